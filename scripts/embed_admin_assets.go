@@ -0,0 +1,62 @@
+// Writes the go file that embeds the admin site in the binary, i.e.
+// src/admin/embedded_assets.go, to stdout
+//
+//	go run scripts/embed_admin_assets.go <admin site dir>
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <admin site dir>\n", os.Args[0])
+		os.Exit(1)
+	}
+	root := os.Args[1]
+
+	files := map[string][]byte{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files["/"+filepath.ToSlash(name)] = content
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the admin site: %s\n", err)
+		os.Exit(1)
+	}
+	if _, ok := files["/index.html"]; !ok {
+		fmt.Fprintf(os.Stderr, "%s doesn't have the index.html of the admin site\n", root)
+		os.Exit(1)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("package admin")
+	fmt.Println()
+	fmt.Println("// generated by scripts/embed_admin_assets.go, don't edit")
+	fmt.Println()
+	fmt.Println("var embeddedAssets = map[string]string{")
+	for _, name := range names {
+		fmt.Printf("\t%q: %q,\n", name, files[name])
+	}
+	fmt.Println("}")
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns the file system the admin site is served from, the directory
+// if it's set and the assets embedded in the binary otherwise. The api
+// lists the interfaces from the same file system, so both servers agree
+// on where the assets are.
+func Assets(dir string) (http.FileSystem, error) {
+	if dir == "" {
+		if len(embeddedAssets) == 0 {
+			return nil, fmt.Errorf("admin.assets isn't set and the admin site isn't embedded in this build, set it to the directory of the admin site")
+		}
+		return newEmbeddedFileSystem(embeddedAssets), nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("admin.assets is %s, the admin site can't be served from it: %s", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("admin.assets is %s, it isn't a directory", dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+		return nil, fmt.Errorf("admin.assets is %s, it doesn't have the index.html of the admin site", dir)
+	}
+	return http.Dir(dir), nil
+}
+
+// Serves nothing, used when the assets of the admin site can't be found
+var NoAssets http.FileSystem = newEmbeddedFileSystem(nil)
+
+// Returns the names of the directories in the directory name of the
+// assets
+func ListDirectories(assets http.FileSystem, name string) ([]string, error) {
+	dir, err := assets.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	directories := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			directories = append(directories, entry.Name())
+		}
+	}
+	return directories, nil
+}
+
+// Serves the assets embedded in the binary, the files are keyed by
+// their slash separated path, e.g. /index.html, the directories are
+// implied by the paths of the files
+type embeddedFileSystem struct {
+	files   map[string]string
+	dirs    map[string][]string
+	modTime time.Time
+}
+
+func newEmbeddedFileSystem(files map[string]string) *embeddedFileSystem {
+	children := map[string]map[string]bool{"/": {}}
+	for name := range files {
+		for child := name; child != "/"; child = path.Dir(child) {
+			parent := path.Dir(child)
+			if children[parent] == nil {
+				children[parent] = map[string]bool{}
+			}
+			children[parent][path.Base(child)] = true
+		}
+	}
+
+	self := &embeddedFileSystem{files: files, dirs: map[string][]string{}, modTime: time.Now()}
+	for dir, names := range children {
+		for name := range names {
+			self.dirs[dir] = append(self.dirs[dir], name)
+		}
+		sort.Strings(self.dirs[dir])
+	}
+	return self
+}
+
+func (self *embeddedFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if content, ok := self.files[name]; ok {
+		return &embeddedFile{Reader: strings.NewReader(content), fs: self, name: name, size: int64(len(content))}, nil
+	}
+	if _, ok := self.dirs[name]; ok {
+		return &embeddedFile{Reader: strings.NewReader(""), fs: self, name: name, dir: true}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+type embeddedFile struct {
+	*strings.Reader
+	fs     *embeddedFileSystem
+	name   string
+	size   int64
+	dir    bool
+	listed int
+}
+
+func (self *embeddedFile) Close() error {
+	return nil
+}
+
+func (self *embeddedFile) Stat() (os.FileInfo, error) {
+	return &embeddedFileInfo{path.Base(self.name), self.size, self.dir, self.fs.modTime}, nil
+}
+
+func (self *embeddedFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !self.dir {
+		return nil, fmt.Errorf("%s isn't a directory", self.name)
+	}
+	children := self.fs.dirs[self.name][self.listed:]
+	if count > 0 {
+		if len(children) == 0 {
+			return nil, io.EOF
+		}
+		if len(children) > count {
+			children = children[:count]
+		}
+	}
+	self.listed += len(children)
+
+	infos := make([]os.FileInfo, 0, len(children))
+	for _, child := range children {
+		file, err := self.fs.Open(path.Join(self.name, child))
+		if err != nil {
+			return nil, err
+		}
+		info, _ := file.Stat()
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+type embeddedFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (self *embeddedFileInfo) Name() string       { return self.name }
+func (self *embeddedFileInfo) Size() int64        { return self.size }
+func (self *embeddedFileInfo) ModTime() time.Time { return self.modTime }
+func (self *embeddedFileInfo) IsDir() bool        { return self.dir }
+func (self *embeddedFileInfo) Sys() interface{}   { return nil }
+
+func (self *embeddedFileInfo) Mode() os.FileMode {
+	if self.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
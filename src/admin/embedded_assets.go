@@ -0,0 +1,7 @@
+package admin
+
+// The admin site served when admin.assets isn't set, keyed by the path
+// of the files. It's empty in the source tree, `make embed_admin_assets`
+// regenerates this file from the build of the admin site before the
+// packages are built.
+var embeddedAssets = map[string]string{}
@@ -1,41 +1,105 @@
 package admin
 
 import (
+	"common"
+	"encoding/base64"
 	"net"
 	"net/http"
 	"strings"
 )
 
+// Authenticates the users of the admin site against the users of the
+// cluster
+type Authenticator interface {
+	AuthenticateClusterAdmin(username, password string) (common.User, error)
+	// returns the user that created the token
+	AuthenticateToken(token string) (common.User, error)
+}
+
 type HttpServer struct {
-	homeDir  string
-	port     string
-	listener net.Listener
-	closed   bool
+	assets        http.FileSystem
+	port          string
+	listener      net.Listener
+	closed        bool
+	authenticator Authenticator
 }
 
 /*
-  homeDir is the directory that is the root of the admin site.
+  assets is the root of the admin site, see Assets.
   port should be a string that looks like ":8080" or whatever port to serve on.
 */
-func NewHttpServer(homeDir, port string) *HttpServer {
-	return &HttpServer{homeDir: homeDir, port: port, closed: true}
+func NewHttpServer(assets http.FileSystem, port string) *HttpServer {
+	return &HttpServer{assets: assets, port: port, closed: true}
 }
 
-func (self *HttpServer) ListenAndServe() {
+// Only lets the cluster admins load the site, anyone can if it's not
+// set
+func (self *HttpServer) SetAuthenticator(authenticator Authenticator) {
+	self.authenticator = authenticator
+}
+
+func (self *HttpServer) ListenAndServe() error {
 	if self.port == "" {
-		return
+		return nil
 	}
 
-	self.closed = false
 	var err error
 	self.listener, err = net.Listen("tcp", self.port)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = http.Serve(self.listener, http.FileServer(http.Dir(self.homeDir)))
+	self.closed = false
+	err = http.Serve(self.listener, self.authenticate(http.FileServer(self.assets)))
 	if !strings.Contains(err.Error(), "closed") {
-		panic(err)
+		return err
+	}
+	return nil
+}
+
+func (self *HttpServer) authenticate(handler http.Handler) http.Handler {
+	if self.authenticator == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := self.authenticateRequest(r)
+		if err != nil || !user.IsClusterAdmin() {
+			w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb admin\"")
+			http.Error(w, "Invalid username/password", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Returns the user of the basic auth or bearer token of the request
+func (self *HttpServer) authenticateRequest(r *http.Request) (common.User, error) {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 {
+		return nil, common.NewAuthenticationError("Missing credentials")
+	}
+	switch fields[0] {
+	case "Bearer":
+		return self.authenticator.AuthenticateToken(fields[1])
+	case "Basic":
+		credentials, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, common.NewAuthenticationError("Bad encoding")
+		}
+		username, password, ok := splitCredentials(string(credentials))
+		if !ok {
+			return nil, common.NewAuthenticationError("Bad auth value")
+		}
+		return self.authenticator.AuthenticateClusterAdmin(username, password)
+	}
+	return nil, common.NewAuthenticationError("Unknown authorization scheme %s", fields[0])
+}
+
+func splitCredentials(credentials string) (string, string, bool) {
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", "", false
 	}
+	return credentials[:i], credentials[i+1:], true
 }
 
 func (self *HttpServer) Close() {
@@ -1,11 +1,14 @@
 package admin
 
 import (
+	"common"
+	"encoding/base64"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"net/http"
 	"path"
 	"testing"
+	"time"
 )
 
 // Hook up gocheck into the gotest runner.
@@ -25,7 +28,7 @@ func (self *HttpServerSuite) TestServesIndexByDefault(c *C) {
 	path := path.Join(dir, "index.html")
 	err := ioutil.WriteFile(path, content, 0644)
 	c.Assert(err, IsNil)
-	s := NewHttpServer(dir, ":8083")
+	s := NewHttpServer(http.Dir(dir), ":8083")
 	go func() { s.ListenAndServe() }()
 	resp, err := http.Get("http://localhost:8083/")
 	c.Assert(err, IsNil)
@@ -35,3 +38,101 @@ func (self *HttpServerSuite) TestServesIndexByDefault(c *C) {
 	c.Assert(string(actualContent), Equals, string(content))
 	c.Assert(err, IsNil)
 }
+
+type mockUser struct {
+	common.User
+	clusterAdmin bool
+}
+
+func (self *mockUser) IsClusterAdmin() bool {
+	return self.clusterAdmin
+}
+
+type mockAuthenticator struct{}
+
+func (self *mockAuthenticator) AuthenticateClusterAdmin(username, password string) (common.User, error) {
+	if password != "root" {
+		return nil, common.NewAuthenticationError("Invalid username/password")
+	}
+	return &mockUser{clusterAdmin: true}, nil
+}
+
+func (self *mockAuthenticator) AuthenticateToken(token string) (common.User, error) {
+	switch token {
+	case "admin":
+		return &mockUser{clusterAdmin: true}, nil
+	case "dbuser":
+		return &mockUser{clusterAdmin: false}, nil
+	}
+	return nil, common.NewAuthenticationError("Invalid or expired token")
+}
+
+func (self *HttpServerSuite) TestOnlyServesClusterAdmins(c *C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(path.Join(dir, "index.html"), []byte("Welcome to Influxdb"), 0644)
+	c.Assert(err, IsNil)
+	s := NewHttpServer(http.Dir(dir), ":8093")
+	s.SetAuthenticator(&mockAuthenticator{})
+	go func() { s.ListenAndServe() }()
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	requests := map[string]int{
+		"": http.StatusUnauthorized,
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("root:root")):  http.StatusOK,
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("root:wrong")): http.StatusUnauthorized,
+		"Bearer admin":  http.StatusOK,
+		"Bearer dbuser": http.StatusUnauthorized,
+	}
+	for authorization, status := range requests {
+		req, err := http.NewRequest("GET", "http://localhost:8093/", nil)
+		c.Assert(err, IsNil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status, Commentf("authorization: %s", authorization))
+	}
+}
+
+func (self *HttpServerSuite) TestServesEmbeddedAssets(c *C) {
+	defer func(assets map[string]string) { embeddedAssets = assets }(embeddedAssets)
+	embeddedAssets = map[string]string{}
+	_, err := Assets("")
+	c.Assert(err, NotNil)
+	_, err = Assets(c.MkDir())
+	c.Assert(err, ErrorMatches, ".*doesn't have the index.html.*")
+
+	embeddedAssets = map[string]string{
+		"/index.html":                    "Welcome to Influxdb",
+		"/interfaces/default/index.html": "default",
+		"/interfaces/default/js/app.js":  "app",
+		"/interfaces/graphs/index.html":  "graphs",
+		"/interfaces/README":             "not an interface",
+	}
+	assets, err := Assets("")
+	c.Assert(err, IsNil)
+	interfaces, err := ListDirectories(assets, "/interfaces")
+	c.Assert(err, IsNil)
+	c.Assert(interfaces, DeepEquals, []string{"default", "graphs"})
+
+	s := NewHttpServer(assets, ":8094")
+	go func() { s.ListenAndServe() }()
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for url, content := range map[string]string{
+		"/":                             "Welcome to Influxdb",
+		"/interfaces/default/js/app.js": "app",
+	} {
+		resp, err := http.Get("http://localhost:8094" + url)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, content)
+	}
+}
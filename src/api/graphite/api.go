@@ -18,10 +18,13 @@ import (
 	. "common"
 	"configuration"
 	"coordinator"
+	"fmt"
 	"io"
 	"net"
 	"protocol"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -37,8 +40,65 @@ type Server struct {
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
 	udpEnabled    bool
+	// used to turn the metric names into series names and columns
+	templateDefinitions []string
+	templates           Templates
+	// the separator of the parts of the metric names and the delimiter
+	// of the key and value of the tags in them
+	separator    string
+	tagDelimiter string
+	// the protocol spoken by the tcp clients, plaintext or pickle
+	protocol string
+	// the plaintext lines longer than maxLineLength bytes and the pickle
+	// frames of more than maxPointsPerFrame metrics are dropped
+	maxLineLength     int
+	maxPointsPerFrame int
+	// the metrics are written once batchSize of them are buffered or
+	// every batchTimeout, whichever comes first
+	batchSize    int
+	batchTimeout time.Duration
+	batchLock    sync.Mutex
+	batch        []*protocol.Series
+	flushDone    chan struct{}
+	stats        Stats
+	// the handlers of the tcp clients and of the udp packets, Close
+	// stops the clients and waits for the handlers before the last
+	// flush. No handler starts once closing is set.
+	handlers  sync.WaitGroup
+	connsLock sync.Mutex
+	conns     map[net.Conn]bool
+	closing   bool
 }
 
+// Counters of the metrics handled by the graphite server
+type Stats struct {
+	Address        string `json:"address"`
+	Database       string `json:"database"`
+	PointsReceived int64  `json:"pointsReceived"`
+	// the points waiting for the next flush
+	PointsBuffered int64 `json:"pointsBuffered"`
+	PointsWritten  int64 `json:"pointsWritten"`
+	WriteErrors    int64 `json:"writeErrors"`
+	// the flushes of full batches and the ones of the batch timeout
+	SizeFlushes     int64 `json:"sizeFlushes"`
+	IntervalFlushes int64 `json:"intervalFlushes"`
+	// the lines and pickle frames dropped because they're over the
+	// limits
+	LinesTooLong   int64 `json:"linesTooLong"`
+	FramesTooLarge int64 `json:"framesTooLarge"`
+}
+
+const (
+	PROTOCOL_PLAINTEXT = "plaintext"
+	PROTOCOL_PICKLE    = "pickle"
+
+	DEFAULT_BATCH_SIZE    = 1000
+	DEFAULT_BATCH_TIMEOUT = time.Second
+
+	DEFAULT_MAX_LINE_LENGTH      = 4096
+	DEFAULT_MAX_POINTS_PER_FRAME = 10000
+)
+
 // TODO: check that database exists and create it if not
 func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
 	self := &Server{}
@@ -46,12 +106,57 @@ func NewServer(config *configuration.Configuration, coord coordinator.Coordinato
 	self.database = config.GraphiteDatabase
 	self.coordinator = coord
 	self.shutdown = make(chan bool, 1)
+	self.conns = make(map[net.Conn]bool)
 	self.clusterConfig = clusterConfig
 	self.udpEnabled = config.GraphiteUdpEnabled
+	self.templateDefinitions = config.GraphiteTemplates
+	self.separator = config.GraphiteSeparator
+	if self.separator == "" {
+		self.separator = DEFAULT_SEPARATOR
+	}
+	self.tagDelimiter = config.GraphiteTagDelimiter
+	self.batchSize = config.GraphiteBatchSize
+	if self.batchSize == 0 {
+		self.batchSize = DEFAULT_BATCH_SIZE
+	}
+	self.batchTimeout = config.GraphiteBatchTimeout
+	if self.batchTimeout == 0 {
+		self.batchTimeout = DEFAULT_BATCH_TIMEOUT
+	}
+	self.protocol = config.GraphiteProtocol
+	if self.protocol == "" {
+		self.protocol = PROTOCOL_PLAINTEXT
+	}
+	self.maxLineLength = config.GraphiteMaxLineLength
+	if self.maxLineLength == 0 {
+		self.maxLineLength = DEFAULT_MAX_LINE_LENGTH
+	}
+	self.maxPointsPerFrame = config.GraphiteMaxPointsPerFrame
+	if self.maxPointsPerFrame == 0 {
+		self.maxPointsPerFrame = DEFAULT_MAX_POINTS_PER_FRAME
+	}
 
 	return self
 }
 
+func (self *Server) Stats() *Stats {
+	self.batchLock.Lock()
+	buffered := len(self.batch)
+	self.batchLock.Unlock()
+	return &Stats{
+		Address:         self.listenAddress,
+		Database:        self.database,
+		PointsReceived:  atomic.LoadInt64(&self.stats.PointsReceived),
+		PointsBuffered:  int64(buffered),
+		PointsWritten:   atomic.LoadInt64(&self.stats.PointsWritten),
+		WriteErrors:     atomic.LoadInt64(&self.stats.WriteErrors),
+		SizeFlushes:     atomic.LoadInt64(&self.stats.SizeFlushes),
+		IntervalFlushes: atomic.LoadInt64(&self.stats.IntervalFlushes),
+		LinesTooLong:    atomic.LoadInt64(&self.stats.LinesTooLong),
+		FramesTooLarge:  atomic.LoadInt64(&self.stats.FramesTooLarge),
+	}
+}
+
 // getAuth assures that the user property is a user with access to the graphite database
 // only call this function after everything (i.e. Raft) is initialized, so that there's at least 1 admin user
 func (self *Server) getAuth() {
@@ -60,22 +165,45 @@ func (self *Server) getAuth() {
 	self.user = self.clusterConfig.GetClusterAdmin(names[0])
 }
 
-func (self *Server) ListenAndServe() {
+func (self *Server) ListenAndServe() error {
 	self.getAuth()
 	var err error
+	self.templates, err = NewTemplates(self.templateDefinitions, self.separator)
+	if err != nil {
+		log.Error("GraphiteServer: %s", err)
+		return err
+	}
+	if self.protocol != PROTOCOL_PLAINTEXT && self.protocol != PROTOCOL_PICKLE {
+		err = fmt.Errorf("GraphiteServer: unknown protocol %s, must be %s or %s", self.protocol, PROTOCOL_PLAINTEXT, PROTOCOL_PICKLE)
+		log.Error(err)
+		return err
+	}
+	if self.batchSize > 1 {
+		self.flushDone = make(chan struct{})
+		go self.flushPeriodically(self.flushDone)
+	}
 	if self.listenAddress != "" {
 		self.conn, err = net.Listen("tcp", self.listenAddress)
 		if err != nil {
 			log.Error("GraphiteServer: Listen: ", err)
-			return
+			return err
 		}
 	}
 	if self.udpEnabled {
-		udpAddress, _ := net.ResolveUDPAddr("udp", self.listenAddress)
-		self.udpConn, _ = net.ListenUDP("udp", udpAddress)
+		udpAddress, err := net.ResolveUDPAddr("udp", self.listenAddress)
+		if err != nil {
+			log.Error("GraphiteServer: ResolveUDPAddr: ", err)
+			return err
+		}
+		self.udpConn, err = net.ListenUDP("udp", udpAddress)
+		if err != nil {
+			log.Error("GraphiteServer: ListenUDP: ", err)
+			return err
+		}
 		go self.ServeUdp(self.udpConn)
 	}
 	self.Serve(self.conn)
+	return nil
 }
 
 func (self *Server) Serve(listener net.Listener) {
@@ -86,11 +214,54 @@ func (self *Server) Serve(listener net.Listener) {
 	for {
 		conn_in, err := listener.Accept()
 		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				log.Info("GraphiteServer: listener closed, no longer accepting connections")
+				return
+			}
 			log.Error("GraphiteServer: Accept: ", err)
 			continue
 		}
-		go self.handleClient(conn_in)
+		if !self.startHandler(conn_in) {
+			conn_in.Close()
+			return
+		}
+		if self.protocol == PROTOCOL_PICKLE {
+			go self.handlePickleClient(conn_in)
+		} else {
+			go self.handleClient(conn_in)
+		}
+	}
+}
+
+// Registers a handler of the client conn, or of a udp packet if conn is
+// nil. Returns false if the server is closing, the handler shouldn't
+// start.
+func (self *Server) startHandler(conn net.Conn) bool {
+	self.connsLock.Lock()
+	defer self.connsLock.Unlock()
+	if self.closing {
+		return false
 	}
+	if conn != nil {
+		self.conns[conn] = true
+	}
+	self.handlers.Add(1)
+	return true
+}
+
+func (self *Server) isClosing() bool {
+	self.connsLock.Lock()
+	defer self.connsLock.Unlock()
+	return self.closing
+}
+
+func (self *Server) handlerDone(conn net.Conn) {
+	if conn != nil {
+		self.connsLock.Lock()
+		delete(self.conns, conn)
+		self.connsLock.Unlock()
+	}
+	self.handlers.Done()
 }
 
 func (self *Server) ServeUdp(conn *net.UDPConn) {
@@ -98,21 +269,36 @@ func (self *Server) ServeUdp(conn *net.UDPConn) {
 	for {
 		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			if strings.Contains(err.Error(), "closed network") {
+				log.Info("GraphiteServer: UDP listener closed, no longer reading packets")
+				return
+			}
 			log.Warn("Error when reading from UDP connection %s", err.Error())
+			continue
+		}
+		if !self.startHandler(nil) {
+			return
 		}
 		go self.handleUdpMessage(string(buf[:n]))
 	}
 }
 
 func (self *Server) handleUdpMessage(msg string) {
+	defer self.handlerDone(nil)
 	metrics := strings.Split(msg, "\n")
 	for _, metric := range metrics {
 		reader := bufio.NewReader(strings.NewReader(metric + "\n"))
-		go self.handleMessage(reader)
+		self.handleMessage(reader)
 	}
 }
 
+// Stops accepting clients and packets, stops the clients once they
+// handled the metrics they sent so far and writes the last batch
 func (self *Server) Close() {
+	self.connsLock.Lock()
+	self.closing = true
+	self.connsLock.Unlock()
+
 	if self.udpConn != nil {
 		log.Info("GraphiteService: Closing graphite UDP listener")
 		self.udpConn.Close()
@@ -120,17 +306,107 @@ func (self *Server) Close() {
 	if self.conn != nil {
 		log.Info("GraphiteServer: Closing graphite server")
 		self.conn.Close()
-		log.Info("GraphiteServer: Waiting for all graphite requests to finish before killing the process")
 		select {
 		case <-time.After(time.Second * 5):
-			log.Error("GraphiteServer: There seems to be a hanging graphite request. Closing anyway")
+			log.Error("GraphiteServer: The graphite listener didn't stop. Closing anyway")
 		case <-self.shutdown:
 		}
 	}
+
+	// the clients' reads fail once they read what was sent before
+	self.connsLock.Lock()
+	for conn := range self.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	self.connsLock.Unlock()
+	log.Info("GraphiteServer: Waiting for all graphite requests to finish before killing the process")
+	handled := make(chan struct{})
+	go func() {
+		self.handlers.Wait()
+		close(handled)
+	}()
+	select {
+	case <-time.After(time.Second * 5):
+		log.Error("GraphiteServer: There seems to be a hanging graphite request. Closing anyway")
+	case <-handled:
+	}
+
+	if self.flushDone != nil {
+		close(self.flushDone)
+		self.flushDone = nil
+	}
+	self.batchLock.Lock()
+	batch := self.takeBatch()
+	self.batchLock.Unlock()
+	if len(batch) > 0 {
+		self.flush(batch)
+	}
+}
+
+// Buffers the series and writes the batch if it's full
+func (self *Server) addToBatch(series *protocol.Series) {
+	atomic.AddInt64(&self.stats.PointsReceived, 1)
+	self.batchLock.Lock()
+	self.batch = append(self.batch, series)
+	if len(self.batch) < self.batchSize {
+		self.batchLock.Unlock()
+		return
+	}
+	batch := self.takeBatch()
+	self.batchLock.Unlock()
+	atomic.AddInt64(&self.stats.SizeFlushes, 1)
+	self.flush(batch)
 }
 
-func (self *Server) writePoints(series *protocol.Series) error {
-	serie := []*protocol.Series{series}
+// Has to be called with the batch lock held
+func (self *Server) takeBatch() []*protocol.Series {
+	batch := self.batch
+	self.batch = nil
+	return batch
+}
+
+func (self *Server) flushPeriodically(done <-chan struct{}) {
+	ticker := time.NewTicker(self.batchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		self.batchLock.Lock()
+		batch := self.takeBatch()
+		self.batchLock.Unlock()
+		if len(batch) > 0 {
+			atomic.AddInt64(&self.stats.IntervalFlushes, 1)
+			self.flush(batch)
+		}
+	}
+}
+
+// Merges the series of the batch with the same name and columns and
+// writes them in one request
+func (self *Server) flush(batch []*protocol.Series) {
+	merged := []*protocol.Series{}
+	seriesByKey := map[string]*protocol.Series{}
+	for _, series := range batch {
+		key := series.GetName() + "\x00" + strings.Join(series.Fields, "\x00")
+		if existing, ok := seriesByKey[key]; ok {
+			existing.Points = append(existing.Points, series.Points...)
+			continue
+		}
+		seriesByKey[key] = series
+		merged = append(merged, series)
+	}
+	if err := self.writePoints(merged); err != nil {
+		atomic.AddInt64(&self.stats.WriteErrors, int64(len(batch)))
+		log.Error("Error in graphite plugin: %s", err)
+		return
+	}
+	atomic.AddInt64(&self.stats.PointsWritten, int64(len(batch)))
+}
+
+func (self *Server) writePoints(serie []*protocol.Series) error {
 	err := self.coordinator.WriteSeriesData(self.user, self.database, serie)
 	if err != nil {
 		switch err.(type) {
@@ -148,7 +424,17 @@ func (self *Server) writePoints(series *protocol.Series) error {
 	return err
 }
 
+func indexOf(strs []string, str string) int {
+	for idx, s := range strs {
+		if s == str {
+			return idx
+		}
+	}
+	return -1
+}
+
 func (self *Server) handleClient(conn net.Conn) {
+	defer self.handlerDone(conn)
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
 	for {
@@ -158,24 +444,87 @@ func (self *Server) handleClient(conn net.Conn) {
 				log.Debug("Client closed graphite connection")
 				return
 			}
+			if self.isClosing() {
+				log.Debug("GraphiteServer: closed a client connection on shutdown")
+				return
+			}
 			log.Error(err)
 			return
 		}
 	}
 }
 
+// Reads batches of metrics sent using the carbon pickle protocol
+func (self *Server) handlePickleClient(conn net.Conn) {
+	defer self.handlerDone(conn)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		metrics, err := ReadPickleFrame(reader, self.maxPointsPerFrame)
+		if err == errTooManyMetrics {
+			if atomic.AddInt64(&self.stats.FramesTooLarge, 1)%1000 == 1 {
+				log.Warn("GraphiteServer: dropping a pickle frame of more than %d metrics", self.maxPointsPerFrame)
+			}
+			continue
+		}
+		if err != nil {
+			if io.EOF == err {
+				log.Debug("Client closed graphite connection")
+				return
+			}
+			if self.isClosing() {
+				log.Debug("GraphiteServer: closed a client connection on shutdown")
+				return
+			}
+			log.Error(err)
+			return
+		}
+		for _, metric := range metrics {
+			self.writeMetric(metric)
+		}
+	}
+}
+
 func (self *Server) handleMessage(reader *bufio.Reader) error {
 	graphiteMetric := &GraphiteMetric{}
-	err := graphiteMetric.Read(reader)
+	err := graphiteMetric.Read(reader, self.maxLineLength)
+	if err == errLineTooLong {
+		if atomic.AddInt64(&self.stats.LinesTooLong, 1)%1000 == 1 {
+			log.Warn("GraphiteServer: dropping a line longer than %d bytes", self.maxLineLength)
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	self.writeMetric(graphiteMetric)
+	return nil
+}
+
+func (self *Server) writeMetric(graphiteMetric *GraphiteMetric) {
+	name := graphiteMetric.name
+	fields := []string{"value"}
 	values := []*protocol.FieldValue{}
 	if graphiteMetric.isInt {
 		values = append(values, &protocol.FieldValue{Int64Value: &graphiteMetric.integerValue})
 	} else {
 		values = append(values, &protocol.FieldValue{DoubleValue: &graphiteMetric.floatValue})
 	}
+	addColumns := func(columns, columnValues []string) {
+		for idx, column := range columns {
+			if indexOf(fields, column) >= 0 {
+				continue
+			}
+			fields = append(fields, column)
+			values = append(values, &protocol.FieldValue{StringValue: &columnValues[idx]})
+		}
+	}
+	name, columns, columnValues := ExtractTags(name, self.separator, self.tagDelimiter)
+	addColumns(columns, columnValues)
+	if template := self.templates.Match(name); template != nil {
+		name, columns, columnValues = template.Apply(name)
+		addColumns(columns, columnValues)
+	}
 	sn := uint64(1) // use same SN makes sure that we'll only keep the latest value for a given metric_id-timestamp pair
 	point := &protocol.Point{
 		Timestamp:      &graphiteMetric.timestamp,
@@ -183,13 +532,9 @@ func (self *Server) handleMessage(reader *bufio.Reader) error {
 		SequenceNumber: &sn,
 	}
 	series := &protocol.Series{
-		Name:   &graphiteMetric.name,
-		Fields: []string{"value"},
+		Name:   &name,
+		Fields: fields,
 		Points: []*protocol.Point{point},
 	}
-	// little inefficient for now, later we might want to add multiple series in 1 writePoints request
-	if err := self.writePoints(series); err != nil {
-		log.Error("Error in graphite plugin: %s", err)
-	}
-	return nil
+	self.addToBatch(series)
 }
@@ -0,0 +1,118 @@
+package graphite
+
+import (
+	"common"
+	"configuration"
+	"coordinator"
+	"fmt"
+	"io"
+	"net"
+	"protocol"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type GraphiteSuite struct {
+	coordinator *MockCoordinator
+	server      *Server
+}
+
+var _ = Suite(&GraphiteSuite{})
+
+type MockCoordinator struct {
+	coordinator.Coordinator
+	lock   sync.Mutex
+	points int
+}
+
+func (self *MockCoordinator) WriteSeriesData(_ common.User, db string, series []*protocol.Series) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, s := range series {
+		self.points += len(s.Points)
+	}
+	return nil
+}
+
+func (self *MockCoordinator) written() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.points
+}
+
+func (self *GraphiteSuite) SetUpTest(c *C) {
+	self.coordinator = &MockCoordinator{}
+	self.server = NewServer(&configuration.Configuration{}, self.coordinator, nil)
+}
+
+// Waits until the server received the points
+func (self *GraphiteSuite) waitForPoints(c *C, points int64) {
+	for i := 0; i < 100 && self.server.Stats().PointsReceived < points; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(self.server.Stats().PointsReceived, Equals, points)
+}
+
+func (self *GraphiteSuite) TestCloseStopsTheClientsAndFlushesTheirMetrics(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	self.server.conn = listener
+	served := make(chan struct{})
+	go func() {
+		self.server.Serve(listener)
+		close(served)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(client, "cpu.load %d 1400000000\n", i)
+	}
+	self.waitForPoints(c, 10)
+	c.Assert(self.coordinator.written(), Equals, 0)
+
+	self.server.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		c.Fatal("the accept loop didn't stop")
+	}
+	c.Assert(self.coordinator.written(), Equals, 10)
+	c.Assert(self.server.Stats().PointsWritten, Equals, int64(10))
+
+	// the server closed the connection of the client
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+	_, err = net.Dial("tcp", listener.Addr().String())
+	c.Assert(err, NotNil)
+}
+
+func (self *GraphiteSuite) TestCloseStopsReadingTheUdpPackets(c *C) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	self.server.udpConn = conn
+	served := make(chan struct{})
+	go func() {
+		self.server.ServeUdp(conn)
+		close(served)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	_, err = client.Write([]byte("cpu.load 1 1400000000\nmem.free 2 1400000000"))
+	c.Assert(err, IsNil)
+	self.waitForPoints(c, 2)
+
+	self.server.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		c.Fatal("the udp server didn't stop")
+	}
+	c.Assert(self.coordinator.written(), Equals, 2)
+}
@@ -2,12 +2,17 @@ package graphite
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 )
 
+// returned for the lines longer than the limit, the line is skipped so
+// the next one can be read
+var errLineTooLong = errors.New("GraphiteServer: line too long")
+
 type GraphiteMetric struct {
 	name         string
 	isInt        bool
@@ -16,8 +21,13 @@ type GraphiteMetric struct {
 	timestamp    int64
 }
 
-func (self *GraphiteMetric) Read(reader *bufio.Reader) error {
-	buf, err := reader.ReadBytes('\n')
+// Reads a plaintext line, the lines longer than maxLineLength bytes
+// are skipped and errLineTooLong is returned, zero doesn't limit them
+func (self *GraphiteMetric) Read(reader *bufio.Reader, maxLineLength int) error {
+	buf, err := readLine(reader, maxLineLength)
+	if err == errLineTooLong {
+		return err
+	}
 	str := strings.TrimSpace(string(buf))
 	if err != nil {
 		if err != io.EOF {
@@ -33,14 +43,11 @@ func (self *GraphiteMetric) Read(reader *bufio.Reader) error {
 		return fmt.Errorf("Received '%s' which doesn't have three fields", str)
 	}
 	self.name = elements[0]
-	self.floatValue, err = strconv.ParseFloat(elements[1], 64)
+	value, err := strconv.ParseFloat(elements[1], 64)
 	if err != nil {
 		return err
 	}
-	if i := int64(self.floatValue); float64(i) == self.floatValue {
-		self.isInt = true
-		self.integerValue = int64(self.floatValue)
-	}
+	self.setValue(value)
 	timestamp, err := strconv.ParseUint(elements[2], 10, 32)
 	if err != nil {
 		return err
@@ -48,3 +55,37 @@ func (self *GraphiteMetric) Read(reader *bufio.Reader) error {
 	self.timestamp = int64(timestamp * 1000000)
 	return nil
 }
+
+// Reads up to the next newline without buffering more than maxLength
+// bytes of the line
+func readLine(reader *bufio.Reader, maxLength int) ([]byte, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			// the newline doesn't count
+			if maxLength > 0 && len(line)+len(chunk) > maxLength+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && err == nil {
+			return nil, errLineTooLong
+		}
+		return line, err
+	}
+}
+
+func (self *GraphiteMetric) setValue(value float64) {
+	self.floatValue = value
+	if i := int64(value); float64(i) == value {
+		self.isInt = true
+		self.integerValue = i
+	}
+}
@@ -0,0 +1,57 @@
+package graphite
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type GraphiteMetricSuite struct{}
+
+var _ = Suite(&GraphiteMetricSuite{})
+
+func (self *GraphiteMetricSuite) TestReadLine(c *C) {
+	for _, test := range []struct {
+		input     string
+		maxLength int
+		lines     []string
+		errs      []error
+	}{
+		{"foo\nbar\n", 0, []string{"foo\n", "bar\n", ""}, []error{nil, nil, io.EOF}},
+		{"foo\nbar", 0, []string{"foo\n", "bar"}, []error{nil, io.EOF}},
+		{"foo\n", 3, []string{"foo\n", ""}, []error{nil, io.EOF}},
+		{"fooo\nbar\n", 3, []string{"", "bar\n"}, []error{errLineTooLong, nil}},
+		// lines longer than the bufio buffer are read in several chunks
+		{strings.Repeat("a", 100) + "\nbar\n", 50, []string{"", "bar\n"}, []error{errLineTooLong, nil}},
+		{strings.Repeat("a", 100) + "\nbar\n", 0, []string{strings.Repeat("a", 100) + "\n", "bar\n"}, []error{nil, nil}},
+	} {
+		reader := bufio.NewReaderSize(strings.NewReader(test.input), 16)
+		for i, expected := range test.lines {
+			line, err := readLine(reader, test.maxLength)
+			c.Assert(err, Equals, test.errs[i], Commentf("%q line %d", test.input, i))
+			c.Assert(string(line), Equals, expected, Commentf("%q line %d", test.input, i))
+		}
+	}
+}
+
+func (self *GraphiteMetricSuite) TestRead(c *C) {
+	reader := bufio.NewReader(strings.NewReader("cpu.load 1.5 1400000000\n" + strings.Repeat("a", 20) + " 1 1400000000\nmem.free 42 1400000010\n"))
+
+	metric := &GraphiteMetric{}
+	c.Assert(metric.Read(reader, 30), IsNil)
+	c.Assert(metric.name, Equals, "cpu.load")
+	c.Assert(metric.floatValue, Equals, 1.5)
+	c.Assert(metric.timestamp, Equals, int64(1400000000000000))
+
+	// the long line is skipped and the next one is still read
+	c.Assert(metric.Read(reader, 30), Equals, errLineTooLong)
+	metric = &GraphiteMetric{}
+	c.Assert(metric.Read(reader, 30), IsNil)
+	c.Assert(metric.name, Equals, "mem.free")
+	c.Assert(metric.isInt, Equals, true)
+	c.Assert(metric.integerValue, Equals, int64(42))
+
+	c.Assert(metric.Read(reader, 30), Equals, io.EOF)
+}
@@ -0,0 +1,468 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// pickle frames larger than this are rejected
+const MAX_PICKLE_FRAME_SIZE = 16 * 1024 * 1024
+
+// returned for the frames of more metrics than the limit, the frame is
+// read so the next one can be, but the lists in it are only built up to
+// the limit
+var errTooManyMetrics = errors.New("GraphiteServer: too many metrics in the pickle frame")
+
+// Reads a frame of the carbon pickle protocol, which is a 4 byte big
+// endian length followed by a pickled list of (path, (timestamp,
+// value)) tuples, and returns the metrics in it. The frames of more
+// than maxMetrics metrics are dropped, zero doesn't limit them.
+func ReadPickleFrame(reader io.Reader, maxMetrics int) ([]*GraphiteMetric, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > MAX_PICKLE_FRAME_SIZE {
+		return nil, fmt.Errorf("GraphiteServer: pickle frame of %d bytes is too large", length)
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, fmt.Errorf("GraphiteServer: incomplete pickle frame: %s", err)
+	}
+
+	value, err := unpickle(bufio.NewReader(bytes.NewReader(frame)), maxMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	tuples, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("GraphiteServer: expected a list of metrics but got %T", value)
+	}
+	metrics := make([]*GraphiteMetric, 0, len(tuples))
+	for _, tuple := range tuples {
+		metric, err := pickledMetric(tuple)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func pickledMetric(value interface{}) (*GraphiteMetric, error) {
+	tuple, ok := value.([]interface{})
+	if !ok || len(tuple) != 2 {
+		return nil, fmt.Errorf("GraphiteServer: expected a (path, (timestamp, value)) tuple but got %v", value)
+	}
+	name, ok := tuple[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("GraphiteServer: metric path must be a string but is %T", tuple[0])
+	}
+	datapoint, ok := tuple[1].([]interface{})
+	if !ok || len(datapoint) != 2 {
+		return nil, fmt.Errorf("GraphiteServer: expected a (timestamp, value) tuple for %s but got %v", name, tuple[1])
+	}
+	timestamp, err := pickledNumber(datapoint[0])
+	if err != nil {
+		return nil, err
+	}
+	v, err := pickledNumber(datapoint[1])
+	if err != nil {
+		return nil, err
+	}
+
+	metric := &GraphiteMetric{name: name, timestamp: int64(timestamp) * 1000000}
+	metric.setValue(v)
+	return metric, nil
+}
+
+func pickledNumber(value interface{}) (float64, error) {
+	switch x := value.(type) {
+	case int64:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case string:
+		return strconv.ParseFloat(x, 64)
+	default:
+		return 0, fmt.Errorf("GraphiteServer: expected a number but got %T", value)
+	}
+}
+
+// pickle opcodes, see pickletools.py. Only the ones needed to decode
+// lists and tuples of strings and numbers are supported.
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opInt             = 'I'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opLong            = 'L'
+	opNone            = 'N'
+	opFloat           = 'F'
+	opBinFloat        = 'G'
+	opString          = 'S'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opUnicode         = 'V'
+	opBinUnicode      = 'X'
+	opAppend          = 'a'
+	opAppends         = 'e'
+	opList            = 'l'
+	opEmptyList       = ']'
+	opTuple           = 't'
+	opEmptyTuple      = ')'
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opProto           = 0x80
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opNewTrue         = 0x88
+	opNewFalse        = 0x89
+	opLong1           = 0x8a
+	opShortBinUnicode = 0x8c
+	opMemoize         = 0x94
+	opFrame           = 0x95
+)
+
+// marks the start of a tuple or list on the stack
+type pickleMark struct{}
+
+type unpickler struct {
+	reader *bufio.Reader
+	stack  []interface{}
+	memo   map[int64]interface{}
+	// the lists longer than this are rejected, zero doesn't limit them
+	maxListLength int
+}
+
+func unpickle(reader *bufio.Reader, maxListLength int) (interface{}, error) {
+	u := &unpickler{reader: reader, memo: make(map[int64]interface{}), maxListLength: maxListLength}
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("GraphiteServer: truncated pickle: %s", err)
+		}
+		if op == opStop {
+			return u.pop()
+		}
+		if err := u.execute(op); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (self *unpickler) execute(op byte) error {
+	switch op {
+	case opProto:
+		_, err := self.reader.ReadByte()
+		return err
+	case opFrame:
+		_, err := self.readBytes(8)
+		return err
+	case opMark:
+		self.push(pickleMark{})
+	case opPop:
+		_, err := self.pop()
+		return err
+	case opNone:
+		self.push(nil)
+	case opNewTrue:
+		self.push(int64(1))
+	case opNewFalse:
+		self.push(int64(0))
+	case opInt, opLong:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "L")
+		i, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return err
+		}
+		self.push(i)
+	case opBinInt:
+		b, err := self.readBytes(4)
+		if err != nil {
+			return err
+		}
+		self.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case opBinInt1:
+		b, err := self.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		self.push(int64(b))
+	case opBinInt2:
+		b, err := self.readBytes(2)
+		if err != nil {
+			return err
+		}
+		self.push(int64(binary.LittleEndian.Uint16(b)))
+	case opLong1:
+		n, err := self.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		b, err := self.readBytes(int(n))
+		if err != nil {
+			return err
+		}
+		self.push(decodeLong(b))
+	case opFloat:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return err
+		}
+		self.push(f)
+	case opBinFloat:
+		b, err := self.readBytes(8)
+		if err != nil {
+			return err
+		}
+		self.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case opString:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		s, err := strconv.Unquote(line)
+		if err != nil {
+			// python uses single quotes
+			s, err = strconv.Unquote(`"` + strings.Trim(line, "'") + `"`)
+			if err != nil {
+				return err
+			}
+		}
+		self.push(s)
+	case opUnicode:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		self.push(line)
+	case opShortBinString, opShortBinUnicode:
+		n, err := self.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		return self.pushString(int(n))
+	case opBinString, opBinUnicode:
+		b, err := self.readBytes(4)
+		if err != nil {
+			return err
+		}
+		return self.pushString(int(binary.LittleEndian.Uint32(b)))
+	case opEmptyList:
+		self.push([]interface{}{})
+	case opEmptyTuple:
+		self.push([]interface{}{})
+	case opList:
+		items, err := self.popMark()
+		if err != nil {
+			return err
+		}
+		if self.maxListLength > 0 && len(items) > self.maxListLength {
+			return errTooManyMetrics
+		}
+		self.push(items)
+	case opTuple:
+		items, err := self.popMark()
+		if err != nil {
+			return err
+		}
+		self.push(items)
+	case opTuple1, opTuple2, opTuple3:
+		n := int(op-opTuple1) + 1
+		if len(self.stack) < n {
+			return fmt.Errorf("GraphiteServer: pickle stack underflow")
+		}
+		items := make([]interface{}, n)
+		copy(items, self.stack[len(self.stack)-n:])
+		self.stack = self.stack[:len(self.stack)-n]
+		self.push(items)
+	case opAppend:
+		item, err := self.pop()
+		if err != nil {
+			return err
+		}
+		return self.appendToList([]interface{}{item})
+	case opAppends:
+		items, err := self.popMark()
+		if err != nil {
+			return err
+		}
+		return self.appendToList(items)
+	case opPut:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return err
+		}
+		return self.memoize(id)
+	case opBinPut:
+		b, err := self.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		return self.memoize(int64(b))
+	case opLongBinPut:
+		b, err := self.readBytes(4)
+		if err != nil {
+			return err
+		}
+		return self.memoize(int64(binary.LittleEndian.Uint32(b)))
+	case opMemoize:
+		return self.memoize(int64(len(self.memo)))
+	case opGet:
+		line, err := self.readLine()
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return err
+		}
+		return self.get(id)
+	case opBinGet:
+		b, err := self.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		return self.get(int64(b))
+	case opLongBinGet:
+		b, err := self.readBytes(4)
+		if err != nil {
+			return err
+		}
+		return self.get(int64(binary.LittleEndian.Uint32(b)))
+	default:
+		return fmt.Errorf("GraphiteServer: unsupported pickle opcode 0x%x", op)
+	}
+	return nil
+}
+
+func (self *unpickler) push(value interface{}) {
+	self.stack = append(self.stack, value)
+}
+
+func (self *unpickler) pop() (interface{}, error) {
+	if len(self.stack) == 0 {
+		return nil, fmt.Errorf("GraphiteServer: pickle stack underflow")
+	}
+	value := self.stack[len(self.stack)-1]
+	self.stack = self.stack[:len(self.stack)-1]
+	return value, nil
+}
+
+// Pops the items pushed since the last mark
+func (self *unpickler) popMark() ([]interface{}, error) {
+	for idx := len(self.stack) - 1; idx >= 0; idx-- {
+		if _, ok := self.stack[idx].(pickleMark); ok {
+			items := make([]interface{}, len(self.stack)-idx-1)
+			copy(items, self.stack[idx+1:])
+			self.stack = self.stack[:idx]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("GraphiteServer: pickle mark not found")
+}
+
+func (self *unpickler) appendToList(items []interface{}) error {
+	if len(self.stack) == 0 {
+		return fmt.Errorf("GraphiteServer: pickle stack underflow")
+	}
+	list, ok := self.stack[len(self.stack)-1].([]interface{})
+	if !ok {
+		return fmt.Errorf("GraphiteServer: cannot append to %T", self.stack[len(self.stack)-1])
+	}
+	if self.maxListLength > 0 && len(list)+len(items) > self.maxListLength {
+		return errTooManyMetrics
+	}
+	self.stack[len(self.stack)-1] = append(list, items...)
+	return nil
+}
+
+func (self *unpickler) memoize(id int64) error {
+	if len(self.stack) == 0 {
+		return fmt.Errorf("GraphiteServer: pickle stack underflow")
+	}
+	self.memo[id] = self.stack[len(self.stack)-1]
+	return nil
+}
+
+func (self *unpickler) get(id int64) error {
+	value, ok := self.memo[id]
+	if !ok {
+		return fmt.Errorf("GraphiteServer: pickle memo %d not found", id)
+	}
+	self.push(value)
+	return nil
+}
+
+func (self *unpickler) pushString(length int) error {
+	b, err := self.readBytes(length)
+	if err != nil {
+		return err
+	}
+	self.push(string(b))
+	return nil
+}
+
+func (self *unpickler) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > MAX_PICKLE_FRAME_SIZE {
+		return nil, fmt.Errorf("GraphiteServer: invalid pickle length %d", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(self.reader, b)
+	return b, err
+}
+
+func (self *unpickler) readLine() (string, error) {
+	line, err := self.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// Decodes a little endian two's complement integer
+func decodeLong(b []byte) int64 {
+	if len(b) == 0 {
+		return 0
+	}
+	reversed := make([]byte, len(b))
+	for idx := range b {
+		reversed[len(b)-idx-1] = b[idx]
+	}
+	n := new(big.Int).SetBytes(reversed)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return n.Int64()
+}
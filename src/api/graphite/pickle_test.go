@@ -0,0 +1,107 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type PickleSuite struct{}
+
+var _ = Suite(&PickleSuite{})
+
+// the pickles of [('cpu.load', (1400000000, 1.5)), ('mem.free', (1400000010, 42))]
+var (
+	pickleProtocol0 = "(lp0\n(Vcpu.load\np1\n(I1400000000\nF1.5\ntp2\ntp3\na(Vmem.free\np4\n(I1400000010\nI42\ntp5\ntp6\na."
+	pickleProtocol2 = "\x80\x02]q\x00(X\x08\x00\x00\x00cpu.loadq\x01J\x00NrSG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x08\x00\x00\x00mem.freeq\x04J\nNrSK*\x86q\x05\x86q\x06e."
+)
+
+func pickleFrame(pickle string) []byte {
+	frame := make([]byte, 4, 4+len(pickle))
+	binary.BigEndian.PutUint32(frame, uint32(len(pickle)))
+	return append(frame, pickle...)
+}
+
+func (self *PickleSuite) TestReadPickleFrame(c *C) {
+	for _, test := range []struct {
+		name    string
+		frame   []byte
+		metrics int
+		err     string
+	}{
+		{"protocol 0", pickleFrame(pickleProtocol0), 2, ""},
+		{"protocol 2", pickleFrame(pickleProtocol2), 2, ""},
+		{"empty list", pickleFrame("]."), 0, ""},
+		{"truncated frame", pickleFrame(pickleProtocol2)[:20], 0, ".*incomplete pickle frame.*"},
+		{"missing stop", pickleFrame(pickleProtocol2[:len(pickleProtocol2)-1]), 0, ".*truncated pickle.*"},
+		{"missing length", []byte{0, 0}, 0, "unexpected EOF"},
+		{"bad opcode", pickleFrame("]z."), 0, ".*unsupported pickle opcode 0x7a"},
+		{"stack underflow", pickleFrame("a."), 0, ".*stack underflow"},
+		{"unknown memo", pickleFrame("h\x05."), 0, ".*memo 5 not found"},
+		{"not a list", pickleFrame("K\x01."), 0, ".*expected a list of metrics.*"},
+		{"not a metric", pickleFrame("(K\x01l."), 0, ".*expected a \\(path, \\(timestamp, value\\)\\) tuple.*"},
+		{"oversized frame", []byte{0xff, 0xff, 0xff, 0xff}, 0, ".*pickle frame of 4294967295 bytes is too large"},
+		{"oversized string", pickleFrame("X\xff\xff\xff\xff."), 0, ".*invalid pickle length.*"},
+		{"deep nesting", pickleFrame(strings.Repeat("(", 100000) + strings.Repeat("l", 100000) + "."), 0, ".*expected a \\(path, \\(timestamp, value\\)\\) tuple.*"},
+	} {
+		metrics, err := ReadPickleFrame(bytes.NewReader(test.frame), 0)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err, Commentf(test.name))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf(test.name))
+		c.Assert(metrics, HasLen, test.metrics, Commentf(test.name))
+	}
+}
+
+func (self *PickleSuite) TestPickledMetricValues(c *C) {
+	for _, pickle := range []string{pickleProtocol0, pickleProtocol2} {
+		metrics, err := ReadPickleFrame(bytes.NewReader(pickleFrame(pickle)), 0)
+		c.Assert(err, IsNil)
+		c.Assert(metrics, HasLen, 2)
+		c.Assert(metrics[0].name, Equals, "cpu.load")
+		c.Assert(metrics[0].timestamp, Equals, int64(1400000000000000))
+		c.Assert(metrics[0].isInt, Equals, false)
+		c.Assert(metrics[0].floatValue, Equals, 1.5)
+		c.Assert(metrics[1].name, Equals, "mem.free")
+		c.Assert(metrics[1].timestamp, Equals, int64(1400000010000000))
+		c.Assert(metrics[1].isInt, Equals, true)
+		c.Assert(metrics[1].integerValue, Equals, int64(42))
+	}
+}
+
+func (self *PickleSuite) TestTooManyMetrics(c *C) {
+	for _, pickle := range []string{pickleProtocol0, pickleProtocol2} {
+		_, err := ReadPickleFrame(bytes.NewReader(pickleFrame(pickle)), 1)
+		c.Assert(err, Equals, errTooManyMetrics)
+		metrics, err := ReadPickleFrame(bytes.NewReader(pickleFrame(pickle)), 2)
+		c.Assert(err, IsNil)
+		c.Assert(metrics, HasLen, 2)
+	}
+
+	// the lists built with LIST or APPEND are stopped at the limit too
+	_, err := ReadPickleFrame(bytes.NewReader(pickleFrame("(K\x01K\x02K\x03l.")), 2)
+	c.Assert(err, Equals, errTooManyMetrics)
+	_, err = ReadPickleFrame(bytes.NewReader(pickleFrame("]K\x01aK\x02aK\x03a.")), 2)
+	c.Assert(err, Equals, errTooManyMetrics)
+
+	// but not the tuples
+	metrics, err := ReadPickleFrame(bytes.NewReader(pickleFrame("](X\x01\x00\x00\x00a(K\x01K\x02K\x03tta.")), 2)
+	c.Assert(err, ErrorMatches, ".*expected a \\(timestamp, value\\) tuple.*")
+	c.Assert(metrics, IsNil)
+}
+
+func (self *PickleSuite) TestDecodeLong(c *C) {
+	c.Assert(decodeLong(nil), Equals, int64(0))
+	c.Assert(decodeLong([]byte{0xff, 0x00}), Equals, int64(255))
+	c.Assert(decodeLong([]byte{0xff}), Equals, int64(-1))
+	c.Assert(decodeLong([]byte{0x00, 0x80}), Equals, int64(-32768))
+}
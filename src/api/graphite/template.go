@@ -0,0 +1,145 @@
+package graphite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The part of a template that's used as the series name, parts named
+// anything else become columns
+const MEASUREMENT = "measurement"
+
+// The separator of the parts of the metric names and templates unless
+// it's configured
+const DEFAULT_SEPARATOR = "."
+
+// Parses a dotted metric name into a series name and columns, e.g. the
+// template servers.measurement.host.region turns
+// servers.cpu.web01.us-east into the series cpu with the columns
+// host=web01 and region=us-east. Parts of the template that are the
+// same as the metric part are taken literally and dropped. If the
+// metric has more parts than the template the extra parts are
+// appended to the last one.
+type Template struct {
+	filter    string
+	parts     []string
+	separator string
+}
+
+// Parses a template of the form "[filter ]template", the template is
+// only used for metrics starting with filter. The template and the
+// metric names are split at separator.
+func NewTemplate(definition, separator string) (*Template, error) {
+	fields := strings.Fields(definition)
+	template := &Template{separator: separator}
+	switch len(fields) {
+	case 1:
+		template.parts = strings.Split(fields[0], separator)
+	case 2:
+		template.filter = fields[0]
+		template.parts = strings.Split(fields[1], separator)
+	default:
+		return nil, fmt.Errorf("Invalid graphite template '%s'", definition)
+	}
+
+	hasMeasurement := false
+	for _, part := range template.parts {
+		if part == MEASUREMENT {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("Graphite template '%s' has no measurement", definition)
+	}
+	return template, nil
+}
+
+func (self *Template) Matches(metric string) bool {
+	return strings.HasPrefix(metric, self.filter)
+}
+
+// Returns the series name and the columns with their values, in the
+// order they appear in the template
+func (self *Template) Apply(metric string) (string, []string, []string) {
+	metricParts := strings.Split(metric, self.separator)
+	if len(metricParts) > len(self.parts) {
+		last := len(self.parts) - 1
+		metricParts = append(metricParts[:last], strings.Join(metricParts[last:], self.separator))
+	}
+
+	measurement := []string{}
+	columns := []string{}
+	values := []string{}
+	for idx, value := range metricParts {
+		switch part := self.parts[idx]; part {
+		case MEASUREMENT:
+			measurement = append(measurement, value)
+		case value, "":
+			// literal
+		default:
+			columns = append(columns, part)
+			values = append(values, value)
+		}
+	}
+
+	if len(measurement) == 0 {
+		return metric, nil, nil
+	}
+	return strings.Join(measurement, self.separator), columns, values
+}
+
+// Takes the parts of the metric name that are tags, i.e. a key and a
+// value joined with delimiter like host=web01, out of the name and
+// returns them as columns. The name is returned as is if delimiter is
+// empty.
+func ExtractTags(metric, separator, delimiter string) (string, []string, []string) {
+	if delimiter == "" || !strings.Contains(metric, delimiter) {
+		return metric, nil, nil
+	}
+
+	parts := []string{}
+	columns := []string{}
+	values := []string{}
+	for _, part := range strings.Split(metric, separator) {
+		idx := strings.Index(part, delimiter)
+		if idx <= 0 || idx == len(part)-len(delimiter) {
+			parts = append(parts, part)
+			continue
+		}
+		columns = append(columns, part[:idx])
+		values = append(values, part[idx+len(delimiter):])
+	}
+	return strings.Join(parts, separator), columns, values
+}
+
+// A list of templates, the template with the longest matching filter
+// is used for each metric
+type Templates []*Template
+
+func NewTemplates(definitions []string, separator string) (Templates, error) {
+	templates := make(Templates, 0, len(definitions))
+	for _, definition := range definitions {
+		template, err := NewTemplate(definition, separator)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	sort.Stable(templates)
+	return templates, nil
+}
+
+func (self Templates) Len() int           { return len(self) }
+func (self Templates) Less(i, j int) bool { return len(self[i].filter) > len(self[j].filter) }
+func (self Templates) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the template to use for the metric, nil if there's none
+func (self Templates) Match(metric string) *Template {
+	for _, template := range self {
+		if template.Matches(metric) {
+			return template
+		}
+	}
+	return nil
+}
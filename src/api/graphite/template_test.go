@@ -0,0 +1,120 @@
+package graphite
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type TemplateSuite struct{}
+
+var _ = Suite(&TemplateSuite{})
+
+func (self *TemplateSuite) TestNewTemplate(c *C) {
+	for _, test := range []struct {
+		definition string
+		err        string
+	}{
+		{"measurement", ""},
+		{"servers.measurement.host", ""},
+		{"servers measurement.host", ""},
+		{"servers measurement.host extra", "Invalid graphite template .*"},
+		{"", "Invalid graphite template .*"},
+		{"servers.host", "Graphite template 'servers.host' has no measurement"},
+		{"measurement servers.host", "Graphite template .* has no measurement"},
+	} {
+		_, err := NewTemplate(test.definition, DEFAULT_SEPARATOR)
+		if test.err == "" {
+			c.Assert(err, IsNil, Commentf("%q", test.definition))
+		} else {
+			c.Assert(err, ErrorMatches, test.err, Commentf("%q", test.definition))
+		}
+	}
+}
+
+func (self *TemplateSuite) TestApply(c *C) {
+	for _, test := range []struct {
+		template  string
+		separator string
+		metric    string
+		series    string
+		columns   []string
+		values    []string
+	}{
+		{"servers.measurement.host.region", ".", "servers.cpu.web01.us-east", "cpu", []string{"host", "region"}, []string{"web01", "us-east"}},
+		// the parts that aren't the same as the template are columns
+		{"servers.measurement.host", ".", "hosts.cpu.web01", "cpu", []string{"servers", "host"}, []string{"hosts", "web01"}},
+		// the empty parts are dropped
+		{".measurement.host", ".", "servers.cpu.web01", "cpu", []string{"host"}, []string{"web01"}},
+		// the extra parts are appended to the last one
+		{"measurement.host", ".", "cpu.web01.example.com", "cpu", []string{"host"}, []string{"web01.example.com"}},
+		{"host.measurement", ".", "web01.cpu.load", "cpu.load", []string{"host"}, []string{"web01"}},
+		// and the missing parts are left out
+		{"measurement.host.region", ".", "cpu.web01", "cpu", []string{"host"}, []string{"web01"}},
+		// several parts make up the series name
+		{"measurement.measurement.host", ".", "cpu.load.web01", "cpu.load", []string{"host"}, []string{"web01"}},
+		{"measurement_measurement_host", "_", "cpu_load_web01", "cpu_load", []string{"host"}, []string{"web01"}},
+		// the metric is used as is if it has no measurement
+		{"host.region.measurement", ".", "web01.us-east", "web01.us-east", nil, nil},
+	} {
+		template, err := NewTemplate(test.template, test.separator)
+		c.Assert(err, IsNil)
+		series, columns, values := template.Apply(test.metric)
+		comment := Commentf("%s with %s", test.metric, test.template)
+		c.Assert(series, Equals, test.series, comment)
+		c.Assert(columns, DeepEquals, test.columns, comment)
+		c.Assert(values, DeepEquals, test.values, comment)
+	}
+}
+
+func (self *TemplateSuite) TestTemplatesWithTheLongestFilterMatch(c *C) {
+	templates, err := NewTemplates([]string{
+		"measurement.host",
+		"servers.db measurement.host.database",
+		"servers measurement.host",
+	}, DEFAULT_SEPARATOR)
+	c.Assert(err, IsNil)
+
+	for _, test := range []struct {
+		metric string
+		filter string
+	}{
+		{"servers.db.cpu.web01.metrics", "servers.db"},
+		{"servers.web.cpu.web01", "servers"},
+		{"cpu.web01", ""},
+	} {
+		template := templates.Match(test.metric)
+		c.Assert(template, NotNil, Commentf("%s", test.metric))
+		c.Assert(template.filter, Equals, test.filter, Commentf("%s", test.metric))
+	}
+
+	templates, err = NewTemplates([]string{"servers measurement.host"}, DEFAULT_SEPARATOR)
+	c.Assert(err, IsNil)
+	c.Assert(templates.Match("cpu.web01"), IsNil)
+
+	_, err = NewTemplates([]string{"measurement", "host"}, DEFAULT_SEPARATOR)
+	c.Assert(err, NotNil)
+}
+
+func (self *TemplateSuite) TestExtractTags(c *C) {
+	for _, test := range []struct {
+		metric    string
+		delimiter string
+		name      string
+		columns   []string
+		values    []string
+	}{
+		{"cpu.host=web01.region=us-east", "=", "cpu", []string{"host", "region"}, []string{"web01", "us-east"}},
+		{"servers.host=web01.cpu", "=", "servers.cpu", []string{"host"}, []string{"web01"}},
+		{"cpu.host__web01", "__", "cpu", []string{"host"}, []string{"web01"}},
+		// the parts without a key or a value aren't tags
+		{"cpu.=web01.host=", "=", "cpu.=web01.host=", []string{}, []string{}},
+		// the name is returned as is without tags or a delimiter
+		{"cpu.web01", "=", "cpu.web01", nil, nil},
+		{"cpu.host=web01", "", "cpu.host=web01", nil, nil},
+	} {
+		name, columns, values := ExtractTags(test.metric, DEFAULT_SEPARATOR, test.delimiter)
+		comment := Commentf("%s with %q", test.metric, test.delimiter)
+		c.Assert(name, Equals, test.name, comment)
+		c.Assert(columns, DeepEquals, test.columns, comment)
+		c.Assert(values, DeepEquals, test.values, comment)
+	}
+}
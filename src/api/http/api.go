@@ -1,6 +1,9 @@
 package http
 
 import (
+	"admin"
+	"api/graphite"
+	"api/udp"
 	"bytes"
 	"cluster"
 	. "common"
@@ -12,13 +15,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	libhttp "net/http"
 	"parser"
-	"path/filepath"
 	"protocol"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -31,31 +37,69 @@ type HttpServer struct {
 	httpPort       string
 	httpSslPort    string
 	httpSslCert    string
-	adminAssetsDir string
+	adminAssets    libhttp.FileSystem
 	coordinator    coordinator.Coordinator
 	userManager    UserManager
 	shutdown       chan bool
 	clusterConfig  *cluster.ClusterConfiguration
 	raftServer     *coordinator.RaftServer
-	readTimeout    time.Duration
-}
-
-func NewHttpServer(httpPort string, readTimeout time.Duration, adminAssetsDir string, theCoordinator coordinator.Coordinator, userManager UserManager, clusterConfig *cluster.ClusterConfiguration, raftServer *coordinator.RaftServer) *HttpServer {
+	protobufServer *coordinator.ProtobufServer
+	// the read timeout of the requests, accessed atomically since
+	// it's changed while the listeners are serving
+	readTimeout int64
+	// responses are compressed if the client supports it and they're
+	// at least compressionMinSize bytes
+	compressionEnabled bool
+	compressionMinSize int
+	// origins that browsers are allowed to make cross origin requests
+	// from, "*" allows any origin
+	allowedOrigins []string
+	// limits the points per second written, unlimited by default
+	writeRateLimiter *RateLimiter
+	// the maximum number of points of a query response that's buffered
+	// in memory, unlimited if zero
+	maxQueryPoints int
+	// whether the series a query reads that have no points in range are
+	// returned without points instead of being left out
+	emptySeries bool
+	// returns the counters of the udp listeners for /stats
+	udpStats func() []*udp.Stats
+	// the stats of the graphite server, nil if it's disabled
+	graphiteStats func() *graphite.Stats
+	// how long the tokens created by /token are valid
+	tokenTtl time.Duration
+	// the maximum number of writes buffered for a subscription
+	subscriptionBufferSize int
+}
+
+func NewHttpServer(httpPort string, readTimeout time.Duration, adminAssets libhttp.FileSystem, theCoordinator coordinator.Coordinator, userManager UserManager, clusterConfig *cluster.ClusterConfiguration, raftServer *coordinator.RaftServer) *HttpServer {
 	self := &HttpServer{}
 	self.httpPort = httpPort
-	self.adminAssetsDir = adminAssetsDir
+	self.adminAssets = adminAssets
 	self.coordinator = theCoordinator
 	self.userManager = userManager
 	self.shutdown = make(chan bool, 2)
 	self.clusterConfig = clusterConfig
 	self.raftServer = raftServer
-	self.readTimeout = readTimeout
+	self.readTimeout = int64(readTimeout)
+	self.compressionEnabled = true
+	self.compressionMinSize = DEFAULT_COMPRESSION_MIN_SIZE
+	self.subscriptionBufferSize = DEFAULT_SUBSCRIPTION_BUFFER_SIZE
+	self.allowedOrigins = []string{"*"}
+	self.writeRateLimiter = NewRateLimiter(0, 0)
+	self.tokenTtl = 24 * time.Hour
 	return self
 }
 
 const (
 	INVALID_CREDENTIALS_MSG  = "Invalid database/username/password"
 	JSON_PRETTY_PRINT_INDENT = "    "
+
+	// returned when a write exceeds the write rate limits
+	STATUS_TOO_MANY_REQUESTS = 429
+
+	// returned when only some of the points of a write were committed
+	STATUS_MULTI_STATUS = 207
 )
 
 func isPretty(r *libhttp.Request) bool {
@@ -75,6 +119,69 @@ func (self *HttpServer) EnableSsl(addr, certPath string) {
 	return
 }
 
+// Sets how long the tokens are valid, must be called before the server
+// starts
+func (self *HttpServer) SetTokenTtl(ttl time.Duration) {
+	if ttl > 0 {
+		self.tokenTtl = ttl
+	}
+}
+
+// Disables compression of the responses or changes the minimum size
+// of the compressed responses. Must be called before the server starts
+func (self *HttpServer) SetCompression(enabled bool, minSize int) {
+	self.compressionEnabled = enabled
+	if minSize > 0 {
+		self.compressionMinSize = minSize
+	}
+}
+
+// Sets the origins allowed to make cross origin requests, must be
+// called before the server starts
+func (self *HttpServer) SetAllowedOrigins(origins []string) {
+	self.allowedOrigins = origins
+}
+
+// Limits the number of points per second that can be written in total
+// and by each client, zero means unlimited
+func (self *HttpServer) SetWriteRateLimits(global, perClient int) {
+	self.writeRateLimiter = NewRateLimiter(global, perClient)
+}
+
+// Limits the number of points returned by queries whose response is
+// buffered in memory, zero means unlimited. Chunked responses aren't
+// limited.
+func (self *HttpServer) SetMaxQueryPoints(maxPoints int) {
+	self.maxQueryPoints = maxPoints
+}
+
+// Returns the series queried that have no points in range with their
+// columns and no points, clients can override it with the empty_series
+// parameter
+func (self *HttpServer) SetEmptySeries(emptySeries bool) {
+	self.emptySeries = emptySeries
+}
+
+// The maximum number of writes buffered for each subscription, clients
+// can ask for a smaller buffer
+func (self *HttpServer) SetSubscriptionBufferSize(size int) {
+	self.subscriptionBufferSize = size
+}
+
+func (self *HttpServer) SetGraphiteStats(graphiteStats func() *graphite.Stats) {
+	self.graphiteStats = graphiteStats
+}
+
+func (self *HttpServer) SetUdpStats(udpStats func() []*udp.Stats) {
+	self.udpStats = udpStats
+}
+
+// Used by the /health endpoint to report whether the protobuf server
+// is accepting connections from the other nodes in the cluster
+func (self *HttpServer) SetProtobufServer(protobufServer *coordinator.ProtobufServer) {
+	self.protobufServer = protobufServer
+}
+
 func (self *HttpServer) ListenAndServe() {
 	var err error
 	if self.httpPort != "" {
@@ -90,13 +197,13 @@ func (self *HttpServer) registerEndpoint(p *pat.PatternServeMux, method string,
 	version := self.clusterConfig.GetLocalConfiguration().Version
 	switch method {
 	case "get":
-		p.Get(pattern, CompressionHeaderHandler(f, version))
+		p.Get(pattern, HeaderHandler(CompressionHandler(self.compressionEnabled, self.compressionMinSize, f), version, self.allowedOrigins))
 	case "post":
-		p.Post(pattern, HeaderHandler(f, version))
+		p.Post(pattern, HeaderHandler(f, version, self.allowedOrigins))
 	case "del":
-		p.Del(pattern, HeaderHandler(f, version))
+		p.Del(pattern, HeaderHandler(f, version, self.allowedOrigins))
 	}
-	p.Options(pattern, HeaderHandler(self.sendCrossOriginHeader, version))
+	p.Options(pattern, HeaderHandler(self.sendCrossOriginHeader, version, self.allowedOrigins))
 }
 
 func (self *HttpServer) Serve(listener net.Listener) {
@@ -112,10 +219,36 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	// Write points to the given database
 	self.registerEndpoint(p, "post", "/db/:db/series", self.writePoints)
 	self.registerEndpoint(p, "del", "/db/:db/series/:series", self.dropSeries)
+	self.registerEndpoint(p, "del", "/db/:db/series", self.deleteTimeRange)
+
+	// Run queries in the background and poll for their results
+	self.registerEndpoint(p, "post", "/db/:db/query", self.submitQuery)
+	self.registerEndpoint(p, "get", "/db/:db/query/:id", self.getQueryJob)
+	self.registerEndpoint(p, "del", "/db/:db/query/:id", self.deleteQueryJob)
+	self.registerEndpoint(p, "get", "/db/:db/subscribe", self.subscribe)
 	self.registerEndpoint(p, "get", "/db", self.listDatabases)
 	self.registerEndpoint(p, "post", "/db", self.createDatabase)
 	self.registerEndpoint(p, "del", "/db/:name", self.dropDatabase)
 
+	// Get and set how long the data of a database is kept
+	self.registerEndpoint(p, "get", "/db/:db/retention", self.getRetentionPolicy)
+	self.registerEndpoint(p, "post", "/db/:db/retention", self.setRetentionPolicy)
+
+	// Get and set how many times the shards of a database are replicated
+	self.registerEndpoint(p, "get", "/db/:db/replication_factor", self.getReplicationFactor)
+	self.registerEndpoint(p, "post", "/db/:db/replication_factor", self.setReplicationFactor)
+
+	// Get and set what is done with the points written to a series that
+	// already has a point with their timestamp
+	self.registerEndpoint(p, "get", "/db/:db/duplicate_points", self.getDuplicatePointPolicy)
+	self.registerEndpoint(p, "post", "/db/:db/duplicate_points", self.setDuplicatePointPolicy)
+
+	// Named retention policies, written to and queried with the rp
+	// parameter of /db/:db/series
+	self.registerEndpoint(p, "get", "/db/:db/retention_policies", self.listNamedRetentionPolicies)
+	self.registerEndpoint(p, "post", "/db/:db/retention_policies", self.setNamedRetentionPolicy)
+	self.registerEndpoint(p, "del", "/db/:db/retention_policies/:name", self.deleteNamedRetentionPolicy)
+
 	// cluster admins management interface
 	self.registerEndpoint(p, "get", "/cluster_admins", self.listClusterAdmins)
 	self.registerEndpoint(p, "get", "/cluster_admins/authenticate", self.authenticateClusterAdmin)
@@ -123,6 +256,11 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	self.registerEndpoint(p, "post", "/cluster_admins/:user", self.updateClusterAdmin)
 	self.registerEndpoint(p, "del", "/cluster_admins/:user", self.deleteClusterAdmin)
 
+	// bearer tokens
+	self.registerEndpoint(p, "post", "/token", self.createClusterAdminToken)
+	self.registerEndpoint(p, "post", "/db/:db/token", self.createDbUserToken)
+	self.registerEndpoint(p, "del", "/token", self.deleteToken)
+
 	// db users management interface
 	self.registerEndpoint(p, "get", "/db/:db/authenticate", self.authenticateDbUser)
 	self.registerEndpoint(p, "get", "/db/:db/users", self.listDbUsers)
@@ -130,15 +268,25 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	self.registerEndpoint(p, "get", "/db/:db/users/:user", self.showDbUser)
 	self.registerEndpoint(p, "del", "/db/:db/users/:user", self.deleteDbUser)
 	self.registerEndpoint(p, "post", "/db/:db/users/:user", self.updateDbUser)
+	self.registerEndpoint(p, "post", "/db/:db/users/:user/grant", self.grantDbUserPermissions)
+	self.registerEndpoint(p, "post", "/db/:db/users/:user/revoke", self.revokeDbUserPermissions)
 
 	// continuous queries management interface
 	self.registerEndpoint(p, "get", "/db/:db/continuous_queries", self.listDbContinuousQueries)
+	self.registerEndpoint(p, "get", "/db/:db/continuous_queries/status", self.getDbContinuousQueriesStatus)
 	self.registerEndpoint(p, "post", "/db/:db/continuous_queries", self.createDbContinuousQueries)
 	self.registerEndpoint(p, "del", "/db/:db/continuous_queries/:id", self.deleteDbContinuousQueries)
 
 	// healthcheck
 	self.registerEndpoint(p, "get", "/ping", self.ping)
 
+	// readiness of the local subsystems, used by load balancers
+	self.registerEndpoint(p, "get", "/health", self.health)
+
+	// live counters, only available to cluster admins
+	self.registerEndpoint(p, "get", "/stats", self.stats)
+	self.registerEndpoint(p, "get", "/metrics", self.metrics)
+
 	// force a raft log compaction
 	self.registerEndpoint(p, "post", "/raft/force_compaction", self.forceRaftCompaction)
 
@@ -147,10 +295,23 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// cluster config endpoints
 	self.registerEndpoint(p, "get", "/cluster/servers", self.listServers)
+	self.registerEndpoint(p, "get", "/cluster/status", self.clusterStatus)
+	self.registerEndpoint(p, "get", "/cluster/continuous_queries", self.listContinuousQueries)
+	self.registerEndpoint(p, "get", "/cluster/slow_queries", self.listSlowQueries)
 	self.registerEndpoint(p, "del", "/cluster/servers/:id", self.removeServers)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/decommission", self.decommissionServer)
+	self.registerEndpoint(p, "get", "/cluster/servers/:id/decommission", self.getDecommissionStatus)
+	self.registerEndpoint(p, "post", "/cluster/servers/:id/transfer_leadership", self.transferLeadership)
 	self.registerEndpoint(p, "post", "/cluster/shards", self.createShard)
 	self.registerEndpoint(p, "get", "/cluster/shards", self.getShards)
 	self.registerEndpoint(p, "del", "/cluster/shards/:id", self.dropShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/repair", self.repairShard)
+	self.registerEndpoint(p, "get", "/cluster/shards/:id/backup", self.backupShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/restore", self.restoreShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/compact", self.compactShard)
+	self.registerEndpoint(p, "post", "/cluster/rebalance", self.rebalance)
+	self.registerEndpoint(p, "get", "/cluster/rebalance", self.getRebalance)
+	self.registerEndpoint(p, "del", "/cluster/rebalance", self.cancelRebalance)
 
 	// return whether the cluster is in sync or not
 	self.registerEndpoint(p, "get", "/sync", self.isInSync)
@@ -190,12 +351,37 @@ func (self *HttpServer) startSsl(p *pat.PatternServeMux) {
 }
 
 func (self *HttpServer) serveListener(listener net.Listener, p *pat.PatternServeMux) {
-	srv := &libhttp.Server{Handler: p, ReadTimeout: self.readTimeout}
+	srv := &libhttp.Server{Handler: self.withReadTimeout(p), ReadTimeout: self.getReadTimeout()}
 	if err := srv.Serve(listener); err != nil && !strings.Contains(err.Error(), "closed network") {
 		panic(err)
 	}
 }
 
+// Changes the read timeout of the running listeners, the request
+// headers keep using the timeout the listeners were started with
+func (self *HttpServer) SetReadTimeout(readTimeout time.Duration) {
+	atomic.StoreInt64(&self.readTimeout, int64(readTimeout))
+}
+
+func (self *HttpServer) getReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.readTimeout))
+}
+
+// Applies the current read timeout to the body of the requests, the
+// ReadTimeout of a server can't be changed once it's serving
+func (self *HttpServer) withReadTimeout(handler libhttp.Handler) libhttp.Handler {
+	return libhttp.HandlerFunc(func(w libhttp.ResponseWriter, r *libhttp.Request) {
+		deadline := time.Time{}
+		if readTimeout := self.getReadTimeout(); readTimeout > 0 {
+			deadline = time.Now().Add(readTimeout)
+		}
+		if err := libhttp.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+			log.Debug("Couldn't set the read deadline of the request: %s", err)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func (self *HttpServer) Close() {
 	if self.conn != nil {
 		log.Info("Closing http server")
@@ -244,11 +430,23 @@ func (self *AllPointsWriter) done() {
 	self.w.Write(data)
 }
 
+// Streams the series as they come out of the coordinator using
+// chunked transfer encoding. Each series is written as a json object
+// followed by a newline.
 type ChunkWriter struct {
-	w                libhttp.ResponseWriter
-	precision        TimePrecision
-	wroteContentType bool
-	pretty           bool
+	w           libhttp.ResponseWriter
+	precision   TimePrecision
+	wroteHeader bool
+	pretty      bool
+}
+
+func (self *ChunkWriter) writeHeader() {
+	if self.wroteHeader {
+		return
+	}
+	self.wroteHeader = true
+	self.w.Header().Add("content-type", "application/json")
+	self.w.WriteHeader(libhttp.StatusOK)
 }
 
 func (self *ChunkWriter) yield(series *protocol.Series) error {
@@ -256,21 +454,31 @@ func (self *ChunkWriter) yield(series *protocol.Series) error {
 	if err != nil {
 		return err
 	}
-	if !self.wroteContentType {
-		self.wroteContentType = true
-		self.w.Header().Add("content-type", "application/json")
-	}
-	self.w.WriteHeader(libhttp.StatusOK)
+	self.writeHeader()
 	self.w.Write(data)
+	self.w.Write([]byte{'\n'})
 	self.w.(libhttp.Flusher).Flush()
 	return nil
 }
 
+// Once the response started streaming the status code can't be
+// changed, so the error is sent as the last object of the stream
+func (self *ChunkWriter) writeError(err error) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	self.w.Write(data)
+	self.w.Write([]byte{'\n'})
+	self.w.(libhttp.Flusher).Flush()
+}
+
 func (self *ChunkWriter) done() {
+	// make sure the headers are sent if the query didn't return any series
+	self.writeHeader()
 }
 
 func TimePrecisionFromString(s string) (TimePrecision, error) {
 	switch s {
+	case "n":
+		return NanosecondPrecision, nil
 	case "u":
 		return MicrosecondPrecision, nil
 	case "m":
@@ -304,24 +512,100 @@ func (self *HttpServer) query(w libhttp.ResponseWriter, r *libhttp.Request) {
 	pretty := isPretty(r)
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		db, err := self.policyDatabase(user, db, r)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
+		if r.URL.Query().Get("explain") == "true" {
+			plans, err := self.coordinator.ExplainQuery(user, db, query)
+			if err != nil {
+				return errorToStatusCode(err), err.Error()
+			}
+			return libhttp.StatusOK, plans
+		}
 
 		precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
 		if err != nil {
 			return libhttp.StatusBadRequest, err.Error()
 		}
 
+		maxPoints, err := self.queryPointsLimit(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		emptySeries, err := self.includeEmptySeries(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		location, err := queryTimeZone(r)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" && acceptsMsgpack(r) {
+			format = "msgpack"
+		}
+
+		if r.URL.Query().Get("batch") == "true" {
+			if (format != "" && format != "json") || r.URL.Query().Get("chunked") == "true" {
+				return libhttp.StatusBadRequest, "Batch queries can only return json without chunked=true"
+			}
+			return self.batchQuery(user, db, query, location, precision, maxPoints, emptySeries, closeNotification(w))
+		}
+
 		var writer Writer
-		if r.URL.Query().Get("chunked") == "true" {
-			writer = &ChunkWriter{w, precision, false, pretty}
-		} else {
-			writer = &AllPointsWriter{map[string]*protocol.Series{}, w, precision, pretty}
+		var chunkWriter *ChunkWriter
+		switch format {
+		case "csv":
+			epoch := r.URL.Query().Get("time_format") == "epoch"
+			writer = &CsvWriter{map[string]*protocol.Series{}, w, precision, epoch}
+		case "msgpack":
+			if r.URL.Query().Get("chunked") == "true" {
+				return libhttp.StatusBadRequest, "msgpack responses can't be chunked"
+			}
+			writer = &MsgpackWriter{map[string]*protocol.Series{}, w, precision}
+		case "", "json":
+			if r.URL.Query().Get("chunked") == "true" {
+				chunkWriter = &ChunkWriter{w, precision, false, pretty}
+				writer = chunkWriter
+			} else {
+				writer = &AllPointsWriter{map[string]*protocol.Series{}, w, precision, pretty}
+			}
+		default:
+			return libhttp.StatusBadRequest, fmt.Sprintf("Unknown format %s, valid formats are json, csv and msgpack", format)
+		}
+		yield := writer.yield
+		if chunkWriter == nil && maxPoints > 0 {
+			yield = limitPoints(yield, maxPoints)
+		}
+		var emptySeriesWriter *emptySeriesWriter
+		if emptySeries {
+			emptySeriesWriter = newEmptySeriesWriter(yield)
+			yield = emptySeriesWriter.write
+		}
+		seriesWriter := NewSeriesWriter(yield)
+		err = self.coordinator.RunQueryInTimeZone(user, db, query, location, seriesWriter, closeNotification(w))
+		if err == nil && emptySeriesWriter != nil {
+			var queries []*parser.Query
+			if queries, err = parser.ParseQuery(query); err == nil {
+				err = emptySeriesWriter.yieldEmptySeries(queries)
+			}
+		}
+		if err != nil && chunkWriter != nil && chunkWriter.wroteHeader {
+			chunkWriter.writeError(err)
+			return -1, nil
 		}
-		seriesWriter := NewSeriesWriter(writer.yield)
-		err = self.coordinator.RunQuery(user, db, query, seriesWriter)
 		if err != nil {
 			if e, ok := err.(*parser.QueryError); ok {
 				return errorToStatusCode(err), e.PrettyPrint()
 			}
+			if e, ok := err.(*QuotaExceededError); ok {
+				setRetryAfter(w, e.RetryAfter)
+			}
 			return errorToStatusCode(err), err.Error()
 		}
 
@@ -330,6 +614,208 @@ func (self *HttpServer) query(w libhttp.ResponseWriter, r *libhttp.Request) {
 	})
 }
 
+// The results of a statement of a batch query
+type batchResult struct {
+	Series []*SerializedSeries `json:"series"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// Runs the semicolon separated statements of the query concurrently and
+// returns the results of each one in order, a statement that fails
+// only sets the error of its result
+func (self *HttpServer) batchQuery(user User, db, query string, location *time.Location, precision TimePrecision, maxPoints int, emptySeries bool, cancel <-chan bool) (int, interface{}) {
+	writers := []*AllPointsWriter{}
+	emptySeriesWriters := []*emptySeriesWriter{}
+	errs, err := self.coordinator.RunQueries(user, db, query, location, func(int) coordinator.SeriesWriter {
+		writer := &AllPointsWriter{memSeries: map[string]*protocol.Series{}, precision: precision}
+		writers = append(writers, writer)
+		yield := writer.yield
+		if maxPoints > 0 {
+			yield = limitPoints(yield, maxPoints)
+		}
+		if emptySeries {
+			emptySeriesWriter := newEmptySeriesWriter(yield)
+			emptySeriesWriters = append(emptySeriesWriters, emptySeriesWriter)
+			yield = emptySeriesWriter.write
+		}
+		return NewSeriesWriter(yield)
+	}, cancel)
+	if err != nil {
+		if e, ok := err.(*parser.QueryError); ok {
+			return errorToStatusCode(err), e.PrettyPrint()
+		}
+		return errorToStatusCode(err), err.Error()
+	}
+
+	if emptySeries {
+		// RunQueries parsed the same statements
+		queries, _ := parser.ParseQuery(query)
+		for i, emptySeriesWriter := range emptySeriesWriters {
+			if errs[i] == nil && i < len(queries) {
+				errs[i] = emptySeriesWriter.yieldEmptySeries(queries[i : i+1])
+			}
+		}
+	}
+
+	results := make([]*batchResult, 0, len(writers))
+	for i, writer := range writers {
+		result := &batchResult{Series: SerializeSeries(writer.memSeries, precision)}
+		if errs[i] != nil {
+			result.Error = errs[i].Error()
+		}
+		results = append(results, result)
+	}
+	return libhttp.StatusOK, results
+}
+
+// Whether the series without points in range are returned, the
+// empty_series parameter overrides the setting of the server
+func (self *HttpServer) includeEmptySeries(r *libhttp.Request) (bool, error) {
+	switch r.URL.Query().Get("empty_series") {
+	case "":
+		return self.emptySeries, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("empty_series must be true or false")
+}
+
+// Returns the time zone the buckets of group by time() are aligned to,
+// the tz parameter is the name of an IANA time zone, e.g.
+// Europe/Paris, nil aligns them to UTC
+func queryTimeZone(r *libhttp.Request) (*time.Location, error) {
+	timeZone := r.URL.Query().Get("tz")
+	if timeZone == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timeZone)
+	// the servers of the other shards would use their own local time
+	if err != nil || location == time.Local {
+		return nil, fmt.Errorf("Unknown time zone %s, tz must be the name of an IANA time zone, e.g. Europe/Paris", timeZone)
+	}
+	return location, nil
+}
+
+// Returns the maximum number of points the query may buffer, the
+// max_points parameter can lower the limit of the server
+func (self *HttpServer) queryPointsLimit(r *libhttp.Request) (int, error) {
+	param := r.URL.Query().Get("max_points")
+	if param == "" {
+		return self.maxQueryPoints, nil
+	}
+	maxPoints, err := strconv.Atoi(param)
+	if err != nil || maxPoints <= 0 {
+		return 0, fmt.Errorf("max_points must be a positive integer")
+	}
+	if self.maxQueryPoints > 0 && maxPoints > self.maxQueryPoints {
+		return self.maxQueryPoints, nil
+	}
+	return maxPoints, nil
+}
+
+// Fails the query once it yielded more than maxPoints points, so a
+// query without a time condition can't buffer the whole database in
+// memory
+func limitPoints(yield func(*protocol.Series) error, maxPoints int) func(*protocol.Series) error {
+	points := 0
+	return func(series *protocol.Series) error {
+		points += len(series.Points)
+		if points > maxPoints {
+			return fmt.Errorf("Query returned more than %d points, narrow down its time range or use chunked=true", maxPoints)
+		}
+		return yield(series)
+	}
+}
+
+type queryJob struct {
+	Id         string              `json:"id"`
+	Query      string              `json:"query,omitempty"`
+	Status     string              `json:"status,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	StartedAt  int64               `json:"startedAt,omitempty"`
+	FinishedAt int64               `json:"finishedAt,omitempty"`
+	Results    []*SerializedSeries `json:"results,omitempty"`
+}
+
+func (self *HttpServer) submitQuery(w libhttp.ResponseWriter, r *libhttp.Request) {
+	query := r.URL.Query().Get("q")
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		job, err := self.coordinator.SubmitQuery(user, db, query)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, &queryJob{Id: job.Id}
+	})
+}
+
+// Returns the status of the query job and its results once it's done
+func (self *HttpServer) getQueryJob(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	id := r.URL.Query().Get(":id")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		j, err := self.coordinator.GetQueryJob(user, db, id)
+		if err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+
+		job := j.Snapshot()
+		response := &queryJob{
+			Id:        job.Id,
+			Query:     job.Query,
+			Status:    string(job.Status),
+			Error:     job.Error,
+			StartedAt: job.StartedAt.Unix(),
+		}
+		if job.Status == coordinator.QueryJobRunning {
+			return libhttp.StatusOK, response
+		}
+		response.FinishedAt = job.FinishedAt.Unix()
+		if job.Status != coordinator.QueryJobDone {
+			return libhttp.StatusOK, response
+		}
+
+		writer := &AllPointsWriter{memSeries: map[string]*protocol.Series{}}
+		if err := job.ReadResults(writer.yield); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		response.Results = SerializeSeries(writer.memSeries, precision)
+		return libhttp.StatusOK, response
+	})
+}
+
+// Cancels the query job if it's still running and discards its results
+func (self *HttpServer) deleteQueryJob(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	id := r.URL.Query().Get(":id")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		if err := self.coordinator.DeleteQueryJob(user, db, id); err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Returns a channel that's closed when the client closes the
+// connection, used to cancel the query the client was waiting for
+func closeNotification(w libhttp.ResponseWriter) <-chan bool {
+	notifier, ok := w.(libhttp.CloseNotifier)
+	if !ok {
+		return nil
+	}
+	return notifier.CloseNotify()
+}
+
 func errorToStatusCode(err error) int {
 	switch err.(type) {
 	case AuthenticationError:
@@ -338,14 +824,39 @@ func errorToStatusCode(err error) int {
 		return libhttp.StatusForbidden // HTTP 403
 	case DatabaseExistsError:
 		return libhttp.StatusConflict // HTTP 409
+	case *ConsistencyError, *WriteBufferFullError, *QueryQueueFullError, *ShuttingDownError:
+		return libhttp.StatusServiceUnavailable // HTTP 503
+	case *QuotaExceededError:
+		return STATUS_TOO_MANY_REQUESTS // HTTP 429
 	default:
 		return libhttp.StatusBadRequest // HTTP 400
 	}
 }
 
+// Tells the client how long to wait before retrying the request
+func setRetryAfter(w libhttp.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// Returns the precision given by the `precision` parameter, or the
+// older `time_precision` if it isn't set
+func writePrecision(r *libhttp.Request) (TimePrecision, error) {
+	if precision := r.URL.Query().Get("precision"); precision != "" {
+		return TimePrecisionFromString(precision)
+	}
+	return TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+}
+
 func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
-	precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+	precision, err := writePrecision(r)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	consistency, err := cluster.ParseConsistencyLevel(r.URL.Query().Get("consistency"))
 	if err != nil {
 		w.WriteHeader(libhttp.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -353,14 +864,21 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 	}
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		db, err := self.policyDatabase(user, db, r)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
 		reader := r.Body
 		encoding := r.Header.Get("Content-Encoding")
 		switch encoding {
 		case "gzip":
-			reader, err = gzip.NewReader(r.Body)
+			gzipReader, err := gzip.NewReader(r.Body)
 			if err != nil {
-				return libhttp.StatusInternalServerError, err.Error()
+				return libhttp.StatusBadRequest, err.Error()
 			}
+			defer gzipReader.Close()
+			reader = gzipReader
 		default:
 			// assume it's plain text
 		}
@@ -377,33 +895,98 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 			return libhttp.StatusBadRequest, err.Error()
 		}
 
-		// convert the wire format to the internal representation of the time series
+		if wait := self.writeRateLimiter.Take(r.RemoteAddr, countPoints(serializedSeries)); wait > 0 {
+			setRetryAfter(w, wait)
+			return STATUS_TOO_MANY_REQUESTS, "Write rate limit exceeded"
+		}
+
+		// convert the wire format to the internal representation of the time
+		// series, invalid points are reported back instead of failing the batch
 		dataStoreSeries := make([]*protocol.Series, 0, len(serializedSeries))
-		for _, s := range serializedSeries {
+		// the index of each of dataStoreSeries in the request body and the
+		// indexes of their points in the series of the body
+		seriesIndexes := make([]int, 0, len(serializedSeries))
+		pointIndexes := make([][]int, 0, len(serializedSeries))
+		pointErrors := []*PointError{}
+		totalPoints := 0
+		now := precision.Truncate(CurrentTime())
+		for seriesIndex, s := range serializedSeries {
 			if len(s.Points) == 0 {
 				continue
 			}
+			totalPoints += len(s.Points)
 
-			series, err := ConvertToDataStoreSeries(s, precision)
-			if err != nil {
-				return libhttp.StatusBadRequest, err.Error()
+			if s.Name == "" {
+				for pointIndex := range s.Points {
+					pointErrors = append(pointErrors, NewPointError(seriesIndex, pointIndex, errors.New("Series name cannot be empty")))
+				}
+				continue
+			}
+
+			series, indexes, errs := ConvertValidPointsToDataStoreSeries(s, seriesIndex, precision)
+			pointErrors = append(pointErrors, errs...)
+			if len(series.Points) == 0 {
+				continue
+			}
+
+			// points without a timestamp get the server time at the
+			// requested precision
+			for _, point := range series.Points {
+				if point.Timestamp == nil {
+					point.Timestamp = &now
+				}
 			}
 
 			dataStoreSeries = append(dataStoreSeries, series)
+			seriesIndexes = append(seriesIndexes, seriesIndex)
+			pointIndexes = append(pointIndexes, indexes)
 		}
 
-		err = self.coordinator.WriteSeriesData(user, db, dataStoreSeries)
+		if len(dataStoreSeries) > 0 {
+			err = self.coordinator.WriteSeriesDataWithConsistency(user, db, dataStoreSeries, consistency)
+			if partialErr, ok := err.(*PartialWriteError); ok {
+				for _, pointError := range partialErr.Errors {
+					pointError.Point = pointIndexes[pointError.Series][pointError.Point]
+					pointError.Series = seriesIndexes[pointError.Series]
+					pointErrors = append(pointErrors, pointError)
+				}
+			} else if quotaErr, ok := err.(*QuotaExceededError); ok {
+				setRetryAfter(w, quotaErr.RetryAfter)
+				return errorToStatusCode(err), err.Error()
+			} else if err != nil {
+				return errorToStatusCode(err), err.Error()
+			}
+		}
 
-		if err != nil {
-			return errorToStatusCode(err), err.Error()
+		if len(pointErrors) == 0 {
+			return libhttp.StatusOK, nil
 		}
 
-		return libhttp.StatusOK, nil
+		result := &batchWriteResult{pointErrors}
+		if len(pointErrors) == totalPoints {
+			return libhttp.StatusBadRequest, result
+		}
+		return STATUS_MULTI_STATUS, result
 	})
 }
 
+func countPoints(series []*SerializedSeries) int {
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	return points
+}
+
+// The body returned when some of the points of a write were rejected
+type batchWriteResult struct {
+	Errors []*PointError `json:"errors"`
+}
+
 type createDatabaseRequest struct {
 	Name string `json:"name"`
+	// the replication factor of the cluster is used if it's not set
+	ReplicationFactor uint8 `json:"replicationFactor"`
 }
 
 func (self *HttpServer) listDatabases(w libhttp.ResponseWriter, r *libhttp.Request) {
@@ -427,7 +1010,7 @@ func (self *HttpServer) createDatabase(w libhttp.ResponseWriter, r *libhttp.Requ
 		if err != nil {
 			return libhttp.StatusBadRequest, err.Error()
 		}
-		err = self.coordinator.CreateDatabase(user, createRequest.Name)
+		err = self.coordinator.CreateDatabase(user, createRequest.Name, createRequest.ReplicationFactor)
 		if err != nil {
 			log.Error("Cannot create database %s. Error: %s", createRequest.Name, err)
 			return errorToStatusCode(err), err.Error()
@@ -448,54 +1031,348 @@ func (self *HttpServer) dropDatabase(w libhttp.ResponseWriter, r *libhttp.Reques
 	})
 }
 
-func (self *HttpServer) dropSeries(w libhttp.ResponseWriter, r *libhttp.Request) {
+// The retention is a duration like 30d, empty if the data is kept
+// forever
+type retentionPolicy struct {
+	Retention string `json:"retention"`
+}
+
+func (self *HttpServer) getRetentionPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
-	series := r.URL.Query().Get(":series")
 
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
-		f := func(s *protocol.Series) error {
-			return nil
-		}
-		seriesWriter := NewSeriesWriter(f)
-		err := self.coordinator.RunQuery(user, db, fmt.Sprintf("drop series %s", series), seriesWriter)
+		retention, err := self.coordinator.GetRetentionPolicy(user, db)
 		if err != nil {
 			return errorToStatusCode(err), err.Error()
 		}
-		return libhttp.StatusNoContent, nil
+		return libhttp.StatusOK, &retentionPolicy{formatRetention(retention)}
 	})
 }
 
-type Point struct {
-	Timestamp      int64         `json:"timestamp"`
-	SequenceNumber uint32        `json:"sequenceNumber"`
-	Values         []interface{} `json:"values"`
-}
+func (self *HttpServer) setRetentionPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
 
-func serializeSingleSeries(series *protocol.Series, precision TimePrecision, pretty bool) ([]byte, error) {
-	arg := map[string]*protocol.Series{"": series}
-	if pretty {
-		return json.MarshalIndent(SerializeSeries(arg, precision)[0], "", JSON_PRETTY_PRINT_INDENT)
-	} else {
-		return json.Marshal(SerializeSeries(arg, precision)[0])
-	}
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		policy := &retentionPolicy{}
+		if err := json.Unmarshal(body, policy); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		var retention time.Duration
+		if policy.Retention != "" {
+			nanoseconds, err := ParseTimeDuration(policy.Retention)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+			retention = time.Duration(nanoseconds)
+		}
+
+		if err := self.coordinator.SetRetentionPolicy(user, db, retention); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
 }
 
-func serializeMultipleSeries(series map[string]*protocol.Series, precision TimePrecision, pretty bool) ([]byte, error) {
-	if pretty {
-		return json.MarshalIndent(SerializeSeries(series, precision), "", JSON_PRETTY_PRINT_INDENT)
-	} else {
-		return json.Marshal(SerializeSeries(series, precision))
-	}
+// Zero uses the replication factor of the cluster. A change only
+// applies to the shards created after it, the existing ones keep their
+// replicas.
+type replicationFactor struct {
+	ReplicationFactor uint8 `json:"replicationFactor"`
 }
 
-// // cluster admins management interface
+func (self *HttpServer) getReplicationFactor(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
 
-func toBytes(body interface{}, pretty bool) ([]byte, string, error) {
-	if body == nil {
-		return nil, "text/plain", nil
-	}
-	switch x := body.(type) {
-	case string:
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		factor, err := self.coordinator.GetDatabaseReplicationFactor(user, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, &replicationFactor{uint8(factor)}
+	})
+}
+
+func (self *HttpServer) setReplicationFactor(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		factor := &replicationFactor{}
+		if err := json.Unmarshal(body, factor); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.coordinator.SetDatabaseReplicationFactor(user, db, factor.ReplicationFactor); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// One of keep, overwrite and reject, keep if it's empty
+type duplicatePointPolicy struct {
+	Policy string `json:"policy"`
+}
+
+func (self *HttpServer) getDuplicatePointPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		policy, err := self.coordinator.GetDuplicatePointPolicy(user, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, &duplicatePointPolicy{string(policy)}
+	})
+}
+
+func (self *HttpServer) setDuplicatePointPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		request := &duplicatePointPolicy{}
+		if err := json.Unmarshal(body, request); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		policy, err := cluster.ParseDuplicatePointPolicy(request.Policy)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.coordinator.SetDuplicatePointPolicy(user, db, policy); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// A named retention policy, the retention is formatted like the one of
+// retentionPolicy
+type namedRetentionPolicy struct {
+	Name      string `json:"name"`
+	Retention string `json:"retention"`
+}
+
+func (self *HttpServer) listNamedRetentionPolicies(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		policies, err := self.coordinator.ListNamedRetentionPolicies(user, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		names := make([]string, 0, len(policies))
+		for name := range policies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result := make([]*namedRetentionPolicy, 0, len(names))
+		for _, name := range names {
+			result = append(result, &namedRetentionPolicy{name, formatRetention(policies[name])})
+		}
+		return libhttp.StatusOK, result
+	})
+}
+
+// Creates the named policy or changes its retention
+func (self *HttpServer) setNamedRetentionPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		policy := &namedRetentionPolicy{}
+		if err := json.Unmarshal(body, policy); err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		var retention time.Duration
+		if policy.Retention != "" {
+			nanoseconds, err := ParseTimeDuration(policy.Retention)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+			retention = time.Duration(nanoseconds)
+		}
+
+		if err := self.coordinator.SetNamedRetentionPolicy(user, db, policy.Name, retention); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Deletes the named policy along with its points
+func (self *HttpServer) deleteNamedRetentionPolicy(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	name := r.URL.Query().Get(":name")
+
+	self.tryAsClusterAdmin(w, r, func(user User) (int, interface{}) {
+		if err := self.coordinator.DeleteNamedRetentionPolicy(user, db, name); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+// Returns the database to write to or query, the one of the named
+// retention policy in the rp parameter if it's set
+func (self *HttpServer) policyDatabase(user User, db string, r *libhttp.Request) (string, error) {
+	return self.coordinator.RetentionPolicyDatabase(user, db, r.URL.Query().Get("rp"))
+}
+
+// Formats the retention using the largest unit that divides it, so it
+// can be parsed back by ParseTimeDuration
+func formatRetention(retention time.Duration) string {
+	if retention == 0 {
+		return ""
+	}
+	units := []struct {
+		suffix   string
+		duration time.Duration
+	}{
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, unit := range units {
+		if retention%unit.duration == 0 {
+			return fmt.Sprintf("%d%s", retention/unit.duration, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%du", retention/time.Microsecond)
+}
+
+// Drops the series, or only deletes its points between the start and
+// end parameters if they're set
+func (self *HttpServer) dropSeries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	series := r.URL.Query().Get(":series")
+	start, end, ok, err := deleteTimeRange(r)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	query := fmt.Sprintf("drop series %s", series)
+	if ok {
+		name := fmt.Sprintf("\"%s\"", strings.Replace(series, "\"", "\\\"", -1))
+		query = deleteQuery(name, start, end)
+	}
+	self.runDestructiveQuery(w, r, query)
+}
+
+// Deletes the points of all the series between the start and end
+// parameters. The shards that are entirely in the time range are
+// dropped if the database is the only one.
+func (self *HttpServer) deleteTimeRange(w libhttp.ResponseWriter, r *libhttp.Request) {
+	start, end, ok, err := deleteTimeRange(r)
+	if err == nil && !ok {
+		err = fmt.Errorf("The start and end parameters have to be set")
+	}
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	self.runDestructiveQuery(w, r, deleteQuery("/.*/", start, end))
+}
+
+func (self *HttpServer) runDestructiveQuery(w libhttp.ResponseWriter, r *libhttp.Request, query string) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		f := func(s *protocol.Series) error {
+			return nil
+		}
+		seriesWriter := NewSeriesWriter(f)
+		err := self.coordinator.RunQuery(user, db, query, seriesWriter)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusNoContent, nil
+	})
+}
+
+// Returns the start and end parameters in microseconds, they're in the
+// precision given by the precision parameter. ok is false if neither
+// is set.
+func deleteTimeRange(r *libhttp.Request) (start, end int64, ok bool, err error) {
+	q := r.URL.Query()
+	if q.Get("start") == "" && q.Get("end") == "" {
+		return 0, 0, false, nil
+	}
+	precision, err := writePrecision(r)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	start, err = strconv.ParseInt(q.Get("start"), 10, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("Invalid start %s", q.Get("start"))
+	}
+	end, err = strconv.ParseInt(q.Get("end"), 10, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("Invalid end %s", q.Get("end"))
+	}
+	if end < start {
+		return 0, 0, false, fmt.Errorf("The end has to be after the start")
+	}
+	return precision.ToMicroseconds(start), precision.ToMicroseconds(end), true, nil
+}
+
+// Returns a query that deletes the points of the series between start
+// and end inclusive
+func deleteQuery(series string, start, end int64) string {
+	return fmt.Sprintf("delete from %s where time > %du and time < %du", series, start-1, end+1)
+}
+
+type Point struct {
+	Timestamp      int64         `json:"timestamp"`
+	SequenceNumber uint32        `json:"sequenceNumber"`
+	Values         []interface{} `json:"values"`
+}
+
+func serializeSingleSeries(series *protocol.Series, precision TimePrecision, pretty bool) ([]byte, error) {
+	arg := map[string]*protocol.Series{"": series}
+	if pretty {
+		return json.MarshalIndent(SerializeSeries(arg, precision)[0], "", JSON_PRETTY_PRINT_INDENT)
+	} else {
+		return json.Marshal(SerializeSeries(arg, precision)[0])
+	}
+}
+
+func serializeMultipleSeries(series map[string]*protocol.Series, precision TimePrecision, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(SerializeSeries(series, precision), "", JSON_PRETTY_PRINT_INDENT)
+	} else {
+		return json.Marshal(SerializeSeries(series, precision))
+	}
+}
+
+// // cluster admins management interface
+
+func toBytes(body interface{}, pretty bool) ([]byte, string, error) {
+	if body == nil {
+		return nil, "text/plain", nil
+	}
+	switch x := body.(type) {
+	case string:
 		return []byte(x), "text/plain", nil
 	case []byte:
 		return x, "text/plain", nil
@@ -531,7 +1408,7 @@ func getUsernameAndPassword(r *libhttp.Request) (string, string, error) {
 	}
 
 	auth := r.Header.Get("Authorization")
-	if auth == "" {
+	if auth == "" || getAuthToken(r) != "" {
 		return "", "", nil
 	}
 
@@ -553,6 +1430,28 @@ func getUsernameAndPassword(r *libhttp.Request) (string, string, error) {
 	return fields[0], fields[1], nil
 }
 
+// Returns the token of an "Authorization: Bearer <token>" header
+func getAuthToken(r *libhttp.Request) string {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 || fields[0] != "Bearer" {
+		return ""
+	}
+	return fields[1]
+}
+
+// Returns the user that created the token, the token has to be created
+// by a cluster admin or by a user of db
+func (self *HttpServer) authenticateToken(token, db string) (User, error) {
+	user, err := self.userManager.AuthenticateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsClusterAdmin() && (db == "" || user.GetDb() != db) {
+		return nil, NewAuthorizationError("Invalid or expired token")
+	}
+	return user, nil
+}
+
 func (self *HttpServer) tryAsClusterAdmin(w libhttp.ResponseWriter, r *libhttp.Request, yield func(User) (int, interface{})) {
 	username, password, err := getUsernameAndPassword(r)
 	if err != nil {
@@ -561,14 +1460,20 @@ func (self *HttpServer) tryAsClusterAdmin(w libhttp.ResponseWriter, r *libhttp.R
 		return
 	}
 
-	if username == "" {
+	token := getAuthToken(r)
+	if username == "" && token == "" {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		w.WriteHeader(libhttp.StatusUnauthorized)
 		w.Write([]byte(INVALID_CREDENTIALS_MSG))
 		return
 	}
 
-	user, err := self.userManager.AuthenticateClusterAdmin(username, password)
+	var user User
+	if token != "" {
+		user, err = self.authenticateToken(token, "")
+	} else {
+		user, err = self.userManager.AuthenticateClusterAdmin(username, password)
+	}
 	if err != nil {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		w.WriteHeader(libhttp.StatusUnauthorized)
@@ -609,11 +1514,37 @@ type ApiUser struct {
 type UserDetail struct {
 	Name    string `json:"name"`
 	IsAdmin bool   `json:"isAdmin"`
+	// the regexes of the series the user can read from and write to
+	ReadFrom []string `json:"readFrom,omitempty"`
+	WriteTo  []string `json:"writeTo,omitempty"`
+}
+
+func newUserDetail(user User, db string) *UserDetail {
+	detail := &UserDetail{Name: user.GetName(), IsAdmin: user.IsDbAdmin(db)}
+	if dbUser, ok := user.(*cluster.DbUser); ok {
+		for _, matcher := range dbUser.ReadFrom {
+			detail.ReadFrom = append(detail.ReadFrom, matcher.Name)
+		}
+		for _, matcher := range dbUser.WriteTo {
+			detail.WriteTo = append(detail.WriteTo, matcher.Name)
+		}
+	}
+	return detail
+}
+
+// The access given or taken away by the grant and revoke endpoints,
+// permission is one of read, write or all
+type UserPermission struct {
+	Permission string `json:"permission"`
+	Matcher    string `json:"matcher"`
 }
 
 type ContinuousQuery struct {
 	Id    int64  `json:"id"`
 	Query string `json:"query"`
+	// when creating a query, how much of the existing data it's run
+	// over, e.g. 30d
+	Backfill string `json:"backfill,omitempty"`
 }
 
 type NewContinuousQuery struct {
@@ -717,12 +1648,18 @@ func (self *HttpServer) tryAsDbUser(w libhttp.ResponseWriter, r *libhttp.Request
 
 	db := r.URL.Query().Get(":db")
 
-	if username == "" {
+	token := getAuthToken(r)
+	if username == "" && token == "" {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		return libhttp.StatusUnauthorized, []byte(INVALID_CREDENTIALS_MSG)
 	}
 
-	user, err := self.userManager.AuthenticateDbUser(db, username, password)
+	var user User
+	if token != "" {
+		user, err = self.authenticateToken(token, db)
+	} else {
+		user, err = self.userManager.AuthenticateDbUser(db, username, password)
+	}
 	if err != nil {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"influxdb\"")
 		return libhttp.StatusUnauthorized, []byte(err.Error())
@@ -772,7 +1709,7 @@ func (self *HttpServer) listDbUsers(w libhttp.ResponseWriter, r *libhttp.Request
 
 		users := make([]*UserDetail, 0, len(dbUsers))
 		for _, dbUser := range dbUsers {
-			users = append(users, &UserDetail{dbUser.GetName(), dbUser.IsDbAdmin(db)})
+			users = append(users, newUserDetail(dbUser, db))
 		}
 		return libhttp.StatusOK, users
 	})
@@ -788,9 +1725,7 @@ func (self *HttpServer) showDbUser(w libhttp.ResponseWriter, r *libhttp.Request)
 			return errorToStatusCode(err), err.Error()
 		}
 
-		userDetail := &UserDetail{user.GetName(), user.IsDbAdmin(db)}
-
-		return libhttp.StatusOK, userDetail
+		return libhttp.StatusOK, newUserDetail(user, db)
 	})
 }
 
@@ -906,24 +1841,274 @@ func (self *HttpServer) updateDbUser(w libhttp.ResponseWriter, r *libhttp.Reques
 	})
 }
 
+func (self *HttpServer) grantDbUserPermissions(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.changeDbUserPermissions(w, r, self.userManager.GrantDbUserPermissions)
+}
+
+func (self *HttpServer) revokeDbUserPermissions(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.changeDbUserPermissions(w, r, self.userManager.RevokeDbUserPermissions)
+}
+
+func (self *HttpServer) changeDbUserPermissions(w libhttp.ResponseWriter, r *libhttp.Request, change func(User, string, string, bool, bool, string) error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	permission := &UserPermission{}
+	err = json.Unmarshal(body, permission)
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	username := r.URL.Query().Get(":user")
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		var read, write bool
+		switch permission.Permission {
+		case "read":
+			read = true
+		case "write":
+			write = true
+		case "all":
+			read, write = true, true
+		default:
+			return libhttp.StatusBadRequest, "permission must be one of read, write or all"
+		}
+
+		if err := change(u, db, username, read, write, permission.Matcher); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+type authToken struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func (self *HttpServer) createClusterAdminToken(w libhttp.ResponseWriter, r *libhttp.Request) {
+	if getAuthToken(r) != "" {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte("Tokens can only be created with a username and password"))
+		return
+	}
+	self.tryAsClusterAdmin(w, r, self.createToken)
+}
+
+func (self *HttpServer) createDbUserToken(w libhttp.ResponseWriter, r *libhttp.Request) {
+	if getAuthToken(r) != "" {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte("Tokens can only be created with a username and password"))
+		return
+	}
+	self.tryAsDbUserAndClusterAdmin(w, r, self.createToken)
+}
+
+func (self *HttpServer) createToken(u User) (int, interface{}) {
+	token, expires, err := self.userManager.CreateAuthToken(u, self.tokenTtl)
+	if err != nil {
+		return errorToStatusCode(err), err.Error()
+	}
+	return libhttp.StatusOK, &authToken{token, expires.Unix()}
+}
+
+// Revokes the bearer token of the request
+func (self *HttpServer) deleteToken(w libhttp.ResponseWriter, r *libhttp.Request) {
+	token := getAuthToken(r)
+	if token == "" {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte("The token has to be passed in the Authorization header"))
+		return
+	}
+	if err := self.userManager.DeleteAuthToken(token); err != nil {
+		w.WriteHeader(errorToStatusCode(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(libhttp.StatusOK)
+}
+
+// The version of the server, so the clients can tell which features it
+// has
+type pingResponse struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
 func (self *HttpServer) ping(w libhttp.ResponseWriter, r *libhttp.Request) {
+	config := self.clusterConfig.GetLocalConfiguration()
+	body, err := json.Marshal(&pingResponse{"ok", config.InfluxDBVersion, config.InfluxDBCommit, runtime.Version()})
+	if err != nil {
+		w.WriteHeader(libhttp.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("content-type", "application/json")
 	w.WriteHeader(libhttp.StatusOK)
-	w.Write([]byte("{\"status\":\"ok\"}"))
+	w.Write(body)
 }
 
-func (self *HttpServer) listInterfaces(w libhttp.ResponseWriter, r *libhttp.Request) {
-	statusCode, contentType, body := yieldUser(nil, func(u User) (int, interface{}) {
-		entries, err := ioutil.ReadDir(filepath.Join(self.adminAssetsDir, "interfaces"))
+type healthStatus struct {
+	Raft      bool   `json:"raft"`
+	RaftRole  string `json:"raftRole"`
+	Wal       bool   `json:"wal"`
+	Datastore bool   `json:"datastore"`
+	Protobuf  bool   `json:"protobuf"`
+}
 
+func (self *HttpServer) health(w libhttp.ResponseWriter, r *libhttp.Request) {
+	status := &healthStatus{RaftRole: "stopped"}
+	if self.raftServer != nil {
+		status.Raft = self.raftServer.HasLeader() && self.clusterConfig.IsLocalServerLoaded()
+		status.RaftRole = self.raftServer.State()
+	}
+	status.Wal = self.clusterConfig.HasRecoveredFromWAL()
+	status.Datastore = self.clusterConfig.IsShardStoreOpen()
+	if self.protobufServer != nil {
+		status.Protobuf = self.protobufServer.IsListening()
+	}
+
+	statusCode := libhttp.StatusOK
+	if !status.Raft || !status.Wal || !status.Datastore || !status.Protobuf {
+		statusCode = libhttp.StatusServiceUnavailable
+	}
+
+	body, contentType, err := toBytes(status, isPretty(r))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("content-type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+type serverStats struct {
+	PointsWritten int64 `json:"pointsWritten"`
+	QueriesServed int64 `json:"queriesServed"`
+	// the points rejected for being outside of the write window
+	PointsTooFarInFuture int64 `json:"pointsTooFarInFuture"`
+	PointsTooOld         int64 `json:"pointsTooOld"`
+	// the queries running and waiting to run
+	QueriesRunning int   `json:"queriesRunning"`
+	QueriesQueued  int   `json:"queriesQueued"`
+	Goroutines     int   `json:"goroutines"`
+	WalSize        int64 `json:"walSize"`
+	WalLogFiles    int   `json:"walLogFiles"`
+	// the requests in the wal that weren't fsynced yet
+	WalUnflushedRequests int              `json:"walUnflushedRequests"`
+	Shards               int              `json:"shards"`
+	ShardPointCounts     map[string]int64 `json:"shardPointCounts"`
+	// the last compaction of the shards compacted since startup
+	ShardCompactions map[string]*cluster.ShardCompactionStats `json:"shardCompactions"`
+	// the size and content of the shards stored on this server
+	LocalShards map[string]*cluster.LocalShardStats `json:"localShards"`
+	// the requests in the wal that still have to be written to each
+	// server, by server id
+	PendingRequests map[string]uint32 `json:"pendingRequests"`
+	// the requests buffered in memory for each server, by server id
+	WriteBufferDepths map[string]int `json:"writeBufferDepths"`
+	// the attempts to reconnect to each server since startup
+	ReconnectAttempts map[string]int64 `json:"reconnectAttempts"`
+	// how far ahead of the local clock the clock of each server is, in
+	// milliseconds, as measured by the last heartbeat
+	ClockSkews map[string]int64        `json:"clockSkews"`
+	Udp        []*udp.Stats            `json:"udp,omitempty"`
+	Graphite   *graphite.Stats         `json:"graphite,omitempty"`
+	ReadCache  *cluster.ReadCacheStats `json:"readCache,omitempty"`
+	Raft       *coordinator.RaftStats  `json:"raft,omitempty"`
+
+	// the points written and the queries run by each database and each
+	// user, and their quotas
+	DatabaseUsage map[string]coordinator.QuotaUsage `json:"databaseUsage"`
+	UserUsage     map[string]coordinator.QuotaUsage `json:"userUsage"`
+}
+
+func (self *HttpServer) stats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		stats, err := self.collectStats()
 		if err != nil {
-			return errorToStatusCode(err), err.Error()
+			return libhttp.StatusInternalServerError, err.Error()
 		}
+		return libhttp.StatusOK, stats
+	})
+}
 
-		directories := make([]string, 0, len(entries))
-		for _, entry := range entries {
-			if entry.IsDir() {
-				directories = append(directories, entry.Name())
-			}
+// Returns the stats served by /stats and /metrics
+func (self *HttpServer) collectStats() (*serverStats, error) {
+	walSize, err := self.clusterConfig.WalSize()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &serverStats{
+		Goroutines:           runtime.NumGoroutine(),
+		WalSize:              walSize,
+		WalLogFiles:          self.clusterConfig.WalLogFiles(),
+		WalUnflushedRequests: self.clusterConfig.UnflushedWalRequests(),
+		Shards:               len(self.clusterConfig.GetAllShards()),
+		ShardPointCounts:     map[string]int64{},
+		ShardCompactions:     map[string]*cluster.ShardCompactionStats{},
+		LocalShards:          map[string]*cluster.LocalShardStats{},
+		PendingRequests:      map[string]uint32{},
+		WriteBufferDepths:    map[string]int{},
+		ReconnectAttempts:    map[string]int64{},
+		ClockSkews:           map[string]int64{},
+	}
+	stats.PointsWritten, stats.QueriesServed = self.coordinator.Stats()
+	stats.PointsTooFarInFuture, stats.PointsTooOld = self.coordinator.RejectedPoints()
+	stats.QueriesRunning, stats.QueriesQueued = self.coordinator.QueryCounts()
+	stats.DatabaseUsage, stats.UserUsage = self.coordinator.QuotaUsage()
+	stats.ReadCache = self.clusterConfig.ReadCacheStats()
+	if self.raftServer != nil {
+		stats.Raft = self.raftServer.Stats()
+	}
+	if self.udpStats != nil {
+		stats.Udp = self.udpStats()
+	}
+	if self.graphiteStats != nil {
+		stats.Graphite = self.graphiteStats()
+	}
+	// json object keys have to be strings
+	for id, count := range self.clusterConfig.LocalShardPointCounts() {
+		stats.ShardPointCounts[strconv.FormatUint(uint64(id), 10)] = count
+	}
+	for id, compaction := range self.clusterConfig.LocalShardCompactionStats() {
+		stats.ShardCompactions[strconv.FormatUint(uint64(id), 10)] = compaction
+	}
+	for id, shardStats := range self.clusterConfig.LocalShardStats() {
+		stats.LocalShards[strconv.FormatUint(uint64(id), 10)] = shardStats
+	}
+	for id, pending := range self.clusterConfig.PendingWalRequests() {
+		stats.PendingRequests[strconv.FormatUint(uint64(id), 10)] = pending
+	}
+	for id, depth := range self.clusterConfig.WriteBufferDepths() {
+		stats.WriteBufferDepths[strconv.FormatUint(uint64(id), 10)] = depth
+	}
+	for id, attempts := range self.clusterConfig.ReconnectAttempts() {
+		stats.ReconnectAttempts[strconv.FormatUint(uint64(id), 10)] = attempts
+	}
+	for id, skew := range self.clusterConfig.ClockSkews() {
+		stats.ClockSkews[strconv.FormatUint(uint64(id), 10)] = int64(skew / time.Millisecond)
+	}
+	return stats, nil
+}
+
+func (self *HttpServer) listInterfaces(w libhttp.ResponseWriter, r *libhttp.Request) {
+	statusCode, contentType, body := yieldUser(nil, func(u User) (int, interface{}) {
+		directories, err := admin.ListDirectories(self.adminAssets, "/interfaces")
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
 		}
 		return libhttp.StatusOK, directories
 	}, isPretty(r))
@@ -954,6 +2139,65 @@ func (self *HttpServer) listDbContinuousQueries(w libhttp.ResponseWriter, r *lib
 	})
 }
 
+// Returns the last successful run and the last error of the continuous
+// queries, with their failed intervals that are retried and the ones
+// that failed too many times
+func (self *HttpServer) getDbContinuousQueriesStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		// the users that can list the queries can see their status
+		if _, err := self.coordinator.ListContinuousQueries(u, db); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
+		statuses, err := self.raftServer.ContinuousQueryStatuses(db)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, statuses
+	})
+}
+
+// The continuous queries of a database with their status
+type databaseContinuousQueries struct {
+	Database string                               `json:"database"`
+	Queries  []*coordinator.ContinuousQueryStatus `json:"queries"`
+}
+
+// Returns the continuous queries of all the databases, sorted by
+// database, with their definition and status
+func (self *HttpServer) listContinuousQueries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		names := []string{}
+		for _, database := range self.clusterConfig.GetDatabases() {
+			names = append(names, database.Name)
+		}
+		sort.Strings(names)
+
+		result := make([]*databaseContinuousQueries, 0, len(names))
+		for _, name := range names {
+			statuses, err := self.raftServer.ContinuousQueryStatuses(name)
+			if err != nil {
+				return libhttp.StatusInternalServerError, err.Error()
+			}
+			if len(statuses) == 0 {
+				continue
+			}
+			result = append(result, &databaseContinuousQueries{name, statuses})
+		}
+		return libhttp.StatusOK, result
+	})
+}
+
+// Returns the queries this server ran that took longer than the slow
+// query threshold, the most recent first
+func (self *HttpServer) listSlowQueries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.coordinator.SlowQueries()
+	})
+}
+
 func (self *HttpServer) createDbContinuousQueries(w libhttp.ResponseWriter, r *libhttp.Request) {
 	db := r.URL.Query().Get(":db")
 
@@ -967,7 +2211,16 @@ func (self *HttpServer) createDbContinuousQueries(w libhttp.ResponseWriter, r *l
 		values := &ContinuousQuery{}
 		json.Unmarshal(body, values)
 
-		if err := self.coordinator.CreateContinuousQuery(u, db, values.Query); err != nil {
+		var backfill time.Duration
+		if values.Backfill != "" {
+			nanoseconds, err := ParseTimeDuration(values.Backfill)
+			if err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+			backfill = time.Duration(nanoseconds)
+		}
+
+		if err := self.coordinator.CreateContinuousQueryWithBackfill(u, db, values.Query, backfill); err != nil {
 			return errorToStatusCode(err), err.Error()
 		}
 		return libhttp.StatusOK, nil
@@ -997,6 +2250,62 @@ func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request
 	})
 }
 
+type clusterServerStatus struct {
+	Id                       uint32 `json:"id"`
+	RaftName                 string `json:"raftName"`
+	RaftConnectionString     string `json:"raftConnectionString"`
+	ProtobufConnectionString string `json:"protobufConnectionString"`
+	State                    string `json:"state"`
+	// the raft role as seen by this server, the remote servers are
+	// either the leader or followers
+	RaftRole string `json:"raftRole"`
+	Up       bool   `json:"up"`
+	Local    bool   `json:"local"`
+}
+
+type clusterStatus struct {
+	// the raft name of the leader
+	Leader  string                 `json:"leader"`
+	Servers []*clusterServerStatus `json:"servers"`
+	Shards  []*cluster.ShardStatus `json:"shards"`
+}
+
+// Returns the servers of the cluster and the shards they store, as
+// seen by this server
+func (self *HttpServer) clusterStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		status := &clusterStatus{
+			Servers: []*clusterServerStatus{},
+			Shards:  self.clusterConfig.ShardStatuses(),
+		}
+		localRole := "stopped"
+		if self.raftServer != nil {
+			status.Leader = self.raftServer.Leader()
+			localRole = self.raftServer.State()
+		}
+
+		for _, s := range self.clusterConfig.Servers() {
+			server := &clusterServerStatus{
+				Id:                       s.Id,
+				RaftName:                 s.RaftName,
+				RaftConnectionString:     s.RaftConnectionString,
+				ProtobufConnectionString: s.ProtobufConnectionString,
+				State:                    s.State.String(),
+				RaftRole:                 "follower",
+				Up:                       self.clusterConfig.IsServerUp(s),
+				Local:                    s == self.clusterConfig.LocalServer,
+			}
+			if server.Local {
+				server.RaftRole = localRole
+			} else if s.RaftName == status.Leader {
+				server.RaftRole = "leader"
+			}
+			status.Servers = append(status.Servers, server)
+		}
+		return libhttp.StatusOK, status
+	})
+}
+
 func (self *HttpServer) removeServers(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
 		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
@@ -1012,6 +2321,54 @@ func (self *HttpServer) removeServers(w libhttp.ResponseWriter, r *libhttp.Reque
 	})
 }
 
+// Moves the shards of the server to the other servers, the server is
+// removed from the cluster and stops once it doesn't have any left
+func (self *HttpServer) decommissionServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		moves, err := self.raftServer.DecommissionServer(uint32(id))
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		return libhttp.StatusAccepted, moves
+	})
+}
+
+// Makes the server the raft leader once it has all the committed raft
+// entries, e.g. before the current leader is restarted
+func (self *HttpServer) transferLeadership(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		if err := self.raftServer.TransferLeadership(uint32(id)); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) getDecommissionStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		status, err := self.clusterConfig.GetDecommissionStatus(uint32(id))
+		if err != nil {
+			return libhttp.StatusNotFound, err.Error()
+		}
+		return libhttp.StatusOK, status
+	})
+}
+
 type newShardInfo struct {
 	StartTime int64               `json:"startTime"`
 	EndTime   int64               `json:"endTime"`
@@ -1109,6 +2466,139 @@ func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request)
 	})
 }
 
+// Copies the points missing from the local copy of the shard from its
+// replicas, the shard has to be stored on this server
+func (self *HttpServer) repairShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		copied, err := self.clusterConfig.RepairShard(uint32(id))
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, map[string]int{"pointsCopied": copied}
+	})
+}
+
+// remembers whether the backup started, the status can't be changed
+// once it did
+type backupWriter struct {
+	w       libhttp.ResponseWriter
+	written bool
+}
+
+func (self *backupWriter) Write(b []byte) (int, error) {
+	if !self.written {
+		self.w.Header().Set("Content-Type", "application/octet-stream")
+		self.written = true
+	}
+	return self.w.Write(b)
+}
+
+// Streams a backup of the local replica of the shard. The modification
+// marker of the shard is returned in the X-Influxdb-Shard-Marker
+// header, if it's passed back in the since parameter the backup is
+// only written if the shard was modified since, 304 is returned
+// otherwise.
+func (self *HttpServer) backupShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		since := int64(0)
+		if s := r.URL.Query().Get("since"); s != "" {
+			if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+		}
+
+		// the marker is read before the backup starts, so it's at worst
+		// older than the backup and the next backup isn't skipped
+		marker, err := self.clusterConfig.ShardModificationMarker(uint32(id))
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		w.Header().Set("X-Influxdb-Shard-Marker", strconv.FormatInt(marker, 10))
+		writer := &backupWriter{w: w}
+		if err := self.clusterConfig.BackupShard(uint32(id), since, writer); err != nil {
+			if err == cluster.ShardNotModifiedError {
+				w.WriteHeader(libhttp.StatusNotModified)
+				return -1, nil
+			}
+			if !writer.written {
+				return libhttp.StatusInternalServerError, err.Error()
+			}
+			// the restore fails since the end of the backup is missing
+			log.Error("Error writing the backup of shard %d: %s", id, err)
+		}
+		return -1, nil
+	})
+}
+
+// Loads a backup written by backupShard into a local shard that doesn't
+// have any data yet. The api read-timeout has to be long enough to
+// upload the backup.
+func (self *HttpServer) restoreShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		defer r.Body.Close()
+		if err := self.clusterConfig.RestoreShard(uint32(id), r.Body); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+// Compacts a local shard right away, e.g. after a large delete, and
+// returns the stats of the compaction
+func (self *HttpServer) compactShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.clusterConfig.CompactShard(uint32(id)); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, self.clusterConfig.LocalShardCompactionStats()[uint32(id)]
+	})
+}
+
+// Moves shard replicas so the servers have about the same number of
+// them, returns the moves that were started
+func (self *HttpServer) rebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		moves, err := self.raftServer.Rebalance()
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, moves
+	})
+}
+
+// Returns the shard moves that haven't finished, only the server a
+// shard is moved to knows how much of it was copied
+func (self *HttpServer) getRebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.ShardMovesStatus()
+	})
+}
+
+func (self *HttpServer) cancelRebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		if err := self.raftServer.CancelRebalance(); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
 func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interface{} {
 	result := make([]interface{}, 0)
 	for _, shard := range shards {
@@ -1117,6 +2607,9 @@ func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interf
 		s["startTime"] = shard.StartTime().Unix()
 		s["endTime"] = shard.EndTime().Unix()
 		s["serverIds"] = shard.ServerIds()
+		if database := shard.Database(); database != "" {
+			s["database"] = database
+		}
 		result = append(result, s)
 	}
 	return result
@@ -1,12 +1,15 @@
 package http
 
 import (
+	"api/graphite"
+	"bufio"
 	"bytes"
 	"cluster"
 	. "common"
 	"configuration"
 	"coordinator"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -15,6 +18,8 @@ import (
 	"net/url"
 	"parser"
 	"protocol"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,7 +40,65 @@ type ApiSuite struct {
 
 var _ = Suite(&ApiSuite{})
 
+func (self *MockCoordinator) RunQueryWithCancel(u User, db string, query string, yield coordinator.SeriesWriter, _ <-chan bool) error {
+	return self.RunQuery(u, db, query, yield)
+}
+
+func (self *MockCoordinator) RunQueryInTimeZone(u User, db string, query string, _ *time.Location, yield coordinator.SeriesWriter, _ <-chan bool) error {
+	return self.RunQuery(u, db, query, yield)
+}
+
+func (self *MockCoordinator) RunQueries(u User, db string, query string, _ *time.Location, newWriter func(int) coordinator.SeriesWriter, _ <-chan bool) ([]error, error) {
+	queries, err := parser.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(queries))
+	for i, q := range queries {
+		writer := newWriter(i)
+		if q.SelectQuery.GetFromClause().Names[0].Name.Name == "missing" {
+			errs[i] = fmt.Errorf("Couldn't find series: missing")
+			continue
+		}
+		errs[i] = self.RunQuery(u, db, q.GetQueryString(), writer)
+	}
+	return errs, nil
+}
+
+// Sends one more series than fits in the buffer of the subscription and
+// closes it
+func (self *MockCoordinator) Subscribe(u User, db, query string, bufferSize int, overflow coordinator.SubscriptionOverflow) (*coordinator.Subscription, error) {
+	self.lastQuery = query
+	selectQuery, err := parser.ParseSelectQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := coordinator.NewSubscription(u, db, selectQuery, bufferSize, overflow)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= bufferSize; i++ {
+		series, err := StringToSeriesArray(`[{"name": "foo", "fields": ["column_one"], "points": [{"values": [{"int64_value": 1}], "timestamp": 1381346631000000}]}]`)
+		if err != nil {
+			return nil, err
+		}
+		subscription.Publish(series[0])
+	}
+	subscription.Close()
+	return subscription, nil
+}
+
+func (self *MockCoordinator) Unsubscribe(subscription *coordinator.Subscription) {
+	subscription.Close()
+}
+
+func (self *MockCoordinator) ExplainQuery(_ User, _ string, query string) ([]*coordinator.QueryPlan, error) {
+	self.lastQuery = query
+	return []*coordinator.QueryPlan{{Query: query, Aggregation: "none", Streams: true}}, nil
+}
+
 func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coordinator.SeriesWriter) error {
+	self.lastQuery = query
 	if self.returnedError != nil {
 		return self.returnedError
 	}
@@ -95,17 +158,34 @@ func (self *MockCoordinator) RunQuery(_ User, _ string, query string, yield coor
 
 type MockCoordinator struct {
 	coordinator.Coordinator
-	series            []*protocol.Series
-	continuousQueries map[string][]*cluster.ContinuousQuery
-	deleteQueries     []*parser.DeleteQuery
-	db                string
-	droppedDb         string
-	returnedError     error
+	series               []*protocol.Series
+	continuousQueries    map[string][]*cluster.ContinuousQuery
+	deleteQueries        []*parser.DeleteQuery
+	db                   string
+	droppedDb            string
+	returnedError        error
+	consistency          cluster.ConsistencyLevel
+	retention            time.Duration
+	replicationFactor    uint8
+	duplicatePointPolicy cluster.DuplicatePointPolicy
+	backfill             time.Duration
+	lastQuery            string
+	writtenDb            string
+	namedRetentions      map[string]time.Duration
+
+	// returned by the writes after the series are recorded
+	writeError error
 }
 
 func (self *MockCoordinator) WriteSeriesData(_ User, db string, series []*protocol.Series) error {
+	self.writtenDb = db
 	self.series = append(self.series, series...)
-	return nil
+	return self.writeError
+}
+
+func (self *MockCoordinator) WriteSeriesDataWithConsistency(u User, db string, series []*protocol.Series, consistency cluster.ConsistencyLevel) error {
+	self.consistency = consistency
+	return self.WriteSeriesData(u, db, series)
 }
 
 func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.DeleteQuery, localOnly bool) error {
@@ -113,13 +193,32 @@ func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.D
 	return nil
 }
 
-func (self *MockCoordinator) CreateDatabase(_ User, db string) error {
+func (self *MockCoordinator) CreateDatabase(_ User, db string, replicationFactor uint8) error {
 	self.db = db
+	self.replicationFactor = replicationFactor
+	return nil
+}
+
+func (self *MockCoordinator) SetDatabaseReplicationFactor(_ User, db string, replicationFactor uint8) error {
+	self.replicationFactor = replicationFactor
 	return nil
 }
 
+func (self *MockCoordinator) SetDuplicatePointPolicy(_ User, db string, policy cluster.DuplicatePointPolicy) error {
+	self.duplicatePointPolicy = policy
+	return nil
+}
+
+func (self *MockCoordinator) GetDuplicatePointPolicy(_ User, db string) (cluster.DuplicatePointPolicy, error) {
+	return self.duplicatePointPolicy, nil
+}
+
+func (self *MockCoordinator) GetDatabaseReplicationFactor(_ User, db string) (int, error) {
+	return int(self.replicationFactor), nil
+}
+
 func (self *MockCoordinator) ListDatabases(_ User) ([]*cluster.Database, error) {
-	return []*cluster.Database{{"db1"}, {"db2"}}, nil
+	return []*cluster.Database{{Name: "db1"}, {Name: "db2"}}, nil
 }
 
 func (self *MockCoordinator) DropDatabase(_ User, db string) error {
@@ -127,6 +226,34 @@ func (self *MockCoordinator) DropDatabase(_ User, db string) error {
 	return nil
 }
 
+func (self *MockCoordinator) SetRetentionPolicy(_ User, db string, retention time.Duration) error {
+	self.retention = retention
+	return nil
+}
+
+func (self *MockCoordinator) SetNamedRetentionPolicy(_ User, db, name string, retention time.Duration) error {
+	if self.namedRetentions == nil {
+		self.namedRetentions = map[string]time.Duration{}
+	}
+	self.namedRetentions[name] = retention
+	return nil
+}
+
+func (self *MockCoordinator) ListNamedRetentionPolicies(_ User, db string) (map[string]time.Duration, error) {
+	return self.namedRetentions, nil
+}
+
+func (self *MockCoordinator) RetentionPolicyDatabase(_ User, db, name string) (string, error) {
+	if name != "" && self.namedRetentions[name] == 0 {
+		return "", fmt.Errorf("Retention policy %s of %s doesn't exist", name, db)
+	}
+	return cluster.PolicyDatabase(db, name), nil
+}
+
+func (self *MockCoordinator) GetRetentionPolicy(_ User, db string) (time.Duration, error) {
+	return self.retention, nil
+}
+
 func (self *MockCoordinator) ListContinuousQueries(_ User, db string) ([]*protocol.Series, error) {
 	points := []*protocol.Point{}
 
@@ -157,6 +284,11 @@ func (self *MockCoordinator) CreateContinuousQuery(_ User, db string, query stri
 	return nil
 }
 
+func (self *MockCoordinator) CreateContinuousQueryWithBackfill(u User, db string, query string, backfill time.Duration) error {
+	self.backfill = backfill
+	return self.CreateContinuousQuery(u, db, query)
+}
+
 func (self *MockCoordinator) DeleteContinuousQuery(_ User, db string, id uint32) error {
 	length := len(self.continuousQueries[db])
 	_, self.continuousQueries[db] = self.continuousQueries[db][length-1], self.continuousQueries[db][:length-1]
@@ -186,7 +318,7 @@ func (self *ApiSuite) SetUpSuite(c *C) {
 	self.server = NewHttpServer(
 		"",
 		10*time.Second,
-		dir,
+		libhttp.Dir(dir),
 		self.coordinator,
 		self.manager,
 		cluster.NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil),
@@ -207,9 +339,47 @@ func (self *ApiSuite) TearDownSuite(c *C) {
 func (self *ApiSuite) SetUpTest(c *C) {
 	self.coordinator.series = nil
 	self.coordinator.returnedError = nil
+	self.coordinator.writeError = nil
+	self.coordinator.consistency = cluster.ConsistencyAny
 	self.manager.ops = nil
 }
 
+func (self *ApiSuite) TestSmallResponsesAreNotCompressed(c *C) {
+	req, err := libhttp.NewRequest("GET", self.formatUrl("/ping"), nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := libhttp.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	ping := &pingResponse{}
+	c.Assert(json.Unmarshal(body, ping), IsNil)
+	c.Assert(ping.Status, Equals, "ok")
+	c.Assert(ping.GoVersion, Equals, runtime.Version())
+}
+
+func (self *ApiSuite) TestCorsPreflight(c *C) {
+	req, err := libhttp.NewRequest("OPTIONS", self.formatUrl("/db/foo/series"), nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "http://dashboard.example.com")
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
+}
+
+func (self *ApiSuite) TestAllowedOrigin(c *C) {
+	origins := []string{"http://a.example.com", "http://b.example.com"}
+	c.Assert(allowedOrigin("http://b.example.com", origins), Equals, "http://b.example.com")
+	c.Assert(allowedOrigin("http://c.example.com", origins), Equals, "")
+	c.Assert(allowedOrigin("", origins), Equals, "")
+	c.Assert(allowedOrigin("http://c.example.com", []string{"*"}), Equals, "*")
+}
+
 func (self *ApiSuite) TestHealthCheck(c *C) {
 	url := self.formatUrl("/ping")
 	resp, err := libhttp.Get(url)
@@ -218,6 +388,66 @@ func (self *ApiSuite) TestHealthCheck(c *C) {
 	resp.Body.Close()
 }
 
+func (self *ApiSuite) TestHealthReportsUnavailableBeforeRecovery(c *C) {
+	url := self.formatUrl("/health")
+	resp, err := libhttp.Get(url)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusServiceUnavailable)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	status := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &status), IsNil)
+	c.Assert(status["raft"], Equals, false)
+	c.Assert(status["wal"], Equals, false)
+	c.Assert(status["datastore"], Equals, false)
+	c.Assert(status["protobuf"], Equals, false)
+	c.Assert(status["raftRole"], Equals, "stopped")
+}
+
+func (self *ApiSuite) TestReadTimeoutCanBeChangedWhileServing(c *C) {
+	self.server.SetReadTimeout(100 * time.Millisecond)
+	defer self.server.SetReadTimeout(10 * time.Second)
+
+	conn, err := net.Dial("tcp4", "localhost:8081")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	// promise a body that's never sent
+	fmt.Fprintf(conn, "POST /db/foo/series?u=dbuser&p=password HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n[")
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	resp, err := libhttp.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Not(Equals), libhttp.StatusOK)
+	c.Assert(time.Since(start) < 2*time.Second, Equals, true)
+}
+
+func (self *ApiSuite) TestDeleteSeries(c *C) {
+	del := func(path string) int {
+		req, err := libhttp.NewRequest("DELETE", self.formatUrl(path), nil)
+		c.Assert(err, IsNil)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(del("/db/db1/series/foo?u=root&p=root"), Equals, libhttp.StatusNoContent)
+	c.Assert(self.coordinator.lastQuery, Equals, "drop series foo")
+
+	c.Assert(del("/db/db1/series/foo?u=root&p=root&start=1&end=2&precision=s"), Equals, libhttp.StatusNoContent)
+	c.Assert(self.coordinator.lastQuery, Equals, `delete from "foo" where time > 999999u and time < 2000001u`)
+
+	c.Assert(del("/db/db1/series?u=root&p=root&start=1000&end=2000"), Equals, libhttp.StatusNoContent)
+	c.Assert(self.coordinator.lastQuery, Equals, "delete from /.*/ where time > 999999u and time < 2000001u")
+
+	// deleting from all the series requires a time range
+	c.Assert(del("/db/db1/series?u=root&p=root"), Equals, libhttp.StatusBadRequest)
+	c.Assert(del("/db/db1/series?u=root&p=root&start=2&end=1"), Equals, libhttp.StatusBadRequest)
+}
+
 func (self *ApiSuite) TestClusterAdminAuthentication(c *C) {
 	url := self.formatUrl("/cluster_admins/authenticate?u=root&p=root")
 	resp, err := libhttp.Get(url)
@@ -248,6 +478,45 @@ func (self *ApiSuite) TestDbUserAuthentication(c *C) {
 	resp.Body.Close()
 }
 
+func (self *ApiSuite) TestTokenAuthentication(c *C) {
+	url := self.formatUrl("/token?u=root&p=root")
+	resp, err := libhttp.Post(url, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	token := &authToken{}
+	c.Assert(json.Unmarshal(body, token), IsNil)
+	c.Assert(token.Token, Equals, "root_token")
+	c.Assert(self.manager.ops, HasLen, 1)
+	c.Assert(self.manager.ops[0].operation, Equals, "token_add")
+	self.manager.ops = nil
+
+	request := func(method, path, token string) *libhttp.Response {
+		req, err := libhttp.NewRequest(method, self.formatUrl(path), nil)
+		c.Assert(err, IsNil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	c.Assert(request("GET", "/cluster_admins/authenticate", "root_token").StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(request("GET", "/db/foo/authenticate", "root_token").StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(request("GET", "/cluster_admins/authenticate", "bad_token").StatusCode, Equals, libhttp.StatusUnauthorized)
+
+	// tokens can't be used to create more tokens
+	c.Assert(request("POST", "/token", "root_token").StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.manager.ops, HasLen, 0)
+
+	c.Assert(request("DELETE", "/token", "root_token").StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.manager.ops, HasLen, 1)
+	c.Assert(self.manager.ops[0].operation, Equals, "token_del")
+	self.manager.ops = nil
+}
+
 func (self *ApiSuite) TestDbUserBasicAuthentication(c *C) {
 	url := self.formatUrl("/db/foo/authenticate")
 	req, err := libhttp.NewRequest("GET", url, nil)
@@ -292,6 +561,34 @@ func (self *ApiSuite) TestQueryWithNullColumns(c *C) {
 	c.Assert(series[0].Points[0][3], Equals, nil)
 }
 
+func (self *ApiSuite) TestQueryReturnsEmptySeries(c *C) {
+	query := url.QueryEscape("select column_one, column_two from foo, bar;")
+	for emptySeries, count := range map[string]int{"": 1, "true": 2, "false": 1} {
+		addr := self.formatUrl("/db/foo/series?q=%s&empty_series=%s&u=dbuser&p=password", query, emptySeries)
+		resp, err := libhttp.Get(addr)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		series := []SerializedSeries{}
+		c.Assert(json.Unmarshal(data, &series), IsNil)
+		c.Assert(series, HasLen, count, Commentf("empty_series=%s", emptySeries))
+		for _, s := range series {
+			if s.Name == "bar" {
+				c.Assert(s.Columns, DeepEquals, []string{"time", "sequence_number", "column_one", "column_two"})
+				c.Assert(s.Points, HasLen, 0)
+			}
+		}
+	}
+
+	addr := self.formatUrl("/db/foo/series?q=%s&empty_series=yes&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
 func (self *ApiSuite) TestQueryErrorPropagatesProperly(c *C) {
 	self.coordinator.returnedError = fmt.Errorf("some error")
 	query := "select * from does_not_exist;"
@@ -303,6 +600,106 @@ func (self *ApiSuite) TestQueryErrorPropagatesProperly(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
 }
 
+func (self *ApiSuite) TestQueryMaxPoints(c *C) {
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&max_points=3&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, ".*more than 3 points.*")
+
+	addr = self.formatUrl("/db/foo/series?q=%s&max_points=4&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	// the limit of the server can't be raised
+	self.server.SetMaxQueryPoints(3)
+	defer self.server.SetMaxQueryPoints(0)
+	addr = self.formatUrl("/db/foo/series?q=%s&max_points=4&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestExplainQuery(c *C) {
+	self.coordinator.lastQuery = ""
+	query := url.QueryEscape("select * from foo;")
+	addr := self.formatUrl("/db/foo/series?q=%s&explain=true&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	plans := []*coordinator.QueryPlan{}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&plans), IsNil)
+	c.Assert(plans, HasLen, 1)
+	c.Assert(plans[0].Query, Equals, "select * from foo;")
+	c.Assert(plans[0].Streams, Equals, true)
+}
+
+func (self *ApiSuite) TestBatchQuery(c *C) {
+	query := url.QueryEscape("select * from foo; select * from missing; select * from bar")
+	addr := self.formatUrl("/db/foo/series?q=%s&batch=true&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	results := []*batchResult{}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&results), IsNil)
+	c.Assert(results, HasLen, 3)
+	c.Assert(results[0].Error, Equals, "")
+	c.Assert(results[0].Series, HasLen, 1)
+	c.Assert(results[1].Error, Equals, "Couldn't find series: missing")
+	c.Assert(results[1].Series, HasLen, 0)
+	c.Assert(results[2].Error, Equals, "")
+	c.Assert(results[2].Series, HasLen, 1)
+
+	addr = self.formatUrl("/db/foo/series?q=%s&batch=true&chunked=true&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestSubscribe(c *C) {
+	query := url.QueryEscape("select column_one from foo")
+	addr := self.formatUrl("/db/foo/subscribe?q=%s&buffer=2&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("content-type"), Equals, "text/event-stream")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(body), "event: series\n"), Equals, 2)
+	c.Assert(strings.Contains(string(body), "event: dropped\ndata: {\"dropped\":1}"), Equals, true)
+	c.Assert(strings.Contains(string(body), "event: error"), Equals, false)
+
+	addr = self.formatUrl("/db/foo/subscribe?q=%s&buffer=2&overflow=close&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(body), "event: series\n"), Equals, 2)
+	c.Assert(strings.Contains(string(body), "event: error"), Equals, true)
+
+	addr = self.formatUrl("/db/foo/subscribe?q=%s&overflow=block&u=dbuser&p=password", query)
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	body, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "Unknown overflow block, valid values are drop and close")
+}
+
 func (self *ApiSuite) TestQueryWithSecondsPrecision(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -335,6 +732,17 @@ func (self *ApiSuite) TestQueryWithInvalidPrecision(c *C) {
 	c.Assert(resp.Header.Get("content-type"), Equals, "text/plain")
 }
 
+func (self *ApiSuite) TestQueryTimeZone(c *C) {
+	query := url.QueryEscape("select count(column_one) from foo group by time(1d);")
+	for timeZone, status := range map[string]int{"Europe/Paris": libhttp.StatusOK, "UTC": libhttp.StatusOK, "Mars/Olympus": libhttp.StatusBadRequest, "Local": libhttp.StatusBadRequest} {
+		addr := self.formatUrl("/db/foo/series?q=%s&tz=%s&u=dbuser&p=password", query, url.QueryEscape(timeZone))
+		resp, err := libhttp.Get(addr)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status, Commentf("tz=%s", timeZone))
+	}
+}
+
 func (self *ApiSuite) TestNotChunkedQuery(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -358,6 +766,66 @@ func (self *ApiSuite) TestNotChunkedQuery(c *C) {
 	c.Assert(int64(series[0].Points[0][0].(float64)), Equals, int64(1381346631000))
 }
 
+func (self *ApiSuite) TestFormatMetrics(c *C) {
+	stats := &serverStats{
+		PointsWritten:    10,
+		ShardPointCounts: map[string]int64{"2": 5, "1": 3},
+		LocalShards:      map[string]*cluster.LocalShardStats{"1": {Size: 1024, Series: 2}},
+		PendingRequests:  map[string]uint32{},
+		Graphite:         &graphite.Stats{Address: ":2003", Database: "graphite\"db", SizeFlushes: 4},
+	}
+	metrics := string(formatMetrics(stats))
+	c.Assert(metrics, Matches, "(?s)# HELP influxdb_points_written_total .*\n# TYPE influxdb_points_written_total counter\ninfluxdb_points_written_total 10\n.*")
+	c.Assert(strings.Contains(metrics, "influxdb_shard_points{shard=\"1\"} 3\ninfluxdb_shard_points{shard=\"2\"} 5\n"), Equals, true)
+	c.Assert(strings.Contains(metrics, "influxdb_shard_size_bytes{shard=\"1\"} 1024\n"), Equals, true)
+	c.Assert(strings.Contains(metrics, `influxdb_graphite_flushes_total{address=":2003",database="graphite\"db",trigger="size"} 4`), Equals, true)
+}
+
+func (self *ApiSuite) TestCsvQuery(c *C) {
+	query := "select * from foo where column_one == 'some_value';"
+	query = url.QueryEscape(query)
+	addr := self.formatUrl("/db/foo/series?q=%s&format=csv&u=dbuser&p=password", query)
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(resp.Header.Get("content-type"), Equals, "text/csv")
+	reader := csv.NewReader(resp.Body)
+	// the series name row has a single field
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	c.Assert(err, IsNil)
+	// the series name, the header and 4 points
+	c.Assert(records, HasLen, 6)
+	c.Assert(records[0], DeepEquals, []string{"foo"})
+	c.Assert(records[1], DeepEquals, []string{"time", "sequence_number", "column_one", "column_two"})
+	c.Assert(records[2][0], Equals, "2013-10-09T19:23:51Z")
+}
+
+func (self *ApiSuite) TestMsgpackQuery(c *C) {
+	query := "select * from foo where column_one == 'some_value';"
+	query = url.QueryEscape(query)
+	for _, accept := range []string{"", "application/msgpack"} {
+		addr := self.formatUrl("/db/foo/series?q=%s&u=dbuser&p=password", query)
+		if accept == "" {
+			addr += "&format=msgpack"
+		}
+		req, err := libhttp.NewRequest("GET", addr, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept", accept)
+		resp, err := libhttp.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		c.Assert(resp.Header.Get("content-type"), Equals, "application/msgpack")
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		// an array of one series, a map of name, columns and points
+		c.Assert(string(data[:12]), Equals, "\x91\x83\xa4name\xa3foo\xa7")
+		c.Assert(string(data[12:41]), Equals, "columns\x94\xa4time\xafsequence_number")
+	}
+}
+
 func (self *ApiSuite) TestNotChunkedPrettyQuery(c *C) {
 	query := "select * from foo where column_one == 'some_value';"
 	query = url.QueryEscape(query)
@@ -452,6 +920,42 @@ func (self *ApiSuite) TestPrettyChunkedQuery(c *C) {
 	}
 }
 
+func (self *ApiSuite) TestWriteDataWithTimeInNanoseconds(c *C) {
+	data := `[{"points": [[1382131686123456789, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?precision=n&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	series := self.coordinator.series[0]
+	c.Assert(series.Points, HasLen, 1)
+	c.Assert(*series.Points[0].GetTimestampInMicroseconds(), Equals, int64(1382131686123456))
+}
+
+func (self *ApiSuite) TestWriteDataWithoutTimeUsesPrecision(c *C) {
+	data := `[{"points": [["1"]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?precision=s&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	series := self.coordinator.series[0]
+	c.Assert(series.Points, HasLen, 1)
+	c.Assert(*series.Points[0].GetTimestampInMicroseconds()%1000000, Equals, int64(0))
+}
+
+func (self *ApiSuite) TestWriteDataWithInvalidPrecision(c *C) {
+	data := `[{"points": [[1382131686, "1"]], "name": "foo", "columns": ["time", "column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?precision=h&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
 func (self *ApiSuite) TestWriteDataWithTimeInSeconds(c *C) {
 	data := `
 [
@@ -531,6 +1035,70 @@ func (self *ApiSuite) TestWriteDataWithInvalidTime(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
 }
 
+func (self *ApiSuite) TestWriteDataReportsInvalidPoints(c *C) {
+	data := `
+[
+  {
+    "points": [
+				[1382131686000, "1"],
+				["foo", "2"],
+				[1382131687000, "3"]
+    ],
+    "name": "foo",
+    "columns": ["time", "column_one"]
+  }
+]
+`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, 207)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	result := map[string][]map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &result), IsNil)
+	c.Assert(result["errors"], HasLen, 1)
+	c.Assert(result["errors"][0]["series"], Equals, 0.0)
+	c.Assert(result["errors"][0]["point"], Equals, 1.0)
+
+	// the valid points are still written
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.series[0].Points, HasLen, 2)
+}
+
+func (self *ApiSuite) TestWriteDataReportsThePointsTheCoordinatorRejectedByTheirIndexInTheBody(c *C) {
+	data := `
+[
+  {
+    "points": [
+				[1382131686000, "1"],
+				["foo", "2"],
+				[1382131687000, "3"]
+    ],
+    "name": "foo",
+    "columns": ["time", "column_one"]
+  }
+]
+`
+
+	// the coordinator only sees the 2 valid points, its second point is
+	// the third point of the body
+	self.coordinator.writeError = &PartialWriteError{[]*PointError{NewPointError(0, 1, fmt.Errorf("rejected"))}}
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, 207)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	result := map[string][]map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &result), IsNil)
+	c.Assert(result["errors"], HasLen, 2)
+	c.Assert(result["errors"][0]["point"], Equals, 1.0)
+	c.Assert(result["errors"][1]["point"], Equals, 2.0)
+	c.Assert(result["errors"][1]["error"], Equals, "rejected")
+}
+
 func (self *ApiSuite) TestWriteDataWithNull(c *C) {
 	data := `
 [
@@ -624,6 +1192,39 @@ func (self *ApiSuite) TestWriteDataAsClusterAdmin(c *C) {
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
 }
 
+func (self *ApiSuite) TestWriteDataWithConsistency(c *C) {
+	data := `[{"points": [["1"]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?consistency=quorum&u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.series, HasLen, 1)
+	c.Assert(self.coordinator.consistency, Equals, cluster.ConsistencyQuorum)
+
+	addr = self.formatUrl("/db/foo/series?consistency=most&u=dbuser&p=password")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.coordinator.series, HasLen, 1)
+}
+
+func (self *ApiSuite) TestWriteRateLimit(c *C) {
+	self.server.SetWriteRateLimits(0, 2)
+	defer self.server.SetWriteRateLimits(0, 0)
+
+	data := `[{"points": [["1"], ["2"]], "name": "foo", "columns": ["column_one"]}]`
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, STATUS_TOO_MANY_REQUESTS)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "1")
+}
+
 func (self *ApiSuite) TestCreateDatabase(c *C) {
 	data := `{"name": "foo", "apiKey": "bar"}`
 	addr := self.formatUrl("/db?api_key=asdf&u=root&p=root")
@@ -635,6 +1236,29 @@ func (self *ApiSuite) TestCreateDatabase(c *C) {
 	c.Assert(self.coordinator.db, Equals, "foo")
 }
 
+func (self *ApiSuite) TestReplicationFactor(c *C) {
+	addr := self.formatUrl("/db?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "foo", "replicationFactor": 3}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusCreated)
+	c.Assert(self.coordinator.replicationFactor, Equals, uint8(3))
+
+	addr = self.formatUrl("/db/foo/replication_factor?u=root&p=root")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"replicationFactor": 1}`))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	factor := &replicationFactor{}
+	c.Assert(json.Unmarshal(body, factor), IsNil)
+	c.Assert(factor.ReplicationFactor, Equals, uint8(1))
+}
+
 func (self *ApiSuite) TestDropDatabase(c *C) {
 	addr := self.formatUrl("/db/foo?u=root&p=root")
 	req, err := libhttp.NewRequest("DELETE", addr, nil)
@@ -647,6 +1271,53 @@ func (self *ApiSuite) TestDropDatabase(c *C) {
 	c.Assert(self.coordinator.droppedDb, Equals, "foo")
 }
 
+func (self *ApiSuite) TestRetentionPolicy(c *C) {
+	addr := self.formatUrl("/db/foo/retention?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"retention": "30d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.retention, Equals, 30*24*time.Hour)
+
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	policy := &retentionPolicy{}
+	c.Assert(json.Unmarshal(body, policy), IsNil)
+	c.Assert(policy.Retention, Equals, "30d")
+
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"retention": "forever"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestNamedRetentionPolicies(c *C) {
+	addr := self.formatUrl("/db/foo/retention_policies?u=root&p=root")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(`{"name": "raw", "retention": "7d"}`))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+
+	resp, err = libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	policies := []*namedRetentionPolicy{}
+	c.Assert(json.Unmarshal(body, &policies), IsNil)
+	c.Assert(policies, DeepEquals, []*namedRetentionPolicy{{"raw", "1w"}})
+
+	data := `[{"points": [[1]], "name": "foo", "columns": ["column_one"]}]`
+	resp, err = libhttp.Post(self.formatUrl("/db/foo/series?rp=raw&u=dbuser&p=password"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.writtenDb, Equals, "foo%raw")
+
+	resp, err = libhttp.Post(self.formatUrl("/db/foo/series?rp=missing&u=dbuser&p=password"), "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
 func (self *ApiSuite) TestClusterAdminOperations(c *C) {
 	url := self.formatUrl("/cluster_admins?u=root&p=root")
 	resp, err := libhttp.Post(url, "", bytes.NewBufferString(`{"name":"", "password": "new_pass"}`))
@@ -686,6 +1357,47 @@ func (self *ApiSuite) TestClusterAdminOperations(c *C) {
 	c.Assert(self.manager.ops[0].username, Equals, "new_user")
 }
 
+func (self *ApiSuite) TestDecommissionStatus(c *C) {
+	clusterConfig := cluster.NewClusterConfiguration(&configuration.Configuration{}, nil, nil, nil)
+	clusterConfig.AddPotentialServer(&cluster.ClusterServer{})
+	server := NewHttpServer("", 10*time.Second, libhttp.Dir(c.MkDir()), self.coordinator, self.manager, clusterConfig, nil)
+	listener, err := net.Listen("tcp4", "localhost:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go server.Serve(listener)
+
+	get := func(path string) (int, map[string]interface{}) {
+		resp, err := libhttp.Get(fmt.Sprintf("http://%s%s", listener.Addr(), path))
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		status := map[string]interface{}{}
+		if resp.StatusCode == libhttp.StatusOK {
+			c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+		}
+		return resp.StatusCode, status
+	}
+
+	code, status := get("/cluster/servers/1/decommission?u=root&p=root")
+	c.Assert(code, Equals, libhttp.StatusOK)
+	c.Assert(status["serverId"], Equals, 1.0)
+	c.Assert(status["leaving"], Equals, false)
+	c.Assert(status["shards"], DeepEquals, []interface{}{})
+
+	c.Assert(clusterConfig.DecommissionServer(1), IsNil)
+	code, status = get("/cluster/servers/1/decommission?u=root&p=root")
+	c.Assert(code, Equals, libhttp.StatusOK)
+	c.Assert(status["leaving"], Equals, true)
+	c.Assert(status["moves"], DeepEquals, []interface{}{})
+	c.Assert(status["blockingShards"], DeepEquals, []interface{}{})
+
+	code, _ = get("/cluster/servers/2/decommission?u=root&p=root")
+	c.Assert(code, Equals, libhttp.StatusNotFound)
+	code, _ = get("/cluster/servers/foo/decommission?u=root&p=root")
+	c.Assert(code, Equals, libhttp.StatusBadRequest)
+	code, _ = get("/cluster/servers/1/decommission?u=db_user1&p=db_user1")
+	c.Assert(code, Equals, libhttp.StatusUnauthorized)
+}
+
 func (self *ApiSuite) TestDbUserOperations(c *C) {
 	// create user using the `name` field
 	url := self.formatUrl("/db/db1/users?u=root&p=root")
@@ -762,6 +1474,37 @@ func (self *ApiSuite) TestDbUserOperations(c *C) {
 	c.Assert(self.manager.ops[0].username, Equals, "dbuser")
 }
 
+func (self *ApiSuite) TestDbUserPermissions(c *C) {
+	url := self.formatUrl("/db/db1/users/dbuser/grant?u=root&p=root")
+	resp, err := libhttp.Post(url, "", bytes.NewBufferString(`{"permission":"read", "matcher": "^cpu"}`))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.manager.ops, HasLen, 1)
+	c.Assert(self.manager.ops[0].operation, Equals, "db_user_grant")
+	c.Assert(self.manager.ops[0].username, Equals, "dbuser")
+	c.Assert(self.manager.ops[0].password, Equals, "^cpu")
+	self.manager.ops = nil
+
+	url = self.formatUrl("/db/db1/users/dbuser/revoke?u=root&p=root")
+	resp, err = libhttp.Post(url, "", bytes.NewBufferString(`{"permission":"all"}`))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.manager.ops, HasLen, 1)
+	c.Assert(self.manager.ops[0].operation, Equals, "db_user_revoke")
+	c.Assert(self.manager.ops[0].password, Equals, "")
+	self.manager.ops = nil
+
+	// the permission has to be read, write or all
+	url = self.formatUrl("/db/db1/users/dbuser/grant?u=root&p=root")
+	resp, err = libhttp.Post(url, "", bytes.NewBufferString(`{"permission":"admin"}`))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+	c.Assert(self.manager.ops, HasLen, 0)
+}
+
 func (self *ApiSuite) TestClusterAdminsIndex(c *C) {
 	url := self.formatUrl("/cluster_admins?u=root&p=root")
 	resp, err := libhttp.Get(url)
@@ -802,7 +1545,7 @@ func (self *ApiSuite) TestDbUsersIndex(c *C) {
 	err = json.Unmarshal(body, &users)
 	c.Assert(err, IsNil)
 	c.Assert(users, HasLen, 1)
-	c.Assert(users[0], DeepEquals, &UserDetail{"db_user1", false})
+	c.Assert(users[0], DeepEquals, &UserDetail{Name: "db_user1", IsAdmin: false})
 }
 
 func (self *ApiSuite) TestPrettyDbUsersIndex(c *C) {
@@ -817,7 +1560,7 @@ func (self *ApiSuite) TestPrettyDbUsersIndex(c *C) {
 	err = json.Unmarshal(body, &users)
 	c.Assert(err, IsNil)
 	c.Assert(users, HasLen, 1)
-	c.Assert(users[0], DeepEquals, &UserDetail{"db_user1", false})
+	c.Assert(users[0], DeepEquals, &UserDetail{Name: "db_user1", IsAdmin: false})
 }
 
 func (self *ApiSuite) TestDbUserShow(c *C) {
@@ -831,7 +1574,7 @@ func (self *ApiSuite) TestDbUserShow(c *C) {
 	userDetail := &UserDetail{}
 	err = json.Unmarshal(body, &userDetail)
 	c.Assert(err, IsNil)
-	c.Assert(userDetail, DeepEquals, &UserDetail{"db_user1", false})
+	c.Assert(userDetail, DeepEquals, &UserDetail{Name: "db_user1", IsAdmin: false})
 }
 
 func (self *ApiSuite) TestDatabasesIndex(c *C) {
@@ -848,7 +1591,7 @@ func (self *ApiSuite) TestDatabasesIndex(c *C) {
 		c.Assert(err, IsNil)
 		err = json.Unmarshal(body, &databases)
 		c.Assert(err, IsNil)
-		c.Assert(databases, DeepEquals, []*cluster.Database{{"db1"}, {"db2"}})
+		c.Assert(databases, DeepEquals, []*cluster.Database{{Name: "db1"}, {Name: "db2"}})
 	}
 }
 
@@ -867,7 +1610,7 @@ func (self *ApiSuite) TestBasicAuthentication(c *C) {
 	c.Assert(err, IsNil)
 	err = json.Unmarshal(body, &databases)
 	c.Assert(err, IsNil)
-	c.Assert(databases, DeepEquals, []*cluster.Database{{"db1"}, {"db2"}})
+	c.Assert(databases, DeepEquals, []*cluster.Database{{Name: "db1"}, {Name: "db2"}})
 }
 
 func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
@@ -889,11 +1632,12 @@ func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
 	resp.Body.Close()
 
 	// add a new continuous query
-	data := `{"query": "select * from quu into qux;"}`
+	data := `{"query": "select * from quu into qux;", "backfill": "7d"}`
 	url = self.formatUrl("/db/db1/continuous_queries?u=root&p=root")
 	resp, err = libhttp.Post(url, "application/json", bytes.NewBufferString(data))
 	c.Assert(err, IsNil)
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.backfill, Equals, 7*24*time.Hour)
 	resp.Body.Close()
 
 	// verify updated continuous query index
@@ -4,17 +4,33 @@ import (
 	libhttp "net/http"
 )
 
-func HeaderHandler(handler libhttp.HandlerFunc, version string) libhttp.HandlerFunc {
+// Returns the value of the Access-Control-Allow-Origin header for the
+// given request origin, or an empty string if the origin isn't allowed
+func allowedOrigin(origin string, allowedOrigins []string) string {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+func HeaderHandler(handler libhttp.HandlerFunc, version string, allowedOrigins []string) libhttp.HandlerFunc {
 	return func(rw libhttp.ResponseWriter, req *libhttp.Request) {
-		rw.Header().Add("Access-Control-Allow-Origin", "*")
-		rw.Header().Add("Access-Control-Max-Age", "2592000")
-		rw.Header().Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-		rw.Header().Add("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+		if origin := allowedOrigin(req.Header.Get("Origin"), allowedOrigins); origin != "" {
+			rw.Header().Add("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				// the response depends on the origin, don't let caches share it
+				rw.Header().Add("Vary", "Origin")
+			}
+			rw.Header().Add("Access-Control-Max-Age", "2592000")
+			rw.Header().Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			rw.Header().Add("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		}
 		rw.Header().Add("X-Influxdb-Version", version)
 		handler(rw, req)
 	}
 }
-
-func CompressionHeaderHandler(handler libhttp.HandlerFunc, version string) libhttp.HandlerFunc {
-	return HeaderHandler(CompressionHandler(true, handler), version)
-}
@@ -0,0 +1,100 @@
+package http
+
+// Serializes query results as csv, used when the query has format=csv
+
+import (
+	. "common"
+	"encoding/csv"
+	"fmt"
+	libhttp "net/http"
+	"protocol"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Buffers all the series like AllPointsWriter and writes them out as
+// one csv section per series. Each section starts with the series name
+// on its own line followed by a header row with the column names, and
+// sections are separated by an empty line. The name rows, the header
+// rows and the point rows have different numbers of fields, so readers
+// have to allow variable length records (FieldsPerRecord = -1 with
+// encoding/csv).
+type CsvWriter struct {
+	memSeries map[string]*protocol.Series
+	w         libhttp.ResponseWriter
+	precision TimePrecision
+	// write the timestamps as epoch in the time precision instead of RFC3339
+	epoch bool
+}
+
+func (self *CsvWriter) yield(series *protocol.Series) error {
+	oldSeries := self.memSeries[series.GetName()]
+	if oldSeries == nil {
+		self.memSeries[series.GetName()] = series
+		return nil
+	}
+
+	self.memSeries[series.GetName()] = MergeSeries(oldSeries, series)
+	return nil
+}
+
+func (self *CsvWriter) done() {
+	precision := self.precision
+	if !self.epoch {
+		precision = MicrosecondPrecision
+	}
+	serializedSeries := SerializeSeries(self.memSeries, precision)
+	sort.Sort(serializedSeriesByName(serializedSeries))
+
+	self.w.Header().Add("content-type", "text/csv")
+	self.w.WriteHeader(libhttp.StatusOK)
+
+	writer := csv.NewWriter(self.w)
+	for idx, series := range serializedSeries {
+		if idx > 0 {
+			writer.Write([]string{})
+		}
+		writer.Write([]string{series.Name})
+		writer.Write(series.Columns)
+		for _, point := range series.Points {
+			record := make([]string, 0, len(point))
+			for column, value := range point {
+				if column == 0 && !self.epoch {
+					record = append(record, formatRFC3339(value))
+					continue
+				}
+				record = append(record, csvValue(value))
+			}
+			writer.Write(record)
+		}
+	}
+	writer.Flush()
+}
+
+func formatRFC3339(microseconds interface{}) string {
+	t, ok := microseconds.(int64)
+	if !ok {
+		return csvValue(microseconds)
+	}
+	return time.Unix(t/1000000, (t%1000000)*1000).UTC().Format(time.RFC3339Nano)
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+type serializedSeriesByName []*SerializedSeries
+
+func (self serializedSeriesByName) Len() int           { return len(self) }
+func (self serializedSeriesByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self serializedSeriesByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"engine"
+	"parser"
+	"protocol"
+)
+
+// Yields an empty series with the columns of the query for the series
+// the query reads that didn't return any point, so the response has the
+// same shape whether the series had points in range or not
+type emptySeriesWriter struct {
+	yield    func(*protocol.Series) error
+	returned map[string]bool
+}
+
+func newEmptySeriesWriter(yield func(*protocol.Series) error) *emptySeriesWriter {
+	return &emptySeriesWriter{yield, map[string]bool{}}
+}
+
+func (self *emptySeriesWriter) write(series *protocol.Series) error {
+	self.returned[series.GetName()] = true
+	return self.yield(series)
+}
+
+// Yields the series named by the select statements that weren't
+// returned, the series matched by regexes and the results of merges and
+// joins can't be known without points
+func (self *emptySeriesWriter) yieldEmptySeries(queries []*parser.Query) error {
+	for _, query := range queries {
+		selectQuery := query.SelectQuery
+		if selectQuery == nil || selectQuery.IsContinuousQuery() || selectQuery.IsExplainQuery() {
+			continue
+		}
+		fromClause := selectQuery.GetFromClause()
+		if fromClause.Type != parser.FromClauseArray {
+			continue
+		}
+		for _, name := range fromClause.Names {
+			if _, isRegex := name.Name.GetCompiledRegex(); isRegex || self.returned[name.Name.Name] {
+				continue
+			}
+			self.returned[name.Name.Name] = true
+			series := &protocol.Series{Name: protocol.String(name.Name.Name), Fields: engine.ResultColumns(selectQuery)}
+			if err := self.yield(series); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"bytes"
 	"compress/gzip"
 	"compress/zlib"
 	"io"
@@ -8,37 +9,55 @@ import (
 	"strings"
 )
 
+// responses smaller than this aren't compressed by default
+const DEFAULT_COMPRESSION_MIN_SIZE = 1024
+
 type Flusher interface {
 	Flush() error
 }
 
+// Buffers the response until it's at least minSize bytes long before
+// deciding whether to compress it, so small responses aren't
+// compressed. The status code is held back until then as well since
+// the Content-Encoding header has to be set before it's sent.
 type CompressedResponseWriter struct {
 	responseWriter     libhttp.ResponseWriter
 	writer             io.Writer
 	compressionFlusher Flusher
 	responseFlusher    libhttp.Flusher
+	encoding           string
+	minSize            int
+	buffer             *bytes.Buffer
+	statusCode         int
+	decided            bool
 }
 
-func NewCompressionResponseWriter(useCompression bool, rw libhttp.ResponseWriter, req *libhttp.Request) *CompressedResponseWriter {
+func NewCompressionResponseWriter(useCompression bool, minSize int, rw libhttp.ResponseWriter, req *libhttp.Request) *CompressedResponseWriter {
 	responseFlusher, _ := rw.(libhttp.Flusher)
+	crw := &CompressedResponseWriter{
+		responseWriter:  rw,
+		writer:          rw,
+		responseFlusher: responseFlusher,
+		minSize:         minSize,
+		buffer:          bytes.NewBuffer(nil),
+		statusCode:      libhttp.StatusOK,
+	}
 
-	if req.Header.Get("Accept-Encoding") != "" {
+	if useCompression && req.Header.Get("Accept-Encoding") != "" {
 		encodings := strings.Split(req.Header.Get("Accept-Encoding"), ",")
 
 		for _, val := range encodings {
-			if val == "gzip" {
-				rw.Header().Set("Content-Encoding", "gzip")
-				w, _ := gzip.NewWriterLevel(rw, gzip.BestSpeed)
-				return &CompressedResponseWriter{rw, w, w, responseFlusher}
-			} else if val == "deflate" {
-				rw.Header().Set("Content-Encoding", "deflate")
-				w, _ := zlib.NewWriterLevel(rw, zlib.BestSpeed)
-				return &CompressedResponseWriter{rw, w, w, responseFlusher}
+			val = strings.TrimSpace(val)
+			if val == "gzip" || val == "deflate" {
+				crw.encoding = val
+				break
 			}
 		}
 	}
 
-	return &CompressedResponseWriter{rw, rw, nil, responseFlusher}
+	// nothing to decide if the client doesn't support compression
+	crw.decided = crw.encoding == ""
+	return crw
 }
 
 func (self *CompressedResponseWriter) Header() libhttp.Header {
@@ -46,10 +65,50 @@ func (self *CompressedResponseWriter) Header() libhttp.Header {
 }
 
 func (self *CompressedResponseWriter) Write(bs []byte) (int, error) {
-	return self.writer.Write(bs)
+	if self.decided {
+		return self.writer.Write(bs)
+	}
+
+	self.buffer.Write(bs)
+	if self.buffer.Len() >= self.minSize {
+		if err := self.startWriting(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(bs), nil
+}
+
+// Sends the status code and the buffered data, compressed if compress
+// is true
+func (self *CompressedResponseWriter) startWriting(compress bool) error {
+	self.decided = true
+	if compress {
+		self.responseWriter.Header().Set("Content-Encoding", self.encoding)
+		switch self.encoding {
+		case "gzip":
+			w, _ := gzip.NewWriterLevel(self.responseWriter, gzip.BestSpeed)
+			self.writer, self.compressionFlusher = w, w
+		case "deflate":
+			w, _ := zlib.NewWriterLevel(self.responseWriter, zlib.BestSpeed)
+			self.writer, self.compressionFlusher = w, w
+		}
+	}
+	self.responseWriter.WriteHeader(self.statusCode)
+	if self.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := self.writer.Write(self.buffer.Bytes())
+	self.buffer.Reset()
+	return err
 }
 
 func (self *CompressedResponseWriter) Flush() {
+	// flushing means the response is being streamed, which is usually
+	// the case for large responses, compress it
+	if !self.decided {
+		self.startWriting(true)
+	}
+
 	if self.compressionFlusher != nil {
 		self.compressionFlusher.Flush()
 	}
@@ -59,23 +118,43 @@ func (self *CompressedResponseWriter) Flush() {
 	}
 }
 
+func (self *CompressedResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := self.responseWriter.(libhttp.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
 func (self *CompressedResponseWriter) WriteHeader(responseCode int) {
-	self.responseWriter.WriteHeader(responseCode)
+	if self.decided {
+		self.responseWriter.WriteHeader(responseCode)
+		return
+	}
+	self.statusCode = responseCode
 }
 
-func CompressionHandler(enableCompression bool, handler libhttp.HandlerFunc) libhttp.HandlerFunc {
+// Writes whatever is still buffered and closes the compression writer
+func (self *CompressedResponseWriter) Close() {
+	if !self.decided {
+		self.startWriting(false)
+	}
+
+	switch x := self.writer.(type) {
+	case *gzip.Writer:
+		x.Close()
+	case *zlib.Writer:
+		x.Close()
+	}
+}
+
+func CompressionHandler(enableCompression bool, minSize int, handler libhttp.HandlerFunc) libhttp.HandlerFunc {
 	if !enableCompression {
 		return handler
 	}
 
 	return func(rw libhttp.ResponseWriter, req *libhttp.Request) {
-		crw := NewCompressionResponseWriter(true, rw, req)
+		crw := NewCompressionResponseWriter(true, minSize, rw, req)
 		handler(crw, req)
-		switch x := crw.writer.(type) {
-		case *gzip.Writer:
-			x.Close()
-		case *zlib.Writer:
-			x.Close()
-		}
+		crw.Close()
 	}
 }
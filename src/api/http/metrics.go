@@ -0,0 +1,258 @@
+package http
+
+// Serves the stats in the prometheus text exposition format
+
+import (
+	"bytes"
+	. "common"
+	"coordinator"
+	"fmt"
+	libhttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4"
+
+// Serves the counters of /stats as prometheus metrics, the shards,
+// servers and inputs are told apart by labels
+func (self *HttpServer) metrics(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		stats, err := self.collectStats()
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		w.Header().Add("content-type", METRICS_CONTENT_TYPE)
+		w.WriteHeader(libhttp.StatusOK)
+		w.Write(formatMetrics(stats))
+		return -1, nil
+	})
+}
+
+// Writes metric families, each one has a HELP and a TYPE line followed
+// by its samples
+type metricsWriter struct {
+	buffer bytes.Buffer
+}
+
+func (self *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(&self.buffer, "# HELP influxdb_%s %s\n# TYPE influxdb_%s %s\n", name, help, name, kind)
+}
+
+// Writes a sample of the family, labels are key value pairs
+func (self *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	self.buffer.WriteString("influxdb_")
+	self.buffer.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		fmt.Fprintf(&self.buffer, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(&self.buffer, " %v\n", value)
+}
+
+// Writes a family with a single sample
+func (self *metricsWriter) metric(name, kind, help string, value interface{}, labels ...string) {
+	self.family(name, kind, help)
+	self.sample(name, value, labels...)
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]uint32:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]int:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetrics(stats *serverStats) []byte {
+	writer := &metricsWriter{}
+
+	writer.metric("points_written_total", "counter", "Points written since startup.", stats.PointsWritten)
+	writer.metric("queries_served_total", "counter", "Queries served since startup.", stats.QueriesServed)
+	writer.family("points_rejected_total", "counter", "Points rejected since startup for being outside of the write window.")
+	writer.sample("points_rejected_total", stats.PointsTooFarInFuture, "reason", "future")
+	writer.sample("points_rejected_total", stats.PointsTooOld, "reason", "past")
+	writer.metric("queries_running", "gauge", "Queries running now.", stats.QueriesRunning)
+	writer.metric("queries_queued", "gauge", "Queries waiting for a running query to finish.", stats.QueriesQueued)
+	writer.metric("goroutines", "gauge", "Number of goroutines.", stats.Goroutines)
+	writer.metric("wal_size_bytes", "gauge", "Size of the write ahead log.", stats.WalSize)
+	writer.metric("wal_log_files", "gauge", "Number of log files of the write ahead log.", stats.WalLogFiles)
+	writer.metric("wal_unflushed_requests", "gauge", "Requests in the write ahead log that weren't fsynced yet.", stats.WalUnflushedRequests)
+	writer.metric("shards", "gauge", "Number of shards in the cluster.", stats.Shards)
+
+	shardIds := []string{}
+	for id := range stats.LocalShards {
+		shardIds = append(shardIds, id)
+	}
+	for id := range stats.ShardCompactions {
+		if stats.LocalShards[id] == nil {
+			shardIds = append(shardIds, id)
+		}
+	}
+	sort.Strings(shardIds)
+
+	writer.family("shard_points", "gauge", "Points written to the local shards since startup.")
+	for _, id := range sortedKeys(stats.ShardPointCounts) {
+		writer.sample("shard_points", stats.ShardPointCounts[id], "shard", id)
+	}
+	writer.family("shard_size_bytes", "gauge", "Size of the local shards on disk.")
+	for _, id := range shardIds {
+		if shard := stats.LocalShards[id]; shard != nil {
+			writer.sample("shard_size_bytes", shard.Size, "shard", id)
+		}
+	}
+	writer.family("shard_series", "gauge", "Number of series of the local shards.")
+	for _, id := range shardIds {
+		if shard := stats.LocalShards[id]; shard != nil {
+			writer.sample("shard_series", shard.Series, "shard", id)
+		}
+	}
+	writer.family("shard_compactions_total", "counter", "Compactions of the local shards since startup.")
+	for _, id := range shardIds {
+		if compaction := stats.ShardCompactions[id]; compaction != nil {
+			writer.sample("shard_compactions_total", compaction.Compactions, "shard", id)
+		}
+	}
+	writer.family("shard_last_compaction_reclaimed_bytes", "gauge", "Bytes reclaimed by the last compaction of the local shards.")
+	for _, id := range shardIds {
+		if compaction := stats.ShardCompactions[id]; compaction != nil {
+			writer.sample("shard_last_compaction_reclaimed_bytes", compaction.BytesReclaimed, "shard", id)
+		}
+	}
+
+	writer.family("wal_pending_requests", "gauge", "Requests in the write ahead log that still have to be written to each server.")
+	for _, id := range sortedKeys(stats.PendingRequests) {
+		writer.sample("wal_pending_requests", stats.PendingRequests[id], "server", id)
+	}
+
+	writer.family("write_buffer_depth", "gauge", "Requests buffered in memory for each server.")
+	for _, id := range sortedKeys(stats.WriteBufferDepths) {
+		writer.sample("write_buffer_depth", stats.WriteBufferDepths[id], "server", id)
+	}
+
+	writer.family("protobuf_reconnect_attempts_total", "counter", "Attempts to reconnect to each server since startup.")
+	for _, id := range sortedKeys(stats.ReconnectAttempts) {
+		writer.sample("protobuf_reconnect_attempts_total", stats.ReconnectAttempts[id], "server", id)
+	}
+
+	writer.family("clock_skew_seconds", "gauge", "How far ahead of the local clock the clock of each server is.")
+	for _, id := range sortedKeys(stats.ClockSkews) {
+		seconds := float64(stats.ClockSkews[id]) / 1000
+		writer.sample("clock_skew_seconds", strconv.FormatFloat(seconds, 'f', -1, 64), "server", id)
+	}
+
+	usageMetrics := []struct {
+		name, help string
+		value      func(coordinator.QuotaUsage) int64
+	}{
+		{"points_written_total", "Points written to each %s since it was last idle for an hour.", func(u coordinator.QuotaUsage) int64 { return u.PointsWritten }},
+		{"points_rejected_total", "Points rejected for being over the quota of each %s.", func(u coordinator.QuotaUsage) int64 { return u.PointsRejected }},
+		{"queries_total", "Queries run by each %s since it was last idle for an hour.", func(u coordinator.QuotaUsage) int64 { return u.Queries }},
+		{"queries_rejected_total", "Queries rejected for being over the quota of each %s.", func(u coordinator.QuotaUsage) int64 { return u.QueriesRejected }},
+	}
+	for _, tenants := range []struct {
+		kind  string
+		usage map[string]coordinator.QuotaUsage
+	}{{"database", stats.DatabaseUsage}, {"user", stats.UserUsage}} {
+		names := []string{}
+		for name := range tenants.usage {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, m := range usageMetrics {
+			name := tenants.kind + "_" + m.name
+			writer.family(name, "counter", fmt.Sprintf(m.help, tenants.kind))
+			for _, tenant := range names {
+				writer.sample(name, m.value(tenants.usage[tenant]), tenants.kind, tenant)
+			}
+		}
+	}
+
+	if stats.ReadCache != nil {
+		writer.metric("read_cache_size_bytes", "gauge", "Size of the points in the read cache.", stats.ReadCache.Size)
+		writer.metric("read_cache_max_size_bytes", "gauge", "Maximum size of the read cache.", stats.ReadCache.MaxSize)
+		writer.metric("read_cache_windows", "gauge", "Time windows in the read cache.", stats.ReadCache.Windows)
+		writer.metric("read_cache_hits_total", "counter", "Reads served by the read cache.", stats.ReadCache.Hits)
+		writer.metric("read_cache_misses_total", "counter", "Reads that missed the read cache.", stats.ReadCache.Misses)
+		writer.metric("read_cache_evictions_total", "counter", "Time windows evicted from the read cache.", stats.ReadCache.Evictions)
+	}
+
+	if len(stats.Udp) > 0 {
+		udpMetrics := []struct {
+			name, help string
+			value      func(int) int64
+		}{
+			{"udp_packets_received_total", "Packets received by the udp input.", func(i int) int64 { return stats.Udp[i].PacketsReceived }},
+			{"udp_packets_dropped_total", "Packets dropped because the queue of the udp input was full.", func(i int) int64 { return stats.Udp[i].PacketsDropped }},
+			{"udp_bytes_read_total", "Bytes read by the udp input.", func(i int) int64 { return stats.Udp[i].BytesRead }},
+			{"udp_parse_errors_total", "Series and lines the udp input couldn't parse.", func(i int) int64 { return stats.Udp[i].ParseErrors }},
+			{"udp_unknown_database_total", "Series dropped because their database doesn't exist.", func(i int) int64 { return stats.Udp[i].UnknownDatabase }},
+		}
+		for _, m := range udpMetrics {
+			writer.family(m.name, "counter", m.help)
+			for i, udp := range stats.Udp {
+				writer.sample(m.name, m.value(i), "address", udp.Address, "database", udp.Database)
+			}
+		}
+	}
+
+	if graphite := stats.Graphite; graphite != nil {
+		labels := []string{"address", graphite.Address, "database", graphite.Database}
+		writer.metric("graphite_points_received_total", "counter", "Points received by the graphite input.", graphite.PointsReceived, labels...)
+		writer.metric("graphite_points_buffered", "gauge", "Points waiting for the next flush of the graphite input.", graphite.PointsBuffered, labels...)
+		writer.metric("graphite_points_written_total", "counter", "Points written by the graphite input.", graphite.PointsWritten, labels...)
+		writer.metric("graphite_write_errors_total", "counter", "Points the graphite input couldn't write.", graphite.WriteErrors, labels...)
+		writer.family("graphite_flushes_total", "counter", "Flushes of the graphite input by trigger.")
+		writer.sample("graphite_flushes_total", graphite.SizeFlushes, append(labels, "trigger", "size")...)
+		writer.sample("graphite_flushes_total", graphite.IntervalFlushes, append(labels, "trigger", "interval")...)
+	}
+
+	if raft := stats.Raft; raft != nil {
+		writer.metric("raft_info", "gauge", "The raft name, state and leader of this server.", 1, "name", raft.Name, "state", raft.State, "leader", raft.Leader)
+		writer.metric("raft_term", "gauge", "Current raft term.", raft.Term)
+		writer.metric("raft_commit_index", "gauge", "Last committed raft log entry.", raft.CommitIndex)
+		writer.metric("raft_applied_index", "gauge", "Last applied raft log entry.", raft.AppliedIndex)
+		writer.metric("raft_term_changes_total", "counter", "Raft term changes since startup.", raft.TermChanges)
+		writer.metric("raft_leader_changes_total", "counter", "Raft leader changes since startup.", raft.LeaderChanges)
+		if len(raft.Peers) > 0 {
+			peers := []string{}
+			for name := range raft.Peers {
+				peers = append(peers, name)
+			}
+			sort.Strings(peers)
+			writer.family("raft_peer_lag", "gauge", "Committed raft log entries the peer doesn't have yet.")
+			for _, name := range peers {
+				writer.sample("raft_peer_lag", raft.Peers[name].Lag, "peer", name)
+			}
+			writer.family("raft_peer_last_contact_seconds", "gauge", "Time since the peer last answered the leader.")
+			for _, name := range peers {
+				seconds := float64(raft.Peers[name].LastContactMs) / 1000
+				writer.sample("raft_peer_last_contact_seconds", strconv.FormatFloat(seconds, 'f', -1, 64), "peer", name)
+			}
+		}
+	}
+
+	return writer.buffer.Bytes()
+}
@@ -1,8 +1,10 @@
 package http
 
 import (
+	"cluster"
 	"common"
 	"fmt"
+	"time"
 )
 
 type Operation struct {
@@ -76,6 +78,23 @@ func (self *MockUserManager) AuthenticateClusterAdmin(username, password string)
 	return nil, nil
 }
 
+func (self *MockUserManager) CreateAuthToken(requester common.User, ttl time.Duration) (string, time.Time, error) {
+	self.ops = append(self.ops, &Operation{"token_add", "", "", false})
+	return "root_token", time.Now().Add(ttl), nil
+}
+
+func (self *MockUserManager) AuthenticateToken(token string) (common.User, error) {
+	if token != "root_token" {
+		return nil, fmt.Errorf("Invalid or expired token")
+	}
+	return &cluster.ClusterAdmin{cluster.CommonUser{Name: "root"}}, nil
+}
+
+func (self *MockUserManager) DeleteAuthToken(token string) error {
+	self.ops = append(self.ops, &Operation{"token_del", "", "", false})
+	return nil
+}
+
 func (self *MockUserManager) CreateClusterAdminUser(request common.User, username, password string) error {
 	if username == "" {
 		return fmt.Errorf("Invalid empty username")
@@ -114,6 +133,16 @@ func (self *MockUserManager) ChangeDbUserPassword(requester common.User, db, use
 	return nil
 }
 
+func (self *MockUserManager) GrantDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error {
+	self.ops = append(self.ops, &Operation{"db_user_grant", username, regex, false})
+	return nil
+}
+
+func (self *MockUserManager) RevokeDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error {
+	self.ops = append(self.ops, &Operation{"db_user_revoke", username, regex, false})
+	return nil
+}
+
 func (self *MockUserManager) SetDbAdmin(requester common.User, db, username string, isAdmin bool) error {
 	self.ops = append(self.ops, &Operation{"db_user_admin", username, "", isAdmin})
 	return nil
@@ -0,0 +1,150 @@
+package http
+
+// Serializes query results as MessagePack, used when the query has
+// format=msgpack or accepts application/msgpack
+
+import (
+	"bytes"
+	. "common"
+	"encoding/binary"
+	"fmt"
+	"math"
+	libhttp "net/http"
+	"protocol"
+	"strings"
+)
+
+const MSGPACK_CONTENT_TYPE = "application/msgpack"
+
+// Buffers all the series like AllPointsWriter and writes them out as a
+// msgpack array of maps with the same name, columns and points keys as
+// the json response
+type MsgpackWriter struct {
+	memSeries map[string]*protocol.Series
+	w         libhttp.ResponseWriter
+	precision TimePrecision
+}
+
+func (self *MsgpackWriter) yield(series *protocol.Series) error {
+	oldSeries := self.memSeries[series.GetName()]
+	if oldSeries == nil {
+		self.memSeries[series.GetName()] = series
+		return nil
+	}
+
+	self.memSeries[series.GetName()] = MergeSeries(oldSeries, series)
+	return nil
+}
+
+func (self *MsgpackWriter) done() {
+	data, err := marshalMsgpack(SerializeSeries(self.memSeries, self.precision))
+	if err != nil {
+		self.w.WriteHeader(libhttp.StatusInternalServerError)
+		self.w.Write([]byte(err.Error()))
+		return
+	}
+	self.w.Header().Add("content-type", MSGPACK_CONTENT_TYPE)
+	self.w.WriteHeader(libhttp.StatusOK)
+	self.w.Write(data)
+}
+
+// Whether the client asked for msgpack in the accept header, e.g.
+// "application/msgpack" or "application/x-msgpack"
+func acceptsMsgpack(r *libhttp.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if mediaType == MSGPACK_CONTENT_TYPE || mediaType == "application/x-msgpack" {
+			return true
+		}
+	}
+	return false
+}
+
+func marshalMsgpack(series []*SerializedSeries) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writeMsgpackLength(buffer, len(series), 0x90, 0xdc, 0xdd)
+	for _, s := range series {
+		writeMsgpackLength(buffer, 3, 0x80, 0xde, 0xdf)
+		writeMsgpackString(buffer, "name")
+		writeMsgpackString(buffer, s.Name)
+		writeMsgpackString(buffer, "columns")
+		writeMsgpackLength(buffer, len(s.Columns), 0x90, 0xdc, 0xdd)
+		for _, column := range s.Columns {
+			writeMsgpackString(buffer, column)
+		}
+		writeMsgpackString(buffer, "points")
+		writeMsgpackLength(buffer, len(s.Points), 0x90, 0xdc, 0xdd)
+		for _, point := range s.Points {
+			writeMsgpackLength(buffer, len(point), 0x90, 0xdc, 0xdd)
+			for _, value := range point {
+				if err := writeMsgpackValue(buffer, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Writes the header of an array or a map, fix is the type of the
+// lengths below 16 and the others of the 16 and 32 bit lengths
+func writeMsgpackLength(buffer *bytes.Buffer, length int, fix, type16, type32 byte) {
+	switch {
+	case length < 16:
+		buffer.WriteByte(fix | byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(type16)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(type32)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackString(buffer *bytes.Buffer, str string) {
+	switch length := len(str); {
+	case length < 32:
+		buffer.WriteByte(0xa0 | byte(length))
+	case length <= math.MaxUint8:
+		buffer.WriteByte(0xd9)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(0xda)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(0xdb)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+	buffer.WriteString(str)
+}
+
+// Writes the values of the points, the integers always use 64 bits
+func writeMsgpackValue(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+	case bool:
+		if v {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+	case int64:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, v)
+	case int:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, int64(v))
+	case uint64:
+		buffer.WriteByte(0xcf)
+		binary.Write(buffer, binary.BigEndian, v)
+	case float64:
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, v)
+	case string:
+		writeMsgpackString(buffer, v)
+	default:
+		return fmt.Errorf("Cannot serialize %v of type %T as msgpack", value, value)
+	}
+	return nil
+}
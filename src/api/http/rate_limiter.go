@@ -0,0 +1,106 @@
+package http
+
+import (
+	"common"
+	"net"
+	"sync"
+	"time"
+)
+
+// clients that didn't write for this long are forgotten
+const rateLimiterClientExpiry = time.Minute
+
+// Limits the number of points per second written through the http
+// api, both in total and for each client. A limit of zero or less
+// disables it.
+type RateLimiter struct {
+	globalLimit    int
+	perClientLimit int
+	global         *common.TokenBucket
+	clients        map[string]*common.TokenBucket
+	lastCleanup    time.Time
+	lock           sync.Mutex
+}
+
+func NewRateLimiter(globalLimit, perClientLimit int) *RateLimiter {
+	now := time.Now()
+	limiter := &RateLimiter{
+		globalLimit:    globalLimit,
+		perClientLimit: perClientLimit,
+		clients:        make(map[string]*common.TokenBucket),
+		lastCleanup:    now,
+	}
+	if globalLimit > 0 {
+		limiter.global = common.NewTokenBucket(globalLimit, now)
+	}
+	return limiter
+}
+
+func (self *RateLimiter) enabled() bool {
+	return self.globalLimit > 0 || self.perClientLimit > 0
+}
+
+// Takes points tokens for the client with the given remote address.
+// Returns zero if the points can be written, otherwise how long the
+// client should wait before retrying.
+func (self *RateLimiter) Take(remoteAddr string, points int) time.Duration {
+	if !self.enabled() {
+		return 0
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	self.cleanup(now)
+
+	buckets := make([]*common.TokenBucket, 0, 2)
+	if self.global != nil {
+		buckets = append(buckets, self.global)
+	}
+	if self.perClientLimit > 0 {
+		client := clientHost(remoteAddr)
+		bucket := self.clients[client]
+		if bucket == nil {
+			bucket = common.NewTokenBucket(self.perClientLimit, now)
+			self.clients[client] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	// only take the tokens if all the buckets have enough of them
+	var wait time.Duration
+	for _, bucket := range buckets {
+		bucket.Refill(now)
+		if w := bucket.Wait(float64(points)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, bucket := range buckets {
+		bucket.Take(float64(points))
+	}
+	return 0
+}
+
+func (self *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(self.lastCleanup) < rateLimiterClientExpiry {
+		return
+	}
+	self.lastCleanup = now
+	for client, bucket := range self.clients {
+		if now.Sub(bucket.LastRefill()) > rateLimiterClientExpiry {
+			delete(self.clients, client)
+		}
+	}
+}
+
+func clientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	. "common"
+	"coordinator"
+	"encoding/json"
+	"fmt"
+	libhttp "net/http"
+	"parser"
+	"protocol"
+	"strconv"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// writes buffered for each subscription unless it's configured
+const DEFAULT_SUBSCRIPTION_BUFFER_SIZE = 1000
+
+// how often a comment is sent on an idle subscription stream, so
+// proxies don't close it
+const SUBSCRIPTION_KEEPALIVE_INTERVAL = 15 * time.Second
+
+// Streams the points matching the query as they're written as
+// server-sent events. Each write is sent as a "series" event with the
+// json of the series, the number of writes that were dropped since the
+// last event as a "dropped" event and the stream ends with an "error"
+// event if the subscription was closed because its buffer was full or
+// its user was deleted. The permissions of the user are checked again on
+// every write.
+func (self *HttpServer) subscribe(w libhttp.ResponseWriter, r *libhttp.Request) {
+	query := r.URL.Query().Get("q")
+	db := r.URL.Query().Get(":db")
+
+	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
+		precision, err := TimePrecisionFromString(r.URL.Query().Get("time_precision"))
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+
+		bufferSize := self.subscriptionBufferSize
+		if param := r.URL.Query().Get("buffer"); param != "" {
+			size, err := strconv.Atoi(param)
+			if err != nil || size <= 0 {
+				return libhttp.StatusBadRequest, "buffer must be a positive integer"
+			}
+			if size < bufferSize {
+				bufferSize = size
+			}
+		}
+		overflow := coordinator.SubscriptionDrop
+		if param := r.URL.Query().Get("overflow"); param != "" {
+			overflow = coordinator.SubscriptionOverflow(param)
+		}
+
+		flusher, ok := w.(libhttp.Flusher)
+		if !ok {
+			return libhttp.StatusInternalServerError, "The connection can't be streamed to"
+		}
+
+		subscription, err := self.coordinator.Subscribe(user, db, query, bufferSize, overflow)
+		if err != nil {
+			switch e := err.(type) {
+			case *parser.QueryError:
+				return errorToStatusCode(err), e.PrettyPrint()
+			case *QueryError:
+				// the subscription can't be made for the query
+				return libhttp.StatusBadRequest, e.ErrorMsg
+			}
+			return errorToStatusCode(err), err.Error()
+		}
+		defer self.coordinator.Unsubscribe(subscription)
+
+		w.Header().Add("content-type", "text/event-stream")
+		w.Header().Add("cache-control", "no-cache")
+		w.WriteHeader(libhttp.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(SUBSCRIPTION_KEEPALIVE_INTERVAL)
+		defer keepalive.Stop()
+		closed := closeNotification(w)
+		var dropped int64
+		for {
+			select {
+			case series, ok := <-subscription.Series():
+				if !ok {
+					if subscription.Overflowed() {
+						writeEvent(w, "error", map[string]string{"error": "The buffer of the subscription is full"})
+						flusher.Flush()
+					} else if subscription.Revoked() {
+						writeEvent(w, "error", map[string]string{"error": "The user of the subscription was deleted"})
+						flusher.Flush()
+					}
+					return -1, nil
+				}
+				if total := subscription.Dropped(); total > dropped {
+					err = writeEvent(w, "dropped", map[string]int64{"dropped": total - dropped})
+					dropped = total
+				}
+				if err == nil {
+					err = writeEvent(w, "series", SerializeSeries(map[string]*protocol.Series{"": series}, precision)[0])
+				}
+			case <-keepalive.C:
+				_, err = w.Write([]byte(": keepalive\n\n"))
+			case <-closed:
+				return -1, nil
+			}
+			if err != nil {
+				log.Info("Ending the subscription to %s of %s: %s", query, db, err)
+				return -1, nil
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func writeEvent(w libhttp.ResponseWriter, event string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"common"
+	"time"
 )
 
 type UserManager interface {
@@ -10,6 +11,14 @@ type UserManager interface {
 	AuthenticateDbUser(db, username, password string) (common.User, error)
 	// Returns the cluster admin with the given credentials
 	AuthenticateClusterAdmin(username, password string) (common.User, error)
+	// Returns a token that authenticates as requester for ttl and the
+	// time it expires
+	CreateAuthToken(requester common.User, ttl time.Duration) (string, time.Time, error)
+	// Returns the user that created the token, it's an error if the
+	// token expired or was revoked
+	AuthenticateToken(token string) (common.User, error)
+	// Revoke the token
+	DeleteAuthToken(token string) error
 	// Create a cluster admin user, it's an error if requester isn't a cluster admin
 	CreateClusterAdminUser(request common.User, username, password string) error
 	// Delete a cluster admin. Same restrictions as CreateClusterAdminUser
@@ -25,6 +34,12 @@ type UserManager interface {
 	// Change db user's password. It's an error if requester isn't a cluster admin or db admin
 	ChangeDbUserPassword(requester common.User, db, username, password string) error
 	ChangeDbUserPermissions(requester common.User, db, username, readPermissions, writePermissions string) error
+	// Give the db user read and/or write access to the series matching
+	// regex. Same restrictions apply as in ChangeDbUserPermissions
+	GrantDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error
+	// Take away the access given with regex, or all the access if regex
+	// is empty
+	RevokeDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error
 	// list cluster admins. only a cluster admin or the db admin can list the db users
 	ListDbUsers(requester common.User, db string) ([]common.User, error)
 	GetDbUser(requester common.User, db, username string) (common.User, error)
@@ -1,12 +1,17 @@
 package udp
 
 import (
+	"bytes"
 	"cluster"
 	. "common"
 	"coordinator"
 	"encoding/json"
+	"fmt"
 	"net"
 	"protocol"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	log "code.google.com/p/log4go"
 )
@@ -19,8 +24,80 @@ type Server struct {
 	conn          *net.UDPConn
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
+	// the format of the packets, json or line
+	format string
+	// the size of the socket receive buffer, the os default if zero
+	readBufferSize int
+	// packets are queued here until they're written, packets that
+	// arrive while it's full are dropped
+	queueSize int
+	// whether the database is taken from the packets instead of
+	// always writing to database, either from the database key of the
+	// json series or from the series name prefix before
+	// databaseSeparator
+	databaseFromPayload bool
+	databaseSeparator   string
+	// the parsed series are written once batchSize points are buffered
+	// or every batchTimeout, whichever comes first
+	batchSize    int
+	batchTimeout time.Duration
+	// the packets larger than maxPacketSize or with more than
+	// maxPointsPerPacket points are dropped, zero doesn't limit the
+	// points
+	maxPacketSize      int
+	maxPointsPerPacket int
+	// closed once the buffered points are written after the socket is
+	// closed
+	flushed chan struct{}
+	stats   Stats
 }
 
+// The series parsed since the last write, by database
+type seriesBatch struct {
+	series map[string][]*protocol.Series
+	points int
+}
+
+func (self *seriesBatch) add(db string, series ...*protocol.Series) {
+	self.series[db] = append(self.series[db], series...)
+	for _, s := range series {
+		self.points += len(s.Points)
+	}
+}
+
+// A json series that can specify the database it's written to
+type udpSeries struct {
+	SerializedSeries
+	Database string `json:"database"`
+}
+
+// Counters of the packets handled by a udp server
+type Stats struct {
+	Address         string `json:"address"`
+	Database        string `json:"database"`
+	PacketsReceived int64  `json:"packetsReceived"`
+	PacketsDropped  int64  `json:"packetsDropped"`
+	BytesRead       int64  `json:"bytesRead"`
+	ParseErrors     int64  `json:"parseErrors"`
+	// series dropped because their database doesn't exist
+	UnknownDatabase int64 `json:"unknownDatabase"`
+	// packets dropped because they're larger than max-packet-size or
+	// have more than max-points-per-packet points
+	PacketsTooLarge      int64 `json:"packetsTooLarge"`
+	PacketsTooManyPoints int64 `json:"packetsTooManyPoints"`
+}
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_LINE = "line"
+
+	DEFAULT_QUEUE_SIZE    = 1000
+	DEFAULT_BATCH_SIZE    = 1000
+	DEFAULT_BATCH_TIMEOUT = time.Second
+	// the largest possible udp payload
+	MAX_PACKET_SIZE = 65536
+)
+
 func NewServer(listenAddress string, database string, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
 	self := &Server{}
 
@@ -29,74 +106,314 @@ func NewServer(listenAddress string, database string, coord coordinator.Coordina
 	self.coordinator = coord
 	self.shutdown = make(chan bool, 1)
 	self.clusterConfig = clusterConfig
+	self.format = FORMAT_JSON
+	self.queueSize = DEFAULT_QUEUE_SIZE
+	self.batchSize = DEFAULT_BATCH_SIZE
+	self.batchTimeout = DEFAULT_BATCH_TIMEOUT
+	self.maxPacketSize = MAX_PACKET_SIZE
+	self.flushed = make(chan struct{})
 
 	return self
 }
 
+// Sets the format of the packets, json (the default) or line
+func (self *Server) SetFormat(format string) {
+	if format != "" {
+		self.format = format
+	}
+}
+
+// Sets the size of the socket receive buffer and the number of packets
+// that can be queued, zero keeps the defaults
+func (self *Server) SetBufferSizes(readBufferSize, queueSize int) {
+	self.readBufferSize = readBufferSize
+	if queueSize > 0 {
+		self.queueSize = queueSize
+	}
+}
+
+// Sets the number of points that are written at once and how long they
+// can be buffered, zero keeps the defaults
+func (self *Server) SetBatching(batchSize int, batchTimeout time.Duration) {
+	if batchSize > 0 {
+		self.batchSize = batchSize
+	}
+	if batchTimeout > 0 {
+		self.batchTimeout = batchTimeout
+	}
+}
+
+// Sets the size of the largest packet that's handled and the most
+// points a packet can have, zero keeps the defaults, which accept any
+// packet
+func (self *Server) SetLimits(maxPacketSize, maxPointsPerPacket int) {
+	if maxPacketSize > 0 && maxPacketSize < MAX_PACKET_SIZE {
+		self.maxPacketSize = maxPacketSize
+	}
+	self.maxPointsPerPacket = maxPointsPerPacket
+}
+
+// Takes the database of each series from the packet instead of
+// writing everything to the configured database. The configured
+// database is used for series that don't specify one.
+func (self *Server) SetDatabaseFromPayload(enabled bool, separator string) {
+	self.databaseFromPayload = enabled
+	self.databaseSeparator = separator
+}
+
+func (self *Server) Stats() *Stats {
+	return &Stats{
+		Address:         self.listenAddress,
+		Database:        self.database,
+		PacketsReceived: atomic.LoadInt64(&self.stats.PacketsReceived),
+		PacketsDropped:  atomic.LoadInt64(&self.stats.PacketsDropped),
+		BytesRead:       atomic.LoadInt64(&self.stats.BytesRead),
+		ParseErrors:     atomic.LoadInt64(&self.stats.ParseErrors),
+		UnknownDatabase: atomic.LoadInt64(&self.stats.UnknownDatabase),
+
+		PacketsTooLarge:      atomic.LoadInt64(&self.stats.PacketsTooLarge),
+		PacketsTooManyPoints: atomic.LoadInt64(&self.stats.PacketsTooManyPoints),
+	}
+}
+
 func (self *Server) getAuth() {
 	// just use any (the first) of the list of admins.
 	names := self.clusterConfig.GetClusterAdmins()
 	self.user = self.clusterConfig.GetClusterAdmin(names[0])
 }
 
-func (self *Server) ListenAndServe() {
+func (self *Server) ListenAndServe() error {
 	var err error
 
+	if self.format != FORMAT_JSON && self.format != FORMAT_LINE {
+		err = fmt.Errorf("UDPServer: unknown format %s, must be %s or %s", self.format, FORMAT_JSON, FORMAT_LINE)
+		log.Error(err)
+		return err
+	}
+
 	self.getAuth()
 
 	addr, err := net.ResolveUDPAddr("udp4", self.listenAddress)
 	if err != nil {
 		log.Error("UDPServer: ResolveUDPAddr: ", err)
-		return
+		return err
 	}
 
 	if self.listenAddress != "" {
 		self.conn, err = net.ListenUDP("udp", addr)
 		if err != nil {
 			log.Error("UDPServer: Listen: ", err)
-			return
+			return err
+		}
+		if self.readBufferSize > 0 {
+			if err := self.conn.SetReadBuffer(self.readBufferSize); err != nil {
+				log.Warn("UDPServer: cannot set the read buffer size to %d: %s", self.readBufferSize, err)
+			}
 		}
 	}
 	defer self.conn.Close()
 	self.HandleSocket(self.conn)
+	return nil
 }
 
+// Reads packets from the socket and queues them to be written by
+// another goroutine, so slow writes don't cause the socket buffer to
+// overflow. Packets are dropped if the queue is full.
 func (self *Server) HandleSocket(socket *net.UDPConn) {
-	buffer := make([]byte, 2048)
+	// one more byte than the largest packet handled, so the larger
+	// ones are detected instead of being truncated
+	buffer := make([]byte, self.maxPacketSize+1)
+	queue := make(chan []byte, self.queueSize)
+	defer close(queue)
+	go self.handlePackets(queue)
 
 	for {
 		n, _, err := socket.ReadFromUDP(buffer)
+		if err != nil && strings.Contains(err.Error(), "closed network") {
+			log.Info("UDP listener on %s closed", self.listenAddress)
+			return
+		}
 		if err != nil || n == 0 {
 			log.Error("UDP ReadFromUDP error: %s", err)
 			continue
 		}
 
-		serializedSeries := []*SerializedSeries{}
-		err = json.Unmarshal(buffer[0:n], &serializedSeries)
-		if err != nil {
-			log.Error("UDP json error: %s", err)
+		atomic.AddInt64(&self.stats.PacketsReceived, 1)
+		atomic.AddInt64(&self.stats.BytesRead, int64(n))
+		if n > self.maxPacketSize {
+			if atomic.AddInt64(&self.stats.PacketsTooLarge, 1)%1000 == 1 {
+				log.Warn("UDP dropping a packet larger than %d bytes sent to %s", self.maxPacketSize, self.listenAddress)
+			}
 			continue
 		}
 
-		for _, s := range serializedSeries {
-			if len(s.Points) == 0 {
-				continue
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		select {
+		case queue <- packet:
+		default:
+			if atomic.AddInt64(&self.stats.PacketsDropped, 1)%1000 == 1 {
+				log.Warn("UDP queue of %s is full, dropping packets", self.listenAddress)
 			}
+		}
+	}
+}
 
-			series, err := ConvertToDataStoreSeries(s, SecondPrecision)
-			if err != nil {
-				log.Error("UDP cannot convert received data: %s", err)
-				continue
-			}
+// Parses the queued packets and writes their series in batches. The
+// last batch is written once the queue is closed.
+func (self *Server) handlePackets(queue <-chan []byte) {
+	defer close(self.flushed)
+	ticker := time.NewTicker(self.batchTimeout)
+	defer ticker.Stop()
 
-			serie := []*protocol.Series{series}
-			err = self.coordinator.WriteSeriesData(self.user, self.database, serie)
-			if err != nil {
-				log.Error("UDP cannot write data: %s", err)
-				continue
+	batch := &seriesBatch{series: map[string][]*protocol.Series{}}
+	for {
+		select {
+		case packet, ok := <-queue:
+			if !ok {
+				self.flush(batch)
+				return
+			}
+			if self.format == FORMAT_LINE {
+				self.handleLines(string(packet), batch)
+			} else {
+				self.handleJson(packet, batch)
+			}
+			if batch.points >= self.batchSize {
+				self.flush(batch)
 			}
+		case <-ticker.C:
+			self.flush(batch)
 		}
+	}
+}
 
+func (self *Server) flush(batch *seriesBatch) {
+	for db, series := range batch.series {
+		self.writeSeries(db, series)
 	}
+	batch.series = map[string][]*protocol.Series{}
+	batch.points = 0
+}
 
+func (self *Server) handleJson(packet []byte, batch *seriesBatch) {
+	decoder := json.NewDecoder(bytes.NewReader(packet))
+	decoder.UseNumber()
+	serializedSeries := []*udpSeries{}
+	err := decoder.Decode(&serializedSeries)
+	if err != nil {
+		atomic.AddInt64(&self.stats.ParseErrors, 1)
+		log.Error("UDP json error: %s", err)
+		return
+	}
+	points := 0
+	for _, s := range serializedSeries {
+		points += len(s.Points)
+	}
+	if self.tooManyPoints(points) {
+		return
+	}
+
+	for _, s := range serializedSeries {
+		if len(s.Points) == 0 {
+			continue
+		}
+
+		series, err := ConvertToDataStoreSeries(&s.SerializedSeries, SecondPrecision)
+		if err != nil {
+			atomic.AddInt64(&self.stats.ParseErrors, 1)
+			log.Error("UDP cannot convert received data: %s", err)
+			continue
+		}
+
+		if db, ok := self.route(s.Database, series); ok {
+			batch.add(db, series)
+		}
+	}
+}
+
+// Returns the database the series should be written to, removing the
+// database prefix from the series name if there's one. Returns false
+// if the database doesn't exist.
+func (self *Server) route(db string, series *protocol.Series) (string, bool) {
+	if !self.databaseFromPayload {
+		return self.database, true
+	}
+
+	if db == "" && self.databaseSeparator != "" {
+		if parts := strings.SplitN(series.GetName(), self.databaseSeparator, 2); len(parts) == 2 {
+			db = parts[0]
+			series.Name = &parts[1]
+		}
+	}
+	if db == "" {
+		db = self.database
+	}
+
+	if db == "" || !self.clusterConfig.DatabasesExists(db) {
+		if atomic.AddInt64(&self.stats.UnknownDatabase, 1)%1000 == 1 {
+			log.Warn("UDP dropping series %s for unknown database '%s'", series.GetName(), db)
+		}
+		return "", false
+	}
+	return db, true
+}
+
+// Adds the points of a packet in the line protocol to the batch, lines
+// that can't be parsed are dropped without affecting the rest of the
+// packet
+func (self *Server) handleLines(packet string, batch *seriesBatch) {
+	series := []*protocol.Series{}
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := ParseLine(line)
+		if err != nil {
+			atomic.AddInt64(&self.stats.ParseErrors, 1)
+			log.Warn("UDP dropping invalid line: %s", err)
+			continue
+		}
+		series = append(series, s)
+	}
+	if self.tooManyPoints(len(series)) {
+		return
+	}
+	for _, s := range series {
+		if db, ok := self.route("", s); ok {
+			batch.add(db, s)
+		}
+	}
+}
+
+// Returns true, and counts the packet, if it has more points than a
+// packet can have
+func (self *Server) tooManyPoints(points int) bool {
+	if self.maxPointsPerPacket <= 0 || points <= self.maxPointsPerPacket {
+		return false
+	}
+	if atomic.AddInt64(&self.stats.PacketsTooManyPoints, 1)%1000 == 1 {
+		log.Warn("UDP dropping a packet of %d points sent to %s, packets can't have more than %d", points, self.listenAddress, self.maxPointsPerPacket)
+	}
+	return true
+}
+
+func (self *Server) writeSeries(db string, series []*protocol.Series) {
+	err := self.coordinator.WriteSeriesData(self.user, db, series)
+	if err != nil {
+		log.Error("UDP cannot write data: %s", err)
+	}
+}
+
+func (self *Server) Close() {
+	if self.conn != nil {
+		log.Info("Closing udp listener on %s", self.listenAddress)
+		self.conn.Close()
+		select {
+		case <-self.flushed:
+		case <-time.After(time.Second * 5):
+			log.Error("Timed out writing the points buffered by the udp listener on %s", self.listenAddress)
+		}
+	}
 }
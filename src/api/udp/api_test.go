@@ -0,0 +1,205 @@
+package udp
+
+import (
+	"common"
+	"coordinator"
+	"fmt"
+	"net"
+	"protocol"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type UdpSuite struct {
+	coordinator *MockCoordinator
+	server      *Server
+	client      net.Conn
+}
+
+var _ = Suite(&UdpSuite{})
+
+type MockCoordinator struct {
+	coordinator.Coordinator
+	lock   sync.Mutex
+	writes [][]*protocol.Series
+}
+
+func (self *MockCoordinator) WriteSeriesData(_ common.User, db string, series []*protocol.Series) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writes = append(self.writes, series)
+	return nil
+}
+
+// the number of points written so far
+func (self *MockCoordinator) points() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	points := 0
+	for _, series := range self.writes {
+		for _, s := range series {
+			points += len(s.Points)
+		}
+	}
+	return points
+}
+
+func (self *UdpSuite) SetUpTest(c *C) {
+	self.coordinator = &MockCoordinator{}
+	self.server = NewServer("127.0.0.1:0", "db1", self.coordinator, nil)
+}
+
+func (self *UdpSuite) TearDownTest(c *C) {
+	if self.client != nil {
+		self.client.Close()
+		self.client = nil
+	}
+	self.server.Close()
+}
+
+// Listens on a random port and connects the client to it
+func (self *UdpSuite) listen(c *C) {
+	addr, err := net.ResolveUDPAddr("udp4", self.server.listenAddress)
+	c.Assert(err, IsNil)
+	self.server.conn, err = net.ListenUDP("udp", addr)
+	c.Assert(err, IsNil)
+	go self.server.HandleSocket(self.server.conn)
+	self.client, err = net.Dial("udp", self.server.conn.LocalAddr().String())
+	c.Assert(err, IsNil)
+}
+
+func (self *UdpSuite) send(c *C, packets ...string) {
+	received := self.server.Stats().PacketsReceived
+	for _, packet := range packets {
+		_, err := self.client.Write([]byte(packet))
+		c.Assert(err, IsNil)
+	}
+	for i := 0; i < 100 && self.server.Stats().PacketsReceived < received+int64(len(packets)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(self.server.Stats().PacketsReceived, Equals, received+int64(len(packets)))
+}
+
+func (self *UdpSuite) TestPacketsWithTooManyPointsAreDropped(c *C) {
+	self.server.SetFormat(FORMAT_LINE)
+	self.server.SetLimits(0, 2)
+	self.listen(c)
+
+	self.send(c,
+		"cpu value=1 1\ncpu value=2 2\ncpu value=3 3",
+		"cpu value=4 4\ncpu value=5 5",
+		// the lines that can't be parsed don't count
+		"cpu value=6 6\ncpu\ncpu value=7 7",
+	)
+	self.server.Close()
+
+	c.Assert(self.coordinator.points(), Equals, 4)
+	stats := self.server.Stats()
+	c.Assert(stats.PacketsTooManyPoints, Equals, int64(1))
+	c.Assert(stats.ParseErrors, Equals, int64(1))
+}
+
+func (self *UdpSuite) TestJsonPacketsWithTooManyPointsAreDropped(c *C) {
+	self.server.SetLimits(0, 2)
+	self.listen(c)
+
+	self.send(c,
+		`[{"name": "cpu", "columns": ["value"], "points": [[1], [2]]}, {"name": "mem", "columns": ["value"], "points": [[3]]}]`,
+		`[{"name": "cpu", "columns": ["value"], "points": [[4]]}, {"name": "mem", "columns": ["value"], "points": [[5]]}]`,
+	)
+	self.server.Close()
+
+	c.Assert(self.coordinator.points(), Equals, 2)
+	c.Assert(self.server.Stats().ParseErrors, Equals, int64(0))
+	c.Assert(self.server.Stats().PacketsTooManyPoints, Equals, int64(1))
+}
+
+func (self *UdpSuite) TestOversizedPacketsAreDropped(c *C) {
+	self.server.SetFormat(FORMAT_LINE)
+	self.server.SetLimits(100, 0)
+	self.listen(c)
+
+	line := "cpu value=1 1"
+	self.send(c,
+		strings.Repeat(line+"\n", 100/len(line)+1),
+		strings.Repeat(line+"\n", 100/(len(line)+1)),
+	)
+	self.server.Close()
+
+	c.Assert(self.coordinator.points(), Equals, 100/(len(line)+1))
+	c.Assert(self.server.Stats().PacketsTooLarge, Equals, int64(1))
+}
+
+func (self *UdpSuite) TestPacketSizeLimitIsCapped(c *C) {
+	self.server.SetLimits(0, 0)
+	c.Assert(self.server.maxPacketSize, Equals, MAX_PACKET_SIZE)
+	self.server.SetLimits(MAX_PACKET_SIZE+1, 0)
+	c.Assert(self.server.maxPacketSize, Equals, MAX_PACKET_SIZE)
+	self.server.SetLimits(512, 0)
+	c.Assert(self.server.maxPacketSize, Equals, 512)
+}
+
+// Waits until the points were written
+func (self *UdpSuite) waitForPoints(c *C, points int) {
+	for i := 0; i < 100 && self.coordinator.points() < points; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(self.coordinator.points(), Equals, points)
+}
+
+func (self *UdpSuite) writes() int {
+	self.coordinator.lock.Lock()
+	defer self.coordinator.lock.Unlock()
+	return len(self.coordinator.writes)
+}
+
+func (self *UdpSuite) TestFullBatchesAreWritten(c *C) {
+	self.server.SetFormat(FORMAT_LINE)
+	self.server.SetBatching(3, time.Hour)
+	self.listen(c)
+
+	self.send(c, "cpu value=1 1\ncpu value=2 2")
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(self.coordinator.points(), Equals, 0)
+
+	// the batch is written once it has batch-size points
+	self.send(c, "cpu value=3 3\ncpu value=4 4")
+	self.waitForPoints(c, 4)
+	c.Assert(self.writes(), Equals, 1)
+}
+
+func (self *UdpSuite) TestBatchesAreWrittenAfterTheTimeout(c *C) {
+	self.server.SetFormat(FORMAT_LINE)
+	self.server.SetBatching(1000, 50*time.Millisecond)
+	self.listen(c)
+
+	self.send(c, "cpu value=1 1")
+	self.waitForPoints(c, 1)
+	self.send(c, "cpu value=2 2\ncpu value=3 3")
+	self.waitForPoints(c, 3)
+	c.Assert(self.writes(), Equals, 2)
+}
+
+func (self *UdpSuite) TestCloseWritesTheQueuedPackets(c *C) {
+	self.server.SetFormat(FORMAT_LINE)
+	self.server.SetBatching(1000, time.Hour)
+	self.listen(c)
+
+	for i := 0; i < 10; i++ {
+		self.send(c, fmt.Sprintf("cpu value=%d %d\nmem value=%d %d", i, i, i, i))
+	}
+	c.Assert(self.coordinator.points(), Equals, 0)
+	self.server.Close()
+
+	c.Assert(self.coordinator.points(), Equals, 20)
+	c.Assert(self.writes(), Equals, 1)
+}
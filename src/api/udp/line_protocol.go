@@ -0,0 +1,139 @@
+package udp
+
+import (
+	"common"
+	"fmt"
+	"protocol"
+	"strconv"
+	"strings"
+)
+
+// Parses a point in the line protocol, i.e.
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// into a series with a single point. Tags become string columns,
+// integer field values have to end with an i, unsuffixed numbers are
+// floats. The timestamp is in nanoseconds, the server time is used if
+// it's missing. Commas, spaces and equal signs in names can be escaped
+// with a backslash.
+func ParseLine(line string) (*protocol.Series, error) {
+	sections := splitUnescaped(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected a measurement, fields and an optional timestamp in '%s'", line)
+	}
+
+	key := splitUnescaped(sections[0], ',')
+	name := unescape(key[0])
+	if name == "" {
+		return nil, fmt.Errorf("missing measurement in '%s'", line)
+	}
+
+	columns := []string{}
+	values := []*protocol.FieldValue{}
+	for _, tag := range key[1:] {
+		tagName, tagValue, err := splitPair(tag)
+		if err != nil {
+			return nil, err
+		}
+		v := unescape(tagValue)
+		columns = append(columns, tagName)
+		values = append(values, &protocol.FieldValue{StringValue: &v})
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',') {
+		fieldName, fieldValue, err := splitPair(field)
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseFieldValue(fieldValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for field %s: %s", fieldName, err)
+		}
+		columns = append(columns, fieldName)
+		values = append(values, value)
+	}
+
+	point := &protocol.Point{Values: values}
+	if len(sections) == 3 {
+		nanoseconds, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp '%s'", sections[2])
+		}
+		microseconds := nanoseconds / 1000
+		point.Timestamp = &microseconds
+	}
+
+	return &protocol.Series{
+		Name:   &name,
+		Fields: columns,
+		Points: []*protocol.Point{point},
+	}, nil
+}
+
+func splitPair(pair string) (string, string, error) {
+	parts := splitUnescaped(pair, '=')
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected key=value but got '%s'", pair)
+	}
+	return unescape(parts[0]), parts[1], nil
+}
+
+func parseFieldValue(value string) (*protocol.FieldValue, error) {
+	switch {
+	case value[0] == '"':
+		if len(value) < 2 || value[len(value)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string %s", value)
+		}
+		s := strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+		return &protocol.FieldValue{StringValue: &s}, nil
+	case strings.HasSuffix(value, "i"):
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.FieldValue{Int64Value: &i}, nil
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return &protocol.FieldValue{BoolValue: &common.TRUE}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return &protocol.FieldValue{BoolValue: &common.FALSE}, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.FieldValue{DoubleValue: &f}, nil
+}
+
+// Splits s on sep, ignoring separators that are escaped with a
+// backslash or inside double quotes
+func splitUnescaped(s string, sep byte) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,68 @@
+package udp
+
+import (
+	"protocol"
+
+	. "launchpad.net/gocheck"
+)
+
+type LineProtocolSuite struct{}
+
+var _ = Suite(&LineProtocolSuite{})
+
+func (self *LineProtocolSuite) TestParseLine(c *C) {
+	str := func(s string) *protocol.FieldValue { return &protocol.FieldValue{StringValue: protocol.String(s)} }
+	integer := func(i int64) *protocol.FieldValue { return &protocol.FieldValue{Int64Value: protocol.Int64(i)} }
+	float := func(f float64) *protocol.FieldValue { return &protocol.FieldValue{DoubleValue: protocol.Float64(f)} }
+	boolean := func(b bool) *protocol.FieldValue { return &protocol.FieldValue{BoolValue: &b} }
+
+	for _, test := range []struct {
+		line      string
+		name      string
+		columns   []string
+		values    []*protocol.FieldValue
+		timestamp *int64
+	}{
+		{"cpu value=1.5", "cpu", []string{"value"}, []*protocol.FieldValue{float(1.5)}, nil},
+		{"cpu,host=web01,region=us-east value=1 1400000000000000000", "cpu", []string{"host", "region", "value"},
+			[]*protocol.FieldValue{str("web01"), str("us-east"), float(1)}, protocol.Int64(1400000000000000)},
+		// integers end with an i
+		{"cpu count=42i,load=-1e3", "cpu", []string{"count", "load"}, []*protocol.FieldValue{integer(42), float(-1000)}, nil},
+		{"cpu up=t,down=FALSE,ok=True", "cpu", []string{"up", "down", "ok"}, []*protocol.FieldValue{boolean(true), boolean(false), boolean(true)}, nil},
+		// the strings can have separators and escaped quotes
+		{`log message="a b,c=d \"e\""`, "log", []string{"message"}, []*protocol.FieldValue{str(`a b,c=d "e"`)}, nil},
+		// the names and the tag values can have escaped separators
+		{`disk\ io,path=/var\,/tmp,key\=1=x used=1`, "disk io", []string{"path", "key=1", "used"},
+			[]*protocol.FieldValue{str("/var,/tmp"), str("x"), float(1)}, nil},
+	} {
+		series, err := ParseLine(test.line)
+		c.Assert(err, IsNil, Commentf("%s", test.line))
+		c.Assert(series.GetName(), Equals, test.name, Commentf("%s", test.line))
+		c.Assert(series.Fields, DeepEquals, test.columns, Commentf("%s", test.line))
+		c.Assert(series.Points, HasLen, 1)
+		c.Assert(series.Points[0].Values, DeepEquals, test.values, Commentf("%s", test.line))
+		c.Assert(series.Points[0].Timestamp, DeepEquals, test.timestamp, Commentf("%s", test.line))
+	}
+}
+
+func (self *LineProtocolSuite) TestParseInvalidLines(c *C) {
+	for _, test := range []struct {
+		line string
+		err  string
+	}{
+		{"cpu", "expected a measurement, fields and an optional timestamp in 'cpu'"},
+		{"cpu value=1 1400000000 extra", "expected a measurement, fields .*"},
+		{",host=web01 value=1", "missing measurement in .*"},
+		{"cpu,host value=1", "expected key=value but got 'host'"},
+		{"cpu,host= value=1", "expected key=value but got 'host='"},
+		{"cpu value", "expected key=value but got 'value'"},
+		{"cpu =1", "expected key=value but got '=1'"},
+		{"cpu value=abc", "invalid value for field value: .*"},
+		{"cpu value=1.5i", "invalid value for field value: .*"},
+		{`cpu value="abc`, "invalid value for field value: unterminated string .*"},
+		{"cpu value=1 yesterday", "invalid timestamp 'yesterday'"},
+	} {
+		_, err := ParseLine(test.line)
+		c.Assert(err, ErrorMatches, test.err, Commentf("%s", test.line))
+	}
+}
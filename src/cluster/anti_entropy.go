@@ -0,0 +1,645 @@
+package cluster
+
+import (
+	"common"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"parser"
+	p "protocol"
+	"regexp"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+var (
+	checksumRequest = p.Request_CHECKSUM
+	writeRequest    = p.Request_WRITE
+)
+
+const checksumSeriesName = "checksums"
+
+// The checksum of the points a shard has in a window of time. Replicas
+// of a shard have the same checksums once they're in sync.
+type WindowChecksum struct {
+	// the start of the window in microseconds
+	StartTime int64
+	Count     int64
+	Checksum  uint64
+}
+
+// Returns the checksums of a local shard, one per window of time that
+// has points, ordered by time
+func (self *ClusterConfiguration) LocalShardChecksums(shardId uint32, window time.Duration) ([]*WindowChecksum, error) {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[shardId]
+	self.shardsByIdLock.RUnlock()
+	if shard == nil {
+		return nil, fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	if !shard.IsLocal {
+		return nil, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	databases := self.GetDatabases()
+	return shard.localChecksums(databases, window, newThrottle(self.config.AntiEntropyMaxPointsPerSecond))
+}
+
+// called by the server, compares the local shards with their replicas
+// every anti-entropy-interval and copies the points they're missing
+func (self *ClusterConfiguration) StartAntiEntropy() {
+	interval := self.config.AntiEntropyInterval
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			for _, shard := range self.GetAllShards() {
+				if !shard.IsLocal || len(shard.clusterServers) == 0 {
+					continue
+				}
+				if _, err := self.RepairShard(shard.Id()); err != nil {
+					log.Error("Error repairing shard %d: %s", shard.Id(), err)
+				}
+			}
+		}
+	}()
+}
+
+// Compares the local copy of the shard with the copies on the other
+// servers and writes the points that are missing locally. Returns the
+// number of points copied. Only the local copy is repaired, the other
+// servers repair theirs when they run the same comparison.
+func (self *ClusterConfiguration) RepairShard(shardId uint32) (int, error) {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[shardId]
+	self.shardsByIdLock.RUnlock()
+	if shard == nil {
+		return 0, fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	if !shard.IsLocal {
+		return 0, fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	admins := self.GetClusterAdmins()
+	if len(admins) == 0 {
+		return 0, errors.New("Cannot repair shards without a cluster admin")
+	}
+
+	self.repairLock.Lock()
+	defer self.repairLock.Unlock()
+
+	if ttl := self.config.AntiEntropyDeleteTtl; ttl > 0 {
+		shard.expireDeletes(time.Now().Add(-ttl))
+	}
+	window := self.config.AntiEntropyWindow
+	timeout := self.config.AntiEntropyTimeout
+	throttle := newThrottle(self.config.AntiEntropyMaxPointsPerSecond)
+	databases := self.GetDatabases()
+	copied := 0
+	for _, server := range shard.clusterServers {
+		if !server.IsUp() {
+			log.Warn("Skipping the repair of shard %d from server %d, the server is down", shardId, server.Id)
+			continue
+		}
+
+		// read the local checksums again since the previous server
+		// might have filled in some of the windows
+		local, err := shard.localChecksums(databases, window, throttle)
+		if err != nil {
+			return copied, err
+		}
+		remote, err := shard.remoteChecksums(server, window, timeout)
+		if err != nil {
+			return copied, err
+		}
+
+		for _, start := range mismatchedWindows(local, remote) {
+			end := start + int64(window/time.Microsecond)
+			for _, db := range databases {
+				count, err := shard.copyMissingPoints(server, db.Name, admins[0], start, end, throttle, timeout)
+				if err != nil {
+					return copied, err
+				}
+				copied += count
+			}
+		}
+	}
+
+	if copied > 0 {
+		log.Info("Repaired shard %d, copied %d points from its replicas", shardId, copied)
+	}
+	return copied, nil
+}
+
+// Returns the start of the windows whose remote checksums are different
+// from the local ones
+func mismatchedWindows(local, remote []*WindowChecksum) []int64 {
+	localByTime := make(map[int64]*WindowChecksum, len(local))
+	for _, checksum := range local {
+		localByTime[checksum.StartTime] = checksum
+	}
+
+	windows := []int64{}
+	for _, checksum := range remote {
+		l := localByTime[checksum.StartTime]
+		if l == nil || l.Count != checksum.Count || l.Checksum != checksum.Checksum {
+			windows = append(windows, checksum.StartTime)
+		}
+	}
+	return windows
+}
+
+func ChecksumsToSeries(checksums []*WindowChecksum) *p.Series {
+	points := make([]*p.Point, 0, len(checksums))
+	for _, checksum := range checksums {
+		count := checksum.Count
+		value := int64(checksum.Checksum)
+		point := &p.Point{
+			Values: []*p.FieldValue{
+				&p.FieldValue{Int64Value: &count},
+				&p.FieldValue{Int64Value: &value},
+			},
+		}
+		point.SetTimestampInMicroseconds(checksum.StartTime)
+		points = append(points, point)
+	}
+	return &p.Series{Name: p.String(checksumSeriesName), Fields: []string{"count", "checksum"}, Points: points}
+}
+
+func checksumsFromSeries(series *p.Series) []*WindowChecksum {
+	checksums := make([]*WindowChecksum, 0, len(series.Points))
+	for _, point := range series.Points {
+		checksums = append(checksums, &WindowChecksum{
+			StartTime: point.GetTimestamp(),
+			Count:     point.Values[0].GetInt64Value(),
+			Checksum:  uint64(point.Values[1].GetInt64Value()),
+		})
+	}
+	return checksums
+}
+
+func (self *ShardData) localChecksums(databases []*Database, window time.Duration, throttle *throttle) ([]*WindowChecksum, error) {
+	if window < time.Microsecond {
+		return nil, fmt.Errorf("Invalid checksum window %s", window)
+	}
+	windowMicro := int64(window / time.Microsecond)
+	windows := make(map[int64]*WindowChecksum)
+	for _, db := range databases {
+		processor := &pointsProcessor{database: db.Name, throttle: throttle}
+		processor.yield = func(point *p.Point, hash uint64) {
+			t := point.GetTimestamp()
+			start := t - t%windowMicro
+			if t < 0 && t%windowMicro != 0 {
+				start -= windowMicro
+			}
+			checksum := windows[start]
+			if checksum == nil {
+				checksum = &WindowChecksum{StartTime: start}
+				windows[start] = checksum
+			}
+			checksum.Count++
+			// sums don't depend on the order the points are read in
+			checksum.Checksum += hash
+		}
+		if err := self.queryLocal(db.Name, self.startMicro, self.endMicro, processor); err != nil {
+			return nil, err
+		}
+	}
+
+	checksums := make([]*WindowChecksum, 0, len(windows))
+	for _, checksum := range windows {
+		checksums = append(checksums, checksum)
+	}
+	sort.Sort(windowChecksums(checksums))
+	return checksums, nil
+}
+
+func (self *ShardData) remoteChecksums(server *ClusterServer, window, timeout time.Duration) ([]*WindowChecksum, error) {
+	nanoseconds := int64(window)
+	request := &p.Request{Type: &checksumRequest, Database: p.String(""), ShardId: &self.id, ChecksumWindow: &nanoseconds}
+	responses, err := readResponses(server, request, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the checksums of shard %d from server %d: %s", self.id, server.Id, err)
+	}
+
+	checksums := []*WindowChecksum{}
+	for _, response := range responses {
+		if response.ErrorMessage != nil {
+			return nil, fmt.Errorf("Error getting the checksums of shard %d from server %d: %s", self.id, server.Id, response.GetErrorMessage())
+		}
+		if response.Series != nil {
+			checksums = append(checksums, checksumsFromSeries(response.Series)...)
+		}
+	}
+	return checksums, nil
+}
+
+// Makes the request to the server and reads its responses up to the end
+// of the stream before they're processed, so the connection they come
+// on isn't held up while the points are throttled or written. If no
+// response comes within the timeout the rest of the stream is read and
+// dropped in the background.
+func readResponses(server *ClusterServer, request *p.Request, timeout time.Duration) ([]*p.Response, error) {
+	responses := make(chan *p.Response, 1)
+	go server.MakeRequest(request, responses)
+
+	read := []*p.Response{}
+	for {
+		response, err := nextResponse(responses, timeout)
+		if err != nil {
+			go drainResponses(responses)
+			return nil, err
+		}
+		read = append(read, response)
+		if isEndOfStream(response) {
+			return read, nil
+		}
+	}
+}
+
+func drainResponses(responses <-chan *p.Response) {
+	for response := range responses {
+		if isEndOfStream(response) {
+			return
+		}
+	}
+}
+
+func isEndOfStream(response *p.Response) bool {
+	return response.GetType() == p.Response_END_STREAM || response.GetType() == p.Response_ACCESS_DENIED
+}
+
+// Waits for the next response of a request to another server, fails
+// if it doesn't come within the timeout. Doesn't time out if the
+// timeout is zero.
+func nextResponse(responses <-chan *p.Response, timeout time.Duration) (*p.Response, error) {
+	if timeout <= 0 {
+		return <-responses, nil
+	}
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no response in %s", timeout)
+	}
+}
+
+// Queries the points of the window [start, end) from the server and
+// writes the ones that the local shard doesn't have, except for the
+// ones removed by a delete that ran locally
+func (self *ShardData) copyMissingPoints(server *ClusterServer, database, user string, start, end int64, throttle *throttle, timeout time.Duration) (int, error) {
+	existing := make(map[uint64]bool)
+	processor := &pointsProcessor{database: database, throttle: throttle}
+	processor.yield = func(point *p.Point, hash uint64) {
+		existing[hash] = true
+	}
+	if err := self.queryLocal(database, start, end, processor); err != nil {
+		return 0, err
+	}
+
+	query := windowQuery(start, end)
+	isDbUser := false
+	request := &p.Request{
+		Type:     &queryRequest,
+		Database: &database,
+		ShardId:  &self.id,
+		Query:    &query,
+		UserName: &user,
+		IsDbUser: &isDbUser,
+	}
+	responses, err := readResponses(server, request, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading shard %d from server %d: %s", self.id, server.Id, err)
+	}
+
+	copied := 0
+	for _, response := range responses {
+		if response.ErrorMessage != nil {
+			return copied, fmt.Errorf("Error reading shard %d from server %d: %s", self.id, server.Id, response.GetErrorMessage())
+		}
+		if response.GetType() == p.Response_ACCESS_DENIED {
+			return copied, fmt.Errorf("Access denied reading shard %d from server %d", self.id, server.Id)
+		}
+		if response.Series == nil {
+			continue
+		}
+
+		series := response.Series
+		throttle.wait(len(series.Points))
+		missing := make([]*p.Point, 0)
+		for _, point := range series.Points {
+			t := point.GetTimestamp()
+			if t < start || t >= end || self.isDeleted(database, series.GetName(), t) {
+				continue
+			}
+			if !existing[hashPoint(database, series.GetName(), series.Fields, point)] {
+				missing = append(missing, point)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		write := &p.Request{
+			Type:        &writeRequest,
+			Database:    &database,
+			ShardId:     &self.id,
+			MultiSeries: []*p.Series{&p.Series{Name: series.Name, Fields: series.Fields, Points: missing}},
+		}
+		if err := self.store.Write(write); err != nil {
+			return copied, err
+		}
+		copied += len(missing)
+	}
+	return copied, nil
+}
+
+// Reads all the points of the local shard in [start, end) into the processor
+func (self *ShardData) queryLocal(database string, start, end int64, processor *pointsProcessor) error {
+	query, err := parser.ParseQuery(windowQuery(start, end))
+	if err != nil {
+		return err
+	}
+	processor.start = start
+	processor.end = end
+	user := &ClusterAdmin{CommonUser{Name: "anti-entropy"}}
+	querySpec := parser.NewQuerySpec(user, database, query[0])
+
+	shard, err := self.store.GetShard(self.id)
+	if err != nil {
+		return err
+	}
+	defer self.store.ReturnShard(self.id)
+	return shard.Query(querySpec, processor)
+}
+
+// A delete or drop series that ran on the local copy of a shard. The
+// repairs don't copy the points it removed back from a replica that
+// missed it until it expires.
+type DeleteMarker struct {
+	Database string `json:"database"`
+	// the names of the series it removed the points of
+	Series []string `json:"series,omitempty"`
+	// the regexes of the series it removed the points of
+	Regexes []string `json:"regexes,omitempty"`
+	// the time range of the delete in microseconds, inclusive
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// when the delete ran, in seconds since the epoch
+	Time int64 `json:"time"`
+
+	compiledRegexes []*regexp.Regexp
+}
+
+func (self *DeleteMarker) matches(database, series string, t int64) bool {
+	if database != self.Database || t < self.Start || t > self.End {
+		return false
+	}
+	for _, name := range self.Series {
+		if name == series {
+			return true
+		}
+	}
+	if self.compiledRegexes == nil {
+		for _, expression := range self.Regexes {
+			regex, err := regexp.Compile(expression)
+			if err != nil {
+				log.Error("Invalid regex %s of the delete marker of %s: %s", expression, self.Database, err)
+				continue
+			}
+			self.compiledRegexes = append(self.compiledRegexes, regex)
+		}
+	}
+	for _, regex := range self.compiledRegexes {
+		if regex.MatchString(series) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembers the delete or drop series query that ran on the local copy
+// of the shard, the marker is saved with the shard so it's kept after
+// a restart
+func (self *ShardData) recordDelete(querySpec *parser.QuerySpec) {
+	d := &DeleteMarker{Database: querySpec.Database(), Time: time.Now().Unix()}
+	var names []*parser.Value
+	switch {
+	case querySpec.IsDeleteFromSeriesQuery():
+		query := querySpec.DeleteQuery()
+		for _, name := range query.GetFromClause().Names {
+			names = append(names, name.Name)
+		}
+		d.Start = common.TimeToMicroseconds(query.GetStartTime())
+		d.End = common.TimeToMicroseconds(query.GetEndTime())
+	case querySpec.IsDropSeriesQuery():
+		names = []*parser.Value{&parser.Value{Name: querySpec.Query().DropSeriesQuery.GetTableName(), Type: parser.ValueTableName}}
+		d.Start = math.MinInt64
+		d.End = math.MaxInt64
+	default:
+		return
+	}
+	for _, name := range names {
+		if regex, ok := name.GetCompiledRegex(); ok {
+			d.Regexes = append(d.Regexes, regex.String())
+		} else {
+			d.Series = append(d.Series, name.Name)
+		}
+	}
+
+	self.deletesLock.Lock()
+	defer self.deletesLock.Unlock()
+	self.loadDeletes()
+	self.deletes = append(self.deletes, d)
+	self.saveDeletes()
+}
+
+func (self *ShardData) isDeleted(database, series string, t int64) bool {
+	self.deletesLock.Lock()
+	defer self.deletesLock.Unlock()
+	self.loadDeletes()
+	for _, d := range self.deletes {
+		if d.matches(database, series, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forgets the deletes that ran before the given time, the replicas that
+// missed them had the time to apply them
+func (self *ShardData) expireDeletes(before time.Time) {
+	self.deletesLock.Lock()
+	defer self.deletesLock.Unlock()
+	self.loadDeletes()
+	kept := make([]*DeleteMarker, 0, len(self.deletes))
+	for _, d := range self.deletes {
+		if d.Time >= before.Unix() {
+			kept = append(kept, d)
+		}
+	}
+	if len(kept) == len(self.deletes) {
+		return
+	}
+	log.Info("Forgetting %d deletes of shard %d that ran before %s", len(self.deletes)-len(kept), self.id, before)
+	self.deletes = kept
+	self.saveDeletes()
+}
+
+// Loads the delete markers saved with the local shard, called with
+// deletesLock held. The shards without a local store keep them in
+// memory only.
+func (self *ShardData) loadDeletes() {
+	if self.deletesLoaded || self.store == nil {
+		return
+	}
+	markers, err := self.store.DeleteMarkers(self.id)
+	if err != nil {
+		log.Error("Cannot load the deletes of shard %d: %s", self.id, err)
+		return
+	}
+	self.deletes = append(markers, self.deletes...)
+	self.deletesLoaded = true
+}
+
+// called with deletesLock held, the markers that couldn't be loaded
+// aren't overwritten
+func (self *ShardData) saveDeletes() {
+	if self.store == nil || !self.deletesLoaded {
+		return
+	}
+	if err := self.store.SaveDeleteMarkers(self.id, self.deletes); err != nil {
+		log.Error("Cannot save the deletes of shard %d, a repair after a restart may copy the deleted points back: %s", self.id, err)
+	}
+}
+
+// the time conditions of queries are inclusive, the points outside of
+// [start, end) are dropped after being read
+func windowQuery(start, end int64) string {
+	return fmt.Sprintf("select * from /.*/ where time > %du and time < %du", start-1, end)
+}
+
+// Hashes the points yielded by a shard query and passes them to the
+// yield function
+type pointsProcessor struct {
+	database string
+	start    int64
+	end      int64
+	throttle *throttle
+	yield    func(point *p.Point, hash uint64)
+}
+
+func (self *pointsProcessor) YieldPoint(seriesName *string, columnNames []string, point *p.Point) bool {
+	return self.YieldSeries(&p.Series{Name: seriesName, Fields: columnNames, Points: []*p.Point{point}})
+}
+
+func (self *pointsProcessor) YieldSeries(series *p.Series) bool {
+	self.throttle.wait(len(series.Points))
+	for _, point := range series.Points {
+		t := point.GetTimestamp()
+		if t < self.start || t >= self.end {
+			continue
+		}
+		self.yield(point, hashPoint(self.database, series.GetName(), series.Fields, point))
+	}
+	return true
+}
+
+func (self *pointsProcessor) Close() {}
+
+func (self *pointsProcessor) SetShardInfo(shardId int, shardLocal bool) {}
+
+func (self *pointsProcessor) GetName() string {
+	return "PointsProcessor"
+}
+
+// Hashes the database, series, timestamp, sequence number and the
+// values of the point. Null values are skipped since the columns that
+// are returned depend on the points the replica has.
+func hashPoint(database, series string, fields []string, point *p.Point) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(database))
+	h.Write([]byte{0})
+	h.Write([]byte(series))
+	h.Write([]byte{0})
+	binary.Write(h, binary.BigEndian, point.GetTimestamp())
+	binary.Write(h, binary.BigEndian, point.GetSequenceNumber())
+
+	indices := make([]int, 0, len(fields))
+	for i := range fields {
+		if i < len(point.Values) && !point.Values[i].GetIsNull() {
+			indices = append(indices, i)
+		}
+	}
+	// replicas don't necessarily return the columns in the same order
+	sort.Sort(fieldIndices{indices, fields})
+	for _, i := range indices {
+		h.Write([]byte(fields[i]))
+		h.Write([]byte{0})
+		hashFieldValue(h, point.Values[i])
+	}
+	return h.Sum64()
+}
+
+func hashFieldValue(h hash.Hash64, value *p.FieldValue) {
+	switch {
+	case value.StringValue != nil:
+		h.Write([]byte{'s'})
+		h.Write([]byte(*value.StringValue))
+	case value.Int64Value != nil:
+		h.Write([]byte{'i'})
+		binary.Write(h, binary.BigEndian, *value.Int64Value)
+	case value.DoubleValue != nil:
+		h.Write([]byte{'d'})
+		binary.Write(h, binary.BigEndian, math.Float64bits(*value.DoubleValue))
+	case value.BoolValue != nil:
+		h.Write([]byte{'b'})
+		binary.Write(h, binary.BigEndian, *value.BoolValue)
+	}
+}
+
+type fieldIndices struct {
+	indices []int
+	fields  []string
+}
+
+func (self fieldIndices) Len() int { return len(self.indices) }
+func (self fieldIndices) Swap(i, j int) {
+	self.indices[i], self.indices[j] = self.indices[j], self.indices[i]
+}
+func (self fieldIndices) Less(i, j int) bool {
+	return self.fields[self.indices[i]] < self.fields[self.indices[j]]
+}
+
+type windowChecksums []*WindowChecksum
+
+func (self windowChecksums) Len() int           { return len(self) }
+func (self windowChecksums) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self windowChecksums) Less(i, j int) bool { return self[i].StartTime < self[j].StartTime }
+
+// Limits the rate at which points are read, doesn't limit if the rate
+// is zero
+type throttle struct {
+	rate   int
+	points int
+	start  time.Time
+}
+
+func newThrottle(pointsPerSecond int) *throttle {
+	return &throttle{rate: pointsPerSecond, start: time.Now()}
+}
+
+func (self *throttle) wait(points int) {
+	if self.rate <= 0 {
+		return
+	}
+	self.points += points
+	expected := time.Duration(self.points) * time.Second / time.Duration(self.rate)
+	if elapsed := time.Now().Sub(self.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"configuration"
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+	"time"
+)
+
+type AntiEntropySuite struct{}
+
+var _ = Suite(&AntiEntropySuite{})
+
+func newPoint(timestamp int64, values ...*protocol.FieldValue) *protocol.Point {
+	sequenceNumber := uint64(1)
+	return &protocol.Point{Timestamp: &timestamp, SequenceNumber: &sequenceNumber, Values: values}
+}
+
+func (self *AntiEntropySuite) TestMismatchedWindows(c *C) {
+	local := []*WindowChecksum{
+		&WindowChecksum{StartTime: 0, Count: 1, Checksum: 1},
+		&WindowChecksum{StartTime: 10, Count: 1, Checksum: 1},
+		&WindowChecksum{StartTime: 20, Count: 2, Checksum: 3},
+		&WindowChecksum{StartTime: 30, Count: 1, Checksum: 1},
+	}
+	remote := []*WindowChecksum{
+		&WindowChecksum{StartTime: 0, Count: 1, Checksum: 1},
+		&WindowChecksum{StartTime: 10, Count: 1, Checksum: 2},
+		&WindowChecksum{StartTime: 20, Count: 1, Checksum: 3},
+		&WindowChecksum{StartTime: 40, Count: 1, Checksum: 1},
+	}
+	// the windows only the local shard has aren't copied from the remote one
+	c.Assert(mismatchedWindows(local, remote), DeepEquals, []int64{10, 20, 40})
+	c.Assert(mismatchedWindows(local, local), HasLen, 0)
+}
+
+func (self *AntiEntropySuite) TestChecksumsSurviveTheConversionToASeries(c *C) {
+	checksums := []*WindowChecksum{
+		&WindowChecksum{StartTime: -3600000000, Count: 3, Checksum: 1 << 63},
+		&WindowChecksum{StartTime: 0, Count: 1, Checksum: 42},
+	}
+	c.Assert(checksumsFromSeries(ChecksumsToSeries(checksums)), DeepEquals, checksums)
+}
+
+func (self *AntiEntropySuite) TestHashPointIgnoresTheColumnOrderAndTheNulls(c *C) {
+	value := 1.5
+	name := "foo"
+	isNull := true
+	point := newPoint(10, &protocol.FieldValue{DoubleValue: &value}, &protocol.FieldValue{StringValue: &name})
+	reordered := newPoint(10, &protocol.FieldValue{StringValue: &name}, &protocol.FieldValue{IsNull: &isNull}, &protocol.FieldValue{DoubleValue: &value})
+
+	hash := hashPoint("db", "cpu", []string{"value", "name"}, point)
+	c.Assert(hashPoint("db", "cpu", []string{"name", "other", "value"}, reordered), Equals, hash)
+	c.Assert(hashPoint("db", "memory", []string{"value", "name"}, point), Not(Equals), hash)
+	c.Assert(hashPoint("db", "cpu", []string{"value", "name"}, newPoint(11, point.Values...)), Not(Equals), hash)
+}
+
+func (self *AntiEntropySuite) TestDeletedPointsAreRemembered(c *C) {
+	shard := NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, NewMockWal())
+	user := &ClusterAdmin{CommonUser{Name: "root"}}
+	for _, q := range []string{"delete from /^cpu/ where time > 10u and time < 20u", "drop series memory"} {
+		queries, err := parser.ParseQuery(q)
+		c.Assert(err, IsNil)
+		shard.recordDelete(parser.NewQuerySpec(user, "db", queries[0]))
+	}
+
+	c.Assert(shard.isDeleted("db", "cpu.idle", 15), Equals, true)
+	c.Assert(shard.isDeleted("db", "cpu.idle", 25), Equals, false)
+	c.Assert(shard.isDeleted("db", "disk", 15), Equals, false)
+	c.Assert(shard.isDeleted("other", "cpu.idle", 15), Equals, false)
+	c.Assert(shard.isDeleted("db", "memory", 1000000), Equals, true)
+	c.Assert(shard.isDeleted("db", "memory.free", 1000000), Equals, false)
+}
+
+func (self *AntiEntropySuite) TestDeletesAreSavedWithTheShardUntilTheyExpire(c *C) {
+	store := &MockShardStore{}
+	shard := NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, NewMockWal())
+	c.Assert(shard.SetLocalStore(store, 1), IsNil)
+	user := &ClusterAdmin{CommonUser{Name: "root"}}
+	for _, q := range []string{"delete from /^cpu/i where time > 10u and time < 20u", "drop series memory"} {
+		queries, err := parser.ParseQuery(q)
+		c.Assert(err, IsNil)
+		shard.recordDelete(parser.NewQuerySpec(user, "db", queries[0]))
+	}
+
+	// the shard of a restarted server loads them from the store
+	restarted := NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, NewMockWal())
+	c.Assert(restarted.SetLocalStore(store, 1), IsNil)
+	c.Assert(restarted.isDeleted("db", "CPU.idle", 15), Equals, true)
+	c.Assert(restarted.isDeleted("db", "cpu.idle", 25), Equals, false)
+	c.Assert(restarted.isDeleted("db", "memory", 1000000), Equals, true)
+
+	store.markers[1][0].Time = time.Now().Add(-2 * time.Hour).Unix()
+	restarted = NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, NewMockWal())
+	c.Assert(restarted.SetLocalStore(store, 1), IsNil)
+	restarted.expireDeletes(time.Now().Add(-time.Hour))
+	c.Assert(restarted.isDeleted("db", "cpu.idle", 15), Equals, false)
+	c.Assert(restarted.isDeleted("db", "memory", 1000000), Equals, true)
+	c.Assert(store.markers[1], HasLen, 1)
+}
+
+func (self *AntiEntropySuite) TestResponsesAreReadAfterATimeout(c *C) {
+	connection := &MockServerConnection{}
+	server := &ClusterServer{Id: 2, connection: connection, isUp: true}
+	_, err := readResponses(server, &protocol.Request{Type: &checksumRequest}, 10*time.Millisecond)
+	c.Assert(err, ErrorMatches, "no response in .*")
+
+	// the responses that come late don't hold up the connection
+	connection.lock.Lock()
+	stream := connection.stream
+	connection.lock.Unlock()
+	c.Assert(stream, NotNil)
+	for i := 0; i < 10; i++ {
+		response := &protocol.Response{Type: &queryResponse}
+		if i == 9 {
+			response.Type = &endStreamResponse
+		}
+		select {
+		case stream <- response:
+		case <-time.After(time.Second):
+			c.Fatalf("response %d wasn't read", i)
+		}
+	}
+}
+
+func (self *AntiEntropySuite) TestNextResponseTimesOut(c *C) {
+	responses := make(chan *protocol.Response, 1)
+	_, err := nextResponse(responses, time.Millisecond)
+	c.Assert(err, NotNil)
+
+	responses <- &protocol.Response{Type: &endStreamResponse}
+	response, err := nextResponse(responses, time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(response.GetType(), Equals, endStreamResponse)
+}
+
+func (self *AntiEntropySuite) TestUnknownShardsAreNotCompared(c *C) {
+	store := &MockShardStore{}
+	config := NewClusterConfiguration(&configuration.Configuration{AntiEntropyWindow: time.Hour}, NewMockWal(), store, nil)
+	_, err := config.LocalShardChecksums(1, time.Hour)
+	c.Assert(err, ErrorMatches, "Shard 1 doesn't exist")
+
+	// the shards the store doesn't have aren't created to be read
+	shard := NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, NewMockWal())
+	c.Assert(shard.SetLocalStore(store, 1), IsNil)
+	created := len(store.created)
+	_, err = shard.localChecksums([]*Database{&Database{Name: "db"}}, time.Hour, newThrottle(0))
+	c.Assert(err, ErrorMatches, "Shard 1 doesn't exist on this server")
+	c.Assert(store.created, HasLen, created)
+}
@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"common"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// A bearer token that authenticates as the user that created it, with
+// the user's current permissions. Only the hash of the token is kept,
+// so the raft log and snapshots can't be used to authenticate.
+type AuthToken struct {
+	Hash string `json:"hash"`
+	// empty if the token was created by a cluster admin
+	Db       string    `json:"db"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Returns a new random token and the AuthToken that has to be saved
+// for it
+func NewAuthToken(db, username string, ttl time.Duration) (string, *AuthToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	return token, &AuthToken{
+		Hash:     HashAuthToken(token),
+		Db:       db,
+		Username: username,
+		Created:  now,
+		Expires:  now.Add(ttl),
+	}, nil
+}
+
+func HashAuthToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (self *AuthToken) isOwnedBy(db, username string) bool {
+	return self.Db == db && self.Username == username
+}
+
+// Saves the token, the tokens that expired before it was created are
+// removed
+func (self *ClusterConfiguration) SaveAuthToken(token *AuthToken) {
+	self.authTokensLock.Lock()
+	defer self.authTokensLock.Unlock()
+	for hash, t := range self.authTokens {
+		if t.Expires.Before(token.Created) {
+			delete(self.authTokens, hash)
+		}
+	}
+	self.authTokens[token.Hash] = token
+}
+
+func (self *ClusterConfiguration) DeleteAuthToken(hash string) {
+	self.authTokensLock.Lock()
+	defer self.authTokensLock.Unlock()
+	delete(self.authTokens, hash)
+}
+
+func (self *ClusterConfiguration) GetAuthToken(hash string) *AuthToken {
+	self.authTokensLock.RLock()
+	defer self.authTokensLock.RUnlock()
+	return self.authTokens[hash]
+}
+
+// Removes the tokens of a user that's deleted, so they aren't valid
+// for a new user with the same name
+func (self *ClusterConfiguration) deleteUserAuthTokens(db, username string) {
+	self.authTokensLock.Lock()
+	defer self.authTokensLock.Unlock()
+	for hash, token := range self.authTokens {
+		if token.isOwnedBy(db, username) {
+			delete(self.authTokens, hash)
+		}
+	}
+}
+
+func (self *ClusterConfiguration) getAuthTokens() []*AuthToken {
+	self.authTokensLock.RLock()
+	defer self.authTokensLock.RUnlock()
+	tokens := make([]*AuthToken, 0, len(self.authTokens))
+	for _, token := range self.authTokens {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// Returns the user that created the token, if the token didn't expire
+// and wasn't revoked
+func (self *ClusterConfiguration) AuthenticateToken(token string) (common.User, error) {
+	t := self.GetAuthToken(HashAuthToken(token))
+	if t == nil || time.Now().After(t.Expires) {
+		return nil, common.NewAuthorizationError("Invalid or expired token")
+	}
+
+	if t.Db == "" {
+		if user := self.GetClusterAdmin(t.Username); user != nil {
+			return user, nil
+		}
+	} else if user := self.GetDbUser(t.Db, t.Username); user != nil {
+		return user, nil
+	}
+	return nil, common.NewAuthorizationError("Invalid or expired token")
+}
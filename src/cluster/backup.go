@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned by incremental backups of shards that weren't modified
+// since their last backup
+var ShardNotModifiedError = errors.New("The shard wasn't modified since the last backup")
+
+// Writes a backup of the local replica of the shard. For incremental
+// backups since is the modification marker the shard had when it was
+// last backed up, ShardNotModifiedError is returned if it didn't change.
+func (self *ClusterConfiguration) BackupShard(shardId uint32, since int64, w io.Writer) error {
+	if err := self.checkLocalShard(shardId); err != nil {
+		return err
+	}
+	return self.shardStore.BackupShard(shardId, since, w)
+}
+
+// Returns the marker that changes when the local replica of the shard
+// is modified after it was backed up
+func (self *ClusterConfiguration) ShardModificationMarker(shardId uint32) (int64, error) {
+	if err := self.checkLocalShard(shardId); err != nil {
+		return 0, err
+	}
+	return self.shardStore.ShardModificationMarker(shardId)
+}
+
+// Loads a backup into the local replica of the shard. To restore a
+// backup on a new server the shard is created on the server with the
+// time range of the shard that was backed up first.
+func (self *ClusterConfiguration) RestoreShard(shardId uint32, r io.Reader) error {
+	if err := self.checkLocalShard(shardId); err != nil {
+		return err
+	}
+	return self.shardStore.RestoreShard(shardId, r)
+}
+
+func (self *ClusterConfiguration) checkLocalShard(shardId uint32) error {
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[shardId]
+	self.shardsByIdLock.RUnlock()
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", shardId)
+	}
+	if !shard.IsLocal {
+		return fmt.Errorf("Shard %d isn't stored on this server", shardId)
+	}
+	return nil
+}
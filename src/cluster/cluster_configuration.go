@@ -15,6 +15,7 @@ import (
 	"protocol"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"wal"
 
@@ -39,6 +40,10 @@ type WAL interface {
 	CreateCheckpoint() error
 	RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
 	RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	Size() (int64, error)
+	PendingRequests() map[uint32]uint32
+	UnflushedRequests() int
+	LogFiles() int
 }
 
 type ShardCreator interface {
@@ -47,17 +52,25 @@ type ShardCreator interface {
 	CreateShards(shards []*NewShardData) ([]*ShardData, error)
 }
 
+type ShardMover interface {
+	// called by the server a shard replica was moved to once it has
+	// copied all the points, drops the replica on the source server
+	FinishShardMove(shardId uint32) error
+}
+
 const (
 	FIRST_LOWER_CASE_CHARACTER = uint8('a')
 )
 
 /*
-  This struct stores all the metadata confiugration information about a running cluster. This includes
-  the servers in the cluster and their state, databases, users, and which continuous queries are running.
+This struct stores all the metadata confiugration information about a running cluster. This includes
+the servers in the cluster and their state, databases, users, and which continuous queries are running.
 */
 type ClusterConfiguration struct {
-	createDatabaseLock         sync.RWMutex
-	DatabaseReplicationFactors map[string]struct{}
+	createDatabaseLock sync.RWMutex
+	// the replication factor of each database, zero for the databases
+	// that use the one of the cluster
+	DatabaseReplicationFactors map[string]uint8
 	usersLock                  sync.RWMutex
 	clusterAdmins              map[string]*ClusterAdmin
 	dbUsers                    map[string]map[string]*DbUser
@@ -70,7 +83,7 @@ type ClusterConfiguration struct {
 	LocalServer                *ClusterServer
 	config                     *configuration.Configuration
 	addedLocalServerWait       chan bool
-	addedLocalServer           bool
+	addedLocalServer           int32
 	connectionCreator          func(string) ServerConnection
 	shardStore                 LocalShardStore
 	wal                        WAL
@@ -85,6 +98,36 @@ type ClusterConfiguration struct {
 	shardsByIdLock             sync.RWMutex
 	LocalRaftName              string
 	writeBuffers               []*WriteBuffer
+	localWriteBuffer           *WriteBuffer
+	recoveredFromWAL           int32
+	// how long the data of each database is kept, guarded by
+	// createDatabaseLock
+	retentionPolicies map[string]time.Duration
+	// the named retention policies of each database
+	namedRetentionPolicies map[string]map[string]time.Duration
+	// the databases that were dropped and not created again, with the
+	// id of the last shard created before the drop. Their data is
+	// dropped from the local shards up to it by the retention sweeper,
+	// the writes to them are discarded. Guarded by createDatabaseLock
+	droppedDatabases map[string]uint32
+	// what the shards do with the duplicate points written to each
+	// database, the ones that keep them aren't in it. Guarded by
+	// createDatabaseLock.
+	duplicatePointPolicies map[string]DuplicatePointPolicy
+	// held while a shard is being repaired from its replicas
+	repairLock sync.Mutex
+	shardMover ShardMover
+	// the shard replicas being moved, keyed by the shard id
+	shardMoves     map[uint32]*ShardMove
+	shardMovesLock sync.RWMutex
+	// the progress of the moves to the local server
+	shardMoveProgress map[uint32]*shardMoveProgress
+	shardMoveAdded    chan bool
+	// signaled when the local server is removed from the cluster
+	localServerRemoved chan bool
+	// the tokens of the http api, keyed by the hash of the token
+	authTokens     map[string]*AuthToken
+	authTokensLock sync.RWMutex
 }
 
 type ContinuousQuery struct {
@@ -93,7 +136,8 @@ type ContinuousQuery struct {
 }
 
 type Database struct {
-	Name string `json:"name"`
+	Name              string `json:"name"`
+	ReplicationFactor uint8  `json:"replicationFactor,omitempty"`
 }
 
 func NewClusterConfiguration(
@@ -102,7 +146,11 @@ func NewClusterConfiguration(
 	shardStore LocalShardStore,
 	connectionCreator func(string) ServerConnection) *ClusterConfiguration {
 	return &ClusterConfiguration{
-		DatabaseReplicationFactors: make(map[string]struct{}),
+		DatabaseReplicationFactors: make(map[string]uint8),
+		retentionPolicies:          make(map[string]time.Duration),
+		namedRetentionPolicies:     make(map[string]map[string]time.Duration),
+		droppedDatabases:           make(map[string]uint32),
+		duplicatePointPolicies:     make(map[string]DuplicatePointPolicy),
 		clusterAdmins:              make(map[string]*ClusterAdmin),
 		dbUsers:                    make(map[string]map[string]*DbUser),
 		continuousQueries:          make(map[string][]*ContinuousQuery),
@@ -117,6 +165,11 @@ func NewClusterConfiguration(
 		shortTermShards:            make([]*ShardData, 0),
 		random:                     rand.New(rand.NewSource(time.Now().UnixNano())),
 		shardsById:                 make(map[uint32]*ShardData, 0),
+		shardMoves:                 make(map[uint32]*ShardMove),
+		shardMoveProgress:          make(map[uint32]*shardMoveProgress),
+		shardMoveAdded:             make(chan bool, 1),
+		localServerRemoved:         make(chan bool, 1),
+		authTokens:                 make(map[string]*AuthToken),
 	}
 }
 
@@ -124,13 +177,17 @@ func (self *ClusterConfiguration) SetShardCreator(shardCreator ShardCreator) {
 	self.shardCreator = shardCreator
 }
 
+// The most shards of each type created ahead of time in one check, in
+// case the pre-create window is much longer than the shard duration
+const MAX_SHARDS_CREATED_AHEAD = 100
+
 // called by the server, this will wake up every 10 mintues to see if it should
 // create a shard for the next window of time. This way shards get created before
 // a bunch of writes stream in and try to create it all at the same time.
 func (self *ClusterConfiguration) CreateFutureShardsAutomaticallyBeforeTimeComes() {
 	go func() {
 		for {
-			time.Sleep(time.Minute * 10)
+			time.Sleep(self.config.ShardPreCreateInterval)
 			log.Debug("Checking to see if future shards should be created")
 			self.automaticallyCreateFutureShard(self.shortTermShards, SHORT_TERM)
 			self.automaticallyCreateFutureShard(self.longTermShards, LONG_TERM)
@@ -138,17 +195,38 @@ func (self *ClusterConfiguration) CreateFutureShardsAutomaticallyBeforeTimeComes
 	}()
 }
 
+// Creates the shards following the latest one of each database the
+// shards are dedicated to until they cover the pre-create window
 func (self *ClusterConfiguration) automaticallyCreateFutureShard(shards []*ShardData, shardType ShardType) {
-	if len(shards) == 0 {
-		// don't automatically create shards if they haven't created any yet.
-		return
+	// the shards are in time descending order. Don't automatically
+	// create shards if they haven't created any yet.
+	latest := map[string]*ShardData{}
+	for _, shard := range shards {
+		if latest[shard.database] == nil {
+			latest[shard.database] = shard
+		}
 	}
-	latestShard := shards[0]
-	if latestShard.endTime.Add(-15*time.Minute).Unix() < time.Now().Unix() {
-		newShardTime := latestShard.endTime.Add(time.Second)
+	for database, shard := range latest {
+		// the database was dropped or uses the shared shards now
+		if database != "" && self.shardDatabase(database) != database {
+			continue
+		}
+		self.automaticallyCreateFutureShardsAfter(shard, shardType)
+	}
+}
+
+func (self *ClusterConfiguration) automaticallyCreateFutureShardsAfter(latest *ShardData, shardType ShardType) {
+	endTime := latest.endTime
+	for i := 0; i < MAX_SHARDS_CREATED_AHEAD && endTime.Add(-self.config.ShardPreCreateWindow).Before(time.Now()); i++ {
+		newShardTime := endTime.Add(time.Second)
 		microSecondEpochForNewShard := newShardTime.Unix() * 1000 * 1000
 		log.Info("Automatically creating shard for %s", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
-		self.createShards(microSecondEpochForNewShard, shardType)
+		created, err := self.createShards(microSecondEpochForNewShard, shardType, latest.database)
+		if err != nil || len(created) == 0 {
+			log.Error("Cannot create the shard for %s: %v", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"), err)
+			return
+		}
+		endTime = created[0].endTime
 	}
 }
 
@@ -172,6 +250,145 @@ func (self *ClusterConfiguration) WaitForLocalServerLoaded() {
 	<-self.addedLocalServerWait
 }
 
+// Returns true once the local server was added to the cluster
+// configuration, i.e. WaitForLocalServerLoaded() returned
+func (self *ClusterConfiguration) IsLocalServerLoaded() bool {
+	return atomic.LoadInt32(&self.addedLocalServer) == 1
+}
+
+// Returns true once RecoverFromWAL() finished replaying the wal to
+// all the servers
+func (self *ClusterConfiguration) HasRecoveredFromWAL() bool {
+	return atomic.LoadInt32(&self.recoveredFromWAL) == 1
+}
+
+// Returns true if the local shard store is open and can be written to
+func (self *ClusterConfiguration) IsShardStoreOpen() bool {
+	return self.shardStore != nil && !self.shardStore.IsClosed()
+}
+
+// Returns the size of the wal on disk, 0 if there's no wal
+func (self *ClusterConfiguration) WalSize() (int64, error) {
+	if self.wal == nil {
+		return 0, nil
+	}
+	return self.wal.Size()
+}
+
+// Returns the stats of the read cache of the local shards, nil if it's
+// disabled
+func (self *ClusterConfiguration) ReadCacheStats() *ReadCacheStats {
+	if self.shardStore == nil {
+		return nil
+	}
+	return self.shardStore.ReadCacheStats()
+}
+
+// Compacts the engine of the local replica of the shard
+func (self *ClusterConfiguration) CompactShard(shardId uint32) error {
+	if err := self.checkLocalShard(shardId); err != nil {
+		return err
+	}
+	return self.shardStore.CompactShard(shardId)
+}
+
+// Returns the last compaction of the local shards that were compacted
+// since startup
+func (self *ClusterConfiguration) LocalShardCompactionStats() map[uint32]*ShardCompactionStats {
+	if self.shardStore == nil {
+		return nil
+	}
+	return self.shardStore.CompactionStats()
+}
+
+// Returns the size and content of the shards stored on this server
+func (self *ClusterConfiguration) LocalShardStats() map[uint32]*LocalShardStats {
+	if self.shardStore == nil {
+		return nil
+	}
+	return self.shardStore.ShardStats()
+}
+
+// Returns the number of log files of the wal
+func (self *ClusterConfiguration) WalLogFiles() int {
+	if self.wal == nil {
+		return 0
+	}
+	return self.wal.LogFiles()
+}
+
+// Returns the number of requests in the wal that weren't fsynced yet
+func (self *ClusterConfiguration) UnflushedWalRequests() int {
+	if self.wal == nil {
+		return 0
+	}
+	return self.wal.UnflushedRequests()
+}
+
+// Returns the number of requests buffered in memory for the local
+// shards, zero until the server recovered from the wal
+func (self *ClusterConfiguration) LocalWriteBufferDepth() int {
+	if self.localWriteBuffer == nil {
+		return 0
+	}
+	return self.localWriteBuffer.Depth()
+}
+
+// Returns the number of requests buffered in memory for each server,
+// including the local one
+func (self *ClusterConfiguration) WriteBufferDepths() map[uint32]int {
+	depths := map[uint32]int{}
+	for _, buffer := range self.writeBuffers {
+		depths[buffer.serverId] = buffer.Depth()
+	}
+	return depths
+}
+
+// Returns the number of times the connection to each server tried to
+// reconnect since startup, the servers without a connection that
+// counts them are left out
+func (self *ClusterConfiguration) ReconnectAttempts() map[uint32]int64 {
+	attempts := map[uint32]int64{}
+	for _, server := range self.servers {
+		if counter, ok := server.connection.(interface {
+			ReconnectAttempts() int64
+		}); ok {
+			attempts[server.Id] = counter.ReconnectAttempts()
+		}
+	}
+	return attempts
+}
+
+// Returns how far ahead of the local clock the clock of each server is,
+// the servers whose skew wasn't measured yet are left out
+func (self *ClusterConfiguration) ClockSkews() map[uint32]time.Duration {
+	skews := map[uint32]time.Duration{}
+	for _, server := range self.servers {
+		if skew, ok := server.ClockSkew(); ok {
+			skews[server.Id] = skew
+		}
+	}
+	return skews
+}
+
+// Returns the number of requests in the wal that still have to be
+// written to each server, nil if there's no wal
+func (self *ClusterConfiguration) PendingWalRequests() map[uint32]uint32 {
+	if self.wal == nil {
+		return nil
+	}
+	return self.wal.PendingRequests()
+}
+
+// Returns the number of points written to each local shard since the
+// server started
+func (self *ClusterConfiguration) LocalShardPointCounts() map[uint32]int64 {
+	if self.shardStore == nil {
+		return map[uint32]int64{}
+	}
+	return self.shardStore.PointCounts()
+}
+
 func (self *ClusterConfiguration) GetServerByRaftName(name string) *ClusterServer {
 	for _, server := range self.servers {
 		if server.RaftName == name {
@@ -219,7 +436,14 @@ func (self *ClusterConfiguration) ChangeProtobufConnectionString(server *Cluster
 }
 
 func (self *ClusterConfiguration) RemoveServer(server *ClusterServer) error {
-	server.connection.Close()
+	if server == self.LocalServer {
+		select {
+		case self.localServerRemoved <- true:
+		default:
+		}
+	} else if server.connection != nil {
+		server.connection.Close()
+	}
 	i := 0
 	l := len(self.servers)
 	for i = 0; i < l; i++ {
@@ -245,7 +469,7 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	log.Info("Added server to cluster config: %d, %s, %s", server.Id, server.RaftConnectionString, server.ProtobufConnectionString)
 	log.Info("Checking whether this is the local server local: %s, new: %s", self.config.ProtobufConnectionString(), server.ProtobufConnectionString)
 
-	if server.RaftName == self.LocalRaftName && self.addedLocalServer {
+	if server.RaftName == self.LocalRaftName && self.IsLocalServerLoaded() {
 		panic("how did we add the same server twice ?")
 	}
 
@@ -255,7 +479,7 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 		log.Info("Added the local server")
 		self.LocalServer = server
 		self.addedLocalServerWait <- true
-		self.addedLocalServer = true
+		atomic.StoreInt32(&self.addedLocalServer, 1)
 		return
 	}
 
@@ -285,8 +509,8 @@ func (self *ClusterConfiguration) GetDatabases() []*Database {
 	defer self.createDatabaseLock.RUnlock()
 
 	dbs := make([]*Database, 0, len(self.DatabaseReplicationFactors))
-	for name := range self.DatabaseReplicationFactors {
-		dbs = append(dbs, &Database{Name: name})
+	for name, replicationFactor := range self.DatabaseReplicationFactors {
+		dbs = append(dbs, &Database{Name: name, ReplicationFactor: replicationFactor})
 	}
 	return dbs
 }
@@ -299,26 +523,65 @@ func (self *ClusterConfiguration) DatabaseExists(name string) bool {
 	}
 }
 
-func (self *ClusterConfiguration) CreateDatabase(name string) error {
+// Creates the database, its shards are replicated replicationFactor
+// times or as many times as the ones of the cluster if it's zero
+func (self *ClusterConfiguration) CreateDatabase(name string, replicationFactor uint8) error {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
 
 	if _, ok := self.DatabaseReplicationFactors[name]; ok {
 		return common.NewDatabaseExistsError(name)
 	}
-	self.DatabaseReplicationFactors[name] = struct{}{}
+	self.DatabaseReplicationFactors[name] = replicationFactor
+	// every server dropped the data of the database that had the name
+	// before when it applied the drop, the sweeper is done with it
+	delete(self.droppedDatabases, name)
+	for dropped := range self.droppedDatabases {
+		if db, _ := SplitPolicyDatabase(dropped); db == name {
+			delete(self.droppedDatabases, dropped)
+		}
+	}
 	return nil
 }
 
+// Drops the database and the data it has in the local shards. Every
+// server drops the data when it applies the drop, before it applies a
+// create of a database with the same name, so the old points don't
+// come back with the new database.
 func (self *ClusterConfiguration) DropDatabase(name string) error {
+	dbs, lastShardId, err := self.deleteDatabase(name)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		self.dropLocalDatabase(db, lastShardId)
+	}
+	return nil
+}
+
+// Deletes the database and its settings, returns the databases the
+// shards keep its points under and the last shard that may have them
+func (self *ClusterConfiguration) deleteDatabase(name string) ([]string, uint32, error) {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
 
 	if _, ok := self.DatabaseReplicationFactors[name]; !ok {
-		return fmt.Errorf("Database %s doesn't exist", name)
+		return nil, 0, fmt.Errorf("Database %s doesn't exist", name)
 	}
 
 	delete(self.DatabaseReplicationFactors, name)
+	delete(self.retentionPolicies, name)
+	delete(self.duplicatePointPolicies, name)
+	// the sweeper of every server drops whatever data of the database
+	// and of its named policies is left in its shards, e.g. written
+	// by the writes replayed after the drop
+	dbs := []string{name}
+	self.markDatabaseDropped(name)
+	for policy := range self.namedRetentionPolicies[name] {
+		dbs = append(dbs, PolicyDatabase(name, policy))
+		self.markDatabaseDropped(PolicyDatabase(name, policy))
+	}
+	delete(self.namedRetentionPolicies, name)
 
 	self.continuousQueriesLock.Lock()
 	defer self.continuousQueriesLock.Unlock()
@@ -329,7 +592,7 @@ func (self *ClusterConfiguration) DropDatabase(name string) error {
 	defer self.usersLock.Unlock()
 
 	delete(self.dbUsers, name)
-	return nil
+	return dbs, self.lastShardIdUsed, nil
 }
 
 func (self *ClusterConfiguration) CreateContinuousQuery(db string, query string) error {
@@ -436,6 +699,7 @@ func (self *ClusterConfiguration) SaveDbUser(u *DbUser) {
 	db := u.GetDb()
 	dbUsers := self.dbUsers[db]
 	if u.IsDeleted() {
+		self.deleteUserAuthTokens(db, u.GetName())
 		if dbUsers == nil {
 			return
 		}
@@ -463,6 +727,27 @@ func (self *ClusterConfiguration) ChangeDbUserPassword(db, username, hash string
 	return nil
 }
 
+// Changes the password hash of the user, a cluster admin if db is
+// empty, only if it's still oldHash. Returns false if the user is gone
+// or its password was changed since oldHash was verified.
+func (self *ClusterConfiguration) RehashUserPassword(db, username, oldHash, hash string) bool {
+	self.usersLock.Lock()
+	defer self.usersLock.Unlock()
+	var user *CommonUser
+	if db == "" {
+		if admin := self.clusterAdmins[username]; admin != nil {
+			user = &admin.CommonUser
+		}
+	} else if dbUser := self.dbUsers[db][username]; dbUser != nil {
+		user = &dbUser.CommonUser
+	}
+	if user == nil || user.Hash != oldHash {
+		return false
+	}
+	user.ChangePassword(hash)
+	return true
+}
+
 func (self *ClusterConfiguration) ChangeDbUserPermissions(db, username, readPermissions, writePermissions string) error {
 	self.usersLock.Lock()
 	defer self.usersLock.Unlock()
@@ -499,6 +784,7 @@ func (self *ClusterConfiguration) SaveClusterAdmin(u *ClusterAdmin) {
 	self.usersLock.Lock()
 	defer self.usersLock.Unlock()
 	if u.IsDeleted() {
+		self.deleteUserAuthTokens("", u.GetName())
 		delete(self.clusterAdmins, u.GetName())
 		return
 	}
@@ -507,31 +793,43 @@ func (self *ClusterConfiguration) SaveClusterAdmin(u *ClusterAdmin) {
 }
 
 type SavedConfiguration struct {
-	Databases         map[string]uint8
-	Admins            map[string]*ClusterAdmin
-	DbUsers           map[string]map[string]*DbUser
-	Servers           []*ClusterServer
-	ShortTermShards   []*NewShardData
-	LongTermShards    []*NewShardData
-	ContinuousQueries map[string][]*ContinuousQuery
-	LastShardIdUsed   uint32
+	Databases              map[string]uint8
+	Admins                 map[string]*ClusterAdmin
+	DbUsers                map[string]map[string]*DbUser
+	Servers                []*ClusterServer
+	ShortTermShards        []*NewShardData
+	LongTermShards         []*NewShardData
+	ContinuousQueries      map[string][]*ContinuousQuery
+	LastShardIdUsed        uint32
+	RetentionPolicies      map[string]time.Duration
+	NamedRetentionPolicies map[string]map[string]time.Duration
+	DroppedDatabases       map[string]uint32
+	DuplicatePointPolicies map[string]DuplicatePointPolicy
+	ShardMoves             []*ShardMove
+	AuthTokens             []*AuthToken
 }
 
 func (self *ClusterConfiguration) Save() ([]byte, error) {
 	log.Debug("Dumping the cluster configuration")
 	data := &SavedConfiguration{
-		Databases:         make(map[string]uint8, len(self.DatabaseReplicationFactors)),
-		Admins:            self.clusterAdmins,
-		DbUsers:           self.dbUsers,
-		Servers:           self.servers,
-		ContinuousQueries: self.continuousQueries,
-		ShortTermShards:   self.convertShardsToNewShardData(self.shortTermShards),
-		LongTermShards:    self.convertShardsToNewShardData(self.longTermShards),
-		LastShardIdUsed:   self.lastShardIdUsed,
-	}
-
-	for k := range self.DatabaseReplicationFactors {
-		data.Databases[k] = 0
+		Databases:              make(map[string]uint8, len(self.DatabaseReplicationFactors)),
+		Admins:                 self.clusterAdmins,
+		DbUsers:                self.dbUsers,
+		Servers:                self.servers,
+		ContinuousQueries:      self.continuousQueries,
+		ShortTermShards:        self.convertShardsToNewShardData(self.shortTermShards),
+		LongTermShards:         self.convertShardsToNewShardData(self.longTermShards),
+		LastShardIdUsed:        self.lastShardIdUsed,
+		RetentionPolicies:      self.retentionPolicies,
+		NamedRetentionPolicies: self.namedRetentionPolicies,
+		DroppedDatabases:       self.droppedDatabases,
+		DuplicatePointPolicies: self.duplicatePointPolicies,
+		ShardMoves:             self.ShardMoves(),
+		AuthTokens:             self.getAuthTokens(),
+	}
+
+	for k, v := range self.DatabaseReplicationFactors {
+		data.Databases[k] = v
 	}
 
 	b := bytes.NewBuffer(nil)
@@ -546,7 +844,7 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 func (self *ClusterConfiguration) convertShardsToNewShardData(shards []*ShardData) []*NewShardData {
 	newShardData := make([]*NewShardData, len(shards), len(shards))
 	for i, shard := range shards {
-		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.serverIds, DurationSplit: shard.durationIsSplit}
+		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.serverIds, DurationSplit: shard.durationIsSplit, Database: shard.database}
 	}
 	return newShardData
 }
@@ -555,6 +853,7 @@ func (self *ClusterConfiguration) convertNewShardDataToShards(newShards []*NewSh
 	shards := make([]*ShardData, len(newShards), len(newShards))
 	for i, newShard := range newShards {
 		shard := NewShard(newShard.Id, newShard.StartTime, newShard.EndTime, newShard.Type, newShard.DurationSplit, self.wal)
+		shard.database = newShard.Database
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range newShard.ServerIds {
 			if serverId == self.LocalServer.Id {
@@ -583,9 +882,26 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		return err
 	}
 
-	self.DatabaseReplicationFactors = make(map[string]struct{}, len(data.Databases))
-	for k := range data.Databases {
-		self.DatabaseReplicationFactors[k] = struct{}{}
+	self.DatabaseReplicationFactors = make(map[string]uint8, len(data.Databases))
+	for k, v := range data.Databases {
+		self.DatabaseReplicationFactors[k] = v
+	}
+	self.retentionPolicies = data.RetentionPolicies
+	if self.retentionPolicies == nil {
+		// snapshots taken before retention policies were added
+		self.retentionPolicies = make(map[string]time.Duration)
+	}
+	self.namedRetentionPolicies = data.NamedRetentionPolicies
+	if self.namedRetentionPolicies == nil {
+		self.namedRetentionPolicies = make(map[string]map[string]time.Duration)
+	}
+	self.droppedDatabases = data.DroppedDatabases
+	if self.droppedDatabases == nil {
+		self.droppedDatabases = make(map[string]uint32)
+	}
+	self.duplicatePointPolicies = data.DuplicatePointPolicies
+	if self.duplicatePointPolicies == nil {
+		self.duplicatePointPolicies = make(map[string]DuplicatePointPolicy)
 	}
 	self.clusterAdmins = data.Admins
 	self.dbUsers = data.DbUsers
@@ -596,11 +912,13 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		if server.RaftName == self.LocalRaftName {
 			self.LocalServer = server
 			self.addedLocalServerWait <- true
-			self.addedLocalServer = true
+			atomic.StoreInt32(&self.addedLocalServer, 1)
 			continue
 		}
 
 		server.connection = self.connectionCreator(server.ProtobufConnectionString)
+		// the threshold isn't saved in the snapshot
+		server.clockSkewThreshold = self.config.ClockSkewThreshold
 		writeBuffer := NewWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize)
 		self.writeBuffers = append(self.writeBuffers, writeBuffer)
 		server.SetWriteBuffer(writeBuffer)
@@ -631,6 +949,23 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		}
 	}
 
+	self.shardMovesLock.Lock()
+	self.shardMoves = make(map[uint32]*ShardMove, len(data.ShardMoves))
+	for _, move := range data.ShardMoves {
+		self.shardMoves[move.ShardId] = move
+		if shard := self.shardsById[move.ShardId]; shard != nil {
+			shard.movingTo = move.ToServerId
+		}
+	}
+	self.shardMovesLock.Unlock()
+
+	self.authTokensLock.Lock()
+	self.authTokens = make(map[string]*AuthToken, len(data.AuthTokens))
+	for _, token := range data.AuthTokens {
+		self.authTokens[token.Hash] = token
+	}
+	self.authTokensLock.Unlock()
+
 	if data.LastShardIdUsed == 0 {
 		self.lastShardIdUsed = highestShardId
 	} else {
@@ -708,8 +1043,12 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 		hasRandomSplit = self.config.LongTermShard.HasRandomSplit()
 		splitRegex = self.config.LongTermShard.SplitRegex()
 	}
+	shardDatabase := self.shardDatabase(db)
 	matchingShards := make([]*ShardData, 0)
 	for _, s := range shards {
+		if s.database != shardDatabase {
+			continue
+		}
 		if s.IsMicrosecondInRange(microsecondsEpoch) {
 			matchingShards = append(matchingShards, s)
 		} else if len(matchingShards) > 0 {
@@ -721,7 +1060,7 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	var err error
 	if len(matchingShards) == 0 {
 		log.Info("No matching shards for write at time %du, creating...", microsecondsEpoch)
-		matchingShards, err = self.createShards(microsecondsEpoch, shardType)
+		matchingShards, err = self.createShards(microsecondsEpoch, shardType, shardDatabase)
 		if err != nil {
 			return nil, err
 		}
@@ -739,7 +1078,65 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	return matchingShards[index], nil
 }
 
-func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardType ShardType) ([]*ShardData, error) {
+// Returns the database the shards db is written to are dedicated to,
+// empty for the shared shards. The databases with a replication factor
+// of their own get their own shards, the shards of a policy database
+// are the ones of its database.
+func (self *ClusterConfiguration) shardDatabase(db string) string {
+	db, _ = SplitPolicyDatabase(db)
+	self.createDatabaseLock.RLock()
+	replicationFactor := self.DatabaseReplicationFactors[db]
+	self.createDatabaseLock.RUnlock()
+	if replicationFactor == 0 || int(replicationFactor) == self.config.ReplicationFactor {
+		return ""
+	}
+	return db
+}
+
+// Returns the number of replicas of the shards dedicated to the
+// database, the replication factor of the cluster for the shared ones
+func (self *ClusterConfiguration) shardReplicationFactor(database string) int {
+	if database == "" {
+		return self.config.ReplicationFactor
+	}
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	if replicationFactor := self.DatabaseReplicationFactors[database]; replicationFactor > 0 {
+		return int(replicationFactor)
+	}
+	return self.config.ReplicationFactor
+}
+
+// Sets how many times the shards of the database created from now on
+// are replicated, zero uses the replication factor of the cluster. The
+// existing shards keep their replicas.
+func (self *ClusterConfiguration) SetDatabaseReplicationFactor(db string, replicationFactor uint8) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	self.DatabaseReplicationFactors[db] = replicationFactor
+	return nil
+}
+
+// Returns the replication factor of the database, the one of the
+// cluster if it doesn't have its own
+func (self *ClusterConfiguration) GetDatabaseReplicationFactor(db string) (int, error) {
+	self.createDatabaseLock.RLock()
+	replicationFactor, ok := self.DatabaseReplicationFactors[db]
+	self.createDatabaseLock.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if replicationFactor == 0 {
+		return self.config.ReplicationFactor, nil
+	}
+	return int(replicationFactor), nil
+}
+
+func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardType ShardType, database string) ([]*ShardData, error) {
 	numberOfShardsToCreateForDuration := 1
 	var secondsOfDuration float64
 	if shardType == LONG_TERM {
@@ -749,9 +1146,17 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 		numberOfShardsToCreateForDuration = self.config.ShortTermShard.Split
 		secondsOfDuration = self.config.ShortTermShard.ParsedDuration().Seconds()
 	}
+	// servers that are being decommissioned don't get new shards
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, server := range self.servers {
+		if server.State != Leaving {
+			servers = append(servers, server)
+		}
+	}
+
 	startIndex := 0
 	if self.lastServerToGetShard != nil {
-		for i, server := range self.servers {
+		for i, server := range servers {
 			if server == self.lastServerToGetShard {
 				startIndex = i + 1
 			}
@@ -768,21 +1173,21 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 		serverIds := make([]uint32, 0)
 
 		// if they have the replication factor set higher than the number of servers in the cluster, limit it
-		rf := self.config.ReplicationFactor
-		if rf > len(self.servers) {
-			rf = len(self.servers)
+		rf := self.shardReplicationFactor(database)
+		if rf > len(servers) {
+			rf = len(servers)
 		}
 
 		for ; rf > 0; rf-- {
-			if startIndex >= len(self.servers) {
+			if startIndex >= len(servers) {
 				startIndex = 0
 			}
-			server := self.servers[startIndex]
+			server := servers[startIndex]
 			self.lastServerToGetShard = server
 			serverIds = append(serverIds, server.Id)
 			startIndex += 1
 		}
-		shards = append(shards, &NewShardData{StartTime: *startTime, EndTime: *endTime, ServerIds: serverIds, Type: shardType})
+		shards = append(shards, &NewShardData{StartTime: *startTime, EndTime: *endTime, ServerIds: serverIds, Type: shardType, Database: database})
 	}
 
 	// call out to rafter server to create the shards (or return shard objects that the leader already knows about)
@@ -805,7 +1210,50 @@ func (self *ClusterConfiguration) getStartAndEndBasedOnDuration(microsecondsEpoc
 	return &startTime, &endTime
 }
 
+// Returns the shards whose time range is entirely between start and
+// end that only have the data of db, the ones dedicated to it and the
+// shared ones if it's the only database
+func (self *ClusterConfiguration) GetShardsInTimeRange(db string, start, end time.Time) []*ShardData {
+	self.createDatabaseLock.RLock()
+	_, exists := self.DatabaseReplicationFactors[db]
+	onlyDb := exists && len(self.DatabaseReplicationFactors) == 1
+	self.createDatabaseLock.RUnlock()
+	if !exists {
+		return nil
+	}
+
+	shards := []*ShardData{}
+	for _, shard := range self.GetAllShards() {
+		if shard.database != db && (shard.database != "" || !onlyDb) {
+			continue
+		}
+		if shard.StartTime().After(start) && !shard.EndTime().After(end) {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Returns the shards a query has to read, the shared ones and the ones
+// dedicated to its database
 func (self *ClusterConfiguration) GetShards(querySpec *parser.QuerySpec) []*ShardData {
+	return DatabaseShards(querySpec.Database(), self.getShards(querySpec))
+}
+
+// Returns the shards that can have the data of db in the same order,
+// the shared ones and the ones dedicated to it
+func DatabaseShards(db string, shards []*ShardData) []*ShardData {
+	db, _ = SplitPolicyDatabase(db)
+	dedicated := make([]*ShardData, 0, len(shards))
+	for _, shard := range shards {
+		if shard.database == "" || shard.database == db {
+			dedicated = append(dedicated, shard)
+		}
+	}
+	return dedicated
+}
+
+func (self *ClusterConfiguration) getShards(querySpec *parser.QuerySpec) []*ShardData {
 	self.shardsByIdLock.RLock()
 	defer self.shardsByIdLock.RUnlock()
 
@@ -922,7 +1370,7 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 	}
 
 	for _, s := range existingShards {
-		if s.startTime.Unix() == startTime.Unix() && s.endTime.Unix() == endTime.Unix() {
+		if s.startTime.Unix() == startTime.Unix() && s.endTime.Unix() == endTime.Unix() && s.database == shards[0].Database {
 			createdShards = append(createdShards, s)
 		}
 	}
@@ -937,6 +1385,7 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 		id := self.lastShardIdUsed + 1
 		self.lastShardIdUsed = id
 		shard := NewShard(id, newShard.StartTime, newShard.EndTime, shardType, durationIsSplit, self.wal)
+		shard.database = newShard.Database
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range newShard.ServerIds {
 			// if a shard is created before the local server then the local
@@ -984,6 +1433,7 @@ func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewS
 	durationIsSplit := len(newShards) > 1
 	for i, s := range newShards {
 		shard := NewShard(s.Id, s.StartTime, s.EndTime, s.Type, durationIsSplit, self.wal)
+		shard.database = s.Database
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range s.ServerIds {
 			if serverId == self.LocalServer.Id {
@@ -1022,6 +1472,7 @@ func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
 func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32) error {
 	// take it out of the memory map so writes and queries stop going to it
 	self.updateOrRemoveShard(shardId, serverIds)
+	self.pruneDroppedDatabases()
 
 	// now actually remove it from disk if it lives here
 	for _, serverId := range serverIds {
@@ -1035,6 +1486,7 @@ func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32)
 func (self *ClusterConfiguration) RecoverFromWAL() error {
 	writeBuffer := NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServer.Id, self.config.LocalStoreWriteBufferSize)
 	self.writeBuffers = append(self.writeBuffers, writeBuffer)
+	self.localWriteBuffer = writeBuffer
 	self.shardStore.SetWriteBuffer(writeBuffer)
 	var waitForAll sync.WaitGroup
 	for _, _server := range self.servers {
@@ -1063,6 +1515,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 	}
 	log.Info("Waiting for servers to recover")
 	waitForAll.Wait()
+	atomic.StoreInt32(&self.recoveredFromWAL, 1)
 	return nil
 }
 
@@ -1119,6 +1572,7 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 	}
 	if shard == nil {
 		log.Error("Attempted to remove shard %d, which we couldn't find. %d shards currently loaded.", shardId, len(self.GetAllShards()))
+		return
 	}
 
 	if len(shard.serverIds) == len(serverIds) {
@@ -1127,20 +1581,7 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 	}
 	self.shardsByIdLock.Lock()
 	defer self.shardsByIdLock.Unlock()
-	newIds := make([]uint32, 0)
-	for _, oldId := range shard.serverIds {
-		include := true
-		for _, removeId := range serverIds {
-			if oldId == removeId {
-				include = false
-				break
-			}
-		}
-		if include {
-			newIds = append(newIds, oldId)
-		}
-	}
-	shard.serverIds = newIds
+	shard.removeServers(serverIds)
 }
 
 func (self *ClusterConfiguration) removeShard(shardId uint32) {
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"configuration"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ClusterConfigurationSuite struct{}
+
+var _ = Suite(&ClusterConfigurationSuite{})
+
+// A configuration of three servers whose shards are an hour long and
+// replicated once
+func newTestClusterConfiguration(c *C) *ClusterConfiguration {
+	conf := &configuration.Configuration{
+		ReplicationFactor: 1,
+		ShortTermShard:    &configuration.ShardConfiguration{},
+		LongTermShard:     &configuration.ShardConfiguration{},
+	}
+	c.Assert(conf.ShortTermShard.ParseAndValidate(time.Hour), IsNil)
+	c.Assert(conf.LongTermShard.ParseAndValidate(time.Hour), IsNil)
+	config := NewClusterConfiguration(conf, NewMockWal(), &MockShardStore{}, nil)
+	config.LocalServer = &ClusterServer{Id: 1}
+	config.servers = []*ClusterServer{config.LocalServer, {Id: 2}, {Id: 3}}
+	config.SetShardCreator(&MockShardCreator{config})
+	return config
+}
+
+func (self *ClusterConfigurationSuite) TestDatabasesWithTheirOwnReplicationFactorGetTheirShards(c *C) {
+	config := newTestClusterConfiguration(c)
+	c.Assert(config.CreateDatabase("shared", 0), IsNil)
+	c.Assert(config.CreateDatabase("same", 1), IsNil)
+	c.Assert(config.CreateDatabase("dedicated", 3), IsNil)
+	now := time.Now().Unix() * 1000 * 1000
+
+	shared, err := config.GetShardToWriteToBySeriesAndTime("shared", "foo", now)
+	c.Assert(err, IsNil)
+	c.Assert(shared.Database(), Equals, "")
+	c.Assert(shared.ServerIds(), HasLen, 1)
+	// the databases with the replication factor of the cluster use the
+	// shared shards
+	same, err := config.GetShardToWriteToBySeriesAndTime("same", "foo", now)
+	c.Assert(err, IsNil)
+	c.Assert(same, Equals, shared)
+
+	dedicated, err := config.GetShardToWriteToBySeriesAndTime("dedicated", "foo", now)
+	c.Assert(err, IsNil)
+	c.Assert(dedicated.Database(), Equals, "dedicated")
+	c.Assert(dedicated.ServerIds(), HasLen, 3)
+	c.Assert(dedicated.Id(), Not(Equals), shared.Id())
+	// the policy databases are written to the shards of their database
+	policy, err := config.GetShardToWriteToBySeriesAndTime(PolicyDatabase("dedicated", "week"), "foo", now)
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, dedicated)
+
+	shards := config.GetShortTermShards()
+	c.Assert(shards, HasLen, 2)
+	c.Assert(DatabaseShards("shared", shards), DeepEquals, []*ShardData{shared})
+	c.Assert(DatabaseShards("dedicated", shards), HasLen, 2)
+	c.Assert(DatabaseShards(PolicyDatabase("dedicated", "week"), shards), HasLen, 2)
+
+	// the shards created from now on use the new replication factor, the
+	// existing ones keep theirs
+	c.Assert(config.SetDatabaseReplicationFactor("dedicated", 2), IsNil)
+	later, err := config.GetShardToWriteToBySeriesAndTime("dedicated", "foo", now+int64(time.Hour/time.Microsecond))
+	c.Assert(err, IsNil)
+	c.Assert(later.ServerIds(), HasLen, 2)
+	c.Assert(dedicated.ServerIds(), HasLen, 3)
+}
+
+func (self *ClusterConfigurationSuite) TestFutureShardsAreCreatedUntilTheyCoverThePreCreateWindow(c *C) {
+	config := newTestClusterConfiguration(c)
+	c.Assert(config.CreateDatabase("db", 0), IsNil)
+	_, err := config.GetShardToWriteToBySeriesAndTime("db", "foo", time.Now().Unix()*1000*1000)
+	c.Assert(err, IsNil)
+
+	config.config.ShardPreCreateWindow = 2 * time.Hour
+	config.automaticallyCreateFutureShard(config.GetShortTermShards(), SHORT_TERM)
+	// the shards are created until the latest one ends after the window
+	shards := config.GetShortTermShards()
+	c.Assert(shards, HasLen, 3)
+	c.Assert(shards[0].endTime.Add(-config.config.ShardPreCreateWindow).Before(time.Now()), Equals, false)
+	config.automaticallyCreateFutureShard(config.GetShortTermShards(), SHORT_TERM)
+	c.Assert(config.GetShortTermShards(), HasLen, 3)
+
+	// at most MAX_SHARDS_CREATED_AHEAD are created at a time however
+	// long the window is
+	config.config.ShardPreCreateWindow = 1000 * time.Hour
+	config.automaticallyCreateFutureShard(config.GetShortTermShards(), SHORT_TERM)
+	c.Assert(config.GetShortTermShards(), HasLen, 3+MAX_SHARDS_CREATED_AHEAD)
+	config.automaticallyCreateFutureShard(config.GetShortTermShards(), SHORT_TERM)
+	c.Assert(config.GetShortTermShards(), HasLen, 3+2*MAX_SHARDS_CREATED_AHEAD)
+}
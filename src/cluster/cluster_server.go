@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"protocol"
+	"sync/atomic"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -29,6 +30,13 @@ type ClusterServer struct {
 	isUp                     bool
 	writeBuffer              *WriteBuffer
 	heartbeatStarted         bool
+	// how far ahead of the local clock the clock of the server was at
+	// the last heartbeat, in nanoseconds, a warning is logged when it's
+	// more than the threshold either way
+	clockSkew          int64
+	clockSkewMeasured  int32
+	clockSkewThreshold time.Duration
+	clockSkewed        bool
 }
 
 type ServerConnection interface {
@@ -36,6 +44,9 @@ type ServerConnection interface {
 	Close()
 	ClearRequests()
 	MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error
+	// asks the server to stop the query request, its response stream
+	// still ends with an END_STREAM
+	CancelRequest(request *protocol.Request) error
 }
 
 type ServerState int
@@ -46,8 +57,29 @@ const (
 	DeletingOldData
 	Running
 	Potential
+	// the server is being decommissioned, its shards are moved to the
+	// other servers and it doesn't get new ones
+	Leaving
 )
 
+func (self ServerState) String() string {
+	switch self {
+	case LoadingRingData:
+		return "loading_ring_data"
+	case SendingRingData:
+		return "sending_ring_data"
+	case DeletingOldData:
+		return "deleting_old_data"
+	case Running:
+		return "running"
+	case Potential:
+		return "potential"
+	case Leaving:
+		return "leaving"
+	}
+	return fmt.Sprintf("unknown(%d)", int(self))
+}
+
 func NewClusterServer(raftName, raftConnectionString, protobufConnectionString string, connection ServerConnection, config *c.Configuration) *ClusterServer {
 
 	s := &ClusterServer{
@@ -60,6 +92,7 @@ func NewClusterServer(raftName, raftConnectionString, protobufConnectionString s
 		MinBackoff:               config.ProtobufMinBackoff.Duration,
 		MaxBackoff:               config.ProtobufMaxBackoff.Duration,
 		heartbeatStarted:         false,
+		clockSkewThreshold:       config.ClockSkewThreshold,
 	}
 
 	return s
@@ -104,6 +137,12 @@ func (self *ClusterServer) MakeRequest(request *protocol.Request, responseStream
 	}
 }
 
+func (self *ClusterServer) CancelRequest(request *protocol.Request) {
+	if err := self.connection.CancelRequest(request); err != nil {
+		log.Error("ClusterServer: cannot cancel request %d on server %d: %s", request.GetId(), self.Id, err)
+	}
+}
+
 func (self *ClusterServer) Write(request *protocol.Request) error {
 	responseChan := make(chan *protocol.Response, 1)
 	err := self.connection.MakeRequest(request, responseChan)
@@ -126,6 +165,15 @@ func (self *ClusterServer) IsUp() bool {
 	return self.isUp
 }
 
+// Returns how far ahead of the local clock the clock of the server is,
+// false if no heartbeat measured it yet
+func (self *ClusterServer) ClockSkew() (time.Duration, bool) {
+	if atomic.LoadInt32(&self.clockSkewMeasured) == 0 {
+		return 0, false
+	}
+	return time.Duration(atomic.LoadInt64(&self.clockSkew)), true
+}
+
 // private methods
 
 var HEARTBEAT_TYPE = protocol.Request_HEARTBEAT
@@ -144,12 +192,14 @@ func (self *ClusterServer) heartbeat() {
 			Type:     &HEARTBEAT_TYPE,
 			Database: protocol.String(""),
 		}
+		sent := time.Now()
 		self.MakeRequest(heartbeatRequest, responseChan)
-		err := self.getHeartbeatResponse(responseChan)
+		response, err := self.getHeartbeatResponse(responseChan)
 		if err != nil {
 			self.handleHeartbeatError(err)
 			continue
 		}
+		self.checkClockSkew(sent, time.Now(), response)
 
 		if !self.isUp {
 			log.Warn("Server marked as up. Hearbeat succeeded")
@@ -161,22 +211,45 @@ func (self *ClusterServer) heartbeat() {
 	}
 }
 
-func (self *ClusterServer) getHeartbeatResponse(responseChan <-chan *protocol.Response) error {
+func (self *ClusterServer) getHeartbeatResponse(responseChan <-chan *protocol.Response) (*protocol.Response, error) {
 	select {
 	case response := <-responseChan:
 		if response.ErrorMessage != nil {
-			return fmt.Errorf("Server %d returned error to heartbeat: %s", self.Id, *response.ErrorMessage)
+			return nil, fmt.Errorf("Server %d returned error to heartbeat: %s", self.Id, *response.ErrorMessage)
 		}
 
 		if *response.Type != protocol.Response_HEARTBEAT {
-			return fmt.Errorf("Server returned a non heartbeat response")
+			return nil, fmt.Errorf("Server returned a non heartbeat response")
 		}
+		return response, nil
 
 	case <-time.After(self.HeartbeatInterval):
-		return fmt.Errorf("Server failed to return heartbeat in %s: %d", self.HeartbeatInterval, self.Id)
+		return nil, fmt.Errorf("Server failed to return heartbeat in %s: %d", self.HeartbeatInterval, self.Id)
 	}
+}
 
-	return nil
+// Measures the skew of the clock of the server from the time in its
+// heartbeat response, assuming it answered halfway through the round
+// trip. Servers running an older version don't send their time.
+func (self *ClusterServer) checkClockSkew(sent, received time.Time, response *protocol.Response) {
+	if response.Timestamp == nil {
+		return
+	}
+	skew := time.Unix(0, response.GetTimestamp()).Sub(sent.Add(received.Sub(sent) / 2))
+	atomic.StoreInt64(&self.clockSkew, int64(skew))
+	atomic.StoreInt32(&self.clockSkewMeasured, 1)
+
+	if self.clockSkewThreshold <= 0 {
+		return
+	}
+	skewed := skew > self.clockSkewThreshold || skew < -self.clockSkewThreshold
+	if skewed && !self.clockSkewed {
+		log.Warn("The clock of server %d - %s is %s ahead of the local clock, more than the clock skew threshold %s. Points may be written to the wrong shards",
+			self.Id, self.ProtobufConnectionString, skew, self.clockSkewThreshold)
+	} else if !skewed && self.clockSkewed {
+		log.Info("The clock of server %d - %s is back within %s of the local clock", self.Id, self.ProtobufConnectionString, self.clockSkewThreshold)
+	}
+	self.clockSkewed = skewed
 }
 
 func (self *ClusterServer) markServerAsDown() {
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// The number of replicas of a shard that have to acknowledge a write
+// before it's considered successful
+type ConsistencyLevel int
+
+const (
+	// the write is logged to the wal and buffered for the replicas,
+	// this is the default
+	ConsistencyAny ConsistencyLevel = iota
+	ConsistencyOne
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+func ParseConsistencyLevel(level string) (ConsistencyLevel, error) {
+	switch level {
+	case "", "any":
+		return ConsistencyAny, nil
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	default:
+		return ConsistencyAny, fmt.Errorf("Unknown consistency level %s, valid levels are one, quorum and all", level)
+	}
+}
+
+func (self ConsistencyLevel) String() string {
+	switch self {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	default:
+		return "any"
+	}
+}
+
+// Returns the number of acknowledgements needed out of the given
+// number of replicas
+func (self ConsistencyLevel) RequiredReplicas(replicas int) int {
+	switch self {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return replicas/2 + 1
+	case ConsistencyAll:
+		return replicas
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+
+	log "code.google.com/p/log4go"
+)
+
+// The progress of decommissioning a server
+type DecommissionStatus struct {
+	ServerId uint32 `json:"serverId"`
+	Leaving  bool   `json:"leaving"`
+	// the shards that are still stored on the server
+	Shards []uint32 `json:"shards"`
+	// the moves of the shards to the other servers
+	Moves []*ShardMoveStatus `json:"moves"`
+	// the shards stored on the server that aren't being moved, they
+	// keep the server from being removed
+	BlockingShards []uint32 `json:"blockingShards"`
+}
+
+// Returns the moves that restore the replicas of the server's shards
+// on the other servers, each shard goes to the server with the fewest
+// replicas that doesn't have it yet. Returns an error if a shard would
+// have fewer replicas once the server is removed.
+func (self *ClusterConfiguration) PlanDecommission(serverId uint32) ([]*ShardMove, error) {
+	if self.GetServerById(&serverId) == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+
+	counts := make(map[uint32]int)
+	for _, server := range self.Servers() {
+		if server.Id != serverId && server.State != Leaving {
+			counts[server.Id] = 0
+		}
+	}
+	shards := self.GetAllShards()
+	for _, shard := range shards {
+		for _, id := range shard.serverIds {
+			if _, ok := counts[id]; ok {
+				counts[id]++
+			}
+		}
+	}
+	serverIds := make([]int, 0, len(counts))
+	for id := range counts {
+		serverIds = append(serverIds, int(id))
+	}
+	sort.Ints(serverIds)
+
+	pending := make(map[uint32]*ShardMove)
+	for _, move := range self.ShardMoves() {
+		pending[move.ShardId] = move
+	}
+
+	moves := []*ShardMove{}
+	for _, shard := range shards {
+		if !shard.hasServer(serverId) {
+			continue
+		}
+		if move := pending[shard.id]; move != nil {
+			if move.FromServerId == serverId {
+				// already being moved away
+				continue
+			}
+			return nil, fmt.Errorf("Shard %d is being moved to server %d, cancel the rebalance first", shard.id, move.ToServerId)
+		}
+
+		to := uint32(0)
+		for _, id := range serverIds {
+			if shard.hasServer(uint32(id)) {
+				continue
+			}
+			if to == 0 || counts[uint32(id)] < counts[to] {
+				to = uint32(id)
+			}
+		}
+		if to == 0 {
+			return nil, fmt.Errorf("Removing server %d would leave shard %d with %d replicas, add a server first", serverId, shard.id, len(shard.serverIds)-1)
+		}
+		counts[to]++
+		moves = append(moves, &ShardMove{ShardId: shard.id, FromServerId: serverId, ToServerId: to})
+	}
+	return moves, nil
+}
+
+// Marks the server as leaving, it doesn't get new shards anymore
+func (self *ClusterConfiguration) DecommissionServer(serverId uint32) error {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	if server.State != Leaving {
+		log.Info("Decommissioning server %d", serverId)
+		server.State = Leaving
+	}
+	return nil
+}
+
+func (self *ClusterConfiguration) GetDecommissionStatus(serverId uint32) (*DecommissionStatus, error) {
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+
+	status := &DecommissionStatus{
+		ServerId:       serverId,
+		Leaving:        server.State == Leaving,
+		Shards:         []uint32{},
+		Moves:          []*ShardMoveStatus{},
+		BlockingShards: []uint32{},
+	}
+	moving := make(map[uint32]bool)
+	for _, move := range self.ShardMovesStatus() {
+		if move.FromServerId == serverId {
+			status.Moves = append(status.Moves, move)
+			moving[move.ShardId] = true
+		}
+	}
+	for _, shard := range self.GetAllShards() {
+		if !shard.hasServer(serverId) {
+			continue
+		}
+		status.Shards = append(status.Shards, shard.id)
+		if !moving[shard.id] {
+			status.BlockingShards = append(status.BlockingShards, shard.id)
+		}
+	}
+	return status, nil
+}
+
+// Returns the servers being decommissioned that don't have any shards
+// left, they can be removed from the cluster
+func (self *ClusterConfiguration) DecommissionedServers() []*ClusterServer {
+	servers := []*ClusterServer{}
+	for _, server := range self.Servers() {
+		if server.State != Leaving {
+			continue
+		}
+		status, err := self.GetDecommissionStatus(server.Id)
+		if err == nil && len(status.Shards) == 0 {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Signaled once the local server is removed from the cluster, or once
+// it's decommissioned if it's the raft leader, which can't remove itself
+func (self *ClusterConfiguration) LocalServerRemoved() <-chan bool {
+	return self.localServerRemoved
+}
+
+func (self *ClusterConfiguration) LocalServerDecommissioned() {
+	select {
+	case self.localServerRemoved <- true:
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type DecommissionSuite struct{}
+
+var _ = Suite(&DecommissionSuite{})
+
+func runningServers(ids ...uint32) []*ClusterServer {
+	servers := make([]*ClusterServer, 0, len(ids))
+	for _, id := range ids {
+		servers = append(servers, &ClusterServer{Id: id, State: Running})
+	}
+	return servers
+}
+
+func (self *DecommissionSuite) TestPlanDecommission(c *C) {
+	leaving := runningServers(1, 2, 3, 4)
+	leaving[2].State = Leaving
+
+	for _, test := range []struct {
+		name     string
+		servers  []*ClusterServer
+		replicas [][]uint32
+		pending  []*ShardMove
+		serverId uint32
+		expected []*ShardMove
+		err      string
+	}{
+		{"the shards go to the servers with the fewest replicas", runningServers(1, 2, 3), [][]uint32{{1, 3}, {2, 3}, {1, 2}}, nil, 3,
+			[]*ShardMove{{1, 3, 2}, {2, 3, 1}}, ""},
+		{"servers without shards", runningServers(1, 2, 3), [][]uint32{{1, 2}}, nil, 3,
+			[]*ShardMove{}, ""},
+		{"leaving servers get no shards", leaving, [][]uint32{{4}, {4}, {1}}, nil, 4,
+			[]*ShardMove{{1, 4, 2}, {2, 4, 1}}, ""},
+		{"shards already moved away", runningServers(1, 2, 3), [][]uint32{{1, 3}, {2, 3}}, []*ShardMove{{1, 3, 2}}, 3,
+			[]*ShardMove{{2, 3, 1}}, ""},
+		{"shards moved to the server", runningServers(1, 2, 3), [][]uint32{{1, 3}, {2, 3}}, []*ShardMove{{2, 2, 3}}, 3,
+			nil, "Shard 2 is being moved to server 3, cancel the rebalance first"},
+		{"too few servers", runningServers(1, 2), [][]uint32{{1, 2}}, nil, 2,
+			nil, "Removing server 2 would leave shard 1 with 1 replicas, add a server first"},
+		{"unknown server", runningServers(1, 2), nil, nil, 9,
+			nil, "Server 9 doesn't exist"},
+	} {
+		config := newRebalanceConfiguration(c, test.servers, test.replicas)
+		for _, move := range test.pending {
+			config.shardMoves[move.ShardId] = move
+		}
+		moves, err := config.PlanDecommission(test.serverId)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err, Commentf(test.name))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf(test.name))
+		c.Assert(moves, DeepEquals, test.expected, Commentf(test.name))
+	}
+}
+
+func (self *DecommissionSuite) TestDecommissionedServersAreRemovedOnceTheirShardsMoved(c *C) {
+	config := newRebalanceConfiguration(c, runningServers(1, 2, 3), [][]uint32{{1, 3}, {2, 3}, {1, 2}})
+
+	status, err := config.GetDecommissionStatus(3)
+	c.Assert(err, IsNil)
+	c.Assert(status.Leaving, Equals, false)
+	c.Assert(status.Shards, DeepEquals, []uint32{1, 2})
+	c.Assert(status.BlockingShards, DeepEquals, []uint32{1, 2})
+
+	c.Assert(config.DecommissionServer(3), IsNil)
+	c.Assert(config.GetServerById(&status.ServerId).State, Equals, Leaving)
+	// decommissioning twice is harmless
+	c.Assert(config.DecommissionServer(3), IsNil)
+	c.Assert(config.DecommissionedServers(), HasLen, 0)
+
+	moves, err := config.PlanDecommission(3)
+	c.Assert(err, IsNil)
+	c.Assert(moves, HasLen, 2)
+	for _, move := range moves {
+		c.Assert(config.AddShardMove(move), IsNil)
+	}
+	// the leaving server doesn't get the replicas of the rebalance
+	for _, move := range config.PlanRebalance() {
+		c.Assert(move.ToServerId, Not(Equals), uint32(3))
+	}
+
+	status, err = config.GetDecommissionStatus(3)
+	c.Assert(err, IsNil)
+	c.Assert(status.Leaving, Equals, true)
+	c.Assert(status.Shards, DeepEquals, []uint32{1, 2})
+	c.Assert(status.Moves, HasLen, 2)
+	c.Assert(status.BlockingShards, HasLen, 0)
+
+	c.Assert(config.FinishShardMove(moves[0].ShardId), IsNil)
+	status, err = config.GetDecommissionStatus(3)
+	c.Assert(err, IsNil)
+	c.Assert(status.Shards, DeepEquals, []uint32{moves[1].ShardId})
+	c.Assert(status.Moves, HasLen, 1)
+	c.Assert(config.DecommissionedServers(), HasLen, 0)
+
+	c.Assert(config.FinishShardMove(moves[1].ShardId), IsNil)
+	status, err = config.GetDecommissionStatus(3)
+	c.Assert(err, IsNil)
+	c.Assert(status.Shards, HasLen, 0)
+	c.Assert(status.Moves, HasLen, 0)
+	decommissioned := config.DecommissionedServers()
+	c.Assert(decommissioned, HasLen, 1)
+	c.Assert(decommissioned[0].Id, Equals, uint32(3))
+}
+
+func (self *DecommissionSuite) TestUnknownServersCantBeDecommissioned(c *C) {
+	config := newRebalanceConfiguration(c, runningServers(1, 2), nil)
+	c.Assert(config.DecommissionServer(9), ErrorMatches, "Server 9 doesn't exist")
+	_, err := config.GetDecommissionStatus(9)
+	c.Assert(err, ErrorMatches, "Server 9 doesn't exist")
+}
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// What the shards do with a point written to a series that already has
+// a point with its timestamp, e.g. when a write is retried after a
+// timeout
+type DuplicatePointPolicy string
+
+const (
+	// both points are kept, unless they have the same sequence number
+	// in which case the last one written replaces the other
+	KEEP_DUPLICATE_POINTS DuplicatePointPolicy = "keep"
+	// the last point written replaces the points with its timestamp
+	OVERWRITE_DUPLICATE_POINTS DuplicatePointPolicy = "overwrite"
+	// the point is dropped, the first point written with the timestamp
+	// is kept
+	REJECT_DUPLICATE_POINTS DuplicatePointPolicy = "reject"
+)
+
+func ParseDuplicatePointPolicy(policy string) (DuplicatePointPolicy, error) {
+	switch DuplicatePointPolicy(policy) {
+	case "":
+		return KEEP_DUPLICATE_POINTS, nil
+	case KEEP_DUPLICATE_POINTS, OVERWRITE_DUPLICATE_POINTS, REJECT_DUPLICATE_POINTS:
+		return DuplicatePointPolicy(policy), nil
+	}
+	return "", fmt.Errorf("%s isn't a duplicate point policy, the policies are keep, overwrite and reject", policy)
+}
+
+// Sets what the shards do with the duplicate points written to db and
+// to its named retention policies
+func (self *ClusterConfiguration) SetDuplicatePointPolicy(db string, policy DuplicatePointPolicy) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if policy == KEEP_DUPLICATE_POINTS {
+		delete(self.duplicatePointPolicies, db)
+		return nil
+	}
+	self.duplicatePointPolicies[db] = policy
+	return nil
+}
+
+// Returns the duplicate point policy of db, which can be the database
+// of one of its named retention policies
+func (self *ClusterConfiguration) GetDuplicatePointPolicy(db string) DuplicatePointPolicy {
+	db, _ = SplitPolicyDatabase(db)
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	if policy, ok := self.duplicatePointPolicies[db]; ok {
+		return policy
+	}
+	return KEEP_DUPLICATE_POINTS
+}
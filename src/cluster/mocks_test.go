@@ -0,0 +1,154 @@
+package cluster
+
+import (
+	"fmt"
+	"protocol"
+	"sync"
+	"wal"
+)
+
+// Assigns increasing request numbers and records the commits
+type MockWal struct {
+	WAL
+	lock          sync.Mutex
+	requestNumber uint32
+	commits       map[uint32][]uint32
+}
+
+func NewMockWal() *MockWal {
+	return &MockWal{commits: map[uint32][]uint32{}}
+}
+
+func (self *MockWal) AssignSequenceNumbersAndLog(request *protocol.Request, shard wal.Shard) (uint32, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.requestNumber++
+	return self.requestNumber, nil
+}
+
+func (self *MockWal) Commit(requestNumber uint32, serverId uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.commits[serverId] = append(self.commits[serverId], requestNumber)
+	return nil
+}
+
+// The request numbers committed for the server
+func (self *MockWal) Commits(serverId uint32) []uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.commits[serverId]
+}
+
+// Records the writes of the local shards, failing them all if fail is
+// set. GetShard only returns the shards in shards.
+type MockShardStore struct {
+	LocalShardStore
+	lock     sync.Mutex
+	fail     bool
+	written  []*protocol.Request
+	buffered []*protocol.Request
+	created  []uint32
+	shards   map[uint32]*MockShardDb
+	markers  map[uint32][]*DeleteMarker
+}
+
+func (self *MockShardStore) Write(request *protocol.Request) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.fail {
+		return fmt.Errorf("cannot write")
+	}
+	self.written = append(self.written, request)
+	return nil
+}
+
+func (self *MockShardStore) BufferWrite(request *protocol.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.buffered = append(self.buffered, request)
+}
+
+func (self *MockShardStore) GetOrCreateShard(id uint32) (LocalShardDb, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.created = append(self.created, id)
+	return nil, nil
+}
+
+func (self *MockShardStore) GetShard(id uint32) (LocalShardDb, error) {
+	if shard, ok := self.shards[id]; ok {
+		return shard, nil
+	}
+	return nil, fmt.Errorf("Shard %d doesn't exist on this server", id)
+}
+
+func (self *MockShardStore) ReturnShard(id uint32) {}
+
+func (self *MockShardStore) DeleteMarkers(id uint32) ([]*DeleteMarker, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*DeleteMarker{}, self.markers[id]...), nil
+}
+
+func (self *MockShardStore) SaveDeleteMarkers(id uint32, markers []*DeleteMarker) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.markers == nil {
+		self.markers = make(map[uint32][]*DeleteMarker)
+	}
+	self.markers[id] = append([]*DeleteMarker{}, markers...)
+	return nil
+}
+
+func (self *MockShardStore) DeleteShard(id uint32) error {
+	return nil
+}
+
+// Records the databases dropped from the shard
+type MockShardDb struct {
+	LocalShardDb
+	dropped []string
+}
+
+func (self *MockShardDb) DropDatabase(database string) error {
+	self.dropped = append(self.dropped, database)
+	return nil
+}
+
+// Keeps the response stream of the last request, a cancel ends it
+type MockServerConnection struct {
+	ServerConnection
+	lock      sync.Mutex
+	requests  []*protocol.Request
+	cancelled []*protocol.Request
+	stream    chan *protocol.Response
+}
+
+func (self *MockServerConnection) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.requests = append(self.requests, request)
+	self.stream = responseStream
+	return nil
+}
+
+func (self *MockServerConnection) CancelRequest(request *protocol.Request) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cancelled = append(self.cancelled, request)
+	message := "Query cancelled"
+	go func(stream chan *protocol.Response) {
+		stream <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+	}(self.stream)
+	return nil
+}
+
+// Adds the shards to the configuration like the raft command would
+type MockShardCreator struct {
+	config *ClusterConfiguration
+}
+
+func (self *MockShardCreator) CreateShards(shards []*NewShardData) ([]*ShardData, error) {
+	return self.config.AddShards(shards)
+}
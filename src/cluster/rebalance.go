@@ -0,0 +1,356 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+var shardMoveCancelledError = errors.New("The shard move was cancelled")
+
+// A replica of a shard being moved from one server to another. The
+// target server is added to the shard right away so it gets the new
+// writes, it then copies the existing points from the source server
+// and finally the replica on the source server is dropped.
+type ShardMove struct {
+	ShardId      uint32 `json:"shardId"`
+	FromServerId uint32 `json:"fromServerId"`
+	ToServerId   uint32 `json:"toServerId"`
+}
+
+// A shard move with the progress of the copy, which is only known by
+// the target server
+type ShardMoveStatus struct {
+	*ShardMove
+	WindowsCopied int `json:"windowsCopied"`
+	Windows       int `json:"windows"`
+	PointsCopied  int `json:"pointsCopied"`
+}
+
+type shardMoveProgress struct {
+	// the start of the next window to copy in microseconds
+	nextWindow    int64
+	windowsCopied int
+	windows       int
+	pointsCopied  int
+}
+
+func (self *ClusterConfiguration) SetShardMover(shardMover ShardMover) {
+	self.shardMover = shardMover
+}
+
+// Returns the shard moves in progress, ordered by shard id
+func (self *ClusterConfiguration) ShardMoves() []*ShardMove {
+	self.shardMovesLock.RLock()
+	defer self.shardMovesLock.RUnlock()
+
+	moves := make([]*ShardMove, 0, len(self.shardMoves))
+	for _, move := range self.shardMoves {
+		moves = append(moves, move)
+	}
+	sort.Sort(shardMovesById(moves))
+	return moves
+}
+
+// Returns the shard moves in progress with the progress of the moves
+// to this server
+func (self *ClusterConfiguration) ShardMovesStatus() []*ShardMoveStatus {
+	moves := self.ShardMoves()
+	statuses := make([]*ShardMoveStatus, 0, len(moves))
+
+	self.shardMovesLock.RLock()
+	defer self.shardMovesLock.RUnlock()
+	for _, move := range moves {
+		status := &ShardMoveStatus{ShardMove: move}
+		if progress := self.shardMoveProgress[move.ShardId]; progress != nil {
+			status.WindowsCopied = progress.windowsCopied
+			status.Windows = progress.windows
+			status.PointsCopied = progress.pointsCopied
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Returns the moves that even out the number of shard replicas per
+// server, each move takes a replica from the server with the most
+// replicas to the one with the least. Shards that are already being
+// moved aren't moved again.
+func (self *ClusterConfiguration) PlanRebalance() []*ShardMove {
+	counts := make(map[uint32]int)
+	for _, server := range self.Servers() {
+		// the shards of the servers being decommissioned are already
+		// moved away
+		if server.State != Leaving {
+			counts[server.Id] = 0
+		}
+	}
+
+	self.shardMovesLock.RLock()
+	candidates := make([]*ShardData, 0)
+	for _, shard := range self.GetAllShards() {
+		for _, id := range shard.serverIds {
+			if _, ok := counts[id]; ok {
+				counts[id]++
+			}
+		}
+		if self.shardMoves[shard.id] == nil {
+			candidates = append(candidates, shard)
+		}
+	}
+	self.shardMovesLock.RUnlock()
+
+	serverIds := make([]int, 0, len(counts))
+	for id := range counts {
+		serverIds = append(serverIds, int(id))
+	}
+	sort.Ints(serverIds)
+
+	moves := []*ShardMove{}
+	moved := make(map[uint32]bool)
+	for {
+		from, to := uint32(0), uint32(0)
+		for _, id := range serverIds {
+			if from == 0 || counts[uint32(id)] > counts[from] {
+				from = uint32(id)
+			}
+			if to == 0 || counts[uint32(id)] < counts[to] {
+				to = uint32(id)
+			}
+		}
+		if counts[from]-counts[to] <= 1 {
+			return moves
+		}
+
+		var shard *ShardData
+		for _, candidate := range candidates {
+			if !moved[candidate.id] && candidate.hasServer(from) && !candidate.hasServer(to) {
+				shard = candidate
+				break
+			}
+		}
+		if shard == nil {
+			return moves
+		}
+
+		moved[shard.id] = true
+		counts[from]--
+		counts[to]++
+		moves = append(moves, &ShardMove{ShardId: shard.id, FromServerId: from, ToServerId: to})
+	}
+}
+
+// Starts moving the replica, the target server is added to the shard
+// and starts copying the points in the background
+func (self *ClusterConfiguration) AddShardMove(move *ShardMove) error {
+	self.shardsByIdLock.Lock()
+	defer self.shardsByIdLock.Unlock()
+	self.shardMovesLock.Lock()
+	defer self.shardMovesLock.Unlock()
+
+	shard := self.shardsById[move.ShardId]
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", move.ShardId)
+	}
+	if self.shardMoves[move.ShardId] != nil {
+		return fmt.Errorf("Shard %d is already being moved", move.ShardId)
+	}
+	if !shard.hasServer(move.FromServerId) {
+		return fmt.Errorf("Shard %d isn't stored on server %d", move.ShardId, move.FromServerId)
+	}
+	if shard.hasServer(move.ToServerId) {
+		return fmt.Errorf("Shard %d is already stored on server %d", move.ShardId, move.ToServerId)
+	}
+	server := self.GetServerById(&move.ToServerId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", move.ToServerId)
+	}
+	if server.State == Leaving {
+		return fmt.Errorf("Server %d is being decommissioned", move.ToServerId)
+	}
+
+	if self.LocalServer != nil && move.ToServerId == self.LocalServer.Id {
+		if err := shard.SetLocalStore(self.shardStore, self.LocalServer.Id); err != nil {
+			return err
+		}
+	} else {
+		shard.addServer(server)
+	}
+	shard.movingTo = move.ToServerId
+	self.shardMoves[move.ShardId] = move
+	log.Info("Moving shard %d from server %d to server %d", move.ShardId, move.FromServerId, move.ToServerId)
+
+	select {
+	case self.shardMoveAdded <- true:
+	default:
+	}
+	return nil
+}
+
+// Called once the target server copied all the points, the replica on
+// the source server is dropped
+func (self *ClusterConfiguration) FinishShardMove(shardId uint32) error {
+	move := self.removeShardMove(shardId)
+	if move == nil {
+		return fmt.Errorf("Shard %d isn't being moved", shardId)
+	}
+	log.Info("Moved shard %d from server %d to server %d", move.ShardId, move.FromServerId, move.ToServerId)
+	return self.DropShard(shardId, []uint32{move.FromServerId})
+}
+
+// Stops moving the replica, the partial copy on the target server is
+// dropped
+func (self *ClusterConfiguration) CancelShardMove(shardId uint32) error {
+	move := self.removeShardMove(shardId)
+	if move == nil {
+		return fmt.Errorf("Shard %d isn't being moved", shardId)
+	}
+	log.Info("Cancelled moving shard %d from server %d to server %d", move.ShardId, move.FromServerId, move.ToServerId)
+	return self.DropShard(shardId, []uint32{move.ToServerId})
+}
+
+func (self *ClusterConfiguration) removeShardMove(shardId uint32) *ShardMove {
+	self.shardsByIdLock.RLock()
+	defer self.shardsByIdLock.RUnlock()
+	self.shardMovesLock.Lock()
+	defer self.shardMovesLock.Unlock()
+
+	move := self.shardMoves[shardId]
+	if move == nil {
+		return nil
+	}
+	delete(self.shardMoves, shardId)
+	delete(self.shardMoveProgress, shardId)
+	if shard := self.shardsById[shardId]; shard != nil {
+		shard.movingTo = 0
+	}
+	return move
+}
+
+func (self *ClusterConfiguration) isShardMovePending(move *ShardMove) bool {
+	self.shardMovesLock.RLock()
+	defer self.shardMovesLock.RUnlock()
+	return self.shardMoves[move.ShardId] == move
+}
+
+// called by the server, copies the shards that are moved to this
+// server one at a time
+func (self *ClusterConfiguration) StartShardMoves() {
+	go func() {
+		for {
+			select {
+			case <-self.shardMoveAdded:
+			case <-time.After(time.Minute):
+			}
+			if !self.IsLocalServerLoaded() {
+				continue
+			}
+
+			for _, move := range self.ShardMoves() {
+				if move.ToServerId != self.LocalServer.Id {
+					continue
+				}
+				if err := self.copyShard(move); err != nil {
+					if err != shardMoveCancelledError {
+						log.Error("Error copying shard %d from server %d: %s", move.ShardId, move.FromServerId, err)
+					}
+					continue
+				}
+				if err := self.shardMover.FinishShardMove(move.ShardId); err != nil {
+					log.Error("Error finishing the move of shard %d: %s", move.ShardId, err)
+				}
+			}
+		}
+	}()
+}
+
+// Copies the points of the shard from the source server one window at
+// a time. The progress is kept, so a copy that fails is resumed from
+// the window it failed on.
+func (self *ClusterConfiguration) copyShard(move *ShardMove) error {
+	window := int64(self.config.AntiEntropyWindow / time.Microsecond)
+	if window <= 0 {
+		return fmt.Errorf("Cannot copy shards in windows of %s", self.config.AntiEntropyWindow)
+	}
+
+	self.shardsByIdLock.RLock()
+	shard := self.shardsById[move.ShardId]
+	self.shardsByIdLock.RUnlock()
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", move.ShardId)
+	}
+	server := self.GetServerById(&move.FromServerId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", move.FromServerId)
+	}
+	if !server.IsUp() {
+		return fmt.Errorf("Server %d is down", move.FromServerId)
+	}
+	admins := self.GetClusterAdmins()
+	if len(admins) == 0 {
+		return errors.New("Cannot copy shards without a cluster admin")
+	}
+	// the points are compared with the local copy, which only exists
+	// once something was written to it
+	if _, err := self.shardStore.GetOrCreateShard(shard.id); err != nil {
+		return err
+	}
+	self.shardStore.ReturnShard(shard.id)
+
+	self.shardMovesLock.Lock()
+	progress := self.shardMoveProgress[move.ShardId]
+	if progress == nil {
+		progress = &shardMoveProgress{
+			nextWindow: shard.startMicro,
+			windows:    int((shard.endMicro - shard.startMicro + window - 1) / window),
+		}
+		self.shardMoveProgress[move.ShardId] = progress
+	}
+	self.shardMovesLock.Unlock()
+
+	throttle := newThrottle(self.config.AntiEntropyMaxPointsPerSecond)
+	for progress.nextWindow < shard.endMicro {
+		if !self.isShardMovePending(move) {
+			return shardMoveCancelledError
+		}
+
+		start := progress.nextWindow
+		end := start + window
+		if end > shard.endMicro {
+			end = shard.endMicro
+		}
+		copied := 0
+		for _, db := range self.GetDatabases() {
+			count, err := shard.copyMissingPoints(server, db.Name, admins[0], start, end, throttle, self.config.AntiEntropyTimeout)
+			if err != nil {
+				return err
+			}
+			copied += count
+		}
+
+		self.shardMovesLock.Lock()
+		progress.nextWindow = end
+		progress.windowsCopied++
+		progress.pointsCopied += copied
+		self.shardMovesLock.Unlock()
+	}
+	return nil
+}
+
+func (self *ShardData) hasServer(serverId uint32) bool {
+	for _, id := range self.serverIds {
+		if id == serverId {
+			return true
+		}
+	}
+	return false
+}
+
+type shardMovesById []*ShardMove
+
+func (self shardMovesById) Len() int           { return len(self) }
+func (self shardMovesById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self shardMovesById) Less(i, j int) bool { return self[i].ShardId < self[j].ShardId }
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type RebalanceSuite struct{}
+
+var _ = Suite(&RebalanceSuite{})
+
+// A configuration with the given servers and one shard per list of
+// replicas, the shards are numbered from 1
+func newRebalanceConfiguration(c *C, servers []*ClusterServer, replicas [][]uint32) *ClusterConfiguration {
+	config := newTestClusterConfiguration(c)
+	config.servers = servers
+	for i, serverIds := range replicas {
+		start := time.Unix(int64(i)*3600, 0)
+		shard := NewShard(uint32(i+1), start, start.Add(time.Hour), SHORT_TERM, false, NewMockWal())
+		for _, id := range serverIds {
+			shard.addServer(config.GetServerById(&id))
+		}
+		config.shortTermShards = append(config.shortTermShards, shard)
+		config.shardsById[shard.id] = shard
+	}
+	return config
+}
+
+func (self *RebalanceSuite) TestPlanRebalance(c *C) {
+	servers := runningServers
+	leaving := servers(1, 2, 3)
+	leaving[2].State = Leaving
+
+	for _, test := range []struct {
+		name     string
+		servers  []*ClusterServer
+		replicas [][]uint32
+		moving   []uint32
+		expected []*ShardMove
+	}{
+		{"balanced", servers(1, 2, 3), [][]uint32{{1}, {2}, {3}, {1}}, nil, []*ShardMove{}},
+		{"one server has all the shards", servers(1, 2, 3), [][]uint32{{1}, {1}, {1}, {1}}, nil,
+			[]*ShardMove{{1, 1, 2}, {2, 1, 3}}},
+		{"new server", servers(1, 2, 3, 4), [][]uint32{{1, 2}, {1, 2}, {2, 3}, {1, 3}}, nil,
+			[]*ShardMove{{1, 1, 4}, {2, 2, 4}}},
+		{"leaving servers get no shards", leaving, [][]uint32{{1}, {1}, {1}, {3}}, nil,
+			[]*ShardMove{{1, 1, 2}}},
+		{"shards being moved aren't moved again", servers(1, 2), [][]uint32{{1}, {1}, {1}}, []uint32{1},
+			[]*ShardMove{{2, 1, 2}}},
+		{"the replicas of a shard stay on different servers", servers(1, 2), [][]uint32{{1, 2}, {1, 2}, {1}, {1}}, nil,
+			[]*ShardMove{{3, 1, 2}}},
+	} {
+		config := newRebalanceConfiguration(c, test.servers, test.replicas)
+		for _, id := range test.moving {
+			config.shardMoves[id] = &ShardMove{id, 1, 3}
+		}
+		c.Assert(config.PlanRebalance(), DeepEquals, test.expected, Commentf(test.name))
+	}
+}
+
+func (self *RebalanceSuite) TestShardsAreNotCopiedWithoutAWindow(c *C) {
+	config := newRebalanceConfiguration(c, []*ClusterServer{{Id: 1}, {Id: 2}}, [][]uint32{{1}})
+	err := config.copyShard(&ShardMove{1, 1, 2})
+	c.Assert(err, ErrorMatches, "Cannot copy shards in windows of 0.*")
+}
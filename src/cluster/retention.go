@@ -0,0 +1,321 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Sets how long the data of db is kept, zero keeps it forever
+func (self *ClusterConfiguration) SetRetentionPolicy(db string, retention time.Duration) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if retention < 0 {
+		return fmt.Errorf("Retention policy of %s cannot be negative", db)
+	}
+
+	if retention == 0 {
+		delete(self.retentionPolicies, db)
+		return nil
+	}
+	self.retentionPolicies[db] = retention
+	return nil
+}
+
+// Returns how long the data of db is kept, zero if it's kept forever
+func (self *ClusterConfiguration) GetRetentionPolicy(db string) (time.Duration, error) {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return 0, fmt.Errorf("Database %s doesn't exist", db)
+	}
+	return self.retentionPolicies[db], nil
+}
+
+// Returns the shards that only have data older than the retention
+// policies of all the databases. The shared shards hold the data of all
+// the databases so they can only be dropped as a whole when none of
+// them keeps the data, which is never the case while a database or one
+// of its named policies keeps the data forever. The shards dedicated to
+// a database only depend on its own policies, they're all expired once
+// it's dropped.
+func (self *ClusterConfiguration) ExpiredShards(now time.Time) []*ShardData {
+	self.createDatabaseLock.RLock()
+	retentions := self.policyDatabaseRetentions()
+	exists := make(map[string]bool, len(self.DatabaseReplicationFactors))
+	for db := range self.DatabaseReplicationFactors {
+		exists[db] = true
+	}
+	self.createDatabaseLock.RUnlock()
+
+	// the longest retention of the shards dedicated to each database,
+	// keyed by "" for the shared ones. Zero keeps them forever.
+	maxRetentions := map[string]time.Duration{}
+	forever := map[string]bool{}
+	for name, retention := range retentions {
+		db, _ := SplitPolicyDatabase(name)
+		for _, database := range []string{"", db} {
+			if retention == 0 {
+				forever[database] = true
+			} else if retention > maxRetentions[database] {
+				maxRetentions[database] = retention
+			}
+		}
+	}
+
+	expired := []*ShardData{}
+	for _, shard := range self.GetAllShards() {
+		if shard.database != "" && !exists[shard.database] {
+			expired = append(expired, shard)
+			continue
+		}
+		maxRetention := maxRetentions[shard.database]
+		if forever[shard.database] || maxRetention == 0 {
+			continue
+		}
+		if shard.EndTime().Before(now.Add(-maxRetention)) {
+			expired = append(expired, shard)
+		}
+	}
+	return expired
+}
+
+// Returns the databases whose data in each of the local shards is
+// older than their retention policy, keyed by the shard id. The named
+// policies expire the databases PolicyDatabase names. The dropped
+// databases are expired in the local shards created before the drop.
+// The shards in ExpiredShards are left out, the leader drops them as a
+// whole.
+func (self *ClusterConfiguration) ExpiredLocalDatabases(now time.Time) map[uint32][]string {
+	expiredShards := map[uint32]bool{}
+	for _, shard := range self.ExpiredShards(now) {
+		expiredShards[shard.Id()] = true
+	}
+
+	self.createDatabaseLock.RLock()
+	policies := map[string]time.Duration{}
+	for db, retention := range self.policyDatabaseRetentions() {
+		if retention > 0 {
+			policies[db] = retention
+		}
+	}
+	dropped := make(map[string]uint32, len(self.droppedDatabases))
+	for db, lastShardId := range self.droppedDatabases {
+		dropped[db] = lastShardId
+	}
+	self.createDatabaseLock.RUnlock()
+
+	expired := map[uint32][]string{}
+	if len(policies) == 0 && len(dropped) == 0 {
+		return expired
+	}
+
+	for _, shard := range self.GetAllShards() {
+		if !shard.IsLocal || expiredShards[shard.Id()] {
+			continue
+		}
+		for db, retention := range policies {
+			if shard.EndTime().Before(now.Add(-retention)) {
+				expired[shard.Id()] = append(expired[shard.Id()], db)
+			}
+		}
+		for db, lastShardId := range dropped {
+			if shard.mayHaveDataOf(db, lastShardId) {
+				expired[shard.Id()] = append(expired[shard.Id()], db)
+			}
+		}
+	}
+	return expired
+}
+
+// Whether the database was dropped and not created again, the writes
+// to it that were still buffered or replayed are discarded
+func (self *ClusterConfiguration) IsDroppedDatabase(db string) bool {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	_, ok := self.droppedDatabases[db]
+	return ok
+}
+
+// Records the drop of the database if the shards that exist may have
+// some of its data. Called with createDatabaseLock held.
+func (self *ClusterConfiguration) markDatabaseDropped(db string) {
+	lastShardId := self.lastShardIdUsed
+	for _, shard := range self.GetAllShards() {
+		if shard.mayHaveDataOf(db, lastShardId) {
+			self.droppedDatabases[db] = lastShardId
+			return
+		}
+	}
+}
+
+// Drops the data of db from the local shards created by lastShardId,
+// the shards that don't exist on this server have none
+func (self *ClusterConfiguration) dropLocalDatabase(db string, lastShardId uint32) {
+	if self.shardStore == nil {
+		return
+	}
+	for _, shard := range self.GetAllShards() {
+		if !shard.IsLocal || !shard.mayHaveDataOf(db, lastShardId) {
+			continue
+		}
+		localShard, err := self.shardStore.GetShard(shard.Id())
+		if err != nil {
+			continue
+		}
+		log.Info("Dropping the data of %s from shard %d, the database was dropped", db, shard.Id())
+		if err := localShard.DropDatabase(db); err != nil {
+			log.Error("Cannot drop the data of %s from shard %d, the sweeper retries: %s", db, shard.Id(), err)
+		}
+		self.shardStore.ReturnShard(shard.Id())
+	}
+}
+
+// Forgets the drops once all the shards that may have had data of the
+// dropped databases are dropped, called when a shard is dropped
+func (self *ClusterConfiguration) pruneDroppedDatabases() {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+	shards := self.GetAllShards()
+	for db, lastShardId := range self.droppedDatabases {
+		pending := false
+		for _, shard := range shards {
+			if shard.mayHaveDataOf(db, lastShardId) {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			log.Info("The shards of the dropped database %s are all dropped", db)
+			delete(self.droppedDatabases, db)
+		}
+	}
+}
+
+// Whether the shard was created by lastShardId and holds the data of
+// db, the shared shards hold the data of all of them
+func (self *ShardData) mayHaveDataOf(db string, lastShardId uint32) bool {
+	if self.id > lastShardId {
+		return false
+	}
+	name, _ := SplitPolicyDatabase(db)
+	return self.database == "" || self.database == name
+}
+
+// The shards keep the points of the named retention policies of a
+// database under a database of their own, named after both. % can't
+// appear in database names so it doesn't collide with one.
+const POLICY_SEPARATOR = "%"
+
+// Returns the database the shards keep the points of the named policy
+// of db under, db itself if policy is empty
+func PolicyDatabase(db, policy string) string {
+	if policy == "" {
+		return db
+	}
+	return db + POLICY_SEPARATOR + policy
+}
+
+// The reverse of PolicyDatabase, the policy is empty for the databases
+// of the default policies
+func SplitPolicyDatabase(name string) (db, policy string) {
+	parts := strings.SplitN(name, POLICY_SEPARATOR, 2)
+	if len(parts) == 1 {
+		return name, ""
+	}
+	return parts[0], parts[1]
+}
+
+// Creates or changes the named retention policy of db, which keeps its
+// points for the given duration, zero keeps them forever
+func (self *ClusterConfiguration) SetNamedRetentionPolicy(db, name string, retention time.Duration) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return fmt.Errorf("Database %s doesn't exist", db)
+	}
+	if name == "" || strings.Contains(name, POLICY_SEPARATOR) {
+		return fmt.Errorf("%s isn't a valid retention policy name", name)
+	}
+	if retention < 0 {
+		return fmt.Errorf("Retention policy %s of %s cannot be negative", name, db)
+	}
+
+	policies := self.namedRetentionPolicies[db]
+	if policies == nil {
+		policies = make(map[string]time.Duration)
+		self.namedRetentionPolicies[db] = policies
+	}
+	policies[name] = retention
+	return nil
+}
+
+func (self *ClusterConfiguration) DeleteNamedRetentionPolicy(db, name string) error {
+	self.createDatabaseLock.Lock()
+	defer self.createDatabaseLock.Unlock()
+
+	if _, ok := self.namedRetentionPolicies[db][name]; !ok {
+		return fmt.Errorf("Retention policy %s of %s doesn't exist", name, db)
+	}
+	delete(self.namedRetentionPolicies[db], name)
+	if len(self.namedRetentionPolicies[db]) == 0 {
+		delete(self.namedRetentionPolicies, db)
+	}
+	return nil
+}
+
+// Returns how long each of the named retention policies of db keeps
+// its points
+func (self *ClusterConfiguration) GetNamedRetentionPolicies(db string) (map[string]time.Duration, error) {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	if _, ok := self.DatabaseReplicationFactors[db]; !ok {
+		return nil, fmt.Errorf("Database %s doesn't exist", db)
+	}
+	policies := make(map[string]time.Duration, len(self.namedRetentionPolicies[db]))
+	for name, retention := range self.namedRetentionPolicies[db] {
+		policies[name] = retention
+	}
+	return policies, nil
+}
+
+func (self *ClusterConfiguration) NamedRetentionPolicyExists(db, name string) bool {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+
+	_, ok := self.namedRetentionPolicies[db][name]
+	return ok
+}
+
+// Whether the shards may keep points under name, which is a database or
+// the database of one of its named retention policies
+func (self *ClusterConfiguration) PolicyDatabaseExists(name string) bool {
+	db, policy := SplitPolicyDatabase(name)
+	if policy == "" {
+		return self.DatabasesExists(db)
+	}
+	return self.NamedRetentionPolicyExists(db, policy)
+}
+
+// Returns how long the points kept under each database of the shards
+// are kept, including the databases of the named policies. Those kept
+// forever are zero.
+func (self *ClusterConfiguration) policyDatabaseRetentions() map[string]time.Duration {
+	retentions := map[string]time.Duration{}
+	for db := range self.DatabaseReplicationFactors {
+		retentions[db] = self.retentionPolicies[db]
+		for name, retention := range self.namedRetentionPolicies[db] {
+			retentions[PolicyDatabase(db, name)] = retention
+		}
+	}
+	return retentions
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"configuration"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type RetentionSuite struct{}
+
+var _ = Suite(&RetentionSuite{})
+
+func (self *RetentionSuite) TestDroppedDatabasesAreExpiredFromTheShardsCreatedBefore(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, NewMockWal(), &MockShardStore{}, nil)
+	config.LocalServer = &ClusterServer{Id: 1}
+	addShard := func(db string, start time.Time) *ShardData {
+		shards, err := config.AddShards([]*NewShardData{{StartTime: start, EndTime: start.Add(time.Hour), ServerIds: []uint32{1}, Type: SHORT_TERM, Database: db}})
+		c.Assert(err, IsNil)
+		return shards[0]
+	}
+	start := time.Now().Truncate(time.Hour)
+	c.Assert(config.CreateDatabase("db", 1), IsNil)
+	c.Assert(config.CreateDatabase("other", 1), IsNil)
+	// the databases without shards have nothing to drop
+	c.Assert(config.DropDatabase("other"), IsNil)
+	c.Assert(config.IsDroppedDatabase("other"), Equals, false)
+
+	shared := addShard("", start)
+	dedicated := addShard("db", start.Add(-time.Hour))
+	addShard("third", start.Add(-2*time.Hour))
+	c.Assert(config.DropDatabase("db"), IsNil)
+	c.Assert(config.IsDroppedDatabase("db"), Equals, true)
+	later := addShard("", start.Add(time.Hour))
+
+	// the dedicated shard is dropped as a whole by the leader
+	expired := config.ExpiredLocalDatabases(time.Now())
+	c.Assert(expired, DeepEquals, map[uint32][]string{shared.Id(): {"db"}})
+	c.Assert(later.Id() > shared.Id(), Equals, true)
+
+	// the drop is forgotten once the shards that may have its data are
+	// dropped, and it survives the snapshots until then
+	c.Assert(config.DropShard(shared.Id(), []uint32{1}), IsNil)
+	c.Assert(config.IsDroppedDatabase("db"), Equals, true)
+	snapshot, err := config.Save()
+	c.Assert(err, IsNil)
+	c.Assert(config.Recovery(snapshot), IsNil)
+	c.Assert(config.IsDroppedDatabase("db"), Equals, true)
+	c.Assert(config.DropShard(dedicated.Id(), []uint32{1}), IsNil)
+	c.Assert(config.IsDroppedDatabase("db"), Equals, false)
+	c.Assert(config.ExpiredLocalDatabases(time.Now()), HasLen, 0)
+}
+
+func (self *RetentionSuite) TestDroppedDatabasesAreDroppedFromTheLocalShardsBeforeTheyAreCreatedAgain(c *C) {
+	store := &MockShardStore{shards: map[uint32]*MockShardDb{}}
+	config := NewClusterConfiguration(&configuration.Configuration{}, NewMockWal(), store, nil)
+	config.LocalServer = &ClusterServer{Id: 1}
+	config.servers = []*ClusterServer{config.LocalServer, {Id: 2}}
+	addShard := func(db string, serverId uint32, start time.Time) *ShardData {
+		shards, err := config.AddShards([]*NewShardData{{StartTime: start, EndTime: start.Add(time.Hour), ServerIds: []uint32{serverId}, Type: SHORT_TERM, Database: db}})
+		c.Assert(err, IsNil)
+		store.shards[shards[0].Id()] = &MockShardDb{}
+		return shards[0]
+	}
+	start := time.Now().Truncate(time.Hour)
+	c.Assert(config.CreateDatabase("db", 1), IsNil)
+	c.Assert(config.SetNamedRetentionPolicy("db", "week", 7*24*time.Hour), IsNil)
+	shared := addShard("", 1, start)
+	dedicated := addShard("db", 1, start.Add(-time.Hour))
+	other := addShard("other", 1, start.Add(-2*time.Hour))
+	remote := addShard("", 2, start.Add(-3*time.Hour))
+	// the shards that don't exist on this server are skipped
+	missing := addShard("", 1, start.Add(-4*time.Hour))
+	delete(store.shards, missing.Id())
+
+	c.Assert(config.DropDatabase("db"), IsNil)
+	c.Assert(config.CreateDatabase("db", 1), IsNil)
+	c.Assert(store.shards[shared.Id()].dropped, DeepEquals, []string{"db", "db%week"})
+	c.Assert(store.shards[dedicated.Id()].dropped, DeepEquals, []string{"db", "db%week"})
+	c.Assert(store.shards[other.Id()].dropped, HasLen, 0)
+	c.Assert(store.shards[remote.Id()].dropped, HasLen, 0)
+	c.Assert(config.ExpiredLocalDatabases(time.Now()), HasLen, 0)
+}
+
+func (self *RetentionSuite) TestDedicatedShardsOfDroppedDatabasesExpire(c *C) {
+	config := newTestClusterConfiguration(c)
+	c.Assert(config.CreateDatabase("shared", 0), IsNil)
+	c.Assert(config.CreateDatabase("dedicated", 3), IsNil)
+	now := time.Now().Unix() * 1000 * 1000
+	shared, err := config.GetShardToWriteToBySeriesAndTime("shared", "foo", now)
+	c.Assert(err, IsNil)
+	dedicated, err := config.GetShardToWriteToBySeriesAndTime("dedicated", "foo", now)
+	c.Assert(err, IsNil)
+
+	// the shards of the databases that keep their data forever don't
+	// expire
+	c.Assert(config.ExpiredShards(time.Now().Add(24*time.Hour)), HasLen, 0)
+
+	// the dedicated shards only depend on the policies of their database
+	c.Assert(config.SetRetentionPolicy("dedicated", time.Hour), IsNil)
+	c.Assert(config.ExpiredShards(time.Now().Add(24*time.Hour)), DeepEquals, []*ShardData{dedicated})
+	c.Assert(config.SetRetentionPolicy("dedicated", 0), IsNil)
+
+	// and are expired as a whole once it's dropped, even if they aren't
+	// older than any retention
+	c.Assert(config.DropDatabase("dedicated"), IsNil)
+	c.Assert(config.ExpiredShards(time.Now()), DeepEquals, []*ShardData{dedicated})
+	c.Assert(shared.Database(), Equals, "")
+}
+
+func (self *RetentionSuite) TestLocalDatabasesOfTheExpiredShardsAreLeftToTheLeader(c *C) {
+	config := NewClusterConfiguration(&configuration.Configuration{}, NewMockWal(), &MockShardStore{}, nil)
+	config.LocalServer = &ClusterServer{Id: 1}
+	start := time.Now().Truncate(time.Hour).Add(-48 * time.Hour)
+	shards, err := config.AddShards([]*NewShardData{{StartTime: start, EndTime: start.Add(time.Hour), ServerIds: []uint32{1}, Type: SHORT_TERM}})
+	c.Assert(err, IsNil)
+	c.Assert(config.CreateDatabase("db", 1), IsNil)
+	c.Assert(config.CreateDatabase("other", 1), IsNil)
+
+	// the shared shard keeps the data of the other database
+	c.Assert(config.SetRetentionPolicy("db", time.Hour), IsNil)
+	c.Assert(config.ExpiredShards(time.Now()), HasLen, 0)
+	c.Assert(config.ExpiredLocalDatabases(time.Now()), DeepEquals, map[uint32][]string{shards[0].Id(): {"db"}})
+
+	// once it's expired for all of them it's dropped as a whole
+	c.Assert(config.SetRetentionPolicy("other", 2*time.Hour), IsNil)
+	c.Assert(config.ExpiredShards(time.Now()), DeepEquals, shards)
+	c.Assert(config.ExpiredLocalDatabases(time.Now()), HasLen, 0)
+}
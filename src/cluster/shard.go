@@ -4,10 +4,12 @@ import (
 	"common"
 	"engine"
 	"fmt"
+	"io"
 	"parser"
 	p "protocol"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"wal"
 
@@ -24,6 +26,7 @@ type Shard interface {
 	EndTime() time.Time
 	Write(*p.Request) error
 	SyncWrite(*p.Request) error
+	WriteWithConsistency(*p.Request, ConsistencyLevel) error
 	Query(querySpec *parser.QuerySpec, response chan *p.Response)
 	IsMicrosecondInRange(t int64) bool
 }
@@ -50,6 +53,9 @@ type NewShardData struct {
 	ServerIds     []uint32
 	Type          ShardType
 	DurationSplit bool `json:",omitempty"`
+	// the database the shard is dedicated to, empty if it has the data
+	// of the databases that use the replication factor of the cluster
+	Database string `json:",omitempty"`
 }
 
 type ShardType int
@@ -76,6 +82,16 @@ type ShardData struct {
 	shardNanoseconds uint64
 	localServerId    uint32
 	IsLocal          bool
+	// the server a replica of the shard is being moved to, zero if
+	// none. It doesn't have all the points yet, so it isn't queried.
+	movingTo uint32
+	// the database the shard is dedicated to, empty if it's shared
+	database string
+	// the deletes that ran on the local copy, loaded from the store
+	// the first time they're needed
+	deletes       []*DeleteMarker
+	deletesLoaded bool
+	deletesLock   sync.Mutex
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
@@ -110,18 +126,97 @@ var (
 
 type LocalShardDb interface {
 	Write(database string, series []*p.Series) error
+	// writes the series, the points with the timestamp of another point
+	// of their series are written according to the policy. Nothing is
+	// written to a dropped database. Returns the number of points
+	// written and the number dropped because their values don't match
+	// the types of their columns.
+	WriteWithPolicy(database string, series []*p.Series, policy DuplicatePointPolicy) (written, rejected int, err error)
 	Query(*parser.QuerySpec, QueryProcessor) error
 	DropDatabase(database string) error
 	IsClosed() bool
 }
 
+// Implemented by the local shards that keep the types of the columns,
+// the writes are checked before they're logged so the points rejected
+// by the field type policy fail the write
+type FieldTypeChecker interface {
+	CheckFieldTypes(database string, series []*p.Series) error
+}
+
 type LocalShardStore interface {
 	Write(request *p.Request) error
 	SetWriteBuffer(writeBuffer *WriteBuffer)
 	BufferWrite(request *p.Request)
 	GetOrCreateShard(id uint32) (LocalShardDb, error)
+	// fails if the shard doesn't exist locally
+	GetShard(id uint32) (LocalShardDb, error)
 	ReturnShard(id uint32)
 	DeleteShard(shardId uint32) error
+	IsClosed() bool
+	PointCounts() map[uint32]int64
+	// writes a consistent backup of the shard while it keeps serving,
+	// unless its modification marker is still since
+	BackupShard(id uint32, since int64, w io.Writer) error
+	ShardModificationMarker(id uint32) (int64, error)
+	// loads a backup into the shard, which has to be empty
+	RestoreShard(id uint32, r io.Reader) error
+	// nil if the read cache is disabled
+	ReadCacheStats() *ReadCacheStats
+	CompactShard(id uint32) error
+	CompactionStats() map[uint32]*ShardCompactionStats
+	ShardStats() map[uint32]*LocalShardStats
+	// the limits of the query engines of the local shards
+	QueryEngineConfig() *engine.QueryEngineConfig
+	// the deletes that ran on the shard, kept with its data until it's
+	// dropped
+	DeleteMarkers(id uint32) ([]*DeleteMarker, error)
+	SaveDeleteMarkers(id uint32, markers []*DeleteMarker) error
+}
+
+// The size and content of a shard stored on this server. The points,
+// series and time range are counted by periodic scans of the shard, the
+// points written since the last scan are added to the points.
+type LocalShardStats struct {
+	// the size of the shard on disk in bytes
+	Size   int64 `json:"size"`
+	Points int64 `json:"points"`
+	Series int   `json:"series"`
+	// the times of the first and last points in seconds, not set if
+	// the shard doesn't have any points
+	FirstPointTime *int64 `json:"firstPointTime,omitempty"`
+	LastPointTime  *int64 `json:"lastPointTime,omitempty"`
+	// zero if the shard wasn't scanned yet
+	ScannedAt time.Time `json:"scannedAt"`
+	// the points dropped since startup because their values don't
+	// match the types of their columns. The writes are checked before
+	// they're logged and fail instead, these are the points rejected
+	// after they were logged.
+	RejectedPoints int64 `json:"rejectedPoints"`
+}
+
+// The last compaction of a local shard
+type ShardCompactionStats struct {
+	LastRun    time.Time `json:"lastRun"`
+	DurationMs int64     `json:"durationMs"`
+	// the shard can grow if it was written to during the compaction
+	BytesReclaimed int64 `json:"bytesReclaimed"`
+	// the size of the shard after the compaction
+	Size int64 `json:"size"`
+	// the number of compactions since startup
+	Compactions int `json:"compactions"`
+}
+
+// The usage of the cache of the points read from the local shards
+type ReadCacheStats struct {
+	// the size of the cached points in bytes
+	Size    int `json:"size"`
+	MaxSize int `json:"maxSize"`
+	// the number of cached time windows of the columns
+	Windows   int   `json:"windows"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
 }
 
 func (self *ShardData) Id() uint32 {
@@ -144,6 +239,12 @@ func (self *ShardData) EndTime() time.Time {
 	return self.endTime
 }
 
+// The database the shard is dedicated to, empty if it has the data of
+// all the databases that use the replication factor of the cluster
+func (self *ShardData) Database() string {
+	return self.database
+}
+
 func (self *ShardData) IsMicrosecondInRange(t int64) bool {
 	return t >= self.startMicro && t < self.endMicro
 }
@@ -175,6 +276,49 @@ func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32
 	return nil
 }
 
+// Adds a replica of the shard on the given remote server
+func (self *ShardData) addServer(server *ClusterServer) {
+	self.clusterServers = append(self.clusterServers, server)
+	self.servers = append(self.servers, server)
+	self.serverIds = append(self.serverIds, server.Id)
+	self.sortServerIds()
+}
+
+// Removes the replicas of the shard on the given servers
+func (self *ShardData) removeServers(serverIds []uint32) {
+	isRemoved := func(id uint32) bool {
+		for _, removeId := range serverIds {
+			if id == removeId {
+				return true
+			}
+		}
+		return false
+	}
+
+	newIds := make([]uint32, 0)
+	for _, id := range self.serverIds {
+		if !isRemoved(id) {
+			newIds = append(newIds, id)
+		}
+	}
+	self.serverIds = newIds
+
+	clusterServers := make([]*ClusterServer, 0)
+	servers := make([]wal.Server, 0)
+	for _, server := range self.clusterServers {
+		if !isRemoved(server.Id) {
+			clusterServers = append(clusterServers, server)
+			servers = append(servers, server)
+		}
+	}
+	self.clusterServers = clusterServers
+	self.servers = servers
+
+	if self.IsLocal && isRemoved(self.localServerId) {
+		self.IsLocal = false
+	}
+}
+
 func (self *ShardData) ServerIds() []uint32 {
 	return self.serverIds
 }
@@ -196,6 +340,9 @@ func (self *ShardData) SyncWrite(request *p.Request) error {
 
 func (self *ShardData) Write(request *p.Request) error {
 	request.ShardId = &self.id
+	if err := self.checkFieldTypes(request); err != nil {
+		return err
+	}
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
 	if err != nil {
 		return err
@@ -212,6 +359,95 @@ func (self *ShardData) Write(request *p.Request) error {
 	return nil
 }
 
+// Logs the request to the wal then writes it to the local store and
+// the replicas in parallel, returning once enough of them acknowledged
+// the write to satisfy the consistency level. The request is committed
+// in the wal for each replica that wrote it, like the write buffers do,
+// and replicas that fail get it buffered so it's replayed from the wal
+// when they're back.
+func (self *ShardData) WriteWithConsistency(request *p.Request, level ConsistencyLevel) error {
+	request.ShardId = &self.id
+	if err := self.checkFieldTypes(request); err != nil {
+		return err
+	}
+	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
+	if err != nil {
+		return err
+	}
+	request.RequestNumber = &requestNumber
+
+	replicas := len(self.clusterServers)
+	if self.store != nil {
+		replicas++
+	}
+	required := level.RequiredReplicas(replicas)
+
+	acks := make(chan bool, replicas)
+	if self.store != nil {
+		go func() {
+			if err := self.store.Write(request); err != nil {
+				log.Error("Error writing request %d to local shard %d: %s", requestNumber, self.id, err)
+				self.store.BufferWrite(request)
+				acks <- false
+				return
+			}
+			self.commit(requestNumber, self.localServerId)
+			acks <- true
+		}()
+	}
+	for _, server := range self.clusterServers {
+		// we have to create a new reqeust object because the ID gets assigned on each server.
+		requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, MultiSeries: request.MultiSeries, ShardId: &self.id, RequestNumber: request.RequestNumber}
+		go func(server *ClusterServer) {
+			if err := server.Write(requestWithoutId); err != nil {
+				log.Error("Error writing request %d of shard %d to server %d: %s", requestNumber, self.id, server.Id, err)
+				server.BufferWrite(requestWithoutId)
+				acks <- false
+				return
+			}
+			self.commit(requestNumber, server.Id)
+			acks <- true
+		}(server)
+	}
+
+	acknowledged, failed := 0, 0
+	for acknowledged < required && failed <= replicas-required {
+		if <-acks {
+			acknowledged++
+		} else {
+			failed++
+		}
+	}
+
+	if acknowledged < required {
+		return common.NewConsistencyError(level.String(), required, acknowledged)
+	}
+	return nil
+}
+
+func (self *ShardData) commit(requestNumber, serverId uint32) {
+	if err := self.wal.Commit(requestNumber, serverId); err != nil {
+		log.Error("Error committing request %d of shard %d for server %d: %s", requestNumber, self.id, serverId, err)
+	}
+}
+
+// Checks the values of the request against the types of the columns of
+// the local shard, the replicas check them when they write the request
+func (self *ShardData) checkFieldTypes(request *p.Request) error {
+	if self.store == nil {
+		return nil
+	}
+	shard, err := self.store.GetOrCreateShard(self.id)
+	if err != nil {
+		return err
+	}
+	defer self.store.ReturnShard(self.id)
+	if checker, ok := shard.(FieldTypeChecker); ok {
+		return checker.CheckFieldTypes(*request.Database, request.MultiSeries)
+	}
+	return nil
+}
+
 func (self *ShardData) WriteLocalOnly(request *p.Request) error {
 	self.store.Write(request)
 	return nil
@@ -233,7 +469,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		}
 	}
 
-	if self.IsLocal {
+	if self.IsLocal && self.movingTo != self.localServerId {
 		var processor QueryProcessor
 		var err error
 
@@ -246,7 +482,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 			query := querySpec.SelectQuery()
 			if self.ShouldAggregateLocally(querySpec) {
 				log.Debug("creating a query engine")
-				processor, err = engine.NewQueryEngine(query, response)
+				processor, err = engine.NewQueryEngineWithConfig(query, response, self.store.QueryEngineConfig())
 				if err != nil {
 					response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
 					log.Error("Error while creating engine: %s", err)
@@ -260,7 +496,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 			} else {
 				maxPointsToBufferBeforeSending := 1000
 				log.Debug("creating a passthrough engine with limit")
-				processor = engine.NewPassthroughEngineWithLimit(response, maxPointsToBufferBeforeSending, query.Limit)
+				processor = engine.NewPassthroughEngineWithLimit(response, maxPointsToBufferBeforeSending, query.LimitWithOffset())
 			}
 
 			if query.GetFromClause().Type != parser.FromClauseInnerJoin {
@@ -294,7 +530,13 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 	if server := self.randomHealthyServer(); server != nil {
 		log.Debug("Querying server %d for shard %d", server.GetId(), self.Id())
 		request := self.createRequest(querySpec)
-		server.MakeRequest(request, response)
+		if querySpec.CancelChannel() == nil {
+			server.MakeRequest(request, response)
+			return
+		}
+		responses := make(chan *p.Response, cap(response))
+		server.MakeRequest(request, responses)
+		self.forwardRemoteResponses(server, request, querySpec.CancelChannel(), responses, response)
 		return
 	}
 
@@ -307,7 +549,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 func (self *ShardData) randomHealthyServer() *ClusterServer {
 	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
 	for _, s := range self.clusterServers {
-		if s.IsUp() {
+		if s.IsUp() && s.Id != self.movingTo {
 			healthyServers = append(healthyServers, s)
 		}
 	}
@@ -345,6 +587,25 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 	}
 }
 
+// Forwards the responses of the remote query until the end of the
+// stream, the remote server is asked to stop the query once it's
+// cancelled
+func (self *ShardData) forwardRemoteResponses(server *ClusterServer, request *p.Request, cancelled <-chan bool, responses <-chan *p.Response, response chan<- *p.Response) {
+	for {
+		select {
+		case r := <-responses:
+			response <- r
+			if r.GetType() == p.Response_END_STREAM || r.GetType() == p.Response_ACCESS_DENIED {
+				return
+			}
+		case <-cancelled:
+			log.Debug("Cancelling the query of shard %d on server %d", self.Id(), server.GetId())
+			server.CancelRequest(request)
+			cancelled = nil
+		}
+	}
+}
+
 func (self *ShardData) String() string {
 	serversString := make([]string, 0)
 	for _, s := range self.servers {
@@ -374,6 +635,21 @@ func (self *ShardData) ShouldAggregateLocally(querySpec *parser.QuerySpec) bool
 		}
 		return true
 	}
+
+	// the buckets of a time zone don't line up with the shards, whose
+	// boundaries are in UTC
+	if query := querySpec.SelectQuery(); query != nil && query.GetGroupByClause().Location != nil {
+		return false
+	}
+
+	// fill() has to create the empty buckets of the whole time range,
+	// including the ones of the other shards, which is only possible
+	// where the points of all the shards are aggregated
+	if query := querySpec.SelectQuery(); query != nil && query.GetGroupByClause().FillWithZero {
+		if !query.IsStartTimeSpecified() || query.GetStartTime().Before(self.startTime) || query.GetEndTime().After(self.endTime) {
+			return false
+		}
+	}
 	return self.shardDuration%*groupByInterval == 0
 }
 
@@ -436,6 +712,9 @@ func (self *ShardData) deleteDataLocally(querySpec *parser.QuerySpec) (<-chan *p
 	defer self.store.ReturnShard(self.id)
 	err = shard.Query(querySpec, processor)
 	processor.Close()
+	if err == nil {
+		self.recordDelete(querySpec)
+	}
 	return localResponses, err
 }
 
@@ -515,7 +794,7 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 	database := querySpec.Database()
 	isDbUser := !user.IsClusterAdmin()
 
-	return &p.Request{
+	request := &p.Request{
 		Type:     &queryRequest,
 		ShardId:  &self.id,
 		Query:    &queryString,
@@ -523,6 +802,11 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 		Database: &database,
 		IsDbUser: &isDbUser,
 	}
+	// the time zone isn't part of the query string
+	if query := querySpec.SelectQuery(); query != nil && query.GetGroupByClause().Location != nil {
+		request.TimeZone = p.String(query.GetGroupByClause().Location.String())
+	}
+	return request
 }
 
 // used to serialize shards when sending around in raft or when snapshotting in the log
@@ -533,6 +817,7 @@ func (self *ShardData) ToNewShardData() *NewShardData {
 		EndTime:   self.endTime,
 		Type:      self.shardType,
 		ServerIds: self.serverIds,
+		Database:  self.database,
 	}
 }
 
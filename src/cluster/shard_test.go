@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"common"
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+	"time"
+)
+
+type ShardSuite struct{}
+
+var _ = Suite(&ShardSuite{})
+
+func newWriteRequest() *protocol.Request {
+	db := "db"
+	return &protocol.Request{Type: protocol.Request_WRITE.Enum(), Database: &db}
+}
+
+func (self *ShardSuite) TestWriteWithConsistencyCommitsTheAcknowledgedWrites(c *C) {
+	wal := NewMockWal()
+	store := &MockShardStore{}
+	end := time.Now().Truncate(time.Hour)
+	shard := NewShard(1, end.Add(-time.Hour), end, SHORT_TERM, false, wal)
+	c.Assert(shard.SetLocalStore(store, 2), IsNil)
+
+	c.Assert(shard.WriteWithConsistency(newWriteRequest(), ConsistencyAll), IsNil)
+	c.Assert(store.written, HasLen, 1)
+	c.Assert(wal.Commits(2), DeepEquals, []uint32{1})
+
+	// the failed writes are buffered to be replayed and aren't committed
+	store.fail = true
+	err := shard.WriteWithConsistency(newWriteRequest(), ConsistencyAll)
+	c.Assert(err, FitsTypeOf, &common.ConsistencyError{})
+	c.Assert(store.buffered, HasLen, 1)
+	c.Assert(wal.Commits(2), DeepEquals, []uint32{1})
+}
+
+func (self *ShardSuite) TestCancelledQueriesAreCancelledOnTheRemoteServer(c *C) {
+	connection := &MockServerConnection{}
+	server := &ClusterServer{Id: 2, connection: connection, isUp: true}
+	end := time.Now().Truncate(time.Hour)
+	shard := NewShard(1, end.Add(-time.Hour), end, SHORT_TERM, false, NewMockWal())
+	shard.SetServers([]*ClusterServer{server})
+
+	query, err := parser.ParseSelectQuery("select value from cpu")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(&ClusterAdmin{CommonUser{Name: "root"}}, "db", &parser.Query{SelectQuery: query})
+	cancel := make(chan bool)
+	querySpec.SetCancelChannel(cancel)
+	responses := make(chan *protocol.Response, 1)
+	go shard.Query(querySpec, responses)
+
+	// the responses that come before the cancel are forwarded
+	for {
+		connection.lock.Lock()
+		stream := connection.stream
+		connection.lock.Unlock()
+		if stream != nil {
+			stream <- &protocol.Response{Type: &queryResponse}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert((<-responses).GetType(), Equals, protocol.Response_QUERY)
+
+	close(cancel)
+	response := <-responses
+	c.Assert(response.GetType(), Equals, protocol.Response_END_STREAM)
+	c.Assert(response.GetErrorMessage(), Equals, "Query cancelled")
+	c.Assert(connection.cancelled, DeepEquals, connection.requests)
+}
@@ -0,0 +1,61 @@
+package cluster
+
+// The servers a shard is stored on and whether enough of them are up
+type ShardStatus struct {
+	Id        uint32   `json:"id"`
+	StartTime int64    `json:"startTime"`
+	EndTime   int64    `json:"endTime"`
+	LongTerm  bool     `json:"longTerm"`
+	ServerIds []uint32 `json:"serverIds"`
+	// the database the shard is dedicated to, empty if it's shared
+	Database string `json:"database,omitempty"`
+	// the servers the shard is stored on that are down
+	DownServerIds []uint32 `json:"downServerIds"`
+	// true if fewer servers than the replication factor have the
+	// shard and are up
+	UnderReplicated bool `json:"underReplicated"`
+	// the stats of the replica stored on this server, if there's one
+	Local *LocalShardStats `json:"local,omitempty"`
+}
+
+// Returns true if the server is up, the local server always is
+func (self *ClusterConfiguration) IsServerUp(server *ClusterServer) bool {
+	return server == self.LocalServer || server.IsUp()
+}
+
+// Returns the status of all the shards, the short term ones first
+func (self *ClusterConfiguration) ShardStatuses() []*ShardStatus {
+	servers := 0
+	for _, server := range self.Servers() {
+		if server.State != Leaving {
+			servers++
+		}
+	}
+	localStats := self.LocalShardStats()
+	statuses := []*ShardStatus{}
+	for _, shard := range self.GetAllShards() {
+		status := &ShardStatus{
+			Id:            shard.id,
+			StartTime:     shard.startTime.Unix(),
+			EndTime:       shard.endTime.Unix(),
+			LongTerm:      shard.shardType == LONG_TERM,
+			Database:      shard.database,
+			ServerIds:     shard.serverIds,
+			DownServerIds: []uint32{},
+			Local:         localStats[shard.id],
+		}
+		for _, id := range shard.serverIds {
+			server := self.GetServerById(&id)
+			if server == nil || !self.IsServerUp(server) {
+				status.DownServerIds = append(status.DownServerIds, id)
+			}
+		}
+		replicationFactor := self.shardReplicationFactor(shard.database)
+		if replicationFactor > servers {
+			replicationFactor = servers
+		}
+		status.UnderReplicated = len(status.ServerIds)-len(status.DownServerIds) < replicationFactor
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -60,6 +60,13 @@ func (self *CommonUser) isValidPwd(password string) bool {
 	return isValid
 }
 
+// Returns true if the password wasn't hashed with the given cost, it
+// should be hashed again once the user logs in
+func (self *CommonUser) NeedsRehash(passwordHashCost int) bool {
+	cost, err := bcrypt.Cost([]byte(self.Hash))
+	return err == nil && cost != passwordHashCost
+}
+
 func (self *CommonUser) IsClusterAdmin() bool {
 	return false
 }
@@ -141,12 +148,60 @@ func (self *DbUser) ChangePermissions(readPermissions, writePermissions string)
 	self.WriteTo = []*Matcher{{true, writePermissions}}
 }
 
-func HashPassword(password string) ([]byte, error) {
+// Gives the user read and/or write access to the series matching the
+// regex, on top of the access the user already has
+func (self *DbUser) GrantPermissions(read, write bool, regex string) {
+	if read {
+		self.ReadFrom = addMatcher(self.ReadFrom, regex)
+	}
+	if write {
+		self.WriteTo = addMatcher(self.WriteTo, regex)
+	}
+}
+
+// Takes away the read and/or write access that was given with the
+// regex, or all the access if the regex is empty
+func (self *DbUser) RevokePermissions(read, write bool, regex string) {
+	if read {
+		self.ReadFrom = removeMatcher(self.ReadFrom, regex)
+	}
+	if write {
+		self.WriteTo = removeMatcher(self.WriteTo, regex)
+	}
+}
+
+// the matchers are copied instead of changed in place, since the user
+// may be in use by queries that are running
+func addMatcher(matchers []*Matcher, regex string) []*Matcher {
+	for _, matcher := range matchers {
+		if matcher.IsRegex && matcher.Name == regex {
+			return matchers
+		}
+	}
+	updated := make([]*Matcher, 0, len(matchers)+1)
+	updated = append(updated, matchers...)
+	return append(updated, &Matcher{true, regex})
+}
+
+func removeMatcher(matchers []*Matcher, regex string) []*Matcher {
+	updated := make([]*Matcher, 0, len(matchers))
+	if regex == "" {
+		return updated
+	}
+	for _, matcher := range matchers {
+		if !matcher.IsRegex || matcher.Name != regex {
+			updated = append(updated, matcher)
+		}
+	}
+	return updated
+}
+
+func HashPassword(password string, cost int) ([]byte, error) {
 	if length := len(password); length < 4 || length > 56 {
 		return nil, common.NewQueryError(common.InvalidArgument, "Password must be more than 4 and less than 56 characters")
 	}
 
 	// The second arg is the cost of the hashing, higher is slower but makes it harder
 	// to brute force, since it will be really slow and impractical
-	return bcrypt.GenerateFromPassword([]byte(password), 10)
+	return bcrypt.GenerateFromPassword([]byte(password), cost)
 }
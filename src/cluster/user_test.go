@@ -28,7 +28,7 @@ func (self *UserSuite) TestProperties(c *C) {
 	c.Assert(u.IsClusterAdmin(), Equals, true)
 	c.Assert(u.IsDbAdmin("db"), Equals, true)
 	c.Assert(u.GetName(), Equals, "root")
-	hash, err := HashPassword("foobar")
+	hash, err := HashPassword("foobar", 4)
 	c.Assert(err, IsNil)
 	c.Assert(u.ChangePassword(string(hash)), IsNil)
 	c.Assert(u.isValidPwd("foobar"), Equals, true)
@@ -38,9 +38,40 @@ func (self *UserSuite) TestProperties(c *C) {
 	c.Assert(dbUser.IsClusterAdmin(), Equals, false)
 	c.Assert(dbUser.IsDbAdmin("db"), Equals, true)
 	c.Assert(dbUser.GetName(), Equals, "db_user")
-	hash, err = HashPassword("password")
+	hash, err = HashPassword("password", 4)
 	c.Assert(err, IsNil)
 	c.Assert(dbUser.ChangePassword(string(hash)), IsNil)
 	c.Assert(dbUser.isValidPwd("password"), Equals, true)
 	c.Assert(dbUser.isValidPwd("password1"), Equals, false)
 }
+
+func (self *UserSuite) TestNeedsRehash(c *C) {
+	hash, err := HashPassword("password", 4)
+	c.Assert(err, IsNil)
+	u := ClusterAdmin{CommonUser{Name: "root", Hash: string(hash)}}
+	c.Assert(u.NeedsRehash(4), Equals, false)
+	c.Assert(u.NeedsRehash(5), Equals, true)
+}
+
+func (self *UserSuite) TestGrantAndRevokePermissions(c *C) {
+	dbUser := DbUser{CommonUser{Name: "db_user"}, "db", nil, nil, false}
+	c.Assert(dbUser.HasReadAccess("cpu"), Equals, false)
+	c.Assert(dbUser.HasWriteAccess("cpu"), Equals, false)
+
+	dbUser.GrantPermissions(true, false, "^cpu")
+	dbUser.GrantPermissions(true, true, "^mem")
+	dbUser.GrantPermissions(true, true, "^mem")
+	c.Assert(dbUser.ReadFrom, HasLen, 2)
+	c.Assert(dbUser.WriteTo, HasLen, 1)
+	c.Assert(dbUser.HasReadAccess("cpu"), Equals, true)
+	c.Assert(dbUser.HasWriteAccess("cpu"), Equals, false)
+	c.Assert(dbUser.HasWriteAccess("mem"), Equals, true)
+
+	dbUser.RevokePermissions(true, false, "^cpu")
+	c.Assert(dbUser.HasReadAccess("cpu"), Equals, false)
+	c.Assert(dbUser.HasReadAccess("mem"), Equals, true)
+
+	dbUser.RevokePermissions(true, true, "")
+	c.Assert(dbUser.HasReadAccess("mem"), Equals, false)
+	c.Assert(dbUser.HasWriteAccess("mem"), Equals, false)
+}
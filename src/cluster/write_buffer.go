@@ -48,6 +48,11 @@ func (self *WriteBuffer) ShardsRequestNumber() map[uint32]uint32 {
 	return self.shardLastRequestNumber
 }
 
+// Returns the number of requests waiting to be written
+func (self *WriteBuffer) Depth() int {
+	return len(self.writes)
+}
+
 func (self *WriteBuffer) HasUncommitedWrites() bool {
 	return !reflect.DeepEqual(self.shardCommitedRequestNumber, self.shardLastRequestNumber)
 }
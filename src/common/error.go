@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
@@ -23,6 +24,10 @@ func NewQueryError(code int, msg string, args ...interface{}) *QueryError {
 	return &QueryError{code, fmt.Sprintf(msg, args...)}
 }
 
+// Returned when a query stops because it was cancelled, e.g. because
+// the client disconnected or the query timed out
+var QueryCancelledError = fmt.Errorf("Query cancelled")
+
 type AuthenticationError string
 
 func (self AuthenticationError) Error() string {
@@ -52,3 +57,105 @@ func (self DatabaseExistsError) Error() string {
 func NewDatabaseExistsError(db string) DatabaseExistsError {
 	return DatabaseExistsError(fmt.Sprintf("database %s exists", db))
 }
+
+// Returned when a write is rejected because the local write buffer is
+// above its high-water mark
+type WriteBufferFullError struct {
+	Depth         int
+	HighWaterMark int
+}
+
+func (self *WriteBufferFullError) Error() string {
+	return fmt.Sprintf("the write buffer has %d requests, more than the high-water mark of %d, retry later", self.Depth, self.HighWaterMark)
+}
+
+func NewWriteBufferFullError(depth, highWaterMark int) *WriteBufferFullError {
+	return &WriteBufferFullError{depth, highWaterMark}
+}
+
+// Returned when a query can't run because the maximum number of
+// queries are running and the queue of the waiting ones is full
+type QueryQueueFullError struct {
+	MaxRunning int
+	MaxQueued  int
+}
+
+func (self *QueryQueueFullError) Error() string {
+	return fmt.Sprintf("%d queries are running and %d are queued, retry later", self.MaxRunning, self.MaxQueued)
+}
+
+func NewQueryQueueFullError(maxRunning, maxQueued int) *QueryQueueFullError {
+	return &QueryQueueFullError{maxRunning, maxQueued}
+}
+
+// Returned when a write or a query is rejected because the server is
+// draining the pending requests before it shuts down
+type ShuttingDownError struct{}
+
+func (self *ShuttingDownError) Error() string {
+	return "the server is shutting down, retry on another server"
+}
+
+func NewShuttingDownError() *ShuttingDownError {
+	return &ShuttingDownError{}
+}
+
+// Returned when a write or a query is rejected because the database or
+// the user is over their quota, Tenant is "database <name>" or
+// "user <name>"
+type QuotaExceededError struct {
+	Tenant     string
+	Limit      int
+	Unit       string
+	RetryAfter time.Duration
+}
+
+func (self *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s is over its quota of %d %s per second, retry later", self.Tenant, self.Limit, self.Unit)
+}
+
+func NewQuotaExceededError(tenant string, limit int, unit string, retryAfter time.Duration) *QuotaExceededError {
+	return &QuotaExceededError{tenant, limit, unit, retryAfter}
+}
+
+// Returned when a write didn't reach the number of replicas required
+// by the requested consistency level
+type ConsistencyError struct {
+	Level        string
+	Required     int
+	Acknowledged int
+}
+
+func (self *ConsistencyError) Error() string {
+	return fmt.Sprintf("write with consistency %s was acknowledged by %d replicas, %d required", self.Level, self.Acknowledged, self.Required)
+}
+
+func NewConsistencyError(level string, required, acknowledged int) *ConsistencyError {
+	return &ConsistencyError{level, required, acknowledged}
+}
+
+// The reason a point of a batch write couldn't be written. Series and
+// Point are the indexes of the series in the batch and of the point
+// in the series.
+type PointError struct {
+	Series  int    `json:"series"`
+	Point   int    `json:"point"`
+	Message string `json:"error"`
+}
+
+func NewPointError(series, point int, err error) *PointError {
+	return &PointError{series, point, err.Error()}
+}
+
+// Returned when some of the points of a batch write were rejected,
+// the remaining points were written
+type PartialWriteError struct {
+	Errors []*PointError
+}
+
+func (self *PartialWriteError) Error() string {
+	if len(self.Errors) == 1 {
+		return fmt.Sprintf("1 point wasn't written: %s", self.Errors[0].Message)
+	}
+	return fmt.Sprintf("%d points weren't written, first error: %s", len(self.Errors), self.Errors[0].Message)
+}
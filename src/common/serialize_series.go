@@ -19,8 +19,35 @@ const (
 	MicrosecondPrecision TimePrecision = iota
 	MillisecondPrecision
 	SecondPrecision
+	NanosecondPrecision
 )
 
+// Converts a time in the precision to microseconds
+func (self TimePrecision) ToMicroseconds(t int64) int64 {
+	switch self {
+	case NanosecondPrecision:
+		return t / 1000
+	case MillisecondPrecision:
+		return t * 1000
+	case SecondPrecision:
+		return t * 1000000
+	}
+	return t
+}
+
+// Truncates the given time in microseconds to the precision, e.g. to
+// the start of the second for SecondPrecision
+func (self TimePrecision) Truncate(microseconds int64) int64 {
+	switch self {
+	case SecondPrecision:
+		return microseconds - microseconds%1000000
+	case MillisecondPrecision:
+		return microseconds - microseconds%1000
+	default:
+		return microseconds
+	}
+}
+
 func init() {
 }
 
@@ -54,93 +81,136 @@ type ApiSeries interface {
 func ConvertToDataStoreSeries(s ApiSeries, precision TimePrecision) (*protocol.Series, error) {
 	points := make([]*protocol.Point, 0, len(s.GetPoints()))
 	for _, point := range s.GetPoints() {
-		if len(point) != len(s.GetColumns()) {
-			return nil, fmt.Errorf("invalid payload")
+		p, err := convertToDataStorePoint(s.GetColumns(), point, precision)
+		if err != nil {
+			return nil, err
 		}
+		points = append(points, p)
+	}
 
-		values := make([]*protocol.FieldValue, 0, len(point))
-		var timestamp *int64
-		var sequence *uint64
+	fields := removeTimestampFieldDefinition(s.GetColumns())
 
-		for idx, field := range s.GetColumns() {
+	series := &protocol.Series{
+		Name:   protocol.String(s.GetName()),
+		Fields: fields,
+		Points: points,
+	}
+	return series, nil
+}
 
-			value := point[idx]
-			if field == "time" {
-				switch x := value.(type) {
-				case json.Number:
-					f, err := x.Float64()
-					if err != nil {
-						return nil, err
-					}
-					_timestamp := int64(f)
-					switch precision {
-					case SecondPrecision:
-						_timestamp *= 1000
-						fallthrough
-					case MillisecondPrecision:
-						_timestamp *= 1000
-					}
+// Same as ConvertToDataStoreSeries but instead of failing on the first
+// invalid point it skips it and returns an error for each point that
+// couldn't be converted. seriesIndex is used to fill the PointErrors.
+// The returned indexes are the indexes in s of the converted points.
+func ConvertValidPointsToDataStoreSeries(s ApiSeries, seriesIndex int, precision TimePrecision) (*protocol.Series, []int, []*PointError) {
+	points := make([]*protocol.Point, 0, len(s.GetPoints()))
+	indexes := make([]int, 0, len(s.GetPoints()))
+	var pointErrors []*PointError
+	for idx, point := range s.GetPoints() {
+		p, err := convertToDataStorePoint(s.GetColumns(), point, precision)
+		if err != nil {
+			pointErrors = append(pointErrors, NewPointError(seriesIndex, idx, err))
+			continue
+		}
+		points = append(points, p)
+		indexes = append(indexes, idx)
+	}
 
-					timestamp = &_timestamp
-					continue
-				default:
-					return nil, fmt.Errorf("time field must be float but is %T (%v)", value, value)
-				}
-			}
+	fields := removeTimestampFieldDefinition(s.GetColumns())
+
+	series := &protocol.Series{
+		Name:   protocol.String(s.GetName()),
+		Fields: fields,
+		Points: points,
+	}
+	return series, indexes, pointErrors
+}
+
+func convertToDataStorePoint(columns []string, point []interface{}, precision TimePrecision) (*protocol.Point, error) {
+	if len(point) != len(columns) {
+		return nil, fmt.Errorf("invalid payload")
+	}
+
+	values := make([]*protocol.FieldValue, 0, len(point))
+	var timestamp *int64
+	var sequence *uint64
 
-			if field == "sequence_number" {
-				switch x := value.(type) {
-				case json.Number:
+	for idx, field := range columns {
+
+		value := point[idx]
+		if field == "time" {
+			switch x := value.(type) {
+			case json.Number:
+				// nanosecond timestamps don't fit in the mantissa of a
+				// float64, so try to parse integers first
+				_timestamp, err := x.Int64()
+				if err != nil {
 					f, err := x.Float64()
 					if err != nil {
 						return nil, err
 					}
-					_sequenceNumber := uint64(f)
-					sequence = &_sequenceNumber
-					continue
-				default:
-					return nil, fmt.Errorf("sequence_number field must be float but is %T (%v)", value, value)
+					_timestamp = int64(f)
+				}
+				switch precision {
+				case NanosecondPrecision:
+					_timestamp /= 1000
+				case SecondPrecision:
+					_timestamp *= 1000
+					fallthrough
+				case MillisecondPrecision:
+					_timestamp *= 1000
 				}
+
+				timestamp = &_timestamp
+				continue
+			default:
+				return nil, fmt.Errorf("time field must be float but is %T (%v)", value, value)
 			}
+		}
 
-			switch v := value.(type) {
-			case string:
-				values = append(values, &protocol.FieldValue{StringValue: &v})
+		if field == "sequence_number" {
+			switch x := value.(type) {
 			case json.Number:
-				i, err := v.Int64()
-				if err == nil {
-					values = append(values, &protocol.FieldValue{Int64Value: &i})
-					break
-				}
-				f, err := v.Float64()
+				f, err := x.Float64()
 				if err != nil {
 					return nil, err
 				}
-				values = append(values, &protocol.FieldValue{DoubleValue: &f})
-			case bool:
-				values = append(values, &protocol.FieldValue{BoolValue: &v})
-			case nil:
-				values = append(values, &protocol.FieldValue{IsNull: &TRUE})
+				_sequenceNumber := uint64(f)
+				sequence = &_sequenceNumber
+				continue
 			default:
-				// if we reached this line then the dynamic type didn't match
-				return nil, fmt.Errorf("Unknown type %T", value)
+				return nil, fmt.Errorf("sequence_number field must be float but is %T (%v)", value, value)
 			}
 		}
-		points = append(points, &protocol.Point{
-			Values:         values,
-			Timestamp:      timestamp,
-			SequenceNumber: sequence,
-		})
-	}
-
-	fields := removeTimestampFieldDefinition(s.GetColumns())
 
-	series := &protocol.Series{
-		Name:   protocol.String(s.GetName()),
-		Fields: fields,
-		Points: points,
+		switch v := value.(type) {
+		case string:
+			values = append(values, &protocol.FieldValue{StringValue: &v})
+		case json.Number:
+			i, err := v.Int64()
+			if err == nil {
+				values = append(values, &protocol.FieldValue{Int64Value: &i})
+				break
+			}
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, &protocol.FieldValue{DoubleValue: &f})
+		case bool:
+			values = append(values, &protocol.FieldValue{BoolValue: &v})
+		case nil:
+			values = append(values, &protocol.FieldValue{IsNull: &TRUE})
+		default:
+			// if we reached this line then the dynamic type didn't match
+			return nil, fmt.Errorf("Unknown type %T", value)
+		}
 	}
-	return series, nil
+	return &protocol.Point{
+		Values:         values,
+		Timestamp:      timestamp,
+		SequenceNumber: sequence,
+	}, nil
 }
 
 // takes a slice of protobuf series and convert them to the format
@@ -168,6 +238,8 @@ func SerializeSeries(memSeries map[string]*protocol.Series, precision TimePrecis
 			if t := row.Timestamp; t != nil {
 				timestamp = *row.GetTimestampInMicroseconds()
 				switch precision {
+				case NanosecondPrecision:
+					timestamp *= 1000
 				case SecondPrecision:
 					timestamp /= 1000
 					fallthrough
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"math"
+	"time"
+)
+
+// A token bucket that fills up at rate tokens per second and holds up
+// to one second worth of tokens
+type TokenBucket struct {
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func NewTokenBucket(rate int, now time.Time) *TokenBucket {
+	return &TokenBucket{float64(rate), float64(rate), now}
+}
+
+func (self *TokenBucket) Refill(now time.Time) {
+	self.tokens += now.Sub(self.lastRefill).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	self.lastRefill = now
+}
+
+// Returns how long to wait before n tokens can be taken, zero if they
+// can be taken now. Batches larger than the bucket are let through
+// once it's full and put the bucket in debt, otherwise they'd never be
+// accepted.
+func (self *TokenBucket) Wait(n float64) time.Duration {
+	needed := math.Min(n, self.rate)
+	if self.tokens >= needed {
+		return 0
+	}
+	return time.Duration((needed - self.tokens) / self.rate * float64(time.Second))
+}
+
+func (self *TokenBucket) Take(n float64) {
+	self.tokens -= n
+}
+
+// Puts back n tokens taken but not used, the bucket doesn't fill up
+// past one second worth of tokens
+func (self *TokenBucket) Return(n float64) {
+	self.tokens = math.Min(self.tokens+n, self.rate)
+}
+
+func (self *TokenBucket) LastRefill() time.Time {
+	return self.lastRefill
+}
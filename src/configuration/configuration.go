@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -17,7 +20,8 @@ import (
 type Size int
 
 const (
-	ONE_MEGABYTE int64 = 1024 * 1024
+	ONE_KILOBYTE int64 = 1024
+	ONE_MEGABYTE       = 1024 * ONE_KILOBYTE
 	ONE_GIGABYTE       = 1024 * ONE_MEGABYTE
 	// Maximum integer representable by a word (32bit or 64bit depending
 	// on the architecture)
@@ -32,6 +36,8 @@ func (d *Size) UnmarshalText(text []byte) error {
 		return err
 	}
 	switch suffix := text[len(text)-1]; suffix {
+	case 'k':
+		size *= ONE_KILOBYTE
 	case 'm':
 		size *= ONE_MEGABYTE
 	case 'g':
@@ -59,9 +65,40 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return err
 }
 
+// A daily time window, like "02:00-05:00", in local time. The window
+// wraps around midnight if it ends before it starts.
+type timeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (w *timeWindow) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		return nil
+	}
+	times := strings.Split(string(text), "-")
+	if len(times) != 2 {
+		return fmt.Errorf("Invalid time window %s, it should look like 02:00-05:00", text)
+	}
+	offsets := make([]time.Duration, 2)
+	for i, t := range times {
+		parsed, err := time.Parse("15:04", strings.TrimSpace(t))
+		if err != nil {
+			return fmt.Errorf("Invalid time window %s, it should look like 02:00-05:00", text)
+		}
+		offsets[i] = time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute
+	}
+	w.Start, w.End = offsets[0], offsets[1]
+	return nil
+}
+
 type AdminConfig struct {
 	Port   int
 	Assets string
+	// only cluster admins can load the admin site if set
+	AuthEnabled bool `toml:"auth-enabled"`
+	// overrides the bind-address of the server for the admin site
+	BindAddress string `toml:"bind-address"`
 }
 
 type ApiConfig struct {
@@ -69,47 +106,204 @@ type ApiConfig struct {
 	SslCertPath string `toml:"ssl-cert"`
 	Port        int
 	ReadTimeout duration `toml:"read-timeout"`
+	// overrides the global bind-address for the http and https ports
+	BindAddress string `toml:"bind-address"`
+	// compression of the responses, enabled by default
+	CompressionDisabled bool `toml:"compression-disabled"`
+	CompressionMinSize  int  `toml:"compression-min-size"`
+	// origins allowed to make cross origin requests, defaults to any
+	AllowedOrigins []string `toml:"allowed-origins"`
+	// points per second that can be written, unlimited if not set
+	WriteRateLimit          int `toml:"write-rate-limit"`
+	WriteRateLimitPerClient int `toml:"write-rate-limit-per-client"`
+	// the maximum number of points of a buffered query response
+	MaxQueryPoints int `toml:"max-query-points"`
+	// return the series queried that have no points in range
+	EmptySeries bool `toml:"empty-series"`
+	// the bcrypt cost of the password hashes
+	PasswordHashCost int `toml:"password-hash-cost"`
+	// how long the bearer tokens are valid
+	TokenTtl duration `toml:"token-ttl"`
+	// the writes buffered for each live query subscription
+	SubscriptionBufferSize int `toml:"subscription-buffer-size"`
 }
 
 type GraphiteConfig struct {
-	Enabled    bool
-	Port       int
-	Database   string
-	UdpEnabled bool `toml:"udp_enabled"`
+	Enabled     bool
+	Port        int
+	BindAddress string `toml:"bind-address"`
+	Database    string
+	UdpEnabled  bool `toml:"udp_enabled"`
+	// "[filter ]template" definitions used to parse the metric names
+	Templates []string
+	// plaintext or pickle
+	Protocol string
+	// the separator of the parts of the metric names and templates and
+	// the delimiter of the key and value of the tags in the names
+	Separator    string
+	TagDelimiter string `toml:"tag-delimiter"`
+	// the metrics are written in batches of batch-size or every
+	// batch-timeout, whichever comes first
+	BatchSize    int      `toml:"batch-size"`
+	BatchTimeout duration `toml:"batch-timeout"`
+	// the lines longer than max-line-length bytes and the pickle frames
+	// of more than max-points-per-frame metrics are dropped
+	MaxLineLength     int `toml:"max-line-length"`
+	MaxPointsPerFrame int `toml:"max-points-per-frame"`
 }
 
 type UdpInputConfig struct {
-	Enabled  bool
-	Port     int
-	Database string
+	Enabled     bool
+	Port        int
+	BindAddress string `toml:"bind-address"`
+	Database    string
+	// the format of the packets, json or line
+	Format string
+	// the size of the socket receive buffer in bytes and the number
+	// of packets that can be queued before they're dropped
+	ReadBufferSize int `toml:"read-buffer-size"`
+	QueueSize      int `toml:"queue-size"`
+	// take the database from the packets, either from the database
+	// key of json series or from the series name prefix before
+	// database-separator
+	DatabaseFromPayload bool   `toml:"database-from-payload"`
+	DatabaseSeparator   string `toml:"database-separator"`
+	// the points are written in batches of batch-size or every
+	// batch-timeout, whichever comes first
+	BatchSize    int      `toml:"batch-size"`
+	BatchTimeout duration `toml:"batch-timeout"`
+	// the packets larger than max-packet-size bytes or with more than
+	// max-points-per-packet points are dropped
+	MaxPacketSize      int `toml:"max-packet-size"`
+	MaxPointsPerPacket int `toml:"max-points-per-packet"`
 }
 
+// The raft election timeout has to be at least this many heartbeat
+// intervals
+const MIN_RAFT_HEARTBEATS_PER_ELECTION_TIMEOUT = 4
+
 type RaftConfig struct {
-	Port    int
-	Dir     string
-	Timeout duration `toml:"election-timeout"`
+	Port        int
+	BindAddress string `toml:"bind-address"`
+	Dir         string
+	Timeout     duration `toml:"election-timeout"`
+	// how often the leader sends heartbeats to the followers
+	HeartbeatInterval duration `toml:"heartbeat-interval"`
+	// the certificate, key and certificate authority used to encrypt
+	// and authenticate the raft connections between the servers
+	SslCert string `toml:"ssl-cert"`
+	SslKey  string `toml:"ssl-key"`
+	SslCa   string `toml:"ssl-ca"`
+	// the raft log is compacted into a snapshot of the cluster
+	// configuration every snapshot-interval, or sooner once it's bigger
+	// than snapshot-log-size or has more than snapshot-log-entries
+	SnapshotInterval   duration `toml:"snapshot-interval"`
+	SnapshotLogSize    Size     `toml:"snapshot-log-size"`
+	SnapshotLogEntries int      `toml:"snapshot-log-entries"`
 }
 
 type StorageConfig struct {
-	Dir             string
+	Dir string
+	// where the shards are stored, a directory under dir if it's not
+	// set
+	ShardDir        string `toml:"shard-dir"`
 	DefaultEngine   string `toml:"default-engine"`
 	WriteBufferSize int    `toml:"write-buffer-size"`
-	MaxOpenShards   int    `toml:"max-open-shards"`
-	PointBatchSize  int    `toml:"point-batch-size"`
-	WriteBatchSize  int    `toml:"write-batch-size"`
-	Engines         map[string]toml.Primitive
+	// writes are rejected while more requests than this are buffered,
+	// never if it's not set
+	WriteBufferHighWaterMark int `toml:"write-buffer-high-water-mark"`
+	MaxOpenShards            int `toml:"max-open-shards"`
+	PointBatchSize           int `toml:"point-batch-size"`
+	WriteBatchSize           int `toml:"write-batch-size"`
+	Engines                  map[string]toml.Primitive
+	// how often data older than the retention policies is dropped
+	RetentionSweepInterval duration `toml:"retention-sweep-interval"`
+	// the size of the cache of the points read from the shards, 0
+	// disables it, and the length of the time windows it caches
+	ReadCacheSize   Size     `toml:"read-cache-size"`
+	ReadCacheWindow duration `toml:"read-cache-window"`
+	// the columns whose string values are indexed to the series that
+	// have them
+	IndexedColumns []string `toml:"indexed-columns"`
+	// what's done with the values whose type isn't the type of their
+	// column, store, coerce or reject
+	FieldTypeMismatch string `toml:"field-type-mismatch"`
+	// how often the local shards are compacted, never if it's not set,
+	// and the time of the day the compactions can run at
+	CompactionInterval duration   `toml:"compaction-interval"`
+	CompactionWindow   timeWindow `toml:"compaction-window"`
+	// how often the points and series of the local shards are counted
+	ShardStatsInterval duration `toml:"shard-stats-interval"`
 }
 
 type ClusterConfig struct {
 	SeedServers               []string `toml:"seed-servers"`
 	ProtobufPort              int      `toml:"protobuf_port"`
+	ProtobufBindAddress       string   `toml:"protobuf-bind-address"`
 	ProtobufTimeout           duration `toml:"protobuf_timeout"`
 	ProtobufHeartbeatInterval duration `toml:"protobuf_heartbeat"`
 	MinBackoff                duration `toml:"protobuf_min_backoff"`
 	MaxBackoff                duration `toml:"protobuf_max_backoff"`
-	WriteBufferSize           int      `toml:"write-buffer-size"`
-	ConcurrentShardQueryLimit int      `toml:"concurrent-shard-query-limit"`
-	MaxResponseBufferSize     int      `toml:"max-response-buffer-size"`
+	// the connections opened to each server and their timeouts, the
+	// dial and write timeouts default to protobuf_timeout. The read
+	// timeout defaults to 30s and the health checks to every 10s, a
+	// negative value disables them.
+	ProtobufConnectionsPerServer int      `toml:"protobuf-connections-per-server"`
+	ProtobufDialTimeout          duration `toml:"protobuf-dial-timeout"`
+	ProtobufReadTimeout          duration `toml:"protobuf-read-timeout"`
+	ProtobufWriteTimeout         duration `toml:"protobuf-write-timeout"`
+	ProtobufHealthCheckInterval  duration `toml:"protobuf-health-check-interval"`
+	// a warning is logged when the heartbeats show the clock of a server
+	// is more than clock-skew-threshold off the local one, the points
+	// more than write-max-future ahead of the local clock or more than
+	// write-max-age behind it are rejected
+	ClockSkewThreshold duration `toml:"clock-skew-threshold"`
+	WriteMaxFuture     duration `toml:"write-max-future"`
+	WriteMaxAge        duration `toml:"write-max-age"`
+	// the certificate, key and certificate authority used to encrypt
+	// and authenticate the protobuf connections between the servers
+	ProtobufSslCert           string `toml:"protobuf-ssl-cert"`
+	ProtobufSslKey            string `toml:"protobuf-ssl-key"`
+	ProtobufSslCa             string `toml:"protobuf-ssl-ca"`
+	WriteBufferSize           int    `toml:"write-buffer-size"`
+	ConcurrentShardQueryLimit int    `toml:"concurrent-shard-query-limit"`
+	// the number of local shards read ahead by queries that can't be
+	// sent to all the shards at once
+	ConcurrentLocalShardQueryLimit int      `toml:"concurrent-local-shard-query-limit"`
+	MaxResponseBufferSize          int      `toml:"max-response-buffer-size"`
+	QueryTimeout                   duration `toml:"query-timeout"`
+	QueryJobTtl                    duration `toml:"query-job-ttl"`
+	// the queries running at once, the others wait in a queue of at
+	// most max-queued-queries
+	MaxConcurrentQueries int `toml:"max-concurrent-queries"`
+	MaxQueuedQueries     int `toml:"max-queued-queries"`
+	// the queries running longer than the threshold are logged to the
+	// file, the last slow-query-log-size of them are kept in memory
+	SlowQueryThreshold duration `toml:"slow-query-threshold"`
+	SlowQueryLogFile   string   `toml:"slow-query-log-file"`
+	SlowQueryLogSize   int      `toml:"slow-query-log-size"`
+	// the results of query-cache-size queries over time ranges older
+	// than write-max-age are kept for query-cache-ttl, the results of
+	// more than query-cache-max-points points aren't
+	QueryCacheSize      int      `toml:"query-cache-size"`
+	QueryCacheTtl       duration `toml:"query-cache-ttl"`
+	QueryCacheMaxPoints int      `toml:"query-cache-max-points"`
+	// how far back continuous queries are backfilled at most
+	ContinuousQueryMaxBackfill duration `toml:"continuous-query-max-backfill"`
+	// the number of values sampled per bucket by percentile() and median()
+	PercentileSampleSize int `toml:"percentile-sample-size"`
+	// the number of distinct values distinct() keeps per bucket
+	DistinctValuesLimit int `toml:"distinct-values-limit"`
+	// how often the local shards are compared with their replicas
+	AntiEntropyInterval duration `toml:"anti-entropy-interval"`
+	// the time range covered by each checksum of a shard
+	AntiEntropyWindow duration `toml:"anti-entropy-window"`
+	// the number of points read per second when comparing shards
+	AntiEntropyMaxPointsPerSecond int `toml:"anti-entropy-max-points-per-second"`
+	// how long a repair waits for the next response of a replica
+	AntiEntropyTimeout duration `toml:"anti-entropy-timeout"`
+	// how long the repairs remember the deletes that ran on a shard
+	AntiEntropyDeleteTtl duration `toml:"anti-entropy-delete-ttl"`
 }
 
 type LevelDbConfiguration struct {
@@ -123,15 +317,32 @@ type LevelDbConfiguration struct {
 	WriteBatchSize int `toml:"write-batch-size"`
 }
 
+const (
+	LogFormatText = "text"
+	// one json object per line with the time, level, source and message
+	LogFormatJson = "json"
+)
+
 type LoggingConfig struct {
 	File  string
 	Level string
+	// text or json lines
+	Format string
+	// the log file is rotated daily, and once it's this big if it's set
+	MaxFileSize Size `toml:"max-file-size"`
+	// the number of rotated log files that are kept, all of them if it's
+	// not set
+	MaxFiles int `toml:"max-files"`
 }
 
 type ShardingDefinition struct {
 	ReplicationFactor int                `toml:"replication-factor"`
 	ShortTerm         ShardConfiguration `toml:"short-term"`
 	LongTerm          ShardConfiguration `toml:"long-term"`
+	// the next shards are created once the latest ones end within
+	// pre-create-window, which is checked every pre-create-interval
+	PreCreateWindow   duration `toml:"pre-create-window"`
+	PreCreateInterval duration `toml:"pre-create-interval"`
 }
 
 type ShardConfiguration struct {
@@ -181,12 +392,47 @@ func (self *ShardConfiguration) SplitRegex() *regexp.Regexp {
 	return self.splitRandomRegex
 }
 
+const (
+	// fsync after flush-after writes or flush-interval, whichever
+	// comes first
+	WalFlushBatch = "batch"
+	// fsync after every write
+	WalFlushSync = "sync"
+	// leave the flushing to the os, the log files are only synced when
+	// they're rotated and when the wal is closed
+	WalFlushAsync = "async"
+)
+
 type WalConfig struct {
-	Dir                   string `toml:"dir"`
-	FlushAfterRequests    int    `toml:"flush-after"`
-	BookmarkAfterRequests int    `toml:"bookmark-after"`
-	IndexAfterRequests    int    `toml:"index-after"`
-	RequestsPerLogFile    int    `toml:"requests-per-log-file"`
+	Dir                   string   `toml:"dir"`
+	FlushAfterRequests    int      `toml:"flush-after"`
+	FlushInterval         duration `toml:"flush-interval"`
+	FlushMode             string   `toml:"flush-mode"`
+	BookmarkAfterRequests int      `toml:"bookmark-after"`
+	IndexAfterRequests    int      `toml:"index-after"`
+	RequestsPerLogFile    int      `toml:"requests-per-log-file"`
+	// the number of requests kept for servers that are down
+	MaxPendingRequests int `toml:"max-pending-requests-per-server"`
+	// gzip the log files once they're rotated
+	CompressLogFiles bool `toml:"compress-log-files"`
+	// the log file is also rotated once it reaches this size
+	MaxLogFileSize Size `toml:"max-log-file-size"`
+}
+
+// The points per second a database or a user can write and the queries
+// per second they can run, zero doesn't limit them
+type Quota struct {
+	PointsPerSecond  int `toml:"points-per-second"`
+	QueriesPerSecond int `toml:"queries-per-second"`
+}
+
+type QuotasConfig struct {
+	// the quotas of the databases and the users that don't have one of
+	// their own
+	DefaultDatabase Quota            `toml:"default-database"`
+	DefaultUser     Quota            `toml:"default-user"`
+	Databases       map[string]Quota `toml:"databases"`
+	Users           map[string]Quota `toml:"users"`
 }
 
 type InputPlugins struct {
@@ -202,74 +448,180 @@ type TomlConfiguration struct {
 	Raft              RaftConfig
 	Storage           StorageConfig
 	Cluster           ClusterConfig
+	Quotas            QuotasConfig
 	Logging           LoggingConfig
 	Hostname          string
 	BindAddress       string             `toml:"bind-address"`
 	ReportingDisabled bool               `toml:"reporting-disabled"`
+	ReportingHost     string             `toml:"reporting-host"`
+	ReportingInterval duration           `toml:"reporting-interval"`
+	ReportingDatabase string             `toml:"reporting-database"`
+	ShutdownTimeout   duration           `toml:"shutdown-timeout"`
 	Sharding          ShardingDefinition `toml:"sharding"`
 	WalConfig         WalConfig          `toml:"wal"`
 	LevelDb           LevelDbConfiguration
 }
 
 type Configuration struct {
-	AdminHttpPort   int
-	AdminAssetsDir  string
-	ApiHttpSslPort  int
-	ApiHttpCertPath string
-	ApiHttpPort     int
-	ApiReadTimeout  time.Duration
-
-	GraphiteEnabled    bool
-	GraphitePort       int
-	GraphiteDatabase   string
-	GraphiteUdpEnabled bool
+	// the file this configuration was loaded from, used to reload the
+	// configuration at runtime
+	FileName string
+
+	AdminHttpPort    int
+	AdminAssetsDir   string
+	AdminAuthEnabled bool
+	AdminBindAddress string
+	ApiHttpSslPort   int
+	ApiHttpCertPath  string
+	ApiHttpPort      int
+	ApiBindAddress   string
+	ApiReadTimeout   time.Duration
+
+	ApiCompressionDisabled     bool
+	ApiCompressionMinSize      int
+	ApiAllowedOrigins          []string
+	ApiWriteRateLimit          int
+	ApiWriteRateLimitPerClient int
+	ApiMaxQueryPoints          int
+	ApiEmptySeries             bool
+	PasswordHashCost           int
+	ApiTokenTtl                time.Duration
+	ApiSubscriptionBufferSize  int
+
+	GraphiteEnabled      bool
+	GraphitePort         int
+	GraphiteBindAddress  string
+	GraphiteDatabase     string
+	GraphiteUdpEnabled   bool
+	GraphiteTemplates    []string
+	GraphiteProtocol     string
+	GraphiteSeparator    string
+	GraphiteTagDelimiter string
+	GraphiteBatchSize    int
+	GraphiteBatchTimeout time.Duration
+	// the longest plaintext line and the most metrics of a pickle frame
+	GraphiteMaxLineLength     int
+	GraphiteMaxPointsPerFrame int
 
 	UdpServers []UdpInputConfig
 
-	StorageDefaultEngine  string
-	StorageMaxOpenShards  int
-	StoragePointBatchSize int
-	StorageWriteBatchSize int
-	StorageEngineConfigs  map[string]toml.Primitive
+	StorageDefaultEngine   string
+	StorageMaxOpenShards   int
+	StoragePointBatchSize  int
+	StorageWriteBatchSize  int
+	StorageEngineConfigs   map[string]toml.Primitive
+	RetentionSweepInterval time.Duration
+	StorageReadCacheSize   int
+	StorageReadCacheWindow time.Duration
+	StorageIndexedColumns  []string
+	// store, coerce or reject
+	StorageFieldTypeMismatch string
+
+	// the compaction window is the time since midnight it starts and
+	// ends at, the compactions can run all day if they're equal
+	StorageCompactionInterval    time.Duration
+	StorageCompactionWindowStart time.Duration
+	StorageCompactionWindowEnd   time.Duration
+	StorageShardStatsInterval    time.Duration
 
 	// TODO: this is for backward compatability only
 	LevelDbMaxOpenFiles int
 	LevelDbLruCacheSize int
 
-	RaftServerPort               int
-	RaftTimeout                  duration
-	SeedServers                  []string
-	DataDir                      string
-	RaftDir                      string
-	ProtobufPort                 int
-	ProtobufTimeout              duration
-	ProtobufHeartbeatInterval    duration
-	ProtobufMinBackoff           duration
-	ProtobufMaxBackoff           duration
-	Hostname                     string
-	LogFile                      string
-	LogLevel                     string
-	BindAddress                  string
-	ShortTermShard               *ShardConfiguration
-	LongTermShard                *ShardConfiguration
-	ReplicationFactor            int
-	WalDir                       string
-	WalFlushAfterRequests        int
-	WalBookmarkAfterRequests     int
-	WalIndexAfterRequests        int
-	WalRequestsPerLogFile        int
-	LocalStoreWriteBufferSize    int
-	PerServerWriteBufferSize     int
-	ClusterMaxResponseBufferSize int
-	ConcurrentShardQueryLimit    int
-	ReportingDisabled            bool
-	Version                      string
-	InfluxDBVersion              string
+	RaftServerPort                 int
+	RaftBindAddress                string
+	RaftTimeout                    duration
+	RaftHeartbeatInterval          time.Duration
+	RaftSslCertPath                string
+	RaftSslKeyPath                 string
+	RaftSslCaPath                  string
+	SeedServers                    []string
+	DataDir                        string
+	ShardDir                       string
+	RaftDir                        string
+	RaftSnapshotInterval           time.Duration
+	RaftSnapshotLogSize            int
+	RaftSnapshotLogEntries         int
+	ProtobufPort                   int
+	ProtobufBindAddress            string
+	ProtobufTimeout                duration
+	ProtobufHeartbeatInterval      duration
+	ProtobufMinBackoff             duration
+	ProtobufMaxBackoff             duration
+	ProtobufConnectionsPerServer   int
+	ProtobufDialTimeout            time.Duration
+	ProtobufReadTimeout            time.Duration
+	ProtobufWriteTimeout           time.Duration
+	ProtobufHealthCheckInterval    time.Duration
+	ProtobufSslCertPath            string
+	ProtobufSslKeyPath             string
+	ProtobufSslCaPath              string
+	Hostname                       string
+	LogFile                        string
+	LogLevel                       string
+	LogFormat                      string
+	LogMaxFileSize                 int
+	LogMaxFiles                    int
+	BindAddress                    string
+	ShortTermShard                 *ShardConfiguration
+	LongTermShard                  *ShardConfiguration
+	ReplicationFactor              int
+	ShardPreCreateWindow           time.Duration
+	ShardPreCreateInterval         time.Duration
+	WalDir                         string
+	WalFlushAfterRequests          int
+	WalFlushInterval               time.Duration
+	WalFlushMode                   string
+	WalCompressLogFiles            bool
+	WalBookmarkAfterRequests       int
+	WalIndexAfterRequests          int
+	WalRequestsPerLogFile          int
+	WalMaxLogFileSize              int
+	WalMaxPendingRequests          int
+	LocalStoreWriteBufferSize      int
+	WriteBufferHighWaterMark       int
+	PerServerWriteBufferSize       int
+	ClusterMaxResponseBufferSize   int
+	ConcurrentShardQueryLimit      int
+	ConcurrentLocalShardQueryLimit int
+	QueryTimeout                   time.Duration
+	MaxConcurrentQueries           int
+	MaxQueuedQueries               int
+	SlowQueryThreshold             time.Duration
+	SlowQueryLogFile               string
+	SlowQueryLogSize               int
+	QueryCacheSize                 int
+	QueryCacheTtl                  time.Duration
+	QueryCacheMaxPoints            int
+	ClockSkewThreshold             time.Duration
+	WriteMaxFuture                 time.Duration
+	WriteMaxAge                    time.Duration
+	QueryJobTtl                    time.Duration
+	ContinuousQueryMaxBackfill     time.Duration
+	PercentileSampleSize           int
+	DistinctValuesLimit            int
+	AntiEntropyInterval            time.Duration
+	AntiEntropyWindow              time.Duration
+	AntiEntropyMaxPointsPerSecond  int
+	AntiEntropyTimeout             time.Duration
+	AntiEntropyDeleteTtl           time.Duration
+	DefaultDatabaseQuota           Quota
+	DefaultUserQuota               Quota
+	DatabaseQuotas                 map[string]Quota
+	UserQuotas                     map[string]Quota
+	ReportingDisabled              bool
+	ReportingHost                  string
+	ReportingInterval              time.Duration
+	ReportingDatabase              string
+	ShutdownTimeout                time.Duration
+	Version                        string
+	InfluxDBVersion                string
+	InfluxDBCommit                 string
 }
 
 func LoadConfiguration(fileName string) *Configuration {
 	log.Info("Loading configuration file %s", fileName)
-	config, err := parseTomlConfiguration(fileName)
+	config, err := ParseConfiguration(fileName)
 	if err != nil {
 		log.Error("Couldn't parse configuration file: " + fileName)
 		panic(err)
@@ -277,6 +629,17 @@ func LoadConfiguration(fileName string) *Configuration {
 	return config
 }
 
+// Same as LoadConfiguration but returns the error instead of
+// panicing, used when the configuration is reloaded at runtime
+func ParseConfiguration(fileName string) (*Configuration, error) {
+	config, err := parseTomlConfiguration(fileName)
+	if err != nil {
+		return nil, err
+	}
+	config.FileName = fileName
+	return config, nil
+}
+
 func parseTomlConfiguration(filename string) (*Configuration, error) {
 	body, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -287,6 +650,9 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := applyEnvironment(tomlConfiguration, os.Getenv); err != nil {
+		return nil, err
+	}
 	err = tomlConfiguration.Sharding.LongTerm.ParseAndValidate(time.Hour * 24 * 30)
 	if err != nil {
 		return nil, err
@@ -335,10 +701,72 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		defaultConcurrentShardQueryLimit = tomlConfiguration.Cluster.ConcurrentShardQueryLimit
 	}
 
+	if tomlConfiguration.Cluster.ConcurrentLocalShardQueryLimit == 0 {
+		tomlConfiguration.Cluster.ConcurrentLocalShardQueryLimit = 4
+	}
+
+	if tomlConfiguration.Cluster.AntiEntropyWindow.Duration <= 0 {
+		tomlConfiguration.Cluster.AntiEntropyWindow = duration{time.Hour}
+	}
+
+	if tomlConfiguration.Cluster.AntiEntropyTimeout.Duration == 0 {
+		tomlConfiguration.Cluster.AntiEntropyTimeout = duration{time.Hour}
+	}
+
+	if tomlConfiguration.Cluster.AntiEntropyDeleteTtl.Duration <= 0 {
+		tomlConfiguration.Cluster.AntiEntropyDeleteTtl = duration{7 * 24 * time.Hour}
+	}
+
 	if tomlConfiguration.Raft.Timeout.Duration == 0 {
 		tomlConfiguration.Raft.Timeout = duration{time.Second}
 	}
 
+	if tomlConfiguration.Raft.HeartbeatInterval.Duration == 0 {
+		tomlConfiguration.Raft.HeartbeatInterval = duration{50 * time.Millisecond}
+	}
+
+	// the followers would start elections between two heartbeats
+	if tomlConfiguration.Raft.Timeout.Duration < MIN_RAFT_HEARTBEATS_PER_ELECTION_TIMEOUT*tomlConfiguration.Raft.HeartbeatInterval.Duration {
+		return nil, fmt.Errorf("The raft election-timeout %s should be at least %d times the heartbeat-interval %s",
+			tomlConfiguration.Raft.Timeout.Duration, MIN_RAFT_HEARTBEATS_PER_ELECTION_TIMEOUT, tomlConfiguration.Raft.HeartbeatInterval.Duration)
+	}
+
+	if tomlConfiguration.Raft.SnapshotInterval.Duration == 0 {
+		tomlConfiguration.Raft.SnapshotInterval = duration{24 * time.Hour}
+	}
+
+	if tomlConfiguration.Raft.SnapshotLogSize == 0 {
+		tomlConfiguration.Raft.SnapshotLogSize = Size(10 * ONE_MEGABYTE)
+	}
+
+	if tomlConfiguration.Raft.SnapshotLogEntries == 0 {
+		tomlConfiguration.Raft.SnapshotLogEntries = 10000
+	}
+
+	switch tomlConfiguration.Logging.Format {
+	case "":
+		tomlConfiguration.Logging.Format = LogFormatText
+	case LogFormatText, LogFormatJson:
+	default:
+		return nil, fmt.Errorf("Unknown log format %s, valid formats are text and json", tomlConfiguration.Logging.Format)
+	}
+
+	switch tomlConfiguration.WalConfig.FlushMode {
+	case "":
+		tomlConfiguration.WalConfig.FlushMode = WalFlushBatch
+	case WalFlushBatch, WalFlushSync, WalFlushAsync:
+	default:
+		return nil, fmt.Errorf("Unknown wal flush mode %s", tomlConfiguration.WalConfig.FlushMode)
+	}
+
+	if tomlConfiguration.HttpApi.PasswordHashCost == 0 {
+		tomlConfiguration.HttpApi.PasswordHashCost = 10
+	}
+
+	if tomlConfiguration.HttpApi.SubscriptionBufferSize == 0 {
+		tomlConfiguration.HttpApi.SubscriptionBufferSize = 1000
+	}
+
 	apiReadTimeout := tomlConfiguration.HttpApi.ReadTimeout.Duration
 	if apiReadTimeout == 0 {
 		apiReadTimeout = 5 * time.Second
@@ -356,18 +784,105 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		tomlConfiguration.Cluster.ProtobufHeartbeatInterval = duration{10 * time.Millisecond}
 	}
 
+	// a negative read timeout or health check interval disables them
+	if tomlConfiguration.Cluster.ProtobufReadTimeout.Duration == 0 {
+		tomlConfiguration.Cluster.ProtobufReadTimeout = duration{30 * time.Second}
+	} else if tomlConfiguration.Cluster.ProtobufReadTimeout.Duration < 0 {
+		tomlConfiguration.Cluster.ProtobufReadTimeout = duration{0}
+	}
+
+	if tomlConfiguration.Cluster.ProtobufHealthCheckInterval.Duration == 0 {
+		tomlConfiguration.Cluster.ProtobufHealthCheckInterval = duration{10 * time.Second}
+	} else if tomlConfiguration.Cluster.ProtobufHealthCheckInterval.Duration < 0 {
+		tomlConfiguration.Cluster.ProtobufHealthCheckInterval = duration{0}
+	}
+
+	shutdownTimeout := tomlConfiguration.ShutdownTimeout.Duration
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 10 * time.Second
+	}
+
+	if tomlConfiguration.ReportingHost == "" {
+		tomlConfiguration.ReportingHost = "m.influxdb.com:8086"
+	}
+
+	if tomlConfiguration.Storage.ShardStatsInterval.Duration == 0 {
+		tomlConfiguration.Storage.ShardStatsInterval = duration{time.Hour}
+	}
+
+	if tomlConfiguration.Storage.FieldTypeMismatch == "" {
+		tomlConfiguration.Storage.FieldTypeMismatch = "store"
+	}
+
+	if tomlConfiguration.Storage.ReadCacheWindow.Duration == 0 {
+		tomlConfiguration.Storage.ReadCacheWindow = duration{10 * time.Minute}
+	}
+
+	if tomlConfiguration.Storage.RetentionSweepInterval.Duration == 0 {
+		tomlConfiguration.Storage.RetentionSweepInterval = duration{10 * time.Minute}
+	}
+
+	if tomlConfiguration.Cluster.SlowQueryLogSize == 0 {
+		tomlConfiguration.Cluster.SlowQueryLogSize = 100
+	}
+	if tomlConfiguration.Cluster.QueryCacheTtl.Duration == 0 {
+		tomlConfiguration.Cluster.QueryCacheTtl = duration{10 * time.Minute}
+	}
+	if tomlConfiguration.Cluster.QueryCacheMaxPoints == 0 {
+		tomlConfiguration.Cluster.QueryCacheMaxPoints = 100000
+	}
+	if tomlConfiguration.Cluster.ClockSkewThreshold.Duration == 0 {
+		tomlConfiguration.Cluster.ClockSkewThreshold = duration{time.Second}
+	}
+
+	if tomlConfiguration.Cluster.QueryJobTtl.Duration == 0 {
+		tomlConfiguration.Cluster.QueryJobTtl = duration{time.Hour}
+	}
+
+	if tomlConfiguration.ReportingInterval.Duration == 0 {
+		tomlConfiguration.ReportingInterval = duration{24 * time.Hour}
+	}
+
+	if tomlConfiguration.ReportingDatabase == "" {
+		tomlConfiguration.ReportingDatabase = "reporting"
+	}
+
 	config := &Configuration{
-		AdminHttpPort:   tomlConfiguration.Admin.Port,
-		AdminAssetsDir:  tomlConfiguration.Admin.Assets,
-		ApiHttpPort:     tomlConfiguration.HttpApi.Port,
-		ApiHttpCertPath: tomlConfiguration.HttpApi.SslCertPath,
-		ApiHttpSslPort:  tomlConfiguration.HttpApi.SslPort,
-		ApiReadTimeout:  apiReadTimeout,
-
-		GraphiteEnabled:    tomlConfiguration.InputPlugins.Graphite.Enabled,
-		GraphitePort:       tomlConfiguration.InputPlugins.Graphite.Port,
-		GraphiteDatabase:   tomlConfiguration.InputPlugins.Graphite.Database,
-		GraphiteUdpEnabled: tomlConfiguration.InputPlugins.Graphite.UdpEnabled,
+		AdminHttpPort:    tomlConfiguration.Admin.Port,
+		AdminAssetsDir:   tomlConfiguration.Admin.Assets,
+		AdminAuthEnabled: tomlConfiguration.Admin.AuthEnabled,
+		AdminBindAddress: tomlConfiguration.Admin.BindAddress,
+		ApiHttpPort:      tomlConfiguration.HttpApi.Port,
+		ApiBindAddress:   tomlConfiguration.HttpApi.BindAddress,
+		ApiHttpCertPath:  tomlConfiguration.HttpApi.SslCertPath,
+		ApiHttpSslPort:   tomlConfiguration.HttpApi.SslPort,
+		ApiReadTimeout:   apiReadTimeout,
+
+		ApiCompressionDisabled:     tomlConfiguration.HttpApi.CompressionDisabled,
+		ApiCompressionMinSize:      tomlConfiguration.HttpApi.CompressionMinSize,
+		ApiAllowedOrigins:          tomlConfiguration.HttpApi.AllowedOrigins,
+		ApiWriteRateLimit:          tomlConfiguration.HttpApi.WriteRateLimit,
+		ApiWriteRateLimitPerClient: tomlConfiguration.HttpApi.WriteRateLimitPerClient,
+		ApiMaxQueryPoints:          tomlConfiguration.HttpApi.MaxQueryPoints,
+		ApiEmptySeries:             tomlConfiguration.HttpApi.EmptySeries,
+		PasswordHashCost:           tomlConfiguration.HttpApi.PasswordHashCost,
+		ApiTokenTtl:                tomlConfiguration.HttpApi.TokenTtl.Duration,
+		ApiSubscriptionBufferSize:  tomlConfiguration.HttpApi.SubscriptionBufferSize,
+
+		GraphiteEnabled:      tomlConfiguration.InputPlugins.Graphite.Enabled,
+		GraphitePort:         tomlConfiguration.InputPlugins.Graphite.Port,
+		GraphiteBindAddress:  tomlConfiguration.InputPlugins.Graphite.BindAddress,
+		GraphiteDatabase:     tomlConfiguration.InputPlugins.Graphite.Database,
+		GraphiteUdpEnabled:   tomlConfiguration.InputPlugins.Graphite.UdpEnabled,
+		GraphiteTemplates:    tomlConfiguration.InputPlugins.Graphite.Templates,
+		GraphiteProtocol:     tomlConfiguration.InputPlugins.Graphite.Protocol,
+		GraphiteSeparator:    tomlConfiguration.InputPlugins.Graphite.Separator,
+		GraphiteTagDelimiter: tomlConfiguration.InputPlugins.Graphite.TagDelimiter,
+		GraphiteBatchSize:    tomlConfiguration.InputPlugins.Graphite.BatchSize,
+		GraphiteBatchTimeout: tomlConfiguration.InputPlugins.Graphite.BatchTimeout.Duration,
+
+		GraphiteMaxLineLength:     tomlConfiguration.InputPlugins.Graphite.MaxLineLength,
+		GraphiteMaxPointsPerFrame: tomlConfiguration.InputPlugins.Graphite.MaxPointsPerFrame,
 
 		UdpServers: tomlConfiguration.InputPlugins.UdpServersInput,
 
@@ -377,43 +892,126 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		StoragePointBatchSize:     tomlConfiguration.Storage.PointBatchSize,
 		StorageWriteBatchSize:     tomlConfiguration.Storage.WriteBatchSize,
 		DataDir:                   tomlConfiguration.Storage.Dir,
+		ShardDir:                  tomlConfiguration.Storage.ShardDir,
 		LocalStoreWriteBufferSize: tomlConfiguration.Storage.WriteBufferSize,
+		WriteBufferHighWaterMark:  tomlConfiguration.Storage.WriteBufferHighWaterMark,
 		StorageEngineConfigs:      tomlConfiguration.Storage.Engines,
+		RetentionSweepInterval:    tomlConfiguration.Storage.RetentionSweepInterval.Duration,
+		StorageReadCacheSize:      int(tomlConfiguration.Storage.ReadCacheSize),
+		StorageReadCacheWindow:    tomlConfiguration.Storage.ReadCacheWindow.Duration,
+		StorageIndexedColumns:     tomlConfiguration.Storage.IndexedColumns,
+		StorageFieldTypeMismatch:  tomlConfiguration.Storage.FieldTypeMismatch,
+
+		StorageCompactionInterval:    tomlConfiguration.Storage.CompactionInterval.Duration,
+		StorageCompactionWindowStart: tomlConfiguration.Storage.CompactionWindow.Start,
+		StorageCompactionWindowEnd:   tomlConfiguration.Storage.CompactionWindow.End,
+		StorageShardStatsInterval:    tomlConfiguration.Storage.ShardStatsInterval.Duration,
 
 		LevelDbMaxOpenFiles: tomlConfiguration.LevelDb.MaxOpenFiles,
 		LevelDbLruCacheSize: int(tomlConfiguration.LevelDb.LruCacheSize),
 
-		RaftServerPort:               tomlConfiguration.Raft.Port,
-		RaftTimeout:                  tomlConfiguration.Raft.Timeout,
-		RaftDir:                      tomlConfiguration.Raft.Dir,
-		ProtobufPort:                 tomlConfiguration.Cluster.ProtobufPort,
-		ProtobufTimeout:              tomlConfiguration.Cluster.ProtobufTimeout,
-		ProtobufHeartbeatInterval:    tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
-		ProtobufMinBackoff:           tomlConfiguration.Cluster.MinBackoff,
-		ProtobufMaxBackoff:           tomlConfiguration.Cluster.MaxBackoff,
-		SeedServers:                  tomlConfiguration.Cluster.SeedServers,
-		LogFile:                      tomlConfiguration.Logging.File,
-		LogLevel:                     tomlConfiguration.Logging.Level,
-		Hostname:                     tomlConfiguration.Hostname,
-		BindAddress:                  tomlConfiguration.BindAddress,
-		ReportingDisabled:            tomlConfiguration.ReportingDisabled,
-		LongTermShard:                &tomlConfiguration.Sharding.LongTerm,
-		ShortTermShard:               &tomlConfiguration.Sharding.ShortTerm,
-		ReplicationFactor:            tomlConfiguration.Sharding.ReplicationFactor,
-		WalDir:                       tomlConfiguration.WalConfig.Dir,
-		WalFlushAfterRequests:        tomlConfiguration.WalConfig.FlushAfterRequests,
-		WalBookmarkAfterRequests:     tomlConfiguration.WalConfig.BookmarkAfterRequests,
-		WalIndexAfterRequests:        tomlConfiguration.WalConfig.IndexAfterRequests,
-		WalRequestsPerLogFile:        tomlConfiguration.WalConfig.RequestsPerLogFile,
-		PerServerWriteBufferSize:     tomlConfiguration.Cluster.WriteBufferSize,
-		ClusterMaxResponseBufferSize: tomlConfiguration.Cluster.MaxResponseBufferSize,
-		ConcurrentShardQueryLimit:    defaultConcurrentShardQueryLimit,
+		RaftServerPort:                 tomlConfiguration.Raft.Port,
+		RaftBindAddress:                tomlConfiguration.Raft.BindAddress,
+		RaftTimeout:                    tomlConfiguration.Raft.Timeout,
+		RaftHeartbeatInterval:          tomlConfiguration.Raft.HeartbeatInterval.Duration,
+		RaftSslCertPath:                tomlConfiguration.Raft.SslCert,
+		RaftSslKeyPath:                 tomlConfiguration.Raft.SslKey,
+		RaftSslCaPath:                  tomlConfiguration.Raft.SslCa,
+		RaftDir:                        tomlConfiguration.Raft.Dir,
+		RaftSnapshotInterval:           tomlConfiguration.Raft.SnapshotInterval.Duration,
+		RaftSnapshotLogSize:            int(tomlConfiguration.Raft.SnapshotLogSize),
+		RaftSnapshotLogEntries:         tomlConfiguration.Raft.SnapshotLogEntries,
+		ProtobufPort:                   tomlConfiguration.Cluster.ProtobufPort,
+		ProtobufBindAddress:            tomlConfiguration.Cluster.ProtobufBindAddress,
+		ProtobufTimeout:                tomlConfiguration.Cluster.ProtobufTimeout,
+		ProtobufHeartbeatInterval:      tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
+		ProtobufMinBackoff:             tomlConfiguration.Cluster.MinBackoff,
+		ProtobufMaxBackoff:             tomlConfiguration.Cluster.MaxBackoff,
+		ProtobufConnectionsPerServer:   tomlConfiguration.Cluster.ProtobufConnectionsPerServer,
+		ProtobufDialTimeout:            tomlConfiguration.Cluster.ProtobufDialTimeout.Duration,
+		ProtobufReadTimeout:            tomlConfiguration.Cluster.ProtobufReadTimeout.Duration,
+		ProtobufWriteTimeout:           tomlConfiguration.Cluster.ProtobufWriteTimeout.Duration,
+		ProtobufHealthCheckInterval:    tomlConfiguration.Cluster.ProtobufHealthCheckInterval.Duration,
+		ProtobufSslCertPath:            tomlConfiguration.Cluster.ProtobufSslCert,
+		ProtobufSslKeyPath:             tomlConfiguration.Cluster.ProtobufSslKey,
+		ProtobufSslCaPath:              tomlConfiguration.Cluster.ProtobufSslCa,
+		SeedServers:                    tomlConfiguration.Cluster.SeedServers,
+		LogFile:                        tomlConfiguration.Logging.File,
+		LogLevel:                       tomlConfiguration.Logging.Level,
+		LogFormat:                      tomlConfiguration.Logging.Format,
+		LogMaxFileSize:                 int(tomlConfiguration.Logging.MaxFileSize),
+		LogMaxFiles:                    tomlConfiguration.Logging.MaxFiles,
+		Hostname:                       tomlConfiguration.Hostname,
+		BindAddress:                    tomlConfiguration.BindAddress,
+		ReportingDisabled:              tomlConfiguration.ReportingDisabled,
+		ReportingHost:                  tomlConfiguration.ReportingHost,
+		ReportingInterval:              tomlConfiguration.ReportingInterval.Duration,
+		ReportingDatabase:              tomlConfiguration.ReportingDatabase,
+		ShutdownTimeout:                shutdownTimeout,
+		LongTermShard:                  &tomlConfiguration.Sharding.LongTerm,
+		ShortTermShard:                 &tomlConfiguration.Sharding.ShortTerm,
+		ReplicationFactor:              tomlConfiguration.Sharding.ReplicationFactor,
+		ShardPreCreateWindow:           tomlConfiguration.Sharding.PreCreateWindow.Duration,
+		ShardPreCreateInterval:         tomlConfiguration.Sharding.PreCreateInterval.Duration,
+		WalDir:                         tomlConfiguration.WalConfig.Dir,
+		WalFlushAfterRequests:          tomlConfiguration.WalConfig.FlushAfterRequests,
+		WalFlushInterval:               tomlConfiguration.WalConfig.FlushInterval.Duration,
+		WalFlushMode:                   tomlConfiguration.WalConfig.FlushMode,
+		WalCompressLogFiles:            tomlConfiguration.WalConfig.CompressLogFiles,
+		WalBookmarkAfterRequests:       tomlConfiguration.WalConfig.BookmarkAfterRequests,
+		WalIndexAfterRequests:          tomlConfiguration.WalConfig.IndexAfterRequests,
+		WalRequestsPerLogFile:          tomlConfiguration.WalConfig.RequestsPerLogFile,
+		WalMaxLogFileSize:              int(tomlConfiguration.WalConfig.MaxLogFileSize),
+		WalMaxPendingRequests:          tomlConfiguration.WalConfig.MaxPendingRequests,
+		PerServerWriteBufferSize:       tomlConfiguration.Cluster.WriteBufferSize,
+		ClusterMaxResponseBufferSize:   tomlConfiguration.Cluster.MaxResponseBufferSize,
+		ConcurrentShardQueryLimit:      defaultConcurrentShardQueryLimit,
+		ConcurrentLocalShardQueryLimit: tomlConfiguration.Cluster.ConcurrentLocalShardQueryLimit,
+		QueryTimeout:                   tomlConfiguration.Cluster.QueryTimeout.Duration,
+		MaxConcurrentQueries:           tomlConfiguration.Cluster.MaxConcurrentQueries,
+		MaxQueuedQueries:               tomlConfiguration.Cluster.MaxQueuedQueries,
+		SlowQueryThreshold:             tomlConfiguration.Cluster.SlowQueryThreshold.Duration,
+		SlowQueryLogFile:               tomlConfiguration.Cluster.SlowQueryLogFile,
+		SlowQueryLogSize:               tomlConfiguration.Cluster.SlowQueryLogSize,
+		QueryCacheSize:                 tomlConfiguration.Cluster.QueryCacheSize,
+		QueryCacheTtl:                  tomlConfiguration.Cluster.QueryCacheTtl.Duration,
+		QueryCacheMaxPoints:            tomlConfiguration.Cluster.QueryCacheMaxPoints,
+		ClockSkewThreshold:             tomlConfiguration.Cluster.ClockSkewThreshold.Duration,
+		WriteMaxFuture:                 tomlConfiguration.Cluster.WriteMaxFuture.Duration,
+		WriteMaxAge:                    tomlConfiguration.Cluster.WriteMaxAge.Duration,
+		QueryJobTtl:                    tomlConfiguration.Cluster.QueryJobTtl.Duration,
+		ContinuousQueryMaxBackfill:     tomlConfiguration.Cluster.ContinuousQueryMaxBackfill.Duration,
+		PercentileSampleSize:           tomlConfiguration.Cluster.PercentileSampleSize,
+		DistinctValuesLimit:            tomlConfiguration.Cluster.DistinctValuesLimit,
+		AntiEntropyInterval:            tomlConfiguration.Cluster.AntiEntropyInterval.Duration,
+		AntiEntropyWindow:              tomlConfiguration.Cluster.AntiEntropyWindow.Duration,
+		AntiEntropyMaxPointsPerSecond:  tomlConfiguration.Cluster.AntiEntropyMaxPointsPerSecond,
+		AntiEntropyTimeout:             tomlConfiguration.Cluster.AntiEntropyTimeout.Duration,
+		AntiEntropyDeleteTtl:           tomlConfiguration.Cluster.AntiEntropyDeleteTtl.Duration,
+		DefaultDatabaseQuota:           tomlConfiguration.Quotas.DefaultDatabase,
+		DefaultUserQuota:               tomlConfiguration.Quotas.DefaultUser,
+		DatabaseQuotas:                 tomlConfiguration.Quotas.Databases,
+		UserQuotas:                     tomlConfiguration.Quotas.Users,
 	}
 
 	config.UdpServers = append(config.UdpServers, UdpInputConfig{
-		Enabled:  tomlConfiguration.InputPlugins.UdpInput.Enabled,
-		Database: tomlConfiguration.InputPlugins.UdpInput.Database,
-		Port:     tomlConfiguration.InputPlugins.UdpInput.Port,
+		Enabled:     tomlConfiguration.InputPlugins.UdpInput.Enabled,
+		Database:    tomlConfiguration.InputPlugins.UdpInput.Database,
+		Port:        tomlConfiguration.InputPlugins.UdpInput.Port,
+		BindAddress: tomlConfiguration.InputPlugins.UdpInput.BindAddress,
+		Format:      tomlConfiguration.InputPlugins.UdpInput.Format,
+
+		ReadBufferSize: tomlConfiguration.InputPlugins.UdpInput.ReadBufferSize,
+		QueueSize:      tomlConfiguration.InputPlugins.UdpInput.QueueSize,
+
+		DatabaseFromPayload: tomlConfiguration.InputPlugins.UdpInput.DatabaseFromPayload,
+		DatabaseSeparator:   tomlConfiguration.InputPlugins.UdpInput.DatabaseSeparator,
+
+		BatchSize:    tomlConfiguration.InputPlugins.UdpInput.BatchSize,
+		BatchTimeout: tomlConfiguration.InputPlugins.UdpInput.BatchTimeout,
+
+		MaxPacketSize:      tomlConfiguration.InputPlugins.UdpInput.MaxPacketSize,
+		MaxPointsPerPacket: tomlConfiguration.InputPlugins.UdpInput.MaxPointsPerPacket,
 	})
 
 	if config.LocalStoreWriteBufferSize == 0 {
@@ -423,6 +1021,49 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		config.PerServerWriteBufferSize = 1000
 	}
 
+	// everything is stored under the data directory unless the wal
+	// and the shards have their own
+	if config.WalDir == "" && config.DataDir != "" {
+		config.WalDir = filepath.Join(config.DataDir, "wal")
+	}
+
+	if config.ProtobufConnectionsPerServer == 0 {
+		config.ProtobufConnectionsPerServer = 1
+	}
+	if config.ProtobufDialTimeout == 0 {
+		config.ProtobufDialTimeout = config.ProtobufTimeout.Duration
+	}
+	if config.ProtobufWriteTimeout == 0 {
+		config.ProtobufWriteTimeout = config.ProtobufTimeout.Duration
+	}
+
+	if config.ShardPreCreateWindow == 0 {
+		config.ShardPreCreateWindow = 15 * time.Minute
+	}
+	if config.ShardPreCreateInterval == 0 {
+		config.ShardPreCreateInterval = 10 * time.Minute
+	}
+
+	if config.GraphiteSeparator == "" {
+		config.GraphiteSeparator = "."
+	}
+	if config.GraphiteBatchSize == 0 {
+		config.GraphiteBatchSize = 1000
+	}
+	if config.GraphiteBatchTimeout == 0 {
+		config.GraphiteBatchTimeout = time.Second
+	}
+	if config.GraphiteMaxLineLength == 0 {
+		config.GraphiteMaxLineLength = 4096
+	}
+	if config.GraphiteMaxPointsPerFrame == 0 {
+		config.GraphiteMaxPointsPerFrame = 10000
+	}
+
+	if config.ApiAllowedOrigins == nil {
+		config.ApiAllowedOrigins = []string{"*"}
+	}
+
 	if config.ClusterMaxResponseBufferSize == 0 {
 		config.ClusterMaxResponseBufferSize = 100
 	}
@@ -448,12 +1089,53 @@ func parseJsonConfiguration(fileName string) (*Configuration, error) {
 	return config, nil
 }
 
+// Returns true if the raft connections between the servers are
+// encrypted
+func (self *Configuration) IsRaftSslEnabled() bool {
+	return self.RaftSslCertPath != "" || self.RaftSslKeyPath != "" || self.RaftSslCaPath != ""
+}
+
+// Returns true if the protobuf connections between the servers are
+// encrypted
+func (self *Configuration) IsProtobufSslEnabled() bool {
+	return self.ProtobufSslCertPath != "" || self.ProtobufSslKeyPath != "" || self.ProtobufSslCaPath != ""
+}
+
+// Returns a log filter that writes the records of the configured log
+// level and above to the writer
+func (self *Configuration) NewLogFilter(writer log.LogWriter) *log.Filter {
+	level := log.DEBUG
+	switch self.LogLevel {
+	case "info":
+		level = log.INFO
+	case "warn":
+		level = log.WARNING
+	case "error":
+		level = log.ERROR
+	}
+	return &log.Filter{Level: level, LogWriter: writer}
+}
+
 func (self *Configuration) AdminHttpPortString() string {
 	if self.AdminHttpPort <= 0 {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.AdminHttpPort)
+	return joinHostPort(self.listenAddress(self.AdminBindAddress), self.AdminHttpPort)
+}
+
+// Returns host:port, or [host]:port for the IPv6 addresses
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Returns the address a listener binds to, its own if it's set,
+// otherwise the global bind-address
+func (self *Configuration) listenAddress(bindAddress string) string {
+	if bindAddress != "" {
+		return bindAddress
+	}
+	return self.BindAddress
 }
 
 func (self *Configuration) ApiHttpPortString() string {
@@ -461,11 +1143,11 @@ func (self *Configuration) ApiHttpPortString() string {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.ApiHttpPort)
+	return joinHostPort(self.listenAddress(self.ApiBindAddress), self.ApiHttpPort)
 }
 
 func (self *Configuration) ApiHttpSslPortString() string {
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.ApiHttpSslPort)
+	return joinHostPort(self.listenAddress(self.ApiBindAddress), self.ApiHttpSslPort)
 }
 
 func (self *Configuration) GraphitePortString() string {
@@ -473,15 +1155,15 @@ func (self *Configuration) GraphitePortString() string {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.GraphitePort)
+	return joinHostPort(self.listenAddress(self.GraphiteBindAddress), self.GraphitePort)
 }
 
-func (self *Configuration) UdpInputPortString(port int) string {
-	if port <= 0 {
+func (self *Configuration) UdpInputPortString(udpInput UdpInputConfig) string {
+	if udpInput.Port <= 0 {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%d", self.BindAddress, port)
+	return joinHostPort(self.listenAddress(udpInput.BindAddress), udpInput.Port)
 }
 
 func (self *Configuration) HostnameOrDetect() string {
@@ -498,17 +1180,21 @@ func (self *Configuration) HostnameOrDetect() string {
 }
 
 func (self *Configuration) ProtobufConnectionString() string {
-	return fmt.Sprintf("%s:%d", self.HostnameOrDetect(), self.ProtobufPort)
+	return joinHostPort(self.HostnameOrDetect(), self.ProtobufPort)
 }
 
 func (self *Configuration) RaftConnectionString() string {
-	return fmt.Sprintf("http://%s:%d", self.HostnameOrDetect(), self.RaftServerPort)
+	scheme := "http"
+	if self.IsRaftSslEnabled() {
+		scheme = "https"
+	}
+	return scheme + "://" + joinHostPort(self.HostnameOrDetect(), self.RaftServerPort)
 }
 
 func (self *Configuration) ProtobufListenString() string {
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.ProtobufPort)
+	return joinHostPort(self.listenAddress(self.ProtobufBindAddress), self.ProtobufPort)
 }
 
 func (self *Configuration) RaftListenString() string {
-	return fmt.Sprintf("%s:%d", self.BindAddress, self.RaftServerPort)
+	return joinHostPort(self.listenAddress(self.RaftBindAddress), self.RaftServerPort)
 }
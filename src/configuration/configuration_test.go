@@ -1,10 +1,13 @@
 package configuration
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	log "code.google.com/p/log4go"
 	. "launchpad.net/gocheck"
 )
 
@@ -35,6 +38,12 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.GraphiteEnabled, Equals, false)
 	c.Assert(config.GraphitePort, Equals, 2003)
 	c.Assert(config.GraphiteDatabase, Equals, "")
+	c.Assert(config.GraphiteSeparator, Equals, ".")
+	c.Assert(config.GraphiteTagDelimiter, Equals, "")
+	c.Assert(config.GraphiteBatchSize, Equals, 1000)
+	c.Assert(config.GraphiteBatchTimeout, Equals, time.Second)
+	c.Assert(config.GraphiteMaxLineLength, Equals, 4096)
+	c.Assert(config.GraphiteMaxPointsPerFrame, Equals, 10000)
 
 	c.Assert(config.UdpServers, HasLen, 1)
 	c.Assert(config.UdpServers[0].Enabled, Equals, true)
@@ -43,19 +52,29 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 
 	c.Assert(config.RaftDir, Equals, "/tmp/influxdb/development/raft")
 	c.Assert(config.RaftServerPort, Equals, 8090)
+	c.Assert(config.RaftListenString(), Equals, "10.0.0.1:8090")
 	c.Assert(config.RaftTimeout.Duration, Equals, time.Second)
+	c.Assert(config.RaftHeartbeatInterval, Equals, 50*time.Millisecond)
 
 	c.Assert(config.DataDir, Equals, "/tmp/influxdb/development/db")
 
 	c.Assert(config.ProtobufPort, Equals, 8099)
+	c.Assert(config.ProtobufListenString(), Equals, ":8099")
 	c.Assert(config.ProtobufHeartbeatInterval.Duration, Equals, 200*time.Millisecond)
 	c.Assert(config.ProtobufMinBackoff.Duration, Equals, 100*time.Millisecond)
 	c.Assert(config.ProtobufMaxBackoff.Duration, Equals, time.Second)
 	c.Assert(config.ProtobufTimeout.Duration, Equals, 2*time.Second)
+	c.Assert(config.ProtobufReadTimeout, Equals, 30*time.Second)
+	c.Assert(config.ProtobufHealthCheckInterval, Equals, 10*time.Second)
+	c.Assert(config.ClockSkewThreshold, Equals, time.Second)
+	c.Assert(config.WriteMaxFuture, Equals, time.Duration(0))
+	c.Assert(config.WriteMaxAge, Equals, time.Duration(0))
 	c.Assert(config.SeedServers, DeepEquals, []string{"hosta:8090", "hostb:8090"})
 
 	c.Assert(config.WalDir, Equals, "/tmp/influxdb/development/wal")
 	c.Assert(config.WalFlushAfterRequests, Equals, 0)
+	c.Assert(config.WalFlushMode, Equals, WalFlushBatch)
+	c.Assert(config.WalFlushInterval, Equals, time.Duration(0))
 	c.Assert(config.WalBookmarkAfterRequests, Equals, 0)
 	c.Assert(config.WalIndexAfterRequests, Equals, 1000)
 	c.Assert(config.WalRequestsPerLogFile, Equals, 10000)
@@ -63,8 +82,24 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.ClusterMaxResponseBufferSize, Equals, 5)
 }
 
+func (self *LoadConfigurationSuite) TestNegativeProtobufTimeoutsDisableThem(c *C) {
+	file, err := ioutil.TempFile("", "influxdb-config")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("[cluster]\nprotobuf-read-timeout = \"-1s\"\nprotobuf-health-check-interval = \"-1s\"\n")
+	c.Assert(err, IsNil)
+	file.Close()
+
+	config, err := parseTomlConfiguration(file.Name())
+	c.Assert(err, IsNil)
+	c.Assert(config.ProtobufReadTimeout, Equals, time.Duration(0))
+	c.Assert(config.ProtobufHealthCheckInterval, Equals, time.Duration(0))
+}
+
 func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
 	var s Size
+	c.Assert(s.UnmarshalText([]byte("4k")), IsNil)
+	c.Assert(int64(s), Equals, 4*ONE_KILOBYTE)
 	c.Assert(s.UnmarshalText([]byte("200m")), IsNil)
 	c.Assert(int64(s), Equals, 200*ONE_MEGABYTE)
 	if t := reflect.TypeOf(0); t.Size() > 4 {
@@ -72,3 +107,102 @@ func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
 		c.Assert(int64(s), Equals, 10*ONE_GIGABYTE)
 	}
 }
+
+func (self *LoadConfigurationSuite) TestTimeWindowParsing(c *C) {
+	var w timeWindow
+	c.Assert(w.UnmarshalText([]byte("22:30-05:00")), IsNil)
+	c.Assert(w.Start, Equals, 22*time.Hour+30*time.Minute)
+	c.Assert(w.End, Equals, 5*time.Hour)
+	c.Assert(w.UnmarshalText([]byte("22:30")), NotNil)
+	c.Assert(w.UnmarshalText([]byte("25:00-05:00")), NotNil)
+}
+
+func (self *LoadConfigurationSuite) TestEnvironmentOverrides(c *C) {
+	environment := map[string]string{
+		"INFLUXDB_API_PORT":                       "9086",
+		"INFLUXDB_API_READ_TIMEOUT":               "10s",
+		"INFLUXDB_API_ALLOWED_ORIGINS":            "http://a.example.com, http://b.example.com",
+		"INFLUXDB_INPUT_PLUGINS_GRAPHITE_ENABLED": "true",
+		"INFLUXDB_STORAGE_DIR":                    "/var/lib/influxdb/db",
+		"INFLUXDB_RAFT_SNAPSHOT_LOG_SIZE":         "20m",
+		"INFLUXDB_BIND_ADDRESS":                   "127.0.0.1",
+	}
+	config := &TomlConfiguration{}
+	config.HttpApi.Port = 8086
+	config.Storage.Dir = "/tmp/influxdb/db"
+	err := applyEnvironment(config, func(name string) string { return environment[name] })
+	c.Assert(err, IsNil)
+	c.Assert(config.HttpApi.Port, Equals, 9086)
+	c.Assert(config.HttpApi.ReadTimeout.Duration, Equals, 10*time.Second)
+	c.Assert(config.HttpApi.AllowedOrigins, DeepEquals, []string{"http://a.example.com", "http://b.example.com"})
+	c.Assert(config.InputPlugins.Graphite.Enabled, Equals, true)
+	c.Assert(config.Storage.Dir, Equals, "/var/lib/influxdb/db")
+	c.Assert(int64(config.Raft.SnapshotLogSize), Equals, 20*ONE_MEGABYTE)
+	c.Assert(config.BindAddress, Equals, "127.0.0.1")
+
+	environment = map[string]string{"INFLUXDB_API_PORT": "http"}
+	err = applyEnvironment(&TomlConfiguration{}, func(name string) string { return environment[name] })
+	c.Assert(err, NotNil)
+}
+
+func (self *LoadConfigurationSuite) TestValidation(c *C) {
+	config := LoadConfiguration("config.toml")
+	c.Assert(config.Validate(), IsNil)
+
+	config.DataDir = ""
+	config.AdminHttpPort = config.ApiHttpSslPort
+	config.GraphiteEnabled = true
+	config.GraphitePort = 2003
+	config.GraphiteDatabase = ""
+	config.UdpServers = []UdpInputConfig{{Enabled: true, Port: 4444}, {Enabled: false}}
+	config.PasswordHashCost = 3
+	err := config.Validate()
+	c.Assert(err, NotNil)
+	problems, ok := err.(ValidationError)
+	c.Assert(ok, Equals, true)
+	c.Assert(problems, DeepEquals, ValidationError{
+		"storage.dir isn't set",
+		"api.ssl-port and admin.port are both 8087",
+		"api.password-hash-cost is 3, it has to be between 4 and 31",
+		"input_plugins.graphite.database isn't set, graphite is enabled",
+		"The udp input on port 4444 has no database and doesn't take it from the payload",
+	})
+
+	// the same port on different interfaces doesn't collide
+	config = LoadConfiguration("config.toml")
+	config.AdminHttpPort = config.RaftServerPort
+	config.AdminBindAddress = "127.0.0.1"
+	c.Assert(config.Validate(), IsNil)
+	config.AdminBindAddress = ""
+	c.Assert(config.Validate(), DeepEquals, ValidationError{"raft.port and admin.port are both 8090"})
+}
+
+func (self *LoadConfigurationSuite) TestIPv6Addresses(c *C) {
+	config := LoadConfiguration("config.toml")
+	config.BindAddress = "::1"
+	config.RaftBindAddress = ""
+	config.Hostname = "fe80::1"
+	config.RaftSslCertPath = ""
+	c.Assert(config.RaftListenString(), Equals, "[::1]:8090")
+	c.Assert(config.ProtobufListenString(), Equals, "[::1]:8099")
+	c.Assert(config.AdminHttpPortString(), Equals, "[::1]:8083")
+	c.Assert(config.ProtobufConnectionString(), Equals, "[fe80::1]:8099")
+	c.Assert(config.RaftConnectionString(), Matches, "https?://\\[fe80::1\\]:8090")
+
+	config.AdminBindAddress = "127.0.0.1"
+	c.Assert(config.AdminHttpPortString(), Equals, "127.0.0.1:8083")
+}
+
+func (self *LoadConfigurationSuite) TestNewLogFilter(c *C) {
+	for level, expected := range map[string]interface{}{
+		"debug": log.DEBUG,
+		"info":  log.INFO,
+		"warn":  log.WARNING,
+		"error": log.ERROR,
+		"":      log.DEBUG,
+	} {
+		config := &Configuration{LogLevel: level}
+		filter := config.NewLogFilter(nil)
+		c.Assert(filter.Level, Equals, expected, Commentf("%q", level))
+	}
+}
@@ -0,0 +1,105 @@
+package configuration
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the environment variables that override the settings
+// of the configuration file
+const ENVIRONMENT_PREFIX = "INFLUXDB"
+
+// Overrides the settings of the configuration file with the environment
+// variables named after the setting's section and key, uppercased and
+// joined with underscores, with the dashes replaced by underscores as
+// well. E.g. INFLUXDB_API_PORT sets port in [api] and
+// INFLUXDB_INPUT_PLUGINS_GRAPHITE_ENABLED sets enabled in
+// [input_plugins.graphite]. Lists are comma separated, the arrays of
+// tables like [[input_plugins.udp_servers]] can't be set. The defaults
+// are applied afterwards, so the environment overrides the file and
+// both override the defaults.
+func applyEnvironment(config *TomlConfiguration, getenv func(string) string) error {
+	return applyEnvironmentToStruct(reflect.ValueOf(config).Elem(), ENVIRONMENT_PREFIX, getenv)
+}
+
+func applyEnvironmentToStruct(value reflect.Value, prefix string, getenv func(string) string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		key := field.Tag.Get("toml")
+		if key == "" {
+			key = field.Name
+		}
+		name := prefix + "_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+
+		fieldValue := value.Field(i)
+		if _, ok := fieldValue.Addr().Interface().(encoding.TextUnmarshaler); !ok && fieldValue.Kind() == reflect.Struct {
+			if err := applyEnvironmentToStruct(fieldValue, name, getenv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		setting := getenv(name)
+		if setting == "" {
+			continue
+		}
+		if err := setFromEnvironment(fieldValue, setting); err != nil {
+			return fmt.Errorf("Invalid value %s of %s: %s", setting, name, err)
+		}
+	}
+	return nil
+}
+
+func setFromEnvironment(value reflect.Value, setting string) error {
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(setting))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(setting)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(setting)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(setting, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(setting, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(setting, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s can't be set from the environment", value.Type())
+		}
+		items := strings.Split(setting, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		value.Set(reflect.ValueOf(items).Convert(value.Type()))
+	default:
+		return fmt.Errorf("%s can't be set from the environment", value.Type())
+	}
+	return nil
+}
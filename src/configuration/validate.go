@@ -0,0 +1,220 @@
+package configuration
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The problems of a configuration, reported all at once so they can be
+// fixed in one go
+type ValidationError []string
+
+func (self ValidationError) Error() string {
+	return fmt.Sprintf("Invalid configuration:\n  %s", strings.Join(self, "\n  "))
+}
+
+// Returns a ValidationError listing every setting that would keep the
+// server from starting or from running as configured, nil if there
+// are none
+func (self *Configuration) Validate() error {
+	problems := ValidationError{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, dir := range []struct{ name, dir string }{
+		{"storage.dir", self.DataDir},
+		{"raft.dir", self.RaftDir},
+		{"wal.dir", self.WalDir},
+	} {
+		if dir.dir == "" {
+			problem("%s isn't set", dir.name)
+		}
+	}
+
+	// the tcp ports, zero disables the optional listeners
+	type portSetting struct {
+		name     string
+		address  string
+		port     int
+		required bool
+	}
+	ports := []portSetting{
+		{"raft.port", self.listenAddress(self.RaftBindAddress), self.RaftServerPort, true},
+		{"cluster.protobuf_port", self.listenAddress(self.ProtobufBindAddress), self.ProtobufPort, true},
+		{"api.port", self.listenAddress(self.ApiBindAddress), self.ApiHttpPort, false},
+		{"api.ssl-port", self.listenAddress(self.ApiBindAddress), self.ApiHttpSslPort, false},
+		{"admin.port", self.listenAddress(self.AdminBindAddress), self.AdminHttpPort, false},
+	}
+	if self.GraphiteEnabled {
+		ports = append(ports, portSetting{"input_plugins.graphite.port", self.listenAddress(self.GraphiteBindAddress), self.GraphitePort, true})
+	}
+	used := map[int][]portSetting{}
+	for _, p := range ports {
+		switch {
+		case p.port == 0 && p.required:
+			problem("%s isn't set", p.name)
+		case p.port < 0 || p.port > 65535:
+			problem("%s is %d, ports are between 1 and 65535", p.name, p.port)
+		case p.port == 0:
+		default:
+			for _, other := range used[p.port] {
+				if addressesOverlap(other.address, p.address) {
+					problem("%s and %s are both %d", other.name, p.name, p.port)
+				}
+			}
+			used[p.port] = append(used[p.port], p)
+		}
+	}
+
+	if self.ApiHttpSslPort > 0 && self.ApiHttpCertPath == "" {
+		problem("api.ssl-port is set but api.ssl-cert isn't")
+	}
+	// the costs bcrypt accepts
+	if self.PasswordHashCost < 4 || self.PasswordHashCost > 31 {
+		problem("api.password-hash-cost is %d, it has to be between 4 and 31", self.PasswordHashCost)
+	}
+
+	if self.GraphiteEnabled {
+		if self.GraphiteDatabase == "" {
+			problem("input_plugins.graphite.database isn't set, graphite is enabled")
+		}
+		switch self.GraphiteProtocol {
+		case "", "plaintext", "pickle":
+		default:
+			problem("input_plugins.graphite.protocol is %s, valid protocols are plaintext and pickle", self.GraphiteProtocol)
+		}
+		if strings.ContainsAny(self.GraphiteSeparator, " \t\n") || strings.ContainsAny(self.GraphiteTagDelimiter, " \t\n") {
+			problem("input_plugins.graphite.separator and tag-delimiter can't contain whitespace")
+		}
+		if self.GraphiteBatchSize < 0 || self.GraphiteBatchTimeout < 0 {
+			problem("input_plugins.graphite.batch-size and batch-timeout can't be negative")
+		}
+		if self.GraphiteMaxLineLength < 0 || self.GraphiteMaxPointsPerFrame < 0 {
+			problem("input_plugins.graphite.max-line-length and max-points-per-frame can't be negative")
+		}
+		if self.GraphiteTagDelimiter != "" && strings.Contains(self.GraphiteTagDelimiter, self.GraphiteSeparator) {
+			problem("input_plugins.graphite.tag-delimiter can't contain the separator %s", self.GraphiteSeparator)
+		}
+	}
+
+	udpPorts := map[int][]string{}
+	if self.GraphiteEnabled && self.GraphiteUdpEnabled {
+		udpPorts[self.GraphitePort] = []string{self.listenAddress(self.GraphiteBindAddress)}
+	}
+	for _, udp := range self.UdpServers {
+		if !udp.Enabled {
+			continue
+		}
+		if udp.Port <= 0 || udp.Port > 65535 {
+			problem("The port of the udp input is %d, ports are between 1 and 65535", udp.Port)
+			continue
+		}
+		address := self.listenAddress(udp.BindAddress)
+		for _, other := range udpPorts[udp.Port] {
+			if addressesOverlap(other, address) {
+				problem("The udp port %d is used twice", udp.Port)
+				break
+			}
+		}
+		udpPorts[udp.Port] = append(udpPorts[udp.Port], address)
+		if udp.Database == "" && !udp.DatabaseFromPayload {
+			problem("The udp input on port %d has no database and doesn't take it from the payload", udp.Port)
+		}
+		if udp.BatchSize < 0 || udp.BatchTimeout.Duration < 0 {
+			problem("The batch-size and batch-timeout of the udp input on port %d can't be negative", udp.Port)
+		}
+		if udp.MaxPacketSize < 0 || udp.MaxPacketSize > 65536 {
+			problem("The max-packet-size of the udp input on port %d is %d, it has to be between 0 and 65536", udp.Port, udp.MaxPacketSize)
+		}
+		if udp.MaxPointsPerPacket < 0 {
+			problem("The max-points-per-packet of the udp input on port %d can't be negative", udp.Port)
+		}
+		switch udp.Format {
+		case "", "json", "line":
+		default:
+			problem("The format of the udp input on port %d is %s, valid formats are json and line", udp.Port, udp.Format)
+		}
+	}
+
+	if self.ProtobufConnectionsPerServer < 1 {
+		problem("cluster.protobuf-connections-per-server is %d, it has to be at least 1", self.ProtobufConnectionsPerServer)
+	}
+	if self.ProtobufDialTimeout < 0 || self.ProtobufReadTimeout < 0 || self.ProtobufWriteTimeout < 0 || self.ProtobufHealthCheckInterval < 0 {
+		problem("cluster.protobuf-dial-timeout, read-timeout, write-timeout and health-check-interval can't be negative")
+	}
+
+	if self.MaxConcurrentQueries < 0 || self.MaxQueuedQueries < 0 {
+		problem("cluster.max-concurrent-queries and max-queued-queries can't be negative")
+	}
+	if self.SlowQueryThreshold < 0 || self.SlowQueryLogSize < 0 {
+		problem("cluster.slow-query-threshold and slow-query-log-size can't be negative")
+	}
+	if self.QueryCacheSize < 0 || self.QueryCacheTtl < 0 || self.QueryCacheMaxPoints < 0 {
+		problem("cluster.query-cache-size, query-cache-ttl and query-cache-max-points can't be negative")
+	}
+	if self.QueryCacheSize > 0 && self.WriteMaxAge <= 0 {
+		problem("cluster.query-cache-size needs write-max-age, only the results older than it are cached")
+	}
+	if self.ClockSkewThreshold < 0 || self.WriteMaxFuture < 0 || self.WriteMaxAge < 0 {
+		problem("cluster.clock-skew-threshold, write-max-future and write-max-age can't be negative")
+	}
+
+	quotas := map[string]Quota{
+		"quotas.default-database": self.DefaultDatabaseQuota,
+		"quotas.default-user":     self.DefaultUserQuota,
+	}
+	for name, quota := range self.DatabaseQuotas {
+		quotas["quotas.databases."+name] = quota
+	}
+	for name, quota := range self.UserQuotas {
+		quotas["quotas.users."+name] = quota
+	}
+	quotaNames := make([]string, 0, len(quotas))
+	for name := range quotas {
+		quotaNames = append(quotaNames, name)
+	}
+	sort.Strings(quotaNames)
+	for _, name := range quotaNames {
+		if quota := quotas[name]; quota.PointsPerSecond < 0 || quota.QueriesPerSecond < 0 {
+			problem("%s.points-per-second and queries-per-second can't be negative", name)
+		}
+	}
+
+	if self.ShardPreCreateWindow < 0 || self.ShardPreCreateInterval < 0 {
+		problem("sharding.pre-create-window and pre-create-interval can't be negative")
+	} else if self.ShardPreCreateInterval > self.ShardPreCreateWindow {
+		problem("sharding.pre-create-interval is longer than pre-create-window, the shards could be created too late")
+	}
+
+	if self.WriteBufferHighWaterMark < 0 || self.WriteBufferHighWaterMark > self.LocalStoreWriteBufferSize {
+		problem("storage.write-buffer-high-water-mark is %d, it has to be between 0 and write-buffer-size", self.WriteBufferHighWaterMark)
+	}
+
+	switch self.StorageFieldTypeMismatch {
+	case "", "store", "coerce", "reject":
+	default:
+		problem("storage.field-type-mismatch is %s, valid policies are store, coerce and reject", self.StorageFieldTypeMismatch)
+	}
+
+	switch self.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problem("logging.level is %s, valid levels are debug, info, warn and error", self.LogLevel)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Listeners on the same port collide if they bind to the same address
+// or one of them binds to all the interfaces
+func addressesOverlap(a, b string) bool {
+	all := func(address string) bool {
+		return address == "" || address == "0.0.0.0" || address == "::"
+	}
+	return a == b || all(a) || all(b)
+}
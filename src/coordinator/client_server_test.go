@@ -1,6 +1,8 @@
 package coordinator
 
 import (
+	"cluster"
+	"configuration"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -9,6 +11,8 @@ import (
 	"protocol"
 	"testing"
 	"time"
+
+	"code.google.com/p/goprotobuf/proto"
 )
 
 type ClientServerSuite struct{}
@@ -81,6 +85,57 @@ func (self *ClientServerSuite) TestClientCanMakeRequests(c *C) {
 	}
 }
 
+func (self *ClientServerSuite) TestClientCanCancelQueries(c *C) {
+	config := &configuration.Configuration{}
+	store := &mockLocalShardStore{untilCancelled: true}
+	clusterConfiguration := newLocalClusterConfiguration(c, config, store)
+	clusterConfiguration.SaveClusterAdmin(&cluster.ClusterAdmin{cluster.CommonUser{Name: "root"}})
+	end := time.Now().Truncate(time.Hour)
+	shard := addLocalShard(c, clusterConfiguration, end.Add(-time.Hour), end)
+
+	protobufServer := NewProtobufServer(":8095", NewProtobufRequestHandler(nil, clusterConfiguration))
+	go protobufServer.ListenAndServe()
+	defer protobufServer.Close()
+	protobufClient := NewProtobufClient("localhost:8095", 0)
+	protobufClient.Connect()
+	defer protobufClient.Close()
+
+	queryType := protocol.Request_QUERY
+	request := &protocol.Request{
+		Type:     &queryType,
+		Database: protocol.String("db"),
+		ShardId:  proto.Uint32(shard.Id()),
+		Query:    protocol.String("select value from cpu"),
+		UserName: protocol.String("root"),
+		IsDbUser: proto.Bool(false),
+	}
+	responseStream := make(chan *protocol.Response, 1)
+	for i := 0; protobufClient.MakeRequest(request, responseStream) != nil; i++ {
+		c.Assert(i < 100, Equals, true, Commentf("cannot connect to the server"))
+		request.Id = nil
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a cancel of another request doesn't stop the query
+	other := &protocol.Request{Id: proto.Uint32(request.GetId() + 1), Type: &queryType, Database: protocol.String("db")}
+	c.Assert(protobufClient.CancelRequest(other), IsNil)
+	select {
+	case response := <-responseStream:
+		c.Fatalf("unexpected response %v", response)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.Assert(protobufClient.CancelRequest(request), IsNil)
+	select {
+	case response := <-responseStream:
+		// the stream of a lost connection ends with an error
+		c.Assert(response.GetType(), Equals, protocol.Response_END_STREAM)
+		c.Assert(response.ErrorMessage, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("Timed out waiting for the end of the cancelled query")
+	}
+}
+
 func (self *ClientServerSuite) TestClientReconnectsIfDisconnected(c *C) {
 }
 
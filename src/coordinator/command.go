@@ -24,12 +24,24 @@ func init() {
 		&SaveDbUserCommand{},
 		&SaveClusterAdminCommand{},
 		&ChangeDbUserPassword{},
+		&RehashUserPasswordCommand{},
 		&ChangeDbUserPermissions{},
 		&CreateContinuousQueryCommand{},
 		&DeleteContinuousQueryCommand{},
 		&SetContinuousQueryTimestampCommand{},
 		&CreateShardsCommand{},
 		&DropShardCommand{},
+		&SetRetentionPolicyCommand{},
+		&SetDatabaseReplicationFactorCommand{},
+		&SetDuplicatePointPolicyCommand{},
+		&SetNamedRetentionPolicyCommand{},
+		&DeleteNamedRetentionPolicyCommand{},
+		&MoveShardCommand{},
+		&FinishShardMoveCommand{},
+		&CancelShardMoveCommand{},
+		&DecommissionServerCommand{},
+		&SaveAuthTokenCommand{},
+		&DeleteAuthTokenCommand{},
 	} {
 		internalRaftCommands[command.CommandName()] = command
 	}
@@ -110,11 +122,12 @@ func (c *DropDatabaseCommand) Apply(server raft.Server) (interface{}, error) {
 }
 
 type CreateDatabaseCommand struct {
-	Name string `json:"name"`
+	Name              string `json:"name"`
+	ReplicationFactor uint8  `json:"replicationFactor,omitempty"`
 }
 
-func NewCreateDatabaseCommand(name string) *CreateDatabaseCommand {
-	return &CreateDatabaseCommand{name}
+func NewCreateDatabaseCommand(name string, replicationFactor uint8) *CreateDatabaseCommand {
+	return &CreateDatabaseCommand{name, replicationFactor}
 }
 
 func (c *CreateDatabaseCommand) CommandName() string {
@@ -123,7 +136,7 @@ func (c *CreateDatabaseCommand) CommandName() string {
 
 func (c *CreateDatabaseCommand) Apply(server raft.Server) (interface{}, error) {
 	config := server.Context().(*cluster.ClusterConfiguration)
-	err := config.CreateDatabase(c.Name)
+	err := config.CreateDatabase(c.Name, c.ReplicationFactor)
 	return nil, err
 }
 
@@ -172,6 +185,38 @@ func (c *ChangeDbUserPassword) Apply(server raft.Server) (interface{}, error) {
 	return nil, config.ChangeDbUserPassword(c.Database, c.Username, c.Hash)
 }
 
+// Replaces the password hash of a user, a cluster admin if Database is
+// empty, with the same password hashed with another cost. It's ignored
+// if the hash isn't OldHash anymore, i.e. the password was changed
+// while it was being hashed again.
+type RehashUserPasswordCommand struct {
+	Database string `json:"database"`
+	Username string `json:"username"`
+	OldHash  string `json:"oldHash"`
+	Hash     string `json:"hash"`
+}
+
+func NewRehashUserPasswordCommand(db, username, oldHash, hash string) *RehashUserPasswordCommand {
+	return &RehashUserPasswordCommand{
+		Database: db,
+		Username: username,
+		OldHash:  oldHash,
+		Hash:     hash,
+	}
+}
+
+func (c *RehashUserPasswordCommand) CommandName() string {
+	return "rehash_user_password"
+}
+
+func (c *RehashUserPasswordCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	if !config.RehashUserPassword(c.Database, c.Username, c.OldHash, c.Hash) {
+		log.Debug("(raft:%s) password of %s:%s changed, not hashing it again", server.Name(), c.Database, c.Username)
+	}
+	return nil, nil
+}
+
 type ChangeDbUserPermissions struct {
 	Database         string
 	Username         string
@@ -378,3 +423,207 @@ func (c *DropShardCommand) Apply(server raft.Server) (interface{}, error) {
 	err := config.DropShard(c.ShardId, c.ServerIds)
 	return nil, err
 }
+
+type SetRetentionPolicyCommand struct {
+	Database  string        `json:"database"`
+	Retention time.Duration `json:"retention"`
+}
+
+func NewSetRetentionPolicyCommand(db string, retention time.Duration) *SetRetentionPolicyCommand {
+	return &SetRetentionPolicyCommand{db, retention}
+}
+
+func (c *SetRetentionPolicyCommand) CommandName() string {
+	return "set_retention_policy"
+}
+
+func (c *SetRetentionPolicyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetRetentionPolicy(c.Database, c.Retention)
+	return nil, err
+}
+
+type SetDatabaseReplicationFactorCommand struct {
+	Database          string `json:"database"`
+	ReplicationFactor uint8  `json:"replicationFactor"`
+}
+
+func NewSetDatabaseReplicationFactorCommand(db string, replicationFactor uint8) *SetDatabaseReplicationFactorCommand {
+	return &SetDatabaseReplicationFactorCommand{db, replicationFactor}
+}
+
+func (c *SetDatabaseReplicationFactorCommand) CommandName() string {
+	return "set_database_replication_factor"
+}
+
+func (c *SetDatabaseReplicationFactorCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetDatabaseReplicationFactor(c.Database, c.ReplicationFactor)
+	return nil, err
+}
+
+type SetDuplicatePointPolicyCommand struct {
+	Database string                       `json:"database"`
+	Policy   cluster.DuplicatePointPolicy `json:"policy"`
+}
+
+func NewSetDuplicatePointPolicyCommand(db string, policy cluster.DuplicatePointPolicy) *SetDuplicatePointPolicyCommand {
+	return &SetDuplicatePointPolicyCommand{db, policy}
+}
+
+func (c *SetDuplicatePointPolicyCommand) CommandName() string {
+	return "set_duplicate_point_policy"
+}
+
+func (c *SetDuplicatePointPolicyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetDuplicatePointPolicy(c.Database, c.Policy)
+	return nil, err
+}
+
+type SetNamedRetentionPolicyCommand struct {
+	Database  string        `json:"database"`
+	Name      string        `json:"name"`
+	Retention time.Duration `json:"retention"`
+}
+
+func NewSetNamedRetentionPolicyCommand(db, name string, retention time.Duration) *SetNamedRetentionPolicyCommand {
+	return &SetNamedRetentionPolicyCommand{db, name, retention}
+}
+
+func (c *SetNamedRetentionPolicyCommand) CommandName() string {
+	return "set_named_retention_policy"
+}
+
+func (c *SetNamedRetentionPolicyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetNamedRetentionPolicy(c.Database, c.Name, c.Retention)
+	return nil, err
+}
+
+type DeleteNamedRetentionPolicyCommand struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+}
+
+func NewDeleteNamedRetentionPolicyCommand(db, name string) *DeleteNamedRetentionPolicyCommand {
+	return &DeleteNamedRetentionPolicyCommand{db, name}
+}
+
+func (c *DeleteNamedRetentionPolicyCommand) CommandName() string {
+	return "delete_named_retention_policy"
+}
+
+func (c *DeleteNamedRetentionPolicyCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DeleteNamedRetentionPolicy(c.Database, c.Name)
+	return nil, err
+}
+
+type MoveShardCommand struct {
+	Move *cluster.ShardMove `json:"move"`
+}
+
+func NewMoveShardCommand(move *cluster.ShardMove) *MoveShardCommand {
+	return &MoveShardCommand{move}
+}
+
+func (c *MoveShardCommand) CommandName() string {
+	return "move_shard"
+}
+
+func (c *MoveShardCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.AddShardMove(c.Move)
+	return nil, err
+}
+
+type FinishShardMoveCommand struct {
+	ShardId uint32 `json:"shardId"`
+}
+
+func NewFinishShardMoveCommand(id uint32) *FinishShardMoveCommand {
+	return &FinishShardMoveCommand{id}
+}
+
+func (c *FinishShardMoveCommand) CommandName() string {
+	return "finish_shard_move"
+}
+
+func (c *FinishShardMoveCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.FinishShardMove(c.ShardId)
+	return nil, err
+}
+
+type CancelShardMoveCommand struct {
+	ShardId uint32 `json:"shardId"`
+}
+
+func NewCancelShardMoveCommand(id uint32) *CancelShardMoveCommand {
+	return &CancelShardMoveCommand{id}
+}
+
+func (c *CancelShardMoveCommand) CommandName() string {
+	return "cancel_shard_move"
+}
+
+func (c *CancelShardMoveCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.CancelShardMove(c.ShardId)
+	return nil, err
+}
+
+type DecommissionServerCommand struct {
+	ServerId uint32 `json:"serverId"`
+}
+
+func NewDecommissionServerCommand(id uint32) *DecommissionServerCommand {
+	return &DecommissionServerCommand{id}
+}
+
+func (c *DecommissionServerCommand) CommandName() string {
+	return "decommission_server"
+}
+
+func (c *DecommissionServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.DecommissionServer(c.ServerId)
+	return nil, err
+}
+
+type SaveAuthTokenCommand struct {
+	Token *cluster.AuthToken `json:"token"`
+}
+
+func NewSaveAuthTokenCommand(token *cluster.AuthToken) *SaveAuthTokenCommand {
+	return &SaveAuthTokenCommand{token}
+}
+
+func (c *SaveAuthTokenCommand) CommandName() string {
+	return "save_auth_token"
+}
+
+func (c *SaveAuthTokenCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	config.SaveAuthToken(c.Token)
+	return nil, nil
+}
+
+type DeleteAuthTokenCommand struct {
+	Hash string `json:"hash"`
+}
+
+func NewDeleteAuthTokenCommand(hash string) *DeleteAuthTokenCommand {
+	return &DeleteAuthTokenCommand{hash}
+}
+
+func (c *DeleteAuthTokenCommand) CommandName() string {
+	return "delete_auth_token"
+}
+
+func (c *DeleteAuthTokenCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	config.DeleteAuthToken(c.Hash)
+	return nil, nil
+}
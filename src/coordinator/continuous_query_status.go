@@ -0,0 +1,262 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"parser"
+	"sort"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/goraft/raft"
+)
+
+const (
+	// the failed runs of the continuous queries are retried with an
+	// exponential backoff between these
+	CONTINUOUS_QUERY_RETRY_MIN_BACKOFF = 10 * time.Second
+	CONTINUOUS_QUERY_RETRY_MAX_BACKOFF = 10 * time.Minute
+	// the intervals that fail this many times are given up on and
+	// reported as gaps
+	CONTINUOUS_QUERY_MAX_RETRIES = 10
+	// the number of gaps that are kept per continuous query
+	CONTINUOUS_QUERY_MAX_GAPS = 100
+)
+
+// The runs of a continuous query on the current leader, the leader
+// runs the continuous queries so a new leader starts with empty
+// statuses
+type ContinuousQueryStatus struct {
+	Id            uint32    `json:"id"`
+	Query         string    `json:"query"`
+	LastSuccess   time.Time `json:"lastSuccess"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	// the intervals that failed and will be retried
+	PendingRetries []*ContinuousQueryInterval `json:"pendingRetries"`
+	// the intervals that failed too many times, the results of the
+	// query are missing or incomplete for them
+	Gaps []*ContinuousQueryInterval `json:"gaps"`
+}
+
+type ContinuousQueryInterval struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError"`
+}
+
+func continuousQueryBackoff(attempts int) time.Duration {
+	backoff := CONTINUOUS_QUERY_RETRY_MIN_BACKOFF
+	for i := 1; i < attempts && backoff < CONTINUOUS_QUERY_RETRY_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > CONTINUOUS_QUERY_RETRY_MAX_BACKOFF {
+		backoff = CONTINUOUS_QUERY_RETRY_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// Returns the status of the query, it's created if it doesn't exist.
+// Has to be called with the statuses locked.
+func (s *RaftServer) continuousQueryStatus(db string, id uint32, query string) *ContinuousQueryStatus {
+	statuses := s.continuousQueryStatuses[db]
+	if statuses == nil {
+		statuses = make(map[uint32]*ContinuousQueryStatus)
+		s.continuousQueryStatuses[db] = statuses
+	}
+	status := statuses[id]
+	if status == nil {
+		status = &ContinuousQueryStatus{
+			Id:             id,
+			Query:          query,
+			PendingRetries: []*ContinuousQueryInterval{},
+			Gaps:           []*ContinuousQueryInterval{},
+		}
+		statuses[id] = status
+	}
+	return status
+}
+
+// Runs the continuous query over [start, end) and schedules a retry of
+// the interval if it fails
+func (s *RaftServer) runAndRecordContinuousQuery(db string, id uint32, query *parser.SelectQuery, start, end time.Time) error {
+	err := s.runContinuousQuery(db, query, start, end)
+
+	s.continuousQueryStatusesLock.Lock()
+	defer s.continuousQueryStatusesLock.Unlock()
+	status := s.continuousQueryStatus(db, id, query.GetQueryString())
+	now := time.Now()
+	if err == nil {
+		status.LastSuccess = now
+		return nil
+	}
+
+	log.Error("Continuous query %d of %s failed for %s to %s, retrying in %s: %s", id, db, start, end, CONTINUOUS_QUERY_RETRY_MIN_BACKOFF, err)
+	status.LastError = err.Error()
+	status.LastErrorTime = now
+	status.PendingRetries = append(status.PendingRetries, &ContinuousQueryInterval{
+		Start:       start,
+		End:         end,
+		Attempts:    1,
+		NextAttempt: now.Add(continuousQueryBackoff(1)),
+		LastError:   err.Error(),
+	})
+	return err
+}
+
+// Retries the failed intervals of the continuous queries whose backoff
+// expired
+func (s *RaftServer) retryContinuousQueries() {
+	type retry struct {
+		db       string
+		status   *ContinuousQueryStatus
+		interval *ContinuousQueryInterval
+		query    *parser.SelectQuery
+	}
+
+	now := time.Now()
+	retries := []retry{}
+	s.continuousQueryStatusesLock.Lock()
+	for db, statuses := range s.continuousQueryStatuses {
+		for id, status := range statuses {
+			query := s.clusterConfig.ParsedContinuousQueries[db][id]
+			if query == nil {
+				// the query was deleted
+				delete(statuses, id)
+				continue
+			}
+			for _, interval := range status.PendingRetries {
+				if !interval.NextAttempt.After(now) {
+					retries = append(retries, retry{db, status, interval, query})
+				}
+			}
+		}
+	}
+	s.continuousQueryStatusesLock.Unlock()
+
+	for _, r := range retries {
+		err := s.runContinuousQuery(r.db, r.query, r.interval.Start, r.interval.End)
+
+		s.continuousQueryStatusesLock.Lock()
+		now := time.Now()
+		r.interval.Attempts++
+		if err == nil {
+			log.Info("Retry of continuous query %d of %s succeeded for %s to %s", r.status.Id, r.db, r.interval.Start, r.interval.End)
+			r.status.LastSuccess = now
+			r.status.PendingRetries = removeContinuousQueryInterval(r.status.PendingRetries, r.interval)
+		} else {
+			r.status.LastError = err.Error()
+			r.status.LastErrorTime = now
+			r.interval.LastError = err.Error()
+			if r.interval.Attempts >= CONTINUOUS_QUERY_MAX_RETRIES {
+				log.Critical("Continuous query %d of %s failed %d times for %s to %s, giving up. Its results are missing for this interval: %s",
+					r.status.Id, r.db, r.interval.Attempts, r.interval.Start, r.interval.End, err)
+				r.status.PendingRetries = removeContinuousQueryInterval(r.status.PendingRetries, r.interval)
+				r.status.Gaps = append(r.status.Gaps, r.interval)
+				if len(r.status.Gaps) > CONTINUOUS_QUERY_MAX_GAPS {
+					r.status.Gaps = r.status.Gaps[len(r.status.Gaps)-CONTINUOUS_QUERY_MAX_GAPS:]
+				}
+			} else {
+				backoff := continuousQueryBackoff(r.interval.Attempts)
+				log.Error("Retry %d of continuous query %d of %s failed for %s to %s, retrying in %s: %s",
+					r.interval.Attempts-1, r.status.Id, r.db, r.interval.Start, r.interval.End, backoff, err)
+				r.interval.NextAttempt = now.Add(backoff)
+			}
+		}
+		s.continuousQueryStatusesLock.Unlock()
+	}
+}
+
+func removeContinuousQueryInterval(intervals []*ContinuousQueryInterval, interval *ContinuousQueryInterval) []*ContinuousQueryInterval {
+	for i, other := range intervals {
+		if other == interval {
+			return append(intervals[:i], intervals[i+1:]...)
+		}
+	}
+	return intervals
+}
+
+// Returns the id of the continuous query of the database, false if it
+// doesn't exist anymore
+func (s *RaftServer) continuousQueryId(db string, query *parser.SelectQuery) (uint32, bool) {
+	for id, other := range s.clusterConfig.ParsedContinuousQueries[db] {
+		if other.GetQueryString() == query.GetQueryString() {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+type continuousQueryStatusesById []*ContinuousQueryStatus
+
+func (self continuousQueryStatusesById) Len() int           { return len(self) }
+func (self continuousQueryStatusesById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self continuousQueryStatusesById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the statuses of the continuous queries of the database from
+// the leader, which runs them
+func (s *RaftServer) ContinuousQueryStatuses(db string) ([]*ContinuousQueryStatus, error) {
+	if s.raftServer.State() != raft.Leader {
+		leader, ok := s.leaderConnectString()
+		if !ok {
+			return nil, errors.New("Couldn't connect to the cluster leader...")
+		}
+		resp, err := s.httpClient.Get(leader + "/continuous_query_statuses?db=" + url.QueryEscape(db))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			message, _ := ioutil.ReadAll(resp.Body)
+			return nil, errors.New(strings.TrimSpace(string(message)))
+		}
+		statuses := []*ContinuousQueryStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+			return nil, err
+		}
+		return statuses, nil
+	}
+
+	s.continuousQueryStatusesLock.Lock()
+	defer s.continuousQueryStatusesLock.Unlock()
+	statuses := []*ContinuousQueryStatus{}
+	for id, query := range s.clusterConfig.ParsedContinuousQueries[db] {
+		// the json is encoded from a copy, the retries keep updating the
+		// status
+		status := *s.continuousQueryStatus(db, id, query.GetQueryString())
+		status.PendingRetries = copyContinuousQueryIntervals(status.PendingRetries)
+		status.Gaps = copyContinuousQueryIntervals(status.Gaps)
+		statuses = append(statuses, &status)
+	}
+	sort.Sort(continuousQueryStatusesById(statuses))
+	return statuses, nil
+}
+
+func copyContinuousQueryIntervals(intervals []*ContinuousQueryInterval) []*ContinuousQueryInterval {
+	copies := make([]*ContinuousQueryInterval, 0, len(intervals))
+	for _, interval := range intervals {
+		intervalCopy := *interval
+		copies = append(copies, &intervalCopy)
+	}
+	return copies
+}
+
+func (s *RaftServer) continuousQueryStatusesHandler(w http.ResponseWriter, req *http.Request) {
+	statuses, err := s.ContinuousQueryStatuses(req.URL.Query().Get("db"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(statuses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
@@ -10,8 +10,10 @@ import (
 	"parser"
 	"protocol"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -22,6 +24,31 @@ type CoordinatorImpl struct {
 	raftServer           ClusterConsensus
 	config               *configuration.Configuration
 	permissions          Permissions
+	// the number of RunQuery and WriteSeriesData calls that haven't
+	// returned yet, used to drain requests on shutdown. drained is
+	// closed once draining and there are no pending requests left.
+	pendingRequestsLock sync.Mutex
+	pendingRequests     int
+	draining            bool
+	drained             chan struct{}
+	// counters reported by the /stats endpoint
+	pointsWritten int64
+	queriesServed int64
+	queryLimiter  *QueryLimiter
+	queryJobs     *QueryJobRegistry
+	subscriptions *SubscriptionRegistry
+	slowQueries   *SlowQueryLog
+	queryCache    *QueryCache
+	quotas        *Quotas
+	engineConfig  *engine.QueryEngineConfig
+
+	// the points rejected for being outside of the write window
+	pointsTooFarInFuture int64
+	pointsTooOld         int64
+
+	// the users whose password is being hashed again
+	rehashing     map[string]bool
+	rehashingLock sync.Mutex
 }
 
 const (
@@ -62,12 +89,265 @@ func NewCoordinatorImpl(config *configuration.Configuration, raftServer ClusterC
 		clusterConfiguration: clusterConfiguration,
 		raftServer:           raftServer,
 		permissions:          Permissions{},
+		queryLimiter:         NewQueryLimiter(config.MaxConcurrentQueries, config.MaxQueuedQueries),
+		slowQueries:          NewSlowQueryLog(config.SlowQueryThreshold, config.SlowQueryLogSize, config.SlowQueryLogFile),
+		queryCache:           NewQueryCache(config.QueryCacheSize, config.QueryCacheTtl, config.QueryCacheMaxPoints),
+		quotas:               NewQuotas(config.DefaultDatabaseQuota, config.DefaultUserQuota, config.DatabaseQuotas, config.UserQuotas),
+		rehashing:            make(map[string]bool),
+		engineConfig:         engine.NewQueryEngineConfig(config),
+		drained:              make(chan struct{}),
 	}
+	coordinator.queryJobs = NewQueryJobRegistry(coordinator, config.QueryJobTtl)
+	coordinator.subscriptions = NewSubscriptionRegistry(coordinator.currentUser)
 
 	return coordinator
 }
 
+// Returns an error if the pending requests are being drained, new
+// requests aren't started then
+func (self *CoordinatorImpl) startRequest() error {
+	self.pendingRequestsLock.Lock()
+	defer self.pendingRequestsLock.Unlock()
+	if self.draining {
+		return common.NewShuttingDownError()
+	}
+	self.pendingRequests++
+	return nil
+}
+
+func (self *CoordinatorImpl) endRequest() {
+	self.pendingRequestsLock.Lock()
+	defer self.pendingRequestsLock.Unlock()
+	self.pendingRequests--
+	if self.draining && self.pendingRequests == 0 {
+		close(self.drained)
+	}
+}
+
+// Rejects the new queries and writes and waits up to timeout for all
+// in flight ones to finish. Returns the number of requests that were
+// still running when the timeout elapsed.
+func (self *CoordinatorImpl) WaitForPendingRequests(timeout time.Duration) int {
+	self.pendingRequestsLock.Lock()
+	if !self.draining {
+		self.draining = true
+		if self.pendingRequests == 0 {
+			close(self.drained)
+		}
+	}
+	self.pendingRequestsLock.Unlock()
+
+	select {
+	case <-self.drained:
+		return 0
+	case <-time.After(timeout):
+		self.pendingRequestsLock.Lock()
+		defer self.pendingRequestsLock.Unlock()
+		return self.pendingRequests
+	}
+}
+
+// Returns the number of points written and queries run through this
+// coordinator since startup
+func (self *CoordinatorImpl) Stats() (pointsWritten int64, queriesServed int64) {
+	return atomic.LoadInt64(&self.pointsWritten), atomic.LoadInt64(&self.queriesServed)
+}
+
+// Returns the number of points rejected because their timestamp was
+// outside of the write-max-future and write-max-age window
+func (self *CoordinatorImpl) RejectedPoints() (tooFarInFuture int64, tooOld int64) {
+	return atomic.LoadInt64(&self.pointsTooFarInFuture), atomic.LoadInt64(&self.pointsTooOld)
+}
+
+// Returns the number of queries running and waiting to run
+func (self *CoordinatorImpl) QueryCounts() (running, queued int) {
+	return self.queryLimiter.Counts()
+}
+
+func (self *CoordinatorImpl) QuotaUsage() (databases, users map[string]QuotaUsage) {
+	return self.quotas.Usage()
+}
+
+func (self *CoordinatorImpl) SlowQueries() []*SlowQuery {
+	return self.slowQueries.Recent()
+}
+
 func (self *CoordinatorImpl) RunQuery(user common.User, database string, queryString string, seriesWriter SeriesWriter) (err error) {
+	return self.RunQueryWithCancel(user, database, queryString, seriesWriter, nil)
+}
+
+func (self *CoordinatorImpl) SubmitQuery(user common.User, db, query string) (*QueryJob, error) {
+	return self.queryJobs.Submit(user, db, query)
+}
+
+func (self *CoordinatorImpl) GetQueryJob(user common.User, db, id string) (*QueryJob, error) {
+	return self.queryJobs.Get(user, db, id)
+}
+
+func (self *CoordinatorImpl) DeleteQueryJob(user common.User, db, id string) error {
+	return self.queryJobs.Delete(user, db, id)
+}
+
+func (self *CoordinatorImpl) Subscribe(user common.User, db, query string, bufferSize int, overflow SubscriptionOverflow) (*Subscription, error) {
+	if !self.clusterConfiguration.DatabasesExists(db) {
+		return nil, fmt.Errorf("Database %s doesn't exist", db)
+	}
+	selectQuery, err := parser.ParseSelectQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	querySpec := parser.NewQuerySpec(user, db, &parser.Query{SelectQuery: selectQuery})
+	if err := self.checkPermission(user, querySpec); err != nil {
+		return nil, err
+	}
+	subscription, err := NewSubscription(user, db, selectQuery, bufferSize, overflow)
+	if err != nil {
+		return nil, err
+	}
+	self.subscriptions.Add(subscription)
+	log.Info("Subscribed to %s of %s, u: %s", selectQuery.GetQueryString(), db, user.GetName())
+	return subscription, nil
+}
+
+func (self *CoordinatorImpl) Unsubscribe(subscription *Subscription) {
+	self.subscriptions.Remove(subscription)
+}
+
+// Returns the user as it's currently saved in the cluster
+// configuration, or nil if it was deleted
+func (self *CoordinatorImpl) currentUser(user common.User) common.User {
+	if user.IsClusterAdmin() {
+		if admin := self.clusterConfiguration.GetClusterAdmin(user.GetName()); admin != nil && !admin.IsDeleted() {
+			return admin
+		}
+		return nil
+	}
+	if dbUser := self.clusterConfiguration.GetDbUser(user.GetDb(), user.GetName()); dbUser != nil && !dbUser.IsDeleted() {
+		return dbUser
+	}
+	return nil
+}
+
+// Same as RunQuery but stops querying the shards when cancel is
+// closed or the query timeout elapses
+func (self *CoordinatorImpl) RunQueryWithCancel(user common.User, database string, queryString string, seriesWriter SeriesWriter, cancel <-chan bool) error {
+	return self.runQueryWithCancel(user, database, queryString, nil, seriesWriter, cancel)
+}
+
+func (self *CoordinatorImpl) RunQueryInTimeZone(user common.User, database string, queryString string, location *time.Location, seriesWriter SeriesWriter, cancel <-chan bool) error {
+	if location == nil {
+		return self.RunQueryWithCancel(user, database, queryString, seriesWriter, cancel)
+	}
+	queries, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return err
+	}
+	setTimeZone(queries, location)
+	return self.runQueryWithCancel(user, database, queryString, queries, seriesWriter, cancel)
+}
+
+// Aligns the time buckets of the select queries to the time zone
+func setTimeZone(queries []*parser.Query, location *time.Location) {
+	for _, query := range queries {
+		if query.SelectQuery != nil {
+			query.SelectQuery.SetTimeZone(location)
+		}
+	}
+}
+
+// Runs the statements of the query concurrently, the results of each
+// statement are written to the writer newWriter returns for its index.
+// newWriter is called for every statement in order before they run. A
+// statement that fails doesn't stop the others, their errors are
+// returned in the order of the statements.
+func (self *CoordinatorImpl) RunQueries(user common.User, database string, queryString string, location *time.Location, newWriter func(statement int) SeriesWriter, cancel <-chan bool) ([]error, error) {
+	queries, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
+	if location != nil {
+		setTimeZone(queries, location)
+	}
+
+	writers := make([]SeriesWriter, len(queries))
+	for i := range queries {
+		writers[i] = newWriter(i)
+	}
+	errs := make([]error, len(queries))
+	var wait sync.WaitGroup
+	for i, query := range queries {
+		statementString := queryString
+		if len(queries) > 1 {
+			statementString = query.GetQueryString()
+		}
+		wait.Add(1)
+		go func(i int, statementString string, query *parser.Query) {
+			defer wait.Done()
+			errs[i] = self.runQueryWithCancel(user, database, statementString, []*parser.Query{query}, writers[i], cancel)
+		}(i, statementString, query)
+	}
+	wait.Wait()
+	return errs, nil
+}
+
+// Runs the statements, they're parsed from the query string if they're
+// nil
+func (self *CoordinatorImpl) runQueryWithCancel(user common.User, database string, queryString string, q []*parser.Query, seriesWriter SeriesWriter, cancel <-chan bool) error {
+	if err := self.quotas.TakeQuery(database, user); err != nil {
+		log.Warn("Not running query: db: %s, u: %s, q: %s: %s", database, user.GetName(), queryString, err)
+		return err
+	}
+	return self.runQueryWithoutQuota(user, database, queryString, q, seriesWriter, cancel)
+}
+
+// Same as runQueryWithCancel but the query isn't counted against the
+// quotas, for the queries the server runs itself like the continuous
+// queries
+func (self *CoordinatorImpl) runQueryWithoutQuota(user common.User, database string, queryString string, q []*parser.Query, seriesWriter SeriesWriter, cancel <-chan bool) (err error) {
+	if err := self.startRequest(); err != nil {
+		log.Warn("Not running query: db: %s, u: %s, q: %s: %s", database, user.GetName(), queryString, err)
+		return err
+	}
+	defer self.endRequest()
+	if err := self.queryLimiter.Acquire(cancel); err != nil {
+		log.Warn("Not running query: db: %s, u: %s, q: %s: %s", database, user.GetName(), queryString, err)
+		return err
+	}
+	defer self.queryLimiter.Release()
+	atomic.AddInt64(&self.queriesServed, 1)
+
+	var shardsQueried int32
+	if self.slowQueries.isEnabled() {
+		counter := &pointCountingWriter{SeriesWriter: seriesWriter}
+		seriesWriter = counter
+		defer func(t time.Time) {
+			slowQuery := &SlowQuery{
+				Query:     queryString,
+				Database:  database,
+				User:      user.GetName(),
+				StartedAt: t.Unix(),
+				Shards:    atomic.LoadInt32(&shardsQueried),
+				Points:    atomic.LoadInt64(&counter.points),
+			}
+			if err != nil {
+				slowQuery.Error = err.Error()
+			}
+			self.slowQueries.Record(slowQuery, time.Now().Sub(t))
+		}(time.Now())
+	}
+
+	writer := newCancellingWriter(seriesWriter)
+	seriesWriter = writer
+	cancelled := self.watchQuery(queryString, cancel, writer.failed)
+	defer func() {
+		if writeErr := writer.error(); writeErr != nil {
+			err = writeErr
+		} else if err == nil && cancelled.isCancelled() {
+			err = common.QueryCancelledError
+		}
+		cancelled.done()
+	}()
+
 	log.Info("Start Query: db: %s, u: %s, q: %s", database, user.GetName(), queryString)
 	defer func(t time.Time) {
 		log.Debug("End Query: db: %s, u: %s, q: %s, t: %s", database, user.GetName(), queryString, time.Now().Sub(t))
@@ -75,13 +355,17 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 	// don't let a panic pass beyond RunQuery
 	defer common.RecoverFunc(database, queryString, nil)
 
-	q, err := parser.ParseQuery(queryString)
-	if err != nil {
-		return err
+	if q == nil {
+		q, err = parser.ParseQuery(queryString)
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, query := range q {
 		querySpec := parser.NewQuerySpec(user, database, query)
+		querySpec.SetCancelChannel(cancelled.channel)
+		querySpec.SetShardCounter(&shardsQueried)
 
 		if query.DeleteQuery != nil {
 			if err := self.clusterConfiguration.CreateCheckpoint(); err != nil {
@@ -129,17 +413,135 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 		selectQuery := query.SelectQuery
 
 		if selectQuery.IsContinuousQuery() {
+			// with a time range the query runs once over it instead
+			if selectQuery.IsStartTimeSpecified() || selectQuery.IsEndTimeSpecified() {
+				return self.runIntoQuery(querySpec)
+			}
+			if len(q) > 1 {
+				return self.CreateContinuousQuery(user, database, selectQuery.GetQueryString())
+			}
 			return self.CreateContinuousQuery(user, database, queryString)
 		}
 		if err := self.checkPermission(user, querySpec); err != nil {
 			return err
 		}
-		return self.runQuery(querySpec, seriesWriter)
+		return self.runCachedQuery(querySpec, seriesWriter)
 	}
 	seriesWriter.Close()
 	return nil
 }
 
+// Runs a select query with an into clause and a time range once and
+// writes its results into the target like a continuous query would.
+// The points written get the sequence numbers of their position at
+// their timestamp, so running the query again overwrites the points it
+// wrote before instead of adding to them. The points of the target
+// outside of the time range aren't touched.
+func (self *CoordinatorImpl) runIntoQuery(querySpec *parser.QuerySpec) error {
+	user, db := querySpec.User(), querySpec.Database()
+	if ok, err := self.permissions.AuthorizeCreateContinuousQuery(user, db); !ok {
+		return err
+	}
+	if err := self.checkPermission(user, querySpec); err != nil {
+		return err
+	}
+
+	query := querySpec.SelectQuery()
+	selectQuery, err := parser.ParseSelectQuery(query.GetQueryStringWithTimesAndNoIntoClause(query.GetStartTime(), query.GetEndTime()))
+	if err != nil {
+		return err
+	}
+	targetName := query.GetIntoClause().Target.Name
+	log.Info("Writing the results of %s into %s of %s", selectQuery.GetQueryString(), targetName, db)
+
+	sequenceNumbers := IntoSequenceNumbers{}
+	writer := NewContinuousQueryWriter(func(series *protocol.Series) error {
+		return self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, sequenceNumbers)
+	})
+	return self.runQuery(querySpec.DerivedSpec(&parser.Query{SelectQuery: selectQuery}), writer)
+}
+
+type queryCancellation struct {
+	// closed when the query is cancelled or times out
+	channel  chan bool
+	finished chan bool
+}
+
+func (self *queryCancellation) isCancelled() bool {
+	select {
+	case <-self.channel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *queryCancellation) done() {
+	close(self.finished)
+}
+
+// Cancels the query once the writer returns an error, e.g. because the
+// response got too big, instead of querying the rest of the shards
+type cancellingWriter struct {
+	SeriesWriter
+	lock   sync.Mutex
+	err    error
+	failed chan bool
+}
+
+func newCancellingWriter(writer SeriesWriter) *cancellingWriter {
+	return &cancellingWriter{SeriesWriter: writer, failed: make(chan bool)}
+}
+
+func (self *cancellingWriter) Write(series *protocol.Series) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		return self.err
+	}
+	if err := self.SeriesWriter.Write(series); err != nil {
+		self.err = err
+		close(self.failed)
+		return err
+	}
+	return nil
+}
+
+func (self *cancellingWriter) error() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+// Closes the returned cancellation channel when cancel or failed is
+// closed or the query timeout elapses, whichever happens first
+func (self *CoordinatorImpl) watchQuery(queryString string, cancel, failed <-chan bool) *queryCancellation {
+	cancellation := &queryCancellation{make(chan bool), make(chan bool)}
+
+	go func() {
+		var timeout <-chan time.Time
+		if self.config.QueryTimeout > 0 {
+			timer := time.NewTimer(self.config.QueryTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-cancel:
+			log.Info("Cancelling query: %s", queryString)
+		case <-failed:
+			log.Info("Cancelling query that failed writing its results: %s", queryString)
+		case <-timeout:
+			log.Warn("Query timed out after %s, cancelling: %s", self.config.QueryTimeout, queryString)
+		case <-cancellation.finished:
+			return
+		}
+		close(cancellation.channel)
+	}()
+
+	return cancellation
+}
+
 func (self *CoordinatorImpl) checkPermission(user common.User, querySpec *parser.QuerySpec) error {
 	// if this isn't a regex query do the permission check here
 	fromClause := querySpec.SelectQuery().GetFromClause()
@@ -156,19 +558,72 @@ func (self *CoordinatorImpl) checkPermission(user common.User, querySpec *parser
 
 // This should only get run for SelectQuery types
 func (self *CoordinatorImpl) runQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	if offset := querySpec.SelectQuery().Offset; offset > 0 {
+		seriesWriter = NewOffsetWriter(seriesWriter, offset)
+	}
+	if querySpec.SelectQuery().GetFromClause().Type == parser.FromClauseSubquery {
+		return self.runSubquery(querySpec, seriesWriter)
+	}
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
 
+// Runs the query the select query selects from and feeds its results to
+// the engine of the outer query, which writes its own results to the
+// writer
+func (self *CoordinatorImpl) runSubquery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	subquerySpec := querySpec.SubquerySpec()
+	if err := self.checkPermission(querySpec.User(), subquerySpec); err != nil {
+		return err
+	}
+
+	responseChan := make(chan *protocol.Response)
+	processor, err := engine.NewQueryEngineWithConfig(querySpec.SelectQuery(), responseChan, self.engineConfig)
+	if err != nil {
+		return err
+	}
+	seriesClosed := self.writeResponses(querySpec, responseChan, seriesWriter)
+
+	err = self.runQuery(subquerySpec, &subqueryWriter{querySpec.SelectQuery(), processor})
+	processor.Close()
+	if closeErr := <-seriesClosed; err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Writes the results of a subquery to the engine of the outer query
+type subqueryWriter struct {
+	query     *parser.SelectQuery
+	processor cluster.QueryProcessor
+}
+
+func (self *subqueryWriter) Write(series *protocol.Series) error {
+	series, err := engine.FilterSubqueryResults(self.query, series)
+	if err != nil {
+		return err
+	}
+	if len(series.Points) > 0 {
+		self.processor.YieldSeries(series)
+	}
+	return nil
+}
+
+// the outer engine is closed once the subquery is done
+func (self *subqueryWriter) Close() {}
+
 func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
-	shortTermShards := self.clusterConfiguration.GetShortTermShards()
+	// the latest shards that can have the series of the database, the
+	// ones dedicated to other databases don't
+	shortTermShards := cluster.DatabaseShards(querySpec.Database(), self.clusterConfiguration.GetShortTermShards())
 	if len(shortTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
 		shortTermShards = shortTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
 	}
-	longTermShards := self.clusterConfiguration.GetLongTermShards()
+	longTermShards := cluster.DatabaseShards(querySpec.Database(), self.clusterConfiguration.GetLongTermShards())
 	if len(longTermShards) > SHARDS_TO_QUERY_FOR_LIST_SERIES {
 		longTermShards = longTermShards[:SHARDS_TO_QUERY_FOR_LIST_SERIES]
 	}
 	seriesYielded := make(map[string]bool)
+	names := []string{}
 
 	var shards []*cluster.ShardData
 	shards = append(shards, shortTermShards...)
@@ -183,18 +638,24 @@ func (self *CoordinatorImpl) runListSeriesQuery(querySpec *parser.QuerySpec, ser
 			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
 				if response.ErrorMessage != nil && err != nil {
 					log.Debug("Error when querying shard: %s", err)
-					err = common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+					err = common.NewQueryError(common.InvalidArgument, "%s", *response.ErrorMessage)
 				}
 				break
 			}
 			for _, series := range response.MultiSeries {
 				if !seriesYielded[*series.Name] {
 					seriesYielded[*series.Name] = true
-					seriesWriter.Write(series)
+					names = append(names, *series.Name)
 				}
 			}
 		}
 	}
+
+	// the series are sorted so the pages of a listing don't overlap
+	sort.Strings(names)
+	for _, name := range querySpec.ListQuery().Page(names) {
+		seriesWriter.Write(&protocol.Series{Name: protocol.String(name)})
+	}
 	seriesWriter.Close()
 	return err
 }
@@ -205,10 +666,43 @@ func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesW
 	if ok, err := self.permissions.AuthorizeDeleteQuery(user, db); !ok {
 		return err
 	}
+	defer self.queryCache.clear(db)
+	if err := self.dropShardsCoveredByDelete(querySpec); err != nil {
+		return err
+	}
 	querySpec.RunAgainstAllServersInShard = true
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
 
+// A delete of all the series drops the shards that are entirely in its
+// time range, instead of deleting their points one at a time
+func (self *CoordinatorImpl) dropShardsCoveredByDelete(querySpec *parser.QuerySpec) error {
+	query := querySpec.DeleteQuery()
+	if !deletesAllSeries(query) {
+		return nil
+	}
+	for _, shard := range self.clusterConfiguration.GetShardsInTimeRange(querySpec.Database(), query.GetStartTime(), query.GetEndTime()) {
+		log.Info("Dropping shard %d, it's entirely in the time range of: %s", shard.Id(), querySpec.GetQueryString())
+		if err := self.raftServer.DropShard(shard.Id(), shard.ServerIds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deletesAllSeries(query *parser.DeleteQuery) bool {
+	from := query.GetFromClause()
+	if from.Type != parser.FromClauseArray {
+		return false
+	}
+	for _, name := range from.Names {
+		if regex, ok := name.Name.GetCompiledRegex(); ok && regex.String() == ".*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
 	user := querySpec.User()
 	db := querySpec.Database()
@@ -216,6 +710,7 @@ func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, ser
 	if ok, err := self.permissions.AuthorizeDropSeries(user, db, series); !ok {
 		return err
 	}
+	defer self.queryCache.clear(db)
 	querySpec.RunAgainstAllServersInShard = true
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
@@ -229,6 +724,23 @@ func (self *CoordinatorImpl) shouldAggregateLocally(shards []*cluster.ShardData,
 	return true
 }
 
+// Returns the number of shards that are queried at the same time, used
+// by the queries and their explanation
+func (self *CoordinatorImpl) shardConcurrentLimit(shards []*cluster.ShardData, querySpec *parser.QuerySpec) int {
+	if !self.shouldQuerySequentially(shards, querySpec) {
+		return self.config.ConcurrentShardQueryLimit
+	}
+	// a local shard that gets ahead of the query processor blocks once
+	// its response channel is full, so local shards can be read
+	// concurrently without buffering more than
+	// ClusterMaxResponseBufferSize responses each. The responses are
+	// still processed one shard at a time in time order.
+	if allShardsLocal(shards) && self.config.ConcurrentLocalShardQueryLimit > 1 {
+		return self.config.ConcurrentLocalShardQueryLimit
+	}
+	return 1
+}
+
 func (self *CoordinatorImpl) shouldQuerySequentially(shards []*cluster.ShardData, querySpec *parser.QuerySpec) bool {
 	// if the query isn't a select, then it doesn't matter
 	if querySpec.SelectQuery() == nil {
@@ -277,7 +789,16 @@ func (self *CoordinatorImpl) shouldQuerySequentially(shards []*cluster.ShardData
 	return false
 }
 
-func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec, writer SeriesWriter) ([]*cluster.ShardData, cluster.QueryProcessor, chan bool, error) {
+func allShardsLocal(shards []*cluster.ShardData) bool {
+	for _, shard := range shards {
+		if !shard.IsLocal {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec, writer SeriesWriter) ([]*cluster.ShardData, cluster.QueryProcessor, chan error, error) {
 	shards := self.clusterConfiguration.GetShards(querySpec)
 	shouldAggregateLocally := self.shouldAggregateLocally(shards, querySpec)
 
@@ -285,18 +806,17 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 	var processor cluster.QueryProcessor
 
 	responseChan := make(chan *protocol.Response)
-	seriesClosed := make(chan bool)
 
 	selectQuery := querySpec.SelectQuery()
 	if selectQuery != nil {
 		if !shouldAggregateLocally {
 			// if we should aggregate in the coordinator (i.e. aggregation
 			// isn't happening locally at the shard level), create an engine
-			processor, err = engine.NewQueryEngine(querySpec.SelectQuery(), responseChan)
+			processor, err = engine.NewQueryEngineWithConfig(querySpec.SelectQuery(), responseChan, self.engineConfig)
 		} else {
 			// if we have a query with limit, then create an engine, or we can
 			// make the passthrough limit aware
-			processor = engine.NewPassthroughEngineWithLimit(responseChan, 100, selectQuery.Limit)
+			processor = engine.NewPassthroughEngineWithLimit(responseChan, 100, selectQuery.LimitWithOffset())
 		}
 	} else if !shouldAggregateLocally {
 		processor = engine.NewPassthroughEngine(responseChan, 100)
@@ -310,13 +830,25 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 		return shards, nil, nil, nil
 	}
 
+	return shards, processor, self.writeResponses(querySpec, responseChan, writer), nil
+}
+
+// Writes the series the processor sends on the response channel to the
+// writer, the returned channel gets the error the processor ended the
+// stream with, if any, once the writer is closed
+func (self *CoordinatorImpl) writeResponses(querySpec *parser.QuerySpec, responseChan <-chan *protocol.Response, writer SeriesWriter) chan error {
+	seriesClosed := make(chan error)
 	go func() {
 		for {
 			response := <-responseChan
 
 			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
 				writer.Close()
-				seriesClosed <- true
+				var err error
+				if response.ErrorMessage != nil {
+					err = common.NewQueryError(common.InvalidArgument, "%s", *response.ErrorMessage)
+				}
+				seriesClosed <- err
 				return
 			}
 			if !(*response.Type == queryResponse && querySpec.IsExplainQuery()) {
@@ -326,17 +858,31 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 			}
 		}
 	}()
+	return seriesClosed
+}
 
-	return shards, processor, seriesClosed, nil
+// Whether the query is done once the processor stops taking points,
+// instead of once the limit of one of its series is reached
+func limitEndsQuery(querySpec *parser.QuerySpec) bool {
+	query := querySpec.SelectQuery()
+	if query == nil || query.Limit <= 0 || querySpec.IsRegex() {
+		return false
+	}
+	fromClause := query.GetFromClause()
+	return fromClause.Type == parser.FromClauseArray && len(fromClause.Names) == 1
 }
 
 func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryProcessor,
 	writer SeriesWriter,
-	isExplainQuery bool,
+	querySpec *parser.QuerySpec,
 	errors chan<- error,
-	channels <-chan (<-chan *protocol.Response)) {
+	channels <-chan (<-chan *protocol.Response),
+	limitReached chan<- struct{}) {
 
 	defer close(errors)
+	isExplainQuery := querySpec.IsExplainQuery()
+	endsWithLimit := limitEndsQuery(querySpec)
+	reachedLimit := false
 
 	for responseChan := range channels {
 		for response := range responseChan {
@@ -348,7 +894,7 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 					break
 				}
 
-				err := common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				err := common.NewQueryError(common.InvalidArgument, "%s", *response.ErrorMessage)
 				log.Error("Error while executing query: %s", err)
 				errors <- err
 				return
@@ -359,6 +905,13 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 				continue
 			}
 
+			// keep draining the responses of a cancelled query until
+			// the shards notice and end the stream, same for the shards
+			// that were already queried once the limit is reached
+			if querySpec.IsCancelled() || reachedLimit {
+				continue
+			}
+
 			// if we don't have a processor, yield the point to the writer
 			// this happens if shard took care of the query
 			// otherwise client will get points from passthrough engine
@@ -366,7 +919,11 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 				// if the data wasn't aggregated at the shard level, aggregate
 				// the data here
 				log.Debug("YIELDING: %d points with %d columns", len(response.Series.Points), len(response.Series.Fields))
-				processor.YieldSeries(response.Series)
+				if !processor.YieldSeries(response.Series) && endsWithLimit {
+					log.Debug("The limit of the query was reached, not querying more shards")
+					reachedLimit = true
+					close(limitReached)
+				}
 				continue
 			}
 
@@ -386,7 +943,8 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 
 func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*cluster.ShardData,
 	errors <-chan error,
-	responseChannels chan<- (<-chan *protocol.Response)) error {
+	responseChannels chan<- (<-chan *protocol.Response),
+	limitReached <-chan struct{}) error {
 	defer close(responseChannels)
 
 	for i := 0; i < len(shards); i++ {
@@ -397,6 +955,16 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 		if err != nil {
 			return err
 		}
+		if querySpec.IsCancelled() {
+			return common.QueryCancelledError
+		}
+		// the shards are queried in time order, the remaining ones
+		// can't have points the query still needs
+		select {
+		case <-limitReached:
+			return nil
+		default:
+		}
 		shard := shards[i]
 		bufferSize := shard.QueryResponseBufferSize(querySpec, self.config.StoragePointBatchSize)
 		if bufferSize > self.config.ClusterMaxResponseBufferSize {
@@ -412,26 +980,25 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 	return nil
 }
 
-func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) (err error) {
 	shards, processor, seriesClosed, err := self.getShardsAndProcessor(querySpec, seriesWriter)
 	if err != nil {
 		return err
 	}
+	querySpec.AddShardsQueried(len(shards))
 
 	defer func() {
 		if processor != nil {
 			processor.Close()
-			<-seriesClosed
+			if closeErr := <-seriesClosed; err == nil {
+				err = closeErr
+			}
 		} else {
 			seriesWriter.Close()
 		}
 	}()
 
-	shardConcurrentLimit := self.config.ConcurrentShardQueryLimit
-	if self.shouldQuerySequentially(shards, querySpec) {
-		log.Debug("Querying shards sequentially")
-		shardConcurrentLimit = 1
-	}
+	shardConcurrentLimit := self.shardConcurrentLimit(shards, querySpec)
 	log.Debug("Shard concurrent limit: %d", shardConcurrentLimit)
 
 	errors := make(chan error, shardConcurrentLimit)
@@ -439,10 +1006,11 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 		errors <- nil
 	}
 	responseChannels := make(chan (<-chan *protocol.Response), shardConcurrentLimit)
+	limitReached := make(chan struct{})
 
-	go self.readFromResponseChannels(processor, seriesWriter, querySpec.IsExplainQuery(), errors, responseChannels)
+	go self.readFromResponseChannels(processor, seriesWriter, querySpec, errors, responseChannels, limitReached)
 
-	err = self.queryShards(querySpec, shards, errors, responseChannels)
+	err = self.queryShards(querySpec, shards, errors, responseChannels, limitReached)
 
 	// make sure we read the rest of the errors and responses
 	for _err := range errors {
@@ -457,7 +1025,7 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 				continue
 			}
 			if response.ErrorMessage != nil && err == nil {
-				err = common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				err = common.NewQueryError(common.InvalidArgument, "%s", *response.ErrorMessage)
 			}
 			break
 		}
@@ -474,11 +1042,34 @@ func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 }
 
 func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series []*protocol.Series) error {
-	// make sure that the db exist
-	if !self.clusterConfiguration.DatabasesExists(db) {
+	return self.WriteSeriesDataWithConsistency(user, db, series, cluster.ConsistencyAny)
+}
+
+// Same as WriteSeriesData but doesn't return until the number of
+// replicas required by the consistency level acknowledged the write
+func (self *CoordinatorImpl) WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.ConsistencyLevel) error {
+	if err := self.startRequest(); err != nil {
+		return err
+	}
+	defer self.endRequest()
+
+	// make sure that the db exist, or the named retention policy when
+	// db is one of theirs
+	if !self.clusterConfiguration.PolicyDatabaseExists(db) {
+		if _, policy := cluster.SplitPolicyDatabase(db); policy != "" {
+			return fmt.Errorf("Retention policy %s doesn't exist", policy)
+		}
 		return fmt.Errorf("Database %s doesn't exist", db)
 	}
 
+	// shed the load instead of buffering more writes than the local
+	// shards can keep up with
+	if mark := self.config.WriteBufferHighWaterMark; mark > 0 {
+		if depth := self.clusterConfiguration.LocalWriteBufferDepth(); depth >= mark {
+			return common.NewWriteBufferFullError(depth, mark)
+		}
+	}
+
 	for _, s := range series {
 		seriesName := s.GetName()
 		if user.HasWriteAccess(seriesName) {
@@ -487,16 +1078,109 @@ func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series
 		return common.NewAuthorizationError("User %s doesn't have write permissions for %s", user.GetName(), seriesName)
 	}
 
-	err := self.CommitSeriesData(db, series, false)
-	if err != nil {
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	if err := self.quotas.TakeWrite(db, user, points); err != nil {
 		return err
 	}
+	written := 0
+	defer func() {
+		self.quotas.CountWrite(db, user, points, written)
+	}()
 
+	accepted, pointErrors := self.acceptPointsInWindow(series)
+	if len(accepted.series) > 0 {
+		err := self.commitSeriesData(db, accepted.series, false, consistency)
+		if partialErr, ok := err.(*common.PartialWriteError); ok {
+			pointErrors = append(pointErrors, accepted.originalIndexes(partialErr.Errors)...)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// the points that weren't written were removed from the series, the
+	// subscribers only get the points that were written
+	writtenSeries := make([]*protocol.Series, 0, len(series))
 	for _, s := range series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		atomic.AddInt64(&self.pointsWritten, int64(len(s.Points)))
 		self.ProcessContinuousQueries(db, s)
+		writtenSeries = append(writtenSeries, s)
+		written += len(s.Points)
 	}
+	self.subscriptions.Publish(db, writtenSeries)
 
-	return err
+	if len(pointErrors) > 0 {
+		return &common.PartialWriteError{pointErrors}
+	}
+	return nil
+}
+
+// The series of a write left with the points in the write window, and
+// the indexes of the series and of their points in the write. The
+// indexes of the points are nil if none of them were removed.
+type acceptedSeries struct {
+	series        []*protocol.Series
+	seriesIndexes []int
+	pointIndexes  [][]int
+}
+
+// Translates the indexes of the errors of the accepted series into
+// indexes in the write
+func (self *acceptedSeries) originalIndexes(pointErrors []*common.PointError) []*common.PointError {
+	for _, pointError := range pointErrors {
+		if indexes := self.pointIndexes[pointError.Series]; indexes != nil {
+			pointError.Point = indexes[pointError.Point]
+		}
+		pointError.Series = self.seriesIndexes[pointError.Series]
+	}
+	return pointErrors
+}
+
+// Removes the points further than write-max-future ahead or write-max-age
+// behind the server time from the series, returning an error for each
+// of them. Only the writes of the clients are checked, the points the
+// continuous queries write keep the timestamps of the points they're
+// computed from.
+func (self *CoordinatorImpl) acceptPointsInWindow(series []*protocol.Series) (*acceptedSeries, []*common.PointError) {
+	accepted := &acceptedSeries{
+		series:        make([]*protocol.Series, 0, len(series)),
+		seriesIndexes: make([]int, 0, len(series)),
+		pointIndexes:  make([][]int, 0, len(series)),
+	}
+	checked := self.config.WriteMaxFuture > 0 || self.config.WriteMaxAge > 0
+	now := common.CurrentTime()
+	var pointErrors []*common.PointError
+	for seriesIndex, s := range series {
+		var indexes []int
+		if checked && len(s.Points) > 0 {
+			points := make([]*protocol.Point, 0, len(s.Points))
+			indexes = make([]int, 0, len(s.Points))
+			for pointIndex, point := range s.Points {
+				// the points without a timestamp get the server time
+				if point.Timestamp != nil {
+					if err := self.checkTimestamp(point.GetTimestamp(), now); err != nil {
+						pointErrors = append(pointErrors, common.NewPointError(seriesIndex, pointIndex, err))
+						continue
+					}
+				}
+				points = append(points, point)
+				indexes = append(indexes, pointIndex)
+			}
+			s.Points = points
+			if len(points) == 0 {
+				continue
+			}
+		}
+		accepted.series = append(accepted.series, s)
+		accepted.seriesIndexes = append(accepted.seriesIndexes, seriesIndex)
+		accepted.pointIndexes = append(accepted.pointIndexes, indexes)
+	}
+	return accepted, pointErrors
 }
 
 func (self *CoordinatorImpl) ProcessContinuousQueries(db string, series *protocol.Series) {
@@ -516,11 +1200,11 @@ func (self *CoordinatorImpl) ProcessContinuousQueries(db string, series *protoco
 				tableValue := table.Name
 				if regex, ok := tableValue.GetCompiledRegex(); ok {
 					if regex.MatchString(incomingSeriesName) {
-						self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, false)
+						self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, nil)
 					}
 				} else {
 					if tableValue.Name == incomingSeriesName {
-						self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, false)
+						self.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, nil)
 					}
 				}
 			}
@@ -528,15 +1212,38 @@ func (self *CoordinatorImpl) ProcessContinuousQueries(db string, series *protoco
 	}
 }
 
-func (self *CoordinatorImpl) InterpolateValuesAndCommit(query string, db string, series *protocol.Series, targetName string, assignSequenceNumbers bool) error {
+type intoSequenceKey struct {
+	seriesName string
+	timestamp  int64
+}
+
+// Numbers the points an INTO query writes by their series and
+// timestamp. A run of the query over a time range uses one for all the
+// series it returns, so the numbers only depend on the points of the
+// range and running the query again, e.g. to retry a failed run of a
+// continuous query, overwrites the points it wrote instead of
+// duplicating them.
+type IntoSequenceNumbers map[intoSequenceKey]uint64
+
+func (self IntoSequenceNumbers) next(seriesName string, timestamp int64) *uint64 {
+	key := intoSequenceKey{seriesName, timestamp}
+	self[key]++
+	sequenceNumber := self[key]
+	return &sequenceNumber
+}
+
+// Writes the series into the target of the query, the points keep
+// their sequence numbers if sequenceNumbers is nil
+func (self *CoordinatorImpl) InterpolateValuesAndCommit(query string, db string, series *protocol.Series, targetName string, sequenceNumbers IntoSequenceNumbers) error {
 	defer common.RecoverFunc(db, query, nil)
 
-	targetName = strings.Replace(targetName, ":series_name", *series.Name, -1)
-	type sequenceKey struct {
-		seriesName string
-		timestamp  int64
+	// a target like policy:name writes into the named retention policy of
+	// db, e.g. to keep the rollups longer than the raw points
+	if i := strings.Index(targetName, ":"); i > 0 && self.clusterConfiguration.NamedRetentionPolicyExists(db, targetName[:i]) {
+		db, targetName = cluster.PolicyDatabase(db, targetName[:i]), targetName[i+1:]
 	}
-	sequenceMap := make(map[sequenceKey]int)
+
+	targetName = strings.Replace(targetName, ":series_name", *series.Name, -1)
 	r, _ := regexp.Compile(`\[.*?\]`)
 
 	// get the fields that are used in the target name
@@ -588,11 +1295,8 @@ nextfield:
 				p.Values = append(p.Values, v)
 			}
 
-			if assignSequenceNumbers {
-				key := sequenceKey{targetNameWithValues, *p.Timestamp}
-				sequenceMap[key] += 1
-				sequenceNumber := uint64(sequenceMap[key])
-				p.SequenceNumber = &sequenceNumber
+			if sequenceNumbers != nil {
+				p.SequenceNumber = sequenceNumbers.next(targetNameWithValues, *p.Timestamp)
 			}
 
 			newSeries := serieses[targetNameWithValues]
@@ -613,11 +1317,9 @@ nextfield:
 	} else {
 		newSeries := &protocol.Series{Name: &targetName, Fields: fields, Points: series.Points}
 
-		if assignSequenceNumbers {
+		if sequenceNumbers != nil {
 			for _, point := range newSeries.Points {
-				sequenceMap[sequenceKey{targetName, *point.Timestamp}] += 1
-				sequenceNumber := uint64(sequenceMap[sequenceKey{targetName, *point.Timestamp}])
-				point.SequenceNumber = &sequenceNumber
+				point.SequenceNumber = sequenceNumbers.next(targetName, *point.Timestamp)
 			}
 		}
 
@@ -630,12 +1332,36 @@ nextfield:
 }
 
 func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Series, sync bool) error {
+	return self.commitSeriesData(db, serieses, sync, cluster.ConsistencyAny)
+}
+
+// Returns an error if the timestamp, in microseconds, is more than
+// write-max-future ahead of now or more than write-max-age behind it,
+// counting the points rejected
+func (self *CoordinatorImpl) checkTimestamp(timestamp, now int64) error {
+	maxFuture := self.config.WriteMaxFuture
+	if maxFuture > 0 && timestamp > now+int64(maxFuture/time.Microsecond) {
+		atomic.AddInt64(&self.pointsTooFarInFuture, 1)
+		return fmt.Errorf("The timestamp %d is more than %s ahead of the server time %d, check the clock of the client", timestamp, maxFuture, now)
+	}
+	maxAge := self.config.WriteMaxAge
+	if maxAge > 0 && timestamp < now-int64(maxAge/time.Microsecond) {
+		atomic.AddInt64(&self.pointsTooOld, 1)
+		return fmt.Errorf("The timestamp %d is more than %s behind the server time %d, points older than the write-max-age are rejected", timestamp, maxAge, now)
+	}
+	return nil
+}
+
+func (self *CoordinatorImpl) commitSeriesData(db string, serieses []*protocol.Series, sync bool, consistency cluster.ConsistencyLevel) error {
 	now := common.CurrentTime()
+	defer self.invalidateQueryCache(db, serieses)
 
 	shardToSerieses := map[uint32]map[string]*protocol.Series{}
 	shardIdToShard := map[uint32]*cluster.ShardData{}
+	// points that can't be written don't fail the whole batch
+	var pointErrors []*common.PointError
 
-	for _, series := range serieses {
+	for seriesIndex, series := range serieses {
 		if len(series.Points) == 0 {
 			return fmt.Errorf("Can't write series with zero points.")
 		}
@@ -646,6 +1372,13 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 			}
 		}
 
+		// keep the original order of the points to report errors by index
+		originalIndexes := make(map[*protocol.Point]int, len(series.Points))
+		for idx, point := range series.Points {
+			originalIndexes[point] = idx
+		}
+		failed := 0
+
 		// sort the points by timestamp
 		// TODO: this isn't needed anymore
 		series.SortPointsTimeDescending()
@@ -655,15 +1388,20 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 				return fmt.Errorf("Series name cannot be empty")
 			}
 
-			shard, err := self.clusterConfiguration.GetShardToWriteToBySeriesAndTime(db, series.GetName(), series.Points[i].GetTimestamp())
-			if err != nil {
-				return err
-			}
 			firstIndex := i
 			timestamp := series.Points[i].GetTimestamp()
 			for ; i < len(series.Points) && series.Points[i].GetTimestamp() == timestamp; i++ {
 				// add all points with the same timestamp
 			}
+			shard, err := self.clusterConfiguration.GetShardToWriteToBySeriesAndTime(db, series.GetName(), timestamp)
+			if err != nil {
+				for _, point := range series.Points[firstIndex:i] {
+					pointErrors = append(pointErrors, common.NewPointError(seriesIndex, originalIndexes[point], err))
+					delete(originalIndexes, point)
+				}
+				failed += i - firstIndex
+				continue
+			}
 			newSeries := &protocol.Series{Name: series.Name, Fields: series.Fields, Points: series.Points[firstIndex:i:i]}
 
 			shardIdToShard[shard.Id()] = shard
@@ -680,6 +1418,18 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 			}
 			shardSerieses[seriesName] = common.MergeSeries(s, newSeries)
 		}
+
+		// leave only the points that are written in the series, the caller
+		// counts them and passes them on to the continuous queries
+		if failed > 0 {
+			written := make([]*protocol.Point, 0, len(series.Points)-failed)
+			for _, point := range series.Points {
+				if _, ok := originalIndexes[point]; ok {
+					written = append(written, point)
+				}
+			}
+			series.Points = written
+		}
 	}
 
 	for id, serieses := range shardToSerieses {
@@ -690,50 +1440,60 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 			seriesesSlice = append(seriesesSlice, s)
 		}
 
-		err := self.write(db, seriesesSlice, shard, sync)
+		err := self.write(db, seriesesSlice, shard, sync, consistency)
 		if err != nil {
 			log.Error("COORD error writing: ", err)
 			return err
 		}
 	}
 
+	if len(pointErrors) > 0 {
+		return &common.PartialWriteError{pointErrors}
+	}
 	return nil
 }
 
-func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool) error {
+func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool, consistency cluster.ConsistencyLevel) error {
 	request := &protocol.Request{Type: &write, Database: &db, MultiSeries: series}
 	// break the request if it's too big
 	if request.Size() >= MAX_REQUEST_SIZE {
 		if l := len(series); l > 1 {
 			// create two requests with half the serie
-			if err := self.write(db, series[:l/2], shard, sync); err != nil {
+			if err := self.write(db, series[:l/2], shard, sync, consistency); err != nil {
 				return err
 			}
-			return self.write(db, series[l/2:], shard, sync)
+			return self.write(db, series[l/2:], shard, sync, consistency)
 		}
 
 		// otherwise, split the points of the only series
 		s := series[0]
 		l := len(s.Points)
 		s1 := &protocol.Series{Name: s.Name, Fields: s.Fields, Points: s.Points[:l/2]}
-		if err := self.write(db, []*protocol.Series{s1}, shard, sync); err != nil {
+		if err := self.write(db, []*protocol.Series{s1}, shard, sync, consistency); err != nil {
 			return err
 		}
 		s2 := &protocol.Series{Name: s.Name, Fields: s.Fields, Points: s.Points[l/2:]}
-		return self.write(db, []*protocol.Series{s2}, shard, sync)
+		return self.write(db, []*protocol.Series{s2}, shard, sync, consistency)
 	}
 	if sync {
 		return shard.SyncWrite(request)
 	}
+	if consistency != cluster.ConsistencyAny {
+		return shard.WriteWithConsistency(request, consistency)
+	}
 	return shard.Write(request)
 }
 
 func (self *CoordinatorImpl) CreateContinuousQuery(user common.User, db string, query string) error {
+	return self.CreateContinuousQueryWithBackfill(user, db, query, 0)
+}
+
+func (self *CoordinatorImpl) CreateContinuousQueryWithBackfill(user common.User, db string, query string, backfill time.Duration) error {
 	if ok, err := self.permissions.AuthorizeCreateContinuousQuery(user, db); !ok {
 		return err
 	}
 
-	err := self.raftServer.CreateContinuousQuery(db, query)
+	err := self.raftServer.CreateContinuousQueryWithBackfill(db, query, backfill)
 	if err != nil {
 		return err
 	}
@@ -779,7 +1539,72 @@ func (self *CoordinatorImpl) ListContinuousQueries(user common.User, db string)
 	return series, nil
 }
 
-func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
+func (self *CoordinatorImpl) SetRetentionPolicy(user common.User, db string, retention time.Duration) error {
+	if ok, err := self.permissions.AuthorizeChangeRetentionPolicy(user); !ok {
+		return err
+	}
+
+	if retention < 0 {
+		return fmt.Errorf("Retention policy cannot be negative")
+	}
+	return self.raftServer.SetRetentionPolicy(db, retention)
+}
+
+func (self *CoordinatorImpl) GetRetentionPolicy(user common.User, db string) (time.Duration, error) {
+	if ok, err := self.permissions.AuthorizeGetRetentionPolicy(user, db); !ok {
+		return 0, err
+	}
+	return self.clusterConfiguration.GetRetentionPolicy(db)
+}
+
+func (self *CoordinatorImpl) SetNamedRetentionPolicy(user common.User, db, name string, retention time.Duration) error {
+	if ok, err := self.permissions.AuthorizeChangeRetentionPolicy(user); !ok {
+		return err
+	}
+
+	if !isValidName(name) || name == "" {
+		return fmt.Errorf("%s isn't a valid retention policy name", name)
+	}
+	if retention < 0 {
+		return fmt.Errorf("Retention policy cannot be negative")
+	}
+	return self.raftServer.SetNamedRetentionPolicy(db, name, retention)
+}
+
+// Deletes the policy and drops its points from all the shards
+func (self *CoordinatorImpl) DeleteNamedRetentionPolicy(user common.User, db, name string) error {
+	if ok, err := self.permissions.AuthorizeChangeRetentionPolicy(user); !ok {
+		return err
+	}
+
+	if err := self.clusterConfiguration.CreateCheckpoint(); err != nil {
+		return err
+	}
+
+	if err := self.raftServer.DeleteNamedRetentionPolicy(db, name); err != nil {
+		return err
+	}
+	self.dropFromAllShards(cluster.PolicyDatabase(db, name))
+	return nil
+}
+
+func (self *CoordinatorImpl) ListNamedRetentionPolicies(user common.User, db string) (map[string]time.Duration, error) {
+	if ok, err := self.permissions.AuthorizeGetRetentionPolicy(user, db); !ok {
+		return nil, err
+	}
+	return self.clusterConfiguration.GetNamedRetentionPolicies(db)
+}
+
+// Returns the database the points of the named policy of db are kept
+// under, db itself if name is empty
+func (self *CoordinatorImpl) RetentionPolicyDatabase(user common.User, db, name string) (string, error) {
+	if name != "" && !self.clusterConfiguration.NamedRetentionPolicyExists(db, name) {
+		return "", fmt.Errorf("Retention policy %s of %s doesn't exist", name, db)
+	}
+	return cluster.PolicyDatabase(db, name), nil
+}
+
+func (self *CoordinatorImpl) CreateDatabase(user common.User, db string, replicationFactor uint8) error {
 	if ok, err := self.permissions.AuthorizeCreateDatabase(user); !ok {
 		return err
 	}
@@ -788,13 +1613,60 @@ func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
 		return fmt.Errorf("%s isn't a valid db name", db)
 	}
 
-	err := self.raftServer.CreateDatabase(db)
+	err := self.raftServer.CreateDatabase(db, replicationFactor)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self *CoordinatorImpl) SetDatabaseReplicationFactor(user common.User, db string, replicationFactor uint8) error {
+	if ok, err := self.permissions.AuthorizeCreateDatabase(user); !ok {
+		return err
+	}
+
+	previous, err := self.clusterConfiguration.GetDatabaseReplicationFactor(db)
 	if err != nil {
 		return err
 	}
+	if err := self.raftServer.SetDatabaseReplicationFactor(db, replicationFactor); err != nil {
+		return err
+	}
+	current, _ := self.clusterConfiguration.GetDatabaseReplicationFactor(db)
+	if current != previous {
+		log.Warn("The replication factor of %s changed from %d to %d, the existing shards keep their replicas and only the shards created from now on are replicated %d times", db, previous, current, current)
+	}
 	return nil
 }
 
+func (self *CoordinatorImpl) SetDuplicatePointPolicy(user common.User, db string, policy cluster.DuplicatePointPolicy) error {
+	if ok, err := self.permissions.AuthorizeCreateDatabase(user); !ok {
+		return err
+	}
+
+	if _, err := cluster.ParseDuplicatePointPolicy(string(policy)); err != nil {
+		return err
+	}
+	return self.raftServer.SetDuplicatePointPolicy(db, policy)
+}
+
+func (self *CoordinatorImpl) GetDuplicatePointPolicy(user common.User, db string) (cluster.DuplicatePointPolicy, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return "", common.NewAuthorizationError("Insufficient permissions to get the duplicate point policy of %s", db)
+	}
+	if !self.clusterConfiguration.DatabasesExists(db) {
+		return "", fmt.Errorf("Database %s doesn't exist", db)
+	}
+	return self.clusterConfiguration.GetDuplicatePointPolicy(db), nil
+}
+
+func (self *CoordinatorImpl) GetDatabaseReplicationFactor(user common.User, db string) (int, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return 0, common.NewAuthorizationError("Insufficient permissions to get the replication factor of %s", db)
+	}
+	return self.clusterConfiguration.GetDatabaseReplicationFactor(db)
+}
+
 func (self *CoordinatorImpl) ListDatabases(user common.User) ([]*cluster.Database, error) {
 	if ok, err := self.permissions.AuthorizeListDatabases(user); !ok {
 		return nil, err
@@ -813,10 +1685,33 @@ func (self *CoordinatorImpl) DropDatabase(user common.User, db string) error {
 		return err
 	}
 
+	// the points of the named policies go away with the database
+	policies, _ := self.clusterConfiguration.GetNamedRetentionPolicies(db)
+
 	if err := self.raftServer.DropDatabase(db); err != nil {
 		return err
 	}
 
+	// every server drops the data of its shards when it applies the
+	// drop, the servers that are down once they catch up. The writes
+	// that come after a server applied the drop are discarded by its
+	// datastore.
+	self.dropFromAllShards(db)
+	self.queryCache.clear(db)
+	for name := range policies {
+		self.dropFromAllShards(cluster.PolicyDatabase(db, name))
+		self.queryCache.clear(cluster.PolicyDatabase(db, name))
+	}
+	for _, pending := range self.clusterConfiguration.PendingWalRequests() {
+		if pending > 0 {
+			log.Warn("Dropped database %s while the wal still has requests for other servers, their writes to it are discarded", db)
+			break
+		}
+	}
+	return nil
+}
+
+func (self *CoordinatorImpl) dropFromAllShards(db string) {
 	var wait sync.WaitGroup
 	for _, shard := range self.clusterConfiguration.GetAllShards() {
 		wait.Add(1)
@@ -826,7 +1721,6 @@ func (self *CoordinatorImpl) DropDatabase(user common.User, db string) error {
 		}(shard)
 	}
 	wait.Wait()
-	return nil
 }
 
 func (self *CoordinatorImpl) AuthenticateDbUser(db, username, password string) (common.User, error) {
@@ -834,12 +1728,101 @@ func (self *CoordinatorImpl) AuthenticateDbUser(db, username, password string) (
 	user, err := self.clusterConfiguration.AuthenticateDbUser(db, username, password)
 	if user != nil {
 		log.Debug("(raft:%s) User %s authenticated succesfully", self.raftServer.(*RaftServer).raftServer.Name(), username)
+		if dbUser, ok := user.(*cluster.DbUser); ok && dbUser.NeedsRehash(self.config.PasswordHashCost) {
+			if self.startRehash(dbUser.Db + ":" + dbUser.Name) {
+				go self.rehashDbUserPassword(dbUser.Db, dbUser.Name, dbUser.Hash, password)
+			}
+		}
 	}
 	return user, err
 }
 
 func (self *CoordinatorImpl) AuthenticateClusterAdmin(username, password string) (common.User, error) {
-	return self.clusterConfiguration.AuthenticateClusterAdmin(username, password)
+	user, err := self.clusterConfiguration.AuthenticateClusterAdmin(username, password)
+	if admin, ok := user.(*cluster.ClusterAdmin); ok && admin.NeedsRehash(self.config.PasswordHashCost) {
+		if self.startRehash(admin.Name) {
+			go self.rehashClusterAdminPassword(admin.Name, admin.Hash, password)
+		}
+	}
+	return user, err
+}
+
+// Returns a token that authenticates as the requester until it expires
+// or is revoked
+func (self *CoordinatorImpl) CreateAuthToken(requester common.User, ttl time.Duration) (string, time.Time, error) {
+	token, authToken, err := cluster.NewAuthToken(requester.GetDb(), requester.GetName(), ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := self.raftServer.SaveAuthToken(authToken); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, authToken.Expires, nil
+}
+
+func (self *CoordinatorImpl) AuthenticateToken(token string) (common.User, error) {
+	return self.clusterConfiguration.AuthenticateToken(token)
+}
+
+// Revokes the token, anyone that has the token can revoke it
+func (self *CoordinatorImpl) DeleteAuthToken(token string) error {
+	hash := cluster.HashAuthToken(token)
+	if self.clusterConfiguration.GetAuthToken(hash) == nil {
+		return common.NewAuthenticationError("Invalid or expired token")
+	}
+	return self.raftServer.DeleteAuthToken(hash)
+}
+
+// Returns false if the password of the user, db:name for the database
+// users, is already being hashed again. The logins that come while the
+// new hash goes through raft don't hash it again.
+func (self *CoordinatorImpl) startRehash(user string) bool {
+	self.rehashingLock.Lock()
+	defer self.rehashingLock.Unlock()
+	if self.rehashing[user] {
+		return false
+	}
+	self.rehashing[user] = true
+	return true
+}
+
+func (self *CoordinatorImpl) endRehash(user string) {
+	self.rehashingLock.Lock()
+	defer self.rehashingLock.Unlock()
+	delete(self.rehashing, user)
+}
+
+// Hashes the password of a user that logged in again with the
+// configured cost. It's done in the background, since it goes through
+// raft and the login doesn't have to wait for it. The new hash replaces
+// oldHash, the one the password was verified against, only if the
+// password wasn't changed in the meantime.
+func (self *CoordinatorImpl) rehashDbUserPassword(db, username, oldHash, password string) {
+	defer self.endRehash(db + ":" + username)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
+	if err != nil {
+		log.Error("Cannot hash the password of %s:%s: %s", db, username, err)
+		return
+	}
+	if err := self.raftServer.RehashUserPassword(db, username, []byte(oldHash), hash); err != nil {
+		log.Error("Cannot change the password hash of %s:%s: %s", db, username, err)
+		return
+	}
+	log.Info("Hashed the password of %s:%s again", db, username)
+}
+
+func (self *CoordinatorImpl) rehashClusterAdminPassword(username, oldHash, password string) {
+	defer self.endRehash(username)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
+	if err != nil {
+		log.Error("Cannot hash the password of %s: %s", username, err)
+		return
+	}
+	if err := self.raftServer.RehashUserPassword("", username, []byte(oldHash), hash); err != nil {
+		log.Error("Cannot change the password hash of %s: %s", username, err)
+		return
+	}
+	log.Info("Hashed the password of %s again", username)
 }
 
 func (self *CoordinatorImpl) ListClusterAdmins(requester common.User) ([]string, error) {
@@ -859,7 +1842,7 @@ func (self *CoordinatorImpl) CreateClusterAdminUser(requester common.User, usern
 		return fmt.Errorf("%s isn't a valid username", username)
 	}
 
-	hash, err := cluster.HashPassword(password)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
 	if err != nil {
 		return err
 	}
@@ -895,7 +1878,7 @@ func (self *CoordinatorImpl) ChangeClusterAdminPassword(requester common.User, u
 		return fmt.Errorf("Invalid user name %s", username)
 	}
 
-	hash, err := cluster.HashPassword(password)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
 	if err != nil {
 		return err
 	}
@@ -916,7 +1899,7 @@ func (self *CoordinatorImpl) CreateDbUser(requester common.User, db, username, p
 		return fmt.Errorf("%s isn't a valid username", username)
 	}
 
-	hash, err := cluster.HashPassword(password)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
 	if err != nil {
 		return err
 	}
@@ -983,7 +1966,7 @@ func (self *CoordinatorImpl) ChangeDbUserPassword(requester common.User, db, use
 		return err
 	}
 
-	hash, err := cluster.HashPassword(password)
+	hash, err := cluster.HashPassword(password, self.config.PasswordHashCost)
 	if err != nil {
 		return err
 	}
@@ -998,6 +1981,40 @@ func (self *CoordinatorImpl) ChangeDbUserPermissions(requester common.User, db,
 	return self.raftServer.ChangeDbUserPermissions(db, username, readPermissions, writePermissions)
 }
 
+func (self *CoordinatorImpl) GrantDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error {
+	if ok, err := self.permissions.AuthorizeChangeDbUserPermissions(requester, db); !ok {
+		return err
+	}
+	if regex == "" {
+		regex = ".*"
+	}
+	if _, err := regexp.Compile(regex); err != nil {
+		return common.NewQueryError(common.InvalidArgument, "Invalid permission %s: %s", regex, err)
+	}
+
+	user := self.clusterConfiguration.GetDbUser(db, username)
+	if user == nil {
+		return fmt.Errorf("Invalid username %s", username)
+	}
+	updated := *user
+	updated.GrantPermissions(read, write, regex)
+	return self.raftServer.SaveDbUser(&updated)
+}
+
+func (self *CoordinatorImpl) RevokeDbUserPermissions(requester common.User, db, username string, read, write bool, regex string) error {
+	if ok, err := self.permissions.AuthorizeChangeDbUserPermissions(requester, db); !ok {
+		return err
+	}
+
+	user := self.clusterConfiguration.GetDbUser(db, username)
+	if user == nil {
+		return fmt.Errorf("Invalid username %s", username)
+	}
+	updated := *user
+	updated.RevokePermissions(read, write, regex)
+	return self.raftServer.SaveDbUser(&updated)
+}
+
 func (self *CoordinatorImpl) SetDbAdmin(requester common.User, db, username string, isAdmin bool) error {
 	if ok, err := self.permissions.AuthorizeGrantDbUserAdmin(requester, db); !ok {
 		return err
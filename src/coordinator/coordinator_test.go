@@ -2,11 +2,19 @@ package coordinator
 
 import (
 	"cluster"
+	"common"
 	"configuration"
+	"engine"
 	"fmt"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"parser"
+	"protocol"
+	"strings"
+	"sync"
 	"time"
+
+	"code.google.com/p/goprotobuf/proto"
 )
 
 type CoordinatorSuite struct{}
@@ -40,3 +48,746 @@ func (self *CoordinatorSuite) TestShouldQuerySequentially(c *C) {
 		c.Assert(coordinator.shouldQuerySequentially(shards, querySpec), Equals, result)
 	}
 }
+
+// A local shard store whose shards return the points of their time
+// range in the order of the query
+type mockLocalShardStore struct {
+	cluster.LocalShardStore
+	points map[uint32][]int64
+	slow   uint32
+	// the queries run until they're cancelled
+	untilCancelled bool
+
+	queriesLock sync.Mutex
+	queries     [][2]time.Time
+}
+
+func (self *mockLocalShardStore) GetOrCreateShard(id uint32) (cluster.LocalShardDb, error) {
+	return &mockLocalShardDb{store: self, id: id}, nil
+}
+
+func (self *mockLocalShardStore) ReturnShard(id uint32) {}
+
+func (self *mockLocalShardStore) QueryEngineConfig() *engine.QueryEngineConfig {
+	return &engine.QueryEngineConfig{}
+}
+
+type mockLocalShardDb struct {
+	cluster.LocalShardDb
+	store *mockLocalShardStore
+	id    uint32
+}
+
+func (self *mockLocalShardDb) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	self.store.queriesLock.Lock()
+	self.store.queries = append(self.store.queries, [2]time.Time{querySpec.GetStartTime(), querySpec.GetEndTime()})
+	self.store.queriesLock.Unlock()
+	if self.store.untilCancelled {
+		for !querySpec.IsCancelled() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return common.QueryCancelledError
+	}
+	// the slow shard lets the shards queried after it get ahead
+	if self.id == self.store.slow {
+		time.Sleep(50 * time.Millisecond)
+	}
+	timestamps := self.store.points[self.id]
+	for i := range timestamps {
+		timestamp := timestamps[len(timestamps)-1-i]
+		if querySpec.SelectQuery().Ascending {
+			timestamp = timestamps[i]
+		}
+		point := &protocol.Point{
+			Values:         []*protocol.FieldValue{{Int64Value: protocol.Int64(timestamp)}},
+			Timestamp:      protocol.Int64(timestamp),
+			SequenceNumber: proto.Uint64(1),
+		}
+		if !processor.YieldPoint(protocol.String("cpu"), []string{"value"}, point) {
+			break
+		}
+	}
+	return nil
+}
+
+// Returns a cluster configuration with the database "db" whose only
+// server is the local one
+func newLocalClusterConfiguration(c *C, config *configuration.Configuration, store cluster.LocalShardStore) *cluster.ClusterConfiguration {
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, store, nil)
+	clusterConfiguration.LocalRaftName = "local"
+	clusterConfiguration.AddPotentialServer(&cluster.ClusterServer{RaftName: "local"})
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	return clusterConfiguration
+}
+
+func addLocalShard(c *C, clusterConfiguration *cluster.ClusterConfiguration, start, end time.Time) *cluster.ShardData {
+	shards, err := clusterConfiguration.AddShards([]*cluster.NewShardData{{
+		StartTime: start,
+		EndTime:   end,
+		ServerIds: []uint32{clusterConfiguration.LocalServer.Id},
+		Type:      cluster.SHORT_TERM,
+		Database:  "db",
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(shards[0].IsLocal, Equals, true)
+	return shards[0]
+}
+
+func (self *CoordinatorSuite) TestConcurrentLocalShardsKeepTheOrderAndTheLimit(c *C) {
+	config := &configuration.Configuration{
+		ClusterMaxResponseBufferSize:   1,
+		ConcurrentShardQueryLimit:      10,
+		ConcurrentLocalShardQueryLimit: 4,
+		StoragePointBatchSize:          1,
+	}
+	store := &mockLocalShardStore{points: map[uint32][]int64{}}
+	clusterConfiguration := newLocalClusterConfiguration(c, config, store)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+	user := &cluster.ClusterAdmin{cluster.CommonUser{"root", "", false, "root"}}
+
+	// three hourly shards with three points each, the shard of the
+	// middle hour is slow
+	start := time.Unix(1400000000, 0).Truncate(time.Hour)
+	for i := 0; i < 3; i++ {
+		shardStart := start.Add(time.Duration(i) * time.Hour)
+		shard := addLocalShard(c, clusterConfiguration, shardStart, shardStart.Add(time.Hour))
+		for j := 1; j <= 3; j++ {
+			store.points[shard.Id()] = append(store.points[shard.Id()], common.TimeToMicroseconds(shardStart.Add(time.Duration(j)*10*time.Minute)))
+		}
+		if i == 1 {
+			store.slow = shard.Id()
+		}
+	}
+
+	minutes := func(order string, limit int) []int64 {
+		query := fmt.Sprintf("select value from cpu where time > %ds and time < %ds limit %d %s",
+			start.Unix(), start.Add(3*time.Hour).Unix(), limit, order)
+		result := []int64{}
+		writer := NewContinuousQueryWriter(func(series *protocol.Series) error {
+			for _, point := range series.Points {
+				result = append(result, (point.GetTimestamp()-common.TimeToMicroseconds(start))/int64(time.Minute/time.Microsecond))
+			}
+			return nil
+		})
+		c.Assert(coordinator.RunQuery(user, "db", query, writer), IsNil, Commentf("%s", query))
+		return result
+	}
+
+	c.Assert(minutes("order asc", 5), DeepEquals, []int64{10, 20, 30, 70, 80})
+	c.Assert(minutes("order desc", 5), DeepEquals, []int64{150, 140, 130, 90, 80})
+	c.Assert(minutes("order asc", 20), DeepEquals, []int64{10, 20, 30, 70, 80, 90, 130, 140, 150})
+	c.Assert(minutes("order desc", 2), DeepEquals, []int64{150, 140})
+}
+
+func (self *CoordinatorSuite) TestPasswordsAreHashedAgainOnceAtATime(c *C) {
+	coordinator := NewCoordinatorImpl(&configuration.Configuration{}, nil, nil)
+	c.Assert(coordinator.startRehash("db:user"), Equals, true)
+	c.Assert(coordinator.startRehash("db:user"), Equals, false)
+	c.Assert(coordinator.startRehash("root"), Equals, true)
+	coordinator.endRehash("db:user")
+	c.Assert(coordinator.startRehash("db:user"), Equals, true)
+}
+
+// Applies the rehash commands to the cluster configuration, after
+// running pending, e.g. a password change that races the rehash.
+type rehashConsensus struct {
+	ClusterConsensus
+	config  *cluster.ClusterConfiguration
+	pending func()
+}
+
+func (self *rehashConsensus) RehashUserPassword(db, username string, oldHash, hash []byte) error {
+	if self.pending != nil {
+		self.pending()
+	}
+	self.config.RehashUserPassword(db, username, string(oldHash), string(hash))
+	return nil
+}
+
+func (self *CoordinatorSuite) TestPasswordsChangedWhileHashedAgainAreKept(c *C) {
+	config := &configuration.Configuration{PasswordHashCost: 5}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	consensus := &rehashConsensus{config: clusterConfiguration}
+	coordinator := NewCoordinatorImpl(config, consensus, clusterConfiguration)
+
+	oldHash, err := cluster.HashPassword("password", 4)
+	c.Assert(err, IsNil)
+	newHash, err := cluster.HashPassword("changed", 4)
+	c.Assert(err, IsNil)
+	clusterConfiguration.SaveDbUser(&cluster.DbUser{CommonUser: cluster.CommonUser{Name: "user", Hash: string(oldHash), CacheKey: "db%user"}, Db: "db"})
+	clusterConfiguration.SaveClusterAdmin(&cluster.ClusterAdmin{cluster.CommonUser{Name: "root", Hash: string(oldHash), CacheKey: "root"}})
+
+	// the password is changed before the new hash goes through raft
+	consensus.pending = func() {
+		c.Assert(clusterConfiguration.ChangeDbUserPassword("db", "user", string(newHash)), IsNil)
+		clusterConfiguration.GetClusterAdmin("root").ChangePassword(string(newHash))
+	}
+	coordinator.startRehash("db:user")
+	coordinator.rehashDbUserPassword("db", "user", string(oldHash), "password")
+	coordinator.startRehash("root")
+	coordinator.rehashClusterAdminPassword("root", string(oldHash), "password")
+	c.Assert(clusterConfiguration.GetDbUser("db", "user").Hash, Equals, string(newHash))
+	c.Assert(clusterConfiguration.GetClusterAdmin("root").Hash, Equals, string(newHash))
+
+	// otherwise the password is hashed again with the configured cost
+	consensus.pending = nil
+	coordinator.startRehash("db:user")
+	coordinator.rehashDbUserPassword("db", "user", string(newHash), "changed")
+	coordinator.startRehash("root")
+	coordinator.rehashClusterAdminPassword("root", string(newHash), "changed")
+	c.Assert(clusterConfiguration.GetDbUser("db", "user").NeedsRehash(5), Equals, false)
+	c.Assert(clusterConfiguration.GetClusterAdmin("root").NeedsRehash(5), Equals, false)
+}
+
+func (self *CoordinatorSuite) TestSubscriptionsFilterWrittenPoints(c *C) {
+	query, err := parser.ParseSelectQuery("select value from /^cpu.*/ where host = 'a'")
+	c.Assert(err, IsNil)
+	user := &MockUser{dbCannotRead: map[string]bool{"cpu.secret": true}}
+	subscription, err := NewSubscription(user, "db", query, 10, SubscriptionDrop)
+	c.Assert(err, IsNil)
+	registry := NewSubscriptionRegistry(func(u common.User) common.User { return u })
+	registry.Add(subscription)
+
+	series, err := common.StringToSeriesArray(`[
+	  {"name": "cpu.idle", "fields": ["value", "host"], "points": [
+	    {"values": [{"int64_value": 1}, {"string_value": "a"}], "timestamp": 1381346631000000},
+	    {"values": [{"int64_value": 2}, {"string_value": "b"}], "timestamp": 1381346632000000}
+	  ]},
+	  {"name": "cpu.secret", "fields": ["value", "host"], "points": [
+	    {"values": [{"int64_value": 3}, {"string_value": "a"}], "timestamp": 1381346631000000}
+	  ]},
+	  {"name": "memory", "fields": ["value", "host"], "points": [
+	    {"values": [{"int64_value": 4}, {"string_value": "a"}], "timestamp": 1381346631000000}
+	  ]}
+	]`)
+	c.Assert(err, IsNil)
+	registry.Publish("other", series)
+	registry.Publish("db", series)
+	registry.Remove(subscription)
+
+	published := []*protocol.Series{}
+	for s := range subscription.Series() {
+		published = append(published, s)
+	}
+	c.Assert(published, HasLen, 1)
+	c.Assert(published[0].GetName(), Equals, "cpu.idle")
+	c.Assert(published[0].Fields, DeepEquals, []string{"value"})
+	c.Assert(published[0].Points, HasLen, 1)
+	c.Assert(published[0].Points[0].Values[0].GetInt64Value(), Equals, int64(1))
+	// the written series are left alone
+	c.Assert(series[0].Fields, HasLen, 2)
+	c.Assert(series[0].Points, HasLen, 2)
+
+	_, err = NewSubscription(user, "db", query, 10, SubscriptionOverflow("block"))
+	c.Assert(err, NotNil)
+	aggregate, err := parser.ParseSelectQuery("select count(value) from cpu")
+	c.Assert(err, IsNil)
+	_, err = NewSubscription(user, "db", aggregate, 10, SubscriptionDrop)
+	c.Assert(err, NotNil)
+}
+
+func (self *CoordinatorSuite) TestSubscriptionsCheckThePermissionsOfTheirUserOnEveryWrite(c *C) {
+	config := &configuration.Configuration{}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	saveUser := func(read string, deleted bool) {
+		clusterConfiguration.SaveDbUser(&cluster.DbUser{
+			CommonUser: cluster.CommonUser{Name: "user", CacheKey: "db%user", IsUserDeleted: deleted},
+			Db:         "db",
+			ReadFrom:   []*cluster.Matcher{{true, read}},
+			WriteTo:    []*cluster.Matcher{{true, ".*"}},
+		})
+	}
+	saveUser(".*", false)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+
+	query, err := parser.ParseSelectQuery("select value from cpu")
+	c.Assert(err, IsNil)
+	subscription, err := NewSubscription(clusterConfiguration.GetDbUser("db", "user"), "db", query, 10, SubscriptionDrop)
+	c.Assert(err, IsNil)
+	coordinator.subscriptions.Add(subscription)
+	series, err := common.StringToSeriesArray(`[{"name": "cpu", "fields": ["value"], "points": [{"values": [{"int64_value": 1}]}]}]`)
+	c.Assert(err, IsNil)
+
+	coordinator.subscriptions.Publish("db", series)
+	c.Assert(subscription.Series(), HasLen, 1)
+	// the user is saved again without the read permissions, the
+	// subscription has the user it was made with
+	saveUser("^$", false)
+	coordinator.subscriptions.Publish("db", series)
+	c.Assert(subscription.Series(), HasLen, 1)
+	saveUser(".*", false)
+	coordinator.subscriptions.Publish("db", series)
+	c.Assert(subscription.Series(), HasLen, 2)
+	saveUser(".*", true)
+	coordinator.subscriptions.Publish("db", series)
+
+	published := 0
+	for _ = range subscription.Series() {
+		published++
+	}
+	c.Assert(published, Equals, 2)
+	c.Assert(subscription.Revoked(), Equals, true)
+	c.Assert(subscription.Overflowed(), Equals, false)
+	coordinator.Unsubscribe(subscription)
+}
+
+func (self *CoordinatorSuite) TestRunsOfIntoQueriesWriteTheSameSequenceNumbers(c *C) {
+	config := &configuration.Configuration{}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+
+	// the results of a run over a window, two series of the query are
+	// written into the same target
+	results := func() []*protocol.Series {
+		series, err := common.StringToSeriesArray(`[
+		  {"name": "cpu.1", "fields": ["value"], "points": [
+		    {"values": [{"int64_value": 1}], "timestamp": 20, "sequence_number": 7},
+		    {"values": [{"int64_value": 2}], "timestamp": 10, "sequence_number": 7}
+		  ]},
+		  {"name": "cpu.2", "fields": ["value"], "points": [
+		    {"values": [{"int64_value": 3}], "timestamp": 10, "sequence_number": 7}
+		  ]}
+		]`)
+		c.Assert(err, IsNil)
+		return series
+	}
+	sequenceNumbersOf := func(sequenceNumbers IntoSequenceNumbers) [][]uint64 {
+		numbers := [][]uint64{}
+		for _, series := range results() {
+			// the points that can't be written are only logged
+			c.Assert(coordinator.InterpolateValuesAndCommit("select value from /cpu.*/ into cpu", "db", series, "cpu", sequenceNumbers), IsNil)
+			seriesNumbers := []uint64{}
+			for _, point := range series.Points {
+				seriesNumbers = append(seriesNumbers, point.GetSequenceNumber())
+			}
+			numbers = append(numbers, seriesNumbers)
+		}
+		return numbers
+	}
+
+	first := sequenceNumbersOf(IntoSequenceNumbers{})
+	c.Assert(first, DeepEquals, [][]uint64{{1, 1}, {2}})
+	// a retry of the window overwrites the points of the first run
+	c.Assert(sequenceNumbersOf(IntoSequenceNumbers{}), DeepEquals, first)
+	// the points written as they come keep their sequence numbers
+	c.Assert(sequenceNumbersOf(nil), DeepEquals, [][]uint64{{7, 7}, {7}})
+}
+
+// Records the continuous queries created
+type continuousQueryConsensus struct {
+	ClusterConsensus
+	queries []string
+}
+
+func (self *continuousQueryConsensus) CreateContinuousQueryWithBackfill(db, query string, backfill time.Duration) error {
+	self.queries = append(self.queries, query)
+	return nil
+}
+
+func (self *CoordinatorSuite) TestIntoQueriesWithATimeRangeRunOnce(c *C) {
+	config := &configuration.Configuration{}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	consensus := &continuousQueryConsensus{}
+	coordinator := NewCoordinatorImpl(config, consensus, clusterConfiguration)
+	user := &cluster.ClusterAdmin{cluster.CommonUser{"root", "", false, "root"}}
+	writer := NewContinuousQueryWriter(func(*protocol.Series) error { return nil })
+
+	for _, query := range []string{
+		"select value from cpu where time > now() - 1h into cpu.copy",
+		"select value from cpu where time > '2014-06-01' and time < '2014-06-02' into cpu.copy",
+	} {
+		c.Assert(coordinator.RunQuery(user, "db", query, writer), IsNil, Commentf("%s", query))
+	}
+	c.Assert(consensus.queries, HasLen, 0)
+
+	// without a time range it's a continuous query
+	c.Assert(coordinator.RunQuery(user, "db", "select value from cpu into cpu.copy", writer), IsNil)
+	c.Assert(consensus.queries, DeepEquals, []string{"select value from cpu into cpu.copy"})
+
+	// running it once takes the permission to create continuous queries
+	err := coordinator.RunQuery(&MockUser{}, "db", "select value from cpu where time > now() - 1h into cpu.copy", writer)
+	c.Assert(err, FitsTypeOf, common.AuthorizationError(""))
+}
+
+func newBackfillRaftServer(c *C, config *configuration.Configuration, store *mockLocalShardStore) *RaftServer {
+	clusterConfiguration := newLocalClusterConfiguration(c, config, store)
+	clusterConfiguration.SaveClusterAdmin(&cluster.ClusterAdmin{cluster.CommonUser{Name: "root"}})
+	server := &RaftServer{
+		clusterConfig:           clusterConfiguration,
+		config:                  config,
+		continuousQueryStatuses: make(map[string]map[uint32]*ContinuousQueryStatus),
+	}
+	server.coordinator = NewCoordinatorImpl(config, server, clusterConfiguration)
+	return server
+}
+
+func (self *CoordinatorSuite) TestBackfillStartsAtTheOldestShardAndTheMaxBackfill(c *C) {
+	config := &configuration.Configuration{}
+	server := newBackfillRaftServer(c, config, &mockLocalShardStore{})
+	end := time.Unix(1400000000, 0).Truncate(time.Hour)
+
+	// without shards there's nothing to backfill
+	c.Assert(server.backfillStart(end.Add(-48*time.Hour), end), Equals, end)
+
+	addLocalShard(c, server.clusterConfig, end.Add(-10*time.Hour), end.Add(-9*time.Hour))
+	addLocalShard(c, server.clusterConfig, end.Add(-20*time.Hour), end.Add(-19*time.Hour))
+	addLocalShard(c, server.clusterConfig, end.Add(-time.Hour), end)
+	c.Assert(server.backfillStart(end.Add(-48*time.Hour), end), Equals, end.Add(-20*time.Hour))
+	c.Assert(server.backfillStart(end.Add(-5*time.Hour), end), Equals, end.Add(-5*time.Hour))
+	c.Assert(server.backfillStart(time.Time{}, end), Equals, end.Add(-20*time.Hour))
+
+	config.ContinuousQueryMaxBackfill = 12 * time.Hour
+	c.Assert(server.backfillStart(end.Add(-48*time.Hour), end), Equals, end.Add(-12*time.Hour))
+	c.Assert(server.backfillStart(time.Time{}, end), Equals, end.Add(-12*time.Hour))
+	c.Assert(server.backfillStart(end.Add(-5*time.Hour), end), Equals, end.Add(-5*time.Hour))
+}
+
+func (self *CoordinatorSuite) TestBackfillRunsTheQueryInWindows(c *C) {
+	config := &configuration.Configuration{
+		ConcurrentShardQueryLimit:      10,
+		ConcurrentLocalShardQueryLimit: 1,
+	}
+	store := &mockLocalShardStore{}
+	server := newBackfillRaftServer(c, config, store)
+	start := time.Unix(1400000000, 0).Truncate(24 * time.Hour)
+	addLocalShard(c, server.clusterConfig, start, start.Add(7*24*time.Hour))
+
+	for _, test := range []struct {
+		query   string
+		start   time.Time
+		end     time.Time
+		windows [][2]time.Time
+	}{
+		// the windows start at a group by boundary and the last one ends
+		// at the end of the backfill
+		{
+			"select count(value) from cpu group by time(1h) into cpu.1h",
+			start.Add(90 * time.Minute),
+			start.Add(50 * time.Hour),
+			[][2]time.Time{
+				{start.Add(time.Hour), start.Add(25 * time.Hour)},
+				{start.Add(25 * time.Hour), start.Add(49 * time.Hour)},
+				{start.Add(49 * time.Hour), start.Add(50 * time.Hour)},
+			},
+		},
+		// the windows are a multiple of the group by interval
+		{
+			"select count(value) from cpu group by time(10h) into cpu.10h",
+			start,
+			start.Add(40 * time.Hour),
+			[][2]time.Time{
+				{start, start.Add(30 * time.Hour)},
+				{start.Add(30 * time.Hour), start.Add(40 * time.Hour)},
+			},
+		},
+		// nothing to backfill
+		{
+			"select count(value) from cpu group by time(1h) into cpu.empty",
+			start.Add(10 * time.Hour),
+			start.Add(10 * time.Hour),
+			[][2]time.Time{},
+		},
+	} {
+		c.Assert(server.clusterConfig.CreateContinuousQuery("db", test.query), IsNil)
+		query, err := parser.ParseSelectQuery(test.query)
+		c.Assert(err, IsNil)
+		duration, err := query.GetGroupByClause().GetGroupByTime()
+		c.Assert(err, IsNil)
+
+		store.queries = [][2]time.Time{}
+		server.backfillContinuousQuery("db", query, test.start, test.end, *duration)
+		c.Assert(store.queries, HasLen, len(test.windows), Commentf("%s", test.query))
+		for i, window := range test.windows {
+			// the end of the time range of the query is exclusive
+			c.Assert(store.queries[i][0].Equal(window[0]), Equals, true, Commentf("%s: %v", test.query, store.queries[i]))
+			c.Assert(store.queries[i][1].Equal(window[1]), Equals, true, Commentf("%s: %v", test.query, store.queries[i]))
+		}
+	}
+
+	// the backfill of a deleted query stops
+	query, err := parser.ParseSelectQuery("select count(value) from cpu group by time(1h) into cpu.deleted")
+	c.Assert(err, IsNil)
+	store.queries = [][2]time.Time{}
+	server.backfillContinuousQuery("db", query, start, start.Add(48*time.Hour), time.Hour)
+	c.Assert(store.queries, HasLen, 0)
+}
+
+func (self *CoordinatorSuite) TestOffsetWriterSkipsThePointsOfEachSeries(c *C) {
+	series, err := common.StringToSeriesArray(`[
+	  {"name": "foo", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 1}], "timestamp": 1381346631000000},
+	    {"values": [{"int64_value": 2}], "timestamp": 1381346632000000}
+	  ]},
+	  {"name": "bar", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 3}], "timestamp": 1381346631000000},
+	    {"values": [{"int64_value": 4}], "timestamp": 1381346632000000},
+	    {"values": [{"int64_value": 5}], "timestamp": 1381346633000000}
+	  ]},
+	  {"name": "foo", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 6}], "timestamp": 1381346633000000},
+	    {"values": [{"int64_value": 7}], "timestamp": 1381346634000000}
+	  ]}
+	]`)
+	c.Assert(err, IsNil)
+
+	written := map[string][]int64{}
+	writer := NewOffsetWriter(NewContinuousQueryWriter(func(s *protocol.Series) error {
+		for _, point := range s.Points {
+			written[s.GetName()] = append(written[s.GetName()], point.Values[0].GetInt64Value())
+		}
+		return nil
+	}), 3)
+	for _, s := range series {
+		c.Assert(writer.Write(s), IsNil)
+	}
+	c.Assert(written, DeepEquals, map[string][]int64{"foo": {7}})
+}
+
+func (self *CoordinatorSuite) TestQueryLimiterQueuesAndRejectsQueries(c *C) {
+	limiter := NewQueryLimiter(1, 1)
+	c.Assert(limiter.Acquire(nil), IsNil)
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- limiter.Acquire(nil)
+	}()
+	for {
+		if _, queued := limiter.Counts(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, ok := limiter.Acquire(nil).(*common.QueryQueueFullError)
+	c.Assert(ok, Equals, true)
+
+	limiter.Release()
+	c.Assert(<-acquired, IsNil)
+	running, queued := limiter.Counts()
+	c.Assert(running, Equals, 1)
+	c.Assert(queued, Equals, 0)
+
+	cancel := make(chan bool)
+	close(cancel)
+	c.Assert(limiter.Acquire(cancel), Equals, common.QueryCancelledError)
+}
+
+func (self *CoordinatorSuite) TestDrainingRejectsTheNewRequests(c *C) {
+	config := &configuration.Configuration{}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+
+	c.Assert(coordinator.startRequest(), IsNil)
+	c.Assert(coordinator.WaitForPendingRequests(10*time.Millisecond), Equals, 1)
+	c.Assert(coordinator.startRequest(), FitsTypeOf, &common.ShuttingDownError{})
+	err := coordinator.WriteSeriesData(&MockUser{}, "db", nil)
+	c.Assert(err, FitsTypeOf, &common.ShuttingDownError{})
+
+	// the pending request finishes while draining
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		coordinator.endRequest()
+	}()
+	c.Assert(coordinator.WaitForPendingRequests(time.Second), Equals, 0)
+	c.Assert(coordinator.WaitForPendingRequests(time.Second), Equals, 0)
+}
+
+func (self *CoordinatorSuite) TestSlowQueryLogKeepsTheLastSlowQueries(c *C) {
+	path := c.MkDir() + "/slow_queries.log"
+	slowQueries := NewSlowQueryLog(time.Second, 2, path)
+	for i, duration := range []time.Duration{2 * time.Second, time.Millisecond, time.Second, 3 * time.Second} {
+		slowQueries.Record(&SlowQuery{Query: fmt.Sprintf("select * from s%d", i)}, duration)
+	}
+
+	queries := slowQueries.Recent()
+	c.Assert(queries, HasLen, 2)
+	c.Assert(queries[0].Query, Equals, "select * from s3")
+	c.Assert(queries[0].DurationMs, Equals, int64(3000))
+	c.Assert(queries[1].Query, Equals, "select * from s2")
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(string(content), "\n"), Equals, 3)
+	c.Assert(strings.Contains(string(content), "select * from s1"), Equals, false)
+}
+
+func (self *CoordinatorSuite) TestQueryCacheDropsTheResultsThePointsChange(c *C) {
+	cache := NewQueryCache(2, time.Hour, 0)
+	series := []*protocol.Series{{Name: protocol.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{{}}}}
+	cache.put("q1", "db1", 0, 100, series)
+	cache.put("q2", "db1", 200, 300, series)
+	cache.put("q3", "db2", 0, 100, series)
+
+	// the least recently used results make room for the new ones
+	_, ok := cache.get("q1")
+	c.Assert(ok, Equals, false)
+	cached, ok := cache.get("q2")
+	c.Assert(ok, Equals, true)
+	c.Assert(cached, HasLen, 1)
+	c.Assert(cached[0].Points, HasLen, 1)
+	c.Assert(cached[0], Not(Equals), series[0])
+
+	cache.invalidate("db1", 50, 150)
+	_, ok = cache.get("q2")
+	c.Assert(ok, Equals, true)
+	cache.invalidate("db1", 250, 250)
+	_, ok = cache.get("q2")
+	c.Assert(ok, Equals, false)
+	_, ok = cache.get("q3")
+	c.Assert(ok, Equals, true)
+
+	cache.clear("db2")
+	_, ok = cache.get("q3")
+	c.Assert(ok, Equals, false)
+
+	expired := NewQueryCache(1, time.Nanosecond, 0)
+	expired.put("q1", "db1", 0, 100, series)
+	time.Sleep(time.Millisecond)
+	_, ok = expired.get("q1")
+	c.Assert(ok, Equals, false)
+}
+
+func (self *CoordinatorSuite) TestQueryCacheOnlyKeepsTheResultsOlderThanTheWriteMaxAge(c *C) {
+	queries := map[string]bool{
+		"select * from foo where time < now() - 2d":                              true,
+		"select count(value) from foo group by time(1h) where time < now() - 2d": true,
+		"select * from foo where time < now() - 1h":                              false,
+		"select * from foo where time > now() - 3d":                              false,
+		"select * from foo": false,
+	}
+	for _, maxAge := range []time.Duration{0, 24 * time.Hour} {
+		coordinator := NewCoordinatorImpl(&configuration.Configuration{
+			QueryCacheSize: 10,
+			WriteMaxAge:    maxAge,
+		}, nil, nil)
+		for query, cached := range queries {
+			parsedQuery, err := parser.ParseQuery(query)
+			c.Assert(err, IsNil)
+			querySpec := parser.NewQuerySpec(&MockUser{}, "db", parsedQuery[0])
+			_, ok := coordinator.queryCacheKey(querySpec)
+			// nothing is cached without a write-max-age
+			c.Assert(ok, Equals, cached && maxAge > 0, Commentf("%s", query))
+		}
+	}
+}
+
+func (self *CoordinatorSuite) TestQuotasRejectTheWritesAndQueriesOverThem(c *C) {
+	quotas := NewQuotas(
+		configuration.Quota{PointsPerSecond: 100},
+		configuration.Quota{},
+		map[string]configuration.Quota{"unlimited": {}},
+		map[string]configuration.Quota{"mockuser": {QueriesPerSecond: 1}},
+	)
+	user := &MockUser{}
+
+	c.Assert(quotas.TakeWrite("db1", user, 100), IsNil)
+	quotas.CountWrite("db1", user, 100, 100)
+	err := quotas.TakeWrite(cluster.PolicyDatabase("db1", "policy"), user, 10)
+	c.Assert(err, FitsTypeOf, &common.QuotaExceededError{})
+	c.Assert(err.(*common.QuotaExceededError).Tenant, Equals, "database db1")
+	c.Assert(quotas.TakeWrite("db2", user, 100), IsNil)
+	quotas.CountWrite("db2", user, 100, 100)
+	c.Assert(quotas.TakeWrite("unlimited", user, 1000), IsNil)
+	quotas.CountWrite("unlimited", user, 1000, 1000)
+
+	// the points that weren't written are given back
+	c.Assert(quotas.TakeWrite("db3", user, 100), IsNil)
+	quotas.CountWrite("db3", user, 100, 40)
+	c.Assert(quotas.TakeWrite("db3", user, 60), IsNil)
+	quotas.CountWrite("db3", user, 60, 60)
+	c.Assert(quotas.TakeWrite("db3", user, 10), NotNil)
+
+	// the cluster admins are only exempt from the quotas of the users
+	admin := &MockUser{clusterAdmin: true}
+	err = quotas.TakeWrite("db1", admin, 10)
+	c.Assert(err, FitsTypeOf, &common.QuotaExceededError{})
+	c.Assert(err.(*common.QuotaExceededError).Tenant, Equals, "database db1")
+
+	c.Assert(quotas.TakeQuery("db1", user), IsNil)
+	err = quotas.TakeQuery("db2", user)
+	c.Assert(err, FitsTypeOf, &common.QuotaExceededError{})
+	c.Assert(err.(*common.QuotaExceededError).Tenant, Equals, "user mockuser")
+
+	databases, users := quotas.Usage()
+	c.Assert(databases["db1"].PointsWritten, Equals, int64(100))
+	c.Assert(databases["db1"].PointsRejected, Equals, int64(20))
+	c.Assert(databases["db3"].PointsWritten, Equals, int64(100))
+	c.Assert(databases["db1"].Queries, Equals, int64(1))
+	c.Assert(users["mockuser"].PointsWritten, Equals, int64(1300))
+	c.Assert(users["mockuser"].QueriesRejected, Equals, int64(1))
+}
+
+func (self *CoordinatorSuite) TestQuotasForgetTheIdleTenants(c *C) {
+	quotas := NewQuotas(configuration.Quota{}, configuration.Quota{}, nil, nil)
+	user := &MockUser{}
+	now := time.Now()
+
+	quotas.tenants("idle", user, now.Add(-2*quotaTenantExpiry))
+	quotas.tenants("recent", user, now.Add(-quotaTenantExpiry/2))
+	quotas.tenants("db", user, now)
+	databases, users := quotas.Usage()
+	c.Assert(databases, HasLen, 2)
+	c.Assert(databases["recent"], NotNil)
+	c.Assert(databases["db"], NotNil)
+	c.Assert(users, HasLen, 1)
+
+	// the tenants aren't looked at again until quotaTenantExpiry passed
+	quotas.tenants("idle", user, now.Add(-2*quotaTenantExpiry))
+	quotas.tenants("db", user, now.Add(quotaTenantExpiry/4))
+	databases, _ = quotas.Usage()
+	c.Assert(databases, HasLen, 3)
+}
+
+func (self *CoordinatorSuite) TestWritesRejectThePointsOutsideOfTheWriteWindow(c *C) {
+	config := &configuration.Configuration{
+		WriteMaxFuture: time.Hour,
+		WriteMaxAge:    24 * time.Hour,
+	}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	c.Assert(clusterConfiguration.CreateDatabase("db", 1), IsNil)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+
+	now := common.CurrentTime()
+	future := now + int64(2*time.Hour/time.Microsecond)
+	past := now - int64(48*time.Hour/time.Microsecond)
+	series, err := common.StringToSeriesArray(fmt.Sprintf(`[
+	  {"name": "cpu", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 1}], "timestamp": %d},
+	    {"values": [{"int64_value": 2}], "timestamp": %d}
+	  ]},
+	  {"name": "memory", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 3}], "timestamp": %d}
+	  ]}
+	]`, future, past, future))
+	c.Assert(err, IsNil)
+	query, err := parser.ParseSelectQuery("select value from cpu")
+	c.Assert(err, IsNil)
+	subscription, err := NewSubscription(&MockUser{}, "db", query, 10, SubscriptionDrop)
+	c.Assert(err, IsNil)
+	coordinator.subscriptions.Add(subscription)
+
+	err = coordinator.WriteSeriesDataWithConsistency(&MockUser{}, "db", series, cluster.ConsistencyAny)
+	c.Assert(err, FitsTypeOf, &common.PartialWriteError{})
+	pointErrors := err.(*common.PartialWriteError).Errors
+	c.Assert(pointErrors, HasLen, 3)
+	c.Assert([]int{pointErrors[0].Series, pointErrors[0].Point}, DeepEquals, []int{0, 0})
+	c.Assert(pointErrors[0].Message, Matches, ".*ahead of the server time.*")
+	c.Assert([]int{pointErrors[1].Series, pointErrors[1].Point}, DeepEquals, []int{0, 1})
+	c.Assert(pointErrors[1].Message, Matches, ".*behind the server time.*")
+	c.Assert([]int{pointErrors[2].Series, pointErrors[2].Point}, DeepEquals, []int{1, 0})
+
+	tooFarInFuture, tooOld := coordinator.RejectedPoints()
+	c.Assert(tooFarInFuture, Equals, int64(2))
+	c.Assert(tooOld, Equals, int64(1))
+	pointsWritten, _ := coordinator.Stats()
+	c.Assert(pointsWritten, Equals, int64(0))
+
+	// the rejected points aren't published
+	coordinator.subscriptions.Remove(subscription)
+	_, ok := <-subscription.Series()
+	c.Assert(ok, Equals, false)
+}
@@ -5,6 +5,7 @@ import (
 	"common"
 	"net"
 	"protocol"
+	"time"
 )
 
 type Coordinator interface {
@@ -17,27 +18,100 @@ type Coordinator interface {
 	//   4. The end of a time series is signaled by returning a series with no data points
 	//   5. TODO: Aggregation on the nodes
 	WriteSeriesData(user common.User, db string, series []*protocol.Series) error
+	WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.ConsistencyLevel) error
 	DropDatabase(user common.User, db string) error
-	CreateDatabase(user common.User, db string) error
+	// sets how long the data of db is kept, zero keeps it forever
+	SetRetentionPolicy(user common.User, db string, retention time.Duration) error
+	GetRetentionPolicy(user common.User, db string) (time.Duration, error)
+	// named retention policies keep their points apart from the default
+	// policy of db for their own duration, they're written to and
+	// queried through the database RetentionPolicyDatabase returns
+	SetNamedRetentionPolicy(user common.User, db, name string, retention time.Duration) error
+	DeleteNamedRetentionPolicy(user common.User, db, name string) error
+	ListNamedRetentionPolicies(user common.User, db string) (map[string]time.Duration, error)
+	RetentionPolicyDatabase(user common.User, db, name string) (string, error)
+	// the shards of db are replicated replicationFactor times, as many
+	// times as the ones of the cluster if it's zero
+	CreateDatabase(user common.User, db string, replicationFactor uint8) error
+	// sets the replication factor of the shards of db created from now
+	// on, the existing shards keep their replicas
+	SetDatabaseReplicationFactor(user common.User, db string, replicationFactor uint8) error
+	GetDatabaseReplicationFactor(user common.User, db string) (int, error)
+	// sets what the shards do with the points written to a series that
+	// already has a point with their timestamp
+	SetDuplicatePointPolicy(user common.User, db string, policy cluster.DuplicatePointPolicy) error
+	GetDuplicatePointPolicy(user common.User, db string) (cluster.DuplicatePointPolicy, error)
 	ForceCompaction(user common.User) error
 	ListDatabases(user common.User) ([]*cluster.Database, error)
 	DeleteContinuousQuery(user common.User, db string, id uint32) error
 	CreateContinuousQuery(user common.User, db string, query string) error
+	// same as CreateContinuousQuery but first runs the query over the
+	// given duration of existing data
+	CreateContinuousQueryWithBackfill(user common.User, db string, query string, backfill time.Duration) error
 	ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error)
 
 	// v2 clustering, based on sharding instead of the circular hash ring
 	RunQuery(user common.User, db, query string, seriesWriter SeriesWriter) error
+	// same as RunQuery but the query is cancelled when cancel is closed
+	RunQueryWithCancel(user common.User, db, query string, seriesWriter SeriesWriter, cancel <-chan bool) error
+	// same as RunQueryWithCancel but the buckets of group by time() are
+	// aligned to the time zone instead of UTC, nil is UTC
+	RunQueryInTimeZone(user common.User, db, query string, location *time.Location, seriesWriter SeriesWriter, cancel <-chan bool) error
+	// runs the semicolon separated statements of the query concurrently
+	// and returns the error of each statement in order, the results of
+	// statement i go to newWriter(i). The buckets of group by time() are
+	// aligned to location, nil is UTC.
+	RunQueries(user common.User, db, query string, location *time.Location, newWriter func(statement int) SeriesWriter, cancel <-chan bool) ([]error, error)
+	// returns how the select queries would run without running them
+	ExplainQuery(user common.User, db, query string) ([]*QueryPlan, error)
+	// runs the query in the background, the results can be read from
+	// the returned job once it's done
+	SubmitQuery(user common.User, db, query string) (*QueryJob, error)
+	GetQueryJob(user common.User, db, id string) (*QueryJob, error)
+	// cancels the job if it's still running and discards its results
+	DeleteQueryJob(user common.User, db, id string) error
+	// sends the points matching the select query that are written
+	// through this server to the returned subscription until it's
+	// unsubscribed
+	Subscribe(user common.User, db, query string, bufferSize int, overflow SubscriptionOverflow) (*Subscription, error)
+	Unsubscribe(subscription *Subscription)
+
+	// the number of points written and queries served since startup
+	Stats() (pointsWritten int64, queriesServed int64)
+	// the number of points rejected since startup for being more than
+	// write-max-future ahead of the server time or more than
+	// write-max-age behind it
+	RejectedPoints() (tooFarInFuture int64, tooOld int64)
+	// the number of queries running and waiting for a running query
+	// to finish
+	QueryCounts() (running, queued int)
+	// the points written and the queries run by each database and each
+	// user that wrote or queried in the last hour, and their quotas
+	QuotaUsage() (databases, users map[string]QuotaUsage)
+	// the last queries that ran longer than the slow query threshold,
+	// the most recent first
+	SlowQueries() []*SlowQuery
 }
 
 type ClusterConsensus interface {
-	CreateDatabase(name string) error
+	CreateDatabase(name string, replicationFactor uint8) error
 	DropDatabase(name string) error
+	SetDatabaseReplicationFactor(db string, replicationFactor uint8) error
+	SetDuplicatePointPolicy(db string, policy cluster.DuplicatePointPolicy) error
+	SetRetentionPolicy(db string, retention time.Duration) error
+	SetNamedRetentionPolicy(db, name string, retention time.Duration) error
+	DeleteNamedRetentionPolicy(db, name string) error
 	CreateContinuousQuery(db string, query string) error
+	CreateContinuousQueryWithBackfill(db string, query string, backfill time.Duration) error
 	DeleteContinuousQuery(db string, id uint32) error
 	SaveClusterAdminUser(u *cluster.ClusterAdmin) error
 	SaveDbUser(user *cluster.DbUser) error
 	ChangeDbUserPassword(db, username string, hash []byte) error
+	RehashUserPassword(db, username string, oldHash, hash []byte) error
 	ChangeDbUserPermissions(db, username, readPermissions, writePermissions string) error
+	DropShard(id uint32, serverIds []uint32) error
+	SaveAuthToken(token *cluster.AuthToken) error
+	DeleteAuthToken(hash string) error
 	AssignCoordinator(coordinator *CoordinatorImpl) error
 	// When a cluster is turned on for the first time.
 	CreateRootUser() error
@@ -0,0 +1,219 @@
+package coordinator
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/goraft/raft"
+)
+
+// How many election timeouts the leader waits for the target of a
+// leadership transfer to catch up and then to win the election
+const LEADER_TRANSFER_TIMEOUTS = 10
+
+type raftStatus struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	CommitIndex uint64 `json:"commitIndex"`
+}
+
+type leaderTransferRequest struct {
+	ServerId uint32 `json:"serverId"`
+}
+
+// Makes the server the raft leader, e.g. before restarting the current
+// leader. The leader waits for the server to have all the committed
+// entries, lowers its election timeout and steps down, so the server
+// starts the next election before the others.
+func (s *RaftServer) TransferLeadership(serverId uint32) error {
+	if s.raftServer.State() != raft.Leader {
+		leader, ok := s.leaderConnectString()
+		if !ok {
+			return errors.New("Couldn't connect to the cluster leader...")
+		}
+		return s.postToRaftServer(leader, "/transfer_leadership", &leaderTransferRequest{serverId})
+	}
+
+	server := s.clusterConfig.GetServerById(&serverId)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	if server.RaftName == s.name {
+		return nil
+	}
+	if server.State == cluster.Leaving || !s.clusterConfig.IsServerUp(server) {
+		return fmt.Errorf("Server %d isn't healthy", serverId)
+	}
+	if _, ok := s.raftServer.Peers()[server.RaftName]; !ok {
+		return fmt.Errorf("Server %d isn't a raft peer", serverId)
+	}
+
+	timeout := LEADER_TRANSFER_TIMEOUTS * s.raftServer.ElectionTimeout()
+	if err := s.waitForCatchUp(server, timeout); err != nil {
+		return err
+	}
+	if err := s.postToRaftServer(server.RaftConnectionString, "/prepare_leadership", nil); err != nil {
+		return err
+	}
+
+	// once this server stops sending heartbeats the server times out
+	// first and starts the election
+	log.Info("Transferring the raft leadership to server %d", serverId)
+	if err := s.raftServer.StepDown(); err != nil {
+		return err
+	}
+
+	for start := time.Now(); time.Now().Sub(start) < timeout; time.Sleep(50 * time.Millisecond) {
+		if leader := s.raftServer.Leader(); leader == server.RaftName {
+			return nil
+		}
+	}
+	return fmt.Errorf("Server %d didn't become the leader, the leader is %s", serverId, s.raftServer.Leader())
+}
+
+// Waits for the server to have the entries that were committed when the
+// transfer started
+func (s *RaftServer) waitForCatchUp(server *cluster.ClusterServer, timeout time.Duration) error {
+	commitIndex := s.raftServer.CommitIndex()
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		status, err := getRaftStatus(s.httpClient, server.RaftConnectionString)
+		if err != nil {
+			return err
+		}
+		if status.CommitIndex >= commitIndex {
+			return nil
+		}
+		if time.Now().Sub(start) > timeout {
+			return fmt.Errorf("Server %d didn't catch up, it's at %d and the leader at %d", server.Id, status.CommitIndex, commitIndex)
+		}
+	}
+}
+
+func getRaftStatus(client *http.Client, url string) (*raftStatus, error) {
+	resp, err := client.Get(url + "/raft_status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	status := &raftStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (s *RaftServer) postToRaftServer(url, path string, body interface{}) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(body); err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Post(url+path, "application/json", &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (s *RaftServer) raftStatusHandler(w http.ResponseWriter, req *http.Request) {
+	js, err := json.Marshal(&raftStatus{
+		Name:        s.name,
+		State:       s.raftServer.State(),
+		CommitIndex: s.raftServer.CommitIndex(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(js)
+}
+
+// Lowers the election timeout of this server for a while, so it starts
+// the election once the leader steps down before the other servers. The
+// timeouts are random between the timeout and twice the timeout, and the
+// election timeout is at least 4 heartbeat intervals, so the lower one
+// still doesn't expire between two heartbeats.
+func (s *RaftServer) prepareLeadershipHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.isClusterAdminOrPeer(req, s.raftServer.Leader()) {
+		http.Error(w, "Only the leader or a cluster admin can prepare the leadership transfer", http.StatusUnauthorized)
+		return
+	}
+	timeout := s.config.RaftTimeout.Duration
+	s.raftServer.SetElectionTimeout(timeout / 3)
+	time.AfterFunc(LEADER_TRANSFER_TIMEOUTS*timeout, func() {
+		s.raftServer.SetElectionTimeout(timeout)
+	})
+}
+
+func (s *RaftServer) transferLeadershipHandler(w http.ResponseWriter, req *http.Request) {
+	peers := []string{}
+	for name := range s.raftServer.Peers() {
+		peers = append(peers, name)
+	}
+	if !s.isClusterAdminOrPeer(req, peers...) {
+		http.Error(w, "Only a raft peer or a cluster admin can transfer the leadership", http.StatusUnauthorized)
+		return
+	}
+	request := &leaderTransferRequest{}
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.TransferLeadership(request.ServerId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Whether the request is authenticated as a cluster admin or comes from
+// one of the given raft peers. The raft listener only accepts clients
+// with a valid certificate if ssl is enabled, otherwise the request has
+// to come from the host of the peer.
+func (s *RaftServer) isClusterAdminOrPeer(req *http.Request, peerNames ...string) bool {
+	if username, password, ok := req.BasicAuth(); ok {
+		user, err := s.clusterConfig.AuthenticateClusterAdmin(username, password)
+		return err == nil && user.IsClusterAdmin()
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	peers := s.raftServer.Peers()
+	for _, name := range peerNames {
+		peer := peers[name]
+		if peer == nil {
+			continue
+		}
+		peerUrl, err := url.Parse(peer.ConnectionString)
+		if err != nil {
+			continue
+		}
+		addresses, err := net.LookupHost(peerUrl.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if net.ParseIP(address).Equal(net.ParseIP(remoteHost)) {
+				return true
+			}
+		}
+	}
+	return false
+}
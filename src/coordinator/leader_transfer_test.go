@@ -0,0 +1,174 @@
+package coordinator
+
+import (
+	"cluster"
+	"configuration"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/goraft/raft"
+	. "launchpad.net/gocheck"
+)
+
+type LeaderTransferSuite struct{}
+
+var _ = Suite(&LeaderTransferSuite{})
+
+type MockRaftServer struct {
+	raft.Server
+	lock            sync.Mutex
+	state           string
+	leader          string
+	peers           map[string]*raft.Peer
+	electionTimeout time.Duration
+	// the leader once the server stepped down
+	nextLeader  string
+	steppedDown bool
+}
+
+func (self *MockRaftServer) State() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.state
+}
+
+func (self *MockRaftServer) Leader() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.leader
+}
+
+func (self *MockRaftServer) Peers() map[string]*raft.Peer {
+	return self.peers
+}
+
+func (self *MockRaftServer) CommitIndex() uint64 {
+	return 10
+}
+
+func (self *MockRaftServer) Term() uint64 {
+	return 2
+}
+
+func (self *MockRaftServer) ElectionTimeout() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.electionTimeout
+}
+
+func (self *MockRaftServer) SetElectionTimeout(timeout time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.electionTimeout = timeout
+}
+
+func (self *MockRaftServer) StepDown() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.state != raft.Leader {
+		return raft.NotLeaderError
+	}
+	self.state = raft.Follower
+	self.leader = self.nextLeader
+	self.steppedDown = true
+	return nil
+}
+
+func newLeaderTransferRaftServer(c *C, raftServer *MockRaftServer) *RaftServer {
+	config := &configuration.Configuration{PasswordHashCost: 4}
+	config.RaftTimeout.Duration = 30 * time.Millisecond
+	clusterConfig := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	hash, err := cluster.HashPassword("root", 4)
+	c.Assert(err, IsNil)
+	clusterConfig.SaveClusterAdmin(&cluster.ClusterAdmin{cluster.CommonUser{Name: "root", Hash: string(hash)}})
+	return &RaftServer{
+		name:          "leader",
+		raftServer:    raftServer,
+		clusterConfig: clusterConfig,
+		config:        config,
+		httpClient:    http.DefaultClient,
+	}
+}
+
+func (self *LeaderTransferSuite) TestOnlyTheLeaderOrAClusterAdminCanPrepareTheLeadership(c *C) {
+	raftServer := &MockRaftServer{
+		leader:          "leader",
+		electionTimeout: 30 * time.Millisecond,
+		peers: map[string]*raft.Peer{
+			"leader": {Name: "leader", ConnectionString: "http://127.0.0.1:8090"},
+			"other":  {Name: "other", ConnectionString: "http://10.1.2.3:8090"},
+		},
+	}
+	server := newLeaderTransferRaftServer(c, raftServer)
+
+	for _, test := range []struct {
+		name               string
+		remoteAddr         string
+		username, password string
+		expected           int
+	}{
+		{"the leader", "127.0.0.1:4321", "", "", http.StatusOK},
+		{"another peer", "10.1.2.3:4321", "", "", http.StatusUnauthorized},
+		{"another host", "10.9.9.9:4321", "", "", http.StatusUnauthorized},
+		{"a cluster admin", "10.9.9.9:4321", "root", "root", http.StatusOK},
+		{"a wrong password", "127.0.0.1:4321", "root", "wrong", http.StatusUnauthorized},
+	} {
+		raftServer.SetElectionTimeout(30 * time.Millisecond)
+		req, err := http.NewRequest("POST", "/prepare_leadership", nil)
+		c.Assert(err, IsNil)
+		req.RemoteAddr = test.remoteAddr
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		recorder := httptest.NewRecorder()
+		server.prepareLeadershipHandler(recorder, req)
+		c.Assert(recorder.Code, Equals, test.expected, Commentf(test.name))
+		if test.expected == http.StatusOK {
+			c.Assert(raftServer.ElectionTimeout(), Equals, 10*time.Millisecond, Commentf(test.name))
+		} else {
+			c.Assert(raftServer.ElectionTimeout(), Equals, 30*time.Millisecond, Commentf(test.name))
+		}
+	}
+}
+
+func (self *LeaderTransferSuite) TestTheLeaderStepsDownOnceTheServerCaughtUp(c *C) {
+	var lock sync.Mutex
+	commitIndex, prepared := uint64(5), false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/raft_status":
+			json.NewEncoder(w).Encode(&raftStatus{Name: "target", State: raft.Follower, CommitIndex: commitIndex})
+			// catches up after the first status
+			commitIndex = 10
+		case "/prepare_leadership":
+			prepared = true
+		}
+	}))
+	defer target.Close()
+
+	raftServer := &MockRaftServer{
+		state:           raft.Leader,
+		leader:          "leader",
+		nextLeader:      "target",
+		electionTimeout: 10 * time.Millisecond,
+		peers:           map[string]*raft.Peer{"target": {Name: "target", ConnectionString: target.URL}},
+	}
+	server := newLeaderTransferRaftServer(c, raftServer)
+	// the target is added as the local server of the configuration, which
+	// is always up
+	server.clusterConfig.LocalRaftName = "target"
+	server.clusterConfig.AddPotentialServer(&cluster.ClusterServer{RaftName: "target", RaftConnectionString: target.URL})
+
+	c.Assert(server.TransferLeadership(1), IsNil)
+	lock.Lock()
+	c.Assert(prepared, Equals, true)
+	c.Assert(commitIndex, Equals, uint64(10))
+	lock.Unlock()
+	c.Assert(raftServer.steppedDown, Equals, true)
+	c.Assert(raftServer.Leader(), Equals, "target")
+}
@@ -3,6 +3,7 @@ package coordinator
 type MockUser struct {
 	dbCannotRead  map[string]bool
 	dbCannotWrite map[string]bool
+	clusterAdmin  bool
 }
 
 func (self *MockUser) GetName() string {
@@ -12,7 +13,7 @@ func (self *MockUser) IsDeleted() bool {
 	return false
 }
 func (self *MockUser) IsClusterAdmin() bool {
-	return false
+	return self.clusterAdmin
 }
 func (self *MockUser) IsDbAdmin(db string) bool {
 	return false
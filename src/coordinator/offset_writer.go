@@ -0,0 +1,38 @@
+package coordinator
+
+// Skips the first points of each series written to it, the shards
+// return the offset along with the limit so it's applied once after
+// their results are merged
+
+import (
+	"protocol"
+)
+
+type OffsetWriter struct {
+	SeriesWriter
+	offset  int
+	skipped map[string]int
+}
+
+func NewOffsetWriter(writer SeriesWriter, offset int) *OffsetWriter {
+	return &OffsetWriter{writer, offset, map[string]int{}}
+}
+
+func (self *OffsetWriter) Write(series *protocol.Series) error {
+	skip := self.offset - self.skipped[series.GetName()]
+	if skip <= 0 {
+		return self.SeriesWriter.Write(series)
+	}
+	if skip > len(series.Points) {
+		skip = len(series.Points)
+	}
+	self.skipped[series.GetName()] += skip
+	if skip == len(series.Points) {
+		return nil
+	}
+	return self.SeriesWriter.Write(&protocol.Series{
+		Name:   series.Name,
+		Fields: series.Fields,
+		Points: series.Points[skip:],
+	})
+}
@@ -70,6 +70,22 @@ func (self *Permissions) AuthorizeDropDatabase(user common.User) (ok bool, err c
 	return true, ""
 }
 
+func (self *Permissions) AuthorizeChangeRetentionPolicy(user common.User) (ok bool, err common.AuthorizationError) {
+	if !user.IsClusterAdmin() {
+		return false, common.NewAuthorizationError("Insufficient permissions to change retention policies")
+	}
+
+	return true, ""
+}
+
+func (self *Permissions) AuthorizeGetRetentionPolicy(user common.User, db string) (ok bool, err common.AuthorizationError) {
+	if !user.IsDbAdmin(db) {
+		return false, common.NewAuthorizationError("Insufficient permissions to get the retention policies of %s", db)
+	}
+
+	return true, ""
+}
+
 func (self *Permissions) AuthorizeListClusterAdmins(user common.User) (ok bool, err common.AuthorizationError) {
 	if !user.IsClusterAdmin() {
 		return false, common.NewAuthorizationError("Insufficient permissions to list cluster admins")
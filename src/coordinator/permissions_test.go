@@ -113,6 +113,26 @@ func (self *PermissionsSuite) TestAuthorizeListContinuousQueries(c *C) {
 	c.Assert(ok, Equals, true)
 }
 
+func (self *PermissionsSuite) TestAuthorizeGetRetentionPolicy(c *C) {
+	var ok bool
+	var err common.AuthorizationError
+
+	authErr := common.NewAuthorizationError("Insufficient permissions to get the retention policies of db")
+
+	ok, err = self.permissions.AuthorizeGetRetentionPolicy(self.commonUser, "db")
+	c.Assert(ok, Equals, false)
+	c.Assert(err, Equals, authErr)
+
+	ok, _ = self.permissions.AuthorizeGetRetentionPolicy(self.dbAdmin, "db")
+	c.Assert(ok, Equals, true)
+
+	ok, _ = self.permissions.AuthorizeGetRetentionPolicy(self.dbAdmin, "otherdb")
+	c.Assert(ok, Equals, false)
+
+	ok, _ = self.permissions.AuthorizeGetRetentionPolicy(self.clusterAdmin, "db")
+	c.Assert(ok, Equals, true)
+}
+
 func (self *PermissionsSuite) TestAuthorizeCreateDatabase(c *C) {
 	var ok bool
 	var err common.AuthorizationError
@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,27 +15,59 @@ import (
 	log "code.google.com/p/log4go"
 )
 
+// Sends requests to a server over a pool of connections, the requests
+// are spread round robin over the connections. The responses are read
+// from the connection their request was sent on.
 type ProtobufClient struct {
-	connLock          sync.Mutex
-	conn              net.Conn
 	hostAndPort       string
 	requestBufferLock sync.RWMutex
 	requestBuffer     map[uint32]*runningRequest
-	reconnectWait     sync.WaitGroup
-	connectCalled     bool
 	lastRequestId     uint32
+	dialTimeout       time.Duration
+	readTimeout       time.Duration
 	writeTimeout      time.Duration
-	attempts          int
-	stopped           bool
-	reconChan         chan struct{}
-	reconGroup        *sync.WaitGroup
-	once              *sync.Once
+	// set once the client is closed, accessed atomically
+	stopped        int32
+	once           *sync.Once
+	connections    []*protobufConnection
+	nextConnection uint32
+	// idle connections get a heartbeat this often, zero disables it
+	healthCheckInterval time.Duration
+	// the wait between the attempts to reconnect a lost connection
+	// doubles from the min to the max backoff
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+	reconnectAttempts int64
+	// connections are encrypted if set
+	tlsConfig *tls.Config
+	// connects to the server instead of dialing it if set
+	dialer func() (net.Conn, error)
+}
+
+// One of the connections of the pool of a ProtobufClient
+type protobufConnection struct {
+	client     *ProtobufClient
+	connLock   sync.Mutex
+	conn       net.Conn
+	attempts   int
+	reconChan  chan struct{}
+	reconGroup *sync.WaitGroup
+	// whether the connection was dialed before, the dials after the
+	// first one are reconnect attempts
+	dialed bool
+	// whether a goroutine keeps reconnecting the connection
+	reconnecting bool
+	// the requests sent on the connection that wait for a response,
+	// the read deadline is only set while there are some
+	pending  int
+	lastRead time.Time
 }
 
 type runningRequest struct {
 	timeMade     time.Time
 	responseChan chan *protocol.Response
 	request      *protocol.Request
+	connection   *protobufConnection
 }
 
 const (
@@ -42,19 +75,81 @@ const (
 	MAX_RESPONSE_SIZE      = MAX_REQUEST_SIZE
 	MAX_REQUEST_TIME       = time.Second * 1200
 	RECONNECT_RETRY_WAIT   = time.Millisecond * 100
+
+	DEFAULT_MIN_RECONNECT_BACKOFF = time.Second
+	DEFAULT_MAX_RECONNECT_BACKOFF = 10 * time.Second
 )
 
+// The timeout is used to dial and write, the responses are read
+// without a timeout and a single connection is used unless
+// SetTimeouts and SetConnections say otherwise
 func NewProtobufClient(hostAndPort string, writeTimeout time.Duration) *ProtobufClient {
 	log.Debug("NewProtobufClient: ", hostAndPort)
-	return &ProtobufClient{
+	client := &ProtobufClient{
 		hostAndPort:   hostAndPort,
 		requestBuffer: make(map[uint32]*runningRequest),
+		dialTimeout:   writeTimeout,
 		writeTimeout:  writeTimeout,
-		reconChan:     make(chan struct{}, 1),
-		reconGroup:    new(sync.WaitGroup),
+		minBackoff:    DEFAULT_MIN_RECONNECT_BACKOFF,
+		maxBackoff:    DEFAULT_MAX_RECONNECT_BACKOFF,
 		once:          new(sync.Once),
-		stopped:       false,
 	}
+	client.SetConnections(1, 0)
+	return client
+}
+
+// Encrypts the connections to the server, has to be called before
+// Connect()
+func (self *ProtobufClient) SetTlsConfig(tlsConfig *tls.Config) {
+	self.tlsConfig = tlsConfig
+}
+
+// Sets the timeouts to connect to the server, to send a request and to
+// wait for the next response while some are expected. A connection
+// that times out is closed and replaced, the requests waiting for it
+// fail. Zero disables a timeout. Has to be called before Connect()
+func (self *ProtobufClient) SetTimeouts(dial, read, write time.Duration) {
+	self.dialTimeout = dial
+	self.readTimeout = read
+	self.writeTimeout = write
+}
+
+// Sets the number of connections to the server and how often the idle
+// ones are checked with a heartbeat, zero disables the checks. Has to
+// be called before Connect()
+func (self *ProtobufClient) SetConnections(count int, healthCheckInterval time.Duration) {
+	if count < 1 {
+		count = 1
+	}
+	self.connections = make([]*protobufConnection, count)
+	for i := range self.connections {
+		self.connections[i] = &protobufConnection{
+			client:     self,
+			reconChan:  make(chan struct{}, 1),
+			reconGroup: new(sync.WaitGroup),
+		}
+	}
+	self.healthCheckInterval = healthCheckInterval
+}
+
+// Sets the wait between the attempts to reconnect to the server after
+// the connection is lost or the server can't be reached, it starts at
+// min and doubles up to max. Has to be called before Connect()
+func (self *ProtobufClient) SetReconnectBackoff(min, max time.Duration) {
+	if min <= 0 {
+		min = DEFAULT_MIN_RECONNECT_BACKOFF
+	}
+	if max < min {
+		max = min
+	}
+	self.minBackoff = min
+	self.maxBackoff = max
+}
+
+// Returns the number of times the client tried to reconnect to the
+// server since it was created
+func (self *ProtobufClient) ReconnectAttempts() int64 {
+	return atomic.LoadInt64(&self.reconnectAttempts)
 }
 
 func (self *ProtobufClient) Connect() {
@@ -62,29 +157,29 @@ func (self *ProtobufClient) Connect() {
 }
 
 func (self *ProtobufClient) connect() {
-	self.reconChan <- struct{}{}
-	go func() {
-		self.reconnect()
-		self.readResponses()
-	}()
+	for _, connection := range self.connections {
+		connection.reconChan <- struct{}{}
+		go func(connection *protobufConnection) {
+			connection.reconnect()
+			connection.readResponses()
+		}(connection)
+	}
 	go self.peridicallySweepTimedOutRequests()
+	if self.healthCheckInterval > 0 {
+		go self.periodicallyCheckConnections()
+	}
 }
 
 func (self *ProtobufClient) Close() {
-	self.connLock.Lock()
-	defer self.connLock.Unlock()
-	if self.conn != nil {
-		self.conn.Close()
-		self.stopped = true
-		self.conn = nil
+	atomic.StoreInt32(&self.stopped, 1)
+	for _, connection := range self.connections {
+		connection.close()
 	}
 	self.ClearRequests()
 }
 
-func (self *ProtobufClient) getConnection() net.Conn {
-	self.connLock.Lock()
-	defer self.connLock.Unlock()
-	return self.conn
+func (self *ProtobufClient) isStopped() bool {
+	return atomic.LoadInt32(&self.stopped) == 1
 }
 
 func (self *ProtobufClient) ClearRequests() {
@@ -101,12 +196,20 @@ func (self *ProtobufClient) ClearRequests() {
 	}
 
 	self.requestBuffer = map[uint32]*runningRequest{}
+	for _, connection := range self.connections {
+		connection.setPending(0)
+	}
 }
 
 // Makes a request to the server. If the responseStream chan is not nil it will expect a response from the server
 // with a matching request.Id. The REQUEST_RETRY_ATTEMPTS constant of 3 and the RECONNECT_RETRY_WAIT of 100ms means
 // that an attempt to make a request to a downed server will take 300ms to time out.
 func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error {
+	next := atomic.AddUint32(&self.nextConnection, 1)
+	return self.makeRequest(self.connections[int(next)%len(self.connections)], request, responseStream)
+}
+
+func (self *ProtobufClient) makeRequest(connection *protobufConnection, request *protocol.Request, responseStream chan *protocol.Response) error {
 	if request.Id == nil {
 		id := atomic.AddUint32(&self.lastRequestId, uint32(1))
 		request.Id = &id
@@ -120,8 +223,9 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 			message := "already has a request with this id, must have timed out"
 			log.Error(message)
 			oldReq.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+			oldReq.connection.addPending(-1)
 		}
-		self.requestBuffer[*request.Id] = &runningRequest{timeMade: time.Now(), responseChan: responseStream, request: request}
+		self.requestBuffer[*request.Id] = &runningRequest{timeMade: time.Now(), responseChan: responseStream, request: request, connection: connection}
 		self.requestBufferLock.Unlock()
 	}
 
@@ -130,14 +234,18 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 		return err
 	}
 
-	conn := self.getConnection()
+	conn := connection.getConnection()
 	if conn == nil {
-		conn = self.reconnect()
+		conn = connection.reconnect()
 		if conn == nil {
+			self.forgetRequest(request)
 			return fmt.Errorf("Failed to connect to server %s", self.hostAndPort)
 		}
 	}
 
+	if responseStream != nil {
+		connection.addPending(1)
+	}
 	if self.writeTimeout > 0 {
 		conn.SetWriteDeadline(time.Now().Add(self.writeTimeout))
 	}
@@ -150,17 +258,223 @@ func (self *ProtobufClient) MakeRequest(request *protocol.Request, responseStrea
 	}
 
 	// if we got here it errored out, clear out the request
-	self.requestBufferLock.Lock()
-	delete(self.requestBuffer, *request.Id)
-	self.requestBufferLock.Unlock()
-	self.reconnect()
+	log.Error("Error while writing a request to %s, reconnecting: %s", self.hostAndPort, err)
+	self.forgetRequest(request)
+	connection.replace(conn)
 	return err
 }
 
-func (self *ProtobufClient) readResponses() {
+var cancelQueryRequestType = protocol.Request_CANCEL_QUERY
+
+// Sends the cancellation of the query request on the connection the
+// request was made on, the server stops it and ends its stream. Does
+// nothing if the request already ended.
+func (self *ProtobufClient) CancelRequest(request *protocol.Request) error {
+	self.requestBufferLock.RLock()
+	req, ok := self.requestBuffer[request.GetId()]
+	self.requestBufferLock.RUnlock()
+	if !ok || req.request != request {
+		return nil
+	}
+	cancel := &protocol.Request{Id: request.Id, Type: &cancelQueryRequestType, Database: request.Database}
+	return self.makeRequest(req.connection, cancel, nil)
+}
+
+func (self *ProtobufClient) forgetRequest(request *protocol.Request) {
+	self.requestBufferLock.Lock()
+	defer self.requestBufferLock.Unlock()
+	if req, ok := self.requestBuffer[*request.Id]; ok && req.request == request {
+		delete(self.requestBuffer, *request.Id)
+	}
+}
+
+func (self *ProtobufClient) sendResponse(response *protocol.Response) {
+	self.requestBufferLock.RLock()
+	req, ok := self.requestBuffer[*response.RequestId]
+	self.requestBufferLock.RUnlock()
+	if ok {
+		if *response.Type == protocol.Response_END_STREAM || *response.Type == protocol.Response_WRITE_OK || *response.Type == protocol.Response_HEARTBEAT || *response.Type == protocol.Response_ACCESS_DENIED {
+			self.requestBufferLock.Lock()
+			delete(self.requestBuffer, *response.RequestId)
+			self.requestBufferLock.Unlock()
+			req.connection.addPending(-1)
+		}
+		req.responseChan <- response
+	}
+}
+
+// Ends the requests waiting for a response on the connection with an
+// error, their responses can't come anymore
+func (self *ProtobufClient) failRequests(connection *protobufConnection) {
+	self.requestBufferLock.Lock()
+	defer self.requestBufferLock.Unlock()
+
+	message := fmt.Sprintf("lost the connection to %s", self.hostAndPort)
+	for id, req := range self.requestBuffer {
+		if req.connection != connection {
+			continue
+		}
+		select {
+		case req.responseChan <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}:
+		default:
+			log.Debug("Cannot send response on channel")
+		}
+		delete(self.requestBuffer, id)
+	}
+	connection.setPending(0)
+}
+
+func (self *ProtobufClient) dial() (net.Conn, error) {
+	if self.dialer != nil {
+		return self.dialer()
+	}
+	if self.tlsConfig == nil {
+		return net.DialTimeout("tcp", self.hostAndPort, self.dialTimeout)
+	}
+	dialer := &net.Dialer{Timeout: self.dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", self.hostAndPort, self.tlsConfig)
+	if err != nil {
+		// don't return a nil *tls.Conn as a non nil net.Conn
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (self *ProtobufClient) peridicallySweepTimedOutRequests() {
+	for {
+		time.Sleep(time.Minute)
+		self.requestBufferLock.Lock()
+		maxAge := time.Now().Add(-MAX_REQUEST_TIME)
+		for k, req := range self.requestBuffer {
+			if req.timeMade.Before(maxAge) {
+				delete(self.requestBuffer, k)
+				req.connection.addPending(-1)
+				log.Warn("Request timed out: ", req.request)
+			}
+		}
+		self.requestBufferLock.Unlock()
+	}
+}
+
+var healthCheckRequestType = protocol.Request_HEARTBEAT
+
+// Sends a heartbeat on the connections that are down or didn't read
+// anything for a health check interval, a dead connection fails to
+// send it or times out waiting for the response and gets replaced
+// before a request is sent on it
+func (self *ProtobufClient) periodicallyCheckConnections() {
+	for !self.isStopped() {
+		time.Sleep(self.healthCheckInterval)
+		for _, connection := range self.connections {
+			if !connection.isIdle(self.healthCheckInterval) {
+				continue
+			}
+			// buffered so a late response doesn't block the reader
+			responseChan := make(chan *protocol.Response, 1)
+			heartbeatRequest := &protocol.Request{
+				Type:     &healthCheckRequestType,
+				Database: protocol.String(""),
+			}
+			self.makeRequest(connection, heartbeatRequest, responseChan)
+		}
+	}
+}
+
+func (self *protobufConnection) getConnection() net.Conn {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	return self.conn
+}
+
+func (self *protobufConnection) setConnection(conn net.Conn) {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	self.conn = conn
+	self.lastRead = time.Now()
+}
+
+func (self *protobufConnection) close() {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+// Whether the connection is down or didn't wait for or read a response
+// for the given duration
+func (self *protobufConnection) isIdle(duration time.Duration) bool {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	return self.pending == 0 && (self.conn == nil || time.Now().Sub(self.lastRead) >= duration)
+}
+
+func (self *protobufConnection) addPending(delta int) {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	self.pending += delta
+	if self.pending < 0 {
+		self.pending = 0
+	}
+	self.updateReadDeadline()
+}
+
+func (self *protobufConnection) setPending(pending int) {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	self.pending = pending
+	self.updateReadDeadline()
+}
+
+// Called after reading a response
+func (self *protobufConnection) read() {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	self.lastRead = time.Now()
+	self.updateReadDeadline()
+}
+
+// The connection times out if it waits for responses and doesn't read
+// any for the read timeout. Idle connections don't time out. Has to be
+// called with the lock held.
+func (self *protobufConnection) updateReadDeadline() {
+	if self.conn == nil || self.client.readTimeout <= 0 {
+		return
+	}
+	if self.pending > 0 {
+		self.conn.SetReadDeadline(time.Now().Add(self.client.readTimeout))
+	} else {
+		self.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Closes the broken connection if it's still the current one, fails the
+// requests waiting for a response on it and connects again
+func (self *protobufConnection) replace(broken net.Conn) net.Conn {
+	self.connLock.Lock()
+	current := self.conn
+	if current == broken {
+		self.conn = nil
+	}
+	self.connLock.Unlock()
+
+	if current != broken {
+		// already replaced
+		return current
+	}
+	broken.Close()
+	self.client.failRequests(self)
+	if self.client.isStopped() {
+		return nil
+	}
+	return self.reconnect()
+}
+
+func (self *protobufConnection) readResponses() {
 	message := make([]byte, 0, MAX_RESPONSE_SIZE)
 	buff := bytes.NewBuffer(message)
-	for !self.stopped {
+	for !self.client.isStopped() {
 		buff.Reset()
 		conn := self.getConnection()
 		if conn == nil {
@@ -171,43 +485,39 @@ func (self *ProtobufClient) readResponses() {
 		var err error
 		err = binary.Read(conn, binary.LittleEndian, &messageSizeU)
 		if err != nil {
-			log.Error("Error while reading messsage size: %d", err)
-			time.Sleep(200 * time.Millisecond)
+			self.readFailed(conn, "Error while reading messsage size", err)
 			continue
 		}
 		messageSize := int64(messageSizeU)
 		messageReader := io.LimitReader(conn, messageSize)
 		_, err = io.Copy(buff, messageReader)
 		if err != nil {
-			log.Error("Error while reading message: %d", err)
-			time.Sleep(200 * time.Millisecond)
+			self.readFailed(conn, "Error while reading message", err)
 			continue
 		}
+		self.read()
 		response, err := protocol.DecodeResponse(buff)
 		if err != nil {
 			log.Error("error unmarshaling response: %s", err)
 			time.Sleep(200 * time.Millisecond)
 		} else {
-			self.sendResponse(response)
+			self.client.sendResponse(response)
 		}
 	}
 }
 
-func (self *ProtobufClient) sendResponse(response *protocol.Response) {
-	self.requestBufferLock.RLock()
-	req, ok := self.requestBuffer[*response.RequestId]
-	self.requestBufferLock.RUnlock()
-	if ok {
-		if *response.Type == protocol.Response_END_STREAM || *response.Type == protocol.Response_WRITE_OK || *response.Type == protocol.Response_HEARTBEAT || *response.Type == protocol.Response_ACCESS_DENIED {
-			self.requestBufferLock.Lock()
-			delete(self.requestBuffer, *response.RequestId)
-			self.requestBufferLock.Unlock()
-		}
-		req.responseChan <- response
+// A connection that can't be read from anymore, e.g. because the
+// server closed it or it timed out, is replaced
+func (self *protobufConnection) readFailed(conn net.Conn, message string, err error) {
+	if self.client.isStopped() {
+		return
 	}
+	log.Error("%s from %s, reconnecting: %s", message, self.client.hostAndPort, err)
+	self.replace(conn)
+	time.Sleep(200 * time.Millisecond)
 }
 
-func (self *ProtobufClient) reconnect() net.Conn {
+func (self *protobufConnection) reconnect() net.Conn {
 	select {
 	case <-self.reconChan:
 		self.reconGroup.Add(1)
@@ -217,39 +527,68 @@ func (self *ProtobufClient) reconnect() net.Conn {
 		}()
 	default:
 		self.reconGroup.Wait()
-		return self.conn
+		return self.getConnection()
 	}
 
-	if self.conn != nil {
-		self.conn.Close()
+	if conn := self.getConnection(); conn != nil {
+		conn.Close()
 	}
-	conn, err := net.DialTimeout("tcp", self.hostAndPort, self.writeTimeout)
+	if self.dialed {
+		atomic.AddInt64(&self.client.reconnectAttempts, 1)
+	}
+	self.dialed = true
+	conn, err := self.client.dial()
 	if err != nil {
+		self.setConnection(nil)
 		self.attempts++
-		if self.attempts < 100 {
-			return nil
+		if self.attempts%100 == 0 {
+			log.Error("failed to connect to %s %d times", self.client.hostAndPort, self.attempts)
 		}
-
-		log.Error("failed to connect to %s %d times", self.hostAndPort, self.attempts)
-		self.attempts = 0
+		self.keepReconnecting()
+		return nil
 	}
 
-	self.conn = conn
-	log.Info("connected to %s", self.hostAndPort)
+	if self.attempts > 0 {
+		log.Info("reconnected to %s after %d failed attempts", self.client.hostAndPort, self.attempts)
+	} else {
+		log.Info("connected to %s", self.client.hostAndPort)
+	}
+	self.attempts = 0
+	self.setConnection(conn)
 	return conn
 }
 
-func (self *ProtobufClient) peridicallySweepTimedOutRequests() {
-	for {
-		time.Sleep(time.Minute)
-		self.requestBufferLock.Lock()
-		maxAge := time.Now().Add(-MAX_REQUEST_TIME)
-		for k, req := range self.requestBuffer {
-			if req.timeMade.Before(maxAge) {
-				delete(self.requestBuffer, k)
-				log.Warn("Request timed out: ", req.request)
+// Starts a goroutine that reconnects the connection with an exponential
+// backoff unless one is running already, so a server that restarts is
+// reconnected without waiting for the next request
+func (self *protobufConnection) keepReconnecting() {
+	self.connLock.Lock()
+	defer self.connLock.Unlock()
+	if self.reconnecting || self.client.isStopped() {
+		return
+	}
+	self.reconnecting = true
+
+	go func() {
+		defer func() {
+			self.connLock.Lock()
+			self.reconnecting = false
+			self.connLock.Unlock()
+		}()
+
+		backoff := self.client.minBackoff
+		for !self.client.isStopped() && self.getConnection() == nil {
+			time.Sleep(backoff)
+			if self.client.isStopped() || self.getConnection() != nil {
+				return
+			}
+			if self.reconnect() != nil {
+				return
+			}
+			backoff *= 2
+			if backoff > self.client.maxBackoff {
+				backoff = self.client.maxBackoff
 			}
 		}
-		self.requestBufferLock.Unlock()
-	}
+	}()
 }
@@ -3,17 +3,23 @@ package coordinator
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"protocol"
+	"sync"
 	"testing"
 	"time"
 
 	log "code.google.com/p/log4go"
+	. "launchpad.net/gocheck"
 )
 
 type PingResponseServer struct {
 	Listener net.Listener
+	// the connections accepted so far
+	lock        sync.Mutex
+	connections []net.Conn
 }
 
 func (prs *PingResponseServer) Start() {
@@ -28,6 +34,9 @@ func (prs *PingResponseServer) Start() {
 			if err != nil {
 				break
 			}
+			prs.lock.Lock()
+			prs.connections = append(prs.connections, conn)
+			prs.lock.Unlock()
 
 			go prs.handleConnection(conn)
 		}
@@ -76,6 +85,16 @@ func (prs *PingResponseServer) handleConnection(conn net.Conn) {
 	conn.Close()
 }
 
+// Closes the connections accepted so far, the clients have to reconnect
+func (prs *PingResponseServer) CloseConnections() {
+	prs.lock.Lock()
+	defer prs.lock.Unlock()
+	for _, conn := range prs.connections {
+		conn.Close()
+	}
+	prs.connections = nil
+}
+
 func FakeHearbeatServer() *PingResponseServer {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -102,3 +121,149 @@ func BenchmarkSingle(b *testing.B) {
 		<-responseChan
 	}
 }
+
+type ProtobufClientSuite struct{}
+
+var _ = Suite(&ProtobufClientSuite{})
+
+func heartbeat(c *C, client *ProtobufClient) *protocol.Response {
+	responseChan := make(chan *protocol.Response, 1)
+	request := &protocol.Request{Type: &healthCheckRequestType, Database: protocol.String("")}
+	if err := client.MakeRequest(request, responseChan); err != nil {
+		return nil
+	}
+	select {
+	case response := <-responseChan:
+		return response
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the response")
+	}
+	return nil
+}
+
+func (self *ProtobufClientSuite) TestReconnectsAfterTheConnectionIsLost(c *C) {
+	prs := FakeHearbeatServer()
+	defer prs.Listener.Close()
+	client := NewProtobufClient(prs.Listener.Addr().String(), time.Second)
+	client.SetReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)
+	client.Connect()
+	defer client.Close()
+
+	c.Assert(heartbeat(c, client).GetType(), Equals, heartbeatResponse)
+	c.Assert(client.ReconnectAttempts(), Equals, int64(0))
+
+	// the reader notices the closed connection and connects again
+	prs.CloseConnections()
+	for i := 0; i < 100 && client.ReconnectAttempts() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(client.ReconnectAttempts() > 0, Equals, true)
+	var response *protocol.Response
+	for i := 0; i < 100 && response.GetType() != heartbeatResponse; i++ {
+		response = heartbeat(c, client)
+	}
+	c.Assert(response.GetType(), Equals, heartbeatResponse)
+}
+
+func (self *ProtobufClientSuite) TestReadTimeoutFailsTheWaitingRequests(c *C) {
+	// accepts the connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewProtobufClient(listener.Addr().String(), time.Second)
+	client.SetTimeouts(time.Second, 100*time.Millisecond, time.Second)
+	client.SetReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)
+	client.Connect()
+	defer client.Close()
+
+	start := time.Now()
+	response := heartbeat(c, client)
+	c.Assert(response, NotNil)
+	c.Assert(response.GetType(), Equals, endStreamResponse)
+	c.Assert(response.GetErrorMessage(), Matches, "lost the connection to .*")
+	c.Assert(time.Now().Sub(start) < 5*time.Second, Equals, true)
+
+	// the timed out connection is replaced
+	for i := 0; i < 100 && client.ReconnectAttempts() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(client.ReconnectAttempts() > 0, Equals, true)
+}
+
+func (self *ProtobufClientSuite) TestIdleConnectionsDontTimeOut(c *C) {
+	prs := FakeHearbeatServer()
+	defer prs.Listener.Close()
+	client := NewProtobufClient(prs.Listener.Addr().String(), time.Second)
+	client.SetTimeouts(time.Second, 50*time.Millisecond, time.Second)
+	client.Connect()
+	defer client.Close()
+
+	c.Assert(heartbeat(c, client).GetType(), Equals, heartbeatResponse)
+	time.Sleep(200 * time.Millisecond)
+	c.Assert(heartbeat(c, client).GetType(), Equals, heartbeatResponse)
+	c.Assert(client.ReconnectAttempts(), Equals, int64(0))
+}
+
+func (self *ProtobufClientSuite) TestReconnectBackoffDoubles(c *C) {
+	client := NewProtobufClient("localhost:1", time.Second)
+	client.SetReconnectBackoff(10*time.Millisecond, 40*time.Millisecond)
+	var lock sync.Mutex
+	dials := []time.Time{}
+	connected := make(chan struct{})
+	client.dialer = func() (net.Conn, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		dials = append(dials, time.Now())
+		if len(dials) < 6 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		conn, _ := net.Pipe()
+		close(connected)
+		return conn, nil
+	}
+	client.Connect()
+	defer client.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the reconnect")
+	}
+	// the reconnects stop once it's connected
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	c.Assert(dials, HasLen, 6)
+	c.Assert(client.ReconnectAttempts(), Equals, int64(5))
+	for i, backoff := range []time.Duration{10, 20, 40, 40, 40} {
+		waited := dials[i+1].Sub(dials[i])
+		c.Assert(waited >= backoff*time.Millisecond, Equals, true, Commentf("waited %s before attempt %d", waited, i+2))
+	}
+}
+
+func (self *ProtobufClientSuite) TestReconnectBackoffIsClamped(c *C) {
+	client := NewProtobufClient("localhost:1", time.Second)
+	for _, test := range []struct {
+		min, max                 time.Duration
+		expectedMin, expectedMax time.Duration
+	}{
+		{0, 0, DEFAULT_MIN_RECONNECT_BACKOFF, DEFAULT_MIN_RECONNECT_BACKOFF},
+		{-time.Second, time.Minute, DEFAULT_MIN_RECONNECT_BACKOFF, time.Minute},
+		{50 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+		{10 * time.Millisecond, time.Second, 10 * time.Millisecond, time.Second},
+	} {
+		client.SetReconnectBackoff(test.min, test.max)
+		c.Assert(client.minBackoff, Equals, test.expectedMin, Commentf("%s %s", test.min, test.max))
+		c.Assert(client.maxBackoff, Equals, test.expectedMax, Commentf("%s %s", test.min, test.max))
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"parser"
 	"protocol"
+	"sync"
+	"time"
 
 	log "code.google.com/p/log4go"
 )
@@ -18,15 +20,31 @@ type ProtobufRequestHandler struct {
 	coordinator   Coordinator
 	clusterConfig *cluster.ClusterConfiguration
 	writeOk       protocol.Response_Type
+
+	// the cancellation channels of the running queries
+	runningQueriesLock sync.Mutex
+	runningQueries     map[runningQuery]chan bool
+}
+
+// A query request is identified by its id and the connection it came on
+type runningQuery struct {
+	conn net.Conn
+	id   uint32
 }
 
 var (
 	internalError        = protocol.Response_INTERNAL_ERROR
 	accessDeniedResponse = protocol.Response_ACCESS_DENIED
+	checksumResponse     = protocol.Response_CHECKSUM
 )
 
 func NewProtobufRequestHandler(coordinator Coordinator, clusterConfig *cluster.ClusterConfiguration) *ProtobufRequestHandler {
-	return &ProtobufRequestHandler{coordinator: coordinator, writeOk: protocol.Response_WRITE_OK, clusterConfig: clusterConfig}
+	return &ProtobufRequestHandler{
+		coordinator:    coordinator,
+		writeOk:        protocol.Response_WRITE_OK,
+		clusterConfig:  clusterConfig,
+		runningQueries: make(map[runningQuery]chan bool),
+	}
 }
 
 func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, conn net.Conn) error {
@@ -36,9 +54,17 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 	case protocol.Request_DROP_DATABASE:
 		go self.handleDropDatabase(request, conn)
 	case protocol.Request_QUERY:
-		go self.handleQuery(request, conn)
+		// registered before the next request is read, which may cancel it
+		cancel := self.startQuery(request, conn)
+		go self.handleQuery(request, conn, cancel)
+	case protocol.Request_CANCEL_QUERY:
+		self.cancelQuery(request, conn)
+	case protocol.Request_CHECKSUM:
+		go self.handleChecksum(request, conn)
 	case protocol.Request_HEARTBEAT:
-		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse}
+		// the other server compares it to its clock to detect the skew
+		now := time.Now().UnixNano()
+		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse, Timestamp: &now}
 		return self.WriteResponse(conn, response)
 	default:
 		log.Error("unknown request type: %v", request)
@@ -62,7 +88,36 @@ func (self *ProtobufRequestHandler) handleWrites(request *protocol.Request, conn
 	}
 }
 
-func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn net.Conn) {
+func (self *ProtobufRequestHandler) startQuery(request *protocol.Request, conn net.Conn) chan bool {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	cancel := make(chan bool)
+	self.runningQueries[runningQuery{conn, request.GetId()}] = cancel
+	return cancel
+}
+
+func (self *ProtobufRequestHandler) endQuery(request *protocol.Request, conn net.Conn) {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	delete(self.runningQueries, runningQuery{conn, request.GetId()})
+}
+
+// Stops the running query with the id of the request, the queries that
+// ended already are ignored
+func (self *ProtobufRequestHandler) cancelQuery(request *protocol.Request, conn net.Conn) {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	key := runningQuery{conn, request.GetId()}
+	if cancel, ok := self.runningQueries[key]; ok {
+		log.Debug("Cancelling query request %d", request.GetId())
+		close(cancel)
+		delete(self.runningQueries, key)
+	}
+}
+
+func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn net.Conn, cancel <-chan bool) {
+	defer self.endQuery(request, conn)
+
 	// the query should always parse correctly since it was parsed at the originating server.
 	queries, err := parser.ParseQuery(*request.Query)
 	if err != nil || len(queries) < 1 {
@@ -73,6 +128,16 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 		return
 	}
 	query := queries[0]
+	if timeZone := request.GetTimeZone(); timeZone != "" && query.SelectQuery != nil {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Unknown time zone %s: %s", timeZone, err)
+			response := &protocol.Response{Type: &endStreamResponse, ErrorMessage: &errorMsg, RequestId: request.Id}
+			self.WriteResponse(conn, response)
+			return
+		}
+		query.SelectQuery.SetTimeZone(location)
+	}
 	var user common.User
 	if *request.IsDbUser {
 		user = self.clusterConfig.GetDbUser(*request.Database, *request.UserName)
@@ -90,6 +155,7 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 
 	querySpec := parser.NewQuerySpec(user, *request.Database, query)
+	querySpec.SetCancelChannel(cancel)
 
 	responseChan := make(chan *protocol.Response)
 	if querySpec.IsDestructiveQuery() {
@@ -114,6 +180,23 @@ func (self *ProtobufRequestHandler) handleDropDatabase(request *protocol.Request
 	self.WriteResponse(conn, response)
 }
 
+func (self *ProtobufRequestHandler) handleChecksum(request *protocol.Request, conn net.Conn) {
+	window := time.Duration(request.GetChecksumWindow())
+	checksums, err := self.clusterConfig.LocalShardChecksums(*request.ShardId, window)
+	if err != nil {
+		log.Error("Error computing the checksums of shard %d: %s", *request.ShardId, err)
+		response := &protocol.Response{Type: &endStreamResponse, ErrorMessage: protocol.String(err.Error()), RequestId: request.Id}
+		self.WriteResponse(conn, response)
+		return
+	}
+	response := &protocol.Response{Type: &checksumResponse, Series: cluster.ChecksumsToSeries(checksums), RequestId: request.Id}
+	if err := self.WriteResponse(conn, response); err != nil {
+		return
+	}
+	response = &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	self.WriteResponse(conn, response)
+}
+
 func (self *ProtobufRequestHandler) WriteResponse(conn net.Conn, response *protocol.Response) error {
 	if response.Size() >= MAX_RESPONSE_SIZE {
 		l := len(response.Series.Points)
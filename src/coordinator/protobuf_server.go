@@ -2,12 +2,14 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"net"
 	"protocol"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -19,6 +21,10 @@ type ProtobufServer struct {
 	requestHandler    RequestHandler
 	connectionMapLock sync.Mutex
 	connectionMap     map[net.Conn]bool
+	listening         int32
+	// only encrypted connections with a valid client certificate are
+	// accepted if set
+	tlsConfig *tls.Config
 }
 
 const KILOBYTE = 1024
@@ -30,7 +36,16 @@ func NewProtobufServer(port string, requestHandler RequestHandler) *ProtobufServ
 	return server
 }
 
+func (self *ProtobufServer) SetTlsConfig(tlsConfig *tls.Config) {
+	self.tlsConfig = tlsConfig
+}
+
+func (self *ProtobufServer) IsListening() bool {
+	return atomic.LoadInt32(&self.listening) == 1
+}
+
 func (self *ProtobufServer) Close() {
+	atomic.StoreInt32(&self.listening, 0)
 	self.listener.Close()
 	self.connectionMapLock.Lock()
 	defer self.connectionMapLock.Unlock()
@@ -53,18 +68,22 @@ func (self *ProtobufServer) Close() {
 	}
 }
 
-func (self *ProtobufServer) ListenAndServe() {
+func (self *ProtobufServer) ListenAndServe() error {
 	ln, err := net.Listen("tcp", self.port)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if self.tlsConfig != nil {
+		ln = tls.NewListener(ln, self.tlsConfig)
 	}
 	self.listener = ln
+	atomic.StoreInt32(&self.listening, 1)
 	log.Info("ProtobufServer listening on %s", self.port)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Error("Error with TCP connection. Assuming server is closing: %s", err)
-			break
+			return nil
 		}
 		self.connectionMapLock.Lock()
 		self.connectionMap[conn] = true
@@ -0,0 +1,237 @@
+package coordinator
+
+import (
+	"common"
+	"container/list"
+	"parser"
+	"protocol"
+	"sync"
+	"time"
+)
+
+// Keeps the results of the queries over time ranges that ended more
+// than write-max-age ago, which the clients can't write to through any
+// of the servers, so the dashboards running the same queries over and
+// over don't read the shards every time. The results are dropped once
+// they expire, when the least recently used ones make room for new ones
+// and when points written through this server, by a continuous query or
+// a restore, or a delete through this server change their time range.
+type QueryCache struct {
+	size      int
+	ttl       time.Duration
+	maxPoints int
+	lock      sync.Mutex
+	// the most recently used results are at the front
+	results *list.List
+	byKey   map[string]*list.Element
+}
+
+type cachedResult struct {
+	key      string
+	database string
+	// the time range of the query in microseconds
+	start, end int64
+	series     []*protocol.Series
+	expires    time.Time
+}
+
+// A zero size disables the cache, the results of more than maxPoints
+// points aren't cached
+func NewQueryCache(size int, ttl time.Duration, maxPoints int) *QueryCache {
+	return &QueryCache{
+		size:      size,
+		ttl:       ttl,
+		maxPoints: maxPoints,
+		results:   list.New(),
+		byKey:     map[string]*list.Element{},
+	}
+}
+
+func (self *QueryCache) isEnabled() bool {
+	return self.size > 0
+}
+
+// Returns copies of the cached series of the query, false if its
+// results aren't cached or expired
+func (self *QueryCache) get(key string) ([]*protocol.Series, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	element, ok := self.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	result := element.Value.(*cachedResult)
+	if self.ttl > 0 && time.Now().After(result.expires) {
+		self.remove(element)
+		return nil, false
+	}
+	self.results.MoveToFront(element)
+	return copyAllSeries(result.series), true
+}
+
+func (self *QueryCache) put(key, database string, start, end int64, series []*protocol.Series) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if element, ok := self.byKey[key]; ok {
+		self.remove(element)
+	}
+	result := &cachedResult{key, database, start, end, series, time.Now().Add(self.ttl)}
+	self.byKey[key] = self.results.PushFront(result)
+	for self.results.Len() > self.size {
+		self.remove(self.results.Back())
+	}
+}
+
+// Drops the results of the queries of the database whose time range
+// overlaps the one of the points written, in microseconds
+func (self *QueryCache) invalidate(database string, start, end int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for element := self.results.Front(); element != nil; {
+		next := element.Next()
+		result := element.Value.(*cachedResult)
+		if result.database == database && start <= result.end && end >= result.start {
+			self.remove(element)
+		}
+		element = next
+	}
+}
+
+// Drops the results of the queries of the database
+func (self *QueryCache) clear(database string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for element := self.results.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cachedResult).database == database {
+			self.remove(element)
+		}
+		element = next
+	}
+}
+
+// Has to be called with the lock held
+func (self *QueryCache) remove(element *list.Element) {
+	delete(self.byKey, element.Value.(*cachedResult).key)
+	self.results.Remove(element)
+}
+
+func copyAllSeries(series []*protocol.Series) []*protocol.Series {
+	copies := make([]*protocol.Series, 0, len(series))
+	for _, s := range series {
+		copies = append(copies, copySeries(s))
+	}
+	return copies
+}
+
+// Returns the key of the results of the select query in the cache,
+// false if they can still change. The query has to end before the
+// points older than write-max-age are rejected, the writes through the
+// other servers don't drop the results of this one.
+func (self *CoordinatorImpl) queryCacheKey(querySpec *parser.QuerySpec) (string, bool) {
+	query := querySpec.SelectQuery()
+	if !self.queryCache.isEnabled() || self.config.WriteMaxAge <= 0 {
+		return "", false
+	}
+	if query == nil || query.IsExplainQuery() || !query.IsEndTimeSpecified() {
+		return "", false
+	}
+	if query.GetFromClause().Type == parser.FromClauseSubquery {
+		return "", false
+	}
+	if !query.GetEndTime().Before(time.Now().Add(-self.config.WriteMaxAge)) {
+		return "", false
+	}
+
+	timeZone := ""
+	if location := query.GetGroupByClause().Location; location != nil {
+		timeZone = location.String()
+	}
+	// the results depend on the read permissions of the user
+	return querySpec.Database() + "\x00" + querySpec.User().GetName() + "\x00" + timeZone + "\x00" + query.GetQueryStringWithTimeCondition(), true
+}
+
+// Runs the select query, or writes its cached results if it has some
+func (self *CoordinatorImpl) runCachedQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	key, ok := self.queryCacheKey(querySpec)
+	if !ok {
+		return self.runQuery(querySpec, seriesWriter)
+	}
+	if series, ok := self.queryCache.get(key); ok {
+		for _, s := range series {
+			if err := seriesWriter.Write(s); err != nil {
+				return err
+			}
+		}
+		seriesWriter.Close()
+		return nil
+	}
+
+	writer := &cachingWriter{SeriesWriter: seriesWriter, maxPoints: self.queryCache.maxPoints}
+	if err := self.runQuery(querySpec, writer); err != nil {
+		return err
+	}
+	if writer.failed || querySpec.IsCancelled() {
+		return nil
+	}
+	query := querySpec.SelectQuery()
+	start := common.TimeToMicroseconds(query.GetStartTime())
+	end := common.TimeToMicroseconds(query.GetEndTime())
+	self.queryCache.put(key, querySpec.Database(), start, end, writer.series)
+	return nil
+}
+
+// Keeps copies of the series written to it for the query cache, the
+// results that are too large or that failed to be written aren't kept
+type cachingWriter struct {
+	SeriesWriter
+	lock      sync.Mutex
+	maxPoints int
+	points    int
+	series    []*protocol.Series
+	failed    bool
+}
+
+func (self *cachingWriter) Write(series *protocol.Series) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.failed {
+		self.points += len(series.Points)
+		if self.maxPoints > 0 && self.points > self.maxPoints {
+			self.failed = true
+			self.series = nil
+		} else {
+			self.series = append(self.series, copySeries(series))
+		}
+	}
+	err := self.SeriesWriter.Write(series)
+	if err != nil {
+		self.failed = true
+	}
+	return err
+}
+
+// Drops the cached results of the database that the points change,
+// called once they're written
+func (self *CoordinatorImpl) invalidateQueryCache(db string, series []*protocol.Series) {
+	if !self.queryCache.isEnabled() {
+		return
+	}
+	written := false
+	var start, end int64
+	for _, s := range series {
+		for _, point := range s.Points {
+			timestamp := point.GetTimestamp()
+			if !written || timestamp < start {
+				start = timestamp
+			}
+			if !written || timestamp > end {
+				end = timestamp
+			}
+			written = true
+		}
+	}
+	if written {
+		self.queryCache.invalidate(db, start, end)
+	}
+}
@@ -0,0 +1,245 @@
+package coordinator
+
+import (
+	"bufio"
+	"common"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"protocol"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+type QueryJobStatus string
+
+const (
+	QueryJobRunning   QueryJobStatus = "running"
+	QueryJobDone      QueryJobStatus = "done"
+	QueryJobFailed    QueryJobStatus = "failed"
+	QueryJobCancelled QueryJobStatus = "cancelled"
+)
+
+// A query submitted to run in the background. The results are written
+// to a temporary file that's removed when the job expires or is
+// deleted.
+type QueryJob struct {
+	Id         string
+	Database   string
+	Query      string
+	Status     QueryJobStatus
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	user       common.User
+	resultFile string
+	cancel     chan bool
+	lock       sync.Mutex
+}
+
+// Returns a copy of the job that's safe to read while the job is
+// still running
+func (self *QueryJob) Snapshot() *QueryJob {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return &QueryJob{
+		Id:         self.Id,
+		Database:   self.Database,
+		Query:      self.Query,
+		Status:     self.Status,
+		Error:      self.Error,
+		StartedAt:  self.StartedAt,
+		FinishedAt: self.FinishedAt,
+		resultFile: self.resultFile,
+	}
+}
+
+// Yields the series written by the query so far
+func (self *QueryJob) ReadResults(yield func(*protocol.Series) error) error {
+	f, err := os.Open(self.resultFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		series := &protocol.Series{}
+		if err := decoder.Decode(series); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := yield(series); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *QueryJob) finish(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.FinishedAt = time.Now()
+	switch {
+	case self.Status == QueryJobCancelled:
+	case err != nil:
+		self.Status = QueryJobFailed
+		self.Error = err.Error()
+	default:
+		self.Status = QueryJobDone
+	}
+}
+
+func (self *QueryJob) isAccessibleBy(user common.User, db string) bool {
+	if self.Database != db {
+		return false
+	}
+	return user.IsClusterAdmin() || user.GetName() == self.user.GetName()
+}
+
+// Writes the series of a query job to its result file, one json
+// encoded series per line
+type queryJobWriter struct {
+	encoder *json.Encoder
+}
+
+func (self *queryJobWriter) Write(series *protocol.Series) error {
+	return self.encoder.Encode(series)
+}
+
+func (self *queryJobWriter) Close() {
+}
+
+// Runs the queries of the jobs, i.e. the coordinator
+type queryJobRunner interface {
+	RunQueryWithCancel(user common.User, database string, queryString string, seriesWriter SeriesWriter, cancel <-chan bool) error
+}
+
+// Keeps track of the query jobs, jobs are removed ttl after they
+// finished
+type QueryJobRegistry struct {
+	jobs   map[string]*QueryJob
+	lock   sync.RWMutex
+	ttl    time.Duration
+	runner queryJobRunner
+}
+
+func NewQueryJobRegistry(runner queryJobRunner, ttl time.Duration) *QueryJobRegistry {
+	registry := &QueryJobRegistry{
+		jobs:   make(map[string]*QueryJob),
+		ttl:    ttl,
+		runner: runner,
+	}
+	if ttl > 0 {
+		go registry.expireJobs()
+	}
+	return registry
+}
+
+// Starts running the query in the background and returns immediately
+func (self *QueryJobRegistry) Submit(user common.User, db, query string) (*QueryJob, error) {
+	id, err := common.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "influxdb-query-"+id)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &QueryJob{
+		Id:         id,
+		Database:   db,
+		Query:      query,
+		Status:     QueryJobRunning,
+		StartedAt:  time.Now(),
+		user:       user,
+		resultFile: f.Name(),
+		cancel:     make(chan bool),
+	}
+
+	self.lock.Lock()
+	self.jobs[id] = job
+	self.lock.Unlock()
+
+	go func() {
+		defer f.Close()
+		writer := &queryJobWriter{json.NewEncoder(f)}
+		err := self.runner.RunQueryWithCancel(user, db, query, writer, job.cancel)
+		if err != nil {
+			log.Info("Query job %s failed: %s", id, err)
+		}
+		job.finish(err)
+	}()
+
+	return job, nil
+}
+
+func (self *QueryJobRegistry) Get(user common.User, db, id string) (*QueryJob, error) {
+	self.lock.RLock()
+	job := self.jobs[id]
+	self.lock.RUnlock()
+
+	if job == nil || !job.isAccessibleBy(user, db) {
+		return nil, fmt.Errorf("Query job %s doesn't exist", id)
+	}
+	return job, nil
+}
+
+// Cancels the job if it's still running and removes it
+func (self *QueryJobRegistry) Delete(user common.User, db, id string) error {
+	job, err := self.Get(user, db, id)
+	if err != nil {
+		return err
+	}
+
+	job.lock.Lock()
+	if job.Status == QueryJobRunning {
+		job.Status = QueryJobCancelled
+		close(job.cancel)
+	}
+	job.lock.Unlock()
+
+	self.remove(job)
+	return nil
+}
+
+func (self *QueryJobRegistry) remove(job *QueryJob) {
+	self.lock.Lock()
+	delete(self.jobs, job.Id)
+	self.lock.Unlock()
+
+	if err := os.Remove(job.resultFile); err != nil && !os.IsNotExist(err) {
+		log.Error("Cannot remove the results of query job %s: %s", job.Id, err)
+	}
+}
+
+func (self *QueryJobRegistry) expireJobs() {
+	interval := self.ttl / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	for _ = range time.Tick(interval) {
+		expired := []*QueryJob{}
+		self.lock.RLock()
+		for _, job := range self.jobs {
+			snapshot := job.Snapshot()
+			if snapshot.Status != QueryJobRunning && time.Now().Sub(snapshot.FinishedAt) > self.ttl {
+				expired = append(expired, job)
+			}
+		}
+		self.lock.RUnlock()
+
+		for _, job := range expired {
+			log.Debug("Query job %s expired", job.Id)
+			self.remove(job)
+		}
+	}
+}
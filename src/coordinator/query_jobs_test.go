@@ -0,0 +1,169 @@
+package coordinator
+
+import (
+	"common"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+	"protocol"
+	"time"
+)
+
+type QueryJobSuite struct{}
+
+var _ = Suite(&QueryJobSuite{})
+
+// Writes a series and blocks until it's released or the query is
+// cancelled, then returns err
+type blockingQueryRunner struct {
+	release   chan bool
+	cancelled chan bool
+	err       error
+}
+
+func newBlockingQueryRunner(err error) *blockingQueryRunner {
+	return &blockingQueryRunner{make(chan bool), make(chan bool, 1), err}
+}
+
+func (self *blockingQueryRunner) RunQueryWithCancel(user common.User, database string, queryString string, seriesWriter SeriesWriter, cancel <-chan bool) error {
+	series, err := common.StringToSeriesArray(`[{"name": "cpu", "fields": ["value"], "points": [{"values": [{"int64_value": 1}], "timestamp": 10}]}]`)
+	if err != nil {
+		return err
+	}
+	if err := seriesWriter.Write(series[0]); err != nil {
+		return err
+	}
+	select {
+	case <-self.release:
+		return self.err
+	case <-cancel:
+		self.cancelled <- true
+		return fmt.Errorf("cancelled")
+	}
+}
+
+type namedUser struct {
+	MockUser
+	name string
+}
+
+func (self *namedUser) GetName() string {
+	return self.name
+}
+
+// Waits for the job to finish and returns its status
+func waitForQueryJob(c *C, job *QueryJob) *QueryJob {
+	for i := 0; i < 100 && job.Snapshot().Status == QueryJobRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snapshot := job.Snapshot()
+	c.Assert(snapshot.Status, Not(Equals), QueryJobRunning)
+	return snapshot
+}
+
+func (self *QueryJobSuite) TestJobsWriteTheResultsOfTheirQuery(c *C) {
+	runner := newBlockingQueryRunner(nil)
+	registry := NewQueryJobRegistry(runner, 0)
+	user := &MockUser{}
+
+	job, err := registry.Submit(user, "db", "select value from cpu")
+	c.Assert(err, IsNil)
+	c.Assert(job.Snapshot().Status, Equals, QueryJobRunning)
+	defer os.Remove(job.resultFile)
+
+	// only the user who submitted the job and the cluster admins can
+	// get it, from its database
+	for _, test := range []struct {
+		user common.User
+		db   string
+		ok   bool
+	}{
+		{user, "db", true},
+		{&MockUser{clusterAdmin: true}, "db", true},
+		{&namedUser{name: "other"}, "db", false},
+		{user, "otherdb", false},
+	} {
+		found, err := registry.Get(test.user, test.db, job.Id)
+		if test.ok {
+			c.Assert(err, IsNil)
+			c.Assert(found, Equals, job)
+		} else {
+			c.Assert(err, ErrorMatches, "Query job .* doesn't exist")
+		}
+	}
+
+	runner.release <- true
+	snapshot := waitForQueryJob(c, job)
+	c.Assert(snapshot.Status, Equals, QueryJobDone)
+	c.Assert(snapshot.FinishedAt.IsZero(), Equals, false)
+	series := []*protocol.Series{}
+	c.Assert(job.ReadResults(func(s *protocol.Series) error {
+		series = append(series, s)
+		return nil
+	}), IsNil)
+	c.Assert(series, HasLen, 1)
+	c.Assert(series[0].GetName(), Equals, "cpu")
+	c.Assert(series[0].Points, HasLen, 1)
+}
+
+func (self *QueryJobSuite) TestFailedJobsKeepTheirError(c *C) {
+	runner := newBlockingQueryRunner(fmt.Errorf("Couldn't find series: cpu"))
+	registry := NewQueryJobRegistry(runner, 0)
+
+	job, err := registry.Submit(&MockUser{}, "db", "select value from cpu")
+	c.Assert(err, IsNil)
+	defer os.Remove(job.resultFile)
+	runner.release <- true
+	snapshot := waitForQueryJob(c, job)
+	c.Assert(snapshot.Status, Equals, QueryJobFailed)
+	c.Assert(snapshot.Error, Equals, "Couldn't find series: cpu")
+}
+
+func (self *QueryJobSuite) TestDeletedJobsAreCancelledAndRemoved(c *C) {
+	runner := newBlockingQueryRunner(nil)
+	registry := NewQueryJobRegistry(runner, 0)
+	user := &MockUser{}
+
+	job, err := registry.Submit(user, "db", "select value from cpu")
+	c.Assert(err, IsNil)
+	c.Assert(registry.Delete(&namedUser{name: "other"}, "db", job.Id), NotNil)
+	c.Assert(registry.Delete(user, "db", job.Id), IsNil)
+
+	select {
+	case <-runner.cancelled:
+	case <-time.After(time.Second):
+		c.Fatal("the query wasn't cancelled")
+	}
+	// the cancellation isn't reported as a failure
+	c.Assert(waitForQueryJob(c, job).Status, Equals, QueryJobCancelled)
+	_, err = registry.Get(user, "db", job.Id)
+	c.Assert(err, NotNil)
+	_, err = os.Stat(job.resultFile)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(registry.Delete(user, "db", job.Id), NotNil)
+}
+
+func (self *QueryJobSuite) TestFinishedJobsExpire(c *C) {
+	runner := newBlockingQueryRunner(nil)
+	registry := NewQueryJobRegistry(runner, 50*time.Millisecond)
+	user := &MockUser{}
+
+	job, err := registry.Submit(user, "db", "select value from cpu")
+	c.Assert(err, IsNil)
+	// the running jobs don't expire
+	time.Sleep(150 * time.Millisecond)
+	_, err = registry.Get(user, "db", job.Id)
+	c.Assert(err, IsNil)
+
+	runner.release <- true
+	waitForQueryJob(c, job)
+	for i := 0; i < 100; i++ {
+		if _, err = registry.Get(user, "db", job.Id); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(err, ErrorMatches, "Query job .* doesn't exist")
+	_, err = os.Stat(job.resultFile)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,70 @@
+package coordinator
+
+import (
+	"common"
+	"sync/atomic"
+)
+
+// Limits the number of queries running at once. The queries above the
+// limit wait in a queue for one to finish, they're rejected once the
+// queue is full.
+type QueryLimiter struct {
+	// a slot for each query that can run, nil if they aren't limited
+	slots     chan struct{}
+	maxQueued int64
+	running   int64
+	queued    int64
+}
+
+// A maxRunning of zero doesn't limit the queries
+func NewQueryLimiter(maxRunning, maxQueued int) *QueryLimiter {
+	limiter := &QueryLimiter{maxQueued: int64(maxQueued)}
+	if maxRunning > 0 {
+		limiter.slots = make(chan struct{}, maxRunning)
+	}
+	return limiter
+}
+
+// Waits until the query can run. Returns a QueryQueueFullError if the
+// query would have to wait and the queue is full, or the
+// QueryCancelledError if cancel is closed while it waits. Release has
+// to be called once the query is done unless an error is returned.
+func (self *QueryLimiter) Acquire(cancel <-chan bool) error {
+	if self.slots == nil {
+		atomic.AddInt64(&self.running, 1)
+		return nil
+	}
+
+	select {
+	case self.slots <- struct{}{}:
+		atomic.AddInt64(&self.running, 1)
+		return nil
+	default:
+	}
+
+	if queued := atomic.AddInt64(&self.queued, 1); queued > self.maxQueued {
+		atomic.AddInt64(&self.queued, -1)
+		return common.NewQueryQueueFullError(cap(self.slots), int(self.maxQueued))
+	}
+	defer atomic.AddInt64(&self.queued, -1)
+
+	select {
+	case self.slots <- struct{}{}:
+		atomic.AddInt64(&self.running, 1)
+		return nil
+	case <-cancel:
+		return common.QueryCancelledError
+	}
+}
+
+func (self *QueryLimiter) Release() {
+	atomic.AddInt64(&self.running, -1)
+	if self.slots != nil {
+		<-self.slots
+	}
+}
+
+// Returns the number of queries running and waiting in the queue
+func (self *QueryLimiter) Counts() (running, queued int) {
+	return int(atomic.LoadInt64(&self.running)), int(atomic.LoadInt64(&self.queued))
+}
@@ -0,0 +1,176 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"parser"
+	"time"
+)
+
+// How a select query would run, returned instead of the results of
+// queries that are only explained
+type QueryPlan struct {
+	Query string `json:"query"`
+	// the series the query reads, regexes are only matched against the
+	// series of the shards when the query runs
+	Series []string `json:"series"`
+	// where the points are aggregated: "shards", "coordinator" or
+	// "none" if the query has no aggregates
+	Aggregation string `json:"aggregation"`
+	// the number of shards that are queried at the same time
+	ConcurrentShards int `json:"concurrentShards"`
+	// false if the coordinator has to read all the points before it can
+	// return the first result
+	Streams bool `json:"streams"`
+	// the sum of the estimates of the shards that have one
+	EstimatedPoints int64             `json:"estimatedPoints"`
+	Shards          []*ShardQueryPlan `json:"shards"`
+	Subquery        *QueryPlan        `json:"subquery,omitempty"`
+}
+
+type ShardQueryPlan struct {
+	Id        uint32    `json:"id"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	ServerIds []uint32  `json:"serverIds"`
+	Local     bool      `json:"local"`
+	// true if the shard aggregates its points before sending them
+	AggregateLocally bool `json:"aggregateLocally"`
+	// the number of responses the coordinator buffers for the shard
+	ResponseBufferSize int `json:"responseBufferSize"`
+	// the points of all the series of a local shard in the time range of
+	// the query as of its last scan, so an upper bound. -1 for the shards
+	// that aren't local or weren't scanned yet.
+	EstimatedPoints int64 `json:"estimatedPoints"`
+}
+
+// Returns the plans of the select queries without running them
+func (self *CoordinatorImpl) ExplainQuery(user common.User, database string, queryString string) ([]*QueryPlan, error) {
+	queries, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := []*QueryPlan{}
+	for _, query := range queries {
+		if query.SelectQuery == nil || query.SelectQuery.IsContinuousQuery() {
+			return nil, common.NewQueryError(common.InvalidArgument, "Only select queries can be explained")
+		}
+		plan, err := self.queryPlan(parser.NewQuerySpec(user, database, query))
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+func (self *CoordinatorImpl) queryPlan(querySpec *parser.QuerySpec) (*QueryPlan, error) {
+	query := querySpec.SelectQuery()
+	plan := &QueryPlan{
+		Query:  query.GetQueryStringWithTimeCondition(),
+		Series: []string{},
+		Shards: []*ShardQueryPlan{},
+	}
+
+	if query.GetFromClause().Type == parser.FromClauseSubquery {
+		subquery, err := self.queryPlan(querySpec.SubquerySpec())
+		if err != nil {
+			return nil, err
+		}
+		plan.Subquery = subquery
+		plan.Aggregation = "coordinator"
+		if !query.HasAggregates() {
+			plan.Aggregation = "none"
+		}
+		plan.Streams = subquery.Streams && !buffersAllPoints(query)
+		return plan, nil
+	}
+
+	if err := self.checkPermission(querySpec.User(), querySpec); err != nil {
+		return nil, err
+	}
+	for _, name := range query.GetFromClause().Names {
+		plan.Series = append(plan.Series, name.Name.GetString())
+	}
+
+	shards := self.clusterConfiguration.GetShards(querySpec)
+	aggregateLocally := self.shouldAggregateLocally(shards, querySpec)
+	switch {
+	case !query.HasAggregates():
+		plan.Aggregation = "none"
+	case aggregateLocally:
+		plan.Aggregation = "shards"
+	default:
+		plan.Aggregation = "coordinator"
+	}
+	plan.Streams = aggregateLocally || !buffersAllPoints(query)
+
+	plan.ConcurrentShards = self.shardConcurrentLimit(shards, querySpec)
+	if plan.ConcurrentShards > len(shards) {
+		plan.ConcurrentShards = len(shards)
+	}
+
+	stats := self.clusterConfiguration.LocalShardStats()
+	for _, shard := range shards {
+		bufferSize := shard.QueryResponseBufferSize(querySpec, self.config.StoragePointBatchSize)
+		if bufferSize > self.config.ClusterMaxResponseBufferSize {
+			bufferSize = self.config.ClusterMaxResponseBufferSize
+		}
+		shardPlan := &ShardQueryPlan{
+			Id:                 shard.Id(),
+			StartTime:          shard.StartTime(),
+			EndTime:            shard.EndTime(),
+			ServerIds:          shard.ServerIds(),
+			Local:              shard.IsLocal,
+			AggregateLocally:   shard.ShouldAggregateLocally(querySpec),
+			ResponseBufferSize: bufferSize,
+			EstimatedPoints:    -1,
+		}
+		if shard.IsLocal {
+			if shardStats := stats[shard.Id()]; shardStats != nil && !shardStats.ScannedAt.IsZero() {
+				shardPlan.EstimatedPoints = estimatePoints(shardStats, query)
+				plan.EstimatedPoints += shardPlan.EstimatedPoints
+			}
+		}
+		plan.Shards = append(plan.Shards, shardPlan)
+	}
+	return plan, nil
+}
+
+// The engine of the coordinator returns the results of the aggregates
+// without a group by time() and of the fill() queries once it read all
+// the points
+func buffersAllPoints(query *parser.SelectQuery) bool {
+	if !query.HasAggregates() {
+		return false
+	}
+	groupBy := query.GetGroupByClause()
+	duration, err := groupBy.GetGroupByTime()
+	return err != nil || duration == nil || groupBy.FillWithZero
+}
+
+// Prorates the points of the shard to the part of its time range the
+// query reads, assuming the points are spread evenly
+func estimatePoints(stats *cluster.LocalShardStats, query *parser.SelectQuery) int64 {
+	if stats.FirstPointTime == nil || stats.LastPointTime == nil {
+		return 0
+	}
+	first := time.Unix(*stats.FirstPointTime, 0)
+	last := time.Unix(*stats.LastPointTime, 0).Add(time.Second)
+	start, end := query.GetStartTime(), query.GetEndTime()
+	if start.Before(first) {
+		start = first
+	}
+	if end.After(last) {
+		end = last
+	}
+	if !end.After(start) {
+		return 0
+	}
+	fraction := float64(end.Sub(start)) / float64(last.Sub(first))
+	if fraction > 1 {
+		fraction = 1
+	}
+	return int64(fraction * float64(stats.Points))
+}
@@ -0,0 +1,213 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"configuration"
+	"sync"
+	"time"
+)
+
+// the databases and the users that didn't write or query for this long
+// are forgotten, with their usage
+const quotaTenantExpiry = time.Hour
+
+// The points written and the queries run by a database or a user
+// since it was last idle for quotaTenantExpiry, including the ones
+// rejected for being over its quota
+type QuotaUsage struct {
+	PointsWritten    int64 `json:"pointsWritten"`
+	PointsRejected   int64 `json:"pointsRejected"`
+	Queries          int64 `json:"queries"`
+	QueriesRejected  int64 `json:"queriesRejected"`
+	PointsPerSecond  int   `json:"pointsPerSecond"`
+	QueriesPerSecond int   `json:"queriesPerSecond"`
+}
+
+// Limits the points per second written and the queries per second run
+// by each database and each user. The retention policies of a database
+// share its quota. The quotas of the databases apply to everyone,
+// including the cluster admins the graphite and udp listeners write
+// as, the cluster admins are only exempt from the quotas of the users.
+// Each server enforces the quotas on its own.
+type Quotas struct {
+	lock      sync.Mutex
+	databases *quotaGroup
+	users     *quotaGroup
+}
+
+// The quotas of the databases or of the users
+type quotaGroup struct {
+	kind         string
+	defaultQuota configuration.Quota
+	quotas       map[string]configuration.Quota
+	tenants      map[string]*tenant
+	lastCleanup  time.Time
+}
+
+type tenant struct {
+	name string
+	// nil if the points or the queries aren't limited
+	points  *common.TokenBucket
+	queries *common.TokenBucket
+	usage   QuotaUsage
+	// the last time it wrote or queried
+	lastUsed time.Time
+}
+
+// The databases and the users that aren't in the maps get the default
+// quotas
+func NewQuotas(defaultDatabase, defaultUser configuration.Quota, databases, users map[string]configuration.Quota) *Quotas {
+	return &Quotas{
+		databases: &quotaGroup{"database", defaultDatabase, databases, map[string]*tenant{}, time.Time{}},
+		users:     &quotaGroup{"user", defaultUser, users, map[string]*tenant{}, time.Time{}},
+	}
+}
+
+func (self *quotaGroup) get(name string, now time.Time) *tenant {
+	if t := self.tenants[name]; t != nil {
+		t.lastUsed = now
+		return t
+	}
+	quota, ok := self.quotas[name]
+	if !ok {
+		quota = self.defaultQuota
+	}
+	t := &tenant{name: self.kind + " " + name, lastUsed: now}
+	t.usage.PointsPerSecond = quota.PointsPerSecond
+	t.usage.QueriesPerSecond = quota.QueriesPerSecond
+	if quota.PointsPerSecond > 0 {
+		t.points = common.NewTokenBucket(quota.PointsPerSecond, now)
+	}
+	if quota.QueriesPerSecond > 0 {
+		t.queries = common.NewTokenBucket(quota.QueriesPerSecond, now)
+	}
+	self.tenants[name] = t
+	return t
+}
+
+func (self *quotaGroup) cleanup(now time.Time) {
+	if now.Sub(self.lastCleanup) < quotaTenantExpiry {
+		return
+	}
+	self.lastCleanup = now
+	for name, t := range self.tenants {
+		if now.Sub(t.lastUsed) > quotaTenantExpiry {
+			delete(self.tenants, name)
+		}
+	}
+}
+
+// Takes the points from the quotas of the database and the user, or
+// returns a QuotaExceededError if one of them doesn't have enough left.
+// The points are counted as written once the write is done, see
+// CountWrite.
+func (self *Quotas) TakeWrite(db string, user common.User, points int) error {
+	return self.take(db, user, points, false)
+}
+
+// Counts the points written after TakeWrite took taken points from the
+// quotas, the points that weren't written are given back to them
+func (self *Quotas) CountWrite(db string, user common.User, taken, written int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, t := range self.tenants(db, user, time.Now()) {
+		if t.points != nil && written < taken {
+			t.points.Return(float64(taken - written))
+		}
+		t.count(false, written, false)
+	}
+}
+
+// Takes a query from the quotas of the database and the user, or
+// returns a QuotaExceededError if one of them is used up
+func (self *Quotas) TakeQuery(db string, user common.User) error {
+	return self.take(db, user, 1, true)
+}
+
+func (self *Quotas) take(db string, user common.User, n int, query bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	tenants := self.tenants(db, user, now)
+
+	// only take from the quotas if all of them have enough left
+	for _, t := range tenants {
+		bucket, limit, unit := t.bucket(query)
+		if bucket == nil {
+			continue
+		}
+		bucket.Refill(now)
+		if wait := bucket.Wait(float64(n)); wait > 0 {
+			t.count(query, n, true)
+			return common.NewQuotaExceededError(t.name, limit, unit, wait)
+		}
+	}
+	for _, t := range tenants {
+		if bucket, _, _ := t.bucket(query); bucket != nil {
+			bucket.Take(float64(n))
+		}
+		// the points are counted once they're written
+		if query {
+			t.count(query, n, false)
+		}
+	}
+	return nil
+}
+
+// Returns the quotas that apply to the writes and the queries of the
+// user on db, the user's isn't included for the cluster admins
+func (self *Quotas) tenants(db string, user common.User, now time.Time) []*tenant {
+	self.databases.cleanup(now)
+	self.users.cleanup(now)
+
+	tenants := make([]*tenant, 0, 2)
+	if db != "" {
+		db, _ = cluster.SplitPolicyDatabase(db)
+		tenants = append(tenants, self.databases.get(db, now))
+	}
+	if !user.IsClusterAdmin() {
+		tenants = append(tenants, self.users.get(user.GetName(), now))
+	}
+	return tenants
+}
+
+// Returns the bucket of the points or the queries, nil if they aren't
+// limited, with the limit and its unit
+func (self *tenant) bucket(query bool) (*common.TokenBucket, int, string) {
+	if query {
+		return self.queries, self.usage.QueriesPerSecond, "queries"
+	}
+	return self.points, self.usage.PointsPerSecond, "points"
+}
+
+func (self *tenant) count(query bool, n int, rejected bool) {
+	switch {
+	case query && rejected:
+		self.usage.QueriesRejected += int64(n)
+	case query:
+		self.usage.Queries += int64(n)
+	case rejected:
+		self.usage.PointsRejected += int64(n)
+	default:
+		self.usage.PointsWritten += int64(n)
+	}
+}
+
+// Returns the usage of the databases and the users that wrote or
+// queried in the last quotaTenantExpiry, by name
+func (self *Quotas) Usage() (databases, users map[string]QuotaUsage) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.databases.usage(), self.users.usage()
+}
+
+func (self *quotaGroup) usage() map[string]QuotaUsage {
+	usage := make(map[string]QuotaUsage, len(self.tenants))
+	for name, t := range self.tenants {
+		usage[name] = t.usage
+	}
+	return usage
+}
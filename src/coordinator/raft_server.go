@@ -5,6 +5,7 @@ import (
 	"cluster"
 	"common"
 	"configuration"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -30,6 +31,8 @@ const (
 	DEFAULT_ROOT_PWD        = "root"
 	DEFAULT_ROOT_PWD_ENVKEY = "INFLUXDB_INIT_PWD"
 	RAFT_NAME_SIZE          = 8
+	// continuous queries are backfilled in windows of this size
+	BACKFILL_WINDOW = 24 * time.Hour
 )
 
 // The raftd server is a combination of the Raft server and an HTTP
@@ -49,6 +52,22 @@ type RaftServer struct {
 	notLeader                chan bool
 	coordinator              *CoordinatorImpl
 	processContinuousQueries bool
+	lastRetentionSweep       time.Time
+	// the raft connections are encrypted if set
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	// reported in the stats, updated atomically by the raft event
+	// listeners
+	termChanges   int64
+	leaderChanges int64
+	appliedIndex  uint64
+	// the stats returned by Stats() until they're RAFT_STATS_TTL old
+	stats        *RaftStats
+	statsUpdated time.Time
+	statsLock    sync.Mutex
+	// the runs of the continuous queries by database and id
+	continuousQueryStatuses     map[string]map[uint32]*ContinuousQueryStatus
+	continuousQueryStatusesLock sync.Mutex
 }
 
 var registeredCommands bool
@@ -69,6 +88,9 @@ func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.C
 		notLeader:     make(chan bool, 1),
 		router:        mux.NewRouter(),
 		config:        config,
+		httpClient:    http.DefaultClient,
+
+		continuousQueryStatuses: make(map[string]map[uint32]*ContinuousQueryStatus),
 	}
 	// Read existing name or generate a new one.
 	if b, err := ioutil.ReadFile(filepath.Join(s.path, "name")); err == nil {
@@ -110,10 +132,43 @@ func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.C
 	return s
 }
 
+// Encrypts the raft connections, has to be called before the server is
+// started
+func (s *RaftServer) SetTlsConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+	s.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
 func (s *RaftServer) GetRaftName() string {
 	return s.name
 }
 
+// Returns true if the raft server knows who the current leader of
+// the cluster is
+func (s *RaftServer) HasLeader() bool {
+	if s.raftServer == nil {
+		return false
+	}
+	return s.raftServer.Leader() != ""
+}
+
+// Returns the raft name of the current leader, empty if there's none
+func (s *RaftServer) Leader() string {
+	if s.raftServer == nil {
+		return ""
+	}
+	return s.raftServer.Leader()
+}
+
+// Returns the raft role of this server, e.g. leader, follower or
+// candidate
+func (s *RaftServer) State() string {
+	if s.raftServer == nil {
+		return raft.Stopped
+	}
+	return s.raftServer.State()
+}
+
 func (s *RaftServer) leaderConnectString() (string, bool) {
 	leader := s.raftServer.Leader()
 	peers := s.raftServer.Peers()
@@ -152,17 +207,17 @@ func (s *RaftServer) doOrProxyCommandOnce(command raft.Command) (interface{}, er
 		if leader, ok := s.leaderConnectString(); !ok {
 			return nil, errors.New("Couldn't connect to the cluster leader...")
 		} else {
-			return SendCommandToServer(leader, command)
+			return s.SendCommandToServer(leader, command)
 		}
 	}
 }
 
-func SendCommandToServer(url string, command raft.Command) (interface{}, error) {
+func (s *RaftServer) SendCommandToServer(url string, command raft.Command) (interface{}, error) {
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(command); err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
+	resp, err := s.httpClient.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
 	if err != nil {
 		return nil, err
 	}
@@ -179,8 +234,8 @@ func SendCommandToServer(url string, command raft.Command) (interface{}, error)
 
 }
 
-func (s *RaftServer) CreateDatabase(name string) error {
-	command := NewCreateDatabaseCommand(name)
+func (s *RaftServer) CreateDatabase(name string, replicationFactor uint8) error {
+	command := NewCreateDatabaseCommand(name, replicationFactor)
 	_, err := s.doOrProxyCommand(command)
 	return err
 }
@@ -191,6 +246,36 @@ func (s *RaftServer) DropDatabase(name string) error {
 	return err
 }
 
+func (s *RaftServer) SetRetentionPolicy(db string, retention time.Duration) error {
+	command := NewSetRetentionPolicyCommand(db, retention)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetDatabaseReplicationFactor(db string, replicationFactor uint8) error {
+	command := NewSetDatabaseReplicationFactorCommand(db, replicationFactor)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetDuplicatePointPolicy(db string, policy cluster.DuplicatePointPolicy) error {
+	command := NewSetDuplicatePointPolicyCommand(db, policy)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) SetNamedRetentionPolicy(db, name string, retention time.Duration) error {
+	command := NewSetNamedRetentionPolicyCommand(db, name, retention)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) DeleteNamedRetentionPolicy(db, name string) error {
+	command := NewDeleteNamedRetentionPolicyCommand(db, name)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
 func (s *RaftServer) SaveDbUser(u *cluster.DbUser) error {
 	command := NewSaveDbUserCommand(u)
 	_, err := s.doOrProxyCommand(command)
@@ -203,6 +288,12 @@ func (s *RaftServer) ChangeDbUserPassword(db, username string, hash []byte) erro
 	return err
 }
 
+func (s *RaftServer) RehashUserPassword(db, username string, oldHash, hash []byte) error {
+	command := NewRehashUserPasswordCommand(db, username, string(oldHash), string(hash))
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
 func (s *RaftServer) ChangeDbUserPermissions(db, username, readPermissions, writePermissions string) error {
 	command := NewChangeDbUserPermissionsCommand(db, username, readPermissions, writePermissions)
 	_, err := s.doOrProxyCommand(command)
@@ -215,13 +306,25 @@ func (s *RaftServer) SaveClusterAdminUser(u *cluster.ClusterAdmin) error {
 	return err
 }
 
+func (s *RaftServer) SaveAuthToken(token *cluster.AuthToken) error {
+	command := NewSaveAuthTokenCommand(token)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
+func (s *RaftServer) DeleteAuthToken(hash string) error {
+	command := NewDeleteAuthTokenCommand(hash)
+	_, err := s.doOrProxyCommand(command)
+	return err
+}
+
 func (s *RaftServer) CreateRootUser() error {
 	u := &cluster.ClusterAdmin{cluster.CommonUser{Name: "root", Hash: "", IsUserDeleted: false, CacheKey: "root"}}
 	password := os.Getenv(DEFAULT_ROOT_PWD_ENVKEY)
 	if password == "" {
 		password = DEFAULT_ROOT_PWD
 	}
-	hash, _ := cluster.HashPassword(password)
+	hash, _ := cluster.HashPassword(password, s.config.PasswordHashCost)
 	u.ChangePassword(string(hash))
 	return s.SaveClusterAdminUser(u)
 }
@@ -233,6 +336,12 @@ func (s *RaftServer) SetContinuousQueryTimestamp(timestamp time.Time) error {
 }
 
 func (s *RaftServer) CreateContinuousQuery(db string, query string) error {
+	return s.CreateContinuousQueryWithBackfill(db, query, 0)
+}
+
+// Same as CreateContinuousQuery but first runs the query over the
+// given duration of existing data, if it's not zero
+func (s *RaftServer) CreateContinuousQueryWithBackfill(db string, query string, backfill time.Duration) error {
 	selectQuery, err := parser.ParseSelectQuery(query)
 	if err != nil {
 		return fmt.Errorf("Failed to parse continuous query: %s", query)
@@ -251,18 +360,86 @@ func (s *RaftServer) CreateContinuousQuery(db string, query string) error {
 		return fmt.Errorf("Couldn't get group by time for continuous query: %s", err)
 	}
 
-	// if there are already-running queries, we need to initiate a backfill
-	if duration != nil && !s.clusterConfig.LastContinuousQueryRunTime().IsZero() {
-		zeroTime := time.Time{}
-		currentBoundary := time.Now().Truncate(*duration)
-		go s.runContinuousQuery(db, selectQuery, zeroTime, currentBoundary)
-	} else {
-		// TODO: make continuous queries backfill for queries that don't have a group by time
+	command := NewCreateContinuousQueryCommand(db, query)
+	if _, err = s.doOrProxyCommand(command); err != nil {
+		return err
 	}
 
-	command := NewCreateContinuousQueryCommand(db, query)
-	_, err = s.doOrProxyCommand(command)
-	return err
+	// TODO: make continuous queries backfill for queries that don't have a group by time
+	if duration == nil {
+		return nil
+	}
+
+	// if there are already-running queries, we need to initiate a
+	// backfill, otherwise the next run processes all the existing data
+	lastRun := s.clusterConfig.LastContinuousQueryRunTime()
+	if lastRun.IsZero() && backfill == 0 {
+		return nil
+	}
+
+	currentBoundary := time.Now().Truncate(*duration)
+	start := time.Time{}
+	if backfill > 0 {
+		start = currentBoundary.Add(-backfill).Truncate(*duration)
+	}
+	if lastRun.IsZero() {
+		// the data before the current boundary is backfilled, don't let
+		// the first run process it again
+		if err := s.SetContinuousQueryTimestamp(currentBoundary); err != nil {
+			return err
+		}
+	}
+	go s.backfillContinuousQuery(db, selectQuery, s.backfillStart(start, currentBoundary), currentBoundary, *duration)
+	return nil
+}
+
+// Returns the time from which a continuous query is backfilled, which
+// is no earlier than the oldest shard and than the configured maximum
+// backfill allows
+func (s *RaftServer) backfillStart(start, end time.Time) time.Time {
+	if max := s.config.ContinuousQueryMaxBackfill; max > 0 && start.Before(end.Add(-max)) {
+		start = end.Add(-max)
+	}
+	shards := s.clusterConfig.GetAllShards()
+	if len(shards) == 0 {
+		// there's no data
+		return end
+	}
+	oldest := shards[0].StartTime()
+	for _, shard := range shards[1:] {
+		if shard.StartTime().Before(oldest) {
+			oldest = shard.StartTime()
+		}
+	}
+	if start.Before(oldest) {
+		start = oldest
+	}
+	return start
+}
+
+// Runs the continuous query over [start, end) in windows of about a
+// day, so the whole range isn't queried at once
+func (s *RaftServer) backfillContinuousQuery(db string, query *parser.SelectQuery, start, end time.Time, groupByInterval time.Duration) {
+	window := groupByInterval * ((BACKFILL_WINDOW + groupByInterval - 1) / groupByInterval)
+	start = start.Truncate(groupByInterval)
+
+	log.Info("Backfilling continuous query %s from %s to %s", query.GetQueryString(), start, end)
+	for windowStart := start; windowStart.Before(end); windowStart = windowStart.Add(window) {
+		windowEnd := windowStart.Add(window)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		id, ok := s.continuousQueryId(db, query)
+		if !ok {
+			log.Info("Stopping the backfill of continuous query %s, it was deleted", query.GetQueryString())
+			return
+		}
+		// the failed windows are retried with the failed runs
+		if err := s.runAndRecordContinuousQuery(db, id, query, windowStart, windowEnd); err != nil {
+			log.Error("Backfill of continuous query %s failed for %s to %s: %s", query.GetQueryString(), windowStart, windowEnd, err)
+		}
+	}
+	log.Info("Finished backfilling continuous query %s", query.GetQueryString())
 }
 
 func (s *RaftServer) DeleteContinuousQuery(db string, id uint32) error {
@@ -278,9 +455,9 @@ func (s *RaftServer) ChangeConnectionString(raftName, protobufConnectionString,
 		ConnectionString:         raftConnectionString,
 		ProtobufConnectionString: protobufConnectionString,
 	}
-	for _, s := range s.raftServer.Peers() {
+	for _, peer := range s.raftServer.Peers() {
 		// send the command and ignore errors in case a server is down
-		SendCommandToServer(s.ConnectionString, command)
+		s.SendCommandToServer(peer.ConnectionString, command)
 	}
 
 	// make the change permament
@@ -295,10 +472,8 @@ func (s *RaftServer) AssignCoordinator(coordinator *CoordinatorImpl) error {
 	return nil
 }
 
-const (
-	MAX_SIZE = 10 * MEGABYTE
-)
-
+// Takes a snapshot of the cluster configuration and truncates the raft
+// log up to the snapshot
 func (s *RaftServer) ForceLogCompaction() error {
 	err := s.raftServer.TakeSnapshot()
 	if err != nil {
@@ -308,25 +483,35 @@ func (s *RaftServer) ForceLogCompaction() error {
 	return nil
 }
 
+// Compacts the raft log every snapshot interval, or sooner once it grows
+// past the configured size or number of entries
 func (s *RaftServer) CompactLog() {
 	checkSizeTicker := time.Tick(time.Minute)
-	forceCompactionTicker := time.Tick(time.Hour * 24)
+	forceCompactionTicker := time.Tick(s.config.RaftSnapshotInterval)
 
 	for {
 		select {
 		case <-checkSizeTicker:
 			log.Debug("Testing if we should compact the raft logs")
 
+			entries := len(s.raftServer.LogEntries())
 			path := s.raftServer.LogPath()
 			size, err := common.GetFileSize(path)
 			if err != nil {
 				log.Error("Error getting size of file '%s': %s", path, err)
 			}
-			if size < MAX_SIZE {
+			tooBig := s.config.RaftSnapshotLogSize > 0 && size >= int64(s.config.RaftSnapshotLogSize)
+			tooLong := s.config.RaftSnapshotLogEntries > 0 && entries >= s.config.RaftSnapshotLogEntries
+			if !tooBig && !tooLong {
 				continue
 			}
+			log.Info("Compacting the raft log, it has %d entries and %d bytes", entries, size)
 			s.ForceLogCompaction()
 		case <-forceCompactionTicker:
+			// there's nothing to compact since the last snapshot
+			if len(s.raftServer.LogEntries()) == 0 {
+				continue
+			}
 			s.ForceLogCompaction()
 		}
 	}
@@ -353,6 +538,7 @@ func (s *RaftServer) startRaft() error {
 
 	// Initialize and start Raft server.
 	transporter := raft.NewHTTPTransporter("/raft")
+	transporter.Transport.TLSClientConfig = s.tlsConfig
 	var err error
 	s.raftServer, err = raft.NewServer(s.name, s.path, transporter, s.clusterConfig, s.clusterConfig, "")
 	if err != nil {
@@ -360,9 +546,13 @@ func (s *RaftServer) startRaft() error {
 	}
 
 	s.raftServer.SetElectionTimeout(s.config.RaftTimeout.Duration)
+	if s.config.RaftHeartbeatInterval > 0 {
+		s.raftServer.SetHeartbeatInterval(s.config.RaftHeartbeatInterval)
+	}
 	s.raftServer.LoadSnapshot() // ignore errors
 
 	s.raftServer.AddEventListener(raft.StateChangeEventType, s.raftEventHandler)
+	s.addStatsEventListeners()
 
 	transporter.Install(s.raftServer, s)
 	s.raftServer.Start()
@@ -425,6 +615,8 @@ func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
 		case <-loopTimer.C:
 			log.Debug("(raft:%s) Executing leader loop.", s.raftServer.Name())
 			s.checkContinuousQueries()
+			s.dropExpiredShards()
+			s.removeDecommissionedServers()
 			break
 		case <-s.notLeader:
 			log.Debug("(raft:%s) Exiting leader loop.", s.raftServer.Name())
@@ -433,6 +625,40 @@ func (s *RaftServer) raftLeaderLoop(loopTimer *time.Ticker) {
 	}
 }
 
+// Drops the shards that only have data older than the retention
+// policies of all databases, once every retention sweep interval
+func (s *RaftServer) dropExpiredShards() {
+	now := time.Now()
+	if now.Sub(s.lastRetentionSweep) < s.config.RetentionSweepInterval {
+		return
+	}
+	s.lastRetentionSweep = now
+
+	for _, shard := range s.clusterConfig.ExpiredShards(now) {
+		log.Info("Dropping shard %d, its data is older than the retention policies", shard.Id())
+		if err := s.DropShard(shard.Id(), shard.ServerIds()); err != nil {
+			log.Error("Cannot drop expired shard %d: %s", shard.Id(), err)
+		}
+	}
+}
+
+// Removes the decommissioned servers once all their shards were moved
+func (s *RaftServer) removeDecommissionedServers() {
+	for _, server := range s.clusterConfig.DecommissionedServers() {
+		if server == s.clusterConfig.LocalServer {
+			// the leader can't remove itself, it stops and the next
+			// leader removes it
+			log.Info("Stopping, this server was decommissioned")
+			s.clusterConfig.LocalServerDecommissioned()
+			continue
+		}
+		log.Info("Removing decommissioned server %d", server.Id)
+		if err := s.RemoveServer(server.Id); err != nil {
+			log.Error("Cannot remove decommissioned server %d: %s", server.Id, err)
+		}
+	}
+}
+
 func (s *RaftServer) StartProcessingContinuousQueries() {
 	s.processContinuousQueries = true
 }
@@ -446,11 +672,13 @@ func (s *RaftServer) checkContinuousQueries() {
 		return
 	}
 
+	s.retryContinuousQueries()
+
 	runTime := time.Now()
 	queriesDidRun := false
 
 	for db, queries := range s.clusterConfig.ParsedContinuousQueries {
-		for _, query := range queries {
+		for id, query := range queries {
 			groupByClause := query.GetGroupByClause()
 
 			// if there's no group by clause, it's handled as a fanout query
@@ -467,9 +695,14 @@ func (s *RaftServer) checkContinuousQueries() {
 			currentBoundary := runTime.Truncate(*duration)
 			lastRun := s.clusterConfig.LastContinuousQueryRunTime()
 			lastBoundary := lastRun.Truncate(*duration)
+			if lastRun.IsZero() {
+				lastBoundary = s.backfillStart(lastBoundary, currentBoundary).Truncate(*duration)
+			}
 
 			if currentBoundary.After(lastRun) {
-				s.runContinuousQuery(db, query, lastBoundary, currentBoundary)
+				// a failed run is retried later, the next run starts
+				// from the current boundary anyway
+				s.runAndRecordContinuousQuery(db, id, query, lastBoundary, currentBoundary)
 				queriesDidRun = true
 			}
 		}
@@ -481,19 +714,21 @@ func (s *RaftServer) checkContinuousQueries() {
 	}
 }
 
-func (s *RaftServer) runContinuousQuery(db string, query *parser.SelectQuery, start time.Time, end time.Time) {
+func (s *RaftServer) runContinuousQuery(db string, query *parser.SelectQuery, start time.Time, end time.Time) error {
 	adminName := s.clusterConfig.GetClusterAdmins()[0]
 	clusterAdmin := s.clusterConfig.GetClusterAdmin(adminName)
 	intoClause := query.GetIntoClause()
 	targetName := intoClause.Target.Name
 	queryString := query.GetQueryStringWithTimesAndNoIntoClause(start, end)
 
+	// the retries of the window write the same sequence numbers
+	sequenceNumbers := IntoSequenceNumbers{}
 	f := func(series *protocol.Series) error {
-		return s.coordinator.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, true)
+		return s.coordinator.InterpolateValuesAndCommit(query.GetQueryString(), db, series, targetName, sequenceNumbers)
 	}
 
 	writer := NewContinuousQueryWriter(f)
-	s.coordinator.RunQuery(clusterAdmin, db, queryString, writer)
+	return s.coordinator.runQueryWithoutQuota(clusterAdmin, db, queryString, nil, writer, nil)
 }
 
 func (s *RaftServer) ListenAndServe() error {
@@ -501,6 +736,9 @@ func (s *RaftServer) ListenAndServe() error {
 	if err != nil {
 		panic(err)
 	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
 	return s.Serve(l)
 }
 
@@ -517,6 +755,10 @@ func (s *RaftServer) Serve(l net.Listener) error {
 	s.router.HandleFunc("/cluster_config", s.configHandler).Methods("GET")
 	s.router.HandleFunc("/join", s.joinHandler).Methods("POST")
 	s.router.HandleFunc("/process_command/{command_type}", s.processCommandHandler).Methods("POST")
+	s.router.HandleFunc("/raft_status", s.raftStatusHandler).Methods("GET")
+	s.router.HandleFunc("/prepare_leadership", s.prepareLeadershipHandler).Methods("POST")
+	s.router.HandleFunc("/transfer_leadership", s.transferLeadershipHandler).Methods("POST")
+	s.router.HandleFunc("/continuous_query_statuses", s.continuousQueryStatusesHandler).Methods("GET")
 
 	log.Info("Raft Server Listening at %s", s.config.RaftListenString())
 
@@ -555,9 +797,9 @@ func (s *RaftServer) RemoveServer(id uint32) error {
 	command := &InfluxForceLeaveCommand{
 		Id: id,
 	}
-	for _, s := range s.raftServer.Peers() {
+	for _, peer := range s.raftServer.Peers() {
 		// send the command and ignore errors in case a server is down
-		SendCommandToServer(s.ConnectionString, command)
+		s.SendCommandToServer(peer.ConnectionString, command)
 	}
 
 	if _, err := command.Apply(s.raftServer); err != nil {
@@ -578,8 +820,12 @@ func (s *RaftServer) Join(leader string) error {
 		ProtobufConnectionString: s.config.ProtobufConnectionString(),
 	}
 	connectUrl := leader
-	if !strings.HasPrefix(connectUrl, "http://") {
-		connectUrl = "http://" + connectUrl
+	if !strings.HasPrefix(connectUrl, "http://") && !strings.HasPrefix(connectUrl, "https://") {
+		if s.tlsConfig != nil {
+			connectUrl = "https://" + connectUrl
+		} else {
+			connectUrl = "http://" + connectUrl
+		}
 	}
 	if !strings.HasSuffix(connectUrl, "/join") {
 		connectUrl = connectUrl + "/join"
@@ -590,6 +836,7 @@ func (s *RaftServer) Join(leader string) error {
 	log.Debug("(raft:%s) Posting to seed server %s", s.raftServer.Name(), connectUrl)
 	tr := &http.Transport{
 		ResponseHeaderTimeout: time.Second,
+		TLSClientConfig:       s.tlsConfig,
 	}
 	client := &http.Client{Transport: tr}
 	resp, err := client.Post(connectUrl, "application/json", &b)
@@ -716,3 +963,52 @@ func (self *RaftServer) DropShard(id uint32, serverIds []uint32) error {
 	_, err := self.doOrProxyCommand(command)
 	return err
 }
+
+// Moves shard replicas to the servers with the fewest of them, e.g. after
+// adding a server. The target servers copy the shards in the background,
+// one at a time. Returns the moves that were started.
+func (self *RaftServer) Rebalance() ([]*cluster.ShardMove, error) {
+	moves := self.clusterConfig.PlanRebalance()
+	for i, move := range moves {
+		if _, err := self.doOrProxyCommand(NewMoveShardCommand(move)); err != nil {
+			return moves[:i], err
+		}
+	}
+	return moves, nil
+}
+
+func (self *RaftServer) FinishShardMove(shardId uint32) error {
+	command := NewFinishShardMoveCommand(shardId)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+// Cancels the shard moves that haven't finished yet
+func (self *RaftServer) CancelRebalance() error {
+	for _, move := range self.clusterConfig.ShardMoves() {
+		command := NewCancelShardMoveCommand(move.ShardId)
+		if _, err := self.doOrProxyCommand(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the shards of the server to the other servers and then removes
+// it from the cluster. Fails without changing anything if a shard would
+// have fewer replicas once the server is removed.
+func (self *RaftServer) DecommissionServer(id uint32) ([]*cluster.ShardMove, error) {
+	moves, err := self.clusterConfig.PlanDecommission(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := self.doOrProxyCommand(NewDecommissionServerCommand(id)); err != nil {
+		return nil, err
+	}
+	for i, move := range moves {
+		if _, err := self.doOrProxyCommand(NewMoveShardCommand(move)); err != nil {
+			return moves[:i], err
+		}
+	}
+	return moves, nil
+}
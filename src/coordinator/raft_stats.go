@@ -0,0 +1,120 @@
+package coordinator
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goraft/raft"
+)
+
+// The state of the raft server and, on the leader, how far behind the
+// followers are
+type RaftStats struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+	// the last entry that was committed, the entries are applied to the
+	// cluster configuration as soon as they're committed
+	CommitIndex  uint64 `json:"commitIndex"`
+	AppliedIndex uint64 `json:"appliedIndex"`
+	// since startup
+	TermChanges   int64                     `json:"termChanges"`
+	LeaderChanges int64                     `json:"leaderChanges"`
+	Peers         map[string]*RaftPeerStats `json:"peers,omitempty"`
+}
+
+type RaftPeerStats struct {
+	ConnectionString string `json:"connectionString"`
+	// how long ago the peer last answered the leader
+	LastContactMs int64  `json:"lastContactMs"`
+	CommitIndex   uint64 `json:"commitIndex"`
+	// the committed entries the peer doesn't have yet
+	Lag uint64 `json:"lag"`
+	// set if the status of the peer couldn't be fetched
+	Error string `json:"error,omitempty"`
+}
+
+// How long the stats are cached, the leader asks every peer for its
+// status to get them
+const RAFT_STATS_TTL = 5 * time.Second
+
+// Counts the raft events that are reported in the stats
+func (s *RaftServer) addStatsEventListeners() {
+	s.raftServer.AddEventListener(raft.TermChangeEventType, func(e raft.Event) {
+		atomic.AddInt64(&s.termChanges, 1)
+	})
+	s.raftServer.AddEventListener(raft.LeaderChangeEventType, func(e raft.Event) {
+		atomic.AddInt64(&s.leaderChanges, 1)
+	})
+	s.raftServer.AddEventListener(raft.CommitEventType, func(e raft.Event) {
+		if entry, ok := e.Value().(*raft.LogEntry); ok {
+			atomic.StoreUint64(&s.appliedIndex, entry.Index())
+		}
+	})
+}
+
+// Returns nil if raft isn't started yet. The stats are up to
+// RAFT_STATS_TTL old.
+func (s *RaftServer) Stats() *RaftStats {
+	if s.raftServer == nil {
+		return nil
+	}
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	if s.stats == nil || time.Now().Sub(s.statsUpdated) >= RAFT_STATS_TTL {
+		s.stats = s.getStats()
+		s.statsUpdated = time.Now()
+	}
+	return s.stats
+}
+
+// The leader asks the peers for their commit index, so the stats take up
+// to a second longer if a peer is down
+func (s *RaftServer) getStats() *RaftStats {
+	stats := &RaftStats{
+		Name:          s.name,
+		State:         s.raftServer.State(),
+		Leader:        s.raftServer.Leader(),
+		Term:          s.raftServer.Term(),
+		CommitIndex:   s.raftServer.CommitIndex(),
+		AppliedIndex:  atomic.LoadUint64(&s.appliedIndex),
+		TermChanges:   atomic.LoadInt64(&s.termChanges),
+		LeaderChanges: atomic.LoadInt64(&s.leaderChanges),
+	}
+	if stats.State != raft.Leader {
+		return stats
+	}
+
+	stats.Peers = make(map[string]*RaftPeerStats)
+	client := &http.Client{Transport: &http.Transport{
+		ResponseHeaderTimeout: time.Second,
+		TLSClientConfig:       s.tlsConfig,
+		DisableKeepAlives:     true,
+	}}
+	var wait sync.WaitGroup
+	for name, peer := range s.raftServer.Peers() {
+		peerStats := &RaftPeerStats{
+			ConnectionString: peer.ConnectionString,
+			LastContactMs:    int64(time.Now().Sub(peer.LastActivity()) / time.Millisecond),
+		}
+		stats.Peers[name] = peerStats
+		wait.Add(1)
+		go func(url string) {
+			defer wait.Done()
+			status, err := getRaftStatus(client, url)
+			if err != nil {
+				peerStats.Error = err.Error()
+				return
+			}
+			peerStats.CommitIndex = status.CommitIndex
+			if status.CommitIndex < stats.CommitIndex {
+				peerStats.Lag = stats.CommitIndex - status.CommitIndex
+			}
+		}(peer.ConnectionString)
+	}
+	wait.Wait()
+	return stats
+}
@@ -0,0 +1,52 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/goraft/raft"
+	. "launchpad.net/gocheck"
+)
+
+type RaftStatsSuite struct{}
+
+var _ = Suite(&RaftStatsSuite{})
+
+func (self *RaftStatsSuite) TestTheStatsOfThePeersAreCached(c *C) {
+	var lock sync.Mutex
+	requests := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		json.NewEncoder(w).Encode(&raftStatus{Name: "peer", State: raft.Follower, CommitIndex: 7})
+	}))
+	defer peer.Close()
+	statusRequests := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+
+	server := newLeaderTransferRaftServer(c, &MockRaftServer{
+		state:  raft.Leader,
+		leader: "leader",
+		peers:  map[string]*raft.Peer{"peer": {Name: "peer", ConnectionString: peer.URL}},
+	})
+	stats := server.Stats()
+	c.Assert(stats.State, Equals, raft.Leader)
+	c.Assert(stats.Term, Equals, uint64(2))
+	c.Assert(stats.Peers["peer"].CommitIndex, Equals, uint64(7))
+	c.Assert(stats.Peers["peer"].Lag, Equals, uint64(3))
+	c.Assert(statusRequests(), Equals, 1)
+
+	// the peers aren't asked again until the stats expire
+	c.Assert(server.Stats(), Equals, stats)
+	c.Assert(statusRequests(), Equals, 1)
+	server.statsUpdated = time.Now().Add(-RAFT_STATS_TTL)
+	c.Assert(server.Stats(), Not(Equals), stats)
+	c.Assert(statusRequests(), Equals, 2)
+}
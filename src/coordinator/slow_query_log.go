@@ -0,0 +1,110 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"os"
+	"protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A query that ran longer than the slow query threshold
+type SlowQuery struct {
+	Query      string `json:"query"`
+	Database   string `json:"database"`
+	User       string `json:"user"`
+	StartedAt  int64  `json:"startedAt"`
+	DurationMs int64  `json:"durationMs"`
+	// the shards read by the query and the points it returned
+	Shards int32  `json:"shards"`
+	Points int64  `json:"points"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Records the queries that run longer than the threshold, they're
+// appended to the log file as json lines, or to the server log if
+// there's no file, and the last size of them are kept for the api
+type SlowQueryLog struct {
+	threshold time.Duration
+	size      int
+	file      *os.File
+	lock      sync.Mutex
+	// the most recent query is last
+	queries []*SlowQuery
+}
+
+// A zero threshold disables the log, the queries are logged to the
+// server log if path is empty or can't be opened
+func NewSlowQueryLog(threshold time.Duration, size int, path string) *SlowQueryLog {
+	self := &SlowQueryLog{threshold: threshold, size: size}
+	if threshold <= 0 || path == "" {
+		return self
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("Cannot open the slow query log %s, logging the slow queries to the server log: %s", path, err)
+		return self
+	}
+	self.file = file
+	return self
+}
+
+func (self *SlowQueryLog) isEnabled() bool {
+	return self.threshold > 0
+}
+
+// Records the query if it ran longer than the threshold
+func (self *SlowQueryLog) Record(query *SlowQuery, duration time.Duration) {
+	if !self.isEnabled() || duration < self.threshold {
+		return
+	}
+	query.DurationMs = int64(duration / time.Millisecond)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.size > 0 {
+		if len(self.queries) == self.size {
+			copy(self.queries, self.queries[1:])
+			self.queries = self.queries[:len(self.queries)-1]
+		}
+		self.queries = append(self.queries, query)
+	}
+
+	if self.file == nil {
+		log.Warn("Slow query: db: %s, u: %s, q: %s, t: %s, shards: %d, points: %d", query.Database, query.User, query.Query, duration, query.Shards, query.Points)
+		return
+	}
+	line, err := json.Marshal(query)
+	if err != nil {
+		log.Error("Cannot encode the slow query %s: %s", query.Query, err)
+		return
+	}
+	if _, err := self.file.Write(append(line, '\n')); err != nil {
+		log.Error("Cannot write to the slow query log %s: %s", self.file.Name(), err)
+	}
+}
+
+// Returns the slow queries kept in memory, the most recent first
+func (self *SlowQueryLog) Recent() []*SlowQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	queries := make([]*SlowQuery, 0, len(self.queries))
+	for i := len(self.queries) - 1; i >= 0; i-- {
+		queries = append(queries, self.queries[i])
+	}
+	return queries
+}
+
+// Counts the points written to the writer, for the slow query log
+type pointCountingWriter struct {
+	SeriesWriter
+	points int64
+}
+
+func (self *pointCountingWriter) Write(series *protocol.Series) error {
+	atomic.AddInt64(&self.points, int64(len(series.Points)))
+	return self.SeriesWriter.Write(series)
+}
@@ -0,0 +1,241 @@
+package coordinator
+
+import (
+	"common"
+	"engine"
+	"parser"
+	"protocol"
+	"sync"
+	"sync/atomic"
+
+	log "code.google.com/p/log4go"
+)
+
+// What happens to the writes that don't fit in the buffer of a
+// subscription because the client doesn't read them fast enough
+type SubscriptionOverflow string
+
+const (
+	// the writes are dropped and counted, the subscription keeps going
+	SubscriptionDrop SubscriptionOverflow = "drop"
+	// the subscription is closed, so the client knows it missed points
+	// and can query them before subscribing again
+	SubscriptionClose SubscriptionOverflow = "close"
+)
+
+// A query whose matching points are sent to the subscriber as they're
+// written. Only the points written through this server are sent.
+type Subscription struct {
+	Database string
+	Query    *parser.SelectQuery
+
+	user       common.User
+	overflow   SubscriptionOverflow
+	series     chan *protocol.Series
+	dropped    int64
+	lock       sync.Mutex
+	closed     bool
+	overflowed bool
+	revoked    bool
+}
+
+func NewSubscription(user common.User, db string, query *parser.SelectQuery, bufferSize int, overflow SubscriptionOverflow) (*Subscription, error) {
+	switch overflow {
+	case SubscriptionDrop, SubscriptionClose:
+	default:
+		return nil, common.NewQueryError(common.InvalidArgument, "Unknown overflow %s, valid values are drop and close", overflow)
+	}
+	if bufferSize <= 0 {
+		return nil, common.NewQueryError(common.InvalidArgument, "The buffer size of a subscription must be positive")
+	}
+	if query.HasAggregates() || query.IsContinuousQuery() || query.GetFromClause().Type != parser.FromClauseArray {
+		return nil, common.NewQueryError(common.InvalidArgument, "Only select queries without aggregates, joins, merges or subqueries can be subscribed to")
+	}
+	if groupBy := query.GetGroupByClause(); groupBy != nil && len(groupBy.Elems) > 0 {
+		return nil, common.NewQueryError(common.InvalidArgument, "Only select queries without a group by clause can be subscribed to")
+	}
+	return &Subscription{
+		Database: db,
+		Query:    query,
+		user:     user,
+		overflow: overflow,
+		series:   make(chan *protocol.Series, bufferSize),
+	}, nil
+}
+
+// The matching points that were written, closed when the subscription
+// is closed
+func (self *Subscription) Series() <-chan *protocol.Series {
+	return self.series
+}
+
+// The number of writes that were dropped because the buffer was full
+func (self *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&self.dropped)
+}
+
+// True if the subscription was closed because its buffer was full
+func (self *Subscription) Overflowed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.overflowed
+}
+
+// True if the subscription was closed because its user was deleted
+func (self *Subscription) Revoked() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.revoked
+}
+
+// Returns true if the series is one of the series of the query that the
+// user can read
+func (self *Subscription) matches(user common.User, name string) bool {
+	if !user.HasReadAccess(name) {
+		return false
+	}
+	for _, table := range self.Query.GetFromClause().Names {
+		if regex, ok := table.Name.GetCompiledRegex(); ok {
+			if regex.MatchString(name) {
+				return true
+			}
+		} else if table.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the series to the subscriber without blocking, the series is
+// dropped or the subscription closed if the buffer is full
+func (self *Subscription) Publish(series *protocol.Series) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	select {
+	case self.series <- series:
+		return
+	default:
+	}
+
+	if self.overflow == SubscriptionClose {
+		log.Info("Closing the subscription to %s of %s, its buffer is full", self.Query.GetQueryString(), self.Database)
+		self.overflowed = true
+		self.closeLocked()
+		return
+	}
+	atomic.AddInt64(&self.dropped, 1)
+}
+
+func (self *Subscription) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closeLocked()
+}
+
+// Closes the subscription because its user doesn't exist anymore
+func (self *Subscription) revoke() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return
+	}
+	log.Info("Closing the subscription to %s of %s, its user %s was deleted", self.Query.GetQueryString(), self.Database, self.user.GetName())
+	self.revoked = true
+	self.closeLocked()
+}
+
+func (self *Subscription) closeLocked() {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	close(self.series)
+}
+
+// Returns the current version of the user, or nil if it was deleted
+type UserLookup func(user common.User) common.User
+
+// Keeps track of the subscriptions of each database
+type SubscriptionRegistry struct {
+	subscriptions map[string]map[*Subscription]bool
+	lock          sync.RWMutex
+	currentUser   UserLookup
+}
+
+// The permissions of the subscribers are checked on every write with
+// the users returned by currentUser, so the subscriptions stop getting
+// the points once the permissions of their user are revoked
+func NewSubscriptionRegistry(currentUser UserLookup) *SubscriptionRegistry {
+	return &SubscriptionRegistry{
+		subscriptions: make(map[string]map[*Subscription]bool),
+		currentUser:   currentUser,
+	}
+}
+
+func (self *SubscriptionRegistry) Add(subscription *Subscription) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	subscriptions := self.subscriptions[subscription.Database]
+	if subscriptions == nil {
+		subscriptions = make(map[*Subscription]bool)
+		self.subscriptions[subscription.Database] = subscriptions
+	}
+	subscriptions[subscription] = true
+}
+
+// Closes the subscription and stops sending it the writes
+func (self *SubscriptionRegistry) Remove(subscription *Subscription) {
+	self.lock.Lock()
+	subscriptions := self.subscriptions[subscription.Database]
+	delete(subscriptions, subscription)
+	if len(subscriptions) == 0 {
+		delete(self.subscriptions, subscription.Database)
+	}
+	self.lock.Unlock()
+	subscription.Close()
+}
+
+// Sends the points of the series that match the queries of the
+// subscriptions of the database to the subscribers
+func (self *SubscriptionRegistry) Publish(db string, series []*protocol.Series) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for subscription := range self.subscriptions[db] {
+		user := self.currentUser(subscription.user)
+		if user == nil {
+			subscription.revoke()
+			continue
+		}
+		for _, s := range series {
+			if !subscription.matches(user, s.GetName()) {
+				continue
+			}
+			// the columns are filtered in place
+			filtered, err := engine.FilterWrittenPoints(subscription.Query, copySeries(s))
+			if err != nil {
+				log.Error("Cannot filter the points of %s for the subscription to %s: %s", s.GetName(), subscription.Query.GetQueryString(), err)
+				continue
+			}
+			if len(filtered.Points) > 0 {
+				subscription.Publish(filtered)
+			}
+		}
+	}
+}
+
+func copySeries(series *protocol.Series) *protocol.Series {
+	points := make([]*protocol.Point, 0, len(series.Points))
+	for _, p := range series.Points {
+		point := *p
+		point.Values = append([]*protocol.FieldValue(nil), p.Values...)
+		points = append(points, &point)
+	}
+	return &protocol.Series{
+		Name:   series.Name,
+		Fields: append([]string(nil), series.Fields...),
+		Points: points,
+	}
+}
@@ -0,0 +1,39 @@
+package coordinator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Returns the tls configuration of the connections between the
+// servers, used by both the protobuf and the raft servers and clients.
+// Both sides present the certificate and require the peer's to be
+// signed by the certificate authority.
+func NewTlsConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
+	if certPath == "" || keyPath == "" || caPath == "" {
+		return nil, errors.New("The ssl certificate, key and certificate authority have to be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load the ssl certificate: %s", err)
+	}
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the ssl certificate authority: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", caPath)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
@@ -13,44 +13,53 @@ import (
 	"server"
 	"strconv"
 	"time"
+	"wal"
 
 	"github.com/jmhodges/levigo"
 
 	log "code.google.com/p/log4go"
 )
 
-func setupLogging(loggingLevel, logFile string) {
-	level := log.DEBUG
-	switch loggingLevel {
-	case "info":
-		level = log.INFO
-	case "warn":
-		level = log.WARNING
-	case "error":
-		level = log.ERROR
-	}
-
+func setupLogging(config *configuration.Configuration) {
 	log.Global = make(map[string]*log.Filter)
 
-	if logFile == "stdout" {
-		flw := log.NewConsoleLogWriter()
-		log.AddFilter("stdout", level, flw)
-
+	jsonLines := config.LogFormat == configuration.LogFormatJson
+	if config.LogFile == "stdout" {
+		log.Global["stdout"] = config.NewLogFilter(newConsoleLogWriter(jsonLines))
 	} else {
-		logFileDir := filepath.Dir(logFile)
+		logFileDir := filepath.Dir(config.LogFile)
 		os.MkdirAll(logFileDir, 0744)
 
-		flw := log.NewFileLogWriter(logFile, false)
-		log.AddFilter("file", level, flw)
-
-		flw.SetFormat("[%D %T] [%L] (%S) %M")
-		flw.SetRotate(true)
-		flw.SetRotateSize(0)
-		flw.SetRotateLines(0)
-		flw.SetRotateDaily(true)
+		writer, err := newFileLogWriter(config.LogFile, jsonLines, int64(config.LogMaxFileSize), config.LogMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open the log file %s, logging to stdout: %s\n", config.LogFile, err)
+			log.Global["stdout"] = config.NewLogFilter(newConsoleLogWriter(jsonLines))
+			return
+		}
+		log.Global["file"] = config.NewLogFilter(writer)
 	}
 
-	log.Info("Redirectoring logging to %s", logFile)
+	log.Info("Redirectoring logging to %s", config.LogFile)
+}
+
+// Prints the log files of the wal that have invalid entries, returns
+// the exit status
+func verifyWalLogFiles(dir string) int {
+	statuses, err := wal.VerifyLogFiles(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot verify the wal in %s: %s\n", dir, err)
+		return 2
+	}
+	status := 0
+	for _, s := range statuses {
+		if s.IsValid() {
+			fmt.Printf("%s: ok, %d entries\n", s.Name, s.Entries)
+			continue
+		}
+		fmt.Printf("%s: invalid at offset %d after %d entries, %s\n", s.Name, s.InvalidOffset, s.Entries, s.Reason)
+		status = 1
+	}
+	return status
 }
 
 func main() {
@@ -62,6 +71,7 @@ func main() {
 	protobufPort := flag.Int("protobuf-port", 0, "Override the protobuf port, the `protobuf_port` config option will be overridden")
 	pidFile := flag.String("pidfile", "", "the pid file")
 	repairLeveldb := flag.Bool("repair-ldb", false, "set to true to repair the leveldb files")
+	verifyWal := flag.Bool("verify-wal", false, "verify the checksums of the wal log files and exit")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
@@ -88,8 +98,13 @@ func main() {
 
 	config.Version = v
 	config.InfluxDBVersion = version
+	config.InfluxDBCommit = gitSha
 
-	setupLogging(config.LogLevel, config.LogFile)
+	if *verifyWal {
+		os.Exit(verifyWalLogFiles(config.WalDir))
+	}
+
+	setupLogging(config)
 
 	if *repairLeveldb {
 		log.Info("Repairing leveldb")
@@ -134,6 +149,13 @@ func main() {
 	os.MkdirAll(config.RaftDir, 0744)
 	os.MkdirAll(config.DataDir, 0744)
 	server, err := server.NewServer(config)
+	if _, ok := err.(configuration.ValidationError); ok {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		// sleep for the log to flush
+		time.Sleep(time.Second)
+		os.Exit(1)
+	}
 	if err != nil {
 		// sleep for the log to flush
 		time.Sleep(time.Second)
@@ -158,6 +180,11 @@ func main() {
 	}
 	err = server.ListenAndServe()
 	if err != nil {
-		log.Error("ListenAndServe failed: ", err)
+		log.Error("ListenAndServe failed: %s", err)
+		fmt.Fprintln(os.Stderr, err)
+		// sleep for the log to flush
+		time.Sleep(time.Second)
+		// exit with an error so the supervisors restart the server
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const LOG_TEXT_FORMAT = "[%D %T] [%L] (%S) %M"
+
+// A log4go writer that writes text or json lines to stdout or to a file
+// that's rotated daily or once it reaches maxSize bytes. The rotated
+// files are renamed to <file>.1, <file>.2, ... from the newest to the
+// oldest and only maxFiles of them are kept, all of them if it's zero.
+type logWriter struct {
+	lock     sync.Mutex
+	json     bool
+	out      io.Writer
+	file     *os.File
+	path     string
+	size     int64
+	maxSize  int64
+	maxFiles int
+	opened   time.Time
+}
+
+func newConsoleLogWriter(jsonLines bool) *logWriter {
+	return &logWriter{json: jsonLines, out: os.Stdout}
+}
+
+func newFileLogWriter(path string, jsonLines bool, maxSize int64, maxFiles int) (*logWriter, error) {
+	writer := &logWriter{json: jsonLines, path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// The fields of a json log line
+type logLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+func (self *logWriter) format(record *log.LogRecord) []byte {
+	if !self.json {
+		return []byte(log.FormatLogRecord(LOG_TEXT_FORMAT, record))
+	}
+	line, err := json.Marshal(&logLine{
+		Time:    record.Created.Format("2006-01-02T15:04:05.000000Z07:00"),
+		Level:   record.Level.String(),
+		Source:  record.Source,
+		Message: record.Message,
+	})
+	if err != nil {
+		line, _ = json.Marshal(&logLine{Message: fmt.Sprintf("Cannot encode log line %q: %s", record.Message, err)})
+	}
+	return append(line, '\n')
+}
+
+func (self *logWriter) LogWrite(record *log.LogRecord) {
+	line := self.format(record)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.path != "" && self.file == nil {
+		// the last rotation couldn't reopen the file
+		if err := self.open(); err != nil {
+			return
+		}
+	}
+	if self.file != nil && self.shouldRotate(record.Created, len(line)) {
+		if err := self.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate the log file %s: %s\n", self.path, err)
+		}
+	}
+	if self.out == nil {
+		return
+	}
+	n, _ := self.out.Write(line)
+	self.size += int64(n)
+}
+
+func (self *logWriter) shouldRotate(now time.Time, length int) bool {
+	if self.maxSize > 0 && self.size > 0 && self.size+int64(length) > self.maxSize {
+		return true
+	}
+	return now.YearDay() != self.opened.YearDay() || now.Year() != self.opened.Year()
+}
+
+func (self *logWriter) open() error {
+	file, err := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file, self.out = file, file
+	self.size = info.Size()
+	self.opened = info.ModTime()
+	if self.size == 0 {
+		self.opened = time.Now()
+	}
+	return nil
+}
+
+// Has to be called with the lock held. The log file is reopened even
+// if the rotated files couldn't be renamed.
+func (self *logWriter) rotate() error {
+	self.file.Close()
+	self.file, self.out = nil, nil
+	err := self.renameLogFiles()
+	if openErr := self.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (self *logWriter) renameLogFiles() error {
+	// find the oldest file to shift, the ones after it are removed
+	last := 1
+	for ; self.maxFiles == 0 || last < self.maxFiles; last++ {
+		if _, err := os.Stat(rotatedLogFile(self.path, last)); os.IsNotExist(err) {
+			break
+		}
+	}
+	if self.maxFiles > 0 {
+		for i := self.maxFiles; ; i++ {
+			if err := os.Remove(rotatedLogFile(self.path, i)); err != nil {
+				break
+			}
+		}
+	}
+	for i := last; i > 1; i-- {
+		if err := os.Rename(rotatedLogFile(self.path, i-1), rotatedLogFile(self.path, i)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(self.path, rotatedLogFile(self.path, 1))
+}
+
+func rotatedLogFile(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (self *logWriter) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file != nil {
+		self.file.Close()
+		self.file, self.out = nil, nil
+	}
+}
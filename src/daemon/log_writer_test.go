@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type LogWriterSuite struct {
+	dir string
+}
+
+var _ = Suite(&LogWriterSuite{})
+
+func (self *LogWriterSuite) SetUpTest(c *C) {
+	var err error
+	self.dir, err = ioutil.TempDir("", "influxdb-log-writer")
+	c.Assert(err, IsNil)
+}
+
+func (self *LogWriterSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+func readLogFile(c *C, path string) string {
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	return string(content)
+}
+
+func (self *LogWriterSuite) TestLogFilesAreRotatedDailyAndOnceTheyAreTooBig(c *C) {
+	path := filepath.Join(self.dir, "influxdb.log")
+	writer, err := newFileLogWriter(path, false, 100, 0)
+	c.Assert(err, IsNil)
+	defer writer.Close()
+
+	now := time.Now()
+	write := func(message string, created time.Time) {
+		writer.LogWrite(&log.LogRecord{Level: log.INFO, Created: created, Source: "test", Message: message})
+	}
+
+	write("first", now)
+	_, err = os.Stat(rotatedLogFile(path, 1))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the file is rotated the next day even if it's small
+	write("tomorrow", now.Add(24*time.Hour))
+	c.Assert(readLogFile(c, rotatedLogFile(path, 1)), Matches, "(?s).*first.*")
+	write("second", now)
+	_, err = os.Stat(rotatedLogFile(path, 2))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// and on the same day once it would grow over 100 bytes
+	write(strings.Repeat("a", 80), now)
+	c.Assert(readLogFile(c, rotatedLogFile(path, 2)), Matches, "(?s).*first.*")
+	c.Assert(readLogFile(c, rotatedLogFile(path, 1)), Matches, "(?s).*tomorrow.*second.*")
+	c.Assert(readLogFile(c, path), Matches, "(?s).*aaaa.*")
+}
+
+func (self *LogWriterSuite) TestRenameLogFilesKeepsMaxFiles(c *C) {
+	path := filepath.Join(self.dir, "influxdb.log")
+	for _, test := range []struct {
+		maxFiles int
+		files    []string
+	}{
+		// the contents of influxdb.log, influxdb.log.1, ... after the
+		// rename
+		{0, []string{"", "current", "1", "2", "3"}},
+		{3, []string{"", "current", "1", "2"}},
+		{1, []string{"", "current"}},
+	} {
+		for i, content := range []string{"current", "1", "2", "3"} {
+			name := path
+			if i > 0 {
+				name = rotatedLogFile(path, i)
+			}
+			c.Assert(ioutil.WriteFile(name, []byte(content), 0644), IsNil)
+		}
+
+		writer := &logWriter{path: path, maxFiles: test.maxFiles}
+		c.Assert(writer.renameLogFiles(), IsNil)
+
+		_, err := os.Stat(path)
+		c.Assert(os.IsNotExist(err), Equals, true)
+		for i, content := range test.files[1:] {
+			c.Assert(readLogFile(c, rotatedLogFile(path, i+1)), Equals, content, Commentf("max files %d", test.maxFiles))
+		}
+		_, err = os.Stat(rotatedLogFile(path, len(test.files)))
+		c.Assert(os.IsNotExist(err), Equals, true, Commentf("max files %d", test.maxFiles))
+
+		files, err := filepath.Glob(path + "*")
+		c.Assert(err, IsNil)
+		for _, file := range files {
+			c.Assert(os.Remove(file), IsNil)
+		}
+	}
+}
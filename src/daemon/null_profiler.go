@@ -17,12 +17,16 @@ func startProfiler(stoppable Stoppable) error {
 }
 
 func waitForSignals(stoppable Stoppable) {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	for {
 		sig := <-ch
 		log.Info("Received signal: %s", sig.String())
 		switch sig {
+		case syscall.SIGHUP:
+			if reloadable, ok := stoppable.(Reloadable); ok {
+				reloadable.ReloadConfig()
+			}
 		case syscall.SIGINT, syscall.SIGTERM:
 			stoppable.Stop()
 			time.Sleep(time.Second)
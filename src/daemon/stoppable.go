@@ -3,3 +3,9 @@ package main
 type Stoppable interface {
 	Stop()
 }
+
+// Implemented by servers that can reload their configuration
+// without being restarted, triggered by SIGHUP
+type Reloadable interface {
+	ReloadConfig() error
+}
@@ -0,0 +1,238 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"cluster"
+	"datastore/storage"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	log "code.google.com/p/log4go"
+)
+
+// A backup starts with this header, followed by the key/value pairs of
+// the shard, each one preceded by the uvarint lengths of the key and
+// the value. An empty key marks the end, so truncated backups are
+// detected.
+var backupHeader = []byte("influxdb shard backup 1\n")
+
+// The largest key or value a backup entry can have, longer ones are
+// rejected instead of allocated since the backup is corrupt
+const maxBackupEntryLength = 64 * 1024 * 1024
+
+// Writes a backup of the shard, the shard keeps serving reads and
+// writes while it's written. Returns cluster.ShardNotModifiedError
+// without writing anything if the modification marker of the shard is
+// still since, since is ignored if it's 0.
+func (self *ShardDatastore) BackupShard(id uint32, since int64, w io.Writer) error {
+	shardDb, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	count, err := shardDb.(*Shard).backup(since, w)
+	if err != nil {
+		return err
+	}
+	log.Info("DATASTORE: backed up %d keys of shard %d", count, id)
+	return nil
+}
+
+// Returns the modification marker of the shard, which changes when the
+// shard is modified after it was backed up
+func (self *ShardDatastore) ShardModificationMarker(id uint32) (int64, error) {
+	self.shardsLock.RLock()
+	shard := self.shards[id]
+	self.shardsLock.RUnlock()
+	if shard != nil && shard.marker != nil {
+		shard.marker.lock.Lock()
+		defer shard.marker.lock.Unlock()
+		return shard.marker.value, nil
+	}
+	// the marker of shards that aren't open is up to date on disk
+	return readModificationMarker(self.shardDir(id))
+}
+
+// Loads a backup written by BackupShard into the shard, which can't
+// have any data yet
+func (self *ShardDatastore) RestoreShard(id uint32, r io.Reader) error {
+	shardDb, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	count, err := shardDb.(*Shard).restore(r)
+	if err != nil {
+		return err
+	}
+	log.Info("DATASTORE: restored %d keys of shard %d", count, id)
+	return nil
+}
+
+// The iterator reads from a snapshot of the engine, so the backup is
+// consistent and doesn't have the writes that happen while it's written
+func (self *Shard) backup(since int64, w io.Writer) (int, error) {
+	var it storage.Iterator
+	marker := self.marker.backup(func() { it = self.db.Iterator() })
+	defer it.Close()
+	if since != 0 && marker == since {
+		return 0, cluster.ShardNotModifiedError
+	}
+
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(backupHeader); err != nil {
+		return 0, err
+	}
+
+	lengths := make([]byte, 2*binary.MaxVarintLen64)
+	count := 0
+	for it.Seek([]byte{}); it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		n := binary.PutUvarint(lengths, uint64(len(key)))
+		n += binary.PutUvarint(lengths[n:], uint64(len(value)))
+		for _, b := range [][]byte{lengths[:n], key, value} {
+			if _, err := writer.Write(b); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+	if err := it.Error(); err != nil {
+		return count, err
+	}
+
+	if _, err := writer.Write([]byte{0, 0}); err != nil {
+		return count, err
+	}
+	return count, writer.Flush()
+}
+
+func (self *Shard) restore(r io.Reader) (int, error) {
+	// the marker is changed before the column ids are locked, like
+	// the writes do
+	if err := self.marker.modify(); err != nil {
+		return 0, err
+	}
+	defer self.marker.done()
+	// the ids of the columns in the backup would clash with the ones
+	// created for the existing data
+	self.columnIdMutex.Lock()
+	defer self.columnIdMutex.Unlock()
+	defer self.invalidateReadCache()
+	it := self.db.Iterator()
+	it.Seek([]byte{})
+	empty := !it.Valid()
+	it.Close()
+	if !empty {
+		return 0, errors.New("Cannot restore a backup into a shard that has data")
+	}
+
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(backupHeader))
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header, backupHeader) {
+		return 0, errors.New("Invalid shard backup")
+	}
+
+	count, err := self.restoreEntries(reader)
+	if err != nil {
+		// the shard was empty, nothing of a failed restore is kept
+		if err := self.deleteAllKeys(); err != nil {
+			log.Error("Cannot delete the keys of the failed restore: %s", err)
+		}
+		return 0, err
+	}
+	return count, nil
+}
+
+func (self *Shard) restoreEntries(reader *bufio.Reader) (int, error) {
+	count := 0
+	size := 0
+	writes := []storage.Write{}
+	for {
+		key, value, err := readBackupEntry(reader)
+		if err != nil {
+			return count, err
+		}
+		if len(key) == 0 {
+			break
+		}
+		writes = append(writes, storage.Write{Key: key, Value: value})
+		size += len(key) + len(value)
+		if size < self.writeBatchSize {
+			continue
+		}
+		if err := self.db.BatchPut(writes); err != nil {
+			return count, err
+		}
+		count += len(writes)
+		writes, size = writes[:0], 0
+	}
+	if err := self.db.BatchPut(writes); err != nil {
+		return count, err
+	}
+	count += len(writes)
+
+	// the next column ids have to come after the restored ones
+	lastIdBytes, err := self.db.Get(NEXT_ID_KEY)
+	if err != nil || lastIdBytes == nil {
+		return count, err
+	}
+	lastId, err := binary.ReadUvarint(bytes.NewBuffer(lastIdBytes))
+	if err != nil {
+		return count, err
+	}
+	self.lastIdUsed = lastId
+	return count, nil
+}
+
+func (self *Shard) deleteAllKeys() error {
+	it := self.db.Iterator()
+	defer it.Close()
+	var first, last []byte
+	for it.Seek([]byte{}); it.Valid(); it.Next() {
+		if first == nil {
+			first = append([]byte{}, it.Key()...)
+		}
+		last = append(last[:0], it.Key()...)
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if first == nil {
+		return nil
+	}
+	return self.db.Del(first, last)
+}
+
+// Returns an empty key once the end of the backup is reached
+func readBackupEntry(reader *bufio.Reader) ([]byte, []byte, error) {
+	keyLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, nil, truncatedBackupError(err)
+	}
+	valueLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, nil, truncatedBackupError(err)
+	}
+	if keyLength == 0 {
+		return nil, nil, nil
+	}
+	if keyLength > maxBackupEntryLength || valueLength > maxBackupEntryLength {
+		return nil, nil, fmt.Errorf("Invalid shard backup, it has an entry of %d bytes", keyLength+valueLength)
+	}
+	entry := make([]byte, keyLength+valueLength)
+	if _, err := io.ReadFull(reader, entry); err != nil {
+		return nil, nil, truncatedBackupError(err)
+	}
+	return entry[:keyLength], entry[keyLength:], nil
+}
+
+func truncatedBackupError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("The shard backup is truncated")
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"cluster"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Compacts the local shards every interval, between windowStart and
+// windowEnd past midnight in local time unless they're equal. The
+// scheduled compactions skip the shards whose size didn't change since
+// they were last compacted.
+func (self *ShardDatastore) StartCompactionScheduler(interval, windowStart, windowEnd time.Duration) {
+	if interval == 0 {
+		return
+	}
+	inWindow := func() bool {
+		return inCompactionWindow(time.Now(), windowStart, windowEnd)
+	}
+	go func() {
+		for _ = range time.Tick(interval) {
+			if self.IsClosed() {
+				return
+			}
+			if !inWindow() {
+				log.Debug("DATASTORE: skipping the shard compactions, they're outside of the compaction window")
+				continue
+			}
+			self.compactShards(inWindow)
+		}
+	}()
+}
+
+func inCompactionWindow(t time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	year, month, day := t.Date()
+	sinceMidnight := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	if start < end {
+		return sinceMidnight >= start && sinceMidnight < end
+	}
+	// the window wraps around midnight
+	return sinceMidnight >= start || sinceMidnight < end
+}
+
+func (self *ShardDatastore) compactShards(inWindow func() bool) {
+	ids, err := self.localShardIds()
+	if err != nil {
+		log.Error("DATASTORE: cannot list the local shards to compact them: %s", err)
+		return
+	}
+
+	for i, id := range ids {
+		if self.IsClosed() {
+			return
+		}
+		if !inWindow() {
+			log.Info("DATASTORE: the compaction window ended before %d shards were compacted", len(ids)-i)
+			return
+		}
+
+		size, err := dirSize(self.shardDir(id))
+		if err != nil {
+			log.Error("DATASTORE: cannot get the size of shard %d: %s", id, err)
+			continue
+		}
+		self.compactionsLock.Lock()
+		stats := self.compactions[id]
+		self.compactionsLock.Unlock()
+		if stats != nil && stats.Size == size {
+			continue
+		}
+
+		if err := self.CompactShard(id); err != nil {
+			log.Error("DATASTORE: cannot compact shard %d: %s", id, err)
+		}
+	}
+}
+
+// Compacts the engine of the shard to reclaim the space of the deleted
+// and overwritten points
+func (self *ShardDatastore) CompactShard(id uint32) error {
+	shardDb, err := self.GetShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+
+	dir := self.shardDir(id)
+	before, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	shardDb.(*Shard).db.Compact()
+	duration := time.Now().Sub(start)
+	after, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+
+	self.compactionsLock.Lock()
+	stats := self.compactions[id]
+	if stats == nil {
+		stats = &cluster.ShardCompactionStats{}
+		self.compactions[id] = stats
+	}
+	stats.LastRun = start
+	stats.DurationMs = int64(duration / time.Millisecond)
+	stats.BytesReclaimed = before - after
+	stats.Size = after
+	stats.Compactions++
+	self.compactionsLock.Unlock()
+
+	log.Info("DATASTORE: compacted shard %d in %s, reclaimed %d bytes", id, duration, before-after)
+	return nil
+}
+
+// Returns the stats of the last compaction of the shards that were
+// compacted since startup
+func (self *ShardDatastore) CompactionStats() map[uint32]*cluster.ShardCompactionStats {
+	self.compactionsLock.Lock()
+	defer self.compactionsLock.Unlock()
+	stats := make(map[uint32]*cluster.ShardCompactionStats, len(self.compactions))
+	for id, s := range self.compactions {
+		shardStats := *s
+		stats[id] = &shardStats
+	}
+	return stats
+}
+
+// Returns the ids of the shards that have a directory in the data
+// directory
+func (self *ShardDatastore) localShardIds() ([]uint32, error) {
+	infos, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(info.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
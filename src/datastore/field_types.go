@@ -0,0 +1,254 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "code.google.com/p/log4go"
+)
+
+// The type of the values of a column of a series is inferred from the
+// first value written to it. The types are kept by the shard datastore
+// for all the local shards, so a column has the same type in every
+// shard of its database. The values of another type are stored as they
+// are, coerced to the type of the column or rejected, depending on the
+// field type policy. Integers and floats are both numbers, a column can
+// have both.
+
+const (
+	STORE_MISMATCHED_FIELDS  = "store"
+	COERCE_MISMATCHED_FIELDS = "coerce"
+	REJECT_MISMATCHED_FIELDS = "reject"
+
+	// the types of the columns of the local shards
+	FIELD_TYPES_FILE = "field_types"
+)
+
+// The types of the columns, keyed by database~series~column. They're
+// saved in the shard datastore directory when a column gets its type.
+type fieldTypeIndex struct {
+	lock  sync.Mutex
+	types map[string]string
+	// the file the types are saved in, they aren't saved if it's empty
+	path string
+}
+
+func newFieldTypeIndex(dir string) (*fieldTypeIndex, error) {
+	self := &fieldTypeIndex{types: make(map[string]string)}
+	if dir == "" {
+		return self, nil
+	}
+	self.path = filepath.Join(dir, FIELD_TYPES_FILE)
+	body, err := ioutil.ReadFile(self.path)
+	if os.IsNotExist(err) {
+		return self, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &self.types); err != nil {
+		return nil, fmt.Errorf("Invalid field types in %s: %s", self.path, err)
+	}
+	return self, nil
+}
+
+// Returns the type of the column, empty if nothing was written to it
+func (self *fieldTypeIndex) get(database, series, column string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.types[database+"~"+series+"~"+column]
+}
+
+// Sets the type of the column if it doesn't have one yet, returns the
+// type of the column
+func (self *fieldTypeIndex) setIfMissing(database, series, column, fieldType string) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := database + "~" + series + "~" + column
+	if existing, ok := self.types[key]; ok {
+		return existing, nil
+	}
+	self.types[key] = fieldType
+	if err := self.save(); err != nil {
+		delete(self.types, key)
+		return "", err
+	}
+	return fieldType, nil
+}
+
+// Forgets the types of the columns of the series, or of all the series
+// of the database if series is empty
+func (self *fieldTypeIndex) forget(database, series string) error {
+	prefix := database + "~"
+	if series != "" {
+		prefix += series + "~"
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	forgotten := false
+	for key := range self.types {
+		if strings.HasPrefix(key, prefix) {
+			delete(self.types, key)
+			forgotten = true
+		}
+	}
+	if !forgotten {
+		return nil
+	}
+	return self.save()
+}
+
+// Writes the types to a temporary file that replaces the old one, so a
+// crash doesn't leave a partial file. Called with the lock held.
+func (self *fieldTypeIndex) save() error {
+	if self.path == "" {
+		return nil
+	}
+	body, err := json.Marshal(self.types)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(self.path+".tmp", body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(self.path+".tmp", self.path)
+}
+
+// Returns the type of the value, empty for nulls
+func fieldType(value *protocol.FieldValue) string {
+	switch {
+	case value == nil || value.GetIsNull():
+		return ""
+	case value.StringValue != nil:
+		return "string"
+	case value.Int64Value != nil, value.DoubleValue != nil:
+		return "number"
+	case value.BoolValue != nil:
+		return "bool"
+	}
+	return ""
+}
+
+// Returns the value converted to the type, false if it can't be
+// converted without losing it
+func coerceValue(value *protocol.FieldValue, to string) (*protocol.FieldValue, bool) {
+	switch to {
+	case "string":
+		var s string
+		switch {
+		case value.Int64Value != nil:
+			s = strconv.FormatInt(*value.Int64Value, 10)
+		case value.DoubleValue != nil:
+			s = strconv.FormatFloat(*value.DoubleValue, 'g', -1, 64)
+		case value.BoolValue != nil:
+			s = strconv.FormatBool(*value.BoolValue)
+		default:
+			return nil, false
+		}
+		return &protocol.FieldValue{StringValue: &s}, true
+	case "number":
+		switch {
+		case value.StringValue != nil:
+			if i, err := strconv.ParseInt(*value.StringValue, 10, 64); err == nil {
+				return &protocol.FieldValue{Int64Value: &i}, true
+			}
+			if f, err := strconv.ParseFloat(*value.StringValue, 64); err == nil {
+				return &protocol.FieldValue{DoubleValue: &f}, true
+			}
+		case value.BoolValue != nil:
+			i := int64(0)
+			if *value.BoolValue {
+				i = 1
+			}
+			return &protocol.FieldValue{Int64Value: &i}, true
+		}
+	case "bool":
+		if value.StringValue != nil {
+			if b, err := strconv.ParseBool(*value.StringValue); err == nil {
+				return &protocol.FieldValue{BoolValue: &b}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Checks the values of the series against the types of their columns
+// before they're logged, so the points the policy rejects fail the
+// write. The new columns get the types of their values and the values
+// are coerced in place.
+func (self *Shard) CheckFieldTypes(database string, series []*protocol.Series) error {
+	for _, s := range series {
+		if _, err := self.checkFieldTypes(database, s, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the field type policy to the values of the series whose type
+// isn't the type of their column and returns the points to write. The
+// rejected points fail the check, unless drop is set. The writes are
+// checked before they're logged, but a column can get another type
+// between the check and the write, e.g. if it was dropped and written
+// to again, or on a replica. The logged writes can't fail without being
+// retried forever, so their rejected points are dropped and counted.
+func (self *Shard) checkFieldTypes(database string, series *protocol.Series, drop bool) ([]*protocol.Point, error) {
+	rejected := map[int]bool{}
+	for fieldIndex, field := range series.Fields {
+		columnType := self.fieldTypes.get(database, *series.Name, field)
+		for pointIndex, point := range series.Points {
+			value := point.Values[fieldIndex]
+			valueType := fieldType(value)
+			if valueType == "" || valueType == columnType {
+				continue
+			}
+			if columnType == "" {
+				var err error
+				// the column may have got its type from another write
+				if columnType, err = self.fieldTypes.setIfMissing(database, *series.Name, field, valueType); err != nil {
+					return nil, err
+				}
+				if valueType == columnType {
+					continue
+				}
+			}
+
+			switch self.fieldTypePolicy {
+			case COERCE_MISMATCHED_FIELDS:
+				if coerced, ok := coerceValue(value, columnType); ok {
+					point.Values[fieldIndex] = coerced
+					continue
+				}
+			case REJECT_MISMATCHED_FIELDS:
+			default:
+				continue
+			}
+			err := fmt.Errorf("Column %s of series %s has %s values, the point has a %s value", field, *series.Name, columnType, valueType)
+			if !drop {
+				return nil, err
+			}
+			if !rejected[pointIndex] {
+				log.Error("Dropping a logged point written to shard %d: %s", self.id, err)
+			}
+			rejected[pointIndex] = true
+		}
+	}
+
+	if len(rejected) == 0 {
+		return series.Points, nil
+	}
+	points := make([]*protocol.Point, 0, len(series.Points)-len(rejected))
+	for pointIndex, point := range series.Points {
+		if !rejected[pointIndex] {
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
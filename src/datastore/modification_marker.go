@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MODIFICATION_MARKER_FILE = "modified"
+
+// Changes when the shard is modified after it was opened or backed
+// up, so incremental backups can skip the shards whose marker didn't
+// change since their last backup. It's saved before the modification
+// is applied, so a modification that's interrupted by a crash changes
+// it too.
+type modificationMarker struct {
+	path string
+	// held for reading by modifications that are being applied, so a
+	// backup doesn't miss a modification that changed the marker before
+	// the backup started but wasn't applied yet
+	modifications sync.RWMutex
+	lock          sync.Mutex
+	value         int64
+	// whether the value was already changed for the modifications
+	// since the shard was opened or backed up
+	changed bool
+}
+
+func newModificationMarker(dir string) (*modificationMarker, error) {
+	marker := &modificationMarker{path: filepath.Join(dir, MODIFICATION_MARKER_FILE)}
+	value, err := readModificationMarker(dir)
+	if err != nil {
+		return nil, err
+	}
+	marker.value = value
+	return marker, nil
+}
+
+// Returns the marker saved in the shard directory, 0 if the shard
+// wasn't modified since markers were introduced
+func readModificationMarker(dir string) (int64, error) {
+	body, err := ioutil.ReadFile(filepath.Join(dir, MODIFICATION_MARKER_FILE))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// Called before the shard is modified, done has to be called once the
+// modification is applied
+func (self *modificationMarker) modify() error {
+	if self == nil {
+		return nil
+	}
+	self.modifications.RLock()
+	if err := self.change(); err != nil {
+		self.modifications.RUnlock()
+		return err
+	}
+	return nil
+}
+
+func (self *modificationMarker) done() {
+	if self != nil {
+		self.modifications.RUnlock()
+	}
+}
+
+func (self *modificationMarker) change() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.changed {
+		return nil
+	}
+
+	value := time.Now().UnixNano()
+	if value <= self.value {
+		value = self.value + 1
+	}
+	f, err := os.OpenFile(self.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strconv.FormatInt(value, 10)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	self.value = value
+	self.changed = true
+	return nil
+}
+
+// Calls snapshot once the modifications in progress are applied and
+// returns the marker of the data it sees, the next modification
+// changes the marker
+func (self *modificationMarker) backup(snapshot func()) int64 {
+	if self == nil {
+		snapshot()
+		return 0
+	}
+	self.modifications.Lock()
+	defer self.modifications.Unlock()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.changed = false
+	snapshot()
+	return self.value
+}
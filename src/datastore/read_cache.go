@@ -0,0 +1,343 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"container/list"
+	"datastore/storage"
+	"encoding/binary"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the queries that span more windows read from the engine directly,
+// so queries over long time ranges don't evict the recent windows
+const READ_CACHE_MAX_QUERY_WINDOWS = 64
+
+// the memory used by a cached point besides its key and value
+const readCachePointOverhead = 48
+
+// The points of a column in a time window of a shard
+type readCacheKey struct {
+	shardId  uint32
+	columnId string
+	window   uint64
+}
+
+type readCacheEntry struct {
+	key readCacheKey
+	// nil while the window is loaded
+	points  []storage.Write
+	size    int
+	element *list.Element
+}
+
+// An LRU cache of the points of the columns in fixed time windows that
+// is shared by the shards. A window is loaded from the engine the first
+// time it's read and invalidated when points are written to it or
+// deleted from it.
+type readCache struct {
+	lock    sync.Mutex
+	maxSize int
+	size    int
+	// the length of the windows in microseconds
+	window    uint64
+	entries   map[readCacheKey]*readCacheEntry
+	lru       *list.List
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+func newReadCache(maxSize int, window time.Duration) *readCache {
+	return &readCache{
+		maxSize: maxSize,
+		window:  uint64(window / time.Microsecond),
+		entries: make(map[readCacheKey]*readCacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// Returns the window of the time as it's stored in the keys
+func (self *readCache) windowOf(t []byte) uint64 {
+	return binary.BigEndian.Uint64(t) / self.window
+}
+
+// Returns the points of the window, they're loaded with load if they
+// aren't cached
+func (self *readCache) get(key readCacheKey, load func() ([]storage.Write, error)) ([]storage.Write, error) {
+	self.lock.Lock()
+	entry := self.entries[key]
+	if entry != nil && entry.points != nil {
+		self.hits++
+		self.lru.MoveToFront(entry.element)
+		self.lock.Unlock()
+		return entry.points, nil
+	}
+	self.misses++
+	// the placeholder is removed if the window is invalidated while
+	// it's loaded, so the points that were read before the
+	// invalidation aren't cached
+	if entry == nil {
+		entry = &readCacheEntry{key: key}
+		self.entries[key] = entry
+	}
+	self.lock.Unlock()
+
+	points, err := load()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.entries[key] != entry || entry.points != nil {
+		return points, err
+	}
+	size := 0
+	for _, point := range points {
+		size += len(point.Key) + len(point.Value) + readCachePointOverhead
+	}
+	if err != nil || size > self.maxSize {
+		delete(self.entries, key)
+		return points, err
+	}
+
+	if points == nil {
+		points = []storage.Write{}
+	}
+	entry.points = points
+	entry.size = size
+	entry.element = self.lru.PushFront(entry)
+	self.size += size
+	for self.size > self.maxSize {
+		self.remove(self.lru.Back().Value.(*readCacheEntry))
+		self.evictions++
+	}
+	return points, nil
+}
+
+func (self *readCache) remove(entry *readCacheEntry) {
+	delete(self.entries, entry.key)
+	if entry.element != nil {
+		self.lru.Remove(entry.element)
+		self.size -= entry.size
+	}
+}
+
+func (self *readCache) invalidate(keys map[readCacheKey]bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key := range keys {
+		if entry := self.entries[key]; entry != nil {
+			self.remove(entry)
+		}
+	}
+}
+
+func (self *readCache) invalidateShard(shardId uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, entry := range self.entries {
+		if key.shardId == shardId {
+			self.remove(entry)
+		}
+	}
+}
+
+func (self *readCache) stats() *cluster.ReadCacheStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return &cluster.ReadCacheStats{
+		Size:      self.size,
+		MaxSize:   self.maxSize,
+		Windows:   self.lru.Len(),
+		Hits:      self.hits,
+		Misses:    self.misses,
+		Evictions: self.evictions,
+	}
+}
+
+// Collects the windows written by a write, they're invalidated once
+// the write is applied
+type readCacheInvalidation struct {
+	cache   *readCache
+	shardId uint32
+	keys    map[readCacheKey]bool
+}
+
+func (self *Shard) newReadCacheInvalidation() *readCacheInvalidation {
+	if self.cache == nil {
+		return nil
+	}
+	return &readCacheInvalidation{self.cache, self.id, make(map[readCacheKey]bool)}
+}
+
+func (self *readCacheInvalidation) add(columnId []byte, timestamp uint64) {
+	if self != nil {
+		self.keys[readCacheKey{self.shardId, string(columnId), timestamp / self.cache.window}] = true
+	}
+}
+
+func (self *readCacheInvalidation) apply() {
+	if self != nil {
+		self.cache.invalidate(self.keys)
+	}
+}
+
+// Invalidates the cached windows of the shard after a delete
+func (self *Shard) invalidateReadCache() {
+	if self.cache != nil {
+		self.cache.invalidateShard(self.id)
+	}
+}
+
+// Returns an iterator over the cached windows of the column between
+// start and end, nil if the range spans too many windows to be cached
+func (self *Shard) readCacheIterator(columnId, start, end []byte) *readCacheIterator {
+	if self.cache == nil {
+		return nil
+	}
+	first, last := self.cache.windowOf(start), self.cache.windowOf(end)
+	if last-first >= READ_CACHE_MAX_QUERY_WINDOWS {
+		return nil
+	}
+	return &readCacheIterator{shard: self, columnId: columnId, first: first, last: last}
+}
+
+// Reads the points of the column in the window from the engine
+func (self *Shard) loadReadCacheWindow(columnId []byte, window uint64) ([]storage.Write, error) {
+	startTime := make([]byte, 8)
+	binary.BigEndian.PutUint64(startTime, window*self.cache.window)
+	endTime := make([]byte, 8)
+	end := uint64(math.MaxUint64)
+	if window < math.MaxUint64/self.cache.window {
+		end = (window+1)*self.cache.window - 1
+	}
+	binary.BigEndian.PutUint64(endTime, end)
+
+	it := self.db.Iterator()
+	defer it.Close()
+	points := []storage.Write{}
+	for it.Seek(append(append([]byte{}, columnId...), startTime...)); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < 16 || !isPointInRange(columnId, startTime, endTime, key) {
+			break
+		}
+		// the engine reuses the buffers of the keys and values
+		points = append(points, storage.Write{
+			Key:   append([]byte{}, key...),
+			Value: append([]byte{}, it.Value()...),
+		})
+	}
+	return points, it.Error()
+}
+
+// Iterates over the points of a column through the read cache, one
+// window at a time
+type readCacheIterator struct {
+	shard    *Shard
+	columnId []byte
+	first    uint64
+	last     uint64
+	window   uint64
+	points   []storage.Write
+	index    int
+	err      error
+}
+
+func (self *readCacheIterator) load(window uint64) bool {
+	self.window = window
+	key := readCacheKey{self.shard.id, string(self.columnId), window}
+	self.points, self.err = self.shard.cache.get(key, func() ([]storage.Write, error) {
+		return self.shard.loadReadCacheWindow(self.columnId, window)
+	})
+	return self.err == nil
+}
+
+// Positions the iterator on the first point that's >= key
+func (self *readCacheIterator) Seek(key []byte) {
+	if !self.load(self.clamp(key)) {
+		return
+	}
+	self.index = sort.Search(len(self.points), func(i int) bool {
+		return bytes.Compare(self.points[i].Key, key) >= 0
+	})
+	self.forward()
+}
+
+// Positions the iterator on the last point that's < key
+func (self *readCacheIterator) seekBefore(key []byte) {
+	if !self.load(self.clamp(key)) {
+		return
+	}
+	self.index = sort.Search(len(self.points), func(i int) bool {
+		return bytes.Compare(self.points[i].Key, key) >= 0
+	}) - 1
+	self.backward()
+}
+
+func (self *readCacheIterator) clamp(key []byte) uint64 {
+	window := self.first
+	if len(key) >= 16 && bytes.Equal(key[:8], self.columnId) {
+		window = self.shard.cache.windowOf(key[8:16])
+	}
+	if window < self.first {
+		return self.first
+	}
+	if window > self.last {
+		return self.last
+	}
+	return window
+}
+
+// Moves to the next windows while the iterator is past the points of
+// the current one
+func (self *readCacheIterator) forward() {
+	for self.index >= len(self.points) && self.window < self.last {
+		if !self.load(self.window + 1) {
+			return
+		}
+		self.index = 0
+	}
+}
+
+// Moves to the previous windows while the iterator is before the
+// points of the current one
+func (self *readCacheIterator) backward() {
+	for self.index < 0 && self.window > self.first {
+		if !self.load(self.window - 1) {
+			return
+		}
+		self.index = len(self.points) - 1
+	}
+}
+
+func (self *readCacheIterator) Key() []byte {
+	return self.points[self.index].Key
+}
+
+func (self *readCacheIterator) Value() []byte {
+	return self.points[self.index].Value
+}
+
+func (self *readCacheIterator) Next() {
+	self.index++
+	self.forward()
+}
+
+func (self *readCacheIterator) Prev() {
+	self.index--
+	self.backward()
+}
+
+func (self *readCacheIterator) Valid() bool {
+	return self.err == nil && self.index >= 0 && self.index < len(self.points)
+}
+
+func (self *readCacheIterator) Error() error {
+	return self.err
+}
+
+func (self *readCacheIterator) Close() error {
+	return nil
+}
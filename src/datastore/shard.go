@@ -27,6 +27,33 @@ type Shard struct {
 	closed         bool
 	pointBatchSize int
 	writeBatchSize int
+	// changed by the modifications of the shard for incremental backups
+	marker *modificationMarker
+	// the id of the shard and the read cache shared by the shards, nil
+	// if it's disabled
+	id    uint32
+	cache *readCache
+	// the columns whose values are indexed
+	indexedColumns map[string]bool
+	// the indexed columns the index is complete for, the queries don't
+	// use it for the others
+	completeColumns     map[string]bool
+	completeColumnsLock sync.RWMutex
+	// the types of the columns of all the local shards and what's done
+	// with the values of another type
+	fieldTypes      *fieldTypeIndex
+	fieldTypePolicy string
+	// returns whether the database was dropped, the types of its
+	// columns are forgotten when it's dropped from the shard. Nil if
+	// the shard isn't opened by the shard datastore.
+	isDroppedDatabase func(db string) bool
+	// held for writing while a database is dropped from the shard, the
+	// writes hold it for reading
+	dropLock sync.RWMutex
+	// held by the writes that don't keep the duplicate points, from the
+	// lookup of the points they duplicate to their write, so two writes
+	// can't both find a timestamp free
+	duplicatePointsLock sync.Mutex
 }
 
 func NewShard(db storage.Engine, pointBatchSize, writeBatchSize int) (*Shard, error) {
@@ -48,23 +75,81 @@ func NewShard(db storage.Engine, pointBatchSize, writeBatchSize int) (*Shard, er
 		lastIdUsed:     lastId,
 		pointBatchSize: pointBatchSize,
 		writeBatchSize: writeBatchSize,
+		fieldTypes:     &fieldTypeIndex{types: make(map[string]string)},
 	}, nil
 }
 
 func (self *Shard) Write(database string, series []*protocol.Series) error {
+	_, _, err := self.write(database, series, cluster.KEEP_DUPLICATE_POINTS)
+	return err
+}
+
+func (self *Shard) WriteWithPolicy(database string, series []*protocol.Series, policy cluster.DuplicatePointPolicy) (int, int, error) {
+	// the database can't be dropped from the shard between the check
+	// and the write, the points would be left behind
+	self.dropLock.RLock()
+	defer self.dropLock.RUnlock()
+	if self.isDroppedDatabase != nil && self.isDroppedDatabase(database) {
+		log.Warn("DATASTORE: discarding a write to the dropped database %s", database)
+		return 0, 0, nil
+	}
+	return self.write(database, series, policy)
+}
+
+// Writes the series, the points with the timestamp of another point of
+// their series are written according to the policy. Returns the number
+// of points written and the number dropped because their values don't
+// match the types of their columns.
+func (self *Shard) write(database string, series []*protocol.Series, policy cluster.DuplicatePointPolicy) (int, int, error) {
+	if err := self.marker.modify(); err != nil {
+		return 0, 0, err
+	}
+	defer self.marker.done()
+	if policy != cluster.KEEP_DUPLICATE_POINTS {
+		self.duplicatePointsLock.Lock()
+		defer self.duplicatePointsLock.Unlock()
+	}
+
+	invalidation := self.newReadCacheInvalidation()
+	defer invalidation.apply()
 	wb := make([]storage.Write, 0)
+	written, rejected := 0, 0
 
 	for _, s := range series {
 		if len(s.Points) == 0 {
-			return errors.New("Unable to write no data. Series was nil or had no points.")
+			return written, rejected, errors.New("Unable to write no data. Series was nil or had no points.")
+		}
+		points, err := self.checkFieldTypes(database, s, true)
+		if err != nil {
+			return written, rejected, err
+		}
+		if len(points) != len(s.Points) {
+			rejected += len(s.Points) - len(points)
+			if len(points) == 0 {
+				continue
+			}
+			s = &protocol.Series{Name: s.Name, Fields: s.Fields, Points: points}
+		}
+		if policy != cluster.KEEP_DUPLICATE_POINTS {
+			points, deletes, err := self.resolveDuplicatePoints(database, s, policy, invalidation)
+			if err != nil {
+				return written, rejected, err
+			}
+			if len(points) == 0 {
+				continue
+			}
+			wb = append(wb, deletes...)
+			s = &protocol.Series{Name: s.Name, Fields: s.Fields, Points: points}
 		}
+		wb = append(wb, self.valueIndexWrites(database, s)...)
+		written += len(s.Points)
 
 		count := 0
 		for fieldIndex, field := range s.Fields {
 			temp := field
 			id, err := self.createIdForDbSeriesColumn(&database, s.Name, &temp)
 			if err != nil {
-				return err
+				return written, rejected, err
 			}
 			for _, point := range s.Points {
 				keyBuffer := bytes.NewBuffer(make([]byte, 0, 24))
@@ -79,6 +164,7 @@ func (self *Shard) Write(database string, series []*protocol.Series) error {
 				binary.Write(keyBuffer, binary.BigEndian, &timestamp)
 				binary.Write(keyBuffer, binary.BigEndian, point.SequenceNumber)
 				pointKey := keyBuffer.Bytes()
+				invalidation.add(id, timestamp)
 
 				if point.Values[fieldIndex].GetIsNull() {
 					wb = append(wb, storage.Write{Key: pointKey, Value: nil})
@@ -87,7 +173,7 @@ func (self *Shard) Write(database string, series []*protocol.Series) error {
 
 				err = dataBuffer.Marshal(point.Values[fieldIndex])
 				if err != nil {
-					return err
+					return written, rejected, err
 				}
 				wb = append(wb, storage.Write{Key: pointKey, Value: dataBuffer.Bytes()})
 			check:
@@ -95,7 +181,7 @@ func (self *Shard) Write(database string, series []*protocol.Series) error {
 				if count >= self.writeBatchSize {
 					err = self.db.BatchPut(wb)
 					if err != nil {
-						return err
+						return written, rejected, err
 					}
 					count = 0
 					wb = make([]storage.Write, 0, self.writeBatchSize)
@@ -104,7 +190,75 @@ func (self *Shard) Write(database string, series []*protocol.Series) error {
 		}
 	}
 
-	return self.db.BatchPut(wb)
+	return written, rejected, self.db.BatchPut(wb)
+}
+
+// Applies the policy to the points of the series that have the
+// timestamp of another point of the series, written before or in the
+// same write. Returns the points to write and the deletes of the points
+// they overwrite.
+func (self *Shard) resolveDuplicatePoints(database string, series *protocol.Series, policy cluster.DuplicatePointPolicy, invalidation *readCacheInvalidation) ([]*protocol.Point, []storage.Write, error) {
+	overwrite := policy == cluster.OVERWRITE_DUPLICATE_POINTS
+	seen := map[int64]int{}
+	points := make([]*protocol.Point, 0, len(series.Points))
+	for _, point := range series.Points {
+		timestamp := *point.GetTimestampInMicroseconds()
+		if i, ok := seen[timestamp]; ok {
+			if overwrite {
+				points[i] = point
+			}
+			continue
+		}
+		seen[timestamp] = len(points)
+		points = append(points, point)
+	}
+
+	// a point is stored as a key for each column of the series
+	ids := [][]byte{}
+	for _, column := range self.getColumnNamesForSeries(database, *series.Name) {
+		id, err := self.getIdForDbSeriesColumn(&database, series.Name, &column)
+		if err != nil {
+			return nil, nil, err
+		}
+		if id != nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return points, nil, nil
+	}
+
+	itr := self.db.Iterator()
+	defer itr.Close()
+	deletes := []storage.Write{}
+	written := make([]*protocol.Point, 0, len(points))
+	prefix := make([]byte, 16)
+	for _, point := range points {
+		timestamp := self.convertTimestampToUint(point.GetTimestampInMicroseconds())
+		binary.BigEndian.PutUint64(prefix[8:], timestamp)
+		duplicate := false
+	columns:
+		for _, id := range ids {
+			copy(prefix, id)
+			for itr.Seek(prefix); itr.Valid() && bytes.HasPrefix(itr.Key(), prefix); itr.Next() {
+				duplicate = true
+				if !overwrite {
+					break columns
+				}
+				deletes = append(deletes, storage.Write{Key: append([]byte{}, itr.Key()...), Value: nil})
+				invalidation.add(id, timestamp)
+			}
+		}
+		if err := itr.Error(); err != nil {
+			return nil, nil, err
+		}
+		if duplicate && !overwrite {
+			log.Debug("Rejecting the duplicate point at %d of %s", *point.GetTimestampInMicroseconds(), *series.Name)
+			continue
+		}
+		written = append(written, point)
+	}
+	return written, deletes, nil
 }
 
 func (self *Shard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
@@ -122,19 +276,27 @@ func (self *Shard) Query(querySpec *parser.QuerySpec, processor cluster.QueryPro
 		return errors.New("User does not have access to one or more of the series requested.")
 	}
 
+	candidates, indexed, err := self.seriesForIndexedConditions(querySpec)
+	if err != nil {
+		return err
+	}
+
 	for series, columns := range seriesAndColumns {
 		if regex, ok := series.GetCompiledRegex(); ok {
 			seriesNames := self.getSeriesForDbAndRegex(querySpec.Database(), regex)
 			for _, name := range seriesNames {
-				if !querySpec.HasReadAccess(name) {
+				if !querySpec.HasReadAccess(name) || indexed && !candidates[name] {
 					continue
 				}
+				if querySpec.IsCancelled() {
+					return common.QueryCancelledError
+				}
 				err := self.executeQueryForSeries(querySpec, name, columns, processor)
 				if err != nil {
 					return err
 				}
 			}
-		} else {
+		} else if !indexed || candidates[series.Name] {
 			err := self.executeQueryForSeries(querySpec, series.Name, columns, processor)
 			if err != nil {
 				return err
@@ -145,6 +307,8 @@ func (self *Shard) Query(querySpec *parser.QuerySpec, processor cluster.QueryPro
 }
 
 func (self *Shard) DropDatabase(database string) error {
+	self.dropLock.Lock()
+	defer self.dropLock.Unlock()
 	seriesNames := self.getSeriesForDatabase(database)
 	for _, name := range seriesNames {
 		if err := self.dropSeries(database, name); err != nil {
@@ -152,7 +316,21 @@ func (self *Shard) DropDatabase(database string) error {
 			return err
 		}
 	}
-	self.db.Compact()
+	if err := self.dropValueIndex(database); err != nil {
+		return err
+	}
+	// the sweeper drops the expired data of the databases that still
+	// exist, their columns keep their types
+	if self.isDroppedDatabase != nil && self.isDroppedDatabase(database) {
+		if err := self.fieldTypes.forget(database, ""); err != nil {
+			return err
+		}
+	}
+	// the shards are swept again after a restart, don't compact the
+	// ones that have nothing to reclaim
+	if len(seriesNames) > 0 {
+		self.db.Compact()
+	}
 	return nil
 }
 
@@ -307,6 +485,10 @@ func (self *Shard) executeQueryForSeries(querySpec *parser.QuerySpec, seriesName
 		seriesOutgoing.Points = append(seriesOutgoing.Points, point)
 
 		if len(seriesOutgoing.Points) >= self.pointBatchSize {
+			if querySpec.IsCancelled() {
+				log.Debug("Query cancelled, stopping processing")
+				return common.QueryCancelledError
+			}
 			for _, alias := range aliases {
 				series := &protocol.Series{
 					Name:   proto.String(alias),
@@ -374,13 +556,22 @@ func (self *Shard) yieldSeriesNamesForDb(db string, yield func(string) bool) err
 }
 
 func (self *Shard) executeListSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	listQuery := querySpec.ListQuery()
 	return self.yieldSeriesNamesForDb(querySpec.Database(), func(_name string) bool {
+		if !listQuery.IncludesSeries(_name) {
+			return true
+		}
 		name := _name
 		return processor.YieldPoint(&name, nil, nil)
 	})
 }
 
 func (self *Shard) executeDeleteQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
+	if err := self.marker.modify(); err != nil {
+		return err
+	}
+	defer self.marker.done()
+
 	query := querySpec.DeleteQuery()
 	series := query.GetFromClause()
 	database := querySpec.Database()
@@ -411,11 +602,19 @@ func (self *Shard) executeDropSeriesQuery(querySpec *parser.QuerySpec, processor
 	if err != nil {
 		return err
 	}
+	if err := self.fieldTypes.forget(database, series); err != nil {
+		return err
+	}
 	self.db.Compact()
 	return nil
 }
 
 func (self *Shard) dropSeries(database, series string) error {
+	if err := self.marker.modify(); err != nil {
+		return err
+	}
+	defer self.marker.done()
+
 	startTimeBytes := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	endTimeBytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
@@ -473,6 +672,7 @@ func (self *Shard) deleteRangeOfSeriesCommon(database, series string, startTimeB
 		endKey.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 
 		err := self.db.Del(startKey.Bytes(), endKey.Bytes())
+		self.invalidateReadCache()
 		if err != nil {
 			return err
 		}
@@ -730,6 +930,15 @@ func (self *Shard) getIterators(fields []*Field, start, end []byte, isAscendingQ
 	// start the iterators to go through the series data
 	for i, field := range fields {
 		fieldNames[i] = field.Name
+		if it := self.readCacheIterator(field.Id, start, end); it != nil {
+			if isAscendingQuery {
+				it.Seek(append(field.Id, start...))
+			} else {
+				it.seekBefore(append(append(field.Id, end...), MAX_SEQUENCE...))
+			}
+			iterators[i] = it
+			continue
+		}
 		iterators[i] = self.db.Iterator()
 
 		if isAscendingQuery {
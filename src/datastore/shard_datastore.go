@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"cluster"
 	"configuration"
+	"encoding/json"
+	"engine"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -11,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"protocol"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,6 +35,37 @@ type ShardDatastore struct {
 	maxOpenShards  int
 	pointBatchSize int
 	writeBatchSize int
+	indexedColumns map[string]bool
+	closed         bool
+	// number of points written to each shard since startup, and of the
+	// logged points dropped because their values don't match the types
+	// of their columns
+	pointCounts     map[uint32]int64
+	rejectedPoints  map[uint32]int64
+	pointCountsLock sync.Mutex
+	// the types of the columns of the local shards
+	fieldTypes *fieldTypeIndex
+	// the databases already dropped from each shard by the retention
+	// sweeper, only used by the sweeper goroutine. They're saved in the
+	// shard directory so they aren't dropped again after a restart.
+	expiredDatabases map[uint32]map[string]bool
+	// nil if the read cache is disabled
+	readCache *readCache
+	// the limits of the query engines of the local shards
+	engineConfig *engine.QueryEngineConfig
+	// returns the duplicate point policy of a database
+	duplicatePointPolicy func(db string) cluster.DuplicatePointPolicy
+	// returns whether the database was dropped, its writes are discarded
+	isDroppedDatabase func(db string) bool
+	// the last compaction of the shards compacted since startup
+	compactions     map[uint32]*cluster.ShardCompactionStats
+	compactionsLock sync.Mutex
+	// the stats of the local shards as of their last scan
+	shardStats     map[uint32]*scannedShardStats
+	shardStatsLock sync.Mutex
+	// the shards dropped since startup, GetShard doesn't open them again
+	// while their directory is being removed. Guarded by shardsLock.
+	droppedShards map[uint32]bool
 }
 
 const (
@@ -39,6 +73,10 @@ const (
 	ONE_MEGABYTE                    = 1024 * 1024
 	SHARD_BLOOM_FILTER_BITS_PER_KEY = 10
 	SHARD_DATABASE_DIR              = "shard_db"
+	// the databases dropped from the shard by the retention sweeper
+	EXPIRED_DATABASES_FILE = "expired_databases"
+	// the deletes that ran on the shard, in json
+	DELETE_MARKERS_FILE = "delete_markers"
 )
 
 var (
@@ -71,13 +109,37 @@ type rawColumnValue struct {
 }
 
 func NewShardDatastore(config *configuration.Configuration) (*ShardDatastore, error) {
-	baseDbDir := filepath.Join(config.DataDir, SHARD_DATABASE_DIR)
+	baseDbDir := config.ShardDir
+	if baseDbDir == "" {
+		baseDbDir = filepath.Join(config.DataDir, SHARD_DATABASE_DIR)
+	}
 	err := os.MkdirAll(baseDbDir, 0744)
 	if err != nil {
 		return nil, err
 	}
 
+	// fail on startup instead of when the first shard is created
+	if _, err := storage.GetInitializer(config.StorageDefaultEngine); err != nil {
+		return nil, fmt.Errorf("%s, the available engines are %s", err, strings.Join(storage.Engines(), ", "))
+	}
+
+	var cache *readCache
+	if config.StorageReadCacheSize > 0 {
+		cache = newReadCache(config.StorageReadCacheSize, config.StorageReadCacheWindow)
+	}
+
+	fieldTypes, err := newFieldTypeIndex(baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexedColumns := make(map[string]bool, len(config.StorageIndexedColumns))
+	for _, column := range config.StorageIndexedColumns {
+		indexedColumns[column] = true
+	}
+
 	return &ShardDatastore{
+		readCache:      cache,
 		baseDbDir:      baseDbDir,
 		config:         config,
 		shards:         make(map[uint32]*Shard),
@@ -85,19 +147,38 @@ func NewShardDatastore(config *configuration.Configuration) (*ShardDatastore, er
 		lastAccess:     make(map[uint32]int64),
 		shardRefCounts: make(map[uint32]int),
 		shardsToClose:  make(map[uint32]bool),
+		pointCounts:    make(map[uint32]int64),
+		rejectedPoints: make(map[uint32]int64),
+		fieldTypes:     fieldTypes,
+		compactions:    make(map[uint32]*cluster.ShardCompactionStats),
+		shardStats:     make(map[uint32]*scannedShardStats),
+		droppedShards:  make(map[uint32]bool),
 		pointBatchSize: config.StoragePointBatchSize,
 		writeBatchSize: config.StorageWriteBatchSize,
+		indexedColumns: indexedColumns,
+		engineConfig:   engine.NewQueryEngineConfig(config),
 	}, nil
 }
 
 func (self *ShardDatastore) Close() {
 	self.shardsLock.Lock()
 	defer self.shardsLock.Unlock()
+	self.closed = true
 	for _, shard := range self.shards {
 		shard.close()
 	}
 }
 
+func (self *ShardDatastore) IsClosed() bool {
+	self.shardsLock.RLock()
+	defer self.shardsLock.RUnlock()
+	return self.closed
+}
+
+func (self *ShardDatastore) QueryEngineConfig() *engine.QueryEngineConfig {
+	return self.engineConfig
+}
+
 // Get the engine that was used when the shard was created if it
 // exists or set the type of the default engine type
 func (self *ShardDatastore) getEngine(dir string) (string, error) {
@@ -150,6 +231,16 @@ func (self *ShardDatastore) getEngine(dir string) (string, error) {
 }
 
 func (self *ShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalShardDb, error) {
+	return self.getShard(id, true)
+}
+
+// Like GetOrCreateShard but fails if the shard doesn't exist on this
+// server, e.g. because it was dropped
+func (self *ShardDatastore) GetShard(id uint32) (cluster.LocalShardDb, error) {
+	return self.getShard(id, false)
+}
+
+func (self *ShardDatastore) getShard(id uint32, create bool) (cluster.LocalShardDb, error) {
 	now := time.Now().Unix()
 	self.shardsLock.Lock()
 	defer self.shardsLock.Unlock()
@@ -162,6 +253,12 @@ func (self *ShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalShardDb, e
 	}
 
 	dbDir := self.shardDir(id)
+	if !create {
+		if _, err := os.Stat(dbDir); os.IsNotExist(err) || self.droppedShards[id] {
+			delete(self.lastAccess, id)
+			return nil, fmt.Errorf("Shard %d doesn't exist on this server", id)
+		}
+	}
 
 	log.Info("DATASTORE: opening or creating shard %s", dbDir)
 	engine, err := self.getEngine(dbDir)
@@ -192,17 +289,52 @@ func (self *ShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalShardDb, e
 	}
 
 	se, err := init.Initialize(dbDir, c)
+	if err != nil {
+		log.Error("Error initializing the %s engine of shard %d: %s", engine, id, err)
+		return nil, err
+	}
 	db, err = NewShard(se, self.pointBatchSize, self.writeBatchSize)
 	if err != nil {
 		log.Error("Error creating shard: ", err)
 		se.Close()
 		return nil, err
 	}
+	db.id = id
+	db.cache = self.readCache
+	db.indexedColumns = self.indexedColumns
+	db.fieldTypes = self.fieldTypes
+	db.fieldTypePolicy = self.config.StorageFieldTypeMismatch
+	db.isDroppedDatabase = self.isDroppedDatabase
+	if db.marker, err = newModificationMarker(dbDir); err != nil {
+		log.Error("Error reading the modification marker of shard %d: %s", id, err)
+		se.Close()
+		return nil, err
+	}
+	missing, err := db.loadValueIndex()
+	if err != nil {
+		log.Error("Error reading the value index of shard %d: %s", id, err)
+		se.Close()
+		return nil, err
+	}
 	self.shards[id] = db
 	self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+	if len(missing) > 0 {
+		// the reference keeps the shard open until it's indexed
+		self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+		go self.buildValueIndex(id, db, missing)
+	}
 	return db, nil
 }
 
+// Indexes the columns of the shard that weren't indexed yet without
+// holding up the other shards, reading all the points can take a while
+func (self *ShardDatastore) buildValueIndex(id uint32, db *Shard, missing map[string]bool) {
+	defer self.ReturnShard(id)
+	if err := db.buildValueIndex(missing); err != nil {
+		log.Error("Error indexing the values of shard %d: %s", id, err)
+	}
+}
+
 func (self *ShardDatastore) incrementShardRefCountAndCloseOldestIfNeeded(id uint32) {
 	self.shardRefCounts[id] += 1
 	delete(self.shardsToClose, id)
@@ -228,7 +360,40 @@ func (self *ShardDatastore) Write(request *protocol.Request) error {
 		return err
 	}
 	defer self.ReturnShard(*request.ShardId)
-	return shardDb.Write(*request.Database, request.MultiSeries)
+	policy := cluster.KEEP_DUPLICATE_POINTS
+	if self.duplicatePointPolicy != nil {
+		policy = self.duplicatePointPolicy(*request.Database)
+	}
+	written, rejected, err := shardDb.WriteWithPolicy(*request.Database, request.MultiSeries, policy)
+	if err != nil {
+		return err
+	}
+
+	self.pointCountsLock.Lock()
+	self.pointCounts[*request.ShardId] += int64(written)
+	if rejected > 0 {
+		self.rejectedPoints[*request.ShardId] += int64(rejected)
+	}
+	self.pointCountsLock.Unlock()
+	return nil
+}
+
+func (self *ShardDatastore) PointCounts() map[uint32]int64 {
+	self.pointCountsLock.Lock()
+	defer self.pointCountsLock.Unlock()
+	counts := make(map[uint32]int64, len(self.pointCounts))
+	for id, count := range self.pointCounts {
+		counts[id] = count
+	}
+	return counts
+}
+
+// Returns the stats of the read cache, nil if it's disabled
+func (self *ShardDatastore) ReadCacheStats() *cluster.ReadCacheStats {
+	if self.readCache == nil {
+		return nil
+	}
+	return self.readCache.stats()
 }
 
 func (self *ShardDatastore) BufferWrite(request *protocol.Request) {
@@ -239,22 +404,191 @@ func (self *ShardDatastore) SetWriteBuffer(writeBuffer *cluster.WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
 
+// Sets the function that returns what to do with the duplicate points
+// written to a database, they're kept if it's not set
+func (self *ShardDatastore) SetDuplicatePointPolicy(policy func(db string) cluster.DuplicatePointPolicy) {
+	self.duplicatePointPolicy = policy
+}
+
+// Sets the function that returns whether a database was dropped, the
+// writes to it are discarded. All of them are written if it's not set.
+func (self *ShardDatastore) SetDroppedDatabases(isDropped func(db string) bool) {
+	self.isDroppedDatabase = isDropped
+}
+
 func (self *ShardDatastore) DeleteShard(shardId uint32) error {
 	self.shardsLock.Lock()
 	shardDb := self.shards[shardId]
 	delete(self.shards, shardId)
 	delete(self.lastAccess, shardId)
+	self.droppedShards[shardId] = true
 	self.shardsLock.Unlock()
 
+	self.pointCountsLock.Lock()
+	delete(self.pointCounts, shardId)
+	delete(self.rejectedPoints, shardId)
+	self.pointCountsLock.Unlock()
+
+	self.compactionsLock.Lock()
+	delete(self.compactions, shardId)
+	self.compactionsLock.Unlock()
+
+	self.shardStatsLock.Lock()
+	delete(self.shardStats, shardId)
+	self.shardStatsLock.Unlock()
+
 	if shardDb != nil {
 		shardDb.close()
 	}
+	if self.readCache != nil {
+		self.readCache.invalidateShard(shardId)
+	}
 
 	dir := self.shardDir(shardId)
 	log.Info("DATASTORE: dropping shard %s", dir)
 	return os.RemoveAll(dir)
 }
 
+// Drops the data of the databases whose retention policy expired from
+// the local shards every interval. Shards that expired for all the
+// databases are dropped as a whole by the raft leader instead.
+func (self *ShardDatastore) StartRetentionSweeper(interval time.Duration, expiredDatabases func(time.Time) map[uint32][]string) {
+	self.expiredDatabases = make(map[uint32]map[string]bool)
+	go func() {
+		for _ = range time.Tick(interval) {
+			if self.IsClosed() {
+				return
+			}
+			self.dropExpiredDatabases(expiredDatabases(time.Now()))
+		}
+	}()
+}
+
+func (self *ShardDatastore) dropExpiredDatabases(expired map[uint32][]string) {
+	for id, dbs := range expired {
+		if _, err := os.Stat(self.shardDir(id)); os.IsNotExist(err) {
+			// the shard has no data on this server yet or was dropped
+			continue
+		}
+		dropped := self.expiredDatabases[id]
+		if dropped == nil {
+			var err error
+			if dropped, err = readExpiredDatabases(self.shardDir(id)); err != nil {
+				log.Error("DATASTORE: cannot read the expired databases of shard %d: %s", id, err)
+				continue
+			}
+			self.expiredDatabases[id] = dropped
+		}
+
+		changed := false
+		listed := make(map[string]bool, len(dbs))
+		for _, db := range dbs {
+			listed[db] = true
+			if dropped[db] {
+				continue
+			}
+			if err := self.dropShardDatabase(id, db); err != nil {
+				log.Error("DATASTORE: cannot drop expired data of %s from shard %d: %s", db, id, err)
+				continue
+			}
+			dropped[db] = true
+			changed = true
+		}
+
+		// a database that is dropped again after it was created again
+		// has to be dropped again
+		for db := range dropped {
+			if !listed[db] {
+				delete(dropped, db)
+				changed = true
+			}
+		}
+		if changed {
+			if err := writeExpiredDatabases(self.shardDir(id), dropped); err != nil {
+				log.Error("DATASTORE: cannot save the expired databases of shard %d: %s", id, err)
+			}
+		}
+	}
+
+	// forget about the shards that don't exist anymore
+	for id := range self.expiredDatabases {
+		if _, ok := expired[id]; !ok {
+			delete(self.expiredDatabases, id)
+		}
+	}
+}
+
+// Returns the databases the sweeper dropped from the shard, saved in
+// its directory
+func readExpiredDatabases(dir string) (map[string]bool, error) {
+	dropped := make(map[string]bool)
+	body, err := ioutil.ReadFile(filepath.Join(dir, EXPIRED_DATABASES_FILE))
+	if os.IsNotExist(err) {
+		return dropped, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range strings.Split(string(body), "\n") {
+		if db != "" {
+			dropped[db] = true
+		}
+	}
+	return dropped, nil
+}
+
+func writeExpiredDatabases(dir string, dropped map[string]bool) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// the shard was deleted meanwhile
+		return nil
+	}
+	dbs := make([]string, 0, len(dropped))
+	for db := range dropped {
+		dbs = append(dbs, db)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, EXPIRED_DATABASES_FILE), []byte(strings.Join(dbs, "\n")), 0644)
+}
+
+// Returns the delete markers saved in the directory of the shard
+func (self *ShardDatastore) DeleteMarkers(id uint32) ([]*cluster.DeleteMarker, error) {
+	markers := []*cluster.DeleteMarker{}
+	body, err := ioutil.ReadFile(filepath.Join(self.shardDir(id), DELETE_MARKERS_FILE))
+	if os.IsNotExist(err) {
+		return markers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &markers); err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+func (self *ShardDatastore) SaveDeleteMarkers(id uint32, markers []*cluster.DeleteMarker) error {
+	dir := self.shardDir(id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// the shard was deleted meanwhile
+		return nil
+	}
+	body, err := json.Marshal(markers)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, DELETE_MARKERS_FILE), body, 0644)
+}
+
+func (self *ShardDatastore) dropShardDatabase(id uint32, db string) error {
+	shard, err := self.GetShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+
+	log.Info("DATASTORE: dropping the data of %s from shard %d, it's expired or the database was dropped", db, id)
+	return shard.DropDatabase(db)
+}
+
 func (self *ShardDatastore) shardDir(id uint32) string {
 	return filepath.Join(self.baseDbDir, fmt.Sprintf("%.5d", id))
 }
@@ -1,8 +1,16 @@
 package datastore
 
 import (
+	"bytes"
+	"cluster"
 	"configuration"
+	"datastore/storage"
 	"os"
+	"protocol"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
 
 	. "launchpad.net/gocheck"
 )
@@ -39,3 +47,554 @@ func (self *ShardDatastoreSuite) TestWillEnforceMaxOpenShards(c *C) {
 	store.ReturnShard(uint32(2))
 	c.Assert(shard.IsClosed(), Equals, true)
 }
+
+func (self *ShardDatastoreSuite) TestUnknownDefaultEngine(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "foo"
+
+	_, err := NewShardDatastore(config)
+	c.Assert(err, ErrorMatches, "Engine 'foo' not found.*")
+}
+
+func (self *ShardDatastoreSuite) TestBackupAndRestore(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+	config.StorageWriteBatchSize = 1024
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	points := []*protocol.Point{}
+	for i := 0; i < 100; i++ {
+		points = append(points, &protocol.Point{
+			Timestamp:      proto.Int64(int64(i)),
+			SequenceNumber: proto.Uint64(1),
+			Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(int64(i))}},
+		})
+	}
+	err = store.Write(&protocol.Request{
+		Id:          proto.Uint32(1),
+		ShardId:     proto.Uint32(10),
+		Database:    proto.String("db"),
+		MultiSeries: []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: points}},
+	})
+	c.Assert(err, IsNil)
+
+	backup := bytes.NewBuffer(nil)
+	c.Assert(store.BackupShard(10, 0, backup), IsNil)
+	c.Assert(store.RestoreShard(11, bytes.NewReader(backup.Bytes())), IsNil)
+	restored := bytes.NewBuffer(nil)
+	c.Assert(store.BackupShard(11, 0, restored), IsNil)
+	c.Assert(restored.Bytes(), DeepEquals, backup.Bytes())
+
+	// shards that have data and truncated backups are rejected
+	c.Assert(store.RestoreShard(11, bytes.NewReader(backup.Bytes())), ErrorMatches, ".*has data")
+	c.Assert(store.RestoreShard(12, bytes.NewReader(backup.Bytes()[:backup.Len()-1])), ErrorMatches, ".*truncated")
+	oversized := append([]byte{}, backupHeader...)
+	oversized = append(oversized, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1)
+	c.Assert(store.RestoreShard(12, bytes.NewReader(oversized)), ErrorMatches, "Invalid shard backup.*")
+
+	// the keys written before the restore failed are deleted
+	c.Assert(store.RestoreShard(12, bytes.NewReader(backup.Bytes())), IsNil)
+}
+
+func (self *ShardDatastoreSuite) TestIncrementalBackup(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	write := func() {
+		err := store.Write(&protocol.Request{
+			Id:       proto.Uint32(1),
+			ShardId:  proto.Uint32(20),
+			Database: proto.String("db"),
+			MultiSeries: []*protocol.Series{{
+				Name:   proto.String("foo"),
+				Fields: []string{"value"},
+				Points: []*protocol.Point{{
+					Timestamp:      proto.Int64(1),
+					SequenceNumber: proto.Uint64(1),
+					Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(1)}},
+				}},
+			}},
+		})
+		c.Assert(err, IsNil)
+	}
+
+	write()
+	marker, err := store.ShardModificationMarker(20)
+	c.Assert(err, IsNil)
+	c.Assert(marker, Not(Equals), int64(0))
+	c.Assert(store.BackupShard(20, marker, bytes.NewBuffer(nil)), Equals, cluster.ShardNotModifiedError)
+
+	// the first write after a backup changes the marker
+	write()
+	c.Assert(store.BackupShard(20, marker, bytes.NewBuffer(nil)), IsNil)
+	newMarker, err := store.ShardModificationMarker(20)
+	c.Assert(err, IsNil)
+	c.Assert(newMarker, Not(Equals), marker)
+}
+
+func (self *ShardDatastoreSuite) TestReadCacheEvictsAndInvalidates(c *C) {
+	cache := newReadCache(2*(2+readCachePointOverhead), time.Minute)
+	loads := 0
+	load := func() ([]storage.Write, error) {
+		loads++
+		return []storage.Write{{Key: []byte{1}, Value: []byte{2}}}, nil
+	}
+
+	first := readCacheKey{1, "a", 0}
+	for i := 0; i < 2; i++ {
+		_, err := cache.get(first, load)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(loads, Equals, 1)
+
+	// the third window evicts the least recently used one
+	cache.get(readCacheKey{1, "a", 1}, load)
+	cache.get(first, load)
+	cache.get(readCacheKey{2, "a", 0}, load)
+	stats := cache.stats()
+	c.Assert(stats.Windows, Equals, 2)
+	c.Assert(stats.Evictions, Equals, int64(1))
+	c.Assert(stats.Hits, Equals, int64(2))
+
+	cache.invalidateShard(1)
+	cache.get(first, load)
+	c.Assert(loads, Equals, 4)
+}
+
+func (self *ShardDatastoreSuite) TestCompactionWindow(c *C) {
+	at := func(hour int) time.Time {
+		return time.Date(2014, 6, 1, hour, 0, 0, 0, time.Local)
+	}
+	c.Assert(inCompactionWindow(at(3), 2*time.Hour, 5*time.Hour), Equals, true)
+	c.Assert(inCompactionWindow(at(5), 2*time.Hour, 5*time.Hour), Equals, false)
+	// the window wraps around midnight
+	c.Assert(inCompactionWindow(at(1), 22*time.Hour, 2*time.Hour), Equals, true)
+	c.Assert(inCompactionWindow(at(12), 22*time.Hour, 2*time.Hour), Equals, false)
+	c.Assert(inCompactionWindow(at(12), 0, 0), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestUnknownAndDroppedShardsAreNotCompacted(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	c.Assert(store.CompactShard(50), ErrorMatches, "Shard 50 doesn't exist on this server")
+	_, err = os.Stat(store.shardDir(50))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = store.GetOrCreateShard(51)
+	c.Assert(err, IsNil)
+	store.ReturnShard(51)
+	c.Assert(store.CompactShard(51), IsNil)
+	c.Assert(store.DeleteShard(51), IsNil)
+	c.Assert(store.CompactShard(51), ErrorMatches, "Shard 51 doesn't exist on this server")
+	_, err = os.Stat(store.shardDir(51))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestShardStats(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	err = store.Write(&protocol.Request{
+		Id:       proto.Uint32(1),
+		ShardId:  proto.Uint32(30),
+		Database: proto.String("db"),
+		MultiSeries: []*protocol.Series{{
+			Name:   proto.String("foo"),
+			Fields: []string{"value", "other"},
+			Points: []*protocol.Point{
+				{
+					Timestamp:      proto.Int64(1000000),
+					SequenceNumber: proto.Uint64(1),
+					Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(1)}, {Int64Value: proto.Int64(2)}},
+				},
+				{
+					Timestamp:      proto.Int64(3000000),
+					SequenceNumber: proto.Uint64(2),
+					Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(1)}, {Int64Value: proto.Int64(2)}},
+				},
+			},
+		}},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(store.scanShard(30), IsNil)
+	stats := store.ShardStats()[30]
+	c.Assert(stats, NotNil)
+	c.Assert(stats.Points, Equals, int64(2))
+	c.Assert(stats.Series, Equals, 1)
+	c.Assert(*stats.FirstPointTime, Equals, int64(1))
+	c.Assert(*stats.LastPointTime, Equals, int64(3))
+	c.Assert(stats.Size > 0, Equals, true)
+
+	// the dropped shards aren't opened again to be scanned
+	c.Assert(store.DeleteShard(30), IsNil)
+	c.Assert(store.scanShard(30), ErrorMatches, "Shard 30 doesn't exist on this server")
+	c.Assert(store.ShardStats()[30], IsNil)
+	_, err = os.Stat(store.shardDir(30))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestValueIndex(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	write := func(store *ShardDatastore, series, host string) {
+		err := store.Write(&protocol.Request{
+			Id:       proto.Uint32(1),
+			ShardId:  proto.Uint32(40),
+			Database: proto.String("db"),
+			MultiSeries: []*protocol.Series{{
+				Name:   proto.String(series),
+				Fields: []string{"host", "value"},
+				Points: []*protocol.Point{{
+					Timestamp:      proto.Int64(1000000),
+					SequenceNumber: proto.Uint64(1),
+					Values:         []*protocol.FieldValue{{StringValue: proto.String(host)}, {Int64Value: proto.Int64(1)}},
+				}},
+			}},
+		})
+		c.Assert(err, IsNil)
+	}
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	write(store, "cpu.a", "web01")
+	write(store, "cpu.b", "web02")
+	store.Close()
+
+	// the points written before the column was indexed are indexed
+	// in the background when the shard is opened
+	config.StorageIndexedColumns = []string{"host"}
+	store, err = NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	shard, err := store.GetOrCreateShard(40)
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(40)
+	for i := 0; i < 100 && !shard.(*Shard).isColumnIndexed("host"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(shard.(*Shard).isColumnIndexed("host"), Equals, true)
+	series, err := shard.(*Shard).seriesWithValue("db", "host", "web01")
+	c.Assert(err, IsNil)
+	c.Assert(series, DeepEquals, map[string]bool{"cpu.a": true})
+
+	write(store, "cpu.c", "web01")
+	series, err = shard.(*Shard).seriesWithValue("db", "host", "web01")
+	c.Assert(err, IsNil)
+	c.Assert(series, DeepEquals, map[string]bool{"cpu.a": true, "cpu.c": true})
+}
+
+func (self *ShardDatastoreSuite) TestDuplicatePointPolicies(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	policy := cluster.KEEP_DUPLICATE_POINTS
+	store.SetDuplicatePointPolicy(func(string) cluster.DuplicatePointPolicy { return policy })
+	for i, test := range []struct {
+		policy cluster.DuplicatePointPolicy
+		points int64
+	}{
+		{cluster.KEEP_DUPLICATE_POINTS, 3},
+		{cluster.OVERWRITE_DUPLICATE_POINTS, 1},
+		{cluster.REJECT_DUPLICATE_POINTS, 1},
+	} {
+		policy = test.policy
+		id := uint32(80 + i)
+		// a write retried with two points at the same time
+		for sequence := uint64(1); sequence <= 2; sequence++ {
+			points := []*protocol.Point{}
+			for j := uint64(0); j < sequence; j++ {
+				points = append(points, &protocol.Point{
+					Timestamp:      proto.Int64(1000000),
+					SequenceNumber: proto.Uint64(sequence*10 + j),
+					Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(int64(sequence))}},
+				})
+			}
+			err := store.Write(&protocol.Request{
+				Id:          proto.Uint32(1),
+				ShardId:     proto.Uint32(id),
+				Database:    proto.String("db"),
+				MultiSeries: []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: points}},
+			})
+			c.Assert(err, IsNil)
+		}
+
+		c.Assert(store.scanShard(id), IsNil)
+		c.Assert(store.ShardStats()[id].Points, Equals, test.points, Commentf("policy %s", policy))
+	}
+}
+
+func (self *ShardDatastoreSuite) TestConcurrentDuplicatePointsAreRejected(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	store.SetDuplicatePointPolicy(func(string) cluster.DuplicatePointPolicy { return cluster.REJECT_DUPLICATE_POINTS })
+
+	write := func(timestamp int64, sequence uint64) error {
+		return store.Write(&protocol.Request{
+			Id:       proto.Uint32(1),
+			ShardId:  proto.Uint32(85),
+			Database: proto.String("db"),
+			MultiSeries: []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{{
+				Timestamp:      proto.Int64(timestamp),
+				SequenceNumber: proto.Uint64(sequence),
+				Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(1)}},
+			}}}},
+		})
+	}
+	c.Assert(write(0, 1), IsNil)
+
+	// the points retried by many writers at once are written once
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(sequence uint64) {
+			defer wg.Done()
+			<-start
+			for timestamp := int64(1); timestamp <= 100; timestamp++ {
+				c.Check(write(timestamp*1000000, sequence), IsNil)
+			}
+		}(uint64(i + 1))
+	}
+	close(start)
+	wg.Wait()
+
+	c.Assert(store.scanShard(85), IsNil)
+	c.Assert(store.ShardStats()[85].Points, Equals, int64(101))
+}
+
+func (self *ShardDatastoreSuite) TestDroppedDatabases(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	dropped := map[string]bool{}
+	store.SetDroppedDatabases(func(db string) bool { return dropped[db] })
+	store.expiredDatabases = make(map[uint32]map[string]bool)
+	write := func(timestamp int64) {
+		err := store.Write(&protocol.Request{
+			Id:       proto.Uint32(1),
+			ShardId:  proto.Uint32(60),
+			Database: proto.String("db"),
+			MultiSeries: []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{{
+				Timestamp:      proto.Int64(timestamp),
+				SequenceNumber: proto.Uint64(1),
+				Values:         []*protocol.FieldValue{{Int64Value: proto.Int64(1)}},
+			}}}},
+		})
+		c.Assert(err, IsNil)
+	}
+	points := func() int64 {
+		c.Assert(store.scanShard(60), IsNil)
+		return store.ShardStats()[60].Points
+	}
+
+	write(1000000)
+	c.Assert(points(), Equals, int64(1))
+	dropped["db"] = true
+	store.dropExpiredDatabases(map[uint32][]string{60: {"db"}})
+	c.Assert(points(), Equals, int64(0))
+	// the writes that come after the drop, e.g. replayed from the wal,
+	// are discarded
+	write(2000000)
+	c.Assert(points(), Equals, int64(0))
+
+	// the shard isn't opened to drop the database again after a restart
+	store.Close()
+	store, err = NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	store.expiredDatabases = make(map[uint32]map[string]bool)
+	store.dropExpiredDatabases(map[uint32][]string{60: {"db"}})
+	c.Assert(store.shards[60], IsNil)
+	c.Assert(store.expiredDatabases[60], DeepEquals, map[string]bool{"db": true})
+
+	// it's dropped again once it was created again
+	store.dropExpiredDatabases(map[uint32][]string{60: {}})
+	expired, err := readExpiredDatabases(store.shardDir(60))
+	c.Assert(err, IsNil)
+	c.Assert(expired, HasLen, 0)
+
+	// the shards that don't exist on this server aren't created
+	store.dropExpiredDatabases(map[uint32][]string{61: {"db"}})
+	c.Assert(store.shards[61], IsNil)
+	_, err = os.Stat(store.shardDir(61))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestDeleteMarkersAreSavedWithTheShard(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	markers, err := store.DeleteMarkers(90)
+	c.Assert(err, IsNil)
+	c.Assert(markers, HasLen, 0)
+
+	_, err = store.GetOrCreateShard(90)
+	c.Assert(err, IsNil)
+	store.ReturnShard(90)
+	saved := []*cluster.DeleteMarker{{Database: "db", Regexes: []string{"^cpu"}, Start: 10, End: 20, Time: 1400000000}}
+	c.Assert(store.SaveDeleteMarkers(90, saved), IsNil)
+	// the markers of the shards that don't exist aren't saved
+	c.Assert(store.SaveDeleteMarkers(91, saved), IsNil)
+	store.Close()
+
+	store, err = NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	markers, err = store.DeleteMarkers(90)
+	c.Assert(err, IsNil)
+	c.Assert(markers, DeepEquals, saved)
+	_, err = os.Stat(store.shardDir(91))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *ShardDatastoreSuite) TestFieldTypePolicies(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	series := func(start int64, values ...*protocol.FieldValue) []*protocol.Series {
+		points := []*protocol.Point{}
+		for i, value := range values {
+			points = append(points, &protocol.Point{
+				Timestamp:      proto.Int64((start + int64(i)) * 1000000),
+				SequenceNumber: proto.Uint64(1),
+				Values:         []*protocol.FieldValue{value},
+			})
+		}
+		return []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: points}}
+	}
+
+	for i, test := range []struct {
+		policy string
+		points int64
+	}{
+		{STORE_MISMATCHED_FIELDS, 3},
+		{COERCE_MISMATCHED_FIELDS, 2},
+		{REJECT_MISMATCHED_FIELDS, 1},
+	} {
+		config.StorageFieldTypeMismatch = test.policy
+		id := uint32(60 + i)
+		shard, err := store.GetOrCreateShard(id)
+		c.Assert(err, IsNil)
+
+		c.Assert(shard.Write("db", series(1, &protocol.FieldValue{Int64Value: proto.Int64(1)})), IsNil)
+		mismatched := series(2, &protocol.FieldValue{StringValue: proto.String("2")}, &protocol.FieldValue{StringValue: proto.String("three")})
+		err = shard.(*Shard).CheckFieldTypes("db", mismatched)
+		if test.policy == STORE_MISMATCHED_FIELDS {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, "Column value of series foo has number values, the point has a string value")
+		}
+		c.Assert(shard.Write("db", mismatched), IsNil)
+		store.ReturnShard(id)
+
+		c.Assert(store.scanShard(id), IsNil)
+		c.Assert(store.ShardStats()[id].Points, Equals, test.points, Commentf("policy %s", test.policy))
+	}
+}
+
+func (self *ShardDatastoreSuite) TestFieldTypesAreKeptAcrossShards(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageDefaultEngine = "leveldb"
+	config.StorageFieldTypeMismatch = REJECT_MISMATCHED_FIELDS
+
+	store, err := NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	dropped := map[string]bool{}
+	store.SetDroppedDatabases(func(db string) bool { return dropped[db] })
+	series := func(value *protocol.FieldValue) []*protocol.Series {
+		return []*protocol.Series{{Name: proto.String("foo"), Fields: []string{"value"}, Points: []*protocol.Point{{
+			Timestamp:      proto.Int64(1000000),
+			SequenceNumber: proto.Uint64(1),
+			Values:         []*protocol.FieldValue{value},
+		}}}}
+	}
+	check := func(id uint32) error {
+		shard, err := store.GetOrCreateShard(id)
+		c.Assert(err, IsNil)
+		defer store.ReturnShard(id)
+		return shard.(*Shard).CheckFieldTypes("types", series(&protocol.FieldValue{StringValue: proto.String("foo")}))
+	}
+
+	c.Assert(store.Write(&protocol.Request{
+		Id:          proto.Uint32(1),
+		ShardId:     proto.Uint32(70),
+		Database:    proto.String("types"),
+		MultiSeries: series(&protocol.FieldValue{Int64Value: proto.Int64(1)}),
+	}), IsNil)
+	c.Assert(check(71), ErrorMatches, "Column value of series foo has number values, the point has a string value")
+
+	// the logged writes aren't failed, their rejected points are counted
+	c.Assert(store.Write(&protocol.Request{
+		Id:          proto.Uint32(2),
+		ShardId:     proto.Uint32(71),
+		Database:    proto.String("types"),
+		MultiSeries: series(&protocol.FieldValue{StringValue: proto.String("foo")}),
+	}), IsNil)
+	c.Assert(store.scanShard(71), IsNil)
+	stats := store.ShardStats()[71]
+	c.Assert(stats.Points, Equals, int64(0))
+	c.Assert(stats.RejectedPoints, Equals, int64(1))
+
+	// the types are kept after a restart
+	store.Close()
+	store, err = NewShardDatastore(config)
+	c.Assert(err, IsNil)
+	defer store.Close()
+	store.SetDroppedDatabases(func(db string) bool { return dropped[db] })
+	store.expiredDatabases = make(map[uint32]map[string]bool)
+	c.Assert(check(72), NotNil)
+
+	// the expired data of a database doesn't change the types, dropping
+	// the database does
+	store.dropExpiredDatabases(map[uint32][]string{70: {"types"}})
+	c.Assert(check(72), NotNil)
+	dropped["types"] = true
+	store.dropExpiredDatabases(map[uint32][]string{71: {"types"}})
+	c.Assert(check(72), IsNil)
+}
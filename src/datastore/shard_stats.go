@@ -0,0 +1,184 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// Scans the local shards every interval to count their points and
+// series. The scans read all the data of the shards, so the counts are
+// only kept up to date by adding the points written since the last scan
+// in between.
+func (self *ShardDatastore) StartShardStatsCollector(interval time.Duration) {
+	if interval == 0 {
+		return
+	}
+	go func() {
+		self.scanShards()
+		for _ = range time.Tick(interval) {
+			if self.IsClosed() {
+				return
+			}
+			self.scanShards()
+		}
+	}()
+}
+
+func (self *ShardDatastore) scanShards() {
+	ids, err := self.localShardIds()
+	if err != nil {
+		log.Error("DATASTORE: cannot list the local shards to scan them: %s", err)
+		return
+	}
+	for _, id := range ids {
+		if self.IsClosed() {
+			return
+		}
+		if err := self.scanShard(id); err != nil {
+			log.Error("DATASTORE: cannot scan shard %d: %s", id, err)
+		}
+	}
+}
+
+func (self *ShardDatastore) scanShard(id uint32) error {
+	shardDb, err := self.GetShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+
+	// the points written during the scan may be counted twice
+	self.pointCountsLock.Lock()
+	written := self.pointCounts[id]
+	self.pointCountsLock.Unlock()
+	stats, err := shardDb.(*Shard).scanStats()
+	if err != nil {
+		return err
+	}
+
+	// the shard might have been dropped during the scan
+	self.shardsLock.RLock()
+	dropped := self.droppedShards[id]
+	self.shardsLock.RUnlock()
+	if dropped {
+		return nil
+	}
+	self.shardStatsLock.Lock()
+	self.shardStats[id] = &scannedShardStats{stats, written}
+	self.shardStatsLock.Unlock()
+	return nil
+}
+
+// The stats of a shard as of its last scan
+type scannedShardStats struct {
+	stats *cluster.LocalShardStats
+	// the points written to the shard since startup when it was
+	// scanned
+	pointsWritten int64
+}
+
+// Returns the stats of the shards stored on this server, the shards
+// that weren't scanned yet only have their size set
+func (self *ShardDatastore) ShardStats() map[uint32]*cluster.LocalShardStats {
+	ids, err := self.localShardIds()
+	if err != nil {
+		log.Error("DATASTORE: cannot list the local shards: %s", err)
+		return nil
+	}
+	pointCounts := self.PointCounts()
+	self.pointCountsLock.Lock()
+	rejectedPoints := make(map[uint32]int64, len(self.rejectedPoints))
+	for id, rejected := range self.rejectedPoints {
+		rejectedPoints[id] = rejected
+	}
+	self.pointCountsLock.Unlock()
+
+	self.shardStatsLock.Lock()
+	defer self.shardStatsLock.Unlock()
+	result := make(map[uint32]*cluster.LocalShardStats, len(ids))
+	for _, id := range ids {
+		stats := &cluster.LocalShardStats{}
+		if scanned := self.shardStats[id]; scanned != nil {
+			*stats = *scanned.stats
+			stats.Points += pointCounts[id] - scanned.pointsWritten
+		}
+		stats.RejectedPoints = rejectedPoints[id]
+		if stats.Size, err = dirSize(self.shardDir(id)); err != nil {
+			// the shard was dropped
+			continue
+		}
+		result[id] = stats
+	}
+	return result
+}
+
+// Counts the points and series of the shard from a snapshot. A point is
+// stored as one key per column, so the number of points of a series is
+// the number of values of its column that has the most.
+func (self *Shard) scanStats() (*cluster.LocalShardStats, error) {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	stats := &cluster.LocalShardStats{ScannedAt: time.Now()}
+	values := map[string]int64{}
+	first, last := uint64(math.MaxUint64), uint64(0)
+	// the points come before the value index, the persistent integers
+	// and the other indexes
+	for it.Seek([]byte{}); it.Valid(); it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, INDEXED_COLUMNS_KEY) >= 0 {
+			break
+		}
+		if len(key) != 24 {
+			continue
+		}
+		values[string(key[:8])]++
+		timestamp := binary.BigEndian.Uint64(key[8:16])
+		if timestamp < first {
+			first = timestamp
+		}
+		if timestamp > last {
+			last = timestamp
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if len(values) > 0 {
+		stats.FirstPointTime = self.timeInSeconds(first)
+		stats.LastPointTime = self.timeInSeconds(last)
+	}
+
+	// the indexes map the columns to their series
+	points := map[string]int64{}
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if bytes.HasPrefix(key, DATABASE_SERIES_INDEX_PREFIX) {
+			stats.Series++
+			continue
+		}
+		if !bytes.HasPrefix(key, SERIES_COLUMN_INDEX_PREFIX) {
+			continue
+		}
+		column := string(key[len(SERIES_COLUMN_INDEX_PREFIX):])
+		series := column[:strings.LastIndex(column, "~")+1]
+		if count := values[string(it.Value())]; count > points[series] {
+			points[series] = count
+		}
+	}
+	for _, count := range points {
+		stats.Points += count
+	}
+	return stats, it.Error()
+}
+
+func (self *Shard) timeInSeconds(t uint64) *int64 {
+	seconds := self.convertUintTimestampToInt64(&t) / int64(time.Second/time.Microsecond)
+	return &seconds
+}
@@ -15,7 +15,7 @@ import (
 const HYPERLEVELDB_NAME = "hyperleveldb"
 
 func init() {
-	registerEngine(HYPERLEVELDB_NAME, Initializer{
+	RegisterEngine(HYPERLEVELDB_NAME, Initializer{
 		NewHyperlevelDBConfig,
 		NewHyperlevelDB,
 	})
@@ -24,14 +24,22 @@ func init() {
 type HyperlevelDBConfiguration struct {
 	MaxOpenFiles int                `toml:"max-open-files"`
 	LruCacheSize configuration.Size `toml:"lru-cache-size"`
+	// the engine's defaults are used for the settings below if they
+	// aren't set
+	WriteBufferSize configuration.Size `toml:"write-buffer-size"`
+	BlockSize       configuration.Size `toml:"block-size"`
+	// the bits per key of the bloom filter, which saves disk reads
+	// when looking up keys that don't exist. No filter is used if 0.
+	BloomFilterBits int `toml:"bloom-filter-bits"`
 }
 
 type HyperlevelDB struct {
-	db    *hyperleveldb.DB
-	opts  *hyperleveldb.Options
-	wopts *hyperleveldb.WriteOptions
-	ropts *hyperleveldb.ReadOptions
-	path  string
+	db     *hyperleveldb.DB
+	opts   *hyperleveldb.Options
+	wopts  *hyperleveldb.WriteOptions
+	ropts  *hyperleveldb.ReadOptions
+	filter *hyperleveldb.FilterPolicy
+	path   string
 }
 
 func NewHyperlevelDBConfig() interface{} {
@@ -70,10 +78,21 @@ func NewHyperlevelDB(path string, config interface{}) (Engine, error) {
 	opts.SetCache(hyperlevelDBCache)
 	opts.SetCreateIfMissing(true)
 	opts.SetMaxOpenFiles(c.MaxOpenFiles)
+	if c.WriteBufferSize > 0 {
+		opts.SetWriteBufferSize(int(c.WriteBufferSize))
+	}
+	if c.BlockSize > 0 {
+		opts.SetBlockSize(int(c.BlockSize))
+	}
+	var filter *hyperleveldb.FilterPolicy
+	if c.BloomFilterBits > 0 {
+		filter = hyperleveldb.NewBloomFilter(c.BloomFilterBits)
+		opts.SetFilterPolicy(filter)
+	}
 	db, err := hyperleveldb.Open(path, opts)
 	wopts := hyperleveldb.NewWriteOptions()
 	ropts := hyperleveldb.NewReadOptions()
-	return HyperlevelDB{db, opts, wopts, ropts, path}, err
+	return HyperlevelDB{db, opts, wopts, ropts, filter, path}, err
 }
 
 func (db HyperlevelDB) Compact() {
@@ -85,6 +104,9 @@ func (db HyperlevelDB) Close() {
 	db.wopts.Close()
 	db.opts.Close()
 	db.db.Close()
+	if db.filter != nil {
+		db.filter.Close()
+	}
 }
 
 func (db HyperlevelDB) Put(key, value []byte) error {
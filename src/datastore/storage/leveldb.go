@@ -13,7 +13,7 @@ import (
 const LEVELDB_NAME = "leveldb"
 
 func init() {
-	registerEngine(LEVELDB_NAME, Initializer{
+	RegisterEngine(LEVELDB_NAME, Initializer{
 		NewLevelDBConfig,
 		NewLevelDB,
 	})
@@ -22,14 +22,22 @@ func init() {
 type LevelDbConfiguration struct {
 	MaxOpenFiles int                `toml:"max-open-files"`
 	LruCacheSize configuration.Size `toml:"lru-cache-size"`
+	// the engine's defaults are used for the settings below if they
+	// aren't set
+	WriteBufferSize configuration.Size `toml:"write-buffer-size"`
+	BlockSize       configuration.Size `toml:"block-size"`
+	// the bits per key of the bloom filter, which saves disk reads
+	// when looking up keys that don't exist. No filter is used if 0.
+	BloomFilterBits int `toml:"bloom-filter-bits"`
 }
 
 type LevelDB struct {
-	db    *levigo.DB
-	opts  *levigo.Options
-	wopts *levigo.WriteOptions
-	ropts *levigo.ReadOptions
-	path  string
+	db     *levigo.DB
+	opts   *levigo.Options
+	wopts  *levigo.WriteOptions
+	ropts  *levigo.ReadOptions
+	filter *levigo.FilterPolicy
+	path   string
 }
 
 func NewLevelDBConfig() interface{} {
@@ -68,10 +76,21 @@ func NewLevelDB(path string, config interface{}) (Engine, error) {
 	opts.SetCache(cache)
 	opts.SetCreateIfMissing(true)
 	opts.SetMaxOpenFiles(c.MaxOpenFiles)
+	if c.WriteBufferSize > 0 {
+		opts.SetWriteBufferSize(int(c.WriteBufferSize))
+	}
+	if c.BlockSize > 0 {
+		opts.SetBlockSize(int(c.BlockSize))
+	}
+	var filter *levigo.FilterPolicy
+	if c.BloomFilterBits > 0 {
+		filter = levigo.NewBloomFilter(c.BloomFilterBits)
+		opts.SetFilterPolicy(filter)
+	}
 	db, err := levigo.Open(path, opts)
 	wopts := levigo.NewWriteOptions()
 	ropts := levigo.NewReadOptions()
-	return LevelDB{db, opts, wopts, ropts, path}, err
+	return LevelDB{db, opts, wopts, ropts, filter, path}, err
 }
 
 func (db LevelDB) Compact() {
@@ -83,6 +102,9 @@ func (db LevelDB) Close() {
 	db.wopts.Close()
 	db.opts.Close()
 	db.db.Close()
+	if db.filter != nil {
+		db.filter.Close()
+	}
 }
 
 func (db LevelDB) Put(key, value []byte) error {
@@ -12,7 +12,7 @@ import (
 const MDB_NAME = "lmdb"
 
 func init() {
-	registerEngine(MDB_NAME, Initializer{
+	RegisterEngine(MDB_NAME, Initializer{
 		NewMDBConfiguration,
 		NewMDB,
 	})
@@ -1,15 +1,24 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
 var engineRegistry = make(map[string]Initializer)
 
+// Creates the engines of a type, NewConfig returns the configuration
+// that's decoded from the [storage.engines.<name>] section of the
+// config file and passed to Initialize
 type Initializer struct {
 	NewConfig  func() interface{}
 	Initialize func(path string, config interface{}) (Engine, error)
 }
 
-func registerEngine(name string, init Initializer) {
+// Makes an engine available to the datastore, the engines of other
+// packages are registered in their init function and selected with
+// the default-engine setting
+func RegisterEngine(name string, init Initializer) {
 	if _, ok := engineRegistry[name]; ok {
 		panic(fmt.Errorf("Engine '%s' already exists", name))
 	}
@@ -24,3 +33,13 @@ func GetInitializer(name string) (Initializer, error) {
 
 	return initializer, nil
 }
+
+// Returns the names of the registered engines
+func Engines() []string {
+	names := make([]string, 0, len(engineRegistry))
+	for name := range engineRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -16,7 +16,7 @@ import (
 const ROCKSDB_NAME = "rocksdb"
 
 func init() {
-	registerEngine(ROCKSDB_NAME, Initializer{
+	RegisterEngine(ROCKSDB_NAME, Initializer{
 		NewRocksDBConfig,
 		NewRocksDB,
 	})
@@ -25,14 +25,22 @@ func init() {
 type RocksDBConfiguration struct {
 	MaxOpenFiles int                `toml:"max-open-files"`
 	LruCacheSize configuration.Size `toml:"lru-cache-size"`
+	// the engine's defaults are used for the settings below if they
+	// aren't set
+	WriteBufferSize configuration.Size `toml:"write-buffer-size"`
+	BlockSize       configuration.Size `toml:"block-size"`
+	// the bits per key of the bloom filter, which saves disk reads
+	// when looking up keys that don't exist. No filter is used if 0.
+	BloomFilterBits int `toml:"bloom-filter-bits"`
 }
 
 type RocksDB struct {
-	db    *rocksdb.DB
-	opts  *rocksdb.Options
-	wopts *rocksdb.WriteOptions
-	ropts *rocksdb.ReadOptions
-	path  string
+	db     *rocksdb.DB
+	opts   *rocksdb.Options
+	wopts  *rocksdb.WriteOptions
+	ropts  *rocksdb.ReadOptions
+	filter *rocksdb.FilterPolicy
+	path   string
 }
 
 func NewRocksDBConfig() interface{} {
@@ -77,10 +85,21 @@ func NewRocksDB(path string, config interface{}) (Engine, error) {
 	opts.SetCache(rocksDBCache)
 	opts.SetCreateIfMissing(true)
 	opts.SetMaxOpenFiles(c.MaxOpenFiles)
+	if c.WriteBufferSize > 0 {
+		opts.SetWriteBufferSize(int(c.WriteBufferSize))
+	}
+	if c.BlockSize > 0 {
+		opts.SetBlockSize(int(c.BlockSize))
+	}
+	var filter *rocksdb.FilterPolicy
+	if c.BloomFilterBits > 0 {
+		filter = rocksdb.NewBloomFilter(c.BloomFilterBits)
+		opts.SetFilterPolicy(filter)
+	}
 	db, err := rocksdb.Open(path, opts)
 	wopts := rocksdb.NewWriteOptions()
 	ropts := rocksdb.NewReadOptions()
-	return RocksDB{db, opts, wopts, ropts, path}, err
+	return RocksDB{db, opts, wopts, ropts, filter, path}, err
 }
 
 func (db RocksDB) Compact() {
@@ -92,6 +111,9 @@ func (db RocksDB) Close() {
 	db.wopts.Close()
 	db.opts.Close()
 	db.db.Close()
+	if db.filter != nil {
+		db.filter.Close()
+	}
 }
 
 func (db RocksDB) Put(key, value []byte) error {
@@ -0,0 +1,295 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"parser"
+	"protocol"
+	"strings"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+// The value index maps the string values of the indexed columns to the
+// series that have them, so the queries that filter on them, e.g.
+// where host = 'web01', only read the series that can match. It's
+// updated on every write and built in the background from the points
+// of the shard when it's opened with columns that weren't indexed
+// before, the queries don't use it for them until it's done. The entries of
+// deleted points are kept, so the index can list series that don't
+// have the value anymore, the points are still filtered by the where
+// clause.
+
+const VALUE_INDEX_SEPARATOR = "\x00"
+
+var (
+	// INDEXED_COLUMNS_KEY holds the columns the value index is complete
+	// for, separated by VALUE_INDEX_SEPARATOR
+	INDEXED_COLUMNS_KEY = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFB}
+	// VALUE_INDEX_PREFIX is the prefix of the value index, followed by
+	// the database, column, value and series separated by
+	// VALUE_INDEX_SEPARATOR
+	VALUE_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}
+)
+
+func valueIndexKey(database, column, value, series string) []byte {
+	return append(append(VALUE_INDEX_PREFIX, database+VALUE_INDEX_SEPARATOR+column+VALUE_INDEX_SEPARATOR+value+VALUE_INDEX_SEPARATOR...), series...)
+}
+
+// values with the separator can't be told apart from the series names
+// in the keys, they aren't indexed
+func isIndexableValue(value *protocol.FieldValue) bool {
+	return value != nil && value.StringValue != nil && !strings.Contains(*value.StringValue, VALUE_INDEX_SEPARATOR)
+}
+
+// Returns the writes that add the values of the indexed columns of the
+// series to the index
+func (self *Shard) valueIndexWrites(database string, series *protocol.Series) []storage.Write {
+	wb := []storage.Write{}
+	for fieldIndex, field := range series.Fields {
+		if !self.indexedColumns[field] {
+			continue
+		}
+		values := map[string]bool{}
+		for _, point := range series.Points {
+			if value := point.Values[fieldIndex]; isIndexableValue(value) && !values[*value.StringValue] {
+				values[*value.StringValue] = true
+				wb = append(wb, storage.Write{valueIndexKey(database, field, *value.StringValue, *series.Name), []byte{}})
+			}
+		}
+	}
+	return wb
+}
+
+// Returns the series of the database that have the value in the column
+func (self *Shard) seriesWithValue(database, column, value string) (map[string]bool, error) {
+	prefix := valueIndexKey(database, column, value, "")
+	itr := self.db.Iterator()
+	defer itr.Close()
+
+	series := map[string]bool{}
+	for itr.Seek(prefix); itr.Valid(); itr.Next() {
+		key := itr.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		series[string(key[len(prefix):])] = true
+	}
+	return series, itr.Error()
+}
+
+// Returns the series that can match the conditions on the indexed
+// columns the where clause of the query requires, false if it doesn't
+// require any and all the series have to be read
+func (self *Shard) seriesForIndexedConditions(querySpec *parser.QuerySpec) (map[string]bool, bool, error) {
+	query := querySpec.SelectQuery()
+	if len(self.indexedColumns) == 0 || query == nil || query.GetFromClause().Type != parser.FromClauseArray {
+		return nil, false, nil
+	}
+
+	var result map[string]bool
+	for _, condition := range requiredEqualities(query.GetWhereCondition()) {
+		if !self.isColumnIndexed(condition[0]) {
+			continue
+		}
+		series, err := self.seriesWithValue(querySpec.Database(), condition[0], condition[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if result != nil {
+			for name := range result {
+				if !series[name] {
+					delete(result, name)
+				}
+			}
+		} else {
+			result = series
+		}
+	}
+	return result, result != nil, nil
+}
+
+// Returns the column and value of the equalities of a column with a
+// string that the condition requires, i.e. the ones that aren't under
+// an OR
+func requiredEqualities(condition *parser.WhereCondition) [][2]string {
+	if condition == nil {
+		return nil
+	}
+	if expr, ok := condition.GetBoolExpression(); ok {
+		if expr.Type != parser.ValueExpression || expr.Name != "=" || len(expr.Elems) != 2 {
+			return nil
+		}
+		column, value := expr.Elems[0], expr.Elems[1]
+		if column.Type == parser.ValueString {
+			column, value = value, column
+		}
+		if column.Type != parser.ValueSimpleName || value.Type != parser.ValueString || strings.Contains(value.Name, VALUE_INDEX_SEPARATOR) {
+			return nil
+		}
+		return [][2]string{{column.Name, value.Name}}
+	}
+	if condition.Operation != "AND" {
+		return nil
+	}
+	left, _ := condition.GetLeftWhereCondition()
+	return append(requiredEqualities(left), requiredEqualities(condition.Right)...)
+}
+
+// Reads the columns the index is complete for and returns the indexed
+// columns that weren't indexed when the shard was last opened, the
+// points written before they were configured aren't in the index yet
+func (self *Shard) loadValueIndex() (map[string]bool, error) {
+	indexed := map[string]bool{}
+	value, err := self.db.Get(INDEXED_COLUMNS_KEY)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > 0 {
+		for _, column := range strings.Split(string(value), VALUE_INDEX_SEPARATOR) {
+			indexed[column] = true
+		}
+	}
+
+	complete := map[string]bool{}
+	missing := map[string]bool{}
+	for column := range self.indexedColumns {
+		if indexed[column] {
+			complete[column] = true
+		} else {
+			missing[column] = true
+		}
+	}
+	self.completeColumnsLock.Lock()
+	self.completeColumns = complete
+	self.completeColumnsLock.Unlock()
+
+	// the columns that aren't configured anymore aren't kept up to date
+	if len(missing) == 0 && len(complete) != len(indexed) {
+		return missing, self.saveIndexedColumns()
+	}
+	return missing, nil
+}
+
+// Indexes the values of the missing columns, the queries use the index
+// for them once it's done
+func (self *Shard) buildValueIndex(missing map[string]bool) error {
+	if err := self.marker.modify(); err != nil {
+		return err
+	}
+	defer self.marker.done()
+
+	start := time.Now()
+	if err := self.indexValues(missing); err != nil {
+		return err
+	}
+	if err := self.saveIndexedColumns(); err != nil {
+		return err
+	}
+	log.Info("DATASTORE: indexed the values of %d columns of shard %d in %s", len(missing), self.id, time.Now().Sub(start))
+
+	self.completeColumnsLock.Lock()
+	defer self.completeColumnsLock.Unlock()
+	for column := range missing {
+		self.completeColumns[column] = true
+	}
+	return nil
+}
+
+func (self *Shard) saveIndexedColumns() error {
+	columns := make([]string, 0, len(self.indexedColumns))
+	for column := range self.indexedColumns {
+		columns = append(columns, column)
+	}
+	return self.db.Put(INDEXED_COLUMNS_KEY, []byte(strings.Join(columns, VALUE_INDEX_SEPARATOR)))
+}
+
+// true if the index has the values of all the points of the column
+func (self *Shard) isColumnIndexed(column string) bool {
+	self.completeColumnsLock.RLock()
+	defer self.completeColumnsLock.RUnlock()
+	return self.completeColumns[column]
+}
+
+func (self *Shard) indexValues(columns map[string]bool) error {
+	type indexedColumn struct {
+		database, series, column string
+		id                       []byte
+	}
+	indexedColumns := []indexedColumn{}
+
+	itr := self.db.Iterator()
+	for itr.Seek(SERIES_COLUMN_INDEX_PREFIX); itr.Valid(); itr.Next() {
+		key := itr.Key()
+		if !bytes.HasPrefix(key, SERIES_COLUMN_INDEX_PREFIX) {
+			break
+		}
+		dbSeriesColumn := string(key[len(SERIES_COLUMN_INDEX_PREFIX):])
+		first, last := strings.Index(dbSeriesColumn, "~"), strings.LastIndex(dbSeriesColumn, "~")
+		if first == last || !columns[dbSeriesColumn[last+1:]] {
+			continue
+		}
+		id := append([]byte{}, itr.Value()...)
+		indexedColumns = append(indexedColumns, indexedColumn{dbSeriesColumn[:first], dbSeriesColumn[first+1 : last], dbSeriesColumn[last+1:], id})
+	}
+	err := itr.Error()
+	itr.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, column := range indexedColumns {
+		wb := []storage.Write{}
+		values := map[string]bool{}
+		itr := self.db.Iterator()
+		for itr.Seek(column.id); itr.Valid(); itr.Next() {
+			key := itr.Key()
+			if !bytes.HasPrefix(key, column.id) {
+				break
+			}
+			if len(itr.Value()) == 0 {
+				continue
+			}
+			value := &protocol.FieldValue{}
+			if err := proto.Unmarshal(itr.Value(), value); err != nil {
+				itr.Close()
+				return err
+			}
+			if isIndexableValue(value) && !values[*value.StringValue] {
+				values[*value.StringValue] = true
+				wb = append(wb, storage.Write{valueIndexKey(column.database, column.column, *value.StringValue, column.series), []byte{}})
+			}
+		}
+		err := itr.Error()
+		itr.Close()
+		if err != nil {
+			return err
+		}
+		if err := self.db.BatchPut(wb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the values of the database from the index
+func (self *Shard) dropValueIndex(database string) error {
+	prefix := append(VALUE_INDEX_PREFIX, database+VALUE_INDEX_SEPARATOR...)
+	wb := []storage.Write{}
+	itr := self.db.Iterator()
+	for itr.Seek(prefix); itr.Valid(); itr.Next() {
+		key := itr.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		wb = append(wb, storage.Write{append([]byte{}, key...), nil})
+	}
+	err := itr.Error()
+	itr.Close()
+	if err != nil || len(wb) == 0 {
+		return err
+	}
+	return self.db.BatchPut(wb)
+}
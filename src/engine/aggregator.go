@@ -4,6 +4,7 @@ import (
 	"common"
 	"fmt"
 	"math"
+	"math/rand"
 	"parser"
 	"protocol"
 	"sort"
@@ -22,6 +23,26 @@ type Aggregator interface {
 	ColumnNames() []string
 }
 
+// Implemented by the aggregators that select points instead of
+// computing values, e.g. top() and bottom()
+type Selector interface {
+	// the timestamps of the points whose values GetValues returns, has
+	// to be called before GetValues
+	GetTimestamps(state interface{}) []int64
+}
+
+// Implemented by the aggregators whose memory use is bounded by the
+// configuration of the query engine
+type configurableAggregator interface {
+	configure(config *QueryEngineConfig)
+}
+
+func configureAggregator(aggregator Aggregator, config *QueryEngineConfig) {
+	if configurable, ok := aggregator.(configurableAggregator); ok {
+		configurable.configure(config)
+	}
+}
+
 // Initialize a new aggregator given the query, the function call of
 // the aggregator and the default value that should be returned if
 // the bucket doesn't have any points
@@ -34,7 +55,9 @@ func init() {
 	registeredAggregators["count"] = NewCountAggregator
 	registeredAggregators["histogram"] = NewHistogramAggregator
 	registeredAggregators["derivative"] = NewDerivativeAggregator
+	registeredAggregators["non_negative_derivative"] = NewNonNegativeDerivativeAggregator
 	registeredAggregators["difference"] = NewDifferenceAggregator
+	registeredAggregators["moving_average"] = NewMovingAverageAggregator
 	registeredAggregators["stddev"] = NewStandardDeviationAggregator
 	registeredAggregators["min"] = NewMinAggregator
 	registeredAggregators["sum"] = NewSumAggregator
@@ -81,6 +104,20 @@ func wrapDefaultValue(defaultValue *parser.Value) (*protocol.FieldValue, error)
 		v, _ := strconv.Atoi(defaultValue.Name)
 		value := int64(v)
 		return &protocol.FieldValue{Int64Value: &value}, nil
+	case parser.ValueFloat:
+		value, err := strconv.ParseFloat(defaultValue.Name, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.FieldValue{DoubleValue: &value}, nil
+	case parser.ValueSimpleName:
+		// empty buckets are null with fill(null), the query engine
+		// replaces them with the previous bucket with fill(previous)
+		switch strings.ToLower(defaultValue.Name) {
+		case "null", "previous":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unknown fill value %s, expected a number, null or previous", defaultValue.Name)
 	default:
 		return nil, fmt.Errorf("Unknown type %s", defaultValue.Type)
 	}
@@ -257,6 +294,11 @@ func (self *CompositeAggregator) InitializeFieldsMetadata(series *protocol.Serie
 	return self.right.InitializeFieldsMetadata(series)
 }
 
+func (self *CompositeAggregator) configure(config *QueryEngineConfig) {
+	configureAggregator(self.left, config)
+	configureAggregator(self.right, config)
+}
+
 func NewCompositeAggregator(left, right Aggregator) (Aggregator, error) {
 	return &CompositeAggregator{left, right}, nil
 }
@@ -361,8 +403,11 @@ type DerivativeAggregatorState struct {
 
 type DerivativeAggregator struct {
 	AbstractAggregator
+	name         string
 	defaultValue *protocol.FieldValue
 	alias        string
+	// negative derivatives are counter resets and are reported as zero
+	nonNegative bool
 }
 
 func (self *DerivativeAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
@@ -404,7 +449,7 @@ func (self *DerivativeAggregator) ColumnNames() []string {
 	if self.alias != "" {
 		return []string{self.alias}
 	}
-	return []string{"derivative"}
+	return []string{self.name}
 }
 
 func (self *DerivativeAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
@@ -416,8 +461,14 @@ func (self *DerivativeAggregator) GetValues(state interface{}) [][]*protocol.Fie
 
 	// if an old value exist, then compute the derivative and insert it in the points slice
 	deltaT := float64(*s.lastValue.Timestamp-*s.firstValue.Timestamp) / float64(time.Second/time.Microsecond)
+	if deltaT == 0 {
+		return nil
+	}
 	deltaV := *s.lastValue.Values[0].DoubleValue - *s.firstValue.Values[0].DoubleValue
 	derivative := deltaV / deltaT
+	if self.nonNegative && derivative < 0 {
+		derivative = 0
+	}
 	return [][]*protocol.FieldValue{
 		{
 			{DoubleValue: &derivative},
@@ -426,12 +477,22 @@ func (self *DerivativeAggregator) GetValues(state interface{}) [][]*protocol.Fie
 }
 
 func NewDerivativeAggregator(q *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	return newDerivativeAggregator("derivative", false, v, defaultValue)
+}
+
+// Like derivative() but the rate is zero where the value decreases,
+// i.e. a counter that wrapped around or was reset
+func NewNonNegativeDerivativeAggregator(q *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	return newDerivativeAggregator("non_negative_derivative", true, v, defaultValue)
+}
+
+func newDerivativeAggregator(name string, nonNegative bool, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
 	if len(v.Elems) != 1 {
-		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function derivative() requires exactly one argument")
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function %s() requires exactly one argument", name)
 	}
 
 	if v.Elems[0].Type == parser.ValueWildcard {
-		return nil, common.NewQueryError(common.InvalidArgument, "function derivative() doesn't work with wildcards")
+		return nil, common.NewQueryError(common.InvalidArgument, "function %s() doesn't work with wildcards", name)
 	}
 
 	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
@@ -443,8 +504,10 @@ func NewDerivativeAggregator(q *parser.SelectQuery, v *parser.Value, defaultValu
 		AbstractAggregator: AbstractAggregator{
 			value: v.Elems[0],
 		},
+		name:         name,
 		defaultValue: wrappedDefaultValue,
 		alias:        v.Alias,
+		nonNegative:  nonNegative,
 	}, nil
 }
 
@@ -543,6 +606,171 @@ func NewDifferenceAggregator(q *parser.SelectQuery, v *parser.Value, defaultValu
 	}, nil
 }
 
+//
+// Moving Average Aggregator
+//
+
+type MovingAverageAggregatorState struct {
+	points protocol.PointsCollection
+	// the averages and their timestamps in the order of the query,
+	// set by CalculateSummaries
+	averages   []float64
+	timestamps []int64
+}
+
+// Returns the trailing average of every point of the bucket over the
+// last points or the last duration, the points keep their timestamps
+// unless the query has other aggregates. The points of a bucket are
+// kept in memory until the bucket is done, so the average is usually
+// calculated over a whole series without a group by time().
+type MovingAverageAggregator struct {
+	AbstractAggregator
+	ascending    bool
+	defaultValue *protocol.FieldValue
+	alias        string
+	// the window is either a number of points or a duration in
+	// microseconds
+	points   int
+	duration int64
+}
+
+func (self *MovingAverageAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
+	fieldValue, err := GetValue(self.value, self.columns, p)
+	if err != nil {
+		return nil, err
+	}
+
+	var value float64
+	if ptr := fieldValue.Int64Value; ptr != nil {
+		value = float64(*ptr)
+	} else if ptr := fieldValue.DoubleValue; ptr != nil {
+		value = *ptr
+	} else {
+		// else ignore this point
+		return state, nil
+	}
+
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok {
+		s = &MovingAverageAggregatorState{}
+	}
+	s.points = append(s.points, &protocol.Point{
+		Timestamp: p.Timestamp,
+		Values:    []*protocol.FieldValue{{DoubleValue: &value}},
+	})
+	return s, nil
+}
+
+func (self *MovingAverageAggregator) CalculateSummaries(state interface{}) {
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok {
+		return
+	}
+	sort.Sort(protocol.ByPointTimeAsc{PointsCollection: s.points})
+
+	sum := 0.0
+	first := 0
+	for i, p := range s.points {
+		sum += *p.Values[0].DoubleValue
+		if self.points > 0 {
+			if i-first+1 > self.points {
+				sum -= *s.points[first].Values[0].DoubleValue
+				first++
+			}
+			if i-first+1 < self.points {
+				continue
+			}
+		} else {
+			for *p.Timestamp-*s.points[first].Timestamp >= self.duration {
+				sum -= *s.points[first].Values[0].DoubleValue
+				first++
+			}
+		}
+		s.averages = append(s.averages, sum/float64(i-first+1))
+		s.timestamps = append(s.timestamps, *p.Timestamp)
+	}
+	s.points = nil
+
+	if !self.ascending {
+		for i, j := 0, len(s.averages)-1; i < j; i, j = i+1, j-1 {
+			s.averages[i], s.averages[j] = s.averages[j], s.averages[i]
+			s.timestamps[i], s.timestamps[j] = s.timestamps[j], s.timestamps[i]
+		}
+	}
+}
+
+func (self *MovingAverageAggregator) ColumnNames() []string {
+	if self.alias != "" {
+		return []string{self.alias}
+	}
+	return []string{"moving_average"}
+}
+
+func (self *MovingAverageAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok {
+		return [][]*protocol.FieldValue{
+			{self.defaultValue},
+		}
+	}
+
+	returnValues := make([][]*protocol.FieldValue, 0, len(s.averages))
+	for i := range s.averages {
+		returnValues = append(returnValues, []*protocol.FieldValue{{DoubleValue: &s.averages[i]}})
+	}
+	return returnValues
+}
+
+func (self *MovingAverageAggregator) GetTimestamps(state interface{}) []int64 {
+	s, ok := state.(*MovingAverageAggregatorState)
+	if !ok {
+		return nil
+	}
+	return s.timestamps
+}
+
+func NewMovingAverageAggregator(q *parser.SelectQuery, v *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(v.Elems) != 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function moving_average() requires exactly two arguments")
+	}
+
+	if v.Elems[0].Type == parser.ValueWildcard {
+		return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() doesn't work with wildcards")
+	}
+
+	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregator := &MovingAverageAggregator{
+		AbstractAggregator: AbstractAggregator{
+			value: v.Elems[0],
+		},
+		ascending:    q.Ascending,
+		defaultValue: wrappedDefaultValue,
+		alias:        v.Alias,
+	}
+
+	window := v.Elems[1]
+	switch window.Type {
+	case parser.ValueInt:
+		aggregator.points, err = strconv.Atoi(window.Name)
+		if err != nil || aggregator.points <= 0 {
+			return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() requires a positive number of points")
+		}
+	case parser.ValueDuration:
+		duration, err := common.ParseTimeDuration(window.Name)
+		aggregator.duration = duration / int64(time.Microsecond)
+		if err != nil || aggregator.duration <= 0 {
+			return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() requires a positive duration")
+		}
+	default:
+		return nil, common.NewQueryError(common.InvalidArgument, "function moving_average() requires a number of points or a duration as the second argument")
+	}
+	return aggregator, nil
+}
+
 //
 // Histogram Aggregator
 //
@@ -702,7 +930,7 @@ func NewCountAggregator(q *parser.SelectQuery, v *parser.Value, defaultValue *pa
 		innerName := strings.ToLower(v.Elems[0].Name)
 		init := registeredAggregators[innerName]
 		if init == nil {
-			return nil, common.NewQueryError(common.InvalidArgument, fmt.Sprintf("Unknown function %s", innerName))
+			return nil, common.NewQueryError(common.InvalidArgument, "Unknown function %s", innerName)
 		}
 		inner, err := init(q, v.Elems[0], defaultValue)
 		if err != nil {
@@ -816,6 +1044,7 @@ func NewMedianAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValu
 		percentile:   50.0,
 		defaultValue: wrappedDefaultValue,
 		alias:        value.Alias,
+		sampleSize:   DEFAULT_PERCENTILE_SAMPLE_SIZE,
 	}
 	return aggregator, nil
 }
@@ -824,8 +1053,16 @@ func NewMedianAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValu
 // Percentile Aggregator
 //
 
+// The default maximum number of values kept per bucket to calculate
+// percentiles. Buckets with more points keep a uniform random sample
+// of their values (reservoir sampling), so the result is exact for
+// smaller buckets and an approximation bounded to 8 bytes per sampled
+// value for bigger ones.
+const DEFAULT_PERCENTILE_SAMPLE_SIZE = 100000
+
 type PercentileAggregatorState struct {
 	values          []float64
+	count           int
 	percentileValue float64
 }
 
@@ -835,6 +1072,13 @@ type PercentileAggregator struct {
 	percentile   float64
 	defaultValue *protocol.FieldValue
 	alias        string
+	sampleSize   int
+}
+
+func (self *PercentileAggregator) configure(config *QueryEngineConfig) {
+	if config.PercentileSampleSize > 0 {
+		self.sampleSize = config.PercentileSampleSize
+	}
 }
 
 func (self *PercentileAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
@@ -857,7 +1101,12 @@ func (self *PercentileAggregator) AggregatePoint(state interface{}, p *protocol.
 		s = &PercentileAggregatorState{}
 	}
 
-	s.values = append(s.values, value)
+	s.count++
+	if len(s.values) < self.sampleSize {
+		s.values = append(s.values, value)
+	} else if i := rand.Intn(s.count); i < len(s.values) {
+		s.values[i] = value
+	}
 
 	return s, nil
 }
@@ -927,6 +1176,7 @@ func NewPercentileAggregator(_ *parser.SelectQuery, value *parser.Value, default
 		functionName: functionName,
 		percentile:   percentile,
 		defaultValue: wrappedDefaultValue,
+		sampleSize:   DEFAULT_PERCENTILE_SAMPLE_SIZE,
 	}, nil
 }
 
@@ -1076,6 +1326,12 @@ func NewModeAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue
 // Distinct Aggregator
 //
 
+// The default maximum number of distinct values kept per bucket by
+// distinct(), the queries whose buckets have more values fail. Each
+// value is kept in memory until the bucket is done, count(distinct())
+// included.
+const DEFAULT_DISTINCT_VALUES_LIMIT = 100000
+
 type DistinctAggregatorState struct {
 	counts map[interface{}]struct{}
 }
@@ -1084,6 +1340,13 @@ type DistinctAggregator struct {
 	AbstractAggregator
 	defaultValue *protocol.FieldValue
 	alias        string
+	limit        int
+}
+
+func (self *DistinctAggregator) configure(config *QueryEngineConfig) {
+	if config.DistinctValuesLimit > 0 {
+		self.limit = config.DistinctValuesLimit
+	}
 }
 
 func (self *DistinctAggregator) AggregatePoint(state interface{}, p *protocol.Point) (interface{}, error) {
@@ -1110,6 +1373,10 @@ func (self *DistinctAggregator) AggregatePoint(state interface{}, p *protocol.Po
 		value = nil
 	}
 
+	if _, ok := s.counts[value]; !ok && len(s.counts) >= self.limit {
+		return nil, common.NewQueryError(common.InvalidArgument,
+			"function distinct() found more than %d distinct values in a group, use a shorter group by interval", self.limit)
+	}
 	s.counts[value] = struct{}{}
 
 	return s, nil
@@ -1127,6 +1394,7 @@ func (self *DistinctAggregator) GetValues(state interface{}) [][]*protocol.Field
 	s, ok := state.(*DistinctAggregatorState)
 	if !ok || len(s.counts) == 0 {
 		returnValues = append(returnValues, []*protocol.FieldValue{self.defaultValue})
+		return returnValues
 	}
 
 	for value := range s.counts {
@@ -1147,6 +1415,14 @@ func (self *DistinctAggregator) GetValues(state interface{}) [][]*protocol.Field
 }
 
 func NewDistinctAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
+	if len(value.Elems) != 1 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function distinct() requires exactly one argument")
+	}
+
+	if value.Elems[0].Type == parser.ValueWildcard {
+		return nil, common.NewQueryError(common.InvalidArgument, "function distinct() doesn't work with wildcards")
+	}
+
 	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
 	if err != nil {
 		return nil, err
@@ -1158,6 +1434,7 @@ func NewDistinctAggregator(_ *parser.SelectQuery, value *parser.Value, defaultVa
 		},
 		defaultValue: wrappedDefaultValue,
 		alias:        value.Alias,
+		limit:        DEFAULT_DISTINCT_VALUES_LIMIT,
 	}, nil
 }
 
@@ -1266,6 +1543,8 @@ func (s ByPointColumnAsc) Less(i, j int) bool {
 }
 
 type TopOrBottomAggregatorState struct {
+	// copies of the selected points with the value first, followed by
+	// the tag columns
 	values  protocol.PointsCollection
 	counter int64
 }
@@ -1278,6 +1557,9 @@ type TopOrBottomAggregator struct {
 	alias        string
 	limit        int64
 	target       string
+	// the columns of the selected points that are returned with the
+	// values
+	tags []*parser.Value
 }
 
 func comparePointValue(a, b *protocol.Point) bool {
@@ -1334,61 +1616,91 @@ func (self *TopOrBottomAggregator) AggregatePoint(state interface{}, p *protocol
 		}
 		return pp
 	}
+	newvalue := &protocol.Point{
+		Values:    []*protocol.FieldValue{asFieldValue(p)},
+		Timestamp: p.Timestamp,
+	}
 	if s.counter < self.limit {
-		newvalue := &protocol.Point{
-			Values: []*protocol.FieldValue{asFieldValue(p)},
-		}
 		s.values = append(s.values, newvalue)
 		sorter(s.values, self.isTop)
 		s.counter++
+	} else if self.comparePoint(s.values[s.counter-1], newvalue, self.isTop) {
+		s.values = append(s.values, newvalue)
+		sorter(s.values, self.isTop)
+		s.values = s.values[0:self.limit]
 	} else {
-		newvalue := &protocol.Point{
-			Values: []*protocol.FieldValue{asFieldValue(p)},
-		}
-		if self.comparePoint(s.values[s.counter-1], newvalue, self.isTop) {
-			s.values = append(s.values, p)
-			sorter(s.values, self.isTop)
-			s.values = s.values[0:self.limit]
-		}
+		return s, nil
 	}
 
+	for _, tag := range self.tags {
+		tagValue, err := GetValue(tag, self.columns, p)
+		if err != nil {
+			return nil, err
+		}
+		newvalue.Values = append(newvalue.Values, tagValue)
+	}
 	return s, nil
 }
 
 func (self *TopOrBottomAggregator) ColumnNames() []string {
+	names := []string{self.name}
 	if self.alias != "" {
-		return []string{self.alias}
-	} else {
-		return []string{self.name}
+		names[0] = self.alias
+	}
+	for _, tag := range self.tags {
+		names = append(names, tag.Name)
 	}
+	return names
 }
 
 func (self *TopOrBottomAggregator) GetValues(state interface{}) [][]*protocol.FieldValue {
 	returnValues := [][]*protocol.FieldValue{}
 	if state == nil {
-		returnValues = append(returnValues, []*protocol.FieldValue{self.defaultValue})
+		values := make([]*protocol.FieldValue, 1+len(self.tags))
+		values[0] = self.defaultValue
+		returnValues = append(returnValues, values)
 	} else {
 		s := state.(*TopOrBottomAggregatorState)
 		for _, values := range s.values {
-			returnValues = append(returnValues, []*protocol.FieldValue{values.Values[0]})
+			returnValues = append(returnValues, values.Values)
 		}
 	}
 
 	return returnValues
 }
 
+// Returns the timestamps of the selected points, in the same order as
+// their values
+func (self *TopOrBottomAggregator) GetTimestamps(state interface{}) []int64 {
+	if state == nil {
+		return nil
+	}
+	s := state.(*TopOrBottomAggregatorState)
+	timestamps := make([]int64, 0, len(s.values))
+	for _, p := range s.values {
+		timestamps = append(timestamps, p.GetTimestamp())
+	}
+	return timestamps
+}
+
 func (self *TopOrBottomAggregator) InitializeFieldsMetadata(series *protocol.Series) error {
 	self.columns = series.Fields
 	return nil
 }
 
 func NewTopOrBottomAggregator(name string, v *parser.Value, isTop bool, defaultValue *parser.Value) (Aggregator, error) {
-	if len(v.Elems) != 2 {
-		return nil, common.NewQueryError(common.WrongNumberOfArguments, fmt.Sprintf("function %s() requires at exactly 2 arguments", name))
+	if len(v.Elems) < 2 {
+		return nil, common.NewQueryError(common.WrongNumberOfArguments, "function %s() requires at least 2 arguments", name)
 	}
 
 	if v.Elems[1].Type != parser.ValueInt {
-		return nil, common.NewQueryError(common.InvalidArgument, fmt.Sprintf("function %s() second parameter expect int", name))
+		return nil, common.NewQueryError(common.InvalidArgument, "function %s() second parameter expect int", name)
+	}
+
+	for _, tag := range v.Elems[2:] {
+		if tag.Type != parser.ValueSimpleName {
+			return nil, common.NewQueryError(common.InvalidArgument, "function %s() expects column names after the second parameter", name)
+		}
 	}
 
 	wrappedDefaultValue, err := wrapDefaultValue(defaultValue)
@@ -1400,6 +1712,9 @@ func NewTopOrBottomAggregator(name string, v *parser.Value, isTop bool, defaultV
 	if err != nil {
 		return nil, err
 	}
+	if limit <= 0 {
+		return nil, common.NewQueryError(common.InvalidArgument, "function %s() second parameter must be positive", name)
+	}
 
 	return &TopOrBottomAggregator{
 		AbstractAggregator: AbstractAggregator{
@@ -1409,7 +1724,8 @@ func NewTopOrBottomAggregator(name string, v *parser.Value, isTop bool, defaultV
 		isTop:        isTop,
 		defaultValue: wrappedDefaultValue,
 		alias:        v.Alias,
-		limit:        limit}, nil
+		limit:        limit,
+		tags:         v.Elems[2:]}, nil
 }
 
 func NewTopAggregator(_ *parser.SelectQuery, value *parser.Value, defaultValue *parser.Value) (Aggregator, error) {
@@ -2,7 +2,7 @@ package engine
 
 import (
 	"common"
-	"fmt"
+	"configuration"
 	"math"
 	"parser"
 	"protocol"
@@ -43,6 +43,7 @@ type QueryEngine struct {
 	aggregators  []Aggregator
 	elems        []*parser.Value // group by columns other than time()
 	duration     *time.Duration  // the time by duration if any
+	location     *time.Location  // the time zone of the time buckets, UTC if nil
 	seriesStates map[string]*SeriesState
 
 	// query statistics
@@ -53,6 +54,28 @@ type QueryEngine struct {
 	pointsWritten int64
 	shardId       int
 	shardLocal    bool
+
+	// the first error returned while yielding the points, e.g. by an
+	// aggregator, it's sent with the end of the stream
+	yieldErr error
+
+	config *QueryEngineConfig
+}
+
+// The limits of the memory used by the aggregators of a query, the
+// zero values use the defaults
+type QueryEngineConfig struct {
+	// the number of values percentile() and median() keep per bucket
+	PercentileSampleSize int
+	// the number of values distinct() keeps per bucket
+	DistinctValuesLimit int
+}
+
+func NewQueryEngineConfig(config *configuration.Configuration) *QueryEngineConfig {
+	return &QueryEngineConfig{
+		PercentileSampleSize: config.PercentileSampleSize,
+		DistinctValuesLimit:  config.DistinctValuesLimit,
+	}
 }
 
 var (
@@ -62,6 +85,10 @@ var (
 
 const (
 	POINT_BATCH_SIZE = 64
+	// the most buckets a fill() query can fill for each series and
+	// group, so a small group by time() over a long time range doesn't
+	// run the server out of memory
+	MAX_FILL_BUCKETS = 100000
 )
 
 // distribute query and possibly do the merge/join before yielding the points
@@ -81,7 +108,14 @@ func (self *QueryEngine) distributeQuery(query *parser.SelectQuery, yield func(*
 }
 
 func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) (*QueryEngine, error) {
-	limit := query.Limit
+	return NewQueryEngineWithConfig(query, responseChan, nil)
+}
+
+func NewQueryEngineWithConfig(query *parser.SelectQuery, responseChan chan *protocol.Response, config *QueryEngineConfig) (*QueryEngine, error) {
+	limit := query.LimitWithOffset()
+	if config == nil {
+		config = &QueryEngineConfig{}
+	}
 
 	queryEngine := &QueryEngine{
 		query:          query,
@@ -99,6 +133,7 @@ func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Respo
 		shardLocal:    false, //that really doesn't matter if it is not EXPLAIN query
 		duration:      nil,
 		seriesStates:  make(map[string]*SeriesState),
+		config:        config,
 	}
 
 	if queryEngine.explain {
@@ -176,6 +211,9 @@ func (self *QueryEngine) yieldSeriesData(series *protocol.Series) bool {
 	err := self.yield(series)
 	if err != nil {
 		log.Error(err)
+		if self.yieldErr == nil {
+			self.yieldErr = err
+		}
 		return false
 	}
 	return true
@@ -230,6 +268,9 @@ func (self *QueryEngine) Close() {
 		self.SendQueryStats()
 	}
 	response := &protocol.Response{Type: &endStreamResponse}
+	if err == nil {
+		err = self.yieldErr
+	}
 	if err != nil {
 		message := err.Error()
 		response.ErrorMessage = &message
@@ -285,11 +326,23 @@ func (self *QueryEngine) getTimestampFromPoint(point *protocol.Point) int64 {
 }
 
 func (self *QueryEngine) getTimestampBucket(timestampMicroseconds uint64) int64 {
+	if self.location != nil {
+		return timeZoneBucket(int64(timestampMicroseconds), *self.duration, self.location)
+	}
 	timestampMicroseconds *= 1000 // convert to nanoseconds
 	multiplier := uint64(*self.duration)
 	return int64(timestampMicroseconds / multiplier * multiplier / 1000)
 }
 
+// Returns the start of the bucket that follows the one starting at
+// bucket
+func (self *QueryEngine) getNextTimestampBucket(bucket int64) int64 {
+	if self.location != nil {
+		return nextTimeZoneBucket(bucket, *self.duration, self.location)
+	}
+	return bucket + self.duration.Nanoseconds()/1000
+}
+
 type PointRange struct {
 	startTime int64
 	endTime   int64
@@ -329,6 +382,7 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 
 	self.isAggregateQuery = true
 	self.duration = duration
+	self.location = query.GetGroupByClause().Location
 	self.aggregators = []Aggregator{}
 
 	for _, value := range query.GetColumnNames() {
@@ -338,12 +392,13 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 		lowerCaseName := strings.ToLower(value.Name)
 		initializer := registeredAggregators[lowerCaseName]
 		if initializer == nil {
-			return common.NewQueryError(common.InvalidArgument, fmt.Sprintf("Unknown function %s", value.Name))
+			return common.NewQueryError(common.InvalidArgument, "Unknown function %s", value.Name)
 		}
 		aggregator, err := initializer(query, value, query.GetGroupByClause().FillValue)
 		if err != nil {
-			return common.NewQueryError(common.InvalidArgument, fmt.Sprintf("%s", err))
+			return common.NewQueryError(common.InvalidArgument, "%s", err)
 		}
+		configureAggregator(aggregator, self.config)
 		self.aggregators = append(self.aggregators, aggregator)
 	}
 
@@ -355,6 +410,11 @@ func (self *QueryEngine) executeCountQueryWithGroupBy(query *parser.SelectQuery,
 	}
 
 	self.fillWithZero = query.GetGroupByClause().FillWithZero
+	if self.duration != nil && self.fillWithZero && query.IsStartTimeSpecified() {
+		if err := self.checkFillRange(self.getFillRange(&PointRange{})); err != nil {
+			return err
+		}
+	}
 
 	self.initializeFields()
 
@@ -416,9 +476,11 @@ func (self *QueryEngine) getSeriesState(name string) *SeriesState {
 // bucket. We reset the trie once the series is yielded. For (2), we
 // keep track of all group by columns with time being the last level
 // in the prefix tree. At the end of the query we step through [start
-// time, end time] in self.duration steps and get the state from the
-// prefix tree, using default values for groups without state in the
-// prefix tree. For the last case we keep the groups in the prefix
+// time, end time] of the query (or of the points if the query has no
+// time condition) in self.duration steps and get the state from the
+// prefix tree, using the fill value, or the values of the previous
+// bucket with fill(previous), for groups without state in the prefix
+// tree. For the last case we keep the groups in the prefix
 // tree and on close() we loop through the groups and flush their
 // values with a timestamp equal to now()
 func (self *QueryEngine) aggregateValuesForSeries(series *protocol.Series) error {
@@ -504,9 +566,6 @@ func (self *QueryEngine) calculateSummariesForTable(table string) {
 }
 
 func (self *QueryEngine) runAggregatesForTable(table string) {
-	// TODO: if this is a fill query, step through [start,end] in duration
-	// steps and flush the groups for the given bucket
-
 	self.calculateSummariesForTable(table)
 
 	state := self.getSeriesState(table)
@@ -519,41 +578,53 @@ func (self *QueryEngine) runAggregatesForTable(table string) {
 
 	var err error
 	if self.duration != nil && self.fillWithZero {
-		timestampRange := state.pointsRange
-
-		// TODO: DRY this
-		if self.query.Ascending {
-			bucket := self.getTimestampBucket(uint64(timestampRange.startTime))
-			for bucket <= timestampRange.endTime {
-				timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
-				defaultChildNode := &Node{states: make([]interface{}, len(self.aggregators))}
-				err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
-					childNode := node.GetChildNode(timestamp)
-					if childNode == nil {
-						childNode = defaultChildNode
-					}
-					return f(append(v, timestamp), childNode)
-				})
-				bucket += self.duration.Nanoseconds() / 1000
+		start, end := self.getFillRange(state.pointsRange)
+		// the range of the points of a query without a time range
+		// can be too long too
+		if err := self.checkFillRange(start, end); err != nil {
+			if self.yieldErr == nil {
+				self.yieldErr = err
 			}
-		} else {
-			bucket := self.getTimestampBucket(uint64(timestampRange.endTime))
-			for {
-				timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
-				defaultChildNode := &Node{states: make([]interface{}, len(self.aggregators))}
-				err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
-					childNode := node.GetChildNode(timestamp)
-					if childNode == nil {
-						childNode = defaultChildNode
+			trie.Clear()
+			return
+		}
+		fillWithPrevious := self.query.GetGroupByClause().FillWithPrevious()
+		// the points of the last bucket of each group, used by
+		// fill(previous)
+		previous := map[*Node][]*protocol.Point{}
+		// the buckets are calculated in ascending order so that
+		// fill(previous) always uses the older bucket
+		buckets := [][]*protocol.Point{}
+		bucket := self.getTimestampBucket(uint64(start))
+		for ; bucket <= end && err == nil; bucket = self.getNextTimestampBucket(bucket) {
+			timestamp := &protocol.FieldValue{Int64Value: protocol.Int64(bucket)}
+			defaultChildNode := &Node{states: make([]interface{}, len(self.aggregators))}
+			bucketPoints := []*protocol.Point{}
+			err = trie.TraverseLevel(len(self.elems), func(v []*protocol.FieldValue, node *Node) error {
+				childNode := node.GetChildNode(timestamp)
+				if childNode == nil {
+					if previousPoints, ok := previous[node]; ok && fillWithPrevious {
+						bucketPoints = append(bucketPoints, withTimestamp(previousPoints, bucket)...)
+						return nil
 					}
-					return f(append(v, timestamp), childNode)
-				})
-				if bucket <= timestampRange.startTime {
-					break
+					childNode = defaultChildNode
 				}
-				bucket -= self.duration.Nanoseconds() / 1000
+				groupPoints := self.getValuesForGroup(table, append(v, timestamp), childNode)
+				previous[node] = groupPoints
+				bucketPoints = append(bucketPoints, groupPoints...)
+				return nil
+			})
+			buckets = append(buckets, bucketPoints)
+		}
+
+		if !self.query.Ascending {
+			for i, j := 0, len(buckets)-1; i < j; i, j = i+1, j-1 {
+				buckets[i], buckets[j] = buckets[j], buckets[i]
 			}
 		}
+		for _, bucketPoints := range buckets {
+			points = append(points, bucketPoints...)
+		}
 	} else {
 		err = trie.Traverse(f)
 	}
@@ -568,6 +639,47 @@ func (self *QueryEngine) runAggregatesForTable(table string) {
 	})
 }
 
+// Returns the range of the buckets of a fill() query in microseconds,
+// the time range of the query if it has one, otherwise the range of
+// the points of the series
+func (self *QueryEngine) getFillRange(pointsRange *PointRange) (int64, int64) {
+	start, end := pointsRange.startTime, pointsRange.endTime
+	if self.query.IsStartTimeSpecified() {
+		start = common.TimeToMicroseconds(self.query.GetStartTime())
+		// the end time defaults to now, which is what dashboards
+		// querying the last hour expect
+		end = common.TimeToMicroseconds(self.query.GetEndTime()) - 1
+	} else if self.query.IsEndTimeSpecified() {
+		end = common.TimeToMicroseconds(self.query.GetEndTime()) - 1
+	}
+	return start, end
+}
+
+// Returns an error if there are more than MAX_FILL_BUCKETS buckets
+// between start and end
+func (self *QueryEngine) checkFillRange(start, end int64) error {
+	if end < start {
+		return nil
+	}
+	buckets := (end-start)/int64(*self.duration/time.Microsecond) + 1
+	if buckets > MAX_FILL_BUCKETS {
+		return common.NewQueryError(common.InvalidArgument,
+			"fill() would fill %d buckets of %s, it can't fill more than %d, use a longer group by time() or a shorter time range", buckets, *self.duration, MAX_FILL_BUCKETS)
+	}
+	return nil
+}
+
+// Returns copies of the points with the given timestamp
+func withTimestamp(points []*protocol.Point, timestamp int64) []*protocol.Point {
+	copies := make([]*protocol.Point, 0, len(points))
+	for _, p := range points {
+		point := &protocol.Point{Values: p.Values}
+		point.SetTimestampInMicroseconds(timestamp)
+		copies = append(copies, point)
+	}
+	return copies
+}
+
 func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.FieldValue, node *Node) []*protocol.Point {
 
 	values := [][][]*protocol.FieldValue{}
@@ -585,6 +697,15 @@ func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.Field
 		useTimestamp = true
 	}
 
+	// the points selected by a selector keep their timestamps unless
+	// they're combined with the values of other aggregators
+	var timestamps []int64
+	if len(self.aggregators) == 1 {
+		if selector, ok := self.aggregators[0].(Selector); ok {
+			timestamps = selector.GetTimestamps(node.states[0])
+		}
+	}
+
 	for idx, aggregator := range self.aggregators {
 		values = append(values, aggregator.GetValues(node.states[idx]))
 		node.states[idx] = nil
@@ -600,13 +721,15 @@ func (self *QueryEngine) getValuesForGroup(table string, group []*protocol.Field
 
 	points := []*protocol.Point{}
 
-	for _, v := range _values {
+	for i, v := range _values {
 		/* groupPoints := []*protocol.Point{} */
 		point := &protocol.Point{
 			Values: v,
 		}
 
-		if useTimestamp {
+		if i < len(timestamps) {
+			point.SetTimestampInMicroseconds(timestamps[i])
+		} else if useTimestamp {
 			point.SetTimestampInMicroseconds(timestamp)
 		} else {
 			point.SetTimestampInMicroseconds(0)
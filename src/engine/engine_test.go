@@ -0,0 +1,320 @@
+package engine
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"parser"
+	"protocol"
+	"strconv"
+	"strings"
+)
+
+type EngineSuite struct{}
+
+var _ = Suite(&EngineSuite{})
+
+// Runs the query over the series and returns the series it yields,
+// without the empty ones, and the error it ends with
+func runQuery(c *C, queryString string, seriesJson string) ([]*protocol.Series, error) {
+	return runQueryWithConfig(c, nil, queryString, seriesJson)
+}
+
+func runQueryWithConfig(c *C, config *QueryEngineConfig, queryString string, seriesJson string) ([]*protocol.Series, error) {
+	query, err := parser.ParseSelectQuery(queryString)
+	c.Assert(err, IsNil)
+	series, err := common.StringToSeriesArray(seriesJson)
+	c.Assert(err, IsNil)
+	return runSelectQuery(c, config, query, series)
+}
+
+func runSelectQuery(c *C, config *QueryEngineConfig, query *parser.SelectQuery, series []*protocol.Series) ([]*protocol.Series, error) {
+	responses := make(chan *protocol.Response, 1000)
+	engine, err := NewQueryEngineWithConfig(query, responses, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		if !engine.YieldSeries(s) {
+			break
+		}
+	}
+	engine.Close()
+
+	results := []*protocol.Series{}
+	for {
+		response := <-responses
+		if response.GetType() == protocol.Response_END_STREAM {
+			if response.ErrorMessage != nil {
+				return results, errors.New(response.GetErrorMessage())
+			}
+			return results, nil
+		}
+		if len(response.Series.Points) > 0 {
+			results = append(results, response.Series)
+		}
+	}
+}
+
+// Returns the timestamps in seconds and the first values of the points
+// of the series, e.g. 60=1, null values are "null"
+func pointValues(series []*protocol.Series) []string {
+	values := []string{}
+	for _, s := range series {
+		for _, point := range s.Points {
+			value := point.Values[0]
+			var formatted string
+			switch {
+			case value == nil || value.GetIsNull():
+				formatted = "null"
+			case value.Int64Value != nil:
+				formatted = strconv.FormatInt(value.GetInt64Value(), 10)
+			default:
+				formatted = strconv.FormatFloat(value.GetDoubleValue(), 'f', -1, 64)
+			}
+			values = append(values, fmt.Sprintf("%d=%s", point.GetTimestamp()/1000000, formatted))
+		}
+	}
+	return values
+}
+
+// two points 2 minutes apart, in the first and the third of the five
+// minutes starting at 1399999980s
+const fillSeries = `[
+  {"name": "cpu", "fields": ["value"], "points": [
+    {"values": [{"int64_value": 3}], "timestamp": 1399999990000000},
+    {"values": [{"int64_value": 5}], "timestamp": 1400000110000000}
+  ]}
+]`
+
+func (self *EngineSuite) TestFillFillsTheEmptyBuckets(c *C) {
+	for _, test := range []struct {
+		query  string
+		values []string
+	}{
+		{"select mean(value) from cpu group by time(1m) fill(0) where time > 1399999980s and time < 1400000280s",
+			[]string{"1400000220=0", "1400000160=0", "1400000100=5", "1400000040=0", "1399999980=3"}},
+		{"select mean(value) from cpu group by time(1m) fill(0) where time > 1399999980s and time < 1400000280s order asc",
+			[]string{"1399999980=3", "1400000040=0", "1400000100=5", "1400000160=0", "1400000220=0"}},
+		{"select mean(value) from cpu group by time(1m) fill(null) where time > 1399999980s and time < 1400000280s order asc",
+			[]string{"1399999980=3", "1400000040=null", "1400000100=5", "1400000160=null", "1400000220=null"}},
+		// the empty buckets get the values of the bucket before them
+		{"select mean(value) from cpu group by time(1m) fill(previous) where time > 1399999980s and time < 1400000280s order asc",
+			[]string{"1399999980=3", "1400000040=3", "1400000100=5", "1400000160=5", "1400000220=5"}},
+		{"select mean(value) from cpu group by time(1m) fill(previous) where time > 1399999980s and time < 1400000280s",
+			[]string{"1400000220=5", "1400000160=5", "1400000100=5", "1400000040=3", "1399999980=3"}},
+		// without a time range the buckets between the points are filled
+		{"select mean(value) from cpu group by time(1m) fill(-1) order asc",
+			[]string{"1399999980=3", "1400000040=-1", "1400000100=5"}},
+	} {
+		series, err := runQuery(c, test.query, fillSeries)
+		c.Assert(err, IsNil, Commentf("%s", test.query))
+		c.Assert(pointValues(series), DeepEquals, test.values, Commentf("%s", test.query))
+	}
+}
+
+func (self *EngineSuite) TestFillCantFillTooManyBuckets(c *C) {
+	_, err := runQuery(c, "select mean(value) from cpu group by time(1s) fill(0) where time > 1300000000s and time < 1400000000s", fillSeries)
+	c.Assert(err, ErrorMatches, "fill\\(\\) would fill 100000000 buckets of 1s, it can't fill more than 100000, .*")
+
+	// the range of the points is checked without a time range
+	_, err = runQuery(c, "select mean(value) from cpu group by time(1s) fill(0)", `[
+	  {"name": "cpu", "fields": ["value"], "points": [
+	    {"values": [{"int64_value": 3}], "timestamp": 1300000000000000},
+	    {"values": [{"int64_value": 5}], "timestamp": 1400000000000000}
+	  ]}
+	]`)
+	c.Assert(err, ErrorMatches, "fill\\(\\) would fill 100000001 buckets of 1s, .*")
+
+	series, err := runQuery(c, "select mean(value) from cpu group by time(1000s) fill(0) where time > 1300000000s and time < 1400000000s", fillSeries)
+	c.Assert(err, IsNil)
+	c.Assert(pointValues(series), HasLen, 100000)
+}
+
+// Returns a series with the values 1 to n, one per second
+func sequenceSeries(n int) string {
+	points := []string{}
+	for i := 1; i <= n; i++ {
+		points = append(points, fmt.Sprintf(`{"values": [{"int64_value": %d}], "timestamp": %d}`, i, int64(i)*1000000))
+	}
+	return fmt.Sprintf(`[{"name": "cpu", "fields": ["value"], "points": [%s]}]`, strings.Join(points, ","))
+}
+
+func (self *EngineSuite) TestPercentilesAreExactForTheBucketsSmallerThanTheSample(c *C) {
+	for _, test := range []struct {
+		query  string
+		values []string
+	}{
+		{"select percentile(value, 90) from cpu", []string{"0=90"}},
+		{"select median(value) from cpu", []string{"0=50"}},
+	} {
+		series, err := runQueryWithConfig(c, &QueryEngineConfig{PercentileSampleSize: 100}, test.query, sequenceSeries(100))
+		c.Assert(err, IsNil)
+		c.Assert(pointValues(series), DeepEquals, test.values, Commentf("%s", test.query))
+	}
+}
+
+func (self *EngineSuite) TestPercentilesSampleTheBiggerBuckets(c *C) {
+	for _, config := range []*QueryEngineConfig{{PercentileSampleSize: 10}, nil} {
+		query, err := parser.ParseSelectQuery("select percentile(value, 50), count(median(value)) from cpu")
+		c.Assert(err, IsNil)
+		engine, err := NewQueryEngineWithConfig(query, make(chan *protocol.Response, 1), config)
+		c.Assert(err, IsNil)
+
+		sampleSize := DEFAULT_PERCENTILE_SAMPLE_SIZE
+		if config != nil {
+			sampleSize = config.PercentileSampleSize
+		}
+		percentile := engine.aggregators[0].(*PercentileAggregator)
+		c.Assert(percentile.sampleSize, Equals, sampleSize)
+		// the aggregators of the nested functions are configured too
+		median := engine.aggregators[1].(*CompositeAggregator).right.(*PercentileAggregator)
+		c.Assert(median.sampleSize, Equals, sampleSize)
+	}
+
+	series, err := common.StringToSeriesArray(sequenceSeries(1000))
+	c.Assert(err, IsNil)
+	aggregator, err := NewPercentileAggregator(nil, &parser.Value{Elems: []*parser.Value{
+		{Name: "value", Type: parser.ValueSimpleName},
+		{Name: "50", Type: parser.ValueInt},
+	}}, nil)
+	c.Assert(err, IsNil)
+	configureAggregator(aggregator, &QueryEngineConfig{PercentileSampleSize: 10})
+	c.Assert(aggregator.InitializeFieldsMetadata(series[0]), IsNil)
+	var state interface{}
+	for _, point := range series[0].Points {
+		state, err = aggregator.AggregatePoint(state, point)
+		c.Assert(err, IsNil)
+	}
+	s := state.(*PercentileAggregatorState)
+	c.Assert(s.count, Equals, 1000)
+	c.Assert(s.values, HasLen, 10)
+	// the sample is spread over all the values, not only the first ones
+	sampled := false
+	for _, value := range s.values {
+		sampled = sampled || value > 10
+	}
+	c.Assert(sampled, Equals, true)
+	aggregator.CalculateSummaries(state)
+	values := aggregator.GetValues(state)
+	c.Assert(values, HasLen, 1)
+	c.Assert(values[0][0].GetDoubleValue() >= 1 && values[0][0].GetDoubleValue() <= 1000, Equals, true)
+
+	// queries with bigger buckets still work
+	results, err := runQueryWithConfig(c, &QueryEngineConfig{PercentileSampleSize: 10}, "select percentile(value, 50) from cpu", sequenceSeries(1000))
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Points, HasLen, 1)
+}
+
+func (self *EngineSuite) TestDistinctFailsWithTooManyValues(c *C) {
+	config := &QueryEngineConfig{DistinctValuesLimit: 5}
+	_, err := runQueryWithConfig(c, config, "select distinct(value) from cpu", sequenceSeries(6))
+	c.Assert(err, ErrorMatches, "function distinct\\(\\) found more than 5 distinct values in a group, .*")
+	_, err = runQueryWithConfig(c, config, "select count(distinct(value)) from cpu", sequenceSeries(6))
+	c.Assert(err, ErrorMatches, "function distinct\\(\\) found more than 5 distinct values in a group, .*")
+
+	// the limit is per bucket
+	series, err := runQueryWithConfig(c, config, "select count(distinct(value)) from cpu group by time(5s) order asc", sequenceSeries(6))
+	c.Assert(err, IsNil)
+	c.Assert(pointValues(series), DeepEquals, []string{"0=4", "5=2"})
+	series, err = runQueryWithConfig(c, config, "select distinct(value) from cpu", sequenceSeries(5))
+	c.Assert(err, IsNil)
+	c.Assert(pointValues(series), HasLen, 5)
+
+	_, err = runQuery(c, "select distinct(value) from cpu", sequenceSeries(6))
+	c.Assert(err, IsNil)
+}
+
+func (self *EngineSuite) TestNonNegativeDerivativeIgnoresTheCounterResets(c *C) {
+	// the points are yielded newest first, like the shards do
+	counter := func(values ...int64) string {
+		points := []string{}
+		for i, value := range values {
+			points = append(points, fmt.Sprintf(`{"values": [{"int64_value": %d}], "timestamp": %d}`, value, int64(len(values)-1-i)*10000000))
+		}
+		return fmt.Sprintf(`[{"name": "cpu", "fields": ["value"], "points": [%s]}]`, strings.Join(points, ","))
+	}
+
+	for _, test := range []struct {
+		query  string
+		series string
+		values []string
+	}{
+		{"select non_negative_derivative(value) from cpu", counter(150, 50), []string{"0=10"}},
+		{"select derivative(value) from cpu", counter(150, 50), []string{"0=10"}},
+		// the counter was reset
+		{"select non_negative_derivative(value) from cpu", counter(5, 50), []string{"0=0"}},
+		{"select derivative(value) from cpu", counter(5, 50), []string{"0=-4.5"}},
+		// the rate of each bucket, the counter was reset in the last one
+		{"select non_negative_derivative(value) from cpu group by time(20s)", counter(5, 10, 150, 50),
+			[]string{"20=0", "0=10"}},
+		{"select derivative(value) from cpu group by time(20s)", counter(5, 10, 150, 50),
+			[]string{"20=-0.5", "0=10"}},
+		// there's no rate without two points
+		{"select non_negative_derivative(value) from cpu", counter(50), []string{}},
+		{"select non_negative_derivative(value) from cpu group by time(10s)", counter(150, 50), []string{}},
+	} {
+		series, err := runQuery(c, test.query, test.series)
+		c.Assert(err, IsNil, Commentf("%s", test.query))
+		c.Assert(pointValues(series), DeepEquals, test.values, Commentf("%s over %s", test.query, test.series))
+	}
+}
+
+// Runs the subquery of the query over the series and the query over its
+// filtered results, like the coordinator does
+func runSubquery(c *C, queryString string, seriesJson string) ([]*protocol.Series, error) {
+	query, err := parser.ParseSelectQuery(queryString)
+	c.Assert(err, IsNil)
+	series, err := common.StringToSeriesArray(seriesJson)
+	c.Assert(err, IsNil)
+	results, err := runSelectQuery(c, nil, query.GetFromClause().Subquery, series)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []*protocol.Series{}
+	for _, s := range results {
+		s, err := FilterSubqueryResults(query, s)
+		if err != nil {
+			return nil, err
+		}
+		filtered = append(filtered, s)
+	}
+	return runSelectQuery(c, nil, query, filtered)
+}
+
+func (self *EngineSuite) TestSubqueriesAggregateTheResultsOfAggregates(c *C) {
+	// the means of the three minutes are 2, 5 and 10
+	series := `[
+	  {"name": "cpu", "fields": ["value", "host"], "points": [
+	    {"values": [{"int64_value": 10}, {"string_value": "web01"}], "timestamp": 1400000100000000},
+	    {"values": [{"int64_value": 6}, {"string_value": "web02"}], "timestamp": 1400000070000000},
+	    {"values": [{"int64_value": 4}, {"string_value": "web01"}], "timestamp": 1400000040000000},
+	    {"values": [{"int64_value": 3}, {"string_value": "web02"}], "timestamp": 1400000010000000},
+	    {"values": [{"int64_value": 1}, {"string_value": "web01"}], "timestamp": 1399999990000000}
+	  ]}
+	]`
+
+	for _, test := range []struct {
+		query  string
+		values []string
+	}{
+		{"select max(mean) from (select mean(value) from cpu group by time(1m))", []string{"10"}},
+		{"select sum(mean) from (select mean(value) from cpu group by time(1m))", []string{"17"}},
+		// the outer query filters the results of the subquery
+		{"select count(mean) from (select mean(value) from cpu group by time(1m)) where mean > 3", []string{"2"}},
+		{"select min(mean) from (select mean(value) from cpu group by time(1m)) where time < 1400000040s", []string{"2"}},
+		{"select max(count) from (select count(value) from cpu group by host)", []string{"3"}},
+		// and can group them again
+		{"select sum(mean) from (select mean(value) from cpu group by time(1m)) group by time(2m)", []string{"15", "2"}},
+	} {
+		results, err := runSubquery(c, test.query, series)
+		c.Assert(err, IsNil, Commentf("%s", test.query))
+		values := []string{}
+		for _, value := range pointValues(results) {
+			values = append(values, value[strings.Index(value, "=")+1:])
+		}
+		c.Assert(values, DeepEquals, test.values, Commentf("%s", test.query))
+	}
+}
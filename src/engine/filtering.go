@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"common"
 	"fmt"
+	"math"
 	"parser"
 	"protocol"
 	"strconv"
@@ -178,3 +180,64 @@ func Filter(query *parser.SelectQuery, series *protocol.Series) (*protocol.Serie
 	}
 	return series, nil
 }
+
+// Filters the results of a subquery with the where condition and the time
+// range of the outer query. The columns that the outer query doesn't
+// select are dropped unless it's aggregating or computing expressions,
+// the engine only reads the columns it needs then.
+func FilterSubqueryResults(query *parser.SelectQuery, series *protocol.Series) (*protocol.Series, error) {
+	startTime := common.TimeToMicroseconds(query.GetStartTime())
+	endTime := common.TimeToMicroseconds(query.GetEndTime())
+	return filterPoints(query, series, startTime, endTime)
+}
+
+// Filters the points written to a series with the where condition of a
+// subscription's query, the time range of the query is ignored since
+// the subscription only gets the points that are written after it
+// started
+func FilterWrittenPoints(query *parser.SelectQuery, series *protocol.Series) (*protocol.Series, error) {
+	return filterPoints(query, series, math.MinInt64, math.MaxInt64)
+}
+
+func filterPoints(query *parser.SelectQuery, series *protocol.Series, startTime, endTime int64) (*protocol.Series, error) {
+	columns := map[string]struct{}{"*": struct{}{}}
+	if !query.HasAggregates() && !containsArithmeticOperators(query) {
+		selected := map[string]bool{}
+		getColumns(query.GetColumnNames(), selected)
+		columns = make(map[string]struct{}, len(selected))
+		for c := range selected {
+			columns[c] = struct{}{}
+		}
+	}
+
+	condition := query.GetWhereCondition()
+	points := series.Points
+	series.Points = nil
+	for _, point := range points {
+		if timestamp := point.GetTimestamp(); timestamp < startTime || timestamp > endTime {
+			continue
+		}
+		if condition != nil {
+			ok, err := matches(condition, series.Fields, point)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		filterColumns(columns, series.Fields, point)
+		series.Points = append(series.Points, point)
+	}
+
+	if _, ok := columns["*"]; !ok {
+		newFields := []string{}
+		for _, f := range series.Fields {
+			if _, ok := columns[f]; ok {
+				newFields = append(newFields, f)
+			}
+		}
+		series.Fields = newFields
+	}
+	return series, nil
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"parser"
+	"strconv"
+	"strings"
+)
+
+// Returns the columns of the series the query returns, other than time
+// and sequence_number, as far as they're known without reading any
+// point. The columns selected by * aren't, they depend on the series.
+func ResultColumns(query *parser.SelectQuery) []string {
+	columns := []string{}
+	if query.HasAggregates() {
+		for _, value := range query.GetColumnNames() {
+			if !value.IsFunctionCall() {
+				continue
+			}
+			initializer := registeredAggregators[strings.ToLower(value.Name)]
+			if initializer == nil {
+				return columns
+			}
+			aggregator, err := initializer(query, value, query.GetGroupByClause().FillValue)
+			if err != nil {
+				return columns
+			}
+			columns = append(columns, aggregator.ColumnNames()...)
+		}
+		for _, elem := range query.GetGroupByClause().Elems {
+			if !elem.IsFunctionCall() {
+				columns = append(columns, elem.Name)
+			}
+		}
+		return columns
+	}
+
+	for idx, value := range query.GetColumnNames() {
+		switch {
+		case value.Type == parser.ValueExpression && value.Alias != "":
+			columns = append(columns, value.Alias)
+		case value.Type == parser.ValueExpression:
+			columns = append(columns, "expr"+strconv.Itoa(idx))
+		case value.Name != "*" && value.Name != "time" && value.Name != "sequence_number":
+			columns = append(columns, value.Name)
+		}
+	}
+	return columns
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// Returns the start of the bucket of the timestamp, in microseconds,
+// for the buckets of the duration aligned to the time zone. Buckets of
+// whole days start at the local midnight, so they're 23 or 25 hours
+// long on the days the clocks change. The shorter buckets are aligned
+// to the offset of the timestamp, the hour repeated when the clocks go
+// back gets its own buckets.
+func timeZoneBucket(timestampMicroseconds int64, duration time.Duration, location *time.Location) int64 {
+	t := time.Unix(0, timestampMicroseconds*1000).In(location)
+	if duration%day == 0 {
+		year, month, date := t.Date()
+		days := floor(time.Date(year, month, date, 0, 0, 0, 0, time.UTC).Unix()/86400, int64(duration/day))
+		year, month, date = time.Unix(days*86400, 0).UTC().Date()
+		return time.Date(year, month, date, 0, 0, 0, 0, location).UnixNano() / 1000
+	}
+
+	_, offset := t.Zone()
+	offsetMicroseconds := int64(offset) * 1000000
+	return floor(timestampMicroseconds+offsetMicroseconds, int64(duration/time.Microsecond)) - offsetMicroseconds
+}
+
+// Returns the start of the bucket that follows the one starting at
+// bucket
+func nextTimeZoneBucket(bucket int64, duration time.Duration, location *time.Location) int64 {
+	if duration%day == 0 {
+		year, month, date := time.Unix(0, bucket*1000).In(location).Date()
+		return time.Date(year, month, date+int(duration/day), 0, 0, 0, 0, location).UnixNano() / 1000
+	}
+
+	step := int64(duration / time.Microsecond)
+	next := timeZoneBucket(bucket+step, duration, location)
+	// the clocks went back by more than the duration
+	if next <= bucket {
+		next = bucket + step
+	}
+	return next
+}
+
+// Returns the largest multiple of multiple that isn't greater than
+// value
+func floor(value, multiple int64) int64 {
+	remainder := value % multiple
+	if remainder < 0 {
+		remainder += multiple
+	}
+	return value - remainder
+}
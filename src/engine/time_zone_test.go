@@ -0,0 +1,64 @@
+package engine
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type TimeZoneSuite struct{}
+
+var _ = Suite(&TimeZoneSuite{})
+
+func (self *TimeZoneSuite) TestBucketsAreAlignedToTheTimeZone(c *C) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	c.Assert(err, IsNil)
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		location  *time.Location
+		duration  time.Duration
+		timestamp string
+		bucket    string
+		next      string
+	}{
+		// the clocks go forward on 2024-03-31, the day is 23 hours long
+		{paris, day, "2024-03-31 12:00 +0200", "2024-03-31 00:00 +0100", "2024-04-01 00:00 +0200"},
+		{paris, day, "2024-03-31 00:30 +0100", "2024-03-31 00:00 +0100", "2024-04-01 00:00 +0200"},
+		// the clocks go back on 2024-10-27, the day is 25 hours long
+		{paris, day, "2024-10-27 12:00 +0100", "2024-10-27 00:00 +0200", "2024-10-28 00:00 +0100"},
+		{paris, day, "2024-10-27 23:59 +0100", "2024-10-27 00:00 +0200", "2024-10-28 00:00 +0100"},
+		// the weeks start on thursdays, like the epoch
+		{paris, 7 * day, "2024-03-31 12:00 +0200", "2024-03-28 00:00 +0100", "2024-04-04 00:00 +0200"},
+		{paris, 7 * day, "2024-10-27 12:00 +0100", "2024-10-24 00:00 +0200", "2024-10-31 00:00 +0100"},
+		// there's no 02:00 when the clocks go forward
+		{paris, time.Hour, "2024-03-31 01:30 +0100", "2024-03-31 01:00 +0100", "2024-03-31 03:00 +0200"},
+		{paris, time.Hour, "2024-03-31 03:30 +0200", "2024-03-31 03:00 +0200", "2024-03-31 04:00 +0200"},
+		// and 02:00 is repeated when they go back
+		{paris, time.Hour, "2024-10-27 02:30 +0200", "2024-10-27 02:00 +0200", "2024-10-27 02:00 +0100"},
+		{paris, time.Hour, "2024-10-27 02:30 +0100", "2024-10-27 02:00 +0100", "2024-10-27 03:00 +0100"},
+		// the buckets are aligned to the half hour offset
+		{kolkata, time.Hour, "2024-01-01 10:45 +0530", "2024-01-01 10:00 +0530", "2024-01-01 11:00 +0530"},
+		{kolkata, 2 * time.Hour, "2024-01-01 10:45 +0530", "2024-01-01 10:00 +0530", "2024-01-01 12:00 +0530"},
+		{kolkata, day, "2024-01-01 02:00 +0530", "2024-01-01 00:00 +0530", "2024-01-02 00:00 +0530"},
+		{kolkata, day, "2023-12-31 23:59 +0530", "2023-12-31 00:00 +0530", "2024-01-01 00:00 +0530"},
+	} {
+		timestamp := parseMinute(c, t.timestamp)
+		bucket := timeZoneBucket(timestamp, t.duration, t.location)
+		comment := Commentf("%s in %s with %s buckets", t.timestamp, t.location, t.duration)
+		c.Assert(formatMinute(bucket), Equals, formatMinute(parseMinute(c, t.bucket)), comment)
+		next := nextTimeZoneBucket(bucket, t.duration, t.location)
+		c.Assert(formatMinute(next), Equals, formatMinute(parseMinute(c, t.next)), comment)
+	}
+}
+
+// Returns the timestamp of the minute in microseconds
+func parseMinute(c *C, minute string) int64 {
+	t, err := time.Parse("2006-01-02 15:04 -0700", minute)
+	c.Assert(err, IsNil)
+	return t.UnixNano() / 1000
+}
+
+func formatMinute(timestamp int64) string {
+	return time.Unix(0, timestamp*1000).UTC().Format("2006-01-02 15:04 MST")
+}
@@ -98,6 +98,7 @@ type Server interface {
 	Stop()
 	Running() bool
 	Do(command Command) (interface{}, error)
+	StepDown() error
 	TakeSnapshot() error
 	LoadSnapshot() error
 	AddEventListener(string, EventListener)
@@ -147,6 +148,9 @@ type ev struct {
 	c           chan error
 }
 
+// Makes the leader step down, see StepDown()
+type stepDownRequest struct{}
+
 //------------------------------------------------------------------------------
 //
 // Constructor
@@ -731,6 +735,8 @@ func (s *server) candidateLoop() {
 				e.returnValue, _ = s.processAppendEntriesRequest(req)
 			case *RequestVoteRequest:
 				e.returnValue, _ = s.processRequestVoteRequest(req)
+			case *stepDownRequest:
+				err = NotLeaderError
 			}
 
 			// Callback to event.
@@ -783,6 +789,8 @@ func (s *server) leaderLoop() {
 				s.processAppendEntriesResponse(req)
 			case *RequestVoteRequest:
 				e.returnValue, _ = s.processRequestVoteRequest(req)
+			case *stepDownRequest:
+				s.stepDown()
 			}
 
 			// Callback to event.
@@ -812,6 +820,8 @@ func (s *server) snapshotLoop() {
 				e.returnValue, _ = s.processRequestVoteRequest(req)
 			case *SnapshotRecoveryRequest:
 				e.returnValue = s.processSnapshotRecoveryRequest(req)
+			case *stepDownRequest:
+				err = NotLeaderError
 			}
 			// Callback to event.
 			e.c <- err
@@ -819,6 +829,33 @@ func (s *server) snapshotLoop() {
 	}
 }
 
+//--------------------------------------
+// Step down
+//--------------------------------------
+
+// Makes the leader stop sending heartbeats and become a follower in the
+// same term, e.g. to let another server win the next election. Returns
+// NotLeaderError if the server isn't the leader.
+func (s *server) StepDown() error {
+	_, err := s.send(&stepDownRequest{})
+	return err
+}
+
+// Called by the leader loop, the followers time out and elect a new
+// leader in the next term.
+func (s *server) stepDown() {
+	for _, peer := range s.peers {
+		peer.stopHeartbeat(false)
+	}
+	s.setState(Follower)
+
+	s.mutex.Lock()
+	prevLeader := s.leader
+	s.leader = ""
+	s.mutex.Unlock()
+	s.DispatchEvent(newEvent(LeaderChangeEventType, "", prevLeader))
+}
+
 //--------------------------------------
 // Commands
 //--------------------------------------
@@ -200,6 +200,31 @@ func TestServerPromoteSelf(t *testing.T) {
 	}
 }
 
+// Ensure that the leader can step down without changing the term.
+func TestServerStepDown(t *testing.T) {
+	e0, _ := newLogEntry(newLog(), nil, 1, 1, &testCommand1{Val: "foo", I: 20})
+	s := newTestServerWithLog("1", &testTransporter{}, []*LogEntry{e0})
+	s.Start()
+	defer s.Stop()
+
+	if err := s.StepDown(); err != NotLeaderError {
+		t.Fatalf("Expected error: %v, got: %v", NotLeaderError, err)
+	}
+
+	time.Sleep(2 * testElectionTimeout)
+	if s.State() != Leader {
+		t.Fatalf("Server self-promotion failed: %v", s.State())
+	}
+
+	term := s.Term()
+	if err := s.StepDown(); err != nil {
+		t.Fatalf("Step down failed: %v", err)
+	}
+	if s.State() != Follower || s.Leader() != "" || s.Term() != term {
+		t.Fatalf("Unexpected state after stepping down: %v, leader %q, term %d", s.State(), s.Leader(), s.Term())
+	}
+}
+
 //Ensure that we can promote a server within a cluster to a leader.
 func TestServerPromote(t *testing.T) {
 	lookup := map[string]Server{}
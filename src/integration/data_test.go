@@ -2322,6 +2322,63 @@ func (self *DataTestSuite) BottomWithMultipleGroupBy(c *C) (Fun, Fun) {
 		}
 }
 
+func (self *DataTestSuite) TopWithTagColumns(c *C) (Fun, Fun) {
+	return func(client Client) {
+			for i := 0; i < 3; i++ {
+				client.WriteJsonData(fmt.Sprintf(`
+[
+  {
+     "name": "test_top",
+     "columns": ["time", "cpu", "host"],
+     "points": [[%d, %d, "hosta"], [%d, %d, "hostb"]]
+  }
+]
+`, 1400504400+i*60, 60+i*10, 1400504400+i*60+1, 65+i*10), c, "s")
+			}
+		}, func(client Client) {
+			data := client.RunQuery("select top(cpu, 3, host) from test_top group by time(1d);", c, "s")
+			c.Assert(data[0].Name, Equals, "test_top")
+			c.Assert(data[0].Columns, DeepEquals, []string{"time", "top", "host"})
+
+			type tmp struct {
+				time float64
+				cpu  float64
+				host string
+			}
+			tops := []tmp{}
+			for _, point := range data[0].Points {
+				tops = append(tops, tmp{point[0].(float64), point[1].(float64), point[2].(string)})
+			}
+			// the points keep their own timestamps
+			c.Assert(tops, DeepEquals, []tmp{{1400504521, 85, "hostb"}, {1400504520, 80, "hosta"}, {1400504461, 75, "hostb"}})
+		}
+}
+
+func (self *DataTestSuite) MovingAverage(c *C) (Fun, Fun) {
+	return func(client Client) {
+			data := `[{"name": "test_moving_average", "columns": ["time", "value"], "points": [[1, 1], [2, 2], [3, 3], [4, 4], [6, 6]]}]`
+			client.WriteJsonData(data, c, "s")
+		}, func(client Client) {
+			for _, query := range []struct {
+				query    string
+				expected [][]float64
+			}{
+				{"select moving_average(value, 3) from test_moving_average order asc", [][]float64{{3, 2}, {4, 3}, {6, 13.0 / 3}}},
+				{"select moving_average(value, 3) from test_moving_average", [][]float64{{6, 13.0 / 3}, {4, 3}, {3, 2}}},
+				{"select moving_average(value, 2s) from test_moving_average order asc", [][]float64{{1, 1}, {2, 1.5}, {3, 2.5}, {4, 3.5}, {6, 6}}},
+			} {
+				series := client.RunQuery(query.query, c, "s")
+				c.Assert(series, HasLen, 1)
+				c.Assert(series[0].Columns, DeepEquals, []string{"time", "moving_average"})
+				points := [][]float64{}
+				for _, point := range series[0].Points {
+					points = append(points, []float64{point[0].(float64), point[1].(float64)})
+				}
+				c.Assert(points, DeepEquals, query.expected, Commentf("%s", query.query))
+			}
+		}
+}
+
 // issue #557
 func (self *DataTestSuite) GroupByYear(c *C) (Fun, Fun) {
 	return func(client Client) {
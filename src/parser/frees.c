@@ -29,7 +29,13 @@ free_table_name_array(table_name_array *array)
 void
 free_from_clause(from_clause *f)
 {
-  free_table_name_array(f->names);
+  if (f->names) {
+    free_table_name_array(f->names);
+  }
+  if (f->subquery) {
+    free_select_query(f->subquery);
+    free(f->subquery);
+  }
   free(f);
 }
 
@@ -130,6 +136,14 @@ free_drop_series_query (drop_series_query *q)
   free_value(q->name);
 }
 
+void
+free_list_series_query (list_series_query *q)
+{
+  if (q->regex) {
+    free_value(q->regex);
+  }
+}
+
 void
 close_query (query *q)
 {
@@ -151,8 +165,18 @@ close_query (query *q)
     free(q->drop_query);
   }
 
+  if (q->list_series_query) {
+    free_list_series_query(q->list_series_query);
+    free(q->list_series_query);
+  }
+
   if (q->delete_query) {
     free_delete_query(q->delete_query);
     free(q->delete_query);
   }
+
+  if (q->next) {
+    close_query(q->next);
+    free(q->next);
+  }
 }
@@ -15,6 +15,7 @@ const (
 	FromClauseArray     FromClauseType = C.FROM_ARRAY
 	FromClauseMerge     FromClauseType = C.FROM_MERGE
 	FromClauseInnerJoin FromClauseType = C.FROM_INNER_JOIN
+	FromClauseSubquery  FromClauseType = C.FROM_SUBQUERY
 )
 
 func (self *TableName) GetAlias() string {
@@ -39,6 +40,9 @@ type TableName struct {
 type FromClause struct {
 	Type  FromClauseType
 	Names []*TableName
+	// the query whose results the outer query selects from if the type
+	// is FromClauseSubquery, the names are empty then
+	Subquery *SelectQuery
 }
 
 func (self *FromClause) GetString() string {
@@ -47,6 +51,8 @@ func (self *FromClause) GetString() string {
 	case FromClauseMerge:
 		fmt.Fprintf(buffer, "%s%s merge %s %s", self.Names[0].Name.GetString(), self.Names[1].GetAliasString(),
 			self.Names[1].Name.GetString(), self.Names[1].GetAliasString())
+	case FromClauseSubquery:
+		fmt.Fprintf(buffer, "(%s)", self.Subquery.GetQueryStringWithTimeCondition())
 	case FromClauseInnerJoin:
 		fmt.Fprintf(buffer, "%s%s inner join %s%s", self.Names[0].Name.GetString(), self.Names[0].GetAliasString(),
 			self.Names[1].Name.GetString(), self.Names[1].GetAliasString())
@@ -14,6 +14,9 @@ type GroupByClause struct {
 	FillWithZero bool
 	FillValue    *Value
 	Elems        []*Value
+	// the time zone the buckets of time() are aligned to, e.g. days
+	// start at the local midnight, nil aligns them to UTC
+	Location *time.Location
 }
 
 func (self GroupByClause) GetGroupByTime() (*time.Duration, error) {
@@ -39,6 +42,12 @@ func (self GroupByClause) GetGroupByTime() (*time.Duration, error) {
 	return nil, nil
 }
 
+// Returns true if empty buckets are filled with the values of the
+// previous bucket, i.e. fill(previous)
+func (self *GroupByClause) FillWithPrevious() bool {
+	return self.FillWithZero && self.FillValue.Type == ValueSimpleName && strings.ToLower(self.FillValue.Name) == "previous"
+}
+
 func (self *GroupByClause) GetString() string {
 	buffer := bytes.NewBufferString("")
 
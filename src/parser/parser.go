@@ -29,6 +29,10 @@ type IntoClause struct {
 type BasicQuery struct {
 	startTime time.Time
 	endTime   time.Time
+	// whether the times were given in the where condition or are the
+	// defaults
+	startTimeSpecified bool
+	endTimeSpecified   bool
 }
 
 type SelectDeleteCommonQuery struct {
@@ -43,6 +47,7 @@ type SelectQuery struct {
 	groupByClause *GroupByClause
 	IntoClause    *IntoClause
 	Limit         int
+	Offset        int
 	Ascending     bool
 	Explain       bool
 }
@@ -56,6 +61,50 @@ const (
 
 type ListQuery struct {
 	Type ListType
+	// list series only returns the series matching the regex, sorted by
+	// name and paginated by the limit and offset
+	Regex  *Value
+	Limit  int
+	Offset int
+}
+
+func (self *ListQuery) GetQueryString() string {
+	if self.Type == ContinuousQueries {
+		return "list continuous queries"
+	}
+	buffer := bytes.NewBufferString("list series")
+	if self.Regex != nil {
+		fmt.Fprintf(buffer, " %s", self.Regex.GetString())
+	}
+	if self.Limit >= 0 {
+		fmt.Fprintf(buffer, " limit %d", self.Limit)
+	}
+	if self.Offset > 0 {
+		fmt.Fprintf(buffer, " offset %d", self.Offset)
+	}
+	return buffer.String()
+}
+
+// Whether the series is listed by the query
+func (self *ListQuery) IncludesSeries(name string) bool {
+	if self.Regex == nil {
+		return true
+	}
+	regex, _ := self.Regex.GetCompiledRegex()
+	return regex.MatchString(name)
+}
+
+// Returns the page of the sorted series names selected by the limit
+// and offset
+func (self *ListQuery) Page(names []string) []string {
+	if self.Offset >= len(names) {
+		return nil
+	}
+	names = names[self.Offset:]
+	if self.Limit >= 0 && self.Limit < len(names) {
+		names = names[:self.Limit]
+	}
+	return names
 }
 
 type DropQuery struct {
@@ -102,7 +151,7 @@ func (self *Query) commonGetQueryString(withTime bool) string {
 		}
 		return self.SelectQuery.GetQueryString()
 	} else if self.ListQuery != nil {
-		return "list series"
+		return self.ListQuery.GetQueryString()
 	} else if self.DeleteQuery != nil {
 		return self.DeleteQuery.GetQueryString(withTime)
 	}
@@ -180,6 +229,10 @@ func (self *SelectQuery) commonGetQueryStringWithTimes(withTime, withIntoClause
 		fmt.Fprintf(buffer, " limit %d", self.Limit)
 	}
 
+	if self.Offset > 0 {
+		fmt.Fprintf(buffer, " offset %d", self.Offset)
+	}
+
 	if self.Ascending {
 		fmt.Fprintf(buffer, " order asc")
 	}
@@ -191,6 +244,15 @@ func (self *SelectQuery) commonGetQueryStringWithTimes(withTime, withIntoClause
 	return buffer.String()
 }
 
+// The number of points of each series the shards have to return, the
+// offset is skipped once their results are merged
+func (self *SelectQuery) LimitWithOffset() int {
+	if self.Limit <= 0 {
+		return 0
+	}
+	return self.Limit + self.Offset
+}
+
 func (self *SelectQuery) IsSinglePointQuery() bool {
 	w := self.GetWhereCondition()
 	if w == nil {
@@ -427,11 +489,22 @@ func GetTableNameArray(array *C.table_name_array) ([]*TableName, error) {
 }
 
 func GetFromClause(fromClause *C.from_clause) (*FromClause, error) {
+	if fromClause.from_clause_type == C.FROM_SUBQUERY {
+		subquery, err := parseSelectQuery((*C.select_query)(unsafe.Pointer(fromClause.subquery)))
+		if err != nil {
+			return nil, err
+		}
+		if subquery.IsContinuousQuery() {
+			return nil, fmt.Errorf("Subqueries can't have an into clause")
+		}
+		return &FromClause{Type: FromClauseSubquery, Names: []*TableName{}, Subquery: subquery}, nil
+	}
+
 	arr, err := GetTableNameArray(fromClause.names)
 	if err != nil {
 		return nil, err
 	}
-	return &FromClause{FromClauseType(fromClause.from_clause_type), arr}, nil
+	return &FromClause{Type: FromClauseType(fromClause.from_clause_type), Names: arr}, nil
 }
 
 func GetIntoClause(intoClause *C.into_clause) (*IntoClause, error) {
@@ -522,6 +595,15 @@ func (self *SelectQuery) GetGroupByClause() *GroupByClause {
 	return self.groupByClause
 }
 
+// Aligns the time buckets of the query, and of the query it selects
+// from, to the time zone instead of UTC
+func (self *SelectQuery) SetTimeZone(location *time.Location) {
+	self.groupByClause.Location = location
+	if fromClause := self.GetFromClause(); fromClause != nil && fromClause.Type == FromClauseSubquery {
+		fromClause.Subquery.SetTimeZone(location)
+	}
+}
+
 // This is just for backward compatability so we don't have
 // to change all the code.
 func ParseSelectQuery(query string) (*SelectQuery, error) {
@@ -560,12 +642,40 @@ func ParseQuery(query string) ([]*Query, error) {
 		}
 	}
 
-	if q.list_series_query != 0 {
-		return []*Query{{QueryString: query, ListQuery: &ListQuery{Type: Series}}}, nil
+	queries := []*Query{}
+	for statement := &q; statement != nil; statement = statement.next {
+		queryString := query
+		if q.next != nil {
+			// the string of each statement of a query with multiple
+			// statements is rebuilt from the statement
+			queryString = ""
+		}
+		parsed, err := parseStatement(queryString, statement)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, parsed)
+	}
+	return queries, nil
+}
+
+func parseStatement(query string, q *C.query) (*Query, error) {
+	if q.list_series_query != nil {
+		listQuery, err := parseListSeriesQuery(q.list_series_query)
+		if err != nil {
+			return nil, err
+		}
+		if query == "" {
+			query = listQuery.GetQueryString()
+		}
+		return &Query{QueryString: query, ListQuery: listQuery}, nil
 	}
 
 	if q.list_continuous_queries_query != 0 {
-		return []*Query{{QueryString: query, ListQuery: &ListQuery{Type: ContinuousQueries}}}, nil
+		if query == "" {
+			query = "list continuous queries"
+		}
+		return &Query{QueryString: query, ListQuery: &ListQuery{Type: ContinuousQueries}}, nil
 	}
 
 	if q.select_query != nil {
@@ -574,25 +684,47 @@ func ParseQuery(query string) ([]*Query, error) {
 			return nil, err
 		}
 
-		return []*Query{{QueryString: query, SelectQuery: selectQuery}}, nil
+		return &Query{QueryString: query, SelectQuery: selectQuery}, nil
 	} else if q.delete_query != nil {
 		deleteQuery, err := parseDeleteQuery(q.delete_query)
 		if err != nil {
 			return nil, err
 		}
-		return []*Query{{QueryString: query, DeleteQuery: deleteQuery}}, nil
+		return &Query{QueryString: query, DeleteQuery: deleteQuery}, nil
 	} else if q.drop_series_query != nil {
 		dropSeriesQuery, err := parseDropSeriesQuery(query, q.drop_series_query)
 		if err != nil {
 			return nil, err
 		}
-		return []*Query{{QueryString: query, DropSeriesQuery: dropSeriesQuery}}, nil
+		if query == "" {
+			query = fmt.Sprintf("drop series %s", dropSeriesQuery.GetTableName())
+		}
+		return &Query{QueryString: query, DropSeriesQuery: dropSeriesQuery}, nil
 	} else if q.drop_query != nil {
-		return []*Query{{QueryString: query, DropQuery: &DropQuery{Id: int(q.drop_query.id)}}}, nil
+		if query == "" {
+			query = fmt.Sprintf("drop continuous query %d", int(q.drop_query.id))
+		}
+		return &Query{QueryString: query, DropQuery: &DropQuery{Id: int(q.drop_query.id)}}, nil
 	}
 	return nil, fmt.Errorf("Unknown query type encountered")
 }
 
+func parseListSeriesQuery(listSeriesQuery *C.list_series_query) (*ListQuery, error) {
+	listQuery := &ListQuery{
+		Type:   Series,
+		Limit:  int(listSeriesQuery.limit),
+		Offset: int(listSeriesQuery.offset),
+	}
+	if listSeriesQuery.regex != nil {
+		regex, err := GetValue(listSeriesQuery.regex)
+		if err != nil {
+			return nil, err
+		}
+		listQuery.Regex = regex
+	}
+	return listQuery, nil
+}
+
 func parseDropSeriesQuery(queryStirng string, dropSeriesQuery *C.drop_series_query) (*DropSeriesQuery, error) {
 	name, err := GetValue(dropSeriesQuery.name)
 	if err != nil {
@@ -637,6 +769,7 @@ func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.c
 
 	if endTime != nil {
 		goQuery.endTime = *endTime
+		goQuery.endTimeSpecified = true
 	}
 
 	goQuery.Condition, startTime, err = getTime(goQuery.GetWhereCondition(), true)
@@ -646,6 +779,7 @@ func parseSelectDeleteCommonQuery(fromClause *C.from_clause, whereCondition *C.c
 
 	if startTime != nil {
 		goQuery.startTime = *startTime
+		goQuery.startTimeSpecified = true
 	}
 
 	return goQuery, nil
@@ -665,9 +799,10 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 
 	goQuery := &SelectQuery{
 		SelectDeleteCommonQuery: basicQuery,
-		Limit:     int(limit),
-		Ascending: q.ascending != 0,
-		Explain:   q.explain != 0,
+		Limit:                   int(limit),
+		Offset:                  int(q.offset),
+		Ascending:               q.ascending != 0,
+		Explain:                 q.explain != 0,
 	}
 
 	// get the column names
@@ -692,6 +827,10 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 		return goQuery, err
 	}
 
+	if goQuery.IsContinuousQuery() && goQuery.FromClause.Type == FromClauseSubquery {
+		return nil, fmt.Errorf("Continuous queries can't select from a subquery")
+	}
+
 	return goQuery, nil
 }
 
@@ -703,6 +842,9 @@ func parseDeleteQuery(query *C.delete_query) (*DeleteQuery, error) {
 	goQuery := &DeleteQuery{
 		SelectDeleteCommonQuery: basicQuery,
 	}
+	if basicQuery.FromClause.Type == FromClauseSubquery {
+		return nil, fmt.Errorf("Delete queries can't delete from a subquery")
+	}
 	if basicQuery.GetWhereCondition() != nil {
 		return nil, fmt.Errorf("Delete queries can't have where clause that don't reference time")
 	}
@@ -71,6 +71,14 @@ func (self *QueryParserSuite) TestParseBasicSelectQuery(c *C) {
 	}
 }
 
+// Returns the time range of the select or delete query
+func timeRange(query *Query) *BasicQuery {
+	if query.SelectQuery != nil {
+		return &query.SelectQuery.BasicQuery
+	}
+	return &query.DeleteQuery.BasicQuery
+}
+
 func (self *QueryParserSuite) TestGetQueryString(c *C) {
 	for _, query := range []string{
 		"select value from t",
@@ -98,6 +106,12 @@ func (self *QueryParserSuite) TestGetQueryString(c *C) {
 		expectedQuery[0].QueryString = ""
 		actualQuery[0].QueryString = ""
 
+		// the time condition makes the time range of the query explicit
+		actual, expected := timeRange(actualQuery[0]), timeRange(expectedQuery[0])
+		c.Assert(actual.IsStartTimeSpecified(), Equals, true)
+		c.Assert(actual.IsEndTimeSpecified(), Equals, true)
+		expected.startTimeSpecified, expected.endTimeSpecified = true, true
+
 		c.Assert(actualQuery[0], DeepEquals, expectedQuery[0])
 	}
 }
@@ -207,6 +221,21 @@ func (self *QueryParserSuite) TestInvalidWhereClause(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (self *QueryParserSuite) TestParseMultipleStatements(c *C) {
+	queries, err := ParseQuery("select value from t1; list series; drop continuous query 5; select count(value) from t2;")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 4)
+	c.Assert(queries[0].SelectQuery.GetFromClause().Names[0].Name.Name, Equals, "t1")
+	c.Assert(queries[1].IsListSeriesQuery(), Equals, true)
+	c.Assert(queries[2].DropQuery.Id, Equals, 5)
+	c.Assert(queries[2].GetQueryString(), Equals, "drop continuous query 5")
+	c.Assert(queries[3].SelectQuery.GetFromClause().Names[0].Name.Name, Equals, "t2")
+	c.Assert(queries[3].GetQueryString(), Equals, "select count(value) from t2")
+
+	_, err = ParseQuery("select value from t1; select from t2")
+	c.Assert(err, NotNil)
+}
+
 func (self *QueryParserSuite) TestParseWithUnderscore(c *C) {
 	queryString := "select _value, time, sequence_number from foo"
 	query, err := ParseSelectQuery(queryString)
@@ -238,6 +267,38 @@ func (self *QueryParserSuite) TestParseFromWithMergedTable(c *C) {
 	c.Assert(fromClause.Names[1].Name.Name, Equals, "user.signups")
 }
 
+func (self *QueryParserSuite) TestParseFromWithSubquery(c *C) {
+	q, err := ParseSelectQuery("select max(mean) from (select mean(value) from cpu group by time(1m) where time > now() - 1h) where time > now() - 1d;")
+	c.Assert(err, IsNil)
+	fromClause := q.GetFromClause()
+	c.Assert(fromClause.Type, Equals, FromClauseSubquery)
+	c.Assert(fromClause.Names, HasLen, 0)
+	c.Assert(q.HasAggregates(), Equals, true)
+
+	subquery := fromClause.Subquery
+	c.Assert(subquery, NotNil)
+	c.Assert(subquery.GetFromClause().Names[0].Name.Name, Equals, "cpu")
+	c.Assert(subquery.GetGroupByClause().Elems, HasLen, 1)
+	c.Assert(subquery.GetStartTime().Round(time.Minute), Equals, time.Now().Add(-time.Hour).Round(time.Minute).UTC())
+	c.Assert(q.GetStartTime().Round(time.Minute), Equals, time.Now().Add(-24*time.Hour).Round(time.Minute).UTC())
+
+	// the query string keeps the time range of the subquery
+	q, err = ParseSelectQuery(q.GetQueryString())
+	c.Assert(err, IsNil)
+	c.Assert(q.GetFromClause().Subquery.GetStartTime().Round(time.Minute), Equals, subquery.GetStartTime().Round(time.Minute))
+}
+
+func (self *QueryParserSuite) TestInvalidSubqueries(c *C) {
+	for _, query := range []string{
+		"select * from (select value from cpu into cpu.copy)",
+		"select mean(value) from (select value from cpu) group by time(1m) into cpu.1m",
+		"delete from (select value from cpu)",
+	} {
+		_, err := ParseQuery(query)
+		c.Assert(err, NotNil, Commentf("%s", query))
+	}
+}
+
 func (self *QueryParserSuite) TestMultipleAggregateFunctions(c *C) {
 	q, err := ParseSelectQuery("select first(bar), last(bar) from foo")
 	c.Assert(err, IsNil)
@@ -265,6 +326,25 @@ func (self *QueryParserSuite) TestParseListSeries(c *C) {
 	c.Assert(queries[0].IsListQuery(), Equals, true)
 }
 
+func (self *QueryParserSuite) TestParseListSeriesWithRegexAndPagination(c *C) {
+	queries, err := ParseQuery("list series /^cpu\\./i limit 2 offset 1")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	listQuery := queries[0].ListQuery
+	c.Assert(queries[0].IsListSeriesQuery(), Equals, true)
+	c.Assert(listQuery.IncludesSeries("CPU.idle"), Equals, true)
+	c.Assert(listQuery.IncludesSeries("mem.free"), Equals, false)
+	c.Assert(listQuery.Page([]string{"cpu.a", "cpu.b", "cpu.c", "cpu.d"}), DeepEquals, []string{"cpu.b", "cpu.c"})
+	c.Assert(listQuery.Page([]string{"cpu.a"}), HasLen, 0)
+	c.Assert(queries[0].GetQueryString(), Equals, "list series /^cpu\\./i limit 2 offset 1")
+
+	queries, err = ParseQuery("list series; select a / 2 from t1")
+	c.Assert(err, IsNil)
+	c.Assert(queries[0].ListQuery.IncludesSeries("anything"), Equals, true)
+	c.Assert(queries[0].ListQuery.Limit, Equals, -1)
+	c.Assert(queries[1].SelectQuery.GetFromClause().Names[0].Name.Name, Equals, "t1")
+}
+
 // issue #267
 func (self *QueryParserSuite) TestParseSelectWithWeirdCharacters(c *C) {
 	q, err := ParseSelectQuery("select a from \"/blah ( ) ; : ! @ # $ \n \t,foo\\\"=bar/baz\"")
@@ -654,6 +734,40 @@ func (self *QueryParserSuite) TestParseSelectWithOrderByAndLimit(c *C) {
 	c.Assert(q.Ascending, Equals, false)
 }
 
+func (self *QueryParserSuite) TestParseSelectWithOffset(c *C) {
+	q, err := ParseSelectQuery("select value from t limit 10 offset 20 order asc;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Limit, Equals, 10)
+	c.Assert(q.Offset, Equals, 20)
+	c.Assert(q.LimitWithOffset(), Equals, 30)
+	c.Assert(q.Ascending, Equals, true)
+	c.Assert(q.GetQueryString(), Equals, "select value from t limit 10 offset 20 order asc")
+
+	q, err = ParseSelectQuery("select value from t offset 5;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Offset, Equals, 5)
+	// without a limit the shards return all the points
+	c.Assert(q.LimitWithOffset(), Equals, 0)
+}
+
+func (self *QueryParserSuite) TestParseSelectWithOrderByTime(c *C) {
+	q, err := ParseSelectQuery("select value from t order by time desc limit 10;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Limit, Equals, 10)
+	c.Assert(q.Ascending, Equals, false)
+
+	q, err = ParseSelectQuery("select value from t limit 10 ORDER BY time ASC;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Ascending, Equals, true)
+
+	q, err = ParseSelectQuery("select value from t order by time;")
+	c.Assert(err, IsNil)
+	c.Assert(q.Ascending, Equals, true)
+
+	_, err = ParseSelectQuery("select value from t order by value desc;")
+	c.Assert(err, NotNil)
+}
+
 func (self *QueryParserSuite) TestParseFromWithNestedFunctions2(c *C) {
 	q, err := ParseSelectQuery("select count(distinct(email)) from user.events where time>now()-1d group by time(15m);")
 	c.Assert(err, IsNil)
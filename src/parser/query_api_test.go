@@ -54,6 +54,18 @@ func (self *QueryApiSuite) TestGetEndTime(c *C) {
 	}
 }
 
+func (self *QueryApiSuite) TestIsTimeSpecified(c *C) {
+	query, err := ParseSelectQuery("select * from t where time > now() - 1d;")
+	c.Assert(err, IsNil)
+	c.Assert(query.IsStartTimeSpecified(), Equals, true)
+	c.Assert(query.IsEndTimeSpecified(), Equals, false)
+
+	query, err = ParseSelectQuery("select * from t;")
+	c.Assert(err, IsNil)
+	c.Assert(query.IsStartTimeSpecified(), Equals, false)
+	c.Assert(query.IsEndTimeSpecified(), Equals, false)
+}
+
 func (self *QueryApiSuite) TestGetReferencedColumns(c *C) {
 	queryStr := "select value1, sum(value2) from t where value > 90.0 and value2 < 10.0 group by value3;"
 	query, err := ParseSelectQuery(queryStr)
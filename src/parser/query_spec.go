@@ -2,6 +2,7 @@ package parser
 
 import (
 	"common"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,12 +18,68 @@ type QuerySpec struct {
 	RunAgainstAllServersInShard bool
 	groupByInterval             *time.Duration
 	groupByColumnCount          int
+	// closed when the query is cancelled
+	cancelled <-chan bool
+	// counts the shards read by the query and the queries run on its
+	// behalf, nil if they aren't counted
+	shardsQueried *int32
 }
 
 func NewQuerySpec(user common.User, database string, query *Query) *QuerySpec {
 	return &QuerySpec{user: user, query: query, database: database}
 }
 
+func (self *QuerySpec) SetCancelChannel(cancelled <-chan bool) {
+	self.cancelled = cancelled
+}
+
+// Returns the channel closed when the query is cancelled, nil if it
+// can't be cancelled
+func (self *QuerySpec) CancelChannel() <-chan bool {
+	return self.cancelled
+}
+
+// Returns true if the query was cancelled, the shards check it
+// periodically and stop iterating if it's true
+func (self *QuerySpec) IsCancelled() bool {
+	if self.cancelled == nil {
+		return false
+	}
+	select {
+	case <-self.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Counts the shards read by the query in counter
+func (self *QuerySpec) SetShardCounter(counter *int32) {
+	self.shardsQueried = counter
+}
+
+func (self *QuerySpec) AddShardsQueried(shards int) {
+	if self.shardsQueried != nil {
+		atomic.AddInt32(self.shardsQueried, int32(shards))
+	}
+}
+
+// Returns the spec of a query run on behalf of this one, it's cancelled
+// with this query and the shards it reads are counted as this query's
+func (self *QuerySpec) DerivedSpec(query *Query) *QuerySpec {
+	spec := NewQuerySpec(self.user, self.database, query)
+	spec.cancelled = self.cancelled
+	spec.shardsQueried = self.shardsQueried
+	return spec
+}
+
+// Returns the spec of the query the select query selects from, it's
+// cancelled with this query
+func (self *QuerySpec) SubquerySpec() *QuerySpec {
+	subquery := self.query.SelectQuery.GetFromClause().Subquery
+	return self.DerivedSpec(&Query{SelectQuery: subquery})
+}
+
 func (self *QuerySpec) AllShardsQuery() bool {
 	return self.IsDropSeriesQuery()
 }
@@ -57,6 +114,10 @@ func (self *QuerySpec) DeleteQuery() *DeleteQuery {
 	return self.query.DeleteQuery
 }
 
+func (self *QuerySpec) ListQuery() *ListQuery {
+	return self.query.ListQuery
+}
+
 func (self *QuerySpec) TableNames() []string {
 	if self.names != nil {
 		return self.names
@@ -68,28 +68,34 @@ typedef struct {
   table_name **elems;
 } table_name_array;
 
+struct select_query_t;
+
 typedef struct {
   enum {
     FROM_ARRAY,
     FROM_MERGE,
-    FROM_INNER_JOIN
+    FROM_INNER_JOIN,
+    FROM_SUBQUERY
   } from_clause_type;
   // in case of merge or join, it's guaranteed that the names array
   // will have two table names only and they aren't regex.
   table_name_array *names;
+  // in case of a subquery the names are NULL
+  struct select_query_t *subquery;
 } from_clause;
 
 typedef struct {
   value *target;
 } into_clause;
 
-typedef struct {
+typedef struct select_query_t {
   value_array *c;
   from_clause *from_clause;
   groupby_clause *group_by;
   into_clause *into_clause;
   condition *where_condition;
   int limit;
+  int offset;
   char ascending;
   char explain;
 } select_query;
@@ -109,13 +115,22 @@ typedef struct {
 } drop_query;
 
 typedef struct {
+  value *regex;
+  int limit;
+  int offset;
+} list_series_query;
+
+typedef struct query_t {
   select_query *select_query;
   delete_query *delete_query;
   drop_series_query *drop_series_query;
   drop_query *drop_query;
-  char list_series_query;
+  list_series_query *list_series_query;
   char list_continuous_queries_query;
   error *error;
+  // the next statement of a query with multiple statements separated by
+  // semicolons
+  struct query_t *next;
 } query;
 
 // some funcs for freeing our types
@@ -124,6 +139,7 @@ void free_value_array(value_array *array);
 void free_value(value *value);
 void free_condition(condition *condition);
 void free_error (error *error);
+void free_select_query (select_query *q);
 
 // this is the api that is used in GO
 query parse_query(char *const query_s);
@@ -8,8 +8,12 @@ import (
 	"cluster"
 	"configuration"
 	"coordinator"
+	"crypto/tls"
 	"datastore"
+	"fmt"
+	"reflect"
 	"runtime"
+	"sync"
 	"time"
 	"wal"
 
@@ -29,20 +33,54 @@ type Server struct {
 	Coordinator    coordinator.Coordinator
 	Config         *configuration.Configuration
 	RequestHandler *coordinator.ProtobufRequestHandler
-	stopped        bool
 	writeLog       *wal.WAL
 	shardStore     *datastore.ShardDatastore
+
+	// held while the configuration is being reloaded or the server
+	// is stopping
+	reloadLock       sync.Mutex
+	reportingStarted bool
+	// set once the listeners were started, the configuration can't be
+	// reloaded before
+	listenersStarted bool
+	// guards GraphiteApi, UdpServers and the settings of Config that
+	// are changed by ReloadConfig
+	lock sync.RWMutex
+	// closed by Stop() to terminate the background loops and tell
+	// that the server was stopped
+	shutdown chan struct{}
+	// errors returned by the subsystems running in the background,
+	// any error causes the server to stop
+	subsystemErrors chan error
+	fatalError      error
 }
 
 func NewServer(config *configuration.Configuration) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	log.Info("Opening database at %s", config.DataDir)
 	shardDb, err := datastore.NewShardDatastore(config)
 	if err != nil {
 		return nil, err
 	}
 
+	var protobufTlsConfig *tls.Config
+	if config.IsProtobufSslEnabled() {
+		protobufTlsConfig, err = coordinator.NewTlsConfig(config.ProtobufSslCertPath, config.ProtobufSslKeyPath, config.ProtobufSslCaPath)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: %s", err)
+		}
+	}
+
 	newClient := func(connectString string) cluster.ServerConnection {
-		return coordinator.NewProtobufClient(connectString, config.ProtobufTimeout.Duration)
+		client := coordinator.NewProtobufClient(connectString, config.ProtobufTimeout.Duration)
+		client.SetTlsConfig(protobufTlsConfig)
+		client.SetTimeouts(config.ProtobufDialTimeout, config.ProtobufReadTimeout, config.ProtobufWriteTimeout)
+		client.SetConnections(config.ProtobufConnectionsPerServer, config.ProtobufHealthCheckInterval)
+		client.SetReconnectBackoff(config.ProtobufMinBackoff.Duration, config.ProtobufMaxBackoff.Duration)
+		return client
 	}
 	writeLog, err := wal.NewWAL(config)
 	if err != nil {
@@ -51,32 +89,129 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 
 	clusterConfig := cluster.NewClusterConfiguration(config, writeLog, shardDb, newClient)
 	raftServer := coordinator.NewRaftServer(config, clusterConfig)
+	if config.IsRaftSslEnabled() {
+		raftTlsConfig, err := coordinator.NewTlsConfig(config.RaftSslCertPath, config.RaftSslKeyPath, config.RaftSslCaPath)
+		if err != nil {
+			return nil, fmt.Errorf("raft: %s", err)
+		}
+		raftServer.SetTlsConfig(raftTlsConfig)
+	}
 	clusterConfig.LocalRaftName = raftServer.GetRaftName()
 	clusterConfig.SetShardCreator(raftServer)
+	shardDb.SetDuplicatePointPolicy(clusterConfig.GetDuplicatePointPolicy)
+	shardDb.SetDroppedDatabases(clusterConfig.IsDroppedDatabase)
+	clusterConfig.SetShardMover(raftServer)
 	clusterConfig.CreateFutureShardsAutomaticallyBeforeTimeComes()
+	clusterConfig.StartAntiEntropy()
+	clusterConfig.StartShardMoves()
+	shardDb.StartRetentionSweeper(config.RetentionSweepInterval, clusterConfig.ExpiredLocalDatabases)
+	shardDb.StartShardStatsCollector(config.StorageShardStatsInterval)
+	shardDb.StartCompactionScheduler(config.StorageCompactionInterval, config.StorageCompactionWindowStart, config.StorageCompactionWindowEnd)
 
 	coord := coordinator.NewCoordinatorImpl(config, raftServer, clusterConfig)
 	requestHandler := coordinator.NewProtobufRequestHandler(coord, clusterConfig)
 	protobufServer := coordinator.NewProtobufServer(config.ProtobufListenString(), requestHandler)
+	protobufServer.SetTlsConfig(protobufTlsConfig)
 
 	raftServer.AssignCoordinator(coord)
-	httpApi := http.NewHttpServer(config.ApiHttpPortString(), config.ApiReadTimeout, config.AdminAssetsDir, coord, coord, clusterConfig, raftServer)
+	adminAssets, err := admin.Assets(config.AdminAssetsDir)
+	if err != nil {
+		if config.AdminHttpPort > 0 {
+			log.Error("The admin site won't load: %s", err)
+		}
+		adminAssets = admin.NoAssets
+	}
+	httpApi := http.NewHttpServer(config.ApiHttpPortString(), config.ApiReadTimeout, adminAssets, coord, coord, clusterConfig, raftServer)
 	httpApi.EnableSsl(config.ApiHttpSslPortString(), config.ApiHttpCertPath)
+	httpApi.SetProtobufServer(protobufServer)
+	httpApi.SetCompression(!config.ApiCompressionDisabled, config.ApiCompressionMinSize)
+	httpApi.SetAllowedOrigins(config.ApiAllowedOrigins)
+	httpApi.SetWriteRateLimits(config.ApiWriteRateLimit, config.ApiWriteRateLimitPerClient)
+	httpApi.SetMaxQueryPoints(config.ApiMaxQueryPoints)
+	httpApi.SetEmptySeries(config.ApiEmptySeries)
+	httpApi.SetTokenTtl(config.ApiTokenTtl)
+	httpApi.SetSubscriptionBufferSize(config.ApiSubscriptionBufferSize)
 	graphiteApi := graphite.NewServer(config, coord, clusterConfig)
-	adminServer := admin.NewHttpServer(config.AdminAssetsDir, config.AdminHttpPortString())
-
-	return &Server{
-		RaftServer:     raftServer,
-		ProtobufServer: protobufServer,
-		ClusterConfig:  clusterConfig,
-		HttpApi:        httpApi,
-		GraphiteApi:    graphiteApi,
-		Coordinator:    coord,
-		AdminServer:    adminServer,
-		Config:         config,
-		RequestHandler: requestHandler,
-		writeLog:       writeLog,
-		shardStore:     shardDb}, nil
+	adminServer := admin.NewHttpServer(adminAssets, config.AdminHttpPortString())
+	if config.AdminAuthEnabled {
+		adminServer.SetAuthenticator(coord)
+	}
+
+	server := &Server{
+		RaftServer:      raftServer,
+		ProtobufServer:  protobufServer,
+		ClusterConfig:   clusterConfig,
+		HttpApi:         httpApi,
+		GraphiteApi:     graphiteApi,
+		Coordinator:     coord,
+		AdminServer:     adminServer,
+		Config:          config,
+		RequestHandler:  requestHandler,
+		writeLog:        writeLog,
+		shardStore:      shardDb,
+		shutdown:        make(chan struct{}),
+		subsystemErrors: make(chan error, 10)}
+	httpApi.SetUdpStats(server.udpStats)
+	httpApi.SetGraphiteStats(server.graphiteStats)
+	return server, nil
+}
+
+func (self *Server) graphiteStats() *graphite.Stats {
+	self.lock.RLock()
+	enabled, graphiteApi := self.Config.GraphiteEnabled, self.GraphiteApi
+	self.lock.RUnlock()
+	if !enabled {
+		return nil
+	}
+	return graphiteApi.Stats()
+}
+
+func (self *Server) reportingDisabled() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.Config.ReportingDisabled
+}
+
+func (self *Server) udpStats() []*udp.Stats {
+	// the servers are replaced when the configuration is reloaded
+	self.lock.RLock()
+	servers := make([]*udp.Server, len(self.UdpServers))
+	copy(servers, self.UdpServers)
+	self.lock.RUnlock()
+
+	stats := make([]*udp.Stats, 0, len(servers))
+	for _, server := range servers {
+		stats = append(stats, server.Stats())
+	}
+	return stats
+}
+
+// Runs the given ListenAndServe function in the background and sends
+// its error, if any, to the server's error channel
+func (self *Server) startSubsystem(name string, listenAndServe func() error) {
+	go func() {
+		if err := listenAndServe(); err != nil {
+			select {
+			case self.subsystemErrors <- fmt.Errorf("%s: %s", name, err):
+			default:
+				// the server is already stopping
+				log.Error("%s: %s", name, err)
+			}
+		}
+	}()
+}
+
+func (self *Server) monitorSubsystems() {
+	select {
+	case err := <-self.subsystemErrors:
+		log.Error("Stopping the server because of a fatal error in %s", err)
+		self.fatalError = err
+		self.Stop()
+	case <-self.ClusterConfig.LocalServerRemoved():
+		log.Info("Stopping the server, it was removed from the cluster")
+		self.Stop()
+	case <-self.shutdown:
+	}
 }
 
 func (self *Server) ListenAndServe() error {
@@ -85,6 +220,8 @@ func (self *Server) ListenAndServe() error {
 		return err
 	}
 
+	go self.monitorSubsystems()
+
 	log.Info("Waiting for local server to be added")
 	self.ClusterConfig.WaitForLocalServerLoaded()
 	self.writeLog.SetServerId(self.ClusterConfig.ServerId())
@@ -115,73 +252,144 @@ func (self *Server) ListenAndServe() error {
 		log.Info("Connection string changed successfully")
 	}
 
-	go self.ProtobufServer.ListenAndServe()
+	if !self.runUnlessStopped(func() { self.startSubsystem("protobuf server", self.ProtobufServer.ListenAndServe) }) {
+		return self.fatalError
+	}
 
 	log.Info("Recovering from log...")
-	err = self.ClusterConfig.RecoverFromWAL()
+	if !self.runUnlessStopped(func() { err = self.ClusterConfig.RecoverFromWAL() }) {
+		return self.fatalError
+	}
 	if err != nil {
 		return err
 	}
 	log.Info("recovered")
 
-	err = self.Coordinator.(*coordinator.CoordinatorImpl).ConnectToProtobufServers(self.RaftServer.GetRaftName())
+	if !self.runUnlessStopped(func() {
+		err = self.Coordinator.(*coordinator.CoordinatorImpl).ConnectToProtobufServers(self.RaftServer.GetRaftName())
+	}) {
+		return self.fatalError
+	}
 	if err != nil {
 		return err
 	}
-	log.Info("Starting admin interface on port %d", self.Config.AdminHttpPort)
-	go self.AdminServer.ListenAndServe()
-	if self.Config.GraphiteEnabled {
-		if self.Config.GraphitePort <= 0 || self.Config.GraphiteDatabase == "" {
-			log.Warn("Cannot start graphite server. please check your configuration")
-		} else {
-			log.Info("Starting Graphite Listener on port %d", self.Config.GraphitePort)
-			go self.GraphiteApi.ListenAndServe()
-		}
+	if !self.runUnlessStopped(func() {
+		log.Info("Starting admin interface on port %d", self.Config.AdminHttpPort)
+		self.startSubsystem("admin server", self.AdminServer.ListenAndServe)
+	}) {
+		return self.fatalError
 	}
 
+	self.reloadLock.Lock()
+	if self.isStopped() {
+		self.reloadLock.Unlock()
+		return self.fatalError
+	}
+	self.startGraphiteServer()
+
 	// UDP input
+	self.startUdpServers()
+
+	log.Debug("ReportingDisabled: %v", self.Config.ReportingDisabled)
+	if !self.Config.ReportingDisabled {
+		self.reportingStarted = true
+		go self.startReportingLoop()
+	}
+	self.listenersStarted = true
+	self.reloadLock.Unlock()
+
+	// start processing continuous queries
+	self.RaftServer.StartProcessingContinuousQueries()
+
+	if self.isStopped() {
+		return self.fatalError
+	}
+
+	log.Info("Starting Http Api server on port %d", self.Config.ApiHttpPort)
+	self.HttpApi.ListenAndServe()
+
+	return self.fatalError
+}
+
+// Runs a step of the startup unless the server was stopped and returns
+// true if it ran. The step holds reloadLock, so Stop() waits for it to
+// finish before it closes the subsystems the step uses.
+func (self *Server) runUnlessStopped(step func()) bool {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	if self.isStopped() {
+		return false
+	}
+	step()
+	return true
+}
+
+func (self *Server) startGraphiteServer() {
+	// the port and database were validated with the configuration
+	if !self.Config.GraphiteEnabled {
+		return
+	}
+
+	log.Info("Starting Graphite Listener on port %d", self.Config.GraphitePort)
+	self.startSubsystem("graphite server", self.GraphiteApi.ListenAndServe)
+}
+
+func (self *Server) startUdpServers() {
 	for _, udpInput := range self.Config.UdpServers {
 		port := udpInput.Port
 		database := udpInput.Database
 
-		if port <= 0 {
-			log.Warn("Cannot start udp server on port %d. please check your configuration", port)
+		// the enabled servers were validated with the configuration
+		if !udpInput.Enabled {
+			if port > 0 {
+				log.Warn("Not starting the udp server on port %d, it isn't enabled", port)
+			}
 			continue
-		} else if database == "" {
-			log.Warn("Cannot start udp server for database=\"\".  please check your configuration")
 		}
 
 		log.Info("Starting UDP Listener on port %d to database %s", port, database)
 
-		addr := self.Config.UdpInputPortString(port)
+		addr := self.Config.UdpInputPortString(udpInput)
 
 		server := udp.NewServer(addr, database, self.Coordinator, self.ClusterConfig)
+		server.SetFormat(udpInput.Format)
+		server.SetBufferSizes(udpInput.ReadBufferSize, udpInput.QueueSize)
+		server.SetDatabaseFromPayload(udpInput.DatabaseFromPayload, udpInput.DatabaseSeparator)
+		server.SetBatching(udpInput.BatchSize, udpInput.BatchTimeout.Duration)
+		server.SetLimits(udpInput.MaxPacketSize, udpInput.MaxPointsPerPacket)
+		self.lock.Lock()
 		self.UdpServers = append(self.UdpServers, server)
-		go server.ListenAndServe()
+		self.lock.Unlock()
+		self.startSubsystem(fmt.Sprintf("udp server on %s", addr), server.ListenAndServe)
 	}
+}
 
-	log.Debug("ReportingDisabled: %s", self.Config.ReportingDisabled)
-	if !self.Config.ReportingDisabled {
-		go self.startReportingLoop()
+func (self *Server) stopUdpServers() {
+	self.lock.Lock()
+	servers := self.UdpServers
+	self.UdpServers = nil
+	self.lock.Unlock()
+	for _, server := range servers {
+		server.Close()
 	}
-
-	// start processing continuous queries
-	self.RaftServer.StartProcessingContinuousQueries()
-
-	log.Info("Starting Http Api server on port %d", self.Config.ApiHttpPort)
-	self.HttpApi.ListenAndServe()
-
-	return nil
 }
 
-func (self *Server) startReportingLoop() chan struct{} {
+func (self *Server) startReportingLoop() {
 	log.Debug("Starting Reporting Loop")
 	self.reportStats()
 
-	ticker := time.NewTicker(24 * time.Hour)
+	ticker := time.NewTicker(self.Config.ReportingInterval)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-self.shutdown:
+			log.Debug("Stopping Reporting Loop")
+			return
 		case <-ticker.C:
+			if self.reportingDisabled() {
+				log.Debug("Reporting is disabled, not reporting stats")
+				continue
+			}
 			self.reportStats()
 		}
 	}
@@ -189,8 +397,8 @@ func (self *Server) startReportingLoop() chan struct{} {
 
 func (self *Server) reportStats() {
 	client, err := influxdb.NewClient(&influxdb.ClientConfig{
-		Database: "reporting",
-		Host:     "m.influxdb.com:8086",
+		Database: self.Config.ReportingDatabase,
+		Host:     self.Config.ReportingHost,
 		Username: "reporter",
 		Password: "influxdb",
 	})
@@ -211,12 +419,189 @@ func (self *Server) reportStats() {
 	}
 }
 
+// ReloadConfig re-parses the configuration file the server was
+// started with and applies the settings that can be changed at
+// runtime, i.e. the log level, reporting, the api read timeout and
+// the graphite and udp listeners. Other settings that changed are
+// logged and ignored until the next restart.
+func (self *Server) ReloadConfig() error {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if self.isStopped() {
+		return nil
+	}
+	if !self.listenersStarted {
+		log.Warn("The server is still starting, ignoring the configuration reload")
+		return nil
+	}
+
+	log.Info("Reloading configuration file %s", self.Config.FileName)
+	newConfig, err := configuration.ParseConfiguration(self.Config.FileName)
+	if err == nil {
+		err = newConfig.Validate()
+	}
+	if err != nil {
+		log.Error("Couldn't reload configuration file %s: %s", self.Config.FileName, err)
+		return err
+	}
+
+	self.logIgnoredSettings(newConfig)
+
+	if newConfig.LogLevel != self.Config.LogLevel {
+		log.Info("Changing log level from %s to %s", self.Config.LogLevel, newConfig.LogLevel)
+		self.lock.Lock()
+		self.Config.LogLevel = newConfig.LogLevel
+		self.lock.Unlock()
+		setLogLevel(newConfig)
+	}
+
+	if newConfig.ReportingDisabled != self.Config.ReportingDisabled {
+		log.Info("Changing reporting-disabled from %v to %v", self.Config.ReportingDisabled, newConfig.ReportingDisabled)
+		self.lock.Lock()
+		self.Config.ReportingDisabled = newConfig.ReportingDisabled
+		self.lock.Unlock()
+		if !self.Config.ReportingDisabled && !self.reportingStarted {
+			self.reportingStarted = true
+			go self.startReportingLoop()
+		}
+	}
+
+	if newConfig.ApiReadTimeout != self.Config.ApiReadTimeout {
+		log.Info("Changing api read timeout from %s to %s", self.Config.ApiReadTimeout, newConfig.ApiReadTimeout)
+		self.lock.Lock()
+		self.Config.ApiReadTimeout = newConfig.ApiReadTimeout
+		self.lock.Unlock()
+		self.HttpApi.SetReadTimeout(newConfig.ApiReadTimeout)
+	}
+
+	if newConfig.GraphiteEnabled != self.Config.GraphiteEnabled ||
+		newConfig.GraphitePort != self.Config.GraphitePort ||
+		newConfig.GraphiteDatabase != self.Config.GraphiteDatabase ||
+		newConfig.GraphiteUdpEnabled != self.Config.GraphiteUdpEnabled {
+
+		log.Info("Graphite configuration changed, restarting the graphite listener")
+		self.GraphiteApi.Close()
+		self.lock.Lock()
+		self.Config.GraphiteEnabled = newConfig.GraphiteEnabled
+		self.Config.GraphitePort = newConfig.GraphitePort
+		self.Config.GraphiteDatabase = newConfig.GraphiteDatabase
+		self.Config.GraphiteUdpEnabled = newConfig.GraphiteUdpEnabled
+		self.GraphiteApi = graphite.NewServer(self.Config, self.Coordinator, self.ClusterConfig)
+		self.lock.Unlock()
+		self.startGraphiteServer()
+	}
+
+	if !reflect.DeepEqual(newConfig.UdpServers, self.Config.UdpServers) {
+		log.Info("Udp configuration changed, restarting the udp listeners")
+		self.stopUdpServers()
+		self.lock.Lock()
+		self.Config.UdpServers = newConfig.UdpServers
+		self.lock.Unlock()
+		self.startUdpServers()
+	}
+
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// log the settings that changed in the configuration file but can't
+// be applied without restarting the server
+func (self *Server) logIgnoredSettings(newConfig *configuration.Configuration) {
+	ignored := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"storage.dir", self.Config.DataDir, newConfig.DataDir},
+		{"storage.shard-dir", self.Config.ShardDir, newConfig.ShardDir},
+		{"sharding.pre-create-window", self.Config.ShardPreCreateWindow, newConfig.ShardPreCreateWindow},
+		{"sharding.pre-create-interval", self.Config.ShardPreCreateInterval, newConfig.ShardPreCreateInterval},
+		{"storage.write-buffer-high-water-mark", self.Config.WriteBufferHighWaterMark, newConfig.WriteBufferHighWaterMark},
+		{"storage.indexed-columns", self.Config.StorageIndexedColumns, newConfig.StorageIndexedColumns},
+		{"storage.field-type-mismatch", self.Config.StorageFieldTypeMismatch, newConfig.StorageFieldTypeMismatch},
+		{"raft.dir", self.Config.RaftDir, newConfig.RaftDir},
+		{"raft.port", self.Config.RaftServerPort, newConfig.RaftServerPort},
+		{"wal.dir", self.Config.WalDir, newConfig.WalDir},
+		{"wal.flush-mode", self.Config.WalFlushMode, newConfig.WalFlushMode},
+		{"wal.flush-interval", self.Config.WalFlushInterval, newConfig.WalFlushInterval},
+		{"cluster.protobuf_port", self.Config.ProtobufPort, newConfig.ProtobufPort},
+		{"cluster.protobuf-connections-per-server", self.Config.ProtobufConnectionsPerServer, newConfig.ProtobufConnectionsPerServer},
+		{"cluster.protobuf-dial-timeout", self.Config.ProtobufDialTimeout, newConfig.ProtobufDialTimeout},
+		{"cluster.protobuf-read-timeout", self.Config.ProtobufReadTimeout, newConfig.ProtobufReadTimeout},
+		{"cluster.protobuf-write-timeout", self.Config.ProtobufWriteTimeout, newConfig.ProtobufWriteTimeout},
+		{"cluster.protobuf-health-check-interval", self.Config.ProtobufHealthCheckInterval, newConfig.ProtobufHealthCheckInterval},
+		{"cluster.max-concurrent-queries", self.Config.MaxConcurrentQueries, newConfig.MaxConcurrentQueries},
+		{"cluster.max-queued-queries", self.Config.MaxQueuedQueries, newConfig.MaxQueuedQueries},
+		{"cluster.query-timeout", self.Config.QueryTimeout, newConfig.QueryTimeout},
+		{"cluster.slow-query-threshold", self.Config.SlowQueryThreshold, newConfig.SlowQueryThreshold},
+		{"cluster.slow-query-log-file", self.Config.SlowQueryLogFile, newConfig.SlowQueryLogFile},
+		{"cluster.slow-query-log-size", self.Config.SlowQueryLogSize, newConfig.SlowQueryLogSize},
+		{"cluster.query-cache-size", self.Config.QueryCacheSize, newConfig.QueryCacheSize},
+		{"cluster.query-cache-ttl", self.Config.QueryCacheTtl, newConfig.QueryCacheTtl},
+		{"cluster.query-cache-max-points", self.Config.QueryCacheMaxPoints, newConfig.QueryCacheMaxPoints},
+		{"cluster.clock-skew-threshold", self.Config.ClockSkewThreshold, newConfig.ClockSkewThreshold},
+		{"cluster.write-max-future", self.Config.WriteMaxFuture, newConfig.WriteMaxFuture},
+		{"cluster.write-max-age", self.Config.WriteMaxAge, newConfig.WriteMaxAge},
+		{"cluster.anti-entropy-delete-ttl", self.Config.AntiEntropyDeleteTtl, newConfig.AntiEntropyDeleteTtl},
+		{"quotas.default-database", self.Config.DefaultDatabaseQuota, newConfig.DefaultDatabaseQuota},
+		{"quotas.default-user", self.Config.DefaultUserQuota, newConfig.DefaultUserQuota},
+		{"quotas.databases", self.Config.DatabaseQuotas, newConfig.DatabaseQuotas},
+		{"quotas.users", self.Config.UserQuotas, newConfig.UserQuotas},
+		{"api.port", self.Config.ApiHttpPort, newConfig.ApiHttpPort},
+		{"admin.port", self.Config.AdminHttpPort, newConfig.AdminHttpPort},
+		{"bind-address", self.Config.BindAddress, newConfig.BindAddress},
+		{"reporting-host", self.Config.ReportingHost, newConfig.ReportingHost},
+		{"reporting-database", self.Config.ReportingDatabase, newConfig.ReportingDatabase},
+		{"reporting-interval", self.Config.ReportingInterval, newConfig.ReportingInterval},
+		{"logging.file", self.Config.LogFile, newConfig.LogFile},
+		{"logging.format", self.Config.LogFormat, newConfig.LogFormat},
+		{"logging.max-file-size", self.Config.LogMaxFileSize, newConfig.LogMaxFileSize},
+		{"logging.max-files", self.Config.LogMaxFiles, newConfig.LogMaxFiles},
+	}
+
+	for _, setting := range ignored {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			log.Warn("Ignoring change of %s from %v to %v, the server must be restarted for it to take effect", setting.name, setting.old, setting.new)
+		}
+	}
+}
+
+// Swaps the filters of the global logger for filters with the new log
+// level, the filters in use can't be changed while they're read by the
+// goroutines that are logging
+func setLogLevel(config *configuration.Configuration) {
+	logger := make(log.Logger, len(log.Global))
+	for name, filter := range log.Global {
+		logger[name] = config.NewLogFilter(filter.LogWriter)
+	}
+	log.Global = logger
+}
+
+func (self *Server) isStopped() bool {
+	select {
+	case <-self.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
 func (self *Server) Stop() {
-	if self.stopped {
+	self.StopWithTimeout(self.Config.ShutdownTimeout)
+}
+
+// StopWithTimeout stops accepting new connections on all the
+// listeners, waits up to drainTimeout for the in flight queries and
+// writes to finish and then shuts down the rest of the subsystems.
+func (self *Server) StopWithTimeout(drainTimeout time.Duration) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if self.isStopped() {
 		return
 	}
 	log.Info("Stopping server")
-	self.stopped = true
+	close(self.shutdown)
 
 	log.Info("Stopping api server")
 	self.HttpApi.Close()
@@ -226,6 +611,26 @@ func (self *Server) Stop() {
 	self.AdminServer.Close()
 	log.Info("admin server stopped")
 
+	log.Info("Stopping graphite server")
+	self.lock.RLock()
+	graphiteApi := self.GraphiteApi
+	self.lock.RUnlock()
+	graphiteApi.Close()
+	log.Info("graphite server stopped")
+
+	log.Info("Stopping udp servers")
+	self.stopUdpServers()
+	log.Info("udp servers stopped")
+
+	log.Info("Waiting up to %s for pending requests to finish", drainTimeout)
+	if coord, ok := self.Coordinator.(*coordinator.CoordinatorImpl); ok {
+		if abandoned := coord.WaitForPendingRequests(drainTimeout); abandoned > 0 {
+			log.Warn("Drain timeout of %s elapsed, abandoning %d pending requests", drainTimeout, abandoned)
+		} else {
+			log.Info("All pending requests finished")
+		}
+	}
+
 	log.Info("Stopping raft server")
 	self.RaftServer.Close()
 	log.Info("Raft server stopped")
@@ -0,0 +1,240 @@
+package wal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	logger "code.google.com/p/log4go"
+)
+
+// The compressed copies of a log file and its index are written to
+// files with this prefix first, they're renamed to this prefix once
+// both are complete
+const (
+	compressingPrefix = "compressing."
+	compressedPrefix  = "compressed."
+)
+
+func compressRequest(request []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(buffer)
+	if _, err := writer.Write(request); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompressRequest(request []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// Rewrites a log file that was rotated with its requests gzipped in the
+// background, the wal keeps appending to the new log file meanwhile.
+// The compressed copies replace the log file and its index once the
+// wal goroutine gets them, or when the wal is closed.
+func (self *WAL) compressLogFileInBackground(log *log, index *index) {
+	self.compressions.Add(1)
+	go func() {
+		defer self.compressions.Done()
+		e, err := self.compressLogFile(log, index)
+		if err != nil {
+			logger.Error("Cannot compress %s: %s", log.file.Name(), err)
+			return
+		}
+		select {
+		case self.entries <- e:
+		case <-self.closing:
+			// processClose waits for the compressions to finish
+			self.processCompressedEntry(e)
+		}
+	}()
+}
+
+// Writes the compressed copies of the log file and its index, the log
+// file isn't written to anymore and the copies are only read here
+func (self *WAL) compressLogFile(log *log, index *index) (*compressedEntry, error) {
+	logName := log.file.Name()
+	indexName := index.f.Name()
+	tmpLogName := path.Join(self.config.WalDir, compressingPrefix+path.Base(logName))
+	tmpIndexName := path.Join(self.config.WalDir, compressingPrefix+path.Base(indexName))
+
+	size, offsets, err := writeCompressedLogFile(logName, tmpLogName)
+	if err != nil {
+		os.Remove(tmpLogName)
+		return nil, err
+	}
+
+	entries := make([]*indexEntry, 0, len(index.Entries))
+	for _, entry := range index.Entries {
+		firstOffset, ok := offsets[entry.FirstOffset]
+		lastOffset, ok2 := offsets[entry.LastOffset]
+		if !ok || !ok2 {
+			os.Remove(tmpLogName)
+			return nil, fmt.Errorf("the index of %s doesn't match the log file", logName)
+		}
+		entries = append(entries, &indexEntry{entry.FirstRequestNumber, entry.LastRequestNumber, firstOffset, lastOffset})
+	}
+	if err := writeIndexFile(tmpIndexName, entries); err != nil {
+		os.Remove(tmpLogName)
+		os.Remove(tmpIndexName)
+		return nil, err
+	}
+	return &compressedEntry{log, index, size, entries, tmpLogName, tmpIndexName}, nil
+}
+
+// Replaces the log file and its index with their compressed copies,
+// unless the log file was deleted while it was compressed. Called by
+// the wal goroutine, or once it stopped. The replays don't look up an
+// offset in the index or open the file until both are replaced.
+func (self *WAL) processCompressedEntry(e *compressedEntry) {
+	logName := e.log.file.Name()
+	if !self.hasLogFile(e.log) {
+		os.Remove(e.tmpLogName)
+		os.Remove(e.tmpIndexName)
+		return
+	}
+
+	e.log.lock.Lock()
+	defer e.log.lock.Unlock()
+	// once the log file is renamed the compression is finished by
+	// recoverCompressedLogFiles if the server crashes
+	doneLogName := path.Join(self.config.WalDir, compressedPrefix+path.Base(logName))
+	if err := os.Rename(e.tmpLogName, doneLogName); err != nil {
+		logger.Error("Cannot compress %s: %s", logName, err)
+		return
+	}
+	if err := os.Rename(e.tmpIndexName, e.index.f.Name()); err != nil {
+		logger.Error("Cannot compress %s: %s", logName, err)
+		return
+	}
+	if err := os.Rename(doneLogName, logName); err != nil {
+		logger.Error("Cannot compress %s: %s", logName, err)
+		return
+	}
+
+	logger.Info("Compressed %s from %d to %d bytes", logName, e.log.fileSize, e.size)
+	e.log.fileSize = uint64(e.size)
+	e.index.Entries = e.entries
+}
+
+func (self *WAL) hasLogFile(log *log) bool {
+	for _, logFile := range self.logFiles {
+		if logFile == log {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the requests of the log file gzipped to a new file. Returns
+// the size of the new file and the new offset of each request, by the
+// offset it had in the log file.
+func writeCompressedLogFile(name, compressedName string) (int64, map[int64]int64, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(compressedName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer dst.Close()
+
+	offsets := map[int64]int64{0: 0}
+	var offset, compressedOffset int64
+	for {
+		hdr := &entryHeader{}
+		n, err := hdr.Read(src)
+		if err == io.EOF && n == 0 {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		request := make([]byte, hdr.length)
+		if _, err := io.ReadFull(src, request); err != nil {
+			return 0, nil, err
+		}
+		offset += int64(n) + int64(hdr.length)
+
+		if !hdr.compressed {
+			if request, err = compressRequest(request); err != nil {
+				return 0, nil, err
+			}
+			hdr.length = uint32(len(request))
+			hdr.checksum = crc32.ChecksumIEEE(request)
+			hdr.hasChecksum = true
+			hdr.compressed = true
+		}
+		written, err := hdr.Write(dst)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := dst.Write(request); err != nil {
+			return 0, nil, err
+		}
+		compressedOffset += int64(written) + int64(len(request))
+		offsets[offset] = compressedOffset
+	}
+	return compressedOffset, offsets, dst.Sync()
+}
+
+func writeIndexFile(name string, entries []*indexEntry) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the version, which is 1 right now
+	fmt.Fprintf(f, "%d\n", 1)
+	for _, entry := range entries {
+		fmt.Fprintf(f, "%d,%d,%d,%d\n", entry.FirstRequestNumber, entry.FirstOffset, entry.LastRequestNumber, entry.LastOffset)
+	}
+	return f.Sync()
+}
+
+// Finishes the compressions that were interrupted after both files
+// were written and removes the partial files of the others
+func recoverCompressedLogFiles(dir string, names []string) error {
+	for _, name := range names {
+		if !strings.HasPrefix(name, compressedPrefix) {
+			continue
+		}
+		logName := strings.TrimPrefix(name, compressedPrefix)
+		indexName := "index." + strings.TrimPrefix(logName, "log.")
+		logger.Info("Finishing the compression of %s", logName)
+		err := os.Rename(path.Join(dir, compressingPrefix+indexName), path.Join(dir, indexName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(path.Join(dir, name), path.Join(dir, logName)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, compressingPrefix) {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -20,6 +20,29 @@ type commitEntry struct {
 	requestNumber uint32
 }
 
+type pendingRequestsEntry struct {
+	pending chan map[uint32]uint32
+}
+
+type unflushedRequestsEntry struct {
+	unflushed chan int
+}
+
+type logFilesEntry struct {
+	logFiles chan int
+}
+
+// sent by the background compression of a log file once the compressed
+// copies of the log file and its index are written
+type compressedEntry struct {
+	log          *log
+	index        *index
+	size         int64
+	entries      []*indexEntry
+	tmpLogName   string
+	tmpIndexName string
+}
+
 type appendEntry struct {
 	confirmation chan *confirmation
 	request      *protocol.Request
@@ -2,19 +2,50 @@ package wal
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io"
+	"protocol"
 )
 
+// set in the length of the entries whose header ends with the crc32 of
+// the request, the entries written by older versions don't have one
+const checksumFlag = 1 << 31
+
+// set in the length of the entries whose request is gzipped, only the
+// entries with a checksum can be compressed
+const compressedFlag = 1 << 30
+
 type entryHeader struct {
 	requestNumber uint32
 	shardId       uint32
 	length        uint32
+	checksum      uint32
+	hasChecksum   bool
+	compressed    bool
+}
+
+func newEntryHeader(requestNumber, shardId uint32, request []byte) *entryHeader {
+	return &entryHeader{
+		requestNumber: requestNumber,
+		shardId:       shardId,
+		length:        uint32(len(request)),
+		checksum:      crc32.ChecksumIEEE(request),
+		hasChecksum:   true,
+	}
 }
 
 func (self *entryHeader) Write(w io.Writer) (int, error) {
 	size := 0
 
-	for _, n := range []uint32{self.requestNumber, self.shardId, self.length} {
+	fields := []uint32{self.requestNumber, self.shardId, self.length}
+	if self.hasChecksum {
+		length := self.length | checksumFlag
+		if self.compressed {
+			length |= compressedFlag
+		}
+		fields = []uint32{self.requestNumber, self.shardId, length, self.checksum}
+	}
+	for _, n := range fields {
 		if err := binary.Write(w, binary.BigEndian, n); err != nil {
 			return size, err
 		}
@@ -32,5 +63,36 @@ func (self *entryHeader) Read(r io.Reader) (int, error) {
 		}
 		size += 4
 	}
-	return size, nil
+
+	self.hasChecksum = self.length&checksumFlag != 0
+	if !self.hasChecksum {
+		return size, nil
+	}
+	self.compressed = self.length&compressedFlag != 0
+	self.length &^= checksumFlag | compressedFlag
+	if err := binary.Read(r, binary.BigEndian, &self.checksum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return size, err
+	}
+	return size + 4, nil
+}
+
+// Returns false if the request doesn't match the checksum, the entries
+// without a checksum are always valid
+func (self *entryHeader) verify(request []byte) bool {
+	return !self.hasChecksum || crc32.ChecksumIEEE(request) == self.checksum
+}
+
+// Decodes the request that follows the header
+func (self *entryHeader) decode(bytes []byte) (*protocol.Request, error) {
+	if self.compressed {
+		var err error
+		if bytes, err = decompressRequest(bytes); err != nil {
+			return nil, err
+		}
+	}
+	request := &protocol.Request{}
+	return request, request.Decode(bytes)
 }
@@ -9,6 +9,7 @@ import (
 	"protocol"
 	"strconv"
 	"strings"
+	"sync"
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
@@ -21,6 +22,10 @@ type log struct {
 	requestsSinceLastFlush int
 	config                 *configuration.Configuration
 	cachedSuffix           uint32
+	// held while the file and its index are replaced with their
+	// compressed copies, the offsets in the index only match the file
+	// that was opened with it
+	lock sync.RWMutex
 }
 
 func newLog(file *os.File, config *configuration.Configuration) (*log, error) {
@@ -47,50 +52,76 @@ func newLog(file *os.File, config *configuration.Configuration) (*log, error) {
 	return l, l.check()
 }
 
+// Truncates the file at the first invalid entry, so the entries after
+// an unclean shutdown aren't replayed
 func (self *log) check() error {
 	file, err := self.dupLogFile()
 	if err != nil {
 		return err
 	}
-	info, err := file.Stat()
+	defer file.Close()
+
+	_, offset, reason, err := scanLogFile(file)
 	if err != nil {
 		return err
 	}
+	if reason == "" {
+		return nil
+	}
+	logger.Warn("%s was truncated to %d since %s", self.file.Name(), offset, reason)
+	if err := self.file.Truncate(offset); err != nil {
+		return err
+	}
+	self.fileSize = uint64(offset)
+	return nil
+}
+
+// Reads the entries of the file from the beginning. Returns the number
+// of valid entries, the offset of the first invalid entry and the
+// reason it's invalid. The offset is the size of the file and the
+// reason is empty if all the entries are valid.
+func scanLogFile(file *os.File) (int, int64, string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, "", err
+	}
 	size := info.Size()
 	offset, err := file.Seek(0, os.SEEK_SET)
 	if err != nil {
-		return err
+		return 0, 0, "", err
 	}
+
+	entries := 0
 	for {
-		n, hdr, err := self.getNextHeader(file)
-		if err != nil {
-			return err
+		hdr := &entryHeader{}
+		n, err := hdr.Read(file)
+		switch {
+		case err == io.EOF && n == 0:
+			return entries, offset, "", nil
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return entries, offset, "the file ends prematurely", nil
+		case err != nil:
+			return entries, offset, "", err
 		}
-		if n == 0 || hdr.length == 0 {
-			logger.Warn("%s was truncated to %d since the file has a zero size request", self.file.Name(), offset)
-			return self.file.Truncate(offset)
+		if hdr.length == 0 {
+			return entries, offset, "the file has a zero size request", nil
 		}
 		if offset+int64(n)+int64(hdr.length) > size {
-			// file is incomplete, truncate
-			logger.Warn("%s was truncated to %d since the file ends prematurely", self.file.Name(), offset)
-			return self.file.Truncate(offset)
+			return entries, offset, "the file ends prematurely", nil
 		}
 		bytes := make([]byte, hdr.length)
-		_, err = file.Read(bytes)
-		if err != nil {
-			return err
+		if _, err := io.ReadFull(file, bytes); err != nil {
+			return entries, offset, "", err
 		}
-
-		// this request is invalid truncate file
-		req := &protocol.Request{}
-		err = req.Decode(bytes)
-		if err != nil {
-			logger.Warn("%s was truncated to %d since the end of the file contains invalid data", self.file.Name(), offset)
-			// truncate file and return
-			return self.file.Truncate(offset)
+		if !hdr.verify(bytes) {
+			return entries, offset, "the request has an invalid checksum", nil
+		}
+		if _, err := hdr.decode(bytes); err != nil {
+			return entries, offset, "the request contains invalid data", nil
 		}
 
 		offset += int64(n) + int64(hdr.length)
+		entries++
 	}
 }
 
@@ -124,12 +155,9 @@ func (self *log) appendRequest(request *protocol.Request, shardId uint32) error
 	if err != nil {
 		return err
 	}
-	// every request is preceded with the length, shard id and the request number
-	hdr := &entryHeader{
-		shardId:       shardId,
-		requestNumber: request.GetRequestNumber(),
-		length:        uint32(len(bytes)),
-	}
+	// every request is preceded with the length, shard id, the request
+	// number and the checksum of the request
+	hdr := newEntryHeader(request.GetRequestNumber(), shardId, bytes)
 	writtenHdrBytes, err := hdr.Write(self.file)
 	if err != nil {
 		logger.Error("Error while writing header: %s", err)
@@ -161,8 +189,10 @@ func (self *log) dupAndReplayFromOffset(shardIds []uint32, offset int64, rn uint
 	stopChan := make(chan struct{}, 1)
 	replayChan := make(chan *replayRequest, 10)
 
+	// the file is opened before returning, the callers that hold the
+	// lock replay the file that matches the offset
+	file, err := self.dupLogFile()
 	go func() {
-		file, err := self.dupLogFile()
 		if err != nil {
 			sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
 			close(replayChan)
@@ -284,8 +314,14 @@ func (self *log) replayFromFileLocation(file *os.File,
 			return
 		}
 
-		req := &protocol.Request{}
-		err = req.Decode(bytes)
+		if !hdr.verify(bytes) {
+			// the replay stops at the last valid request instead of
+			// applying the corrupted one
+			logger.Error("%s has a request with an invalid checksum at %d, stopping the replay", file.Name(), offset)
+			return
+		}
+
+		req, err := hdr.decode(bytes)
 		if err != nil {
 			sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
 			return
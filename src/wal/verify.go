@@ -0,0 +1,52 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The result of verifying a log file of the wal
+type LogFileStatus struct {
+	Name string
+	// the number of valid entries
+	Entries int
+	// the offset of the first invalid entry and the reason it's
+	// invalid, the file is valid if the reason is empty
+	InvalidOffset int64
+	Reason        string
+}
+
+func (self *LogFileStatus) IsValid() bool {
+	return self.Reason == ""
+}
+
+// Verifies the entries of the log files in dir without changing them,
+// the wal truncates the files at the first invalid entry once it's
+// opened
+func VerifyLogFiles(dir string) ([]*LogFileStatus, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*LogFileStatus{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), "log.") {
+			continue
+		}
+		name := path.Join(dir, info.Name())
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		entries, offset, reason, err := scanLogFile(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, &LogFileStatus{name, entries, offset, reason})
+	}
+	return statuses, nil
+}
@@ -3,12 +3,15 @@ package wal
 import (
 	"configuration"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"protocol"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
@@ -22,6 +25,10 @@ type WAL struct {
 	serverId          uint32
 	nextLogFileSuffix uint32
 	entries           chan interface{}
+	// closed once the wal is closing, the background compressions of the
+	// log files finish on their own then
+	closing      chan struct{}
+	compressions sync.WaitGroup
 
 	// counters to force index creation, bookmark and flushing
 	requestsSinceLastFlush    int
@@ -56,6 +63,9 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := recoverCompressedLogFiles(config.WalDir, names); err != nil {
+		return nil, err
+	}
 
 	state, err := newGlobalState(path.Join(config.WalDir, "bookmark"))
 	if err != nil {
@@ -70,6 +80,7 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 		logIndex: []*index{},
 		state:    state,
 		entries:  make(chan interface{}, 10),
+		closing:  make(chan struct{}),
 	}
 
 	for _, name := range names {
@@ -153,44 +164,48 @@ func (self *WAL) RecoverServerFromRequestNumber(requestNumber uint32, shardIds [
 		return nil
 	}
 
-	firstIndex := 0
-	firstOffset := int64(-1)
+	// issue #522. Copy the log files, otherwise a commit may cause
+	// self.logFiles to be shifted to the left and `idx` in the loop
+	// will be off by one, then by two, etc.
+	logFiles := make([]*log, len(self.logFiles))
+	copy(logFiles, self.logFiles)
+	logIndex := make([]*index, len(self.logIndex))
+	copy(logIndex, self.logIndex)
+
 	// find the log file from which replay will start if the request
 	// number is in range, otherwise replay from all log files
 	if !self.isInRange(requestNumber) {
 		return nil
 	}
 
-	for idx, logIndex := range self.logIndex {
-		logger.Debug("Trying to find request %d in %s", requestNumber, self.logFiles[idx].file.Name())
-		if firstOffset = logIndex.requestOffset(requestNumber); firstOffset != -1 {
-			logger.Debug("Found reqeust %d in %s at offset %d", requestNumber, self.logFiles[idx].file.Name(), firstOffset)
+	// the request must be at the end of the current log file if it
+	// isn't in any of the indexes
+	firstIndex := len(logIndex) - 1
+	for idx := range logIndex {
+		logger.Debug("Trying to find request %d in %s", requestNumber, logFiles[idx].file.Name())
+		logFiles[idx].lock.RLock()
+		found := logIndex[idx].requestOffset(requestNumber) != -1
+		logFiles[idx].lock.RUnlock()
+		if found {
 			firstIndex = idx
 			break
 		}
 	}
 
-	// the request must be at the end of the current log file
-	if firstOffset == -1 {
-		firstIndex = len(self.logIndex) - 1
-		firstOffset = self.logIndex[firstIndex].requestOrLastOffset(requestNumber)
-	}
-
-	// issue #522. Copy the log files, otherwise a commit may cause
-	// self.logFiles to be shifted to the left and `idx` in the loop
-	// will be off by one, then by two, etc.
-	logFiles := make([]*log, len(self.logFiles))
-	copy(logFiles, self.logFiles)
-
 outer:
 	for idx := firstIndex; idx < len(logFiles); idx++ {
 		logFile := logFiles[idx]
-		if idx > firstIndex {
-			firstOffset = -1
+		// the offset is looked up again with the file opened, since the
+		// compression of the file may have changed it meanwhile
+		logFile.lock.RLock()
+		firstOffset := int64(-1)
+		if idx == firstIndex {
+			firstOffset = logIndex[idx].requestOrLastOffset(requestNumber)
 		}
 		logger.Info("Replaying from %s:%d", logFile.file.Name(), firstOffset)
 		count := 0
 		ch, stopChan := logFile.dupAndReplayFromOffset(shardIds, firstOffset, requestNumber)
+		logFile.lock.RUnlock()
 		defer close(stopChan)
 		for {
 			x := <-ch
@@ -232,6 +247,19 @@ func (self *WAL) closeCommon(shouldBookmark bool) error {
 
 func (self *WAL) processClose(shouldBookmark bool) error {
 	logger.Info("Closing WAL")
+	close(self.closing)
+	self.compressions.Wait()
+	// the compressions that finished before the close was processed
+	for drained := false; !drained; {
+		select {
+		case e := <-self.entries:
+			if compressed, ok := e.(*compressedEntry); ok {
+				self.processCompressedEntry(compressed)
+			}
+		default:
+			drained = true
+		}
+	}
 	for idx, logFile := range self.logFiles {
 		logFile.syncFile()
 		logFile.close()
@@ -248,13 +276,39 @@ func (self *WAL) processClose(shouldBookmark bool) error {
 // PRIVATE functions
 
 func (self *WAL) processEntries() {
+	var flushTicks <-chan time.Time
+	if self.config.WalFlushMode != configuration.WalFlushAsync && self.config.WalFlushInterval > 0 {
+		ticker := time.NewTicker(self.config.WalFlushInterval)
+		defer ticker.Stop()
+		flushTicks = ticker.C
+	}
+
 	for {
-		e := <-self.entries
+		var e interface{}
+		select {
+		case e = <-self.entries:
+		case <-flushTicks:
+			if self.requestsSinceLastFlush > 0 && len(self.logFiles) > 0 {
+				if err := self.flush(); err != nil {
+					logger.Error("Cannot flush the wal: %s", err)
+				}
+			}
+			continue
+		}
+
 		switch x := e.(type) {
 		case *commitEntry:
 			self.processCommitEntry(x)
 		case *appendEntry:
 			self.processAppendEntry(x)
+		case *pendingRequestsEntry:
+			x.pending <- self.pendingRequests()
+		case *unflushedRequestsEntry:
+			x.unflushed <- self.requestsSinceLastFlush
+		case *logFilesEntry:
+			x.logFiles <- len(self.logFiles)
+		case *compressedEntry:
+			self.processCompressedEntry(x)
 		case *bookmarkEntry:
 			err := self.bookmark()
 			if err != nil {
@@ -321,16 +375,80 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 		return
 	}
 
-	self.conditionalBookmarkAndIndex()
-	e.confirmation <- &confirmation{e.request.GetRequestNumber(), nil}
+	// in sync mode the request is only confirmed once it's on disk
+	err = self.conditionalBookmarkAndIndex()
+	e.confirmation <- &confirmation{e.request.GetRequestNumber(), err}
 }
 
 func (self *WAL) processCommitEntry(e *commitEntry) {
 	logger.Debug("commiting %d for server %d", e.requestNumber, e.serverId)
 	self.state.commitRequestNumber(e.serverId, e.requestNumber)
+	self.deleteUnusedLogFiles()
+	e.confirmation <- &confirmation{0, nil}
+}
+
+// Returns the number of requests logged since the last commit of each
+// server, i.e. the requests that are replayed to servers that are
+// down once they're back
+func (self *WAL) PendingRequests() map[uint32]uint32 {
+	pending := make(chan map[uint32]uint32)
+	self.entries <- &pendingRequestsEntry{pending}
+	return <-pending
+}
+
+// Returns the number of requests logged since the log file was last
+// fsynced, i.e. the requests that can be lost if the machine crashes
+func (self *WAL) UnflushedRequests() int {
+	unflushed := make(chan int)
+	self.entries <- &unflushedRequestsEntry{unflushed}
+	return <-unflushed
+}
+
+// Returns the number of log files, the log files are deleted once all
+// their requests were committed by every server
+func (self *WAL) LogFiles() int {
+	logFiles := make(chan int)
+	self.entries <- &logFilesEntry{logFiles}
+	return <-logFiles
+}
+
+func (self *WAL) pendingRequests() map[uint32]uint32 {
+	pending := make(map[uint32]uint32, len(self.state.ServerLastRequestNumber))
+	for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+		// the subtraction is correct when the request numbers roll over
+		pending[serverId] = self.state.LargestRequestNumber - requestNumber
+	}
+	return pending
+}
+
+// Drops the oldest requests of the servers that have more than
+// WalMaxPendingRequests requests pending, so a server that stays down
+// doesn't make the wal grow until the disk is full
+func (self *WAL) dropExcessPendingRequests() {
+	max := uint32(self.config.WalMaxPendingRequests)
+	if max == 0 {
+		return
+	}
+
+	dropped := false
+	for serverId, pending := range self.pendingRequests() {
+		if pending <= max {
+			continue
+		}
+		logger.Warn("Server %d has %d pending requests, dropping the oldest %d. The server will miss these writes.", serverId, pending, pending-max)
+		self.state.commitRequestNumber(serverId, self.state.LargestRequestNumber-max)
+		dropped = true
+	}
+	if dropped {
+		self.deleteUnusedLogFiles()
+	}
+}
+
+// Deletes the log files that have no requests that still have to be
+// replayed to a server
+func (self *WAL) deleteUnusedLogFiles() {
 	idx := self.firstLogFile()
 	if idx == 0 {
-		e.confirmation <- &confirmation{0, nil}
 		return
 	}
 
@@ -349,7 +467,6 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		logIndex.delete()
 	}
 	self.state.FirstSuffix = self.logFiles[0].suffix()
-	e.confirmation <- &confirmation{0, nil}
 }
 
 // creates a new log file using the next suffix and initializes its
@@ -424,7 +541,11 @@ func (self *WAL) firstLogFile() int {
 }
 
 func (self *WAL) shouldRotateTheLogFile() bool {
-	return self.requestsSinceRotation >= self.config.WalRequestsPerLogFile
+	if self.requestsSinceRotation >= self.config.WalRequestsPerLogFile {
+		return true
+	}
+	max := self.config.WalMaxLogFileSize
+	return max > 0 && self.logFiles[len(self.logFiles)-1].fileSize >= uint64(max)
 }
 
 func (self *WAL) recover() error {
@@ -504,18 +625,31 @@ func (self *WAL) rotateTheLogFile(nextRequestNumber uint32) (bool, error) {
 	if err := lastIndex.syncFile(); err != nil {
 		return false, err
 	}
+	self.requestsSinceLastFlush = 0
 	lastLogFile.close()
 	lastIndex.close()
+	if self.config.WalCompressLogFiles {
+		self.compressLogFileInBackground(lastLogFile, lastIndex)
+	}
 	lastLogFile, err := self.createNewLog(nextRequestNumber + 1)
 	if err != nil {
 		return false, err
 	}
 	logger.Info("Rotating log. New log file %s", lastLogFile.file.Name())
+	self.dropExcessPendingRequests()
 	return true, nil
 }
 
-func (self *WAL) conditionalBookmarkAndIndex() {
+// Returns the error of the flush, if the log file had to be flushed
+func (self *WAL) conditionalBookmarkAndIndex() error {
 	shouldFlush := false
+	switch self.config.WalFlushMode {
+	case configuration.WalFlushSync:
+		shouldFlush = true
+	case configuration.WalFlushAsync:
+	default:
+		shouldFlush = self.requestsSinceLastFlush >= self.config.WalFlushAfterRequests
+	}
 	logger.Debug("requestsSinceLastIndex: %d", self.requestsSinceLastIndex)
 	if self.requestsSinceLastIndex >= self.config.WalIndexAfterRequests {
 		self.index()
@@ -525,9 +659,10 @@ func (self *WAL) conditionalBookmarkAndIndex() {
 		self.bookmark()
 	}
 
-	if self.requestsSinceLastFlush >= self.config.WalFlushAfterRequests || shouldFlush {
-		self.flush()
+	if shouldFlush {
+		return self.flush()
 	}
+	return nil
 }
 
 func (self *WAL) flush() error {
@@ -550,6 +685,24 @@ func (self *WAL) CreateCheckpoint() error {
 	return confirmation.err
 }
 
+// Returns the total size in bytes of the log, index and bookmark
+// files in the wal directory
+func (self *WAL) Size() (int64, error) {
+	infos, err := ioutil.ReadDir(self.config.WalDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
 func (self *WAL) bookmark() error {
 	if err := self.state.writeToFile(); err != nil {
 		logger.Error("Cannot write bookmark %s", err)
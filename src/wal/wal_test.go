@@ -90,6 +90,20 @@ func (_ *WalSuite) TestRequestNumberAssignment(c *C) {
 	c.Assert(id, Equals, uint32(2))
 }
 
+func (_ *WalSuite) TestSyncModeReportsTheFlushErrors(c *C) {
+	wal := newWal(c)
+	wal.config.WalFlushMode = configuration.WalFlushSync
+	_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+
+	// the request can still be written but the fsync fails
+	c.Assert(wal.logIndex[len(wal.logIndex)-1].close(), IsNil)
+	confirmationChan := make(chan *confirmation)
+	wal.entries <- &appendEntry{confirmationChan, generateRequest(2), 1}
+	confirmation := <-confirmationChan
+	c.Assert(confirmation.err, NotNil)
+}
+
 func (_ *WalSuite) TestRequestNumberAssignmentRecovery(c *C) {
 	wal := newWal(c)
 	request := generateRequest(2)
@@ -135,6 +149,81 @@ func (_ *WalSuite) TestLogFilesReplay(c *C) {
 	c.Assert(requests, Equals, 4000)
 }
 
+func (_ *WalSuite) TestCompressedLogFilesReplay(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 1000
+	wal.config.WalIndexAfterRequests = 100
+	wal.config.WalCompressLogFiles = true
+	for i := 0; i < 2500; i++ {
+		request := generateRequest(2)
+		id, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, uint32(i+1))
+	}
+	c.Assert(wal.Close(), IsNil)
+
+	statuses, err := VerifyLogFiles(wal.config.WalDir)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 3)
+	for _, status := range statuses {
+		c.Assert(status.IsValid(), Equals, true)
+	}
+
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	requests := []uint32{}
+	err = wal.RecoverServerFromRequestNumber(1500, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req.GetRequestNumber())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 1001)
+	c.Assert(requests[0], Equals, uint32(1500))
+}
+
+func (_ *WalSuite) TestReplayWhileLogFilesAreCompressed(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 1000
+	wal.config.WalIndexAfterRequests = 100
+	for i := 0; i < 1500; i++ {
+		request := generateRequest(100)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.logFiles, HasLen, 2)
+	log, index := wal.logFiles[0], wal.logIndex[0]
+	size := log.fileSize
+
+	compressed := make(chan struct{})
+	go func() {
+		defer close(compressed)
+		e, err := wal.compressLogFile(log, index)
+		c.Check(err, IsNil)
+		wal.entries <- e
+	}()
+
+	for done := false; !done; {
+		select {
+		case <-compressed:
+			done = true
+		default:
+		}
+		requests := []uint32{}
+		err := wal.RecoverServerFromRequestNumber(750, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+			requests = append(requests, req.GetRequestNumber())
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(requests, HasLen, 751)
+		for i, requestNumber := range requests {
+			c.Assert(requestNumber, Equals, uint32(750+i))
+		}
+	}
+	c.Assert(wal.Close(), IsNil)
+	c.Assert(log.fileSize < size, Equals, true)
+}
+
 func (_ *WalSuite) TestLogFilesCompaction(c *C) {
 	wal := newWal(c)
 	wal.config.WalRequestsPerLogFile = 2000
@@ -158,6 +247,26 @@ func (_ *WalSuite) TestLogFilesCompaction(c *C) {
 	c.Assert(os.IsNotExist(err), Equals, true)
 }
 
+func (_ *WalSuite) TestMaxPendingRequests(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 1000
+	wal.config.WalMaxPendingRequests = 500
+	wal.Commit(1, 1)
+	wal.Commit(1, 2)
+	for i := 0; i < 2500; i++ {
+		request := generateRequest(2)
+		id, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+		c.Assert(wal.Commit(id, 1), IsNil)
+	}
+	// server 2 is down, the requests it missed before the last
+	// rotation beyond the limit are dropped
+	c.Assert(wal.logFiles, HasLen, 2)
+	pending := wal.PendingRequests()
+	c.Assert(pending[1], Equals, uint32(0))
+	c.Assert(pending[2], Equals, uint32(1000))
+}
+
 func (_ *WalSuite) TestMultipleLogFiles(c *C) {
 	wal := newWal(c)
 	wal.config.WalRequestsPerLogFile = 2000
@@ -188,6 +297,25 @@ func (_ *WalSuite) TestMultipleLogFiles(c *C) {
 	c.Assert(len(requests), Equals, 2000)
 }
 
+func (_ *WalSuite) TestLogFileRotationBySize(c *C) {
+	wal := newWal(c)
+	wal.config.WalMaxLogFileSize = 1024
+	for i := 0; i < 100; i++ {
+		request := generateRequest(2)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	logFiles := wal.LogFiles()
+	c.Assert(logFiles > 2, Equals, true)
+	for _, log := range wal.logFiles[:logFiles-1] {
+		c.Assert(log.fileSize < 2048, Equals, true)
+	}
+
+	// the log files are deleted once the requests are committed
+	c.Assert(wal.Commit(100, 1), IsNil)
+	c.Assert(wal.LogFiles() <= 2, Equals, true)
+}
+
 func (_ *WalSuite) TestAutoBookmark(c *C) {
 	wal := newWal(c)
 	wal.config.WalBookmarkAfterRequests = 2
@@ -390,7 +518,7 @@ func (_ *WalSuite) TestInvalidData(c *C) {
 	c.Assert(err, IsNil)
 	defer file.Close()
 	bytes := []byte{'a', 'b', 'c', 'd'}
-	hdr := &entryHeader{1, 1, 4}
+	hdr := &entryHeader{requestNumber: 1, shardId: 1, length: 4}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	_, err = file.Write(bytes)
@@ -410,6 +538,51 @@ func (_ *WalSuite) TestInvalidData(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (_ *WalSuite) TestInvalidChecksum(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 2; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Close(), IsNil)
+
+	// flip the last byte of the second request
+	filePath := path.Join(wal.config.WalDir, "log.1")
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	info, err := file.Stat()
+	c.Assert(err, IsNil)
+	b := make([]byte, 1)
+	_, err = file.ReadAt(b, info.Size()-1)
+	c.Assert(err, IsNil)
+	_, err = file.WriteAt([]byte{^b[0]}, info.Size()-1)
+	c.Assert(err, IsNil)
+
+	statuses, err := VerifyLogFiles(wal.config.WalDir)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 1)
+	c.Assert(statuses[0].IsValid(), Equals, false)
+	c.Assert(statuses[0].Entries, Equals, 1)
+	c.Assert(statuses[0].InvalidOffset, Equals, info.Size()/2)
+
+	// the WAL should truncate to just the first request
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	requests := []*protocol.Request{}
+	err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+		requests = append(requests, req)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 1)
+
+	statuses, err = VerifyLogFiles(wal.config.WalDir)
+	c.Assert(err, IsNil)
+	c.Assert(statuses[0].IsValid(), Equals, true)
+}
+
 func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	wal := newWal(c)
 	req := generateRequest(2)
@@ -419,7 +592,7 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{1, 1, 500}
+	hdr := &entryHeader{requestNumber: 1, shardId: 1, length: 500}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	// write an incomplete request, 200 bytes as opposed to 500 bytes in
@@ -442,14 +615,14 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	// make sure the file is truncated
 	info, err := file.Stat()
 	c.Assert(err, IsNil)
-	c.Assert(info.Size(), Equals, int64(69))
+	c.Assert(info.Size(), Equals, int64(73))
 	// make sure appending a new request will increase the size of the
 	// file by just that request
 	_, err = wal.AssignSequenceNumbersAndLog(req, &MockShard{id: 1})
 	c.Assert(err, IsNil)
 	info, err = file.Stat()
 	c.Assert(err, IsNil)
-	c.Assert(info.Size(), Equals, int64(69*2))
+	c.Assert(info.Size(), Equals, int64(73*2))
 
 	requests = []*protocol.Request{}
 	wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
@@ -468,7 +641,7 @@ func (_ *WalSuite) TestAnotherRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{0, 0, 0}
+	hdr := &entryHeader{}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	defer file.Close()